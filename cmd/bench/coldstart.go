@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"zstd-learning/internal/dictfile"
+	"zstd-learning/internal/size"
+)
+
+// rawDictID is the ID the synthetic -dict-sizes dictionaries, which are
+// raw content, are registered under.
+const rawDictID = 1
+
+// coldstartPhases are the phases a probe times, in order, followed by the
+// total the parent measures around the whole subprocess.
+var coldstartPhases = []string{"read", "encoder_init", "compress", "decoder_init", "decompress", "process"}
+
+// probeTimings is what one bench coldstart-probe run prints, in
+// nanoseconds per phase.
+type probeTimings map[string]int64
+
+// coldstartDict is one dictionary measured by bench coldstart.
+type coldstartDict struct {
+	Name  string
+	Path  string
+	Raw   bool
+	Bytes int64
+}
+
+// phaseStats summarizes one phase over the iterations, in milliseconds.
+type phaseStats struct {
+	P50 float64 `json:"p50_ms"`
+	P90 float64 `json:"p90_ms"`
+	P99 float64 `json:"p99_ms"`
+	Max float64 `json:"max_ms"`
+}
+
+// coldstartResult is the outcome for one dictionary.
+type coldstartResult struct {
+	Dict       string                `json:"dict"`
+	DictBytes  int64                 `json:"dict_bytes"`
+	Iterations int                   `json:"iterations"`
+	Phases     map[string]phaseStats `json:"phases"`
+}
+
+// runColdstart handles bench coldstart: for each dictionary it starts a
+// fresh bench coldstart-probe process per iteration, so nothing is cached
+// in the process between iterations, and reports percentiles of each phase
+// from reading the dictionary to the first decompressed payload. The OS
+// page cache still holds the dictionary file after the first iteration.
+func runColdstart(args []string) {
+	fs := flag.NewFlagSet("coldstart", flag.ExitOnError)
+	dictPaths := fs.String("dict", "", "comma-separated dictionary files to measure (.zdict or .zdictpkg)")
+	dictSizes := fs.String("dict-sizes", "", "comma-separated sizes of synthetic raw dictionaries to measure, e.g. 16KiB,128KiB,1MiB (default when -dict is not given)")
+	iterations := fs.Int("n", 20, "fresh processes started per dictionary")
+	payloadPath := fs.String("payload", "", "file compressed and decompressed by each probe (default: a built-in JSON record)")
+	level := fs.Int("level", 0, "zstd compression level (0=default)")
+	format := fs.String("format", "text", "output format: text or json")
+	fs.Parse(args)
+
+	if *iterations <= 0 {
+		fmt.Fprintln(os.Stderr, "n must be positive")
+		os.Exit(1)
+	}
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "invalid -format %q (expected text or json)\n", *format)
+		os.Exit(1)
+	}
+	if *dictPaths == "" && *dictSizes == "" {
+		*dictSizes = "16KiB,128KiB,1MiB"
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to locate the bench binary: %v\n", err)
+		os.Exit(1)
+	}
+
+	workDir, err := os.MkdirTemp("", "zstd-coldstart-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create work dir: %v\n", err)
+		os.Exit(1)
+	}
+	fail := func(format string, args ...any) {
+		fmt.Fprintf(os.Stderr, "coldstart failed: %s\n", fmt.Sprintf(format, args...))
+		os.RemoveAll(workDir)
+		os.Exit(1)
+	}
+
+	dicts, err := coldstartDicts(*dictPaths, *dictSizes, workDir)
+	if err != nil {
+		fail("%v", err)
+	}
+	var results []coldstartResult
+	for _, d := range dicts {
+		if *format == "text" {
+			fmt.Printf("measuring %s (%d bytes), %d processes...\n", d.Name, d.Bytes, *iterations)
+		}
+		result, err := measureColdstart(exe, d, *iterations, *payloadPath, *level)
+		if err != nil {
+			fail("%s: %v", d.Name, err)
+		}
+		results = append(results, result)
+	}
+	os.RemoveAll(workDir)
+
+	if *format == "json" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			fail("%v", err)
+		}
+		fmt.Println(string(data))
+		return
+	}
+	printColdstart(results)
+}
+
+// coldstartDicts lists the dictionaries to measure, writing the synthetic
+// ones of the given sizes to dir.
+func coldstartDicts(paths, sizes, dir string) ([]coldstartDict, error) {
+	var dicts []coldstartDict
+	for _, path := range strings.Split(paths, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		loaded, err := dictfile.Load(path, false, "")
+		if err != nil {
+			return nil, err
+		}
+		dicts = append(dicts, coldstartDict{Name: filepath.Base(path), Path: path, Raw: loaded.Raw, Bytes: int64(len(loaded.Data))})
+	}
+	for _, value := range strings.Split(sizes, ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		n, err := size.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -dict-sizes entry %q: %w", value, err)
+		}
+		if n < 8 {
+			return nil, fmt.Errorf("invalid -dict-sizes entry %q: a dictionary needs at least 8 bytes", value)
+		}
+		path := filepath.Join(dir, "synthetic-"+value+".dict")
+		if err := os.WriteFile(path, syntheticDict(n), 0o644); err != nil {
+			return nil, err
+		}
+		dicts = append(dicts, coldstartDict{Name: "synthetic " + value, Path: path, Raw: true, Bytes: n})
+	}
+	return dicts, nil
+}
+
+// syntheticDict returns n bytes of generated JSON records, standing in for
+// a trained dictionary of that size: what init costs is mostly the size.
+func syntheticDict(n int64) []byte {
+	rng := rand.New(rand.NewSource(1))
+	words := []string{"alpha", "beta", "gamma", "delta", "Norway", "Sweden", "Sci-Fi", "Drama", "active", "pending"}
+	var buf bytes.Buffer
+	for i := 0; int64(buf.Len()) < n; i++ {
+		fmt.Fprintf(&buf, `{"id":%d,"name":"user%d","country":%q,"genre":%q,"status":%q,"score":%d}`+"\n",
+			i, rng.Intn(100000), words[rng.Intn(4)+4], words[rng.Intn(2)+6], words[rng.Intn(2)+8], rng.Intn(1000))
+	}
+	return buf.Bytes()[:n]
+}
+
+// measureColdstart runs iterations probes for d and summarizes them.
+func measureColdstart(exe string, d coldstartDict, iterations int, payloadPath string, level int) (coldstartResult, error) {
+	samples := map[string][]float64{}
+	for range iterations {
+		args := []string{"coldstart-probe", "-dict", d.Path, "-level", strconv.Itoa(level)}
+		if d.Raw {
+			args = append(args, "-raw")
+		}
+		if payloadPath != "" {
+			args = append(args, "-payload", payloadPath)
+		}
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(exe, args...)
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		start := time.Now()
+		err := cmd.Run()
+		elapsed := time.Since(start)
+		if err != nil {
+			return coldstartResult{}, fmt.Errorf("probe: %v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		var timings probeTimings
+		if err := json.Unmarshal(stdout.Bytes(), &timings); err != nil {
+			return coldstartResult{}, fmt.Errorf("probe output: %w", err)
+		}
+		timings["process"] = elapsed.Nanoseconds()
+		for _, phase := range coldstartPhases {
+			samples[phase] = append(samples[phase], float64(timings[phase])/1e6)
+		}
+	}
+
+	result := coldstartResult{Dict: d.Name, DictBytes: d.Bytes, Iterations: iterations, Phases: map[string]phaseStats{}}
+	for phase, values := range samples {
+		sort.Float64s(values)
+		result.Phases[phase] = phaseStats{
+			P50: percentile(values, 0.50),
+			P90: percentile(values, 0.90),
+			P99: percentile(values, 0.99),
+			Max: values[len(values)-1],
+		}
+	}
+	return result, nil
+}
+
+// percentile returns the nearest-rank percentile p of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	i := int(float64(len(sorted))*p+0.999999) - 1
+	return sorted[max(0, min(i, len(sorted)-1))]
+}
+
+func printColdstart(results []coldstartResult) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DICT\tBYTES\tPHASE\tP50 MS\tP90 MS\tP99 MS\tMAX MS")
+	for _, r := range results {
+		for _, phase := range coldstartPhases {
+			s := r.Phases[phase]
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%.3f\t%.3f\t%.3f\t%.3f\n", r.Dict, r.DictBytes, phase, s.P50, s.P90, s.P99, s.Max)
+		}
+	}
+	tw.Flush()
+}
+
+// coldstartPayload is compressed by probes without -payload: one generated
+// record, the size of a typical small object in a serverless request.
+const coldstartPayload = `{"id":4711,"name":"user4711","email":"user4711@example.com","country":"Norway","genre":"Sci-Fi","status":"active","tags":["alpha","beta"],"score":815}`
+
+// runColdstartProbe handles bench coldstart-probe, run by bench coldstart
+// in a fresh process per iteration: it times each phase once and prints the
+// timings as JSON.
+func runColdstartProbe(args []string) {
+	fs := flag.NewFlagSet("coldstart-probe", flag.ExitOnError)
+	dictPath := fs.String("dict", "", "dictionary file")
+	raw := fs.Bool("raw", false, "the dictionary is raw content")
+	payloadPath := fs.String("payload", "", "file to compress (default: a built-in JSON record)")
+	level := fs.Int("level", 0, "zstd compression level (0=default)")
+	fs.Parse(args)
+
+	timings, err := probeColdstart(*dictPath, *raw, *payloadPath, *level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	json.NewEncoder(os.Stdout).Encode(timings)
+}
+
+func probeColdstart(dictPath string, raw bool, payloadPath string, level int) (probeTimings, error) {
+	payload := []byte(coldstartPayload)
+	if payloadPath != "" {
+		var err error
+		if payload, err = os.ReadFile(payloadPath); err != nil {
+			return nil, err
+		}
+	}
+	timings := probeTimings{}
+	mark := time.Now()
+	lap := func(phase string) {
+		now := time.Now()
+		timings[phase] = now.Sub(mark).Nanoseconds()
+		mark = now
+	}
+
+	d, err := dictfile.Load(dictPath, raw, "")
+	if err != nil {
+		return nil, err
+	}
+	lap("read")
+
+	encOptions := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+	decOptions := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+	if d.Raw {
+		encOptions = append(encOptions, zstd.WithEncoderDictRaw(rawDictID, d.Data))
+		decOptions = append(decOptions, zstd.WithDecoderDictRaw(rawDictID, d.Data))
+	} else {
+		encOptions = append(encOptions, zstd.WithEncoderDict(d.Data))
+		decOptions = append(decOptions, zstd.WithDecoderDicts(d.Data))
+	}
+	if level != 0 {
+		encOptions = append(encOptions, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	encoder, err := zstd.NewWriter(nil, encOptions...)
+	if err != nil {
+		return nil, err
+	}
+	lap("encoder_init")
+	compressed := encoder.EncodeAll(payload, nil)
+	lap("compress")
+
+	decoder, err := zstd.NewReader(nil, decOptions...)
+	if err != nil {
+		return nil, err
+	}
+	lap("decoder_init")
+	decoded, err := decoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, err
+	}
+	lap("decompress")
+	if !bytes.Equal(decoded, payload) {
+		return nil, errors.New("payload did not round-trip")
+	}
+	return timings, nil
+}
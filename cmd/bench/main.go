@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"zstd-learning/internal/console"
+	"zstd-learning/internal/pushspool"
+)
+
+// dataTypes are the generate-data types benchmarked by default.
+var dataTypes = []string{"movies", "books", "people"}
+
+// typeResult compares plain and dictionary compression of one data type.
+type typeResult struct {
+	Type        string
+	Records     int
+	InputBytes  int64
+	PlainBytes  int64
+	DictBytes   int64
+	PlainRatio  float64
+	DictRatio   float64
+	Improvement float64 // share of the plain output the dictionary saves
+}
+
+var pushSpool *pushspool.Options
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		runSelftest(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "coldstart" {
+		runColdstart(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "coldstart-probe" {
+		runColdstartProbe(os.Args[2:])
+		return
+	}
+
+	types := flag.String("types", strings.Join(dataTypes, ","), "comma-separated generate-data types to benchmark")
+	count := flag.Int("n", 1000, "records generated per type")
+	seed := flag.Int64("seed", 42, "generate-data seed, so runs are comparable")
+	level := flag.Int("level", 0, "zstd compression level for both runs (0=default)")
+	dictSize := flag.Int("dict-size", 16*1024, "dictionary size in bytes passed to train-dict")
+	binDir := flag.String("bin-dir", "", "directory with built generate-data, train-dict and compress binaries (default: go run ./cmd/<tool> from the repository root)")
+	keep := flag.Bool("keep", false, "keep the temporary working directory and print its path")
+	verbose := flag.Bool("verbose", false, "show the output of each tool")
+	pushURL := flag.String("pushgateway", "http://localhost:9091", "Pushgateway base URL, also passed to every tool")
+	pushSpool = pushspool.Flags(flag.CommandLine)
+	colorFlag := flag.String("color", "auto", "colorize output: auto (only on a terminal), always, never")
+	flag.Parse()
+
+	colorMode, err := console.ParseMode(*colorFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	stdout := console.NewPrinter(colorMode, os.Stdout)
+	stderr := console.NewPrinter(colorMode, os.Stderr)
+
+	if *count <= 0 {
+		fmt.Fprintln(os.Stderr, "n must be positive")
+		os.Exit(1)
+	}
+	var selected []string
+	for _, t := range strings.Split(*types, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if !slices.Contains(dataTypes, t) {
+			fmt.Fprintf(os.Stderr, "unknown type: %s (expected %s)\n", t, strings.Join(dataTypes, ", "))
+			os.Exit(1)
+		}
+		selected = append(selected, t)
+	}
+	if len(selected) == 0 {
+		fmt.Fprintln(os.Stderr, "no types selected")
+		os.Exit(1)
+	}
+
+	workDir, err := os.MkdirTemp("", "zstd-bench-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create work dir: %v\n", err)
+		os.Exit(1)
+	}
+	// os.Exit skips deferred calls, so failures clean up through fail.
+	fail := func(format string, args ...any) {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", stderr.Red("benchmark failed"), fmt.Sprintf(format, args...))
+		if !*keep {
+			os.RemoveAll(workDir)
+		}
+		os.Exit(1)
+	}
+
+	tools := toolRunner{BinDir: *binDir, PushURL: *pushURL, Verbose: *verbose}
+	opts := benchOptions{Count: *count, Seed: *seed, Level: *level, DictSize: *dictSize}
+
+	start := time.Now()
+	var results []typeResult
+	for _, t := range selected {
+		fmt.Printf("benchmarking %s...\n", t)
+		result, err := benchType(tools, filepath.Join(workDir, t), t, opts)
+		if err != nil {
+			fail("%s: %v", t, err)
+		}
+		results = append(results, result)
+	}
+	duration := time.Since(start)
+
+	printResults(stdout, results)
+
+	if err := pushMetrics(*pushURL, results, duration, *count); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("metrics push failed"), err)
+		if !*keep {
+			os.RemoveAll(workDir)
+		}
+		os.Exit(1)
+	}
+
+	if *keep {
+		fmt.Printf("work files kept in %s\n", workDir)
+	} else if err := os.RemoveAll(workDir); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to remove %s: %v\n", workDir, err)
+		os.Exit(1)
+	}
+}
+
+func printResults(p console.Printer, results []typeResult) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tRECORDS\tINPUT\tPLAIN\tDICT\tPLAIN RATIO\tDICT RATIO\tSAVED")
+	for _, r := range results {
+		saved := fmt.Sprintf("%.1f%%", r.Improvement*100)
+		if r.Improvement > 0 {
+			saved = p.Green(saved)
+		} else {
+			saved = p.Red(saved)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t%s\t%s\n", r.Type, r.Records, r.InputBytes, r.PlainBytes, r.DictBytes, p.Ratio(r.PlainRatio), p.Ratio(r.DictRatio), saved)
+	}
+	tw.Flush()
+}
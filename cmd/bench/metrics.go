@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"zstd-learning/internal/pushspool"
+)
+
+func pushMetrics(pushURL string, results []typeResult, duration time.Duration, count int) error {
+	registry := prometheus.NewRegistry()
+
+	plainRatio := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bench_plain_ratio",
+		Help: "Output/input ratio without a dictionary per data type in the last benchmark.",
+	}, []string{"type"})
+	dictRatio := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bench_dict_ratio",
+		Help: "Output/input ratio with a per-type dictionary in the last benchmark.",
+	}, []string{"type"})
+	ratioDelta := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bench_dict_ratio_delta",
+		Help: "Plain ratio minus dictionary ratio per data type (positive means the dictionary helped).",
+	}, []string{"type"})
+	improvement := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bench_dict_improvement",
+		Help: "Share of the plain compressed bytes saved by the dictionary per data type.",
+	}, []string{"type"})
+	durationGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bench_duration_seconds",
+		Help: "Duration of the last benchmark run in seconds.",
+	})
+	timestampGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bench_last_run_timestamp_seconds",
+		Help: "Unix timestamp of the last benchmark run.",
+	})
+
+	for _, metric := range []prometheus.Collector{plainRatio, dictRatio, ratioDelta, improvement, durationGauge, timestampGauge} {
+		if err := registry.Register(metric); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range results {
+		plainRatio.WithLabelValues(r.Type).Set(r.PlainRatio)
+		dictRatio.WithLabelValues(r.Type).Set(r.DictRatio)
+		ratioDelta.WithLabelValues(r.Type).Set(r.PlainRatio - r.DictRatio)
+		improvement.WithLabelValues(r.Type).Set(r.Improvement)
+	}
+	durationGauge.Set(duration.Seconds())
+	timestampGauge.Set(float64(time.Now().Unix()))
+
+	return pushspool.Push(pushSpool, pushURL, "bench", pushspool.Grouping{"records": strconv.Itoa(count)}, registry)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+
+	"zstd-learning/internal/console"
+	"zstd-learning/internal/walk"
+)
+
+// selftestRecords is the size of the selftest corpus: enough records for
+// train-dict and for the dictionary to pay off, few enough to stay fast.
+const selftestRecords = 300
+
+// selftestStage is one step of bench selftest. Later stages use what
+// earlier ones wrote, so the first failure skips the rest.
+type selftestStage struct {
+	Name string
+	Run  func() error
+}
+
+// runSelftest handles bench selftest: a quick end-to-end check that the
+// tools, the zstd library and the metrics push work on this machine. It
+// exits non-zero when any stage fails, after removing its temp directory.
+func runSelftest(args []string) {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	binDir := fs.String("bin-dir", "", "directory with built generate-data, train-dict, compress and decompress binaries (default: the directory of this binary when they are there, else go run ./cmd/<tool>, which is much slower)")
+	pushCheck := fs.Bool("push-check", false, "send the tools' metrics to -pushgateway and push a selftest metric there, instead of to a throwaway local endpoint")
+	pushURL := fs.String("pushgateway", "http://localhost:9091", "Pushgateway base URL checked by -push-check")
+	keep := fs.Bool("keep", false, "keep the temporary working directory and print its path")
+	verbose := fs.Bool("verbose", false, "show the output of each tool")
+	colorFlag := fs.String("color", "auto", "colorize output: auto (only on a terminal), always, never")
+	fs.Parse(args)
+
+	colorMode, err := console.ParseMode(*colorFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	stdout := console.NewPrinter(colorMode, os.Stdout)
+
+	if *binDir == "" {
+		*binDir = siblingBinDir()
+	}
+	toolsURL := *pushURL
+	if !*pushCheck {
+		// The tools always push, so without -push-check they push to a
+		// local endpoint that accepts and discards everything.
+		sink, err := startPushSink()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to start local metrics endpoint: %v\n", err)
+			os.Exit(1)
+		}
+		defer sink.Close()
+		toolsURL = "http://" + sink.Addr().String()
+	}
+
+	workDir, err := os.MkdirTemp("", "zstd-selftest-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create work dir: %v\n", err)
+		os.Exit(1)
+	}
+	cleanup := func() {
+		if *keep {
+			fmt.Printf("work files kept in %s\n", workDir)
+		} else {
+			os.RemoveAll(workDir)
+		}
+	}
+	// An interrupted selftest still removes its work directory.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cleanup()
+		os.Exit(130)
+	}()
+
+	tools := toolRunner{BinDir: *binDir, PushURL: toolsURL, Verbose: *verbose}
+	genDir := filepath.Join(workDir, "generated")
+	recordDir := filepath.Join(workDir, "records")
+	dictPath := filepath.Join(workDir, "dict", "selftest.zdict")
+	plainDir := filepath.Join(workDir, "plain")
+	dictDir := filepath.Join(workDir, "dict-out")
+	var plainBytes, dictBytes int64
+
+	stages := []selftestStage{
+		{"generate corpus", func() error {
+			if err := tools.run("generate-data", "-type", "movies", "-n", fmt.Sprint(selftestRecords), "-seed", "42", "-out", genDir); err != nil {
+				return err
+			}
+			_, err := splitRecords(genDir, recordDir)
+			return err
+		}},
+		{"train dictionary", func() error {
+			return tools.run("train-dict", "-in", recordDir, "-out", filepath.Dir(dictPath), "-out-file", dictPath, "-dict-size", "8192")
+		}},
+		{"compress without dictionary", func() error {
+			totals, err := compressRun(tools, recordDir, plainDir, 0, "")
+			plainBytes = totals.OutputBytes
+			return err
+		}},
+		{"compress with dictionary", func() error {
+			totals, err := compressRun(tools, recordDir, dictDir, 0, dictPath)
+			dictBytes = totals.OutputBytes
+			return err
+		}},
+		{"decompress and compare without dictionary", func() error {
+			return restoreAndCompare(tools, plainDir, recordDir, "")
+		}},
+		{"decompress and compare with dictionary", func() error {
+			return restoreAndCompare(tools, dictDir, recordDir, dictPath)
+		}},
+		{"dictionary improves ratio", func() error {
+			if dictBytes >= plainBytes {
+				return fmt.Errorf("%d bytes with the dictionary, %d without", dictBytes, plainBytes)
+			}
+			return nil
+		}},
+	}
+	if *pushCheck {
+		stages = append(stages, selftestStage{"push to pushgateway", func() error {
+			return pushSelftestMetric(*pushURL)
+		}})
+	}
+
+	start := time.Now()
+	failed := false
+	for _, stage := range stages {
+		if failed {
+			fmt.Printf("  %s %s\n", stdout.Yellow("SKIP"), stage.Name)
+			continue
+		}
+		stageStart := time.Now()
+		if err := stage.Run(); err != nil {
+			fmt.Printf("  %s %s: %v\n", stdout.Red("FAIL"), stage.Name, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("  %s %s (%s)\n", stdout.Green("PASS"), stage.Name, time.Since(stageStart).Round(time.Millisecond))
+	}
+	signal.Stop(signals)
+	cleanup()
+
+	if failed {
+		fmt.Printf("selftest %s after %s\n", stdout.Red("FAILED"), time.Since(start).Round(time.Millisecond))
+		os.Exit(1)
+	}
+	fmt.Printf("selftest %s in %s\n", stdout.Green("passed"), time.Since(start).Round(time.Millisecond))
+}
+
+// siblingBinDir returns the directory of the running binary when the tools
+// were built next to it, or "" to fall back to go run.
+func siblingBinDir() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	dir := filepath.Dir(exe)
+	for _, tool := range []string{"generate-data", "train-dict", "compress", "decompress"} {
+		if _, err := os.Stat(filepath.Join(dir, tool+filepath.Ext(exe))); err != nil {
+			return ""
+		}
+	}
+	return dir
+}
+
+// restoreAndCompare decompresses compressedDir and checks every file in
+// originalDir came back byte for byte, and nothing else did.
+func restoreAndCompare(tools toolRunner, compressedDir, originalDir, dictPath string) error {
+	restoredDir := compressedDir + "-restored"
+	args := []string{"-in", compressedDir, "-out", restoredDir}
+	if dictPath != "" {
+		args = append(args, "-use-dict", "-dict", dictPath)
+	}
+	if err := tools.run("decompress", args...); err != nil {
+		return err
+	}
+
+	originals, _, err := walk.Files(originalDir, nil, walk.Error)
+	if err != nil {
+		return err
+	}
+	restored, _, err := walk.Files(restoredDir, nil, walk.Error)
+	if err != nil {
+		return err
+	}
+	if len(restored) != len(originals) {
+		return fmt.Errorf("%d files restored from %d originals", len(restored), len(originals))
+	}
+	for _, path := range originals {
+		rel, err := filepath.Rel(originalDir, path)
+		if err != nil {
+			return err
+		}
+		want, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		got, err := os.ReadFile(filepath.Join(restoredDir, rel))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, want) {
+			return fmt.Errorf("%s differs from its original", rel)
+		}
+	}
+	return nil
+}
+
+// startPushSink serves a local endpoint that accepts Pushgateway pushes and
+// discards them.
+func startPushSink() (net.Listener, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	return listener, nil
+}
+
+// pushSelftestMetric pushes the time of this selftest to pushURL, which
+// fails unless a Pushgateway accepts it.
+func pushSelftestMetric(pushURL string) error {
+	registry := prometheus.NewRegistry()
+	timestampGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bench_selftest_last_run_timestamp_seconds",
+		Help: "Unix timestamp of the last bench selftest that reached the Pushgateway.",
+	})
+	if err := registry.Register(timestampGauge); err != nil {
+		return err
+	}
+	timestampGauge.Set(float64(time.Now().Unix()))
+	if err := push.New(pushURL, "bench-selftest").Gatherer(registry).Push(); err != nil {
+		return fmt.Errorf("pushgateway: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"zstd-learning/internal/chunker"
+	"zstd-learning/internal/report"
+)
+
+// maxRecordBytes bounds one generated record when splitting; generated
+// records are a few hundred bytes.
+const maxRecordBytes = 1 << 20
+
+type benchOptions struct {
+	Count    int
+	Seed     int64
+	Level    int
+	DictSize int
+}
+
+// toolRunner runs the repository's own commands, either prebuilt from
+// BinDir or through go run, so the benchmark exercises them end to end.
+type toolRunner struct {
+	BinDir  string
+	PushURL string
+	Verbose bool
+}
+
+func (t toolRunner) run(tool string, args ...string) error {
+	args = append(args, "-pushgateway", t.PushURL, "-color", "never")
+	var cmd *exec.Cmd
+	if t.BinDir != "" {
+		cmd = exec.Command(filepath.Join(t.BinDir, tool), args...)
+	} else {
+		cmd = exec.Command("go", append([]string{"run", "./cmd/" + tool}, args...)...)
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if t.Verbose {
+		cmd.Stdout = io.MultiWriter(os.Stdout, &output)
+		cmd.Stderr = io.MultiWriter(os.Stderr, &output)
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %v\n%s", tool, strings.Join(args, " "), err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// benchType generates one data type under dir, splits it into one file per
+// record, trains a dictionary on the records and compresses them with and
+// without it.
+func benchType(tools toolRunner, dir, dataType string, opts benchOptions) (typeResult, error) {
+	result := typeResult{Type: dataType}
+	genDir := filepath.Join(dir, "generated")
+	recordDir := filepath.Join(dir, "records")
+	dictPath := filepath.Join(dir, "dict", dataType+".zdict")
+
+	err := tools.run("generate-data", "-type", dataType, "-n", strconv.Itoa(opts.Count), "-seed", strconv.FormatInt(opts.Seed, 10), "-out", genDir)
+	if err != nil {
+		return result, err
+	}
+	result.Records, err = splitRecords(genDir, recordDir)
+	if err != nil {
+		return result, err
+	}
+
+	err = tools.run("train-dict", "-in", recordDir, "-out", filepath.Dir(dictPath), "-out-file", dictPath, "-dict-size", strconv.Itoa(opts.DictSize))
+	if err != nil {
+		return result, err
+	}
+
+	plain, err := compressRun(tools, recordDir, filepath.Join(dir, "plain"), opts.Level, "")
+	if err != nil {
+		return result, err
+	}
+	withDict, err := compressRun(tools, recordDir, filepath.Join(dir, "dict-out"), opts.Level, dictPath)
+	if err != nil {
+		return result, err
+	}
+
+	result.InputBytes = plain.InputBytes
+	result.PlainBytes = plain.OutputBytes
+	result.DictBytes = withDict.OutputBytes
+	result.PlainRatio = plain.Ratio
+	result.DictRatio = withDict.Ratio
+	if plain.OutputBytes > 0 {
+		result.Improvement = 1 - float64(withDict.OutputBytes)/float64(plain.OutputBytes)
+	}
+	return result, nil
+}
+
+// compressRun compresses inDir into outDir, with dictPath when set, and
+// returns the totals from the run's -report.
+func compressRun(tools toolRunner, inDir, outDir string, level int, dictPath string) (report.Totals, error) {
+	reportPath := outDir + ".json"
+	args := []string{"-in", inDir, "-out", outDir, "-level", strconv.Itoa(level), "-report", reportPath}
+	if dictPath != "" {
+		args = append(args, "-use-dict", "-dict", dictPath)
+	}
+	if err := tools.run("compress", args...); err != nil {
+		return report.Totals{}, err
+	}
+	run, err := report.Read(reportPath)
+	if err != nil {
+		return report.Totals{}, err
+	}
+	return run.Totals, nil
+}
+
+// splitRecords writes every element of the JSON arrays in genDir to its own
+// file in recordDir, the many-small-similar-files case where dictionaries
+// matter. It returns the number of records written.
+func splitRecords(genDir, recordDir string) (int, error) {
+	if err := os.MkdirAll(recordDir, 0o755); err != nil {
+		return 0, err
+	}
+	files, err := filepath.Glob(filepath.Join(genDir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+	if len(files) == 0 {
+		return 0, fmt.Errorf("generate-data wrote no files to %s", genDir)
+	}
+
+	records := 0
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			return records, err
+		}
+		chunks := chunker.NewJSONArray(file, maxRecordBytes)
+		for {
+			record, err := chunks.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return records, fmt.Errorf("%s: %w", path, err)
+			}
+			records++
+			name := filepath.Join(recordDir, fmt.Sprintf("%06d.json", records))
+			if err := os.WriteFile(name, append(record, '\n'), 0o644); err != nil {
+				file.Close()
+				return records, err
+			}
+		}
+		file.Close()
+	}
+	return records, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"zstd-learning/internal/console"
+	"zstd-learning/internal/report"
+)
+
+// Arms of a -dict-a/-dict-b run, as recorded in the report.
+const (
+	armA = "A"
+	armB = "B"
+)
+
+// abOptions configures a -dict-a/-dict-b run. Dictionary A is the run's
+// DictBytes; Split is the share of files assigned to B.
+type abOptions struct {
+	DictB []byte
+	Split float64
+}
+
+// arm assigns rel to A or B by a hash of its slash-separated form, so a file
+// lands in the same arm on every run and platform, and reports from several
+// runs can be joined on path.
+func (o *abOptions) arm(rel string) string {
+	h := fnv.New64a()
+	h.Write([]byte(filepath.ToSlash(rel)))
+	if float64(h.Sum64())/math.MaxUint64 < o.Split {
+		return armB
+	}
+	return armA
+}
+
+// abEncoder returns an encoder with dictionary B and otherwise the options
+// of encoderOptions.
+func abEncoder(opts compressOptions) (*zstd.Encoder, error) {
+	options, _ := encoderOptions(compressOptions{Level: opts.Level, DictBytes: opts.AB.DictB})
+	if opts.Pipeline.Readers > 0 {
+		options = append(options, zstd.WithEncoderConcurrency(1))
+	}
+	return zstd.NewWriter(nil, options...)
+}
+
+// abArmStats sums one arm. Mean and StdErr are of the per-file ratios, which
+// weigh every file alike where Ratio, the ratio of the byte totals, is
+// dominated by the largest files.
+type abArmStats struct {
+	Files       int
+	InputBytes  int64
+	OutputBytes int64
+	Ratio       float64
+	Mean        float64
+	StdErr      float64
+}
+
+// abStats compares the two arms. Z is the difference of the mean per-file
+// ratios, B minus A, in standard errors; it is 0 when either arm has fewer
+// than two files.
+type abStats struct {
+	A, B abArmStats
+	Diff float64
+	Z    float64
+}
+
+// abTestStats computes the arm statistics from the report entries.
+func abTestStats(files []report.File) abStats {
+	var s abStats
+	var ratios [2][]float64
+	for _, f := range files {
+		arm, i := &s.A, 0
+		if f.Arm == armB {
+			arm, i = &s.B, 1
+		}
+		arm.Files++
+		arm.InputBytes += f.InputBytes
+		arm.OutputBytes += f.OutputBytes
+		ratios[i] = append(ratios[i], f.Ratio)
+	}
+	s.A.Ratio = ratio(s.A.OutputBytes, s.A.InputBytes)
+	s.B.Ratio = ratio(s.B.OutputBytes, s.B.InputBytes)
+	s.A.Mean, s.A.StdErr = meanStdErr(ratios[0])
+	s.B.Mean, s.B.StdErr = meanStdErr(ratios[1])
+	s.Diff = s.B.Mean - s.A.Mean
+	if se := math.Hypot(s.A.StdErr, s.B.StdErr); se > 0 && s.A.Files > 1 && s.B.Files > 1 {
+		s.Z = s.Diff / se
+	}
+	return s
+}
+
+// meanStdErr returns the mean of values and its standard error, 0 for fewer
+// than two values.
+func meanStdErr(values []float64) (float64, float64) {
+	if len(values) == 0 {
+		return 0, 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	if len(values) < 2 {
+		return mean, 0
+	}
+	var squares float64
+	for _, v := range values {
+		squares += (v - mean) * (v - mean)
+	}
+	variance := squares / float64(len(values)-1)
+	return mean, math.Sqrt(variance / float64(len(values)))
+}
+
+// printABTest prints the arms and a hint of whether their difference is more
+// than noise: |z| of at least 1.96 is significant at about 95%, assuming
+// the files are independent.
+func printABTest(w io.Writer, p console.Printer, s abStats, dictA, dictB string) {
+	for _, arm := range []struct {
+		name, dict string
+		stats      abArmStats
+	}{{armA, dictA, s.A}, {armB, dictB, s.B}} {
+		fmt.Fprintf(w, "dictionary %s (%s): %d files, %d -> %d bytes, ratio %s, mean file ratio %.4f ± %.4f\n",
+			arm.name, arm.dict, arm.stats.Files, arm.stats.InputBytes, arm.stats.OutputBytes, p.Ratio(arm.stats.Ratio), arm.stats.Mean, arm.stats.StdErr)
+	}
+	switch {
+	case s.A.Files < 2 || s.B.Files < 2:
+		fmt.Fprintln(w, p.Yellow("a/b: too few files in an arm to compare"))
+	case math.Abs(s.Z) >= 1.96:
+		better := armA
+		if s.Diff < 0 {
+			better = armB
+		}
+		fmt.Fprintf(w, "a/b: mean file ratio differs by %+.4f (z=%.2f): likely significant, %s compresses better\n", s.Diff, s.Z, better)
+	default:
+		fmt.Fprintf(w, "a/b: mean file ratio differs by %+.4f (z=%.2f): not significant\n", s.Diff, s.Z)
+	}
+}
+
+// abMetrics returns the per-arm gauges pushed for a -dict-a/-dict-b run.
+func abMetrics(s abStats) []prometheus.Collector {
+	files := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "compress_ab_files",
+		Help: "Files compressed per -dict-a/-dict-b arm in the last run.",
+	}, []string{"arm"})
+	output := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "compress_ab_output_bytes",
+		Help: "Output bytes per -dict-a/-dict-b arm in the last run.",
+	}, []string{"arm"})
+	ratios := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "compress_ab_ratio",
+		Help: "Output/input size ratio per -dict-a/-dict-b arm in the last run.",
+	}, []string{"arm"})
+	for _, arm := range []struct {
+		name  string
+		stats abArmStats
+	}{{armA, s.A}, {armB, s.B}} {
+		files.WithLabelValues(arm.name).Set(float64(arm.stats.Files))
+		output.WithLabelValues(arm.name).Set(float64(arm.stats.OutputBytes))
+		ratios.WithLabelValues(arm.name).Set(arm.stats.Ratio)
+	}
+	return []prometheus.Collector{files, output, ratios}
+}
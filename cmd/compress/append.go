@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"zstd-learning/internal/frame"
+	"zstd-learning/internal/summary"
+)
+
+// runAppend handles compress -append: one input file, one new frame at the
+// end of outPath.
+func runAppend(inPath, outPath string, opts compressOptions, pushURL, runID string, useDict bool, summaryFmt summary.Format, quiet bool) {
+	options, _ := encoderOptions(opts)
+	encoder, err := zstd.NewWriter(nil, options...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create encoder: %v\n", err)
+		exit(1)
+	}
+	defer encoder.Close()
+
+	start := time.Now()
+	result, err := appendFrame(encoder, inPath, outPath, opts.MinifyJSON)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "append failed: %v\n", err)
+		exit(1)
+	}
+	duration := time.Since(start)
+
+	stats := runStats{}
+	stats.Add(result.InputBytes, result.FrameBytes)
+	if strings.TrimSpace(runID) == "" {
+		runID = deterministic.Now().Format("20060102_150405")
+	}
+	notifier.Record(runID, stats.FilesProcessed, stats.InputBytes, stats.OutputBytes, stats.Ratio())
+	if err := pushMetrics(pushURL, stats, duration, filepath.Base(outPath), opts.Level, useDict, runID, false, 0, histogramBuckets{}); err != nil {
+		fmt.Fprintf(os.Stderr, "metrics push failed: %v\n", err)
+		exit(1)
+	}
+
+	if quiet {
+		return
+	}
+	sum := summary.New("append", stats.FilesProcessed, stats.InputBytes, stats.OutputBytes, stats.InputBytes, deterministic.Duration(duration))
+	sum.Ratio = stats.Ratio()
+	sum.Destination = outPath
+	sum.Level = opts.Level
+	if summaryFmt == summary.JSON {
+		sum.WriteJSON(os.Stdout)
+		return
+	}
+	fmt.Printf("appended %s (%d bytes -> %d byte frame, ratio %s) to %s, now %d frames\n", inPath, result.InputBytes, result.FrameBytes, opts.Printer.Ratio(ratio(result.FrameBytes, result.InputBytes)), outPath, result.Frames)
+}
+
+// appendResult describes one -append run.
+type appendResult struct {
+	InputBytes int64
+	FrameBytes int64
+	Frames     int // data frames in the output after the append
+}
+
+// appendFrame compresses inPath into a new zstd frame at the end of outPath,
+// creating outPath when it does not exist. Decoders read concatenated frames
+// as one stream, so the decompressed output is the old content followed by
+// inPath. The existing frames are scanned first: appending after a torn
+// frame would leave every later frame unreachable. If writing fails, outPath
+// is truncated back to its previous size.
+func appendFrame(encoder *zstd.Encoder, inPath, outPath string, minify bool) (appendResult, error) {
+	var result appendResult
+
+	existing, err := scanExisting(outPath)
+	if err != nil {
+		return result, err
+	}
+	for _, info := range existing {
+		if !info.Skippable {
+			result.Frames++
+		}
+	}
+
+	outFile, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return result, err
+	}
+	defer outFile.Close()
+	start, err := outFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return result, err
+	}
+
+	input, err := readAppendInput(inPath, minify)
+	if err != nil {
+		return result, err
+	}
+	encoder.ResetContentSize(outFile, int64(len(input)))
+	_, err = encoder.Write(input)
+	if closeErr := encoder.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = outFile.Sync()
+	}
+	if err != nil {
+		if truncErr := outFile.Truncate(start); truncErr != nil {
+			return result, fmt.Errorf("%w (and restoring %s to %d bytes failed: %v)", err, outPath, start, truncErr)
+		}
+		return result, err
+	}
+
+	end, err := outFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return result, err
+	}
+	info, err := os.Stat(inPath)
+	if err != nil {
+		return result, err
+	}
+	result.InputBytes = info.Size()
+	result.FrameBytes = end - start
+	result.Frames++
+	return result, outFile.Close()
+}
+
+// scanExisting returns the frames of outPath, or none when it does not exist
+// yet. A file that ends inside a frame or holds non-zstd data is an error.
+func scanExisting(outPath string) ([]frame.Info, error) {
+	f, err := os.Open(outPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	frames, err := frame.ScanAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s cannot be appended to: %w", outPath, err)
+	}
+	return frames, nil
+}
+
+// readAppendInput returns the bytes to compress for inPath, minified when
+// minify applies to it. Appended inputs are read whole so the new frame can
+// declare its content size.
+func readAppendInput(inPath string, minify bool) ([]byte, error) {
+	data, err := os.ReadFile(inPath)
+	if err != nil {
+		return nil, err
+	}
+	if minify {
+		candidate, err := isJSONCandidate(inPath)
+		if err != nil {
+			return nil, err
+		}
+		if candidate {
+			data, _ = minifyJSON(data)
+		}
+	}
+	return data, nil
+}
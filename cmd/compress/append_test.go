@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestAppendTwice(t *testing.T) {
+	dir := t.TempDir()
+	first := strings.Repeat(`{"level":"info","msg":"started"}`+"\n", 50)
+	second := strings.Repeat(`{"level":"warn","msg":"slow"}`+"\n", 70)
+	writeFiles(t, dir, map[string]string{"first.log": first, "second.log": second})
+	out := filepath.Join(dir, "app.log.zst")
+
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+
+	var size int64
+	for i, name := range []string{"first.log", "second.log"} {
+		result, err := appendFrame(encoder, filepath.Join(dir, name), out, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Frames != i+1 {
+			t.Errorf("after appending %s: %d frames, want %d", name, result.Frames, i+1)
+		}
+		size += result.FrameBytes
+	}
+	if info, err := os.Stat(out); err != nil || info.Size() != size {
+		t.Errorf("output is %v bytes (%v), want the %d appended", info.Size(), err, size)
+	}
+	if got := decodeFile(t, out); got != first+second {
+		t.Errorf("decodes to %d bytes, want the %d of both inputs in order", len(got), len(first+second))
+	}
+}
+
+func TestAppendRefusesATornFrame(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"in.log": "more\n"})
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	frame := encoder.EncodeAll([]byte(strings.Repeat("earlier\n", 100)), nil)
+	torn := frame[:len(frame)-3]
+	out := filepath.Join(dir, "app.log.zst")
+	if err := os.WriteFile(out, torn, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := appendFrame(encoder, filepath.Join(dir, "in.log"), out, false); err == nil || !strings.Contains(err.Error(), "cannot be appended to") {
+		t.Fatalf("got %v, want a refusal", err)
+	}
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, torn) {
+		t.Error("the torn output was modified")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+
+	"zstd-learning/internal/bundle"
+	"zstd-learning/internal/outpath"
+	"zstd-learning/internal/report"
+	"zstd-learning/internal/walk"
+	"zstd-learning/pkg/progress"
+)
+
+// bundleMaxBytes caps the uncompressed size of one bundle, so decompress
+// never has to stream a very large file to get at one member. A directory
+// with more small files than that gets several bundles.
+const bundleMaxBytes = 16 << 20
+
+// bundlePlan is one bundle: small files of the same directory, in sorted
+// order.
+type bundlePlan struct {
+	// Rel is the bundle's output name relative to -in, before -suffix.
+	Rel   string
+	Paths []string
+}
+
+// bundleName returns the base name of the n-th bundle of a directory.
+func bundleName(n int) string {
+	return fmt.Sprintf("_bundle-%04d", n)
+}
+
+// planBundles groups the files smaller than threshold by directory. A
+// directory with a single small file gains nothing from a bundle, so that
+// file stays among the returned unbundled paths with the large ones, whose
+// order is kept.
+func planBundles(paths []string, baseDir string, threshold int64) ([]string, []bundlePlan, error) {
+	var dirs []string
+	small := map[string][]string{}
+	sizes := map[string]int64{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if info.Size() >= threshold {
+			continue
+		}
+		dir := filepath.Dir(path)
+		if _, ok := small[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		small[dir] = append(small[dir], path)
+		sizes[path] = info.Size()
+	}
+
+	bundled := map[string]bool{}
+	var plans []bundlePlan
+	for _, dir := range dirs {
+		members := small[dir]
+		if len(members) < 2 {
+			continue
+		}
+		relDir, err := filepath.Rel(baseDir, dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		var current *bundlePlan
+		var currentBytes int64
+		n := 0
+		for _, path := range members {
+			if current == nil || currentBytes+sizes[path] > bundleMaxBytes {
+				n++
+				plans = append(plans, bundlePlan{Rel: filepath.Join(relDir, bundleName(n))})
+				current = &plans[len(plans)-1]
+				currentBytes = 0
+			}
+			current.Paths = append(current.Paths, path)
+			currentBytes += sizes[path]
+			bundled[path] = true
+		}
+	}
+
+	var rest []string
+	for _, path := range paths {
+		if !bundled[path] {
+			rest = append(rest, path)
+		}
+	}
+	return rest, plans, nil
+}
+
+// checkBundleNames fails when a bundle would land on the output of an
+// unbundled file.
+func checkBundleNames(plans []bundlePlan, paths []string, baseDir, outDir, suffix string) error {
+	rels, outs, _, err := outputPaths(paths, baseDir, outDir, suffix)
+	if err != nil {
+		return err
+	}
+	collisions := outpath.NewCollisions()
+	for i, out := range outs {
+		if err := collisions.Add(rels[i], out); err != nil {
+			return err
+		}
+	}
+	for _, plan := range plans {
+		out, err := outpath.Join(outDir, plan.Rel+suffix)
+		if err != nil {
+			return err
+		}
+		if err := collisions.Add(plan.Rel, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compressBundles writes every planned bundle under outDir and adds them to
+// stats. Each member is also compressed on its own, in memory, so the run
+// can report how many bytes bundling saved over one output per file.
+func compressBundles(plans []bundlePlan, outDir string, opts compressOptions, stats *runStats) error {
+	if len(plans) == 0 {
+		return nil
+	}
+	options, _ := encoderOptions(opts)
+	encoder, err := zstd.NewWriter(nil, options...)
+	if err != nil {
+		return err
+	}
+	defer encoder.Close()
+	separate, err := zstd.NewWriter(nil, options...)
+	if err != nil {
+		return err
+	}
+	defer separate.Close()
+
+	for _, plan := range plans {
+		outPath, err := outpath.Join(outDir, plan.Rel+opts.Suffix)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(outPath), 0o755); err != nil {
+			return err
+		}
+		input, separateBytes, err := writeBundle(encoder, separate, plan.Paths, outPath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", outPath, err)
+		}
+		info, err := os.Stat(outPath)
+		if err != nil {
+			return err
+		}
+		outSize := info.Size()
+
+		stats.Bundles++
+		stats.FilesBundled += len(plan.Paths)
+		stats.BundleBytesSaved += separateBytes - outSize
+		stats.FilesProcessed += len(plan.Paths)
+		stats.InputBytes += input
+		stats.OutputBytes += outSize
+		stats.Files = append(stats.Files, report.File{
+			Path:        filepath.ToSlash(plan.Rel),
+			InputBytes:  input,
+			OutputBytes: outSize,
+			Ratio:       ratio(outSize, input),
+		})
+		if opts.GroupDepth > 0 {
+			stats.AddGroup(groupName(plan.Rel, opts.GroupDepth), input, outSize)
+		}
+		opts.Progress.File(filepath.ToSlash(plan.Rel), input, outSize, progress.StatusOK)
+		if opts.Verbose {
+			fmt.Fprintf(opts.Notes, "  %-40s %10d -> %10d  %s  (%d files)\n", plan.Rel, input, outSize, opts.Printer.Ratio(ratio(outSize, input)), len(plan.Paths))
+		}
+	}
+	return nil
+}
+
+// writeBundle compresses paths into one frame at outPath and appends their
+// index. It returns the input size and the total size of the members
+// compressed separately by separate.
+func writeBundle(encoder, separate *zstd.Encoder, paths []string, outPath string) (int64, int64, error) {
+	contents := make([][]byte, len(paths))
+	members := make([]bundle.Member, len(paths))
+	var total, separateBytes int64
+	for i, path := range paths {
+		data, err := walk.ReadFile(path)
+		if err != nil {
+			return 0, 0, err
+		}
+		contents[i] = data
+		members[i] = bundle.Member{Name: filepath.Base(path), Offset: total, Size: int64(len(data))}
+		total += int64(len(data))
+		separateBytes += int64(len(separate.EncodeAll(data, nil)))
+	}
+
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer outFile.Close()
+	encoder.ResetContentSize(outFile, total)
+	for _, data := range contents {
+		if _, err := encoder.Write(data); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return 0, 0, err
+	}
+	if err := bundle.WriteIndex(outFile, members); err != nil {
+		return 0, 0, err
+	}
+	return total, separateBytes, outFile.Close()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"zstd-learning/internal/bundle"
+)
+
+func TestBundleRoundTrip(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	files := map[string]string{
+		"big.json":         strings.Repeat(record(0)+"\n", 200),
+		"only/small.json":  record(1),
+		"deep/a/b/x.json":  record(2),
+		"deep/a/b/y.json":  record(3),
+		"deep/a/b/z.json":  "",
+		"deep/a/large.log": strings.Repeat("line\n", 2000),
+	}
+	for i := 0; i < 12; i++ {
+		files[fmt.Sprintf("logs/%02d.json", i)] = strings.Repeat(record(i)+"\n", 1+i%4)
+	}
+	writeFiles(t, in, files)
+	// The walk skips empty files, so z.json has no output.
+	delete(files, "deep/a/b/z.json")
+	url, _ := fakeGateway(t)
+
+	code, output := run(t, "-in", in, "-out", out, "-batch-small-files", "4KiB", "-pushgateway", url)
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, output)
+	}
+
+	// Split the outputs back the way decompress does: a bundle by its
+	// index, anything else as one file.
+	restored := map[string]string{}
+	bundles := 0
+	err := filepath.WalkDir(out, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".zst") {
+			return err
+		}
+		rel, _ := filepath.Rel(out, strings.TrimSuffix(path, ".zst"))
+		idx, err := bundle.ReadIndex(path)
+		if err != nil {
+			return err
+		}
+		data := decodeFile(t, path)
+		if idx == nil {
+			restored[filepath.ToSlash(rel)] = data
+			return nil
+		}
+		bundles++
+		if int64(len(data)) != idx.Size() {
+			t.Errorf("%s decodes to %d bytes, its index lists %d", rel, len(data), idx.Size())
+			return nil
+		}
+		for _, m := range idx.Members {
+			restored[filepath.ToSlash(filepath.Join(filepath.Dir(rel), m.Name))] = data[m.Offset : m.Offset+m.Size]
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundles != 2 {
+		t.Errorf("%d bundles, want one for logs and one for deep/a/b", bundles)
+	}
+	for name, data := range files {
+		if got, ok := restored[name]; !ok || got != data {
+			t.Errorf("%s: restored %d bytes (present %v), want %d", name, len(got), ok, len(data))
+		}
+	}
+	for name := range restored {
+		if _, ok := files[name]; !ok {
+			t.Errorf("%s restored, but no such input", name)
+		}
+	}
+	for _, alone := range []string{"only/small.json.zst", "big.json.zst", "deep/a/large.log.zst"} {
+		if _, err := os.Stat(filepath.Join(out, filepath.FromSlash(alone))); err != nil {
+			t.Errorf("%s: %v", alone, err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+
+	"zstd-learning/internal/walk"
+)
+
+// canaryOptions configures -dict-canary: every Every-th file is also
+// compressed without the dictionary to estimate how much it still helps.
+type canaryOptions struct {
+	Every          int
+	MaxBytes       int64
+	Window         int
+	MinImprovement float64
+}
+
+// canaryStats is the outcome of the dictionary canary. Improvement is the
+// share of bytes the dictionary saved over plain compression across the last
+// Window samples, weighted by output size.
+type canaryStats struct {
+	Samples     int
+	Skipped     int
+	Warnings    int
+	Improvement float64
+	Window      int
+}
+
+// dictCanary keeps the dictionary and plain output sizes of the most recent
+// canary samples.
+type dictCanary struct {
+	opts   canaryOptions
+	dict   []int64
+	plain  []int64
+	next   int
+	warned bool
+	stats  canaryStats
+}
+
+func newDictCanary(opts canaryOptions) *dictCanary {
+	return &dictCanary{opts: opts}
+}
+
+// due reports whether the i-th file of the run (from 0) is a canary sample.
+func (c *dictCanary) due(i int) bool {
+	return i%c.opts.Every == 0
+}
+
+// observe compresses path with plainEncoder into a counting discard writer
+// and folds the result into the rolling estimate. Files larger than the size
+// cap are skipped. It returns true when the estimate has just dropped below
+// the threshold; further warnings wait until it recovers.
+func (c *dictCanary) observe(plainEncoder *zstd.Encoder, path string, inputSize, dictSize int64, minify bool) (bool, error) {
+	if c.opts.MaxBytes > 0 && inputSize > c.opts.MaxBytes {
+		c.stats.Skipped++
+		return false, nil
+	}
+	plainSize, err := plainCompressedSize(plainEncoder, path, minify)
+	if err != nil {
+		return false, err
+	}
+
+	if len(c.dict) < c.opts.Window {
+		c.dict = append(c.dict, dictSize)
+		c.plain = append(c.plain, plainSize)
+	} else {
+		c.dict[c.next] = dictSize
+		c.plain[c.next] = plainSize
+		c.next = (c.next + 1) % c.opts.Window
+	}
+	c.stats.Samples++
+
+	var dictTotal, plainTotal int64
+	for i := range c.dict {
+		dictTotal += c.dict[i]
+		plainTotal += c.plain[i]
+	}
+	if plainTotal > 0 {
+		c.stats.Improvement = 1 - float64(dictTotal)/float64(plainTotal)
+	}
+	c.stats.Window = len(c.dict)
+
+	// Wait for a full window so a single odd file cannot raise the alarm.
+	if len(c.dict) < c.opts.Window {
+		return false, nil
+	}
+	if c.stats.Improvement >= c.opts.MinImprovement {
+		c.warned = false
+		return false, nil
+	}
+	if c.warned {
+		return false, nil
+	}
+	c.warned = true
+	c.stats.Warnings++
+	return true, nil
+}
+
+// plainCompressedSize returns the size of path compressed by encoder,
+// minified first when minify applies, without writing the output anywhere.
+func plainCompressedSize(encoder *zstd.Encoder, path string, minify bool) (int64, error) {
+	var out countingWriter
+	if minify {
+		candidate, err := isJSONCandidate(path)
+		if err != nil {
+			return 0, err
+		}
+		if candidate {
+			data, err := walk.ReadFile(path)
+			if err != nil {
+				return 0, err
+			}
+			encoded, _ := minifyJSON(data)
+			encoder.ResetContentSize(&out, int64(len(encoded)))
+			_, err = encoder.Write(encoded)
+			if closeErr := encoder.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+			return out.n, err
+		}
+	}
+
+	in, err := walk.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	contentSize := int64(-1)
+	if info, err := in.Stat(); err == nil && info.Mode().IsRegular() {
+		contentSize = info.Size()
+	}
+	encoder.ResetContentSize(&out, contentSize)
+	_, err = io.Copy(encoder, in)
+	if closeErr := encoder.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return out.n, err
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	"zstd-learning/internal/lock"
+)
+
+// unmatchedFiles returns the files under dir that are not in matched: those
+// the filter skipped and empty files, which are never compressed.
+func unmatchedFiles(dir string, matched []string) ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && d.Name() != lock.FileName {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.SkipDir) {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return slices.DeleteFunc(paths, func(path string) bool {
+		_, found := slices.BinarySearch(matched, path)
+		return found
+	}), nil
+}
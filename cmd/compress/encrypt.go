@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"zstd-learning/internal/crypt"
+)
+
+// createOutput creates outPath. When seal is set everything written is
+// encrypted on the way to disk, so the file is compress-then-encrypt without
+// a second pass; closing the result finishes the encryption and closes the
+// file.
+func createOutput(outPath string, seal *crypt.Sealer) (io.WriteCloser, error) {
+	f, err := os.Create(outPath)
+	if err != nil {
+		// Not f: a nil *os.File in the interface would not compare equal
+		// to nil.
+		return nil, err
+	}
+	return sealOutput(f, seal)
+}
+
+// sealOutput wraps f so everything written is encrypted with seal, or
+// returns f itself without one. f is closed when wrapping fails.
+func sealOutput(f *os.File, seal *crypt.Sealer) (io.WriteCloser, error) {
+	if seal == nil {
+		return f, nil
+	}
+	w, err := seal.Wrap(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return sealedFile{w, f}, nil
+}
+
+type sealedFile struct {
+	io.WriteCloser
+	f *os.File
+}
+
+func (s sealedFile) Close() error {
+	err := s.WriteCloser.Close()
+	if closeErr := s.f.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// freeSpace is not implemented on this platform; the preflight check is
+// skipped.
+func freeSpace(dir string) (int64, bool) {
+	return 0, false
+}
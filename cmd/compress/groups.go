@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"zstd-learning/internal/console"
+	"zstd-learning/internal/report"
+)
+
+// rootGroup is the group of files directly under the input root.
+const rootGroup = "(root)"
+
+// groupName returns the first depth directory components of rel, the path of
+// a file relative to the input root.
+func groupName(rel string, depth int) string {
+	dir := filepath.Dir(filepath.ToSlash(rel))
+	if dir == "." {
+		return rootGroup
+	}
+	parts := strings.Split(filepath.ToSlash(dir), "/")
+	if len(parts) > depth {
+		parts = parts[:depth]
+	}
+	return strings.Join(parts, "/")
+}
+
+func printGroups(w io.Writer, p console.Printer, groups []report.Group) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "GROUP\tFILES\tINPUT\tOUTPUT\tRATIO")
+	for _, g := range groups {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\n", g.Name, g.Files, g.InputBytes, g.OutputBytes, p.Ratio(g.Ratio))
+	}
+	tw.Flush()
+}
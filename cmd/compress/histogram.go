@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"zstd-learning/internal/size"
+)
+
+// Default bucket boundaries for the per-file histograms. Ratios are
+// output/input, so text-like data lands well below 0.5 and already
+// compressed data near 1; sizes step by 4x from 1KiB to 1GiB.
+const (
+	defaultRatioBuckets = "0.05,0.1,0.15,0.2,0.3,0.4,0.5,0.6,0.8,1"
+	defaultSizeBuckets  = "1KiB,4KiB,16KiB,64KiB,256KiB,1MiB,4MiB,16MiB,64MiB,256MiB,1GiB"
+)
+
+// histogramBuckets holds the bucket boundaries of the per-file ratio and
+// input size histograms. Nil boundaries leave that histogram out.
+type histogramBuckets struct {
+	Ratio []float64
+	Size  []float64
+}
+
+// parseBuckets parses comma-separated bucket boundaries with parse and
+// checks that they are positive and strictly increasing, as Prometheus
+// requires.
+func parseBuckets(value string, parse func(string) (float64, error)) ([]float64, error) {
+	var buckets []float64
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		bound, err := parse(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q", field)
+		}
+		if bound <= 0 {
+			return nil, fmt.Errorf("bucket %q must be positive", field)
+		}
+		if n := len(buckets); n > 0 && bound <= buckets[n-1] {
+			return nil, fmt.Errorf("buckets must be sorted in increasing order: %q follows %g", field, buckets[n-1])
+		}
+		buckets = append(buckets, bound)
+	}
+	if len(buckets) == 0 {
+		return nil, fmt.Errorf("no buckets given")
+	}
+	return buckets, nil
+}
+
+func parseRatioBucket(field string) (float64, error) {
+	return strconv.ParseFloat(field, 64)
+}
+
+func parseSizeBucket(field string) (float64, error) {
+	n, err := size.Parse(field)
+	return float64(n), err
+}
+
+// fileHistograms returns the per-file ratio and input size histograms of
+// stats, or nothing when there are no files or no buckets.
+func fileHistograms(stats runStats, buckets histogramBuckets) []prometheus.Collector {
+	if len(stats.Files) == 0 {
+		return nil
+	}
+	var metrics []prometheus.Collector
+	if buckets.Ratio != nil {
+		ratioHistogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "compress_file_ratio_distribution",
+			Help:    "Distribution of the output/input size ratio of the files in the last run (-histogram-buckets).",
+			Buckets: buckets.Ratio,
+		})
+		for _, f := range stats.Files {
+			ratioHistogram.Observe(f.Ratio)
+		}
+		metrics = append(metrics, ratioHistogram)
+	}
+	if buckets.Size != nil {
+		sizeHistogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "compress_file_input_bytes",
+			Help:    "Distribution of the input size of the files in the last run (-size-histogram-buckets).",
+			Buckets: buckets.Size,
+		})
+		for _, f := range stats.Files {
+			sizeHistogram.Observe(float64(f.InputBytes))
+		}
+		metrics = append(metrics, sizeHistogram)
+	}
+	return metrics
+}
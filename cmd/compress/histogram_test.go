@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"zstd-learning/internal/report"
+)
+
+func TestParseBuckets(t *testing.T) {
+	tests := []struct {
+		value string
+		parse func(string) (float64, error)
+		want  []float64
+		err   string
+	}{
+		{"0.25, 0.5,1", parseRatioBucket, []float64{0.25, 0.5, 1}, ""},
+		{"0.5,,2,", parseRatioBucket, []float64{0.5, 2}, ""},
+		{"1KiB,1MiB,1500", parseSizeBucket, nil, "must be sorted"},
+		{"1KiB,4KiB", parseSizeBucket, []float64{1024, 4096}, ""},
+		{"0.5,0.5", parseRatioBucket, nil, "must be sorted"},
+		{"0.5,0.25", parseRatioBucket, nil, "must be sorted"},
+		{"0,0.5", parseRatioBucket, nil, "must be positive"},
+		{"-1", parseRatioBucket, nil, "must be positive"},
+		{"half", parseRatioBucket, nil, `invalid bucket "half"`},
+		{" , ", parseRatioBucket, nil, "no buckets"},
+	}
+	for _, tt := range tests {
+		got, err := parseBuckets(tt.value, tt.parse)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseBuckets(%q) = %v, %v; want an error with %q", tt.value, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseBuckets(%q) = %v, %v; want %v", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+// histogramOf collects the one histogram c holds.
+func histogramOf(t *testing.T, c prometheus.Collector) (string, *dto.Histogram) {
+	t.Helper()
+	ch := make(chan prometheus.Metric, 1)
+	c.Collect(ch)
+	metric := <-ch
+	var m dto.Metric
+	if err := metric.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return metric.Desc().String(), m.GetHistogram()
+}
+
+func TestFileHistogramsUseTheBuckets(t *testing.T) {
+	var stats runStats
+	for _, f := range []struct {
+		ratio float64
+		input int64
+	}{{0.1, 100}, {0.3, 2000}, {0.3, 5000}, {0.9, 1 << 20}} {
+		stats.Files = append(stats.Files, report.File{Ratio: f.ratio, InputBytes: f.input})
+	}
+	ratio, err := parseBuckets("0.25,0.5", parseRatioBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := parseBuckets("1KiB,64KiB", parseSizeBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := fileHistograms(stats, histogramBuckets{Ratio: ratio, Size: size})
+	if len(metrics) != 2 {
+		t.Fatalf("got %d histograms, want 2", len(metrics))
+	}
+	for i, want := range []struct {
+		name   string
+		bounds []float64
+		counts []uint64
+	}{
+		{"compress_file_ratio_distribution", []float64{0.25, 0.5}, []uint64{1, 3}},
+		{"compress_file_input_bytes", []float64{1024, 64 << 10}, []uint64{1, 3}},
+	} {
+		desc, h := histogramOf(t, metrics[i])
+		if !strings.Contains(desc, `"`+want.name+`"`) {
+			t.Errorf("histogram %d is %s, want %s", i, desc, want.name)
+		}
+		var bounds []float64
+		var counts []uint64
+		for _, b := range h.GetBucket() {
+			bounds = append(bounds, b.GetUpperBound())
+			counts = append(counts, b.GetCumulativeCount())
+		}
+		if !reflect.DeepEqual(bounds, want.bounds) || !reflect.DeepEqual(counts, want.counts) || h.GetSampleCount() != 4 {
+			t.Errorf("%s: buckets %v with counts %v of %d, want %v with %v of 4", want.name, bounds, counts, h.GetSampleCount(), want.bounds, want.counts)
+		}
+	}
+
+	if got := fileHistograms(runStats{}, histogramBuckets{Ratio: ratio}); got != nil {
+		t.Errorf("histograms for a run without files: %v", got)
+	}
+	if got := fileHistograms(stats, histogramBuckets{Size: size}); len(got) != 1 {
+		t.Errorf("got %d histograms with only size buckets, want 1", len(got))
+	}
+}
+
+func TestHistogramBucketsFlag(t *testing.T) {
+	in := t.TempDir()
+	writeFiles(t, in, map[string]string{"a.json": record(1)})
+	url, _ := fakeGateway(t)
+	code, out := run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url, "-histogram-buckets", "0.5,0.25")
+	if code != 1 || !strings.Contains(out, "invalid -histogram-buckets: buckets must be sorted in increasing order") {
+		t.Errorf("unsorted buckets: exit %d, output:\n%s", code, out)
+	}
+}
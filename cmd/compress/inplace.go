@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"zstd-learning/internal/outpath"
+)
+
+// inPlaceTempSuffix marks the partial output of an in-place compression. It
+// is renamed to the final name only once complete and synced, so an
+// interrupted run leaves either the original, a complete output, or both.
+const inPlaceTempSuffix = ".tmp"
+
+// inPlaceTempPath is the temporary path next to outPath, hidden so that
+// directory listings and globs do not pick it up.
+func inPlaceTempPath(outPath string) string {
+	return filepath.Join(filepath.Dir(outPath), "."+filepath.Base(outPath)+inPlaceTempSuffix)
+}
+
+// skipCompressed drops paths that are outputs of an earlier in-place run, or
+// leftovers of an interrupted one, so they are not compressed again.
+func skipCompressed(paths []string, suffix string) []string {
+	kept := paths[:0]
+	for _, path := range paths {
+		if outpath.HasSuffix(path, suffix) || outpath.HasSuffix(path, suffix+inPlaceTempSuffix) {
+			continue
+		}
+		kept = append(kept, path)
+	}
+	return kept
+}
+
+// commitInPlace syncs tmpPath, renames it to outPath and syncs the directory
+// so the rename is durable before the caller removes the original.
+func commitInPlace(tmpPath, outPath string) error {
+	if err := syncFile(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, outPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(outPath))
+}
+
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir flushes directory entries. Platforms that cannot sync a directory
+// handle are not treated as an error.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	d.Sync()
+	return nil
+}
+
+// totalSize sums the sizes of paths.
+func totalSize(paths []string) (int64, error) {
+	var total int64
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+		total += info.Size()
+	}
+	return total, nil
+}
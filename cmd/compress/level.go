@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxLevel is the highest zstd level -level accepts.
+const maxLevel = 22
+
+// The library has four encoders, and EncoderLevelFromZstd maps every zstd
+// level onto one of them, so -level 4 compresses exactly like -level 3.
+// levelRange is the span of zstd levels each encoder serves and
+// levelNominal the zstd level its output is closest to, as documented by
+// the library.
+var (
+	levelRange = map[zstd.EncoderLevel][2]int{
+		zstd.SpeedFastest:           {1, 2},
+		zstd.SpeedDefault:           {3, 5},
+		zstd.SpeedBetterCompression: {6, 9},
+		zstd.SpeedBestCompression:   {10, maxLevel},
+	}
+	levelNominal = map[zstd.EncoderLevel]int{
+		zstd.SpeedFastest:           1,
+		zstd.SpeedDefault:           3,
+		zstd.SpeedBetterCompression: 7,
+		zstd.SpeedBestCompression:   11,
+	}
+)
+
+// encoderLevel is the library encoder -level selects; 0 is the default.
+func encoderLevel(level int) zstd.EncoderLevel {
+	if level == 0 {
+		return zstd.SpeedDefault
+	}
+	return zstd.EncoderLevelFromZstd(level)
+}
+
+// levelWarning explains, for a -level other than 0 that does not run the
+// way its number suggests, which encoder it collapses to. It returns "" for
+// the levels that match their encoder.
+func levelWarning(level int) string {
+	enc := encoderLevel(level)
+	if level == 0 || level == levelNominal[enc] {
+		return ""
+	}
+	span := levelRange[enc]
+	return fmt.Sprintf("warning: -level %d runs the library's %q encoder, which compresses about like zstd level %d; levels %d to %d all give the same output", level, enc, levelNominal[enc], span[0], span[1])
+}
+
+// levelFallbacks lists the levels -level-fallback tries after level,
+// nearest first: the highest zstd level of each coarser encoder, since the
+// levels that share level's encoder would fail alike.
+func levelFallbacks(level int) []int {
+	var levels []int
+	for enc := encoderLevel(level) - 1; enc >= zstd.SpeedFastest; enc-- {
+		levels = append(levels, levelRange[enc][1])
+	}
+	return levels
+}
+
+// levelChoice is the level a run compresses at. Failure is the error of
+// the requested level when -level-fallback stepped down from it.
+type levelChoice struct {
+	Level   int
+	Failure error
+}
+
+// resolveLevel builds the encoders opts needs once, before any file is
+// touched, so a level the encoder rejects fails the run up front. With
+// fallback it then tries levelFallbacks in turn and picks the first level
+// that works; without, or when no level works, it returns the error of the
+// requested level.
+func resolveLevel(opts compressOptions, fallback bool) (levelChoice, error) {
+	requested := opts.Level
+	err := probeEncoders(opts)
+	if err == nil || !fallback {
+		return levelChoice{Level: requested}, err
+	}
+	for _, level := range levelFallbacks(requested) {
+		opts.Level = level
+		if probeEncoders(opts) == nil {
+			return levelChoice{Level: level, Failure: err}, nil
+		}
+	}
+	return levelChoice{Level: requested}, fmt.Errorf("%w (no lower level worked either)", err)
+}
+
+// probeEncoders builds and closes the encoder of every dictionary opts
+// compresses with.
+func probeEncoders(opts compressOptions) error {
+	withDict, plain := encoderOptions(opts)
+	sets := [][]zstd.EOption{withDict, plain}
+	if opts.AB != nil {
+		b, _ := encoderOptions(compressOptions{Level: opts.Level, DictBytes: opts.AB.DictB})
+		sets = append(sets, b)
+	}
+	for _, options := range sets {
+		encoder, err := zstd.NewWriter(nil, options...)
+		if err != nil {
+			return err
+		}
+		encoder.Close()
+	}
+	return nil
+}
@@ -5,219 +5,1754 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"io/fs"
 	"os"
 	"path/filepath"
-	"sort"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/push"
+
+	"zstd-learning/internal/config"
+	"zstd-learning/internal/confirm"
+	"zstd-learning/internal/console"
+	"zstd-learning/internal/crypt"
+	"zstd-learning/internal/dictfile"
+	"zstd-learning/internal/events"
+	"zstd-learning/internal/fdlimit"
+	"zstd-learning/internal/filter"
+	"zstd-learning/internal/history"
+	"zstd-learning/internal/lock"
+	"zstd-learning/internal/mirror"
+	"zstd-learning/internal/notify"
+	"zstd-learning/internal/outpath"
+	"zstd-learning/internal/pushspool"
+	"zstd-learning/internal/report"
+	"zstd-learning/internal/repro"
+	"zstd-learning/internal/size"
+	"zstd-learning/internal/stats"
+	"zstd-learning/internal/summary"
+	"zstd-learning/internal/walk"
+	"zstd-learning/pkg/progress"
 )
 
+// exitBudgetReached is the exit status used when -output-budget stops the run
+// and -budget-is-error is set.
+const exitBudgetReached = 3
+
+// runStats counts a compress run. FilesSkipped counts the special,
+// oversized and, with -output-budget, unprocessed files, which are also
+// counted on their own.
 type runStats struct {
-	FilesProcessed int
-	InputBytes     int64
-	OutputBytes    int64
+	stats.RunStats
+	FilesUnprocessed int
+	DictFallbacks    int
+	MinifiedFiles    int
+	MinifiedBytes    int64
+	BudgetReached    bool
+	FilesCopied      int
+	CopiedBytes      int64
+	SpecialSkipped   int
+	FilesOversized   int
+	// FilesUnstable counts the files whose size or modification time
+	// changed while they were compressed, after any -retry-unstable retry;
+	// FilesRetried counts the retries.
+	FilesUnstable int
+	FilesRetried  int
+	// Bundles, FilesBundled and BundleBytesSaved count the bundles written
+	// by -batch-small-files, the files in them and how much smaller they
+	// are than one output per file.
+	Bundles          int
+	FilesBundled     int
+	BundleBytesSaved int64
+	Files            []report.File
+	Canary           *canaryStats
+	AB               *abStats
+	// Snapshot is set with -snapshot-dir.
+	Snapshot *snapshotDiff
+	// LevelFallback is set when -level-fallback compressed at a lower
+	// level than -level.
+	LevelFallback bool
+	// PriorityTiers is set with -priority or -priority-pattern.
+	PriorityTiers []report.PriorityTier
+}
+
+type compressOptions struct {
+	Level        int
+	DictBytes    []byte
+	RawDict      bool
+	RawDictID    uint32
+	Verbose      bool
+	Printer      console.Printer
+	Budget       int64
+	DictFallback bool
+	Suffix       string
+	MinifyJSON   bool
+	GroupDepth   int
+	InPlace      bool
+	RemoveInput  bool
+	Canary       canaryOptions
+	Mmap         mmapOptions
+	Seal         *crypt.Sealer
+	Pipeline     pipelineOptions
+	AB           *abOptions
+	// Stamps holds each input's size and modification time as the walk
+	// saw them, to detect files written to while they are compressed;
+	// RetryUnstable compresses such a file once more.
+	Stamps        map[string]walk.Stamp
+	RetryUnstable bool
+	// Progress receives an event per finished file; nil without
+	// -progress-json.
+	Progress *events.Stream
+	// Notes receives the -verbose per-file lines and Warnings the
+	// warnings printed mid-run, as summary.Outputs routes them.
+	Notes    io.Writer
+	Warnings io.Writer
+}
+
+var (
+	notifier       *notify.Run
+	progressEvents *events.Stream
+	pushSpool      *pushspool.Options
+	deterministic  *repro.Options
+	outLock        *lock.Lock
+)
+
+// exit stands in for os.Exit, which would skip the deferred lock release
+// and leave -notify-url and -progress-json without the outcome.
+func exit(code int) {
+	progressEvents.Finish(code)
+	notifier.Finish(code)
+	outLock.Release()
+	os.Exit(code)
 }
 
 func main() {
-	inputDir := flag.String("in", "output", "input directory with files to compress")
+	if len(os.Args) > 1 && os.Args[1] == "recompress" {
+		runRecompress(os.Args[2:])
+		return
+	}
+
+	inputDir := flag.String("in", "output", "input directory with files to compress, or - to compress stdin into timestamped files under -out")
 	outDir := flag.String("out", "compressed", "output directory for compressed files")
 	level := flag.Int("level", 0, "zstd compression level (0=default, 1..22 supported)")
+	levelFallback := flag.Bool("level-fallback", false, "when no encoder can be built at -level, step down to the nearest level that works, with a warning, instead of failing the run")
 	useDict := flag.Bool("use-dict", false, "enable dictionary compression")
-	dictPath := flag.String("dict", "", "path to zstd dictionary file")
+	dictPath := flag.String("dict", "", "path to zstd dictionary file (.zdict, or a .zdictpkg package from train-dict -package)")
+	rawDict := flag.Bool("raw-dict", false, "treat -dict as raw content (as written by train-dict -dict-format raw) instead of a wrapped zstd dictionary")
+	dictSHA256 := flag.String("dict-sha256", "", "fail unless the -dict file has this hex SHA-256")
+	rawDictID := flag.Uint("raw-dict-id", 0, "dictionary ID to record in frame headers with -raw-dict (0 writes no ID)")
+	dictA := flag.String("dict-a", "", "A/B test two wrapped dictionaries: compress the files assigned to arm A with this one (see -ab-split)")
+	dictB := flag.String("dict-b", "", "with -dict-a, compress the files assigned to arm B with this dictionary; decompress needs both, e.g. via -dict-dir")
+	abSplit := flag.Float64("ab-split", 0.5, "with -dict-a and -dict-b, share of files assigned to arm B by a hash of their relative path")
 	runID := flag.String("run-id", "", "run identifier for metrics grouping")
 	pushURL := flag.String("pushgateway", "http://localhost:9091", "Pushgateway base URL")
-	flag.Parse()
+	suffix := flag.String("suffix", ".zst", "suffix appended to compressed file names (empty keeps the original names)")
+	filterExpr := flag.String("filter", "", "only process files matching an expression, e.g. 'size > 1MB && ext == .json && age < 7d' (see internal/filter)")
+	specialFiles := flag.String("special-files", "skip", "what to do with FIFOs, sockets and device nodes under -in, which are never opened: skip (and count them) or error")
+	summaryFormat := flag.String("summary-format", "text", "end-of-run summary format: text (human-readable sizes and rates) or json (raw numbers)")
+	allowEmpty := flag.Bool("allow-empty", false, "treat an input directory without files as a successful run that does nothing and pushes zeroed metrics, instead of an error")
+	quiet := flag.Bool("quiet", false, "do not print the end-of-run summary or other notes; warnings still go to stderr")
+	waitForLock := flag.Duration("wait-for-lock", 0, "when another run holds the output directory lock, wait up to this long for it instead of failing at once")
+	lockStaleAfter := flag.Duration("lock-stale-after", time.Hour, "break an output directory lock file its holder stopped refreshing this long ago (only where the OS cannot lock files; flock and LockFileEx locks die with their process)")
+	colorFlag := flag.String("color", "auto", "colorize output: auto (only on a terminal), always, never")
+	verbose := flag.Bool("verbose", false, "print a line per compressed file")
+	outputBudget := flag.String("output-budget", "", "stop after this much compressed output has been written (e.g. 500MB, 2GiB)")
+	maxFileSize := flag.String("max-file-size", "", "skip, log and count input files larger than this (e.g. 512MiB), so one pathological file cannot blow a batch job's memory or time budget; empty means no limit")
+	batchSmallFiles := flag.String("batch-small-files", "", "compress files smaller than this (e.g. 4KiB) together, per directory, into _bundle-NNNN bundles with an index that decompress uses to split them again; empty disables")
+	budgetIsError := flag.Bool("budget-is-error", false, fmt.Sprintf("exit with status %d when -output-budget stops the run", exitBudgetReached))
+	dictFallback := flag.Bool("dict-fallback", false, "also compress each file without the dictionary and keep the smaller output")
+	dictCanary := flag.Int("dict-canary", 0, "every N files, also compress the file without the dictionary to track how much the dictionary still helps (0 disables)")
+	canaryMaxBytes := flag.String("canary-max-bytes", "16MiB", "skip the -dict-canary comparison for files larger than this")
+	canaryWindow := flag.Int("canary-window", 5, "number of recent -dict-canary samples in the rolling improvement estimate")
+	canaryMinImprovement := flag.Float64("canary-min-improvement", 0.05, "warn when the rolling -dict-canary estimate of bytes saved by the dictionary falls below this fraction")
+	inPlace := flag.Bool("in-place", false, "write each output next to its input (foo.json -> foo.json.zst) instead of under -out")
+	removeInput := flag.Bool("rm", false, "remove each input file once its compressed output is complete and synced to disk")
+	limit := flag.Int("limit", 0, "process at most this many files, in sorted order or -priority order (0 = no limit)")
+	priority := flag.String("priority", "", "dispatch files newest-first or oldest-first by modification time instead of in sorted order, so -output-budget and -limit leave the least valuable files for later")
+	var priorityPatterns patternList
+	flag.Var(&priorityPatterns, "priority-pattern", "dispatch files matching this glob (e.g. *.json, matched against the relative path and the base name) before later patterns and unmatched files; repeat for more tiers, ordered within by -priority")
+	stateFile := flag.String("state-file", "", "remember when the last successful run started and only compress files modified since then")
+	groupDepth := flag.Int("group-depth", 1, "aggregate per-directory totals this many levels below -in (0 disables)")
+	perFileMetrics := flag.Bool("per-file-metrics", false, "also push a per-file ratio metric with a file label, for small curated corpora; disabled with a warning when the run has more than -per-file-metrics-limit files")
+	perFileLimit := flag.Int("per-file-metrics-limit", 500, "most files -per-file-metrics will label before it disables itself")
+	perGroupMetrics := flag.Bool("per-group-metrics", false, "also push per-group metrics with a group label (one series per directory, so mind cardinality)")
+	histogramBucketsFlag := flag.String("histogram-buckets", defaultRatioBuckets, "comma-separated, increasing bucket boundaries for the per-file compression ratio histogram")
+	sizeHistogramBuckets := flag.String("size-histogram-buckets", defaultSizeBuckets, "comma-separated, increasing bucket boundaries for the per-file input size histogram (sizes such as 64KiB or plain bytes)")
+	historyPath := flag.String("history", "", "append a one-line record of this run to this JSONL history file (export it with report history export)")
+	reportPath := flag.String("report", "", "write a JSON run report with per-file results to this path (compare runs with cmd/report diff)")
+	useMmap := flag.Bool("mmap", false, "read large regular files through a memory mapping instead of read calls (falls back to reading where mapping fails; inputs must not be truncated while mapped)")
+	mmapMinSize := flag.String("mmap-min-size", "64MiB", "with -mmap, only map files at least this large")
+	mmapMemCap := flag.String("mmap-mem-cap", "256MiB", "with -mmap, compress mapped files up to this size in one call; larger ones are streamed from the mapping in windows")
+	copyUnmatched := flag.Bool("copy-unmatched", false, "copy files excluded by -filter, and empty files, uncompressed under their own names into -out so the output tree is a complete mirror")
+	appendMode := flag.Bool("append", false, "compress the single file -in into a new frame appended to the .zst file -out (created if missing), for growing logs")
+	rotateInterval := flag.Duration("rotate-interval", 0, "with -in -, close the current output and start a new timestamped one at every multiple of this interval (e.g. 1h rotates on the hour); 0 writes a single file")
+	stdinPrefix := flag.String("stdin-prefix", "stdin", "with -in -, name outputs <prefix>-<UTC timestamp> plus -suffix")
+	encryptRecipient := flag.String("encrypt-recipient", "", "encrypt each output to these age public keys (comma-separated); outputs get .age after -suffix")
+	encryptKeyfile := flag.String("encrypt-keyfile", "", "encrypt each output with streaming AES-256-GCM under the 32-byte key in this file (raw or hex); outputs get .enc after -suffix")
+	scanOnly := flag.Bool("scan-only", false, "only walk and stat -in: report and push the count and total size of the files a run would compress, without compressing or writing anything")
+	readers := flag.Int("readers", 0, "read files ahead in this many goroutines while -encoders goroutines compress them, so slow disks do not idle the encoders (0 compresses one file at a time)")
+	encoderCount := flag.Int("encoders", runtime.GOMAXPROCS(0), "with -readers, compress this many files at once")
+	prefetchBytes := flag.String("prefetch-bytes", "64MiB", "with -readers, most file contents held in memory ahead of the encoders; larger files are streamed from disk instead")
+	maxOpenFiles := flag.Int("max-open-files", 0, "with -readers, most input and output files held open at once across readers and encoders, to stay under the open file limit on huge trees (0 = no limit)")
+	retryUnstable := flag.Bool("retry-unstable", false, "compress a file again, once, when its size or modification time changed while it was being compressed")
+	requireStable := flag.Bool("require-stable", false, "fail the run when any file changed while it was being compressed (after -retry-unstable), for workflows that need a point-in-time copy")
+	snapshotDir := flag.String("snapshot-dir", "", "write a manifest of every input file's size, modification time and SHA-256 to a new snapshot_<timestamp>.jsonl in this directory once the run succeeds")
+	sinceSnapshot := flag.String("since-snapshot", "", "with -snapshot-dir, only compress the files that are new or changed since this earlier manifest")
+	pruneRemoved := flag.Bool("prune-removed", false, "with -since-snapshot, delete the outputs of files the earlier manifest lists but -in no longer holds")
+	minify := flag.Bool("minify-json", false, "strip insignificant whitespace from JSON inputs before compressing (decompressed files are the minified form, not the original bytes)")
+	notifyOpts := notify.Flags(flag.CommandLine)
+	progressOpts := events.Flags(flag.CommandLine)
+	pushSpool = pushspool.Flags(flag.CommandLine)
+	deterministic = repro.Flags(flag.CommandLine)
+	confirmOpts := confirm.Flags(flag.CommandLine)
+	if err := config.Parse(flag.CommandLine, os.Args[1:], "ZSTD_COMPRESS"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+
+	colorMode, err := console.ParseMode(*colorFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+	stdout := console.NewPrinter(colorMode, os.Stdout)
+	stderr := console.NewPrinter(colorMode, os.Stderr)
+	progressEvents, err = events.Start(progressOpts, "compress")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer progressEvents.Finish(0)
+	notifier, err = notify.Start(notifyOpts, "compress")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+	defer notifier.Finish(0)
+	summaryFmt, err := summary.ParseFormat(*summaryFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+	notes, warnings := summary.Outputs(summaryFmt, *quiet)
+	specialPolicy, err := walk.ParsePolicy(*specialFiles)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
 
+	if *waitForLock < 0 || *lockStaleAfter < 0 {
+		fmt.Fprintln(os.Stderr, "wait-for-lock and lock-stale-after must not be negative")
+		exit(1)
+	}
+	if *level < 0 || *level > maxLevel {
+		fmt.Fprintf(os.Stderr, "invalid -level %d: must be between 0 (the default) and %d\n", *level, maxLevel)
+		exit(1)
+	}
+	if warning := levelWarning(*level); warning != "" {
+		fmt.Fprintln(os.Stderr, stderr.Yellow(warning))
+	}
 	if *useDict && strings.TrimSpace(*dictPath) == "" {
 		fmt.Fprintln(os.Stderr, "-dict is required when -use-dict is set")
-		os.Exit(1)
+		exit(1)
+	}
+	if *rawDict && !*useDict {
+		fmt.Fprintln(os.Stderr, "-raw-dict requires -use-dict")
+		exit(1)
+	}
+	if *dictSHA256 != "" && !*useDict {
+		fmt.Fprintln(os.Stderr, "-dict-sha256 requires -use-dict")
+		exit(1)
+	}
+	if *dictFallback && !*useDict {
+		fmt.Fprintln(os.Stderr, "-dict-fallback requires -use-dict")
+		exit(1)
+	}
+	if *dictCanary < 0 || *canaryWindow <= 0 {
+		fmt.Fprintln(os.Stderr, "dict-canary must not be negative and canary-window must be positive")
+		exit(1)
+	}
+	if *dictCanary > 0 && !*useDict {
+		fmt.Fprintln(os.Stderr, "-dict-canary requires -use-dict")
+		exit(1)
+	}
+	if *dictCanary > 0 && *dictFallback {
+		fmt.Fprintln(os.Stderr, "-dict-canary is redundant with -dict-fallback, which already compresses every file both ways")
+		exit(1)
+	}
+	abTest := *dictA != "" || *dictB != ""
+	if abTest {
+		if *dictA == "" || *dictB == "" {
+			fmt.Fprintln(os.Stderr, "-dict-a and -dict-b must be set together")
+			exit(1)
+		}
+		if !(*abSplit > 0 && *abSplit < 1) {
+			fmt.Fprintf(os.Stderr, "invalid -ab-split %v: must be between 0 and 1\n", *abSplit)
+			exit(1)
+		}
+		// The arms replace -dict, and the options below assume a single
+		// dictionary.
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "use-dict", "dict", "raw-dict", "dict-sha256", "raw-dict-id", "dict-fallback", "dict-canary", "batch-small-files", "append":
+				fmt.Fprintf(os.Stderr, "-%s cannot be combined with -dict-a\n", f.Name)
+				exit(1)
+			}
+		})
+	} else {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "ab-split" {
+				fmt.Fprintln(os.Stderr, "-ab-split needs -dict-a and -dict-b")
+				exit(1)
+			}
+		})
+	}
+	var mmap mmapOptions
+	if *useMmap {
+		mmap.Enabled = true
+		mmap.MinSize, err = size.Parse(*mmapMinSize)
+		if err != nil || mmap.MinSize <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid -mmap-min-size %q: must be a positive size\n", *mmapMinSize)
+			exit(1)
+		}
+		mmap.MemCap, err = size.Parse(*mmapMemCap)
+		if err != nil || mmap.MemCap < 0 {
+			fmt.Fprintf(os.Stderr, "invalid -mmap-mem-cap %q: must be a size\n", *mmapMemCap)
+			exit(1)
+		}
+	}
+	var pipeline pipelineOptions
+	if *readers < 0 {
+		fmt.Fprintln(os.Stderr, "readers must not be negative")
+		exit(1)
+	}
+	if *readers > 0 {
+		if *encoderCount < 1 {
+			fmt.Fprintln(os.Stderr, "encoders must be at least 1")
+			exit(1)
+		}
+		prefetch, err := size.Parse(*prefetchBytes)
+		if err != nil || prefetch <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid -prefetch-bytes %q: must be a positive size\n", *prefetchBytes)
+			exit(1)
+		}
+		// These depend on files being compressed one at a time, in order.
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "output-budget", "dict-canary", "mmap":
+				fmt.Fprintf(os.Stderr, "-%s cannot be combined with -readers\n", f.Name)
+				exit(1)
+			}
+		})
+		if *maxOpenFiles < 0 {
+			fmt.Fprintf(os.Stderr, "invalid -max-open-files %d: must not be negative\n", *maxOpenFiles)
+			exit(1)
+		}
+		pipeline = pipelineOptions{Readers: *readers, Encoders: *encoderCount, PrefetchBytes: prefetch, Files: fdlimit.New(*maxOpenFiles)}
+	} else {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "encoders" || f.Name == "prefetch-bytes" || f.Name == "max-open-files" {
+				fmt.Fprintf(os.Stderr, "-%s needs -readers\n", f.Name)
+				exit(1)
+			}
+		})
+	}
+	canaryCap, err := size.Parse(*canaryMaxBytes)
+	if err != nil || canaryCap <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid -canary-max-bytes %q: must be a positive size\n", *canaryMaxBytes)
+		exit(1)
 	}
 
-	if err := os.MkdirAll(*outDir, 0o755); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to create output dir: %v\n", err)
-		os.Exit(1)
+	if *limit < 0 {
+		fmt.Fprintln(os.Stderr, "limit must not be negative")
+		exit(1)
+	}
+	if *groupDepth < 0 {
+		fmt.Fprintln(os.Stderr, "group-depth must not be negative")
+		exit(1)
+	}
+	if *perFileLimit <= 0 {
+		fmt.Fprintln(os.Stderr, "per-file-metrics-limit must be positive")
+		exit(1)
+	}
+	var buckets histogramBuckets
+	if buckets.Ratio, err = parseBuckets(*histogramBucketsFlag, parseRatioBucket); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -histogram-buckets: %v\n", err)
+		exit(1)
+	}
+	if buckets.Size, err = parseBuckets(*sizeHistogramBuckets, parseSizeBucket); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -size-histogram-buckets: %v\n", err)
+		exit(1)
+	}
+	if *perGroupMetrics && *groupDepth == 0 {
+		fmt.Fprintln(os.Stderr, "-per-group-metrics requires -group-depth > 0")
+		exit(1)
+	}
+
+	if err := deterministic.Check(flag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+	if err := deterministic.Reject(flag.CommandLine, "encrypt-recipient", "encrypt-keyfile", "state-file"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
 	}
 
-	paths, err := listFiles(*inputDir)
+	if strings.ContainsAny(*suffix, `/\`) {
+		fmt.Fprintln(os.Stderr, "-suffix must not contain path separators")
+		exit(1)
+	}
+	var seal *crypt.Sealer
+	switch {
+	case *encryptRecipient != "" && *encryptKeyfile != "":
+		fmt.Fprintln(os.Stderr, "-encrypt-recipient and -encrypt-keyfile are mutually exclusive")
+		exit(1)
+	case *encryptRecipient != "":
+		seal, err = crypt.NewAgeSealer(*encryptRecipient)
+	case *encryptKeyfile != "":
+		var key []byte
+		key, err = crypt.ReadKeyFile(*encryptKeyfile)
+		if err == nil {
+			seal, err = crypt.NewKeySealer(key)
+		}
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to list input files: %v\n", err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("invalid encryption key"), err)
+		exit(1)
 	}
-	if len(paths) == 0 {
-		fmt.Fprintf(os.Stderr, "no files found in %s\n", *inputDir)
-		os.Exit(1)
+	// Encrypted outputs keep the compressed suffix and add the scheme's, so
+	// a.json becomes a.json.zst.age or a.json.zst.enc.
+	outSuffix := *suffix
+	if seal != nil {
+		outSuffix += seal.Scheme().Ext()
+	}
+	if *inPlace {
+		if *suffix == "" {
+			fmt.Fprintln(os.Stderr, "-in-place requires a non-empty -suffix")
+			exit(1)
+		}
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "out" || f.Name == "copy-unmatched" {
+				fmt.Fprintf(os.Stderr, "-%s cannot be combined with -in-place\n", f.Name)
+				exit(1)
+			}
+		})
+		*outDir = *inputDir
+	}
+
+	var fileSizeLimit int64
+	if strings.TrimSpace(*maxFileSize) != "" {
+		fileSizeLimit, err = size.Parse(*maxFileSize)
+		if err != nil || fileSizeLimit <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid -max-file-size %q: must be a positive size\n", *maxFileSize)
+			exit(1)
+		}
+	}
+
+	var batchThreshold int64
+	if strings.TrimSpace(*batchSmallFiles) != "" {
+		batchThreshold, err = size.Parse(*batchSmallFiles)
+		if err != nil || batchThreshold <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid -batch-small-files %q: must be a positive size\n", *batchSmallFiles)
+			exit(1)
+		}
+		// Bundles are found by the index at their end and hold several
+		// inputs, so they cannot be encrypted, appended to or replace their
+		// inputs one by one.
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "append", "in-place", "rm", "dict-fallback", "dict-canary", "output-budget", "minify-json", "encrypt-recipient", "encrypt-keyfile":
+				fmt.Fprintf(os.Stderr, "-%s cannot be combined with -batch-small-files\n", f.Name)
+				exit(1)
+			}
+		})
+	}
+
+	var budget int64
+	if strings.TrimSpace(*outputBudget) != "" {
+		budget, err = size.Parse(*outputBudget)
+		if err != nil || budget <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid -output-budget %q: must be a positive size\n", *outputBudget)
+			exit(1)
+		}
+	}
+
+	switch *priority {
+	case "", priorityNewest, priorityOldest:
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -priority %q: must be %s or %s\n", *priority, priorityNewest, priorityOldest)
+		exit(1)
+	}
+	prioritized := *priority != "" || len(priorityPatterns) > 0
+
+	stdinMode := *inputDir == "-"
+	if stdinMode {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "append", "scan-only", "in-place", "rm", "dict-fallback", "dict-canary", "state-file", "output-budget", "limit", "filter", "group-depth", "per-group-metrics", "copy-unmatched", "report", "mmap", "minify-json", "batch-small-files", "readers", "encoders", "prefetch-bytes", "dict-a", "dict-b", "ab-split", "retry-unstable", "require-stable", "snapshot-dir", "since-snapshot", "prune-removed", "priority", "priority-pattern":
+				fmt.Fprintf(os.Stderr, "-%s cannot be combined with -in -\n", f.Name)
+				exit(1)
+			}
+		})
+		if *rotateInterval < 0 {
+			fmt.Fprintf(os.Stderr, "invalid -rotate-interval %s: must not be negative\n", *rotateInterval)
+			exit(1)
+		}
+	} else if *rotateInterval != 0 {
+		fmt.Fprintln(os.Stderr, "-rotate-interval needs -in -")
+		exit(1)
+	}
+
+	if *snapshotDir != "" {
+		// A snapshot describes the whole tree, so every listed file must be
+		// compressed or known to be unchanged, and inputs must stay put.
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "state-file", "limit", "output-budget", "rm", "in-place", "batch-small-files", "scan-only", "priority", "priority-pattern":
+				fmt.Fprintf(os.Stderr, "-%s cannot be combined with -snapshot-dir\n", f.Name)
+				exit(1)
+			}
+		})
+	} else if *sinceSnapshot != "" {
+		fmt.Fprintln(os.Stderr, "-since-snapshot requires -snapshot-dir")
+		exit(1)
+	}
+	if *pruneRemoved && *sinceSnapshot == "" {
+		fmt.Fprintln(os.Stderr, "-prune-removed requires -since-snapshot")
+		exit(1)
+	}
+
+	if *appendMode {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "scan-only", "in-place", "rm", "dict-fallback", "dict-canary", "state-file", "output-budget", "limit", "filter", "group-depth", "per-group-metrics", "copy-unmatched", "encrypt-recipient", "encrypt-keyfile", "readers", "encoders", "prefetch-bytes", "retry-unstable", "require-stable", "snapshot-dir", "since-snapshot", "prune-removed", "priority", "priority-pattern":
+				fmt.Fprintf(os.Stderr, "-%s cannot be combined with -append\n", f.Name)
+				exit(1)
+			}
+		})
+		if info, err := os.Stat(*inputDir); err != nil || !info.Mode().IsRegular() {
+			fmt.Fprintf(os.Stderr, "-append needs -in to be a regular file: %s\n", *inputDir)
+			exit(1)
+		}
+		if info, err := os.Stat(*outDir); err == nil && info.IsDir() {
+			fmt.Fprintf(os.Stderr, "-append needs -out to be a .zst file, not the directory %s\n", *outDir)
+			exit(1)
+		}
+		if err := os.MkdirAll(filepath.Dir(*outDir), 0o755); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create output dir: %v\n", err)
+			exit(1)
+		}
+	} else if !*inPlace && !*scanOnly {
+		if err := os.MkdirAll(*outDir, 0o755); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create output dir: %v\n", err)
+			exit(1)
+		}
+	}
+	if !*scanOnly {
+		lockDir := *outDir
+		if *appendMode {
+			lockDir = filepath.Dir(*outDir)
+		}
+		held, err := lock.Acquire(lockDir, lock.Options{Command: "compress", Wait: *waitForLock, StaleAfter: *lockStaleAfter})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("cannot lock output directory"), err)
+			exit(1)
+		}
+		outLock = held
+		defer outLock.Release()
 	}
 
 	var dictBytes []byte
+	var dictID uint32
 	if *useDict {
-		dictBytes, err = os.ReadFile(*dictPath)
+		loaded, err := dictfile.Load(*dictPath, *rawDict, *dictSHA256)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to read dict: %v\n", err)
-			os.Exit(1)
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("invalid dictionary"), err)
+			exit(1)
+		}
+		fmt.Fprintln(notes, loaded)
+		// A .zdictpkg records whether it holds a raw dictionary.
+		*rawDict = loaded.Raw
+		dictBytes, dictID = loaded.Data, loaded.ID
+		if loaded.Raw {
+			dictID = uint32(*rawDictID)
+		}
+	}
+	var ab *abOptions
+	if abTest {
+		// Frames name their dictionary by ID, which is how decompress tells
+		// the arms apart, so both must be wrapped and their IDs differ.
+		var loaded [2]dictfile.Dict
+		for i, path := range []string{*dictA, *dictB} {
+			loaded[i], err = dictfile.Load(path, false, "")
+			if err == nil && loaded[i].Raw {
+				err = fmt.Errorf("%s: raw dictionaries carry no ID to tell the arms apart; use wrapped dictionaries", path)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("invalid dictionary"), err)
+				exit(1)
+			}
+			fmt.Fprintln(notes, loaded[i])
+		}
+		if loaded[0].ID == loaded[1].ID {
+			fmt.Fprintf(os.Stderr, "-dict-a and -dict-b have the same dictionary ID %d, so their outputs could not be told apart\n", loaded[0].ID)
+			exit(1)
 		}
+		dictBytes = loaded[0].Data
+		ab = &abOptions{DictB: loaded[1].Data, Split: *abSplit}
 	}
 
-	start := time.Now()
-	stats, err := compressFiles(paths, *inputDir, *outDir, *level, dictBytes)
+	// From here on *level is the level the run compresses at, which
+	// -level-fallback may have lowered; reports and metrics show that one.
+	requestedLevel := *level
+	choice, err := resolveLevel(compressOptions{
+		Level:     *level,
+		DictBytes: dictBytes,
+		RawDict:   *rawDict,
+		RawDictID: uint32(*rawDictID),
+		AB:        ab,
+	}, *levelFallback)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "compression failed: %v\n", err)
-		os.Exit(1)
+		message := fmt.Sprintf("%s: %v", stderr.Red(fmt.Sprintf("cannot build an encoder at -level %d", *level)), err)
+		if !*levelFallback {
+			message += "; -level-fallback steps down to a level that works"
+		}
+		fmt.Fprintln(os.Stderr, message)
+		exit(1)
+	}
+	*level = choice.Level
+	if choice.Failure != nil {
+		fmt.Fprintln(os.Stderr, stderr.Yellow(fmt.Sprintf("warning: cannot build an encoder at -level %d (%v); -level-fallback compresses at level %d", requestedLevel, choice.Failure, *level)))
+	}
+
+	if *appendMode {
+		runAppend(*inputDir, *outDir, compressOptions{
+			Level:      *level,
+			DictBytes:  dictBytes,
+			RawDict:    *rawDict,
+			RawDictID:  uint32(*rawDictID),
+			MinifyJSON: *minify,
+			Printer:    stdout,
+		}, *pushURL, *runID, *useDict, summaryFmt, *quiet)
+		return
+	}
+	if stdinMode {
+		runStdin(compressOptions{
+			Level:     *level,
+			DictBytes: dictBytes,
+			RawDict:   *rawDict,
+			RawDictID: uint32(*rawDictID),
+			Verbose:   *verbose,
+			Printer:   stdout,
+			Notes:     notes,
+		}, stdinOptions{
+			OutDir:   *outDir,
+			Prefix:   *stdinPrefix,
+			Suffix:   outSuffix,
+			Interval: *rotateInterval,
+			Seal:     seal,
+		}, *pushURL, *runID, *useDict, summaryFmt, *quiet)
+		return
+	}
+
+	var match *filter.Expr
+	if strings.TrimSpace(*filterExpr) != "" {
+		match, err = filter.Parse(*filterExpr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
 	}
-	duration := time.Since(start)
 
 	sourceLabel := filepath.Base(*inputDir)
 	if sourceLabel == "." || sourceLabel == string(filepath.Separator) {
 		sourceLabel = "output"
 	}
 	if strings.TrimSpace(*runID) == "" {
-		*runID = time.Now().Format("20060102_150405")
+		*runID = deterministic.Now().Format("20060102_150405")
 	}
 
-	if err := pushMetrics(*pushURL, stats, duration, sourceLabel, *level, *useDict, *runID); err != nil {
-		fmt.Fprintf(os.Stderr, "metrics push failed: %v\n", err)
-		os.Exit(1)
+	// The start time is taken before listing so files modified while this
+	// run is in progress are picked up again by the next one.
+	runStart := time.Now()
+	paths, stamps, specialSkipped, err := walk.FilesStamped(*inputDir, match, specialPolicy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list input files: %v\n", err)
+		exit(1)
+	}
+	if *inPlace {
+		paths = skipCompressed(paths, outSuffix)
+	}
+	if len(paths) == 0 {
+		if !*allowEmpty {
+			fmt.Fprintf(os.Stderr, "no files found in %s\n", *inputDir)
+			exit(1)
+		}
+		fmt.Fprintf(notes, "no files found in %s; nothing to do\n", *inputDir)
+		if err := pushMetrics(*pushURL, runStats{}, 0, sourceLabel, *level, *useDict, *runID, false, 0, histogramBuckets{}); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("metrics push failed"), err)
+			exit(1)
+		}
+		return
+	}
+	var unmatched []string
+	if *copyUnmatched {
+		unmatched, err = unmatchedFiles(*inputDir, paths)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to list input files: %v\n", err)
+			exit(1)
+		}
+	}
+	// Oversized files are dropped after -copy-unmatched has listed what
+	// -filter excluded, so they are neither compressed nor copied.
+	var oversized int
+	if fileSizeLimit > 0 {
+		var skipped []string
+		paths, skipped, err = splitOversized(paths, fileSizeLimit)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to list input files: %v\n", err)
+			exit(1)
+		}
+		for _, path := range skipped {
+			fmt.Fprintln(warnings, stdout.Yellow(fmt.Sprintf("skipping %s: larger than -max-file-size %s", path, size.Format(fileSizeLimit))))
+		}
+		oversized = len(skipped)
+	}
+	if *scanOnly {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "state-file", "copy-unmatched", "report", "retry-unstable", "require-stable":
+				fmt.Fprintf(os.Stderr, "-%s cannot be combined with -scan-only\n", f.Name)
+				exit(1)
+			}
+		})
+	}
+	if *stateFile != "" {
+		if since, ok := readState(*stateFile); ok {
+			paths, err = modifiedAfter(paths, since)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to list input files: %v\n", err)
+				exit(1)
+			}
+			if len(paths) == 0 {
+				fmt.Fprintf(notes, "no files modified since %s\n", since.Format(time.RFC3339))
+				if err := writeState(*stateFile, runStart); err != nil {
+					fmt.Fprintf(os.Stderr, "failed to write state file: %v\n", err)
+					exit(1)
+				}
+				return
+			}
+		}
+	}
+	var tiers []priorityTier
+	if prioritized {
+		paths, tiers, err = priorityOrder(paths, *inputDir, stamps, *priority, priorityPatterns)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to list input files: %v\n", err)
+			exit(1)
+		}
+	}
+	available := len(paths)
+	if *limit > 0 && len(paths) > *limit {
+		paths = paths[:*limit]
+	}
+	limited := len(paths) < available
+
+	if *scanOnly {
+		scan, err := scanFiles(paths, runStart)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("scan failed"), err)
+			exit(1)
+		}
+		notifier.Record(*runID, scan.Files, scan.InputBytes, 0, 0)
+		if err := pushScanMetrics(*pushURL, scan, sourceLabel, *runID); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("metrics push failed"), err)
+			exit(1)
+		}
+		if !*quiet {
+			sum := summary.New("scan", scan.Files, scan.InputBytes, 0, scan.InputBytes, scan.Duration)
+			if summaryFmt == summary.JSON {
+				sum.WriteJSON(os.Stdout)
+			} else {
+				fmt.Printf("scan found %s files to compress: %s in %s, scanned in %s\n", stdout.Bold(strconv.Itoa(scan.Files)), size.Format(scan.InputBytes), *inputDir, summary.FormatDuration(scan.Duration))
+			}
+		}
+		if specialSkipped > 0 {
+			fmt.Fprintln(warnings, stdout.Yellow(fmt.Sprintf("skipped %d special files (FIFOs, sockets or devices)", specialSkipped)))
+		}
+		if limited {
+			fmt.Fprintln(warnings, stdout.Yellow(fmt.Sprintf("limit of %d files applied: %d of %d files counted", *limit, len(paths), available)))
+		}
+		return
+	}
+
+	var snapshot *snapshotWriter
+	var snapDiff snapshotDiff
+	if *snapshotDir != "" {
+		var prev *snapshotReader
+		if *sinceSnapshot != "" {
+			prev, err = openSnapshot(*sinceSnapshot)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("invalid -since-snapshot"), err)
+				exit(1)
+			}
+			defer prev.Close()
+		}
+		var removed []string
+		var onRemoved func(rel string)
+		if *pruneRemoved {
+			onRemoved = func(rel string) { removed = append(removed, rel) }
+		}
+		snapshot, err = createSnapshot(*snapshotDir, outpath.StampLayout, *inputDir)
+		if err == nil {
+			paths, snapDiff, err = planSnapshot(paths, stamps, *inputDir, prev, snapshot, onRemoved)
+		}
+		var stale []string
+		if err == nil && len(removed) > 0 {
+			var staleBytes int64
+			stale, staleBytes, err = staleOutputs(*outDir, removed, outSuffix)
+			if err == nil && len(stale) > 0 {
+				err = confirm.Ask(confirmOpts, confirm.Plan{Action: "delete the outputs of inputs removed since -since-snapshot", Count: len(stale), Unit: "files", Bytes: staleBytes, Paths: stale})
+			}
+		}
+		for _, out := range stale {
+			if err != nil {
+				break
+			}
+			if err = os.Remove(out); err == nil {
+				snapDiff.Pruned++
+			}
+		}
+		if err != nil {
+			if snapshot != nil {
+				snapshot.abort()
+			}
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("snapshot failed"), err)
+			exit(1)
+		}
+	}
+
+	if (*removeInput || *inPlace) && len(paths) > 0 {
+		plan := confirm.Plan{Action: "remove the inputs once they are compressed", Count: len(paths), Unit: "files", Bytes: -1, Paths: paths}
+		if !*removeInput {
+			plan.Action = fmt.Sprintf("compress in place, writing each output next to its input as <name>%s and replacing any file of that name", outSuffix)
+		}
+		if total, err := totalSize(paths); err == nil {
+			plan.Bytes = total
+		}
+		if err := confirm.Ask(confirmOpts, plan); err != nil {
+			fmt.Fprintln(os.Stderr, stderr.Red(err.Error()))
+			exit(1)
+		}
+	}
+
+	// candidates keeps every file to compress, bundled or not.
+	candidates := paths
+	var bundles []bundlePlan
+	if batchThreshold > 0 {
+		paths, bundles, err = planBundles(paths, *inputDir, batchThreshold)
+		if err == nil {
+			err = checkBundleNames(bundles, paths, *inputDir, *outDir, outSuffix)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("compression failed"), err)
+			exit(1)
+		}
+	}
+
+	var copyDests []string
+	if len(unmatched) > 0 {
+		_, outs, _, err := outputPaths(paths, *inputDir, *outDir, outSuffix)
+		inputs := slices.Clip(paths)
+		for _, plan := range bundles {
+			inputs = append(inputs, plan.Rel)
+			outs = append(outs, filepath.Join(*outDir, plan.Rel+outSuffix))
+		}
+		if err == nil {
+			// Copies keep their names while compressed outputs carry the
+			// suffix, which is how the two are told apart.
+			copyDests, err = mirror.Plan(unmatched, *inputDir, *outDir, inputs, outs)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("compression failed"), err)
+			exit(1)
+		}
+	}
+
+	inputBytes, err := totalSize(candidates)
+	if err != nil {
+		inputBytes = -1
+	}
+	// A bundle is one output, so it is one file event.
+	progressEvents.Begin(*runID, len(paths)+len(bundles), inputBytes)
+	if inputBytes >= 0 {
+		if free, ok := freeSpace(*outDir); ok && free < inputBytes {
+			fmt.Fprintln(os.Stderr, stderr.Yellow(fmt.Sprintf("warning: %s free in %s is less than the %s of input", size.Format(free), *outDir, size.Format(inputBytes))))
+		}
+	}
+
+	start := time.Now()
+	stats, err := compressFiles(paths, *inputDir, *outDir, compressOptions{
+		Level:        *level,
+		DictBytes:    dictBytes,
+		RawDict:      *rawDict,
+		RawDictID:    uint32(*rawDictID),
+		Verbose:      *verbose,
+		Printer:      stdout,
+		Budget:       budget,
+		DictFallback: *dictFallback,
+		Suffix:       outSuffix,
+		MinifyJSON:   *minify,
+		GroupDepth:   *groupDepth,
+		InPlace:      *inPlace,
+		RemoveInput:  *removeInput,
+		Canary: canaryOptions{
+			Every:          *dictCanary,
+			MaxBytes:       canaryCap,
+			Window:         *canaryWindow,
+			MinImprovement: *canaryMinImprovement,
+		},
+		Mmap:          mmap,
+		Seal:          seal,
+		Pipeline:      pipeline,
+		AB:            ab,
+		Stamps:        stamps,
+		RetryUnstable: *retryUnstable,
+		Progress:      progressEvents,
+		Notes:         notes,
+		Warnings:      warnings,
+	})
+	if err == nil {
+		err = compressBundles(bundles, *outDir, compressOptions{
+			Level:      *level,
+			DictBytes:  dictBytes,
+			RawDict:    *rawDict,
+			RawDictID:  uint32(*rawDictID),
+			Verbose:    *verbose,
+			Printer:    stdout,
+			Suffix:     outSuffix,
+			GroupDepth: *groupDepth,
+			Progress:   progressEvents,
+			Notes:      notes,
+		}, &stats)
+	}
+	if err != nil {
+		if snapshot != nil {
+			snapshot.abort()
+		}
+		fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("compression failed"), err)
+		exit(1)
+	}
+	if snapshot != nil {
+		snapDiff.Manifest, err = snapshot.commit()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("failed to write snapshot manifest"), err)
+			exit(1)
+		}
+		stats.Snapshot = &snapDiff
+	}
+	stats.SpecialSkipped = specialSkipped
+	stats.FilesSkipped += specialSkipped
+	if ab != nil {
+		abStats := abTestStats(stats.Files)
+		stats.AB = &abStats
+	}
+	stats.FilesOversized = oversized
+	stats.FilesSkipped += oversized
+	stats.LevelFallback = *level != requestedLevel
+	if prioritized {
+		// Files are dispatched in order, so the ones the budget left
+		// unprocessed are the last of paths; bundles always complete.
+		done := make(map[string]bool, len(candidates))
+		for _, path := range candidates {
+			done[path] = true
+		}
+		for _, path := range paths[len(paths)-stats.FilesUnprocessed:] {
+			delete(done, path)
+		}
+		stats.PriorityTiers = tierProgress(tiers, done)
+	}
+	if len(unmatched) > 0 {
+		stats.FilesCopied, stats.CopiedBytes, err = mirror.Copy(unmatched, copyDests)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("copying unmatched files failed"), err)
+			exit(1)
+		}
+	}
+	duration := time.Since(start)
+	notifier.Record(*runID, stats.FilesProcessed, stats.InputBytes, stats.OutputBytes, stats.Ratio())
+
+	// A run cut short by the budget or -limit leaves files unprocessed, so
+	// the state is only advanced when every candidate was compressed.
+	if *stateFile != "" && !stats.BudgetReached && !limited {
+		if err := writeState(*stateFile, runStart); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write state file: %v\n", err)
+			exit(1)
+		}
 	}
 
-	fmt.Printf("compressed %d files (%d bytes -> %d bytes) into %s\n", stats.FilesProcessed, stats.InputBytes, stats.OutputBytes, *outDir)
+	if *reportPath != "" {
+		run := newRunReport(stats, *inputDir, *outDir, *level, *runID)
+		if *level != requestedLevel {
+			run.RequestedLevel = requestedLevel
+		}
+		if *useDict {
+			run.Dict = *dictPath
+			run.DictID = dictID
+		}
+		if err := report.Write(*reportPath, run); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("failed to write report"), err)
+			exit(1)
+		}
+	}
+
+	fileLimit := 0
+	if *perFileMetrics {
+		fileLimit = *perFileLimit
+		if len(stats.Files) > fileLimit {
+			fmt.Fprintln(warnings, stdout.Yellow(fmt.Sprintf("warning: -per-file-metrics disabled: %d files exceed -per-file-metrics-limit %d; only aggregate metrics are pushed", len(stats.Files), fileLimit)))
+		}
+	}
+	if *historyPath != "" {
+		err := history.Append(*historyPath, history.Record{
+			Timestamp:       deterministic.Now(),
+			Command:         "compress",
+			Source:          sourceLabel,
+			RunID:           *runID,
+			Files:           stats.FilesProcessed,
+			InputBytes:      stats.InputBytes,
+			OutputBytes:     stats.OutputBytes,
+			Ratio:           stats.Ratio(),
+			DurationSeconds: deterministic.Duration(duration).Seconds(),
+			Level:           *level,
+			DictID:          dictID,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("failed to record history"), err)
+			exit(1)
+		}
+	}
+	if err := pushMetrics(*pushURL, stats, duration, sourceLabel, *level, *useDict || abTest, *runID, *perGroupMetrics, fileLimit, buckets); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("metrics push failed"), err)
+		exit(1)
+	}
+
+	if !*quiet {
+		sum := summary.New("compress", stats.FilesProcessed, stats.InputBytes, stats.OutputBytes, stats.InputBytes, deterministic.Duration(duration))
+		sum.Ratio = stats.Ratio()
+		sum.Destination = *outDir
+		sum.Level = *level
+		if summaryFmt == summary.JSON {
+			sum.WriteJSON(os.Stdout)
+		} else {
+			fmt.Printf("compressed %s files: %s into %s\n", stdout.Bold(strconv.Itoa(stats.FilesProcessed)), sum.Details(stdout), *outDir)
+			if stats.LevelFallback {
+				fmt.Fprintln(warnings, stdout.Yellow(fmt.Sprintf("compressed at level %d: -level-fallback stepped down from -level %d", *level, requestedLevel)))
+			}
+		}
+	}
+	if stats.AB != nil {
+		printABTest(notes, stdout, *stats.AB, *dictA, *dictB)
+	}
+	if *dictFallback {
+		fmt.Fprintf(notes, "dictionary fallback kept the plain output for %d of %d files\n", stats.DictFallbacks, stats.FilesProcessed)
+	}
+	if c := stats.Canary; c != nil {
+		if c.Samples == 0 {
+			fmt.Fprintf(notes, "dictionary canary: no samples (%d files over -canary-max-bytes)\n", c.Skipped)
+		} else {
+			line := fmt.Sprintf("dictionary canary: dictionary saves %.1f%% over plain zstd across the last %d of %d samples (%d skipped by size, %d warnings)", c.Improvement*100, c.Window, c.Samples, c.Skipped, c.Warnings)
+			if c.Improvement < *canaryMinImprovement {
+				line = stdout.Yellow(line)
+			}
+			fmt.Fprintln(notes, line)
+		}
+	}
+	if limited {
+		fmt.Fprintln(warnings, stdout.Yellow(fmt.Sprintf("limit of %d files applied: %d of %d files processed", *limit, len(paths), available)))
+	}
+	if len(stats.PriorityTiers) > 0 && (limited || stats.BudgetReached) {
+		printPriorityTiers(notes, stats.PriorityTiers)
+	}
+	if _, root := stats.Groups[rootGroup]; len(stats.Groups) > 1 || (len(stats.Groups) == 1 && !root) {
+		printGroups(notes, stdout, stats.GroupList())
+	}
+	if stats.SpecialSkipped > 0 {
+		fmt.Fprintln(warnings, stdout.Yellow(fmt.Sprintf("skipped %d special files (FIFOs, sockets or devices)", stats.SpecialSkipped)))
+	}
+	if stats.FilesOversized > 0 {
+		fmt.Fprintln(warnings, stdout.Yellow(fmt.Sprintf("skipped %d files larger than -max-file-size", stats.FilesOversized)))
+	}
+	if batchThreshold > 0 {
+		fmt.Fprintf(notes, "bundled %d files under %s into %d bundles, saving %s over one output per file\n", stats.FilesBundled, size.Format(batchThreshold), stats.Bundles, size.Format(stats.BundleBytesSaved))
+	}
+	if d := stats.Snapshot; d != nil {
+		line := fmt.Sprintf("snapshot %s: %d added, %d changed, %d unchanged, %d removed", d.Manifest, d.Added, d.Changed, d.Unchanged, d.Removed)
+		if *pruneRemoved {
+			line += fmt.Sprintf(" (%d outputs pruned)", d.Pruned)
+		}
+		fmt.Fprintln(notes, line)
+	}
+	if *copyUnmatched {
+		fmt.Fprintf(notes, "copied %d unmatched files (%d bytes) uncompressed; %d already up to date\n", stats.FilesCopied, stats.CopiedBytes, len(unmatched)-stats.FilesCopied)
+	}
+	if *minify {
+		fmt.Fprintf(notes, "minified %d JSON files, removing %d bytes of whitespace\n", stats.MinifiedFiles, stats.MinifiedBytes)
+	}
+
+	if stats.FilesRetried > 0 {
+		fmt.Fprintf(notes, "-retry-unstable compressed %d files again that changed while being compressed\n", stats.FilesRetried)
+	}
+	if stats.FilesUnstable > 0 {
+		message := fmt.Sprintf("%d files changed while being compressed, so their outputs may match no version of the input (marked unstable in -report)", stats.FilesUnstable)
+		if *removeInput {
+			message += "; their inputs were kept"
+		}
+		if *requireStable {
+			fmt.Fprintln(os.Stderr, stderr.Red(message))
+			exit(1)
+		}
+		fmt.Fprintln(warnings, stdout.Yellow(message))
+	}
+
+	if stats.BudgetReached {
+		message := fmt.Sprintf("output budget of %s reached: %d files left unprocessed", size.Format(budget), stats.FilesUnprocessed)
+		if *budgetIsError {
+			fmt.Fprintln(os.Stderr, stderr.Red(message))
+			exit(exitBudgetReached)
+		}
+		fmt.Fprintln(warnings, stdout.Yellow(message))
+	}
 }
 
-func compressFiles(paths []string, baseDir, outDir string, level int, dictBytes []byte) (runStats, error) {
+// splitOversized separates the paths larger than limit from the rest,
+// keeping both in order.
+func splitOversized(paths []string, limit int64) ([]string, []string, error) {
+	var kept, oversized []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if info.Size() > limit {
+			oversized = append(oversized, path)
+			continue
+		}
+		kept = append(kept, path)
+	}
+	return kept, oversized, nil
+}
+
+func compressFiles(paths []string, baseDir, outDir string, opts compressOptions) (runStats, error) {
 	stats := runStats{}
 
-	options := []zstd.EOption{}
-	if level != 0 {
-		options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	rels, outPaths, caseOnly, err := outputPaths(paths, baseDir, outDir, opts.Suffix)
+	if err != nil {
+		return stats, err
+	}
+	for _, warning := range caseOnly {
+		fmt.Fprintln(opts.Warnings, opts.Printer.Yellow("warning: "+warning))
 	}
-	if len(dictBytes) > 0 {
-		options = append(options, zstd.WithEncoderDict(dictBytes))
+	if opts.Pipeline.Readers > 0 {
+		return compressPipelined(paths, rels, outPaths, opts)
 	}
 
-	encoder, err := zstd.NewWriter(nil, options...)
+	var canary *dictCanary
+	if opts.Canary.Every > 0 && len(opts.DictBytes) > 0 {
+		canary = newDictCanary(opts.Canary)
+	}
+	encoders, err := newFileEncoders(opts, canary != nil)
 	if err != nil {
 		return stats, err
 	}
-	defer encoder.Close()
+	defer encoders.close()
 
-	for _, path := range paths {
-		rel, err := filepath.Rel(baseDir, path)
+	for i, path := range paths {
+		result, err := compressOne(encoders, fileJob{Path: path, Rel: rels[i], Out: outPaths[i]}, opts, canary, i)
 		if err != nil {
 			return stats, err
 		}
+		stats.addResult(rels[i], result, opts)
 
-		outPath := filepath.Join(outDir, rel) + ".zst"
-		if err := os.MkdirAll(filepath.Dir(outPath), 0o755); err != nil {
-			return stats, err
+		if opts.Budget > 0 && stats.OutputBytes >= opts.Budget {
+			stats.BudgetReached = true
+			stats.FilesUnprocessed = len(paths) - i - 1
+			stats.FilesSkipped += stats.FilesUnprocessed
+			break
 		}
+	}
+
+	if canary != nil {
+		stats.Canary = &canary.stats
+	}
+	return stats, nil
+}
 
-		inFile, err := os.Open(path)
+// fileEncoders are the encoders one goroutine compresses files with: the
+// main one, for -dict-fallback and -dict-canary one without the dictionary,
+// and with -dict-b one with dictionary B.
+type fileEncoders struct {
+	encoder *zstd.Encoder
+	plain   *zstd.Encoder
+	armB    *zstd.Encoder
+}
+
+func newFileEncoders(opts compressOptions, canary bool) (fileEncoders, error) {
+	var encoders fileEncoders
+	options, plainOptions := encoderOptions(opts)
+	if opts.Pipeline.Readers > 0 {
+		// The pipeline runs one encoder per goroutine already.
+		options = append(slices.Clip(options), zstd.WithEncoderConcurrency(1))
+		plainOptions = append(slices.Clip(plainOptions), zstd.WithEncoderConcurrency(1))
+	}
+	var err error
+	encoders.encoder, err = zstd.NewWriter(nil, options...)
+	if err != nil {
+		return encoders, err
+	}
+	if (opts.DictFallback || canary) && len(opts.DictBytes) > 0 {
+		encoders.plain, err = zstd.NewWriter(nil, plainOptions...)
 		if err != nil {
-			return stats, err
+			encoders.encoder.Close()
+			return encoders, err
 		}
-		outFile, err := os.Create(outPath)
+	}
+	if opts.AB != nil {
+		encoders.armB, err = abEncoder(opts)
 		if err != nil {
-			inFile.Close()
-			return stats, err
+			encoders.close()
+			return encoders, err
 		}
+	}
+	return encoders, nil
+}
+
+func (e fileEncoders) close() {
+	e.encoder.Close()
+	if e.plain != nil {
+		e.plain.Close()
+	}
+	if e.armB != nil {
+		e.armB.Close()
+	}
+}
 
-		encoder.Reset(outFile)
-		written, err := io.Copy(encoder, inFile)
-		if closeErr := encoder.Close(); closeErr != nil && err == nil {
-			err = closeErr
+// fileJob is one file to compress. Loaded is set when -readers has already
+// read the file into Data.
+type fileJob struct {
+	Path   string
+	Rel    string
+	Out    string
+	Data   []byte
+	Loaded bool
+}
+
+// fileResult is the outcome of compressOne.
+type fileResult struct {
+	// Written is the number of bytes read from the input and Encoded the
+	// number fed to the encoder, fewer when -minify-json stripped some.
+	Written  int64
+	Encoded  int64
+	Output   int64
+	Fallback bool
+	// Arm is the -dict-a/-dict-b arm the file was compressed with.
+	Arm string
+	// Unstable is set when the input changed while it was compressed, and
+	// Retried when -retry-unstable compressed it a second time.
+	Unstable bool
+	Retried  bool
+}
+
+// compressOne compresses one file and, with -in-place or -rm, commits the
+// output and removes the input. canary is nil when -dict-canary is off; i
+// is the file's position in the run, which decides whether it is a canary
+// sample.
+func compressOne(encoders fileEncoders, job fileJob, opts compressOptions, canary *dictCanary, i int) (fileResult, error) {
+	var result fileResult
+	if err := os.MkdirAll(filepath.Dir(job.Out), 0o755); err != nil {
+		return result, err
+	}
+	writePath := job.Out
+	if opts.InPlace {
+		writePath = inPlaceTempPath(job.Out)
+	}
+
+	encoder := encoders.encoder
+	if opts.AB != nil {
+		result.Arm = opts.AB.arm(job.Rel)
+		if result.Arm == armB {
+			encoder = encoders.armB
+		}
+	}
+	stamp, stamped := opts.Stamps[job.Path]
+	for {
+		var err error
+		if job.Loaded {
+			result.Written, result.Encoded, err = compressPrefetched(encoder, job.Data, job.Path, writePath, opts.MinifyJSON, opts.Seal)
+		} else {
+			result.Written, result.Encoded, err = compressFile(encoder, job.Path, writePath, opts.MinifyJSON, opts.Mmap, opts.Seal)
 		}
 		if err != nil {
-			outFile.Close()
-			inFile.Close()
-			return stats, err
+			if opts.InPlace {
+				os.Remove(writePath)
+			}
+			return result, err
 		}
 
-		if err := outFile.Close(); err != nil {
-			inFile.Close()
-			return stats, err
+		info, err := os.Stat(writePath)
+		if err != nil {
+			return result, err
 		}
-		if err := inFile.Close(); err != nil {
-			return stats, err
+		result.Output = info.Size()
+
+		// One stat of the input tells whether it was written to since the
+		// walk (or the previous attempt); the output may then match no
+		// version of it.
+		if !stamped {
+			break
+		}
+		info, err = os.Stat(job.Path)
+		if err != nil {
+			return result, err
 		}
+		result.Unstable = stamp.Changed(info)
+		if !result.Unstable || !opts.RetryUnstable || result.Retried {
+			break
+		}
+		result.Retried = true
+		stamp = walk.StampOf(info)
+		job.Data, job.Loaded = nil, false
+	}
 
-		info, err := os.Stat(outPath)
+	if canary != nil && canary.due(i) {
+		dropped, err := canary.observe(encoders.plain, job.Path, result.Written, result.Output, opts.MinifyJSON)
 		if err != nil {
-			return stats, err
+			return result, err
 		}
+		if dropped {
+			fmt.Fprintln(opts.Warnings, opts.Printer.Yellow(fmt.Sprintf("warning: dictionary canary at %s: rolling improvement over plain zstd fell to %.1f%% (threshold %.1f%%)", job.Rel, canary.stats.Improvement*100, opts.Canary.MinImprovement*100)))
+		}
+	}
 
-		stats.FilesProcessed++
-		stats.InputBytes += written
-		stats.OutputBytes += info.Size()
+	if opts.DictFallback && encoders.plain != nil {
+		plainSize, err := compressFallback(encoders.plain, job.Path, writePath, result.Output, opts.MinifyJSON, opts.Mmap, opts.Seal)
+		if err != nil {
+			return result, err
+		}
+		if plainSize < result.Output {
+			result.Fallback = true
+			result.Output = plainSize
+		}
 	}
 
-	return stats, nil
+	if opts.InPlace {
+		if err := commitInPlace(writePath, job.Out); err != nil {
+			return result, err
+		}
+	} else if opts.RemoveInput {
+		if err := syncFile(job.Out); err != nil {
+			return result, err
+		}
+	}
+	// An unstable input holds data its output lacks, so it is kept.
+	if opts.RemoveInput && !result.Unstable {
+		if err := os.Remove(job.Path); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// addResult adds one compressed file to the totals, the report and its
+// group, and prints it with -verbose.
+func (stats *runStats) addResult(rel string, result fileResult, opts compressOptions) {
+	stats.Add(result.Written, result.Output)
+	if result.Fallback {
+		stats.DictFallbacks++
+	}
+	if result.Unstable {
+		stats.FilesUnstable++
+	}
+	if result.Retried {
+		stats.FilesRetried++
+	}
+	if result.Encoded < result.Written {
+		stats.MinifiedFiles++
+		stats.MinifiedBytes += result.Written - result.Encoded
+	}
+	stats.Files = append(stats.Files, report.File{
+		Path:         filepath.ToSlash(rel),
+		InputBytes:   result.Written,
+		OutputBytes:  result.Output,
+		Ratio:        ratio(result.Output, result.Written),
+		DictFallback: result.Fallback,
+		Arm:          result.Arm,
+		Unstable:     result.Unstable,
+	})
+	if opts.GroupDepth > 0 {
+		stats.AddGroup(groupName(rel, opts.GroupDepth), result.Written, result.Output)
+	}
+	status := progress.StatusOK
+	if result.Unstable {
+		status = progress.StatusUnstable
+	}
+	opts.Progress.File(filepath.ToSlash(rel), result.Written, result.Output, status)
+
+	if opts.Verbose {
+		note := ""
+		if result.Fallback {
+			note = " (no dict)"
+		}
+		if result.Unstable {
+			note += " (changed while compressing)"
+		}
+		fmt.Fprintf(opts.Notes, "  %-40s %10d -> %10d  %s%s\n", rel, result.Written, result.Output, opts.Printer.Ratio(ratio(result.Output, result.Written)), note)
+	}
 }
 
-func listFiles(dir string) ([]string, error) {
-	var paths []string
-	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+// encoderOptions returns the encoder options for opts, and the same options
+// without the dictionary. With -deterministic each encoder uses a single
+// goroutine, so the output does not depend on the number of CPUs.
+func encoderOptions(opts compressOptions) (withDict, plain []zstd.EOption) {
+	if deterministic != nil && deterministic.Enabled {
+		plain = append(plain, zstd.WithEncoderConcurrency(1))
+	}
+	if opts.Level != 0 {
+		plain = append(plain, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(opts.Level)))
+	}
+	withDict = plain
+	if len(opts.DictBytes) > 0 {
+		withDict = slices.Clip(withDict)
+		if opts.RawDict {
+			withDict = append(withDict, zstd.WithEncoderDictRaw(opts.RawDictID, opts.DictBytes))
+		} else {
+			withDict = append(withDict, zstd.WithEncoderDict(opts.DictBytes))
+		}
+	}
+	return withDict, plain
+}
+
+// outputPaths maps every input to its relative name and output path before
+// anything is written, so a name that would escape outDir fails the run up
+// front. caseOnly describes outputs that differ only in case, which are
+// worth a warning but not an error.
+func outputPaths(paths []string, baseDir, outDir, suffix string) (rels, outs, caseOnly []string, err error) {
+	rels = make([]string, len(paths))
+	outs = make([]string, len(paths))
+	collisions := outpath.NewCollisions()
+	for i, path := range paths {
+		rel, err := filepath.Rel(baseDir, path)
 		if err != nil {
-			return err
+			return nil, nil, nil, err
 		}
-		if d.IsDir() {
-			return nil
+		out, err := outpath.Join(outDir, rel+suffix)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if err := collisions.Add(rel, out); err != nil {
+			return nil, nil, nil, err
 		}
-		info, err := d.Info()
+		rels[i], outs[i] = rel, out
+	}
+	return rels, outs, collisions.CaseOnly(), nil
+}
+
+// compressFile compresses inPath into outPath. It returns the number of bytes
+// read from inPath and the number of bytes fed to the encoder, which are
+// fewer when minify strips whitespace from a JSON input.
+func compressFile(encoder *zstd.Encoder, inPath, outPath string, minify bool, mm mmapOptions, seal *crypt.Sealer) (int64, int64, error) {
+	if minify {
+		candidate, err := isJSONCandidate(inPath)
 		if err != nil {
-			return err
+			return 0, 0, err
 		}
-		if info.Size() == 0 {
-			return nil
+		if candidate {
+			return compressMinified(encoder, inPath, outPath, seal)
 		}
-		paths = append(paths, path)
-		return nil
-	})
-	if err != nil && !errors.Is(err, fs.SkipDir) {
-		return nil, err
 	}
-	sort.Strings(paths)
-	return paths, nil
+
+	inFile, err := walk.Open(inPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer inFile.Close()
+
+	// Declaring the size up front records it in the frame header. Only that
+	// many bytes are read, so a file appended to meanwhile still gives a
+	// valid frame of what it held at the stat, which compressOne then
+	// reports as unstable; one that shrank fails.
+	contentSize := int64(-1)
+	if info, err := inFile.Stat(); err == nil && info.Mode().IsRegular() {
+		contentSize = info.Size()
+	}
+	if contentSize >= 0 && mm.use(contentSize) {
+		if written, ok, err := compressMapped(encoder, inFile, contentSize, outPath, mm, seal); ok {
+			return written, written, err
+		}
+	}
+
+	outFile, err := createOutput(outPath, seal)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	encoder.ResetContentSize(outFile, contentSize)
+	var written int64
+	if contentSize >= 0 {
+		written, err = io.CopyN(encoder, inFile, contentSize)
+		if errors.Is(err, io.EOF) {
+			err = fmt.Errorf("%s shrank from %d to %d bytes while being read", inPath, contentSize, written)
+		}
+	} else {
+		written, err = io.Copy(encoder, inFile)
+	}
+	if closeErr := encoder.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if closeErr := outFile.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return written, written, err
+	}
+	return written, written, inFile.Close()
+}
+
+// compressMinified reads a JSON candidate into memory and compresses its
+// minified form. Files that turn out not to be valid JSON are compressed
+// unchanged.
+func compressMinified(encoder *zstd.Encoder, inPath, outPath string, seal *crypt.Sealer) (int64, int64, error) {
+	data, err := walk.ReadFile(inPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	encoded, _ := minifyJSON(data)
+	return int64(len(data)), int64(len(encoded)), compressBytes(encoder, encoded, outPath, seal)
+}
+
+// compressPrefetched compresses data, the contents of inPath already read
+// by -readers, into outPath, minifying it first like compressFile would.
+func compressPrefetched(encoder *zstd.Encoder, data []byte, inPath, outPath string, minify bool, seal *crypt.Sealer) (int64, int64, error) {
+	encoded := data
+	if minify {
+		candidate, err := isJSONCandidate(inPath)
+		if err != nil {
+			return 0, 0, err
+		}
+		if candidate {
+			encoded, _ = minifyJSON(data)
+		}
+	}
+	return int64(len(data)), int64(len(encoded)), compressBytes(encoder, encoded, outPath, seal)
+}
+
+// compressBytes compresses data held in memory into outPath.
+func compressBytes(encoder *zstd.Encoder, data []byte, outPath string, seal *crypt.Sealer) error {
+	outFile, err := createOutput(outPath, seal)
+	if err != nil {
+		return err
+	}
+	encoder.ResetContentSize(outFile, int64(len(data)))
+	_, err = encoder.Write(data)
+	if closeErr := encoder.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if closeErr := outFile.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// compressFallback compresses inPath without the dictionary next to outPath
+// and replaces outPath with it when it is smaller than dictSize. It returns
+// the size of the dictionary-less output.
+func compressFallback(plainEncoder *zstd.Encoder, inPath, outPath string, dictSize int64, minify bool, mm mmapOptions, seal *crypt.Sealer) (int64, error) {
+	tmpPath := outPath + ".nodict.tmp"
+	if _, _, err := compressFile(plainEncoder, inPath, tmpPath, minify, mm, seal); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	info, err := os.Stat(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	if info.Size() >= dictSize {
+		return info.Size(), os.Remove(tmpPath)
+	}
+	if err := os.Rename(tmpPath, outPath); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func ratio(output, input int64) float64 {
+	return report.Ratio(output, input)
+}
+
+func newRunReport(stats runStats, inputDir, outDir string, level int, runID string) report.Run {
+	return report.Run{
+		Tool:      "compress",
+		CreatedAt: deterministic.Now().UTC().Format(time.RFC3339),
+		RunID:     runID,
+		InputDir:  inputDir,
+		OutputDir: outDir,
+		Level:     level,
+		Encoder:   encoderLevel(level).String(),
+		Totals:    stats.Totals(),
+		Groups:    stats.GroupList(),
+		Files:     stats.Files,
+
+		PriorityTiers: stats.PriorityTiers,
+	}
+}
+
+// statsHelp describes the gauges of the run's stats.RunStats.
+var statsHelp = map[string]string{
+	"compress_duration_seconds": "Duration of the last compression run in seconds.",
+	"compress_files_processed":  "Number of files processed in the last compression run.",
+	"compress_files_skipped":    "Number of files skipped in the last compression run: special, oversized and left unprocessed by the output budget.",
+	"compress_files_failed":     "Number of files that failed to compress in the last run.",
+	"compress_input_bytes":      "Total input bytes compressed in the last run.",
+	"compress_output_bytes":     "Total output bytes produced in the last run.",
+	"compress_ratio":            "Output/input size ratio for the last compression run.",
 }
 
-func pushMetrics(pushURL string, stats runStats, duration time.Duration, source string, level int, useDict bool, runID string) error {
+// pushMetrics pushes the run's metrics. Per-file series are only added when
+// fileLimit is positive and the run has at most that many files, so a large
+// run can never push one series per file.
+func pushMetrics(pushURL string, stats runStats, duration time.Duration, source string, level int, useDict bool, runID string, perGroup bool, fileLimit int, buckets histogramBuckets) error {
 	registry := prometheus.NewRegistry()
 
-	durationGauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "compress_duration_seconds",
-		Help: "Duration of the last compression run in seconds.",
+	unprocessedGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "compress_files_unprocessed",
+		Help: "Number of files left unprocessed because the output budget was reached.",
 	})
-	filesGauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "compress_files_processed",
-		Help: "Number of files processed in the last compression run.",
+	fallbackCounter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "compress_dict_fallback_used",
+		Help: "Number of files where the output without the dictionary was smaller and kept.",
 	})
-	inputBytesGauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "compress_input_bytes",
-		Help: "Total input bytes compressed in the last run.",
+	copiedGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "compress_files_copied",
+		Help: "Number of unmatched files copied uncompressed by -copy-unmatched in the last run.",
 	})
-	outputBytesGauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "compress_output_bytes",
-		Help: "Total output bytes produced in the last run.",
+	specialGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "compress_special_files_skipped",
+		Help: "Number of FIFOs, sockets and devices under -in skipped in the last run.",
 	})
-	ratioGauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "compress_ratio",
-		Help: "Output/input size ratio for the last compression run.",
+	oversizedGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "compress_files_oversized",
+		Help: "Number of input files larger than -max-file-size skipped in the last run.",
+	})
+	bundledGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "compress_files_bundled",
+		Help: "Number of small files compressed into bundles by -batch-small-files in the last run.",
+	})
+	bundleSavedGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "compress_bundle_bytes_saved",
+		Help: "Bytes saved by -batch-small-files bundles over compressing each bundled file on its own in the last run.",
+	})
+	unstableGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "compress_files_unstable",
+		Help: "Number of input files whose size or modification time changed while they were compressed in the last run, after any -retry-unstable retry.",
+	})
+	levelFallbackGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "compress_level_fallback",
+		Help: "1 when -level-fallback compressed the last run at a lower level than -level (the level label is the one used), 0 otherwise.",
 	})
 	timestampGauge := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "compress_last_run_timestamp_seconds",
 		Help: "Unix timestamp of the last compression run.",
 	})
 
-	metrics := []prometheus.Collector{
-		durationGauge,
-		filesGauge,
-		inputBytesGauge,
-		outputBytesGauge,
-		ratioGauge,
+	stats.Duration = duration
+	metrics := append(stats.Gauges("compress").Collectors(statsHelp),
+		unprocessedGauge,
+		fallbackCounter,
+		copiedGauge,
+		specialGauge,
+		oversizedGauge,
+		bundledGauge,
+		bundleSavedGauge,
+		unstableGauge,
+		levelFallbackGauge,
 		timestampGauge,
+	)
+	if c := stats.Canary; c != nil {
+		canarySamples := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "compress_dict_canary_samples",
+			Help: "Number of files also compressed without the dictionary by -dict-canary in the last run.",
+		})
+		canaryWarnings := prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "compress_dict_canary_warnings",
+			Help: "Number of times the rolling dictionary improvement fell below -canary-min-improvement.",
+		})
+		canarySamples.Set(float64(c.Samples))
+		canaryWarnings.Add(float64(c.Warnings))
+		metrics = append(metrics, canarySamples, canaryWarnings)
+		if c.Samples > 0 {
+			canaryImprovement := prometheus.NewGauge(prometheus.GaugeOpts{
+				Name: "compress_dict_canary_improvement",
+				Help: "Rolling share of bytes saved by the dictionary over plain compression at the end of the last run.",
+			})
+			canaryImprovement.Set(c.Improvement)
+			metrics = append(metrics, canaryImprovement)
+		}
+	}
+	if stats.AB != nil {
+		metrics = append(metrics, abMetrics(*stats.AB)...)
+	}
+	if d := stats.Snapshot; d != nil {
+		snapshotFiles := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "compress_snapshot_files",
+			Help: "Number of input files added, changed, unchanged or removed since -since-snapshot in the last run (-snapshot-dir).",
+		}, []string{"change"})
+		snapshotFiles.WithLabelValues("added").Set(float64(d.Added))
+		snapshotFiles.WithLabelValues("changed").Set(float64(d.Changed))
+		snapshotFiles.WithLabelValues("unchanged").Set(float64(d.Unchanged))
+		snapshotFiles.WithLabelValues("removed").Set(float64(d.Removed))
+		metrics = append(metrics, snapshotFiles)
+	}
+	metrics = append(metrics, fileHistograms(stats, buckets)...)
+	if fileLimit > 0 && len(stats.Files) <= fileLimit {
+		fileRatio := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "compress_file_ratio",
+			Help: "Output/input size ratio per file in the last run (-per-file-metrics).",
+		}, []string{"file"})
+		for _, f := range stats.Files {
+			fileRatio.WithLabelValues(f.Label()).Set(f.Ratio)
+		}
+		metrics = append(metrics, fileRatio)
+	}
+	if perGroup {
+		groupFiles := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "compress_group_files_processed",
+			Help: "Number of files processed per input directory group in the last run.",
+		}, []string{"group"})
+		groupInput := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "compress_group_input_bytes",
+			Help: "Input bytes per input directory group in the last run.",
+		}, []string{"group"})
+		groupOutput := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "compress_group_output_bytes",
+			Help: "Output bytes per input directory group in the last run.",
+		}, []string{"group"})
+		groupRatio := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "compress_group_ratio",
+			Help: "Output/input size ratio per input directory group in the last run.",
+		}, []string{"group"})
+		for _, g := range stats.GroupList() {
+			groupFiles.WithLabelValues(g.Name).Set(float64(g.Files))
+			groupInput.WithLabelValues(g.Name).Set(float64(g.InputBytes))
+			groupOutput.WithLabelValues(g.Name).Set(float64(g.OutputBytes))
+			groupRatio.WithLabelValues(g.Name).Set(g.Ratio)
+		}
+		metrics = append(metrics, groupFiles, groupInput, groupOutput, groupRatio)
 	}
 	for _, metric := range metrics {
 		if err := registry.Register(metric); err != nil {
@@ -225,12 +1760,16 @@ func pushMetrics(pushURL string, stats runStats, duration time.Duration, source
 		}
 	}
 
-	durationGauge.Set(duration.Seconds())
-	filesGauge.Set(float64(stats.FilesProcessed))
-	inputBytesGauge.Set(float64(stats.InputBytes))
-	outputBytesGauge.Set(float64(stats.OutputBytes))
-	if stats.InputBytes > 0 {
-		ratioGauge.Set(float64(stats.OutputBytes) / float64(stats.InputBytes))
+	unprocessedGauge.Set(float64(stats.FilesUnprocessed))
+	fallbackCounter.Add(float64(stats.DictFallbacks))
+	copiedGauge.Set(float64(stats.FilesCopied))
+	specialGauge.Set(float64(stats.SpecialSkipped))
+	oversizedGauge.Set(float64(stats.FilesOversized))
+	bundledGauge.Set(float64(stats.FilesBundled))
+	bundleSavedGauge.Set(float64(stats.BundleBytesSaved))
+	unstableGauge.Set(float64(stats.FilesUnstable))
+	if stats.LevelFallback {
+		levelFallbackGauge.Set(1)
 	}
 	timestampGauge.Set(float64(time.Now().Unix()))
 
@@ -243,7 +1782,5 @@ func pushMetrics(pushURL string, stats runStats, duration time.Duration, source
 		levelLabel = strconv.Itoa(level)
 	}
 
-	pusher := push.New(pushURL, "compress").Gatherer(registry)
-	pusher = pusher.Grouping("source", source).Grouping("use_dict", strconv.FormatBool(useDict)).Grouping("level", levelLabel).Grouping("run_id", runID)
-	return pusher.Push()
+	return pushspool.Push(pushSpool, pushURL, "compress", pushspool.Grouping{"source": source, "use_dict": strconv.FormatBool(useDict), "level": levelLabel, "run_id": runID}, registry)
 }
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"zstd-learning/internal/frame"
+	"zstd-learning/internal/summary"
+)
+
+// runEnv makes the test binary run main instead of the tests, so a test can
+// run the command as a child process and look at its exit code.
+const runEnv = "ZSTD_LEARNING_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runEnv) == "1" {
+		main()
+		exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// run runs the command with args and returns its exit code and combined
+// output.
+func run(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runEnv+"=1")
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), string(out)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0, string(out)
+}
+
+// fakeGateway starts a Pushgateway stand-in and returns its URL and a
+// function returning the gauge values of the pushes it has received, by
+// family name and, for labeled series, also by name and sorted labels such
+// as compress_file_ratio{file=d0/a.json}.
+func fakeGateway(t *testing.T) (string, func() map[string]float64) {
+	t.Helper()
+	var mu sync.Mutex
+	gauges := map[string]float64{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		mu.Lock()
+		defer mu.Unlock()
+		for {
+			var family dto.MetricFamily
+			if err := dec.Decode(&family); err != nil {
+				return
+			}
+			for _, metric := range family.Metric {
+				value := metric.GetGauge().GetValue() + metric.GetCounter().GetValue()
+				gauges[family.GetName()] = value
+				if len(metric.Label) > 0 {
+					var labels []string
+					for _, label := range metric.Label {
+						labels = append(labels, label.GetName()+"="+label.GetValue())
+					}
+					sort.Strings(labels)
+					gauges[family.GetName()+"{"+strings.Join(labels, ",")+"}"] = value
+				}
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, func() map[string]float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return maps.Clone(gauges)
+	}
+}
+
+// record is a JSON line like the ones testDict is trained on.
+func record(i int) string {
+	return fmt.Sprintf(`{"id":%d,"name":"user-%d","email":"user-%d@example.com","active":%t}`, i, i%17, i, i%3 == 0)
+}
+
+// testDict is a zstd dictionary with ID 42 trained on records.
+var testDict = sync.OnceValues(func() ([]byte, error) {
+	var samples [][]byte
+	for i := 0; i < 300; i++ {
+		samples = append(samples, []byte(record(i)))
+	}
+	return dict.BuildZstdDict(samples, dict.Options{MaxDictSize: 4096, HashBytes: 6, ZstdDictID: 42})
+})
+
+func dictBytes(t *testing.T) []byte {
+	t.Helper()
+	d, err := testDict()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// frameDict returns the dictionary ID in the header of the zstd file at
+// path, 0 for none.
+func frameDict(t *testing.T, path string) uint32 {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := zstd.Header{}
+	if err := header.Decode(data); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return header.DictionaryID
+}
+
+// decodeFile decodes the zstd file at path with dicts registered.
+func decodeFile(t *testing.T, path string, dicts ...[]byte) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dicts...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	plain, err := decoder.DecodeAll(data, nil)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return string(plain)
+}
+
+func TestCompressFileDeclaresContentSize(t *testing.T) {
+	dir := t.TempDir()
+	inPath := filepath.Join(dir, "records.json")
+	data := strings.Repeat(`{"id": 7, "name": "gamma"}`+"\n", 20000)
+	if err := os.WriteFile(inPath, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+
+	tests := []struct {
+		name   string
+		minify bool
+		mm     mmapOptions
+	}{
+		{"streamed", false, mmapOptions{}},
+		{"mapped", false, mmapOptions{Enabled: true, MemCap: 1 << 20}},
+		{"mapped in windows", false, mmapOptions{Enabled: true, MemCap: 64 << 10}},
+		{"minified", true, mmapOptions{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outPath := filepath.Join(t.TempDir(), "records.json.zst")
+			_, encoded, err := compressFile(encoder, inPath, outPath, tt.minify, tt.mm, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := os.Open(outPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer out.Close()
+			frames, err := frame.ScanAll(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var declared int64
+			for _, info := range frames {
+				if !info.HasContentSize() {
+					t.Fatalf("frame at %d does not declare its content size", info.Offset)
+				}
+				declared += int64(info.ContentSize)
+			}
+			if declared != encoded {
+				t.Errorf("frames declare %d bytes, %d were encoded", declared, encoded)
+			}
+		})
+	}
+}
+
+func TestAllowEmpty(t *testing.T) {
+	in := t.TempDir()
+	url, pushed := fakeGateway(t)
+
+	code, out := run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url)
+	if code != 1 || !strings.Contains(out, "no files found in "+in) {
+		t.Fatalf("without -allow-empty: exit %d, output:\n%s", code, out)
+	}
+	if len(pushed()) != 0 {
+		t.Fatal("metrics pushed for a run that failed on empty input")
+	}
+
+	code, out = run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url, "-allow-empty")
+	if code != 0 {
+		t.Fatalf("with -allow-empty: exit %d, output:\n%s", code, out)
+	}
+	gauges := pushed()
+	for _, name := range []string{"compress_files_processed", "compress_input_bytes", "compress_output_bytes", "compress_ratio"} {
+		if value, ok := gauges[name]; !ok || value != 0 {
+			t.Errorf("%s: pushed %v (present %v), want 0", name, value, ok)
+		}
+	}
+}
+
+// compressed lists the outputs a run wrote to dir.
+func compressed(t *testing.T, dir string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*.zst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, path := range paths {
+		names = append(names, filepath.Base(path))
+	}
+	return names
+}
+
+// writeFiles creates files, keyed by slash-separated path, under dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOutputsDifferingOnlyInCaseWarn(t *testing.T) {
+	in := t.TempDir()
+	writeFiles(t, in, map[string]string{"README": "upper", "readme": "lower"})
+	if entries, _ := os.ReadDir(in); len(entries) != 2 {
+		t.Skip("the filesystem ignores case")
+	}
+	url, _ := fakeGateway(t)
+	out := t.TempDir()
+
+	code, output := run(t, "-in", in, "-out", out, "-pushgateway", url)
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, output)
+	}
+	if !strings.Contains(output, "warning: README and readme map to outputs that differ only in case") {
+		t.Errorf("no case warning in output:\n%s", output)
+	}
+	for _, name := range []string{"README.zst", "readme.zst"} {
+		if _, err := os.Stat(filepath.Join(out, name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// runOutputs runs the command like run, feeding it stdin, and returns its
+// stdout and stderr apart.
+func runOutputs(t *testing.T, stdin string, args ...string) (code int, stdout, stderr string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runEnv+"=1")
+	cmd.Stdin = strings.NewReader(stdin)
+	var outBuf, errBuf strings.Builder
+	cmd.Stdout, cmd.Stderr = &outBuf, &errBuf
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), outBuf.String(), errBuf.String()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0, outBuf.String(), errBuf.String()
+}
+
+func TestStdoutHoldsOnlyTheSummary(t *testing.T) {
+	url, _ := fakeGateway(t)
+	in := t.TempDir()
+	writeFiles(t, in, map[string]string{"app.log": strings.Repeat("GET /index.html 200\n", 100)})
+	data := strings.Repeat(`{"id": 1}`+"\n", 100)
+
+	tests := []struct {
+		name   string
+		stdin  string
+		args   []string
+		action string
+	}{
+		{"append", "", []string{"-append", "-in", filepath.Join(in, "app.log"), "-out", filepath.Join(t.TempDir(), "app.log.zst")}, "append"},
+		{"stdin", data, []string{"-in", "-", "-out", t.TempDir(), "-verbose"}, "compress"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append(tt.args, "-pushgateway", url, "-summary-format", "json")
+			code, stdout, stderr := runOutputs(t, tt.stdin, args...)
+			if code != 0 {
+				t.Fatalf("exit %d, stderr:\n%s", code, stderr)
+			}
+			var sum summary.Summary
+			if err := json.Unmarshal([]byte(stdout), &sum); err != nil || strings.Count(stdout, "\n") != 1 {
+				t.Fatalf("stdout is not one JSON summary (%v):\n%s", err, stdout)
+			}
+			if sum.Action != tt.action || sum.Files != 1 || sum.InputBytes == 0 || sum.OutputBytes == 0 {
+				t.Errorf("summary %+v", sum)
+			}
+
+			code, stdout, stderr = runOutputs(t, tt.stdin, append(tt.args, "-pushgateway", url, "-quiet")...)
+			if code != 0 {
+				t.Fatalf("with -quiet: exit %d, stderr:\n%s", code, stderr)
+			}
+			if stdout != "" || stderr != "" {
+				t.Errorf("with -quiet: stdout %q, stderr %q", stdout, stderr)
+			}
+		})
+	}
+}
+
+func TestDictFallback(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	// Bytes that share nothing with the dictionary compress no better with
+	// it, and its ID in the frame header makes that output larger.
+	var noise bytes.Buffer
+	for i := 0; noise.Len() < 300; i++ {
+		fmt.Fprintf(&noise, "%x", i*2654435761%4294967291)
+	}
+	files := map[string]string{
+		"records.json": record(1000) + "\n" + record(1001),
+		"noise.bin":    noise.String(),
+	}
+	writeFiles(t, in, files)
+	paths := []string{filepath.Join(in, "noise.bin"), filepath.Join(in, "records.json")}
+
+	d := dictBytes(t)
+	opts := compressOptions{Suffix: ".zst", DictBytes: d, DictFallback: true, Notes: io.Discard, Warnings: io.Discard}
+	stats, err := compressFiles(paths, in, out, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.DictFallbacks != 1 {
+		t.Errorf("%d fallbacks, want 1", stats.DictFallbacks)
+	}
+	if id := frameDict(t, filepath.Join(out, "noise.bin.zst")); id != 0 {
+		t.Errorf("noise.bin.zst uses dictionary %d, want the plain output", id)
+	}
+	if id := frameDict(t, filepath.Join(out, "records.json.zst")); id != 42 {
+		t.Errorf("records.json.zst uses dictionary %d, want 42", id)
+	}
+	var total int64
+	for name, plain := range files {
+		path := filepath.Join(out, name+".zst")
+		if got := decodeFile(t, path, d); got != plain {
+			t.Errorf("%s decodes to %q", name, got)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += info.Size()
+	}
+	if stats.OutputBytes != total {
+		t.Errorf("output bytes %d, want the %d on disk", stats.OutputBytes, total)
+	}
+	if leftover, _ := filepath.Glob(filepath.Join(out, "*.tmp")); len(leftover) != 0 {
+		t.Errorf("temporary files left: %q", leftover)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	in := t.TempDir()
+	writeFiles(t, in, map[string]string{"e.json": record(5), "b.json": record(2), "d.json": record(4), "a.json": record(1), "c.json": record(3)})
+	url, pushed := fakeGateway(t)
+
+	out := t.TempDir()
+	code, output := run(t, "-in", in, "-out", out, "-pushgateway", url, "-limit", "3")
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, output)
+	}
+	if got, want := compressed(t, out), []string{"a.json.zst", "b.json.zst", "c.json.zst"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("-limit 3 wrote %q, want the first 3 in sorted order %q", got, want)
+	}
+	if !strings.Contains(output, "limit of 3 files applied: 3 of 5 files processed") {
+		t.Errorf("summary does not report the limit:\n%s", output)
+	}
+	if got := pushed()["compress_files_processed"]; got != 3 {
+		t.Errorf("pushed %v files processed, want 3", got)
+	}
+
+	out = t.TempDir()
+	code, output = run(t, "-in", in, "-out", out, "-pushgateway", url, "-limit", "5")
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, output)
+	}
+	if got := compressed(t, out); len(got) != 5 || strings.Contains(output, "limit of") {
+		t.Errorf("-limit 5 of 5 files wrote %q, output:\n%s", got, output)
+	}
+}
+
+func TestPerFileMetrics(t *testing.T) {
+	in := t.TempDir()
+	writeFiles(t, in, map[string]string{"c.json": record(3), "d0/a.json": record(1), "d1/e/b.json": record(2)})
+	wantSeries := []string{"compress_file_ratio{file=c.json}", "compress_file_ratio{file=d0/a.json}", "compress_file_ratio{file=d1/e/b.json}"}
+
+	url, pushed := fakeGateway(t)
+	code, out := run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url, "-per-file-metrics", "-per-file-metrics-limit", "3")
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, out)
+	}
+	gauges := pushed()
+	for _, name := range wantSeries {
+		if ratio, ok := gauges[name]; !ok || ratio <= 0 {
+			t.Errorf("%s = %v (present %v), want a ratio", name, ratio, ok)
+		}
+	}
+
+	// One file over the cap turns the per-file series off altogether.
+	writeFiles(t, in, map[string]string{"d0/f.json": record(4)})
+	url, pushed = fakeGateway(t)
+	code, out = run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url, "-per-file-metrics", "-per-file-metrics-limit", "3")
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, out)
+	}
+	if !strings.Contains(out, "-per-file-metrics disabled: 4 files exceed -per-file-metrics-limit 3") {
+		t.Errorf("no warning that the cap was exceeded:\n%s", out)
+	}
+	gauges = pushed()
+	if _, ok := gauges["compress_file_ratio"]; ok {
+		t.Error("per-file series pushed over the cap")
+	}
+	if gauges["compress_files_processed"] != 4 {
+		t.Errorf("pushed %v files processed, want the aggregate of 4", gauges["compress_files_processed"])
+	}
+}
+
+func TestNotify(t *testing.T) {
+	in := t.TempDir()
+	writeFiles(t, in, map[string]string{"a.json": record(1)})
+	url, _ := fakeGateway(t)
+	var mu sync.Mutex
+	var bodies []map[string]any
+	failing := false
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+	}))
+	defer hook.Close()
+
+	code, out := run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url, "-notify-url", hook.URL, "-run-id", "n1")
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, out)
+	}
+	code, out = run(t, "-in", filepath.Join(in, "missing"), "-out", t.TempDir(), "-pushgateway", url, "-notify-url", hook.URL)
+	if code != 1 {
+		t.Fatalf("missing -in: exit %d, output:\n%s", code, out)
+	}
+	mu.Lock()
+	if len(bodies) != 2 {
+		t.Fatalf("got %d notifications, want 2", len(bodies))
+	}
+	if b := bodies[0]; b["command"] != "compress" || b["status"] != "success" || b["run_id"] != "n1" || b["files"] != 1.0 {
+		t.Errorf("success payload %v", b)
+	}
+	if b := bodies[1]; b["status"] != "failure" || b["error"] == nil {
+		t.Errorf("failure payload %v", b)
+	}
+	failing = true
+	mu.Unlock()
+
+	// An undeliverable notification is reported but leaves the exit code.
+	code, out = run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url, "-notify-url", hook.URL)
+	if code != 0 || !strings.Contains(out, "notification failed") {
+		t.Errorf("webhook down: exit %d, output:\n%s", code, out)
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	in := t.TempDir()
+	writeFiles(t, in, map[string]string{
+		"small.json":  record(1),
+		"big.json":    strings.Repeat(record(2), 100),
+		"tiny.log":    "a log line\n",
+		"d0/big.json": strings.Repeat(record(3), 100),
+	})
+	url, pushed := fakeGateway(t)
+
+	out := t.TempDir()
+	// -filter leaves out tiny.log before the size limit drops the big files.
+	code, output := run(t, "-in", in, "-out", out, "-pushgateway", url, "-max-file-size", "1KiB", "-filter", "ext == .json")
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, output)
+	}
+	if got := compressed(t, out); !reflect.DeepEqual(got, []string{"small.json.zst"}) {
+		t.Errorf("wrote %q, want only small.json.zst", got)
+	}
+	if _, err := os.Stat(filepath.Join(out, "d0")); !os.IsNotExist(err) {
+		t.Errorf("d0 was written to: %v", err)
+	}
+	for _, want := range []string{
+		"skipping " + filepath.Join(in, "big.json") + ": larger than -max-file-size 1.0 KiB",
+		"skipping " + filepath.Join(in, "d0", "big.json") + ": larger than -max-file-size",
+		"skipped 2 files larger than -max-file-size",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output lacks %q:\n%s", want, output)
+		}
+	}
+	gauges := pushed()
+	if gauges["compress_files_oversized"] != 2 || gauges["compress_files_processed"] != 1 {
+		t.Errorf("pushed %v oversized and %v processed, want 2 and 1", gauges["compress_files_oversized"], gauges["compress_files_processed"])
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+
+	"zstd-learning/internal/walk"
+)
+
+// isJSONCandidate reports whether path should be minified: it has a .json
+// extension or its first non-whitespace byte opens a JSON object or array.
+func isJSONCandidate(path string) (bool, error) {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return true, nil
+	}
+	f, err := walk.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return false, nil
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '{', '[':
+			return true, nil
+		default:
+			return false, nil
+		}
+	}
+}
+
+// minifyJSON returns data with insignificant whitespace removed. Key order,
+// number formatting and string escapes are kept as written. ok is false when
+// data is not a single valid JSON value, in which case data is returned
+// unchanged.
+func minifyJSON(data []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+	if err := json.Compact(&buf, data); err != nil {
+		return data, false
+	}
+	return buf.Bytes(), true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMinifyJSON(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"{\n  \"b\": 1,\n  \"a\": [1, 2.50, 3e2]\n}\n", `{"b":1,"a":[1,2.50,3e2]}`, true},
+		{`{ "text": "keep  these   spaces", "esc": "é\n" }`, `{"text":"keep  these   spaces","esc":"é\n"}`, true},
+		{"\t[ ]\r\n", "[]", true},
+		{`"just a string"`, `"just a string"`, true},
+		{`{"a": 1,}`, `{"a": 1,}`, false},
+		{"{\"a\": 1}\n{\"a\": 2}\n", "{\"a\": 1}\n{\"a\": 2}\n", false},
+		{"not json", "not json", false},
+	}
+	for _, tt := range tests {
+		got, ok := minifyJSON([]byte(tt.in))
+		if string(got) != tt.want || ok != tt.ok {
+			t.Errorf("minifyJSON(%q) = %q, %v; want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestIsJSONCandidate(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name, data string
+		want       bool
+	}{
+		{"a.json", "not even json", true},
+		{"a.JSON", "", true},
+		{"a.txt", "  \n{\"a\":1}", true},
+		{"a.log", "\t[1,2]", true},
+		{"a.txt", "hello {", false},
+		{"a.csv", "", false},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(path, []byte(tt.data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := isJSONCandidate(path); err != nil || got != tt.want {
+			t.Errorf("isJSONCandidate(%s with %q) = %v, %v; want %v", tt.name, tt.data, got, err, tt.want)
+		}
+	}
+}
+
+func TestMinifyJSONShrinksOutput(t *testing.T) {
+	in := t.TempDir()
+	var records []map[string]any
+	for i := 0; i < 200; i++ {
+		records = append(records, map[string]any{"id": i, "name": record(i), "tags": []string{"a", "b"}})
+	}
+	pretty, err := json.MarshalIndent(records, "", "    ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact, _ := minifyJSON(pretty)
+	writeFiles(t, in, map[string]string{"records.json": string(pretty), "notes.txt": "  plain text,  kept as is  "})
+	paths := []string{filepath.Join(in, "notes.txt"), filepath.Join(in, "records.json")}
+
+	opts := compressOptions{Suffix: ".zst", Notes: io.Discard, Warnings: io.Discard}
+	plainOut := t.TempDir()
+	plain, err := compressFiles(paths, in, plainOut, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.MinifyJSON = true
+	minOut := t.TempDir()
+	minified, err := compressFiles(paths, in, minOut, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if minified.MinifiedFiles != 1 || minified.MinifiedBytes != int64(len(pretty)-len(compact)) {
+		t.Errorf("minified %d files, %d bytes; want 1 and %d", minified.MinifiedFiles, minified.MinifiedBytes, len(pretty)-len(compact))
+	}
+	if minified.InputBytes != plain.InputBytes {
+		t.Errorf("input bytes %d, want the %d read, as without -minify-json", minified.InputBytes, plain.InputBytes)
+	}
+	if minified.OutputBytes >= plain.OutputBytes {
+		t.Errorf("output %d bytes with -minify-json, %d without; want smaller", minified.OutputBytes, plain.OutputBytes)
+	}
+	if got := decodeFile(t, filepath.Join(minOut, "records.json.zst")); got != string(compact) {
+		t.Errorf("records.json decodes to %d bytes, want the %d-byte minified form", len(got), len(compact))
+	}
+	if got := decodeFile(t, filepath.Join(minOut, "notes.txt.zst")); got != "  plain text,  kept as is  " {
+		t.Errorf("notes.txt decodes to %q, want it unchanged", got)
+	}
+	if !strings.Contains(decodeFile(t, filepath.Join(plainOut, "records.json.zst")), "\n    ") {
+		t.Error("without -minify-json the output lost its indentation")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+
+	"zstd-learning/internal/crypt"
+)
+
+// mmapWindow is how much of a mapped file is handed to the streaming
+// encoder per Write when the file is above the -mmap-mem-cap.
+const mmapWindow = 4 << 20
+
+// mmapOptions configures -mmap. The zero value disables it.
+type mmapOptions struct {
+	Enabled bool
+	MinSize int64
+	MemCap  int64
+}
+
+// use reports whether a regular file of size bytes should be mapped.
+func (o mmapOptions) use(size int64) bool {
+	return o.Enabled && size >= o.MinSize && size > 0 && int64(int(size)) == size
+}
+
+// compressMapped compresses in, a regular file of size bytes, from a
+// read-only mapping into outPath. Files up to opts.MemCap are encoded in one
+// EncodeAll call; larger ones are fed to the streaming encoder in windows so
+// the compressed output is not held in memory. ok is false when the file
+// could not be mapped and nothing was written; the caller then streams it.
+//
+// A file truncated while mapped makes the process fault (SIGBUS) when the
+// missing pages are read, which Go cannot recover from. The size is checked
+// before and after encoding so that a file that shrank is reported as an
+// error, but -mmap should only be used on inputs nothing else is writing.
+// One that grew gives a valid frame of the mapped bytes and is reported as
+// unstable by compressOne.
+func compressMapped(encoder *zstd.Encoder, in *os.File, size int64, outPath string, opts mmapOptions, seal *crypt.Sealer) (written int64, ok bool, err error) {
+	data, unmap, err := mapFile(in, size)
+	if err != nil {
+		return 0, false, nil
+	}
+	defer unmap()
+
+	outFile, err := createOutput(outPath, seal)
+	if err != nil {
+		return 0, true, err
+	}
+
+	if size <= opts.MemCap {
+		_, err = outFile.Write(encoder.EncodeAll(data, nil))
+	} else {
+		encoder.ResetContentSize(outFile, size)
+		for start := 0; start < len(data) && err == nil; start += mmapWindow {
+			_, err = encoder.Write(data[start:min(start+mmapWindow, len(data))])
+		}
+		if closeErr := encoder.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := outFile.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return size, true, err
+	}
+
+	info, err := in.Stat()
+	if err != nil {
+		return size, true, err
+	}
+	if info.Size() < size {
+		return size, true, fmt.Errorf("%s shrank from %d to %d bytes while mapped", in.Name(), size, info.Size())
+	}
+	return size, true, nil
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// mapFile is not implemented on this platform; -mmap falls back to
+// streaming reads.
+func mapFile(f *os.File, size int64) ([]byte, func() error, error) {
+	return nil, nil, errors.ErrUnsupported
+}
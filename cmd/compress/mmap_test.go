@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// writeLarge writes n bytes of JSON lines to a file in dir.
+func writeLarge(t testing.TB, dir string, n int) string {
+	t.Helper()
+	var data bytes.Buffer
+	for i := 0; data.Len() < n; i++ {
+		fmt.Fprintf(&data, `{"id":%d,"name":"user-%d","email":"user-%d@example.com","score":%d}`+"\n", i, i%97, i, i*31%1000)
+	}
+	path := filepath.Join(dir, "large.json")
+	if err := os.WriteFile(path, data.Bytes()[:n], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// mmapCases are the paths compressFile can take for a large file: the
+// streaming one, one EncodeAll over the mapping, and windowed writes from
+// it above the memory cap.
+var mmapCases = []struct {
+	name string
+	mm   mmapOptions
+}{
+	{"stream", mmapOptions{}},
+	{"mmap", mmapOptions{Enabled: true, MemCap: 1 << 30}},
+	{"mmap windowed", mmapOptions{Enabled: true, MemCap: 1}},
+}
+
+func TestCompressFileMapped(t *testing.T) {
+	dir := t.TempDir()
+	// Not a multiple of mmapWindow, so the last window is short.
+	in := writeLarge(t, dir, 2*mmapWindow+12345)
+	want, err := os.ReadFile(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+
+	for _, tc := range mmapCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out := filepath.Join(dir, tc.name+".zst")
+			written, encoded, err := compressFile(encoder, in, out, false, tc.mm, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written != int64(len(want)) || encoded != written {
+				t.Errorf("written %d, encoded %d; want %d", written, encoded, len(want))
+			}
+			frame, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			header := zstd.Header{}
+			if err := header.Decode(frame); err != nil {
+				t.Fatal(err)
+			}
+			if !header.HasFCS || header.FrameContentSize != uint64(len(want)) {
+				t.Errorf("frame declares %d bytes (%v), want %d", header.FrameContentSize, header.HasFCS, len(want))
+			}
+			got, err := decoder.DecodeAll(frame, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Error("decoded output differs from the input")
+			}
+		})
+	}
+}
+
+// BenchmarkCompressFile compares streaming a large file into the encoder
+// with feeding it from a mapping.
+func BenchmarkCompressFile(b *testing.B) {
+	dir := b.TempDir()
+	const size = 64 << 20
+	in := writeLarge(b, dir, size)
+	out := filepath.Join(dir, "large.json.zst")
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer encoder.Close()
+
+	for _, tc := range mmapCases {
+		b.Run(tc.name, func(b *testing.B) {
+			b.SetBytes(size)
+			for b.Loop() {
+				if _, _, err := compressFile(encoder, in, out, false, tc.mm, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
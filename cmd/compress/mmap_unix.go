@@ -0,0 +1,21 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mapFile maps the first size bytes of f read-only. The returned function
+// unmaps it.
+func mapFile(f *os.File, size int64) ([]byte, func() error, error) {
+	data, err := unix.Mmap(int(f.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The encoder reads the mapping front to back exactly once.
+	_ = unix.Madvise(data, unix.MADV_SEQUENTIAL)
+	return data, func() error { return unix.Munmap(data) }, nil
+}
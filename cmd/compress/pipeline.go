@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+
+	"zstd-learning/internal/fdlimit"
+	"zstd-learning/internal/walk"
+)
+
+// pipelineOptions configures -readers. With Readers above 0, that many
+// goroutines read files ahead into memory, holding at most PrefetchBytes at
+// once, while Encoders goroutines compress them, so the encoders do not sit
+// idle waiting on a slow disk. Files larger than PrefetchBytes are not read
+// ahead; an encoder streams them from disk itself. Files bounds the inputs
+// and outputs open at once across readers and encoders (-max-open-files).
+type pipelineOptions struct {
+	Readers       int
+	Encoders      int
+	PrefetchBytes int64
+	Files         *fdlimit.Limit
+}
+
+// byteBudget bounds the bytes held by read-ahead files.
+type byteBudget struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int64
+	used   int64
+	closed bool
+}
+
+func newByteBudget(limit int64) *byteBudget {
+	b := &byteBudget{limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire waits until n more bytes fit in the budget and takes them. n must
+// not exceed the limit. It returns false, taking nothing, once the budget is
+// closed.
+func (b *byteBudget) acquire(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for !b.closed && b.used+n > b.limit {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *byteBudget) release(n int64) {
+	if n == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// close wakes every waiting acquire, which then fails.
+func (b *byteBudget) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// prefetchJob is a file handed from a reader to the encoders. held is the
+// part of the budget its data takes.
+type prefetchJob struct {
+	index int
+	job   fileJob
+	held  int64
+	err   error
+}
+
+// fileOutcome is a compressed file handed back from an encoder.
+type fileOutcome struct {
+	index  int
+	result fileResult
+	err    error
+}
+
+// compressPipelined is compressFiles with -readers. Files are added to the
+// totals as they complete, and the report entries are sorted by path at
+// the end, so the report does not depend on scheduling. The first error
+// stops the reading of further files; files already being compressed
+// finish and are counted.
+func compressPipelined(paths, rels, outPaths []string, opts compressOptions) (runStats, error) {
+	stats := runStats{}
+	pipe := opts.Pipeline
+
+	encoders := make([]fileEncoders, pipe.Encoders)
+	for i := range encoders {
+		var err error
+		encoders[i], err = newFileEncoders(opts, false)
+		if err != nil {
+			for _, e := range encoders[:i] {
+				e.close()
+			}
+			return stats, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	budget := newByteBudget(pipe.PrefetchBytes)
+	defer budget.close()
+
+	indexes := make(chan int)
+	go func() {
+		defer close(indexes)
+		for i := range paths {
+			select {
+			case indexes <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	jobs := make(chan prefetchJob, pipe.Readers)
+	var readers sync.WaitGroup
+	for range pipe.Readers {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for i := range indexes {
+				job := prefetch(fileJob{Path: paths[i], Rel: rels[i], Out: outPaths[i]}, budget, pipe.Files)
+				job.index = i
+				select {
+				case jobs <- job:
+				case <-ctx.Done():
+					budget.release(job.held)
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		readers.Wait()
+		close(jobs)
+	}()
+
+	outcomes := make(chan fileOutcome)
+	var workers sync.WaitGroup
+	for _, e := range encoders {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			defer e.close()
+			for job := range jobs {
+				if ctx.Err() != nil {
+					budget.release(job.held)
+					continue
+				}
+				outcome := fileOutcome{index: job.index, err: job.err}
+				if outcome.err == nil {
+					// An encoder holds at most its input and one output open.
+					pipe.Files.Acquire(2)
+					outcome.result, outcome.err = compressOne(e, job.job, opts, nil, job.index)
+					pipe.Files.Release(2)
+				}
+				budget.release(job.held)
+				outcomes <- outcome
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(outcomes)
+	}()
+
+	var firstErr error
+	for outcome := range outcomes {
+		if outcome.err != nil {
+			if firstErr == nil {
+				firstErr = outcome.err
+				cancel()
+				budget.close()
+			}
+			continue
+		}
+		stats.addResult(rels[outcome.index], outcome.result, opts)
+	}
+	sort.Slice(stats.Files, func(i, j int) bool { return stats.Files[i].Path < stats.Files[j].Path })
+	return stats, firstErr
+}
+
+// prefetch reads job's file into memory when it fits in the budget, waiting
+// for room. Files larger than the whole budget, and any file once the
+// budget is closed, are left for the encoder to stream.
+func prefetch(job fileJob, budget *byteBudget, files *fdlimit.Limit) prefetchJob {
+	out := prefetchJob{job: job}
+	info, err := os.Stat(job.Path)
+	if err != nil {
+		out.err = err
+		return out
+	}
+	if !info.Mode().IsRegular() || info.Size() > budget.limit || !budget.acquire(info.Size()) {
+		return out
+	}
+	out.held = info.Size()
+	files.Acquire(1)
+	data, err := walk.ReadFile(job.Path)
+	files.Release(1)
+	if err != nil {
+		out.err = err
+		return out
+	}
+	out.job.Data, out.job.Loaded = data, true
+	return out
+}
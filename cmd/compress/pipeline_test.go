@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"zstd-learning/internal/fdlimit"
+)
+
+// prefetchLimit is the -prefetch-bytes the pipeline tests run with; the
+// tree from writeTree has files on both sides of it.
+const prefetchLimit = 16 << 10
+
+// writeTree writes small JSON files in a few directories, some empty ones
+// and a few larger than prefetchLimit, and returns their paths sorted, as
+// the walk hands them to compressFiles.
+func writeTree(t testing.TB, dir string, small int) []string {
+	t.Helper()
+	files := map[string]string{}
+	for i := 0; i < small; i++ {
+		files[fmt.Sprintf("d%d/f%03d.json", i%4, i)] = strings.Repeat(fmt.Sprintf(`{"id":%d,"name":"user-%d"}`+"\n", i, i%7), 1+i%40)
+	}
+	for i := 0; i < 3; i++ {
+		files[fmt.Sprintf("d%d/large%d.json", i, i)] = strings.Repeat(fmt.Sprintf(`{"id":%d,"blob":"%s"}`+"\n", i, strings.Repeat("x", i+10)), prefetchLimit/20*(i+2))
+	}
+	files["d0/empty.json"] = ""
+	files["d3/empty.json"] = ""
+
+	var paths []string
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func pipelineOpts(readers, encoders int) compressOptions {
+	opts := compressOptions{Level: 3, Suffix: ".zst", GroupDepth: 1, Notes: io.Discard, Warnings: io.Discard}
+	if readers > 0 {
+		opts.Pipeline = pipelineOptions{Readers: readers, Encoders: encoders, PrefetchBytes: prefetchLimit, Files: fdlimit.New(8)}
+	}
+	return opts
+}
+
+// TestPipelineMatchesSerial checks that -readers counts and reports the
+// same as compressing the files one by one, for prefetched files and those
+// too large for -prefetch-bytes alike.
+func TestPipelineMatchesSerial(t *testing.T) {
+	in := t.TempDir()
+	paths := writeTree(t, in, 60)
+
+	serialOut := t.TempDir()
+	serial, err := compressFiles(paths, in, serialOut, pipelineOpts(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial.FilesProcessed != len(paths) {
+		t.Fatalf("serial run processed %d files, want %d", serial.FilesProcessed, len(paths))
+	}
+
+	for _, shape := range []struct{ readers, encoders int }{{1, 1}, {3, 2}, {8, 4}} {
+		t.Run(fmt.Sprintf("readers=%d,encoders=%d", shape.readers, shape.encoders), func(t *testing.T) {
+			out := t.TempDir()
+			piped, err := compressFiles(paths, in, out, pipelineOpts(shape.readers, shape.encoders))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(piped, serial) {
+				t.Errorf("pipelined stats\n%+v\nwant the serial\n%+v", piped, serial)
+			}
+			for _, path := range paths {
+				rel, _ := filepath.Rel(in, path)
+				want, err := os.ReadFile(filepath.Join(serialOut, rel+".zst"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := os.ReadFile(filepath.Join(out, rel+".zst"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != string(want) {
+					t.Errorf("%s differs from the serial output", rel)
+				}
+			}
+		})
+	}
+}
+
+func TestPipelineStopsAtFirstError(t *testing.T) {
+	in := t.TempDir()
+	paths := writeTree(t, in, 20)
+	missing := filepath.Join(in, "d1", "gone.json")
+	paths = append(paths, missing)
+
+	stats, err := compressFiles(paths, in, t.TempDir(), pipelineOpts(2, 2))
+	if err == nil || !strings.Contains(err.Error(), "gone.json") {
+		t.Fatalf("got %v, want the error for the missing file", err)
+	}
+	if stats.FilesProcessed >= len(paths) {
+		t.Errorf("%d files processed with one missing", stats.FilesProcessed)
+	}
+	if !sort.SliceIsSorted(stats.Files, func(i, j int) bool { return stats.Files[i].Path < stats.Files[j].Path }) {
+		t.Error("report entries are not sorted by path")
+	}
+}
+
+// BenchmarkCompressFiles compares compressing a tree of files one by one
+// with the -readers pipeline. The files are in the page cache, so this
+// measures the overlap of reading and encoding, not a slow disk.
+func BenchmarkCompressFiles(b *testing.B) {
+	in := b.TempDir()
+	paths := writeTree(b, in, 400)
+	var size int64
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size += info.Size()
+	}
+	for _, shape := range []struct {
+		name              string
+		readers, encoders int
+	}{
+		{"serial", 0, 0},
+		{"readers=2,encoders=2", 2, 2},
+		{"readers=4,encoders=4", 4, 4},
+	} {
+		b.Run(shape.name, func(b *testing.B) {
+			out := b.TempDir()
+			b.SetBytes(size)
+			for b.Loop() {
+				if _, err := compressFiles(paths, in, out, pipelineOpts(shape.readers, shape.encoders)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// openFiles counts the process's open descriptors, including the one the
+// count itself takes.
+func openFiles(t *testing.T) int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+// TestPipelineBoundsOpenFiles runs many more files than -max-open-files
+// through more readers and encoders than it allows, and checks on Linux
+// that the open descriptors stay within the limit and none are left open.
+func TestPipelineBoundsOpenFiles(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("counts descriptors in /proc/self/fd")
+	}
+	const maxOpen = 4
+	in := t.TempDir()
+	// Files above -prefetch-bytes keep an input and an output open for as
+	// long as they take to encode, so more open at once would show.
+	var paths []string
+	for i := 0; i < 24; i++ {
+		path := filepath.Join(in, fmt.Sprintf("f%02d.json", i))
+		var data []byte
+		for j := 0; len(data) < 64*prefetchLimit; j++ {
+			data = fmt.Appendf(data, `{"id":%d,"line":%d,"score":%d}`+"\n", i, j, j*7919%10007)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	opts := pipelineOpts(8, 6)
+	// A slow level keeps them open long enough to be seen.
+	opts.Level = 19
+	opts.Pipeline.Files = fdlimit.New(maxOpen)
+
+	baseline := openFiles(t)
+	done := make(chan struct{})
+	peak := make(chan int)
+	go func() {
+		most := 0
+		for {
+			select {
+			case <-done:
+				peak <- most
+				return
+			default:
+				// Not openFiles: t.Fatal must not run on this goroutine.
+				if entries, err := os.ReadDir("/proc/self/fd"); err == nil {
+					most = max(most, len(entries))
+				}
+			}
+		}
+	}()
+	_, err := compressFiles(paths, in, t.TempDir(), opts)
+	close(done)
+	most := <-peak
+	if err != nil {
+		t.Fatal(err)
+	}
+	if most > baseline+maxOpen {
+		t.Errorf("%d descriptors open at the peak, want at most %d more than the %d before the run", most, maxOpen, baseline)
+	}
+	if after := openFiles(t); after > baseline {
+		t.Errorf("%d descriptors open after the run, %d before", after, baseline)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"zstd-learning/internal/report"
+	"zstd-learning/internal/walk"
+)
+
+// Orders -priority accepts.
+const (
+	priorityNewest = "newest-first"
+	priorityOldest = "oldest-first"
+)
+
+// otherTier is the tier of the files no -priority-pattern matches.
+const otherTier = "other"
+
+// Statuses of a priority tier once the run is over.
+const (
+	tierComplete   = "complete"
+	tierPartial    = "partial"
+	tierNotStarted = "not started"
+)
+
+// patternList collects the repeated -priority-pattern globs, rejecting
+// malformed ones.
+type patternList []string
+
+func (l *patternList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *patternList) Set(value string) error {
+	if _, err := path.Match(value, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", value, err)
+	}
+	*l = append(*l, value)
+	return nil
+}
+
+// priorityTier is a tier of files dispatched together, in dispatch order.
+type priorityTier struct {
+	Name  string
+	Paths []string
+}
+
+// priorityOrder reorders paths, which are under baseDir, for -priority and
+// -priority-pattern. Each pattern makes a tier of the files it matches
+// first, in pattern order, with the files none matches last; within a tier
+// files go newest or oldest first by modification time, as order says, or
+// keep their sorted order when it is empty. Without patterns the tiers of
+// an age order are the UTC days files were last modified. It returns the
+// reordered paths and the tiers, empty ones left out.
+func priorityOrder(paths []string, baseDir string, stamps map[string]walk.Stamp, order string, patterns []string) ([]string, []priorityTier, error) {
+	tiers := make([]int, len(paths))
+	modTimes := make([]time.Time, len(paths))
+	for i, p := range paths {
+		if len(patterns) > 0 {
+			rel, err := filepath.Rel(baseDir, p)
+			if err != nil {
+				return nil, nil, err
+			}
+			tiers[i] = matchTier(filepath.ToSlash(rel), patterns)
+		}
+		if order == "" {
+			continue
+		}
+		stamp, ok := stamps[p]
+		if !ok {
+			info, err := os.Stat(p)
+			if err != nil {
+				return nil, nil, err
+			}
+			stamp = walk.StampOf(info)
+		}
+		modTimes[i] = stamp.ModTime
+	}
+
+	index := make([]int, len(paths))
+	for i := range index {
+		index[i] = i
+	}
+	sort.SliceStable(index, func(a, b int) bool {
+		x, y := index[a], index[b]
+		if tiers[x] != tiers[y] {
+			return tiers[x] < tiers[y]
+		}
+		switch order {
+		case priorityNewest:
+			return modTimes[x].After(modTimes[y])
+		case priorityOldest:
+			return modTimes[x].Before(modTimes[y])
+		}
+		return false
+	})
+
+	ordered := make([]string, len(paths))
+	var groups []priorityTier
+	for n, i := range index {
+		ordered[n] = paths[i]
+		name := otherTier
+		switch {
+		case len(patterns) == 0:
+			name = modTimes[i].UTC().Format(time.DateOnly)
+		case tiers[i] < len(patterns):
+			name = patterns[tiers[i]]
+		}
+		if len(groups) == 0 || groups[len(groups)-1].Name != name {
+			groups = append(groups, priorityTier{Name: name})
+		}
+		last := &groups[len(groups)-1]
+		last.Paths = append(last.Paths, paths[i])
+	}
+	return ordered, groups, nil
+}
+
+// matchTier returns the index of the first pattern rel matches, or
+// len(patterns). A pattern without a slash is also matched against the base
+// name, so *.json matches JSON files at any depth.
+func matchTier(rel string, patterns []string) int {
+	for i, pattern := range patterns {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return i
+		}
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+				return i
+			}
+		}
+	}
+	return len(patterns)
+}
+
+// tierProgress counts, per tier, the files done holds.
+func tierProgress(tiers []priorityTier, done map[string]bool) []report.PriorityTier {
+	progress := make([]report.PriorityTier, len(tiers))
+	for i, tier := range tiers {
+		t := report.PriorityTier{Name: tier.Name, Files: len(tier.Paths)}
+		for _, p := range tier.Paths {
+			if done[p] {
+				t.Processed++
+			}
+		}
+		switch t.Processed {
+		case t.Files:
+			t.Status = tierComplete
+		case 0:
+			t.Status = tierNotStarted
+		default:
+			t.Status = tierPartial
+		}
+		progress[i] = t
+	}
+	return progress
+}
+
+func printPriorityTiers(w io.Writer, tiers []report.PriorityTier) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIER\tFILES\tPROCESSED\tSTATUS")
+	for _, t := range tiers {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", t.Name, t.Files, t.Processed, t.Status)
+	}
+	tw.Flush()
+}
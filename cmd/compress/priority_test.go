@@ -0,0 +1,163 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"zstd-learning/internal/report"
+)
+
+// writeAged writes the named files under dir, each modified the given
+// number of days before 2024-06-10 noon UTC, and returns their paths in
+// sorted order.
+func writeAged(t *testing.T, dir string, ages map[string]int) []string {
+	t.Helper()
+	files := map[string]string{}
+	for name := range ages {
+		files[name] = strings.Repeat(name+"\n", 50)
+	}
+	writeFiles(t, dir, files)
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	var paths []string
+	for name, days := range ages {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		modTime := now.AddDate(0, 0, -days)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestPriorityOrder(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeAged(t, dir, map[string]int{"a.log": 1, "b.json": 3, "c.txt": 0, "d/e.json": 1, "f.log": 2})
+	rel := func(paths []string) []string {
+		var rels []string
+		for _, p := range paths {
+			r, _ := filepath.Rel(dir, p)
+			rels = append(rels, filepath.ToSlash(r))
+		}
+		return rels
+	}
+	tierNames := func(tiers []priorityTier) []string {
+		var names []string
+		for _, tier := range tiers {
+			names = append(names, tier.Name+":"+strings.Join(rel(tier.Paths), ","))
+		}
+		return names
+	}
+
+	tests := []struct {
+		name     string
+		order    string
+		patterns []string
+		want     []string
+		tiers    []string
+	}{
+		{"newest first", priorityNewest, nil,
+			[]string{"c.txt", "a.log", "d/e.json", "f.log", "b.json"},
+			[]string{"2024-06-10:c.txt", "2024-06-09:a.log,d/e.json", "2024-06-08:f.log", "2024-06-07:b.json"}},
+		{"oldest first", priorityOldest, nil,
+			[]string{"b.json", "f.log", "a.log", "d/e.json", "c.txt"},
+			[]string{"2024-06-07:b.json", "2024-06-08:f.log", "2024-06-09:a.log,d/e.json", "2024-06-10:c.txt"}},
+		// A pattern without a slash matches at any depth; within a tier
+		// files keep their sorted order.
+		{"patterns", "", []string{"*.json", "*.log"},
+			[]string{"b.json", "d/e.json", "a.log", "f.log", "c.txt"},
+			[]string{"*.json:b.json,d/e.json", "*.log:a.log,f.log", "other:c.txt"}},
+		{"patterns newest first", priorityNewest, []string{"*.log", "d/*"},
+			[]string{"a.log", "f.log", "d/e.json", "c.txt", "b.json"},
+			[]string{"*.log:a.log,f.log", "d/*:d/e.json", "other:c.txt,b.json"}},
+	}
+	for _, tt := range tests {
+		ordered, tiers, err := priorityOrder(paths, dir, nil, tt.order, tt.patterns)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := rel(ordered); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: order %q, want %q", tt.name, got, tt.want)
+		}
+		if got := tierNames(tiers); !reflect.DeepEqual(got, tt.tiers) {
+			t.Errorf("%s: tiers %q, want %q", tt.name, got, tt.tiers)
+		}
+	}
+}
+
+func TestTierProgress(t *testing.T) {
+	tiers := []priorityTier{
+		{Name: "*.json", Paths: []string{"a", "b"}},
+		{Name: "*.log", Paths: []string{"c", "d"}},
+		{Name: otherTier, Paths: []string{"e"}},
+	}
+	got := tierProgress(tiers, map[string]bool{"a": true, "b": true, "d": true})
+	want := []report.PriorityTier{
+		{Name: "*.json", Files: 2, Processed: 2, Status: tierComplete},
+		{Name: "*.log", Files: 2, Processed: 1, Status: tierPartial},
+		{Name: otherTier, Files: 1, Processed: 0, Status: tierNotStarted},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tierProgress = %+v, want %+v", got, want)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	in := t.TempDir()
+	writeAged(t, in, map[string]int{"old.log": 5, "new.log": 0, "mid.json": 2, "a.json": 4, "z.txt": 1})
+	url, _ := fakeGateway(t)
+
+	// -limit keeps the newest files rather than the first in sorted order.
+	out := t.TempDir()
+	code, output := run(t, "-in", in, "-out", out, "-pushgateway", url, "-priority", "newest-first", "-limit", "2")
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, output)
+	}
+	if got := compressed(t, out); !reflect.DeepEqual(got, []string{"new.log.zst", "z.txt.zst"}) {
+		t.Errorf("newest-first -limit 2 wrote %q, want the two newest", got)
+	}
+
+	out = t.TempDir()
+	code, output = run(t, "-in", in, "-out", out, "-pushgateway", url, "-priority-pattern", "*.json", "-priority-pattern", "*.log", "-limit", "3")
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, output)
+	}
+	if got := compressed(t, out); !reflect.DeepEqual(got, []string{"a.json.zst", "mid.json.zst", "new.log.zst"}) {
+		t.Errorf("-priority-pattern -limit 3 wrote %q, want the JSON files and the first log", got)
+	}
+	for _, row := range [][]string{
+		{"*.json", "2", "2", "complete"},
+		{"*.log", "2", "1", "partial"},
+		{"other", "1", "0", "not started"},
+	} {
+		if !containsRow(output, row) {
+			t.Errorf("output lacks the tier row %q:\n%s", row, output)
+		}
+	}
+
+	// Without a cut the tiers are not printed.
+	code, output = run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url, "-priority", "oldest-first")
+	if code != 0 || strings.Contains(output, "TIER") {
+		t.Errorf("a complete run: exit %d, output:\n%s", code, output)
+	}
+	if code, output := run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url, "-priority", "largest-first"); code != 1 || !strings.Contains(output, `invalid -priority "largest-first"`) {
+		t.Errorf("-priority largest-first: exit %d, output:\n%s", code, output)
+	}
+}
+
+// containsRow reports whether a line of output has exactly the fields of
+// row, as the tabwriter prints them.
+func containsRow(output string, row []string) bool {
+	for _, line := range strings.Split(output, "\n") {
+		if reflect.DeepEqual(strings.Fields(line), strings.Fields(strings.Join(row, " "))) {
+			return true
+		}
+	}
+	return false
+}
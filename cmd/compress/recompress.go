@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"zstd-learning/internal/console"
+	"zstd-learning/internal/dictfile"
+	"zstd-learning/internal/frame"
+	"zstd-learning/internal/outpath"
+	"zstd-learning/internal/pushspool"
+	"zstd-learning/internal/size"
+	"zstd-learning/internal/walk"
+)
+
+// recompressStats counts the outcome of compress recompress.
+type recompressStats struct {
+	Recompressed int
+	Skipped      int
+	OldBytes     int64
+	NewBytes     int64
+}
+
+// runRecompress handles compress recompress: every compressed file under -in
+// is decoded and compressed again at -level into a temporary file next to
+// it, which replaces the original only when it is at least
+// -recompress-min-gain percent smaller.
+func runRecompress(args []string) {
+	fs := flag.NewFlagSet("recompress", flag.ExitOnError)
+	inputDir := fs.String("in", "compressed", "directory of compressed files to recompress in place")
+	suffix := fs.String("suffix", ".zst", "suffix of the compressed files to recompress")
+	level := fs.Int("level", 0, "zstd compression level to recompress at (1..22)")
+	dictPath := fs.String("dict", "", "dictionary the files were compressed with; it is also used for the new outputs")
+	minGain := fs.Float64("recompress-min-gain", 5, "only replace a file when the new output is at least this many percent smaller")
+	verbose := fs.Bool("verbose", false, "print a line per file")
+	pushURL := fs.String("pushgateway", "http://localhost:9091", "Pushgateway base URL")
+	pushSpool = pushspool.Flags(fs)
+	runID := fs.String("run-id", "", "run identifier for metrics grouping")
+	colorFlag := fs.String("color", "auto", "colorize output: auto (only on a terminal), always, never")
+	fs.Parse(args)
+
+	colorMode, err := console.ParseMode(*colorFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+	stdout := console.NewPrinter(colorMode, os.Stdout)
+	stderr := console.NewPrinter(colorMode, os.Stderr)
+
+	if *level <= 0 {
+		fmt.Fprintln(os.Stderr, "-level is required for recompress")
+		exit(1)
+	}
+	if *minGain < 0 || *minGain >= 100 {
+		fmt.Fprintln(os.Stderr, "recompress-min-gain must be at least 0 and less than 100")
+		exit(1)
+	}
+	if *suffix == "" {
+		fmt.Fprintln(os.Stderr, "recompress needs a non-empty -suffix")
+		exit(1)
+	}
+
+	decoderOpts := []zstd.DOption{}
+	encoderOpts := []zstd.EOption{zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(*level))}
+	if *dictPath != "" {
+		loaded, err := dictfile.Load(*dictPath, false, "")
+		if err == nil && loaded.Raw {
+			err = errors.New("raw dictionaries are not supported by recompress")
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("invalid dictionary"), err)
+			exit(1)
+		}
+		decoderOpts = append(decoderOpts, zstd.WithDecoderDicts(loaded.Data))
+		encoderOpts = append(encoderOpts, zstd.WithEncoderDict(loaded.Data))
+	}
+
+	paths, _, err := walk.Files(*inputDir, nil, walk.Skip)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list input files: %v\n", err)
+		exit(1)
+	}
+	var inputs []string
+	for _, path := range paths {
+		if outpath.HasSuffix(path, *suffix) {
+			inputs = append(inputs, path)
+		}
+	}
+	if len(inputs) == 0 {
+		fmt.Fprintf(os.Stderr, "no %s files found in %s\n", *suffix, *inputDir)
+		exit(1)
+	}
+
+	decoder, err := zstd.NewReader(nil, decoderOpts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create decoder: %v\n", err)
+		exit(1)
+	}
+	defer decoder.Close()
+	encoder, err := zstd.NewWriter(nil, encoderOpts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create encoder: %v\n", err)
+		exit(1)
+	}
+	defer encoder.Close()
+
+	start := time.Now()
+	var stats recompressStats
+	for _, path := range inputs {
+		oldSize, newSize, replaced, err := recompressFile(decoder, encoder, path, *minGain)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s: %v\n", stderr.Red("recompress failed"), path, err)
+			exit(1)
+		}
+		stats.OldBytes += oldSize
+		if replaced {
+			stats.Recompressed++
+			stats.NewBytes += newSize
+		} else {
+			stats.Skipped++
+			stats.NewBytes += oldSize
+		}
+		if *verbose {
+			action := "kept"
+			if replaced {
+				action = "recompressed"
+			}
+			fmt.Printf("%s %s: %s -> %s (%.1f%% smaller)\n", action, path, size.Format(oldSize), size.Format(newSize), gainPercent(oldSize, newSize))
+		}
+	}
+	duration := time.Since(start)
+
+	source := filepath.Base(*inputDir)
+	if source == "." || source == string(filepath.Separator) {
+		source = "compressed"
+	}
+	if strings.TrimSpace(*runID) == "" {
+		*runID = time.Now().Format("20060102_150405")
+	}
+	if err := pushRecompressMetrics(*pushURL, stats, duration, source, *level, *runID); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("metrics push failed"), err)
+		exit(1)
+	}
+
+	fmt.Printf("recompressed %s of %d files at level %d: %s -> %s; %d kept (gain under %g%%)\n",
+		stdout.Bold(strconv.Itoa(stats.Recompressed)), len(inputs), *level, size.Format(stats.OldBytes), size.Format(stats.NewBytes), stats.Skipped, *minGain)
+}
+
+// recompressFile compresses the decoded content of path again into a
+// temporary file next to it and renames that over path only when it is at
+// least minGain percent smaller; otherwise path is left untouched. The
+// declared content size of the original frames is carried over.
+func recompressFile(decoder *zstd.Decoder, encoder *zstd.Encoder, path string, minGain float64) (oldSize, newSize int64, replaced bool, err error) {
+	in, err := walk.Open(path)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	oldSize = info.Size()
+
+	contentSize := int64(-1)
+	if frames, err := frame.ScanAll(in); err == nil {
+		contentSize = 0
+		for _, f := range frames {
+			if f.Skippable {
+				continue
+			}
+			if !f.HasContentSize() {
+				contentSize = -1
+				break
+			}
+			contentSize += f.ContentSize
+		}
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return oldSize, 0, false, err
+	}
+	if err := decoder.Reset(in); err != nil {
+		return oldSize, 0, false, err
+	}
+
+	tmpPath := inPlaceTempPath(path)
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return oldSize, 0, false, err
+	}
+	encoder.ResetContentSize(out, contentSize)
+	_, err = io.Copy(encoder, decoder)
+	if closeErr := encoder.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		var tmpInfo os.FileInfo
+		if tmpInfo, err = os.Stat(tmpPath); err == nil {
+			newSize = tmpInfo.Size()
+		}
+	}
+	if err != nil || gainPercent(oldSize, newSize) < minGain {
+		os.Remove(tmpPath)
+		return oldSize, newSize, false, err
+	}
+	if err := os.Chmod(tmpPath, info.Mode().Perm()); err != nil {
+		os.Remove(tmpPath)
+		return oldSize, newSize, false, err
+	}
+	if err := commitInPlace(tmpPath, path); err != nil {
+		return oldSize, newSize, false, err
+	}
+	return oldSize, newSize, true, nil
+}
+
+// gainPercent is how many percent smaller newSize is than oldSize; negative
+// when it grew.
+func gainPercent(oldSize, newSize int64) float64 {
+	if oldSize == 0 {
+		return 0
+	}
+	return (1 - float64(newSize)/float64(oldSize)) * 100
+}
+
+func pushRecompressMetrics(pushURL string, stats recompressStats, duration time.Duration, source string, level int, runID string) error {
+	registry := prometheus.NewRegistry()
+
+	recompressedGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "compress_recompress_files_replaced",
+		Help: "Number of files replaced by a smaller recompressed output in the last recompress run.",
+	})
+	skippedGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "compress_recompress_files_kept",
+		Help: "Number of files left untouched because recompressing gained less than -recompress-min-gain.",
+	})
+	savedGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "compress_recompress_bytes_saved",
+		Help: "Bytes saved by the files replaced in the last recompress run.",
+	})
+	durationGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "compress_recompress_duration_seconds",
+		Help: "Duration of the last recompress run in seconds.",
+	})
+	timestampGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "compress_recompress_last_run_timestamp_seconds",
+		Help: "Unix timestamp of the last recompress run.",
+	})
+
+	metrics := []prometheus.Collector{
+		recompressedGauge,
+		skippedGauge,
+		savedGauge,
+		durationGauge,
+		timestampGauge,
+	}
+	for _, metric := range metrics {
+		if err := registry.Register(metric); err != nil {
+			return err
+		}
+	}
+
+	recompressedGauge.Set(float64(stats.Recompressed))
+	skippedGauge.Set(float64(stats.Skipped))
+	savedGauge.Set(float64(stats.OldBytes - stats.NewBytes))
+	durationGauge.Set(duration.Seconds())
+	timestampGauge.Set(float64(time.Now().Unix()))
+
+	return pushspool.Push(pushSpool, pushURL, "compress-recompress", pushspool.Grouping{"source": source, "level": strconv.Itoa(level), "run_id": runID}, registry)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// TestRecompressMinGain recompresses a text file that gains from a higher
+// level and random data that cannot, which must be left untouched.
+func TestRecompressMinGain(t *testing.T) {
+	// Words with a skewed frequency leave the fastest level well short of
+	// what the best one finds.
+	rng := rand.New(rand.NewSource(1))
+	var words []string
+	for i := 0; i < 300; i++ {
+		words = append(words, fmt.Sprintf("w%x", rng.Int63()%1e6))
+	}
+	var text bytes.Buffer
+	for text.Len() < 256<<10 {
+		for j := 0; j < 8; j++ {
+			text.WriteString(words[int(rng.ExpFloat64()*30)%len(words)] + " ")
+		}
+		text.WriteString("\n")
+	}
+	random := make([]byte, 64<<10)
+	rng.Read(random)
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	dir := t.TempDir()
+	originals := map[string][]byte{}
+	for name, data := range map[string][]byte{"text.txt.zst": text.Bytes(), "random.bin.zst": random} {
+		frame := encoder.EncodeAll(data, nil)
+		originals[name] = frame
+		if err := os.WriteFile(filepath.Join(dir, name), frame, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	url, pushed := fakeGateway(t)
+	code, out := run(t, "recompress", "-in", dir, "-level", "19", "-recompress-min-gain", "5", "-pushgateway", url, "-verbose")
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, out)
+	}
+	if !strings.Contains(out, "recompressed 1 of 2 files at level 19") || !strings.Contains(out, "1 kept (gain under 5%)") {
+		t.Errorf("summary does not count one of each:\n%s", out)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "random.bin.zst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, originals["random.bin.zst"]) {
+		t.Error("random.bin.zst was rewritten for a gain under -recompress-min-gain")
+	}
+	recompressed, err := os.ReadFile(filepath.Join(dir, "text.txt.zst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gain := gainPercent(int64(len(originals["text.txt.zst"])), int64(len(recompressed))); gain < 5 {
+		t.Errorf("text.txt.zst is %.1f%% smaller, want at least 5%%", gain)
+	}
+	if decoded := decodeFile(t, filepath.Join(dir, "text.txt.zst")); decoded != text.String() {
+		t.Error("recompressed text.txt.zst decodes to different content")
+	}
+	header := zstd.Header{}
+	if err := header.Decode(recompressed); err != nil || !header.HasFCS || header.FrameContentSize != uint64(text.Len()) {
+		t.Errorf("recompressed frame declares %d bytes (%v, %v), want %d", header.FrameContentSize, header.HasFCS, err, text.Len())
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("%d files left in the directory, want the 2 originals", len(entries))
+	}
+	gauges := pushed()
+	if gauges["compress_recompress_files_replaced"] != 1 || gauges["compress_recompress_files_kept"] != 1 {
+		t.Errorf("pushed %v replaced and %v kept, want 1 and 1", gauges["compress_recompress_files_replaced"], gauges["compress_recompress_files_kept"])
+	}
+}
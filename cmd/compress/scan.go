@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"zstd-learning/internal/pushspool"
+)
+
+// scanStats is what -scan-only learns from walking -in: the files a real
+// run would compress and their total size.
+type scanStats struct {
+	Files      int
+	InputBytes int64
+	Duration   time.Duration
+}
+
+// scanFiles stats paths without opening them.
+func scanFiles(paths []string, start time.Time) (scanStats, error) {
+	inputBytes, err := totalSize(paths)
+	if err != nil {
+		return scanStats{}, err
+	}
+	return scanStats{Files: len(paths), InputBytes: inputBytes, Duration: time.Since(start)}, nil
+}
+
+// pushScanMetrics pushes the totals of a -scan-only run under its own job,
+// so planning scans never overwrite the metrics of real compression runs.
+func pushScanMetrics(pushURL string, stats scanStats, source, runID string) error {
+	registry := prometheus.NewRegistry()
+
+	filesGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "compress_scan_files",
+		Help: "Number of files the last -scan-only run found to compress.",
+	})
+	inputBytesGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "compress_scan_input_bytes",
+		Help: "Total input bytes the last -scan-only run found to compress.",
+	})
+	durationGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "compress_scan_duration_seconds",
+		Help: "Duration of the last -scan-only run in seconds.",
+	})
+	timestampGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "compress_scan_last_run_timestamp_seconds",
+		Help: "Unix timestamp of the last -scan-only run.",
+	})
+
+	metrics := []prometheus.Collector{
+		filesGauge,
+		inputBytesGauge,
+		durationGauge,
+		timestampGauge,
+	}
+	for _, metric := range metrics {
+		if err := registry.Register(metric); err != nil {
+			return err
+		}
+	}
+
+	filesGauge.Set(float64(stats.Files))
+	inputBytesGauge.Set(float64(stats.InputBytes))
+	durationGauge.Set(stats.Duration.Seconds())
+	timestampGauge.Set(float64(time.Now().Unix()))
+
+	source = strings.TrimSpace(source)
+	if source == "" {
+		source = "output"
+	}
+
+	return pushspool.Push(pushSpool, pushURL, "compress-scan", pushspool.Grouping{"source": source, "run_id": runID}, registry)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScanOnly(t *testing.T) {
+	in := t.TempDir()
+	files := map[string]string{"a.json": record(1), "d0/b.json": strings.Repeat(record(2), 50), "d0/d1/c.log": "plain text\n"}
+	writeFiles(t, in, files)
+	var total int
+	for _, data := range files {
+		total += len(data)
+	}
+	url, pushed := fakeGateway(t)
+
+	out := filepath.Join(t.TempDir(), "out")
+	code, output := run(t, "-in", in, "-out", out, "-pushgateway", url, "-scan-only")
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, output)
+	}
+	if !strings.Contains(output, "scan found 3 files to compress") {
+		t.Errorf("summary does not report the 3 files:\n%s", output)
+	}
+	gauges := pushed()
+	if gauges["compress_scan_files"] != 3 || gauges["compress_scan_input_bytes"] != float64(total) {
+		t.Errorf("pushed %v files and %v bytes, want 3 and %d", gauges["compress_scan_files"], gauges["compress_scan_input_bytes"], total)
+	}
+	if _, ok := gauges["compress_files_processed"]; ok {
+		t.Error("a scan pushed the metrics of a compression run")
+	}
+
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("scan created the output directory: %v", err)
+	}
+	var written []string
+	err := filepath.WalkDir(in, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(in, path)
+		if _, ok := files[filepath.ToSlash(rel)]; !ok {
+			written = append(written, rel)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) > 0 {
+		t.Errorf("scan wrote %q under -in", written)
+	}
+}
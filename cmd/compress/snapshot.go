@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"zstd-learning/internal/outpath"
+	"zstd-learning/internal/walk"
+)
+
+// snapshotVersion is the manifest format written by -snapshot-dir.
+const snapshotVersion = 1
+
+// A snapshot manifest is JSON lines: a snapshotHeader, then one
+// snapshotEntry per input file in the order the walk lists them, which is
+// sorted. Keeping that order lets the next run merge the manifest with its
+// own listing one entry at a time instead of loading it.
+type snapshotHeader struct {
+	Version   int    `json:"version"`
+	CreatedAt string `json:"created_at"`
+	InputDir  string `json:"input_dir"`
+}
+
+type snapshotEntry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256"`
+}
+
+// snapshotDiff counts how the tree changed since -since-snapshot. Without
+// it, every file is Added.
+type snapshotDiff struct {
+	Added     int
+	Changed   int
+	Unchanged int
+	Removed   int
+	// Pruned counts the outputs of removed files deleted by -prune-removed.
+	Pruned int
+	// Manifest is the path of the manifest this run wrote.
+	Manifest string
+}
+
+// snapshotReader streams the entries of a manifest.
+type snapshotReader struct {
+	file *os.File
+	dec  *json.Decoder
+	next *snapshotEntry
+	last string
+}
+
+func openSnapshot(path string) (*snapshotReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &snapshotReader{file: file, dec: json.NewDecoder(bufio.NewReader(file))}
+	var header snapshotHeader
+	if err := r.dec.Decode(&header); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: not a snapshot manifest: %w", path, err)
+	}
+	if header.Version != snapshotVersion {
+		file.Close()
+		return nil, fmt.Errorf("%s: unsupported snapshot manifest version %d", path, header.Version)
+	}
+	return r, nil
+}
+
+// peek returns the next entry without consuming it, or nil at the end.
+func (r *snapshotReader) peek() (*snapshotEntry, error) {
+	if r.next != nil {
+		return r.next, nil
+	}
+	var e snapshotEntry
+	if err := r.dec.Decode(&e); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s: %w", r.file.Name(), err)
+	}
+	path := filepath.FromSlash(e.Path)
+	if path <= r.last && r.last != "" {
+		return nil, fmt.Errorf("%s: entry %s is out of order", r.file.Name(), e.Path)
+	}
+	r.last = path
+	r.next = &e
+	return r.next, nil
+}
+
+func (r *snapshotReader) advance() {
+	r.next = nil
+}
+
+func (r *snapshotReader) Close() error {
+	return r.file.Close()
+}
+
+// snapshotWriter writes a manifest to a hidden temporary file in its
+// directory; commit gives it its timestamped name only once the run has
+// succeeded, so -since-snapshot never picks up the manifest of a failed
+// run.
+type snapshotWriter struct {
+	dir    string
+	layout string
+	file   *os.File
+	buf    *bufio.Writer
+	enc    *json.Encoder
+}
+
+func createSnapshot(dir, layout, inputDir string) (*snapshotWriter, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(dir, ".snapshot_*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	w := &snapshotWriter{dir: dir, layout: layout, file: file, buf: bufio.NewWriter(file)}
+	w.enc = json.NewEncoder(w.buf)
+	header := snapshotHeader{
+		Version:   snapshotVersion,
+		CreatedAt: deterministic.Now().UTC().Format(time.RFC3339),
+		InputDir:  inputDir,
+	}
+	if err := w.enc.Encode(header); err != nil {
+		w.abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *snapshotWriter) add(e snapshotEntry) error {
+	return w.enc.Encode(e)
+}
+
+// commit syncs the manifest and renames it to snapshot_<timestamp>.jsonl,
+// returning that path.
+func (w *snapshotWriter) commit() (string, error) {
+	err := w.buf.Flush()
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if closeErr := w.file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(w.file.Name())
+		return "", err
+	}
+	final, err := outpath.CreateStamped(w.dir, "snapshot_", w.layout, ".jsonl", deterministic.Now())
+	if err != nil {
+		os.Remove(w.file.Name())
+		return "", err
+	}
+	final.Close()
+	if err := os.Rename(w.file.Name(), final.Name()); err != nil {
+		os.Remove(w.file.Name())
+		os.Remove(final.Name())
+		return "", err
+	}
+	return final.Name(), syncDir(w.dir)
+}
+
+func (w *snapshotWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// planSnapshot writes a manifest entry for every path to out and returns
+// the paths to compress: all of them without prev, otherwise those that
+// are new or whose content changed since prev. A file whose size and
+// modification time match its prev entry keeps that entry's hash without
+// being read; any other file is hashed, and one whose hash still matches
+// is unchanged. Files in prev that are gone are counted as removed and
+// passed to onRemoved unless it is nil.
+func planSnapshot(paths []string, stamps map[string]walk.Stamp, baseDir string, prev *snapshotReader, out *snapshotWriter, onRemoved func(rel string)) ([]string, snapshotDiff, error) {
+	var diff snapshotDiff
+	var changed []string
+	removed := func(e *snapshotEntry) {
+		diff.Removed++
+		prev.advance()
+		if onRemoved != nil {
+			onRemoved(filepath.FromSlash(e.Path))
+		}
+	}
+
+	for _, path := range paths {
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return nil, diff, err
+		}
+		stamp, ok := stamps[path]
+		if !ok {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, diff, err
+			}
+			stamp = walk.StampOf(info)
+		}
+		entry := snapshotEntry{Path: filepath.ToSlash(rel), Size: stamp.Size, ModTime: stamp.ModTime.UTC()}
+
+		var old *snapshotEntry
+		for prev != nil {
+			e, err := prev.peek()
+			if err != nil {
+				return nil, diff, err
+			}
+			if e == nil || filepath.FromSlash(e.Path) > rel {
+				break
+			}
+			if filepath.FromSlash(e.Path) == rel {
+				old = e
+				prev.advance()
+				break
+			}
+			removed(e)
+		}
+
+		if old != nil && old.Size == stamp.Size && old.ModTime.Equal(stamp.ModTime) {
+			entry.SHA256 = old.SHA256
+		} else if entry.SHA256, err = hashFile(path); err != nil {
+			return nil, diff, err
+		}
+		switch {
+		case old == nil:
+			diff.Added++
+			changed = append(changed, path)
+		case old.SHA256 != entry.SHA256:
+			diff.Changed++
+			changed = append(changed, path)
+		default:
+			diff.Unchanged++
+		}
+		if err := out.add(entry); err != nil {
+			return nil, diff, err
+		}
+	}
+	for prev != nil {
+		e, err := prev.peek()
+		if err != nil {
+			return nil, diff, err
+		}
+		if e == nil {
+			break
+		}
+		removed(e)
+	}
+	return changed, diff, nil
+}
+
+// hashFile returns the hex SHA-256 of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := walk.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// staleOutputs returns the outputs under outDir of the removed inputs
+// rels that still exist, and their total size.
+func staleOutputs(outDir string, rels []string, suffix string) ([]string, int64, error) {
+	var outs []string
+	var total int64
+	for _, rel := range rels {
+		out, err := outpath.Join(outDir, rel+suffix)
+		if err != nil {
+			return nil, 0, err
+		}
+		info, err := os.Stat(out)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		outs = append(outs, out)
+		total += info.Size()
+	}
+	return outs, total, nil
+}
@@ -0,0 +1,40 @@
+//go:build unix
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestSpecialFiles(t *testing.T) {
+	in := t.TempDir()
+	writeFiles(t, in, map[string]string{"a.json": record(1)})
+	if err := syscall.Mkfifo(filepath.Join(in, "pipe.json"), 0o644); err != nil {
+		t.Skipf("cannot create a FIFO: %v", err)
+	}
+	url, pushed := fakeGateway(t)
+
+	out := t.TempDir()
+	code, output := run(t, "-in", in, "-out", out, "-pushgateway", url)
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, output)
+	}
+	if got := compressed(t, out); !reflect.DeepEqual(got, []string{"a.json.zst"}) {
+		t.Errorf("wrote %q, want only a.json.zst", got)
+	}
+	if !strings.Contains(output, "skipped 1 special files") {
+		t.Errorf("the FIFO is not reported:\n%s", output)
+	}
+	if got := pushed()["compress_files_processed"]; got != 1 {
+		t.Errorf("pushed %v files processed, want 1", got)
+	}
+
+	code, output = run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url, "-special-files", "error")
+	if code != 1 || !strings.Contains(output, "pipe.json is a FIFO, not a regular file") {
+		t.Errorf("-special-files error: exit %d, output:\n%s", code, output)
+	}
+}
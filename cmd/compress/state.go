@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// runState is persisted by -state-file so the next run only compresses files
+// modified since this one started.
+type runState struct {
+	LastRunStart time.Time `json:"last_run_start"`
+}
+
+// readState returns the recorded start of the last successful run. A missing
+// or unreadable state file yields ok == false, which means process
+// everything.
+func readState(path string) (time.Time, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	var state runState
+	if err := json.Unmarshal(data, &state); err != nil || state.LastRunStart.IsZero() {
+		return time.Time{}, false
+	}
+	return state.LastRunStart, true
+}
+
+// writeState records start via a temporary file and rename, so an
+// interrupted write never leaves a truncated state file behind.
+func writeState(path string, start time.Time) error {
+	data, err := json.Marshal(runState{LastRunStart: start.UTC()})
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// modifiedAfter keeps the paths whose modification time is after since.
+func modifiedAfter(paths []string, since time.Time) ([]string, error) {
+	kept := paths[:0]
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.ModTime().After(since) {
+			kept = append(kept, path)
+		}
+	}
+	return kept, nil
+}
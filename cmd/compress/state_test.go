@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadState(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC)
+	good := filepath.Join(dir, "good.json")
+	if err := writeState(good, start.In(time.FixedZone("x", 3600))); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := readState(good); !ok || !got.Equal(start) {
+		t.Errorf("readState = %v, %v; want %v", got, ok, start)
+	}
+	if _, err := os.Stat(good + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	writeFiles(t, dir, map[string]string{
+		"corrupt.json": `{"last_run_start": "yesterd`,
+		"zero.json":    `{}`,
+	})
+	for _, name := range []string{"missing.json", "corrupt.json", "zero.json"} {
+		if got, ok := readState(filepath.Join(dir, name)); ok {
+			t.Errorf("%s: readState = %v, want everything processed", name, got)
+		}
+	}
+}
+
+// TestStateFile runs twice with -state-file and checks that the second run
+// compresses only the file touched in between.
+func TestStateFile(t *testing.T) {
+	in := t.TempDir()
+	writeFiles(t, in, map[string]string{"a.json": record(1), "b.json": record(2), "c.json": record(3)})
+	hourAgo := time.Now().Add(-time.Hour)
+	for _, name := range []string{"a.json", "b.json", "c.json"} {
+		if err := os.Chtimes(filepath.Join(in, name), hourAgo, hourAgo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state := filepath.Join(t.TempDir(), "state", "compress.json")
+	url, _ := fakeGateway(t)
+	compress := func() []string {
+		t.Helper()
+		out := t.TempDir()
+		if code, output := run(t, "-in", in, "-out", out, "-pushgateway", url, "-state-file", state); code != 0 {
+			t.Fatalf("exit %d, output:\n%s", code, output)
+		}
+		return compressed(t, out)
+	}
+
+	if got, want := compress(), []string{"a.json.zst", "b.json.zst", "c.json.zst"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("first run wrote %q, want %q", got, want)
+	}
+	first, ok := readState(state)
+	if !ok {
+		t.Fatal("first run recorded no state")
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(filepath.Join(in, "b.json"), now, now); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := compress(), []string{"b.json.zst"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("second run wrote %q, want %q", got, want)
+	}
+	if second, ok := readState(state); !ok || !second.After(first) {
+		t.Errorf("second run recorded %v, want a start after %v", second, first)
+	}
+
+	if got := compress(); len(got) != 0 {
+		t.Errorf("third run wrote %q with nothing modified", got)
+	}
+
+	if err := os.WriteFile(state, []byte("not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := compress(); len(got) != 3 {
+		t.Errorf("run after a corrupt state file wrote %q, want all 3 files", got)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"zstd-learning/internal/crypt"
+	"zstd-learning/internal/outpath"
+	"zstd-learning/internal/size"
+	"zstd-learning/internal/summary"
+)
+
+// stdinChunkSize is how much of stdin is handed to the encoder at a time.
+const stdinChunkSize = 64 * 1024
+
+// stdinOptions configures compress -in -.
+type stdinOptions struct {
+	OutDir string
+	Prefix string
+	Suffix string
+	// Interval, when positive, closes the current output at every multiple
+	// of Interval since the Unix epoch (so 1h rotates on the hour) and
+	// starts the next one on the first data after it.
+	Interval time.Duration
+	Seal     *crypt.Sealer
+	// Clock names outputs and schedules rotations; the zero value uses the
+	// system clock.
+	Clock stdinClock
+}
+
+// stdinClock is the time source of compress -in -, replaced by a fake one
+// in tests.
+type stdinClock struct {
+	Now   func() time.Time
+	After func(d time.Duration) <-chan time.Time
+}
+
+func (c stdinClock) orSystem() stdinClock {
+	if c.Now == nil {
+		c.Now = time.Now
+	}
+	if c.After == nil {
+		c.After = time.After
+	}
+	return c
+}
+
+// stdinOutput is the file currently being written by runStdin.
+type stdinOutput struct {
+	path  string
+	file  io.WriteCloser
+	input int64
+}
+
+// runStdin handles compress -in -: stdin is compressed into timestamped
+// files under the output directory until EOF, SIGINT or SIGTERM. Every file
+// is a complete zstd stream of its own, so each one decodes on its own.
+func runStdin(opts compressOptions, so stdinOptions, pushURL, runID string, useDict bool, summaryFmt summary.Format, quiet bool) {
+	options, _ := encoderOptions(opts)
+	encoder, err := zstd.NewWriter(nil, options...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create encoder: %v\n", err)
+		exit(1)
+	}
+	defer encoder.Close()
+
+	chunks := make(chan []byte)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(chunks)
+		for {
+			buf := make([]byte, stdinChunkSize)
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				chunks <- buf[:n]
+			}
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					readErr <- err
+				}
+				return
+			}
+		}
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	start := time.Now()
+	stats, err := compressChunks(encoder, chunks, signals, so, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", opts.Printer.Red("compression failed"), err)
+		exit(1)
+	}
+	select {
+	case err := <-readErr:
+		fmt.Fprintf(os.Stderr, "%s: reading stdin: %v\n", opts.Printer.Red("compression failed"), err)
+		exit(1)
+	default:
+	}
+	duration := time.Since(start)
+
+	if strings.TrimSpace(runID) == "" {
+		runID = deterministic.Now().Format("20060102_150405")
+	}
+	notifier.Record(runID, stats.FilesProcessed, stats.InputBytes, stats.OutputBytes, stats.Ratio())
+	if err := pushMetrics(pushURL, stats, duration, so.Prefix, opts.Level, useDict, runID, false, 0, histogramBuckets{}); err != nil {
+		fmt.Fprintf(os.Stderr, "metrics push failed: %v\n", err)
+		exit(1)
+	}
+	if quiet {
+		return
+	}
+	sum := summary.New("compress", stats.FilesProcessed, stats.InputBytes, stats.OutputBytes, stats.InputBytes, deterministic.Duration(duration))
+	sum.Ratio = stats.Ratio()
+	sum.Destination = so.OutDir
+	sum.Level = opts.Level
+	if summaryFmt == summary.JSON {
+		sum.WriteJSON(os.Stdout)
+		return
+	}
+	fmt.Printf("compressed stdin into %s files in %s: %s\n", opts.Printer.Bold(strconv.Itoa(stats.FilesProcessed)), so.OutDir, sum.Details(opts.Printer))
+}
+
+// compressChunks compresses chunks into outputs under so.OutDir, rotating
+// them every so.Interval, until chunks is closed or a signal arrives, and
+// closes the last output properly either way.
+func compressChunks(encoder *zstd.Encoder, chunks <-chan []byte, signals <-chan os.Signal, so stdinOptions, opts compressOptions) (runStats, error) {
+	clock := so.Clock.orSystem()
+	var rotate <-chan time.Time
+	if so.Interval > 0 {
+		now := clock.Now()
+		rotate = clock.After(nextRotation(now, so.Interval).Sub(now))
+	}
+
+	var stats runStats
+	var current *stdinOutput
+	finish := func() error {
+		if current == nil {
+			return nil
+		}
+		done := current
+		current = nil
+		err := encoder.Close()
+		if closeErr := done.file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", done.path, err)
+		}
+		info, err := os.Stat(done.path)
+		if err != nil {
+			return err
+		}
+		stats.Add(done.input, info.Size())
+		if opts.Verbose {
+			fmt.Fprintf(opts.Notes, "wrote %s: %s -> %s\n", done.path, size.Format(done.input), size.Format(info.Size()))
+		}
+		return nil
+	}
+
+	for {
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				return stats, finish()
+			}
+			if current == nil {
+				var err error
+				current, err = openStdinOutput(so, clock.Now())
+				if err != nil {
+					return stats, err
+				}
+				encoder.Reset(current.file)
+			}
+			if _, err := encoder.Write(chunk); err != nil {
+				return stats, fmt.Errorf("%s: %w", current.path, err)
+			}
+			current.input += int64(len(chunk))
+		case <-rotate:
+			if err := finish(); err != nil {
+				return stats, err
+			}
+			now := clock.Now()
+			rotate = clock.After(nextRotation(now, so.Interval).Sub(now))
+		case sig := <-signals:
+			fmt.Fprintf(os.Stderr, "received %s, closing the current output\n", sig)
+			return stats, finish()
+		}
+	}
+}
+
+// nextRotation returns the first multiple of interval after now.
+func nextRotation(now time.Time, interval time.Duration) time.Time {
+	return now.Truncate(interval).Add(interval)
+}
+
+// openStdinOutput creates the output for data arriving at now, named after
+// the start of its rotation period (or now, without rotation). It creates
+// with O_EXCL, so a name that is already taken, for example by an earlier or
+// concurrent run in the same period, gets a counter instead of being
+// overwritten.
+func openStdinOutput(so stdinOptions, now time.Time) (*stdinOutput, error) {
+	if so.Interval > 0 {
+		now = now.Truncate(so.Interval)
+	}
+	f, err := outpath.CreateStamped(so.OutDir, so.Prefix+"-", outpath.StampLayout, so.Suffix, now)
+	if err != nil {
+		return nil, err
+	}
+	file, err := sealOutput(f, so.Seal)
+	if err != nil {
+		return nil, err
+	}
+	return &stdinOutput{path: f.Name(), file: file}, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// fakeClock drives compressChunks by hand. After blocks until the test
+// takes the requested wait from scheduled, so the test knows the loop is
+// idle again whenever it changes now.
+type fakeClock struct {
+	now       time.Time
+	fire      chan time.Time
+	scheduled chan time.Duration
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, fire: make(chan time.Time), scheduled: make(chan time.Duration)}
+}
+
+func (c *fakeClock) clock() stdinClock {
+	return stdinClock{
+		Now: func() time.Time { return c.now },
+		After: func(d time.Duration) <-chan time.Time {
+			c.scheduled <- d
+			return c.fire
+		},
+	}
+}
+
+// advance moves the clock to now, fires the pending rotation and returns
+// the wait until the next one.
+func (c *fakeClock) advance(now time.Time) time.Duration {
+	c.now = now
+	c.fire <- now
+	return <-c.scheduled
+}
+
+type chunkRun struct {
+	chunks  chan []byte
+	signals chan os.Signal
+	done    chan struct{}
+	stats   runStats
+	err     error
+}
+
+func startChunks(t *testing.T, so stdinOptions) *chunkRun {
+	t.Helper()
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { encoder.Close() })
+	r := &chunkRun{chunks: make(chan []byte), signals: make(chan os.Signal), done: make(chan struct{})}
+	go func() {
+		defer close(r.done)
+		r.stats, r.err = compressChunks(encoder, r.chunks, r.signals, so, compressOptions{})
+	}()
+	return r
+}
+
+// feed hands data to the loop and returns once it has been written: the
+// empty chunk after it is only taken when the loop is back waiting.
+func (r *chunkRun) feed(data string) {
+	r.chunks <- []byte(data)
+	r.chunks <- nil
+}
+
+// decodeOutputs decodes every file in dir on its own, keyed by name.
+func decodeOutputs(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := map[string]string{}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := decoder.DecodeAll(data, nil)
+		if err != nil {
+			t.Fatalf("%s does not decode on its own: %v", entry.Name(), err)
+		}
+		decoded[entry.Name()] = string(plain)
+	}
+	return decoded
+}
+
+func TestStdinRotation(t *testing.T) {
+	dir := t.TempDir()
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := newFakeClock(day.Add(10*time.Hour + 30*time.Minute))
+	run := startChunks(t, stdinOptions{OutDir: dir, Prefix: "stdin", Suffix: ".zst", Interval: time.Hour, Clock: clock.clock()})
+
+	if wait := <-clock.scheduled; wait != 30*time.Minute {
+		t.Errorf("first rotation in %s, want 30m", wait)
+	}
+	run.feed("alpha 1\n")
+	run.feed("alpha 2\n")
+	if wait := clock.advance(day.Add(11 * time.Hour)); wait != time.Hour {
+		t.Errorf("rotation at 11:00 scheduled the next in %s, want 1h", wait)
+	}
+	run.feed("beta\n")
+	clock.advance(day.Add(12 * time.Hour))
+	// No data between 12:00 and 13:00: no file for that period.
+	clock.advance(day.Add(13 * time.Hour))
+	clock.now = day.Add(13*time.Hour + 15*time.Minute)
+	run.feed("gamma\n")
+	close(run.chunks)
+	<-run.done
+	if run.err != nil {
+		t.Fatal(run.err)
+	}
+
+	want := map[string]string{
+		"stdin-20240101T100000Z.zst": "alpha 1\nalpha 2\n",
+		"stdin-20240101T110000Z.zst": "beta\n",
+		"stdin-20240101T130000Z.zst": "gamma\n",
+	}
+	if got := decodeOutputs(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("outputs %q, want %q", got, want)
+	}
+	if run.stats.FilesProcessed != 3 || run.stats.InputBytes != 27 {
+		t.Errorf("stats %+v, want 3 files of 27 bytes", run.stats)
+	}
+}
+
+func TestStdinKeepsExistingOutputs(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, 1, 1, 10, 20, 0, 0, time.UTC)
+	taken := filepath.Join(dir, "stdin-20240101T100000Z.zst")
+	if err := os.WriteFile(taken, []byte("earlier run"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock(now)
+	run := startChunks(t, stdinOptions{OutDir: dir, Prefix: "stdin", Suffix: ".zst", Interval: time.Hour, Clock: clock.clock()})
+	<-clock.scheduled
+	run.feed("delta\n")
+	close(run.chunks)
+	<-run.done
+	if run.err != nil {
+		t.Fatal(run.err)
+	}
+
+	if data, _ := os.ReadFile(taken); string(data) != "earlier run" {
+		t.Errorf("existing output overwritten with %q", data)
+	}
+	if err := os.Remove(taken); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"stdin-20240101T100000Z_2.zst": "delta\n"}
+	if got := decodeOutputs(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("outputs %q, want %q", got, want)
+	}
+}
+
+func TestStdinClosesOnSignal(t *testing.T) {
+	dir := t.TempDir()
+	clock := newFakeClock(time.Date(2024, 1, 1, 10, 20, 0, 0, time.UTC))
+	run := startChunks(t, stdinOptions{OutDir: dir, Prefix: "stdin", Suffix: ".zst", Clock: clock.clock()})
+	run.feed("partial\n")
+	run.signals <- os.Interrupt
+	<-run.done
+	if run.err != nil {
+		t.Fatal(run.err)
+	}
+	want := map[string]string{"stdin-20240101T102000Z.zst": "partial\n"}
+	if got := decodeOutputs(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("outputs %q, want %q", got, want)
+	}
+}
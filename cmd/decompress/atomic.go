@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// atomicTempSuffix marks an -atomic output while it is being written. It is
+// renamed to the final name only once complete and synced, so an
+// interrupted run leaves no partial file under a name -resume or a reader
+// could mistake for a finished output.
+const atomicTempSuffix = ".tmp"
+
+// writePath returns where the output for outPath is written: outPath
+// itself, or with atomic a hidden temporary file next to it.
+func writePath(outPath string, atomic bool) string {
+	if !atomic {
+		return outPath
+	}
+	return filepath.Join(filepath.Dir(outPath), "."+filepath.Base(outPath)+atomicTempSuffix)
+}
+
+// commitOutput syncs the complete output tmpPath, renames it to outPath and
+// syncs the directory so the rename survives a crash. tmpPath is removed
+// when any step fails.
+func commitOutput(tmpPath, outPath string) error {
+	if err := syncFile(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, outPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(outPath))
+}
+
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir flushes directory entries. Platforms that cannot sync a directory
+// handle are not treated as an error.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	d.Sync()
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCommitOutput(t *testing.T) {
+	dir := t.TempDir()
+	outPath := filepath.Join(dir, "a.json")
+	if got := writePath(outPath, false); got != outPath {
+		t.Errorf("without -atomic, writes to %s", got)
+	}
+	tmpPath := writePath(outPath, true)
+	if tmpPath != filepath.Join(dir, ".a.json.tmp") {
+		t.Fatalf("with -atomic, writes to %s", tmpPath)
+	}
+	if err := os.WriteFile(tmpPath, []byte("complete"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Until the commit, only the temporary is there.
+	if _, err := os.Stat(outPath); !os.IsNotExist(err) {
+		t.Fatalf("output visible before the rename: %v", err)
+	}
+	if err := commitOutput(tmpPath, outPath); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTree(t, dir); len(got) != 1 || got["a.json"] != "complete" {
+		t.Errorf("after the commit: %q, want only a.json", got)
+	}
+
+	// A failed rename removes the temporary.
+	if err := os.WriteFile(tmpPath, []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitOutput(tmpPath, filepath.Join(dir, "missing", "a.json")); err == nil {
+		t.Fatal("renamed into a missing directory")
+	}
+	if _, err := os.Stat(tmpPath); !os.IsNotExist(err) {
+		t.Errorf("temporary left after a failed commit: %v", err)
+	}
+}
+
+// TestAtomicLeavesNoPartialOutput decodes a file whose second frame is cut
+// short: the first frame has been written out by the time the decode
+// fails, which without -atomic stays behind under the final name.
+func TestAtomicLeavesNoPartialOutput(t *testing.T) {
+	data := []byte(strings.Repeat(`{"id":1,"name":"restored record"}`+"\n", 20000))
+	second := encodeSized(t, data, int64(len(data)))
+	in := t.TempDir()
+	broken := append(encodeSized(t, data, int64(len(data))), second[:len(second)/2]...)
+	if err := os.WriteFile(filepath.Join(in, "broken.json.zst"), broken, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	url, _ := fakeGateway(t)
+
+	out := t.TempDir()
+	if code, output := run(t, "-in", in, "-out", out, "-pushgateway", url); code != 1 {
+		t.Fatalf("without -atomic: exit %d, want 1, output:\n%s", code, output)
+	}
+	if got := readTree(t, out)["broken.json"]; len(got) == 0 || len(got) >= 2*len(data) {
+		t.Fatalf("without -atomic: %d bytes under the final name, want the partial output the test relies on", len(got))
+	}
+
+	out = t.TempDir()
+	if code, output := run(t, "-in", in, "-out", out, "-pushgateway", url, "-atomic"); code != 1 {
+		t.Fatalf("-atomic: exit %d, want 1, output:\n%s", code, output)
+	}
+	if got := readTree(t, out); len(got) != 0 {
+		t.Errorf("-atomic: left %d files after the failed decode: %q", len(got), slices.Sorted(maps.Keys(got)))
+	}
+
+	// A good input is decoded under its final name, with no temporary left.
+	writeCompressed(t, in, map[string]string{"broken.json.zst": string(data)})
+	out = t.TempDir()
+	if code, output := run(t, "-in", in, "-out", out, "-pushgateway", url, "-atomic"); code != 0 {
+		t.Fatalf("-atomic: exit %d, output:\n%s", code, output)
+	}
+	if got := readTree(t, out); len(got) != 1 || got["broken.json"] != string(data) {
+		t.Errorf("-atomic: wrote %q, want only broken.json", slices.Sorted(maps.Keys(got)))
+	}
+}
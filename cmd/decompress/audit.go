@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"zstd-learning/internal/crypt"
+	"zstd-learning/internal/decpool"
+	"zstd-learning/internal/dictfile"
+	"zstd-learning/internal/hashcache"
+	"zstd-learning/internal/walk"
+)
+
+// fingerprintVersion is the version of the fingerprint file format.
+const fingerprintVersion = 1
+
+// fingerprint records how a .zst file was encoded, from its frame headers:
+// a file re-compressed at another level or with other options gets a
+// different fingerprint while its content stays the same.
+type fingerprint struct {
+	Path      string   `json:"path"`
+	Frames    int      `json:"frames"`
+	WindowLog int      `json:"window_log"`
+	Checksum  bool     `json:"checksum"`
+	DictIDs   []uint32 `json:"dict_ids,omitempty"`
+	// Ratio is the compressed size over the content size: the declared one,
+	// or with -hash-content the decoded one. It is 0 when neither is known.
+	Ratio float64 `json:"ratio"`
+	// ContentSHA256 is the hash of the decompressed content, with
+	// -hash-content.
+	ContentSHA256 string `json:"content_sha256,omitempty"`
+}
+
+type fingerprintFile struct {
+	Version   int           `json:"version"`
+	CreatedAt string        `json:"created_at"`
+	Files     []fingerprint `json:"files"`
+}
+
+// fingerprintChange is one way two fingerprints of a file differ.
+type fingerprintChange struct {
+	Path     string
+	Old, New string
+}
+
+func runAudit(args []string) {
+	if len(args) == 0 || args[0] != "fingerprint" {
+		fmt.Fprintln(os.Stderr, "usage: decompress audit fingerprint [flags]")
+		exit(1)
+	}
+	fs := flag.NewFlagSet("audit fingerprint", flag.ExitOnError)
+	inputDir := fs.String("in", "compressed", "input directory with .zst files to fingerprint")
+	suffix := fs.String("suffix", ".zst", "only fingerprint files with this suffix (empty fingerprints every file)")
+	outPath := fs.String("out", "", "write the fingerprints to this JSON file")
+	comparePath := fs.String("compare-fingerprints", "", "compare with a fingerprint file from an earlier run and report files encoded differently although their content is unchanged (needs -hash-content on both runs)")
+	hashContent := fs.Bool("hash-content", false, "also decompress each file and record the SHA-256 of its content")
+	ratioBand := fs.Float64("ratio-band", 0.05, "width of the compression ratio bands; a file whose ratio moved to another band counts as changed")
+	failOnDrift := fs.Bool("fail-on-drift", false, "exit with status 1 when -compare-fingerprints finds re-encoded files")
+	dictPath := fs.String("dict", "", "dictionary for decoding with -hash-content")
+	dictDir := fs.String("dict-dir", "", "also load every .zdict file in this directory for -hash-content")
+	decryptIdentity := fs.String("decrypt-identity", "", "age identity file for inputs encrypted with compress -encrypt-recipient")
+	hashCachePath := fs.String("hash-cache", "", "reuse the -hash-content hashes of files whose size and modification time are unchanged since an earlier run, from this cache file, and update it")
+	decryptKeyfile := fs.String("decrypt-keyfile", "", "key file for inputs encrypted with compress -encrypt-keyfile")
+	fs.Parse(args[1:])
+
+	if *comparePath != "" && !*hashContent {
+		fmt.Fprintln(os.Stderr, "-compare-fingerprints requires -hash-content")
+		exit(1)
+	}
+	if !(*ratioBand > 0) {
+		fmt.Fprintln(os.Stderr, "ratio-band must be positive")
+		exit(1)
+	}
+	if *hashCachePath != "" && !*hashContent {
+		fmt.Fprintln(os.Stderr, "-hash-cache requires -hash-content")
+		exit(1)
+	}
+	if (*dictPath != "" || *dictDir != "") && !*hashContent {
+		fmt.Fprintln(os.Stderr, "-dict and -dict-dir require -hash-content")
+		exit(1)
+	}
+	keys, err := loadKeys(*decryptIdentity, *decryptKeyfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid decryption key: %v\n", err)
+		exit(1)
+	}
+
+	var pool *decpool.Pool
+	if *hashContent {
+		var dicts []dictfile.Dict
+		if *dictPath != "" {
+			loaded, err := dictfile.Load(*dictPath, false, "")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "invalid dictionary: %v\n", err)
+				exit(1)
+			}
+			dicts = append(dicts, loaded)
+		}
+		if *dictDir != "" {
+			fromDir, err := loadDictDir(*dictDir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "invalid dictionary: %v\n", err)
+				exit(1)
+			}
+			dicts = append(dicts, fromDir...)
+		}
+		pool, err = decpool.For(dictData(dicts))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid dictionary: %v\n", err)
+			exit(1)
+		}
+	}
+
+	var cache *hashcache.Cache
+	if *hashCachePath != "" {
+		if cache, err = hashcache.Load(*hashCachePath); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read hash cache: %v\n", err)
+			exit(1)
+		}
+	}
+
+	paths, _, err := walk.Files(*inputDir, nil, walk.Skip)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list input files: %v\n", err)
+		exit(1)
+	}
+	current := fingerprintFile{Version: fingerprintVersion, CreatedAt: time.Now().UTC().Format(time.RFC3339)}
+	for _, path := range paths {
+		if *suffix != "" && !hasInputSuffix(path, *suffix) {
+			continue
+		}
+		rel, err := filepath.Rel(*inputDir, path)
+		if err != nil {
+			rel = path
+		}
+		fp, err := fingerprintFileAt(path, keys, pool, cache)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to fingerprint %s: %v\n", rel, err)
+			exit(1)
+		}
+		fp.Path = filepath.ToSlash(rel)
+		current.Files = append(current.Files, fp)
+	}
+	fmt.Printf("fingerprinted %d files\n", len(current.Files))
+	if cache != nil {
+		hits, misses := cache.Stats()
+		fmt.Printf("hash cache: %d reused, %d computed\n", hits, misses)
+		if err := cache.Save(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write hash cache: %v\n", err)
+			exit(1)
+		}
+	}
+
+	if *outPath != "" {
+		data, err := json.MarshalIndent(current, "", "  ")
+		if err == nil {
+			err = os.WriteFile(*outPath, append(data, '\n'), 0o644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write fingerprints: %v\n", err)
+			exit(1)
+		}
+	}
+
+	if *comparePath != "" {
+		old, err := readFingerprints(*comparePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read fingerprints: %v\n", err)
+			exit(1)
+		}
+		drifted := compareFingerprints(old, current, *ratioBand)
+		if drifted > 0 && *failOnDrift {
+			exit(1)
+		}
+	}
+}
+
+// fingerprintFileAt fingerprints path, hashing its content when pool is
+// not nil. cache may be nil.
+func fingerprintFileAt(path string, keys crypt.Keys, pool *decpool.Pool, cache *hashcache.Cache) (fingerprint, error) {
+	listing, err := inspectFile(path, keys)
+	if err != nil {
+		return fingerprint{}, err
+	}
+	fp := fingerprint{
+		Frames:    listing.Frames,
+		WindowLog: bits.Len64(listing.WindowSize - 1),
+		Checksum:  listing.Frames > 0 && listing.Checksums == listing.Frames,
+		DictIDs:   listing.DictIDs,
+	}
+	if listing.WindowSize == 0 {
+		fp.WindowLog = 0
+	}
+	if listing.ContentSize > 0 {
+		fp.Ratio = float64(listing.CompressedSize) / float64(listing.ContentSize)
+	}
+	if pool == nil {
+		return fp, nil
+	}
+
+	sum, size, err := cachedContentHash(path, keys, pool, cache)
+	if err != nil {
+		return fp, err
+	}
+	if fp.Ratio == 0 && size > 0 {
+		fp.Ratio = float64(listing.CompressedSize) / float64(size)
+	}
+	fp.ContentSHA256 = sum
+	return fp, nil
+}
+
+// cachedContentHash is contentHash through cache, which may be nil. The
+// cache stores the hash and the decoded size as "<sha256>:<bytes>".
+func cachedContentHash(path string, keys crypt.Keys, pool *decpool.Pool, cache *hashcache.Cache) (string, int64, error) {
+	if cache == nil {
+		return contentHash(path, keys, pool)
+	}
+	value, err := cache.Hash(path, func() (string, error) {
+		sum, size, err := contentHash(path, keys, pool)
+		return sum + ":" + strconv.FormatInt(size, 10), err
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	sum, sizeText, _ := strings.Cut(value, ":")
+	size, err := strconv.ParseInt(sizeText, 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid -hash-cache entry %q", value)
+	}
+	return sum, size, nil
+}
+
+// contentHash decompresses path and returns the SHA-256 of its content and
+// the content size.
+func contentHash(path string, keys crypt.Keys, pool *decpool.Pool) (string, int64, error) {
+	decoder, err := pool.Get(nil)
+	if err != nil {
+		return "", 0, err
+	}
+	defer pool.Put(decoder)
+	hash := sha256.New()
+	written, err := decodeTo(decoder, nil, 1, path, keys, hash)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), written, nil
+}
+
+func readFingerprints(path string) (fingerprintFile, error) {
+	var file fingerprintFile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return file, err
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return file, fmt.Errorf("%s: %w", path, err)
+	}
+	if file.Version != fingerprintVersion {
+		return file, fmt.Errorf("%s: unsupported fingerprint version %d", path, file.Version)
+	}
+	return file, nil
+}
+
+// compareFingerprints prints the files whose fingerprint changed while
+// their content hash did not, grouped by what changed, and returns how
+// many there are. A file appears in every group it changed in.
+func compareFingerprints(old, current fingerprintFile, band float64) int {
+	before := make(map[string]fingerprint, len(old.Files))
+	for _, fp := range old.Files {
+		before[fp.Path] = fp
+	}
+
+	groups := map[string][]fingerprintChange{}
+	var drifted, contentChanged, unhashed, added int
+	for _, fp := range current.Files {
+		prev, ok := before[fp.Path]
+		if !ok {
+			added++
+			continue
+		}
+		delete(before, fp.Path)
+		if prev.ContentSHA256 == "" {
+			unhashed++
+			continue
+		}
+		if prev.ContentSHA256 != fp.ContentSHA256 {
+			contentChanged++
+			continue
+		}
+		changes := fingerprintChanges(prev, fp, band)
+		for group, change := range changes {
+			groups[group] = append(groups[group], change)
+		}
+		if len(changes) > 0 {
+			drifted++
+		}
+	}
+
+	for _, group := range []string{"window", "dict", "ratio band", "checksum", "frames"} {
+		changes := groups[group]
+		if len(changes) == 0 {
+			continue
+		}
+		fmt.Printf("%s changed (%d files):\n", group, len(changes))
+		for _, c := range changes {
+			fmt.Printf("  %-40s %s -> %s\n", c.Path, c.Old, c.New)
+		}
+	}
+	fmt.Printf("%d files re-encoded with unchanged content; %d changed content, %d new, %d removed", drifted, contentChanged, added, len(before))
+	if unhashed > 0 {
+		fmt.Printf(", %d not compared (no content hash in the earlier fingerprints)", unhashed)
+	}
+	fmt.Println()
+	return drifted
+}
+
+// fingerprintChanges returns the ways new differs from old, keyed by group.
+func fingerprintChanges(old, new fingerprint, band float64) map[string]fingerprintChange {
+	changes := map[string]fingerprintChange{}
+	add := func(group, before, after string) {
+		if before != after {
+			changes[group] = fingerprintChange{Path: new.Path, Old: before, New: after}
+		}
+	}
+	add("window", fmt.Sprintf("window_log %d", old.WindowLog), fmt.Sprintf("window_log %d", new.WindowLog))
+	if !slices.Equal(old.DictIDs, new.DictIDs) {
+		add("dict", "dict "+formatDictIDs(old.DictIDs), "dict "+formatDictIDs(new.DictIDs))
+	}
+	if ratioBandOf(old.Ratio, band) != ratioBandOf(new.Ratio, band) {
+		add("ratio band", fmt.Sprintf("ratio %.3f", old.Ratio), fmt.Sprintf("ratio %.3f", new.Ratio))
+	}
+	add("checksum", fmt.Sprintf("checksum %t", old.Checksum), fmt.Sprintf("checksum %t", new.Checksum))
+	add("frames", fmt.Sprintf("%d frames", old.Frames), fmt.Sprintf("%d frames", new.Frames))
+	return changes
+}
+
+func ratioBandOf(ratio, band float64) int {
+	return int(math.Floor(ratio / band))
+}
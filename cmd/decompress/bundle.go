@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+
+	"zstd-learning/internal/bundle"
+	"zstd-learning/internal/outpath"
+	"zstd-learning/internal/walk"
+	"zstd-learning/pkg/progress"
+)
+
+// splitBundle decodes the compress -batch-small-files bundle at inPath and
+// writes each member of idx to its own file next to where the bundle's
+// output would go, as if the members had been compressed one by one. The
+// bundle's size is shared out between the members in proportion to their
+// decoded size, so the per-file report still adds up to the run totals.
+func splitBundle(decoder *zstd.Decoder, inPath, rel, outDir string, idx *bundle.Index, opts decompressOptions, stats *runStats) error {
+	inFile, err := walk.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+	info, err := inFile.Stat()
+	if err != nil {
+		return err
+	}
+	if err := decoder.Reset(inFile); err != nil {
+		return err
+	}
+
+	total := idx.Size()
+	inputLeft := info.Size()
+	for i, m := range idx.Members {
+		memberRel := filepath.Join(filepath.Dir(rel), m.Name)
+		outPath, err := outpath.Join(outDir, outpath.Sharded(memberRel, opts.Shards))
+		if err != nil {
+			return err
+		}
+		tmpPath := writePath(outPath, opts.Atomic)
+		if opts.Route != nil {
+			tmpPath = opts.Route.tempPath(outDir, outPath)
+		}
+		if err := os.MkdirAll(filepath.Dir(tmpPath), 0o755); err != nil {
+			return err
+		}
+		checks := newOutputChecks(opts, outPath)
+		err = writeMember(decoder, tmpPath, m.Size, opts.Sparse, checks)
+		invalid := checks.finish()
+		routed := outPath
+		if err == nil && opts.Route != nil {
+			routed, err = opts.Route.commit(tmpPath, outDir, outPath, checks.sniff.Type(), opts.Atomic)
+		} else if err == nil && opts.Atomic {
+			err = commitOutput(tmpPath, outPath)
+		}
+		if err != nil {
+			if opts.Atomic || opts.Route != nil {
+				os.Remove(tmpPath)
+			}
+			return fmt.Errorf("%s: %w", m.Name, err)
+		}
+
+		input := inputLeft
+		if i < len(idx.Members)-1 && total > 0 {
+			input = info.Size() * m.Size / total
+		}
+		inputLeft -= input
+		var sharded string
+		if opts.Shards > 1 {
+			sharded, _ = filepath.Rel(outDir, outPath)
+		}
+		// Members are named by their original names, which is what
+		// addFile expects after -suffix is stripped.
+		records := stats.addFile(memberRel, sharded, "", input, m.Size, checks.counter)
+		if opts.Route != nil {
+			stats.recordRoute(outDir, routed, checks.sniff.Type())
+		}
+		stats.addFiltered(opts.Notes, memberRel, checks)
+		if invalid != nil {
+			stats.InvalidJSON = append(stats.InvalidJSON, memberRel)
+			fmt.Fprintf(opts.Warnings, "  %s: %s: %v\n", memberRel, opts.Printer.Red("invalid JSON"), invalid)
+			continue
+		}
+		if opts.Verbose {
+			note := ""
+			if records != nil {
+				note = fmt.Sprintf("  %d records", *records)
+			}
+			fmt.Fprintf(opts.Notes, "  %-40s %10d -> %10d  %s%s\n", memberRel, input, m.Size, opts.Printer.Green("ok from "+filepath.Base(rel)), note)
+		}
+	}
+
+	extra, err := io.Copy(io.Discard, decoder)
+	if errors.Is(err, zstd.ErrFrameSizeMismatch) {
+		return errCorruptSize
+	}
+	if err != nil {
+		return err
+	}
+	if extra > 0 {
+		return fmt.Errorf("corrupt: %d decoded bytes beyond the members listed in the bundle index", extra)
+	}
+
+	opts.Progress.File(filepath.ToSlash(rel), info.Size(), total, progress.StatusOK)
+	stats.Bundles++
+	stats.FilesProcessed += len(idx.Members)
+	stats.InputBytes += info.Size()
+	stats.OutputBytes += total
+	return nil
+}
+
+// writeMember copies the next size decoded bytes into a new file at outPath.
+func writeMember(decoder *zstd.Decoder, outPath string, size int64, sparse bool, checks *outputChecks) error {
+	outFile, err := createOutput(outPath, sparse)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+	_, err = io.CopyN(checks.tee(outFile), decoder, size)
+	if errors.Is(err, io.EOF) {
+		return errors.New("corrupt: bundle ends before the member does")
+	}
+	if errors.Is(err, zstd.ErrFrameSizeMismatch) {
+		return errCorruptSize
+	}
+	if err != nil {
+		return err
+	}
+	return outFile.Close()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"zstd-learning/internal/bundle"
+)
+
+// writeBundle writes members, keyed by base name and in sorted order, as
+// the compress -batch-small-files bundle at path.
+func writeBundle(t *testing.T, path string, names []string, members map[string]string) {
+	t.Helper()
+	var stream []byte
+	var index []bundle.Member
+	for _, name := range names {
+		index = append(index, bundle.Member{Name: name, Offset: int64(len(stream)), Size: int64(len(members[name]))})
+		stream = append(stream, members[name]...)
+	}
+	var out bytes.Buffer
+	out.Write(encodeSized(t, stream, int64(len(stream))))
+	if err := bundle.WriteIndex(&out, index); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, out.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	want := map[string]string{"big.json": strings.Repeat(`{"id":0}`+"\n", 500)}
+	writeCompressed(t, in, map[string]string{"big.json.zst": want["big.json"]})
+
+	for _, dir := range []string{"logs", "deep/a/b"} {
+		members := map[string]string{}
+		var names []string
+		for i := 0; i < 5; i++ {
+			name := fmt.Sprintf("%02d.json", i)
+			names = append(names, name)
+			members[name] = strings.Repeat(fmt.Sprintf(`{"dir":%q,"id":%d}`+"\n", dir, i), i+1)
+			want[dir+"/"+name] = members[name]
+		}
+		// An empty member takes no bytes of the stream but still gets
+		// a file.
+		names = append(names, "empty.json")
+		members["empty.json"] = ""
+		want[dir+"/empty.json"] = ""
+		writeBundle(t, filepath.Join(in, filepath.FromSlash(dir), "_bundle-0001.zst"), names, members)
+	}
+	url, _ := fakeGateway(t)
+
+	code, output := run(t, "-in", in, "-out", out, "-pushgateway", url, "-verbose")
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, output)
+	}
+	got := readTree(t, out)
+	for name, data := range want {
+		if got[name] != data {
+			t.Errorf("%s: %q, want %q", name, got[name], data)
+		}
+	}
+	for name := range got {
+		if _, ok := want[name]; !ok {
+			t.Errorf("%s written, but it is not a member or input", name)
+		}
+	}
+	if !strings.Contains(output, "split 2 bundles") {
+		t.Errorf("output does not count the bundles:\n%s", output)
+	}
+}
+
+func TestBundleWithExtraBytesFails(t *testing.T) {
+	in := t.TempDir()
+	path := filepath.Join(in, "_bundle-0001.zst")
+	// The index lists fewer bytes than the stream holds.
+	var out bytes.Buffer
+	out.Write(encodeSized(t, []byte("abcdef"), 6))
+	if err := bundle.WriteIndex(&out, []bundle.Member{{Name: "a", Size: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, out.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	url, _ := fakeGateway(t)
+
+	code, output := run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url)
+	if code == 0 || !strings.Contains(output, "3 decoded bytes beyond the members") {
+		t.Fatalf("exit %d, want a failure naming the extra bytes:\n%s", code, output)
+	}
+}
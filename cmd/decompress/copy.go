@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sort"
+
+	"zstd-learning/internal/filter"
+	"zstd-learning/internal/lock"
+)
+
+// splitCopies separates, for -copy-unmatched, the compressed inputs in paths
+// from the files under dir without suffix, which compress -copy-unmatched
+// copied uncompressed and which are copied back unchanged. Empty files,
+// which listFiles leaves out, are copies too.
+func splitCopies(dir string, match *filter.Expr, paths []string, suffix string) ([]string, []string, error) {
+	var decode []string
+	for _, path := range paths {
+		if hasInputSuffix(path, suffix) {
+			decode = append(decode, path)
+		}
+	}
+
+	var copies []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || d.Name() == lock.FileName || hasInputSuffix(path, suffix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if match.Match(filter.File{Path: path, Info: info}) {
+			copies = append(copies, path)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.SkipDir) {
+		return nil, nil, err
+	}
+	sort.Strings(copies)
+	return decode, copies, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"zstd-learning/internal/crypt"
+	"zstd-learning/internal/outpath"
+	"zstd-learning/internal/walk"
+)
+
+// encryptedExts are the extensions compress adds after -suffix when it
+// encrypts its outputs.
+var encryptedExts = []string{crypt.Age.Ext(), crypt.Keyfile.Ext()}
+
+// loadKeys reads the -decrypt-identity and -decrypt-keyfile files, either of
+// which may be empty.
+func loadKeys(identityPath, keyfilePath string) (crypt.Keys, error) {
+	var keys crypt.Keys
+	var err error
+	if identityPath != "" {
+		if keys.Identities, err = crypt.ReadIdentities(identityPath); err != nil {
+			return keys, err
+		}
+	}
+	if keyfilePath != "" {
+		if keys.Key, err = crypt.ReadKeyFile(keyfilePath); err != nil {
+			return keys, err
+		}
+	}
+	return keys, nil
+}
+
+// inputFile is an input opened for reading, decrypted on the fly when
+// Scheme is not crypt.None.
+type inputFile struct {
+	io.Reader
+	file   *os.File
+	Scheme crypt.Scheme
+}
+
+// openInput opens inPath and unwraps its encryption, detected from the
+// first bytes, with keys.
+func openInput(inPath string, keys crypt.Keys) (*inputFile, error) {
+	file, err := walk.Open(inPath)
+	if err != nil {
+		return nil, err
+	}
+	plain, scheme, err := keys.Open(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &inputFile{Reader: plain, file: file, Scheme: scheme}, nil
+}
+
+func (f *inputFile) Close() error {
+	return f.file.Close()
+}
+
+// trimEncryptedExt maps a.json.zst.age back to a.json.zst, so outputs are
+// named the same whether or not their input was encrypted.
+func trimEncryptedExt(rel, suffix string) string {
+	for _, ext := range encryptedExts {
+		if trimmed, ok := outpath.TrimSuffix(rel, suffix+ext); ok {
+			return trimmed + suffix
+		}
+	}
+	return rel
+}
+
+// hasInputSuffix reports whether name ends in suffix, on its own or
+// followed by an encryption extension.
+func hasInputSuffix(name, suffix string) bool {
+	return outpath.HasSuffix(trimEncryptedExt(name, suffix), suffix)
+}
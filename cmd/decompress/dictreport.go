@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"zstd-learning/internal/crypt"
+	"zstd-learning/internal/frame"
+)
+
+// countFrameDicts adds the dictionary ID referenced by each data frame of
+// inPath to counts, with 0 for frames that reference none. Only frame
+// headers are read; skippable frames are not counted.
+func countFrameDicts(inPath string, keys crypt.Keys, counts map[uint32]int64) error {
+	inFile, err := openInput(inPath, keys)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+	frames, err := frame.ScanAll(inFile)
+	if err != nil {
+		return err
+	}
+	for _, info := range frames {
+		if !info.Skippable {
+			counts[info.DictID]++
+		}
+	}
+	return nil
+}
+
+// formatFrameDicts renders -dict-report counts as "id 0 (none): 3, id
+// 1234: 57", ordered by dictionary ID.
+func formatFrameDicts(counts map[uint32]int64) string {
+	if len(counts) == 0 {
+		return "no frames"
+	}
+	ids := make([]uint32, 0, len(counts))
+	for id := range counts {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		label := strconv.FormatUint(uint64(id), 10)
+		if id == 0 {
+			label += " (none)"
+		}
+		parts[i] = fmt.Sprintf("id %s: %d", label, counts[id])
+	}
+	return strings.Join(parts, ", ")
+}
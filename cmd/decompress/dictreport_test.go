@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestDictReport(t *testing.T) {
+	people := buildDict(t, 10, person)
+	movies := buildDict(t, 20, movie)
+	dictDir := t.TempDir()
+	for name, data := range map[string][]byte{"people.zdict": people, "movies.zdict": movies} {
+		if err := os.WriteFile(filepath.Join(dictDir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	encode := func(d []byte, data string) []byte {
+		t.Helper()
+		var options []zstd.EOption
+		if d != nil {
+			options = append(options, zstd.WithEncoderDict(d))
+		}
+		encoder, err := zstd.NewWriter(nil, options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer encoder.Close()
+		return encoder.EncodeAll([]byte(data), nil)
+	}
+	skippable := binary.LittleEndian.AppendUint32(nil, 0x184D2A50)
+	skippable = binary.LittleEndian.AppendUint32(skippable, 4)
+	skippable = append(skippable, "note"...)
+
+	in := t.TempDir()
+	for name, data := range map[string][]byte{
+		"plain.txt.zst":  encode(nil, "plain"),
+		"frames.txt.zst": bytes.Join([][]byte{encode(nil, "one"), encode(nil, "two")}, nil),
+		"people.txt.zst": encode(people, person(1)),
+		"mixed.txt.zst":  bytes.Join([][]byte{encode(people, person(2)), skippable, encode(movies, movie(3))}, nil),
+	} {
+		if err := os.WriteFile(filepath.Join(in, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	url, pushed := fakeGateway(t)
+	out := t.TempDir()
+	code, output := run(t, "-in", in, "-out", out, "-dict-dir", dictDir, "-dict-report", "-pushgateway", url)
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, output)
+	}
+	if !strings.Contains(output, "frames by dictionary: id 0 (none): 3, id 10: 2, id 20: 1") {
+		t.Errorf("report does not count the frames by dictionary:\n%s", output)
+	}
+	gauges := pushed()
+	for id, want := range map[string]float64{"0": 3, "10": 2, "20": 1} {
+		if got := gauges["decompress_frames_by_dict{dict_id="+id+"}"]; got != want {
+			t.Errorf("pushed %v frames for dict_id %s, want %v", got, id, want)
+		}
+	}
+	if got := readTree(t, out)["mixed.txt"]; got != person(2)+movie(3) {
+		t.Errorf("mixed.txt decoded to %q", got)
+	}
+
+	// Without -dict-report nothing is counted or pushed.
+	url, pushed = fakeGateway(t)
+	if code, output := run(t, "-in", in, "-out", t.TempDir(), "-dict-dir", dictDir, "-pushgateway", url); code != 0 || strings.Contains(output, "frames by dictionary") {
+		t.Errorf("without -dict-report: exit %d, output:\n%s", code, output)
+	}
+	if _, ok := pushed()["decompress_frames_by_dict"]; ok {
+		t.Error("frames by dictionary pushed without -dict-report")
+	}
+}
+
+func TestFormatFrameDicts(t *testing.T) {
+	if got := formatFrameDicts(nil); got != "no frames" {
+		t.Errorf("formatFrameDicts(nil) = %q", got)
+	}
+	if got := formatFrameDicts(map[uint32]int64{7: 1, 0: 2, 4000000000: 3}); got != "id 0 (none): 2, id 7: 1, id 4000000000: 3" {
+		t.Errorf("formatFrameDicts = %q", got)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"zstd-learning/internal/crypt"
+	"zstd-learning/internal/decpool"
+	"zstd-learning/internal/dictfile"
+	"zstd-learning/internal/frame"
+)
+
+// loadDictDir loads every .zdict file directly inside dir, in name order.
+func loadDictDir(dir string) ([]dictfile.Dict, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var dicts []dictfile.Dict
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".zdict") {
+			continue
+		}
+		dict, err := dictfile.Load(filepath.Join(dir, entry.Name()), false, "")
+		if err != nil {
+			return nil, err
+		}
+		dicts = append(dicts, dict)
+	}
+	return dicts, nil
+}
+
+// relabelDict returns a copy of a wrapped dictionary with its ID replaced, so
+// the decoder applies it to frames that declare id, entropy tables included.
+func relabelDict(data []byte, id uint32) []byte {
+	out := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(out[4:8], id)
+	return out
+}
+
+// retryable reports whether a decode failure could be caused by the wrong
+// dictionary, as opposed to the file being unreadable or failing to decrypt.
+func retryable(err error) bool {
+	var pathErr *fs.PathError
+	return err != nil && !errors.As(err, &pathErr) && !errors.Is(err, crypt.ErrWrongKey) && !errors.Is(err, crypt.ErrCorrupt) && !errors.Is(err, crypt.ErrNoKey)
+}
+
+// retryWithDicts decodes inPath with each dictionary in turn, presenting it
+// under the dictionary IDs the frames declare, until one succeeds. out is
+// called before every attempt and must return a fresh destination.
+func retryWithDicts(dicts []dictfile.Dict, inPath string, keys crypt.Keys, out func() (io.WriteCloser, error)) (dictfile.Dict, int64, error) {
+	inFile, err := openInput(inPath, keys)
+	if err != nil {
+		return dictfile.Dict{}, 0, err
+	}
+	frames, err := frame.ScanAll(inFile)
+	inFile.Close()
+	if err != nil {
+		return dictfile.Dict{}, 0, err
+	}
+	var ids []uint32
+	seen := map[uint32]bool{}
+	for _, info := range frames {
+		if !info.Skippable && info.DictID != 0 && !seen[info.DictID] {
+			seen[info.DictID] = true
+			ids = append(ids, info.DictID)
+		}
+	}
+	if len(ids) == 0 {
+		return dictfile.Dict{}, 0, errors.New("frames do not reference a dictionary")
+	}
+
+	lastErr := errors.New("no alternate dictionary to try")
+	for _, dict := range dicts {
+		if len(ids) == 1 && ids[0] == dict.ID {
+			// Already tried by the primary decoder.
+			continue
+		}
+		relabeled := make([][]byte, len(ids))
+		for i, id := range ids {
+			relabeled[i] = relabelDict(dict.Data, id)
+		}
+		written, err := decodeWithDicts(relabeled, inPath, keys, out)
+		if err == nil {
+			return dict, written, nil
+		}
+		lastErr = err
+	}
+	return dictfile.Dict{}, 0, lastErr
+}
+
+func decodeWithDicts(dicts [][]byte, inPath string, keys crypt.Keys, out func() (io.WriteCloser, error)) (int64, error) {
+	// The relabeled dictionaries are the same for every file declaring the
+	// same IDs, so their decoders are pooled rather than rebuilt per retry.
+	pool, err := decpool.For(dicts)
+	if err != nil {
+		return 0, err
+	}
+	decoder, err := pool.Get(nil)
+	if err != nil {
+		return 0, err
+	}
+	defer pool.Put(decoder)
+
+	w, err := out()
+	if err != nil {
+		return 0, err
+	}
+	written, err := decodeTo(decoder, nil, 1, inPath, keys, w)
+	if closeErr := w.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return written, err
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+// buildDict trains a dictionary with the given ID on records made by line.
+func buildDict(t *testing.T, id uint32, line func(i int) string) []byte {
+	t.Helper()
+	var samples [][]byte
+	for i := 0; i < 300; i++ {
+		samples = append(samples, []byte(line(i)))
+	}
+	d, err := dict.BuildZstdDict(samples, dict.Options{MaxDictSize: 4096, HashBytes: 6, ZstdDictID: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func person(i int) string {
+	return fmt.Sprintf(`{"id":%d,"name":"user-%d","email":"user-%d@example.com","active":%t}`, i, i%17, i, i%3 == 0)
+}
+
+func movie(i int) string {
+	return fmt.Sprintf(`{"title":"Film %d","director":"director-%d","year":%d,"genres":["drama","comedy"]}`, i, i%11, 1950+i%70)
+}
+
+// TestRetryWithDicts writes two files whose frames each declare the other
+// dictionary's ID, so only the retry with the dictionary they were really
+// compressed with decodes them.
+func TestRetryWithDicts(t *testing.T) {
+	people := buildDict(t, 10, person)
+	movies := buildDict(t, 20, movie)
+	dictDir := t.TempDir()
+	for name, data := range map[string][]byte{"people.zdict": people, "movies.zdict": movies} {
+		if err := os.WriteFile(filepath.Join(dictDir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	in := t.TempDir()
+	want := map[string]string{}
+	for _, tc := range []struct {
+		name string
+		dict []byte
+		id   uint32
+		line func(int) string
+	}{
+		{"people.json", people, 20, person},
+		{"movies.json", movies, 10, movie},
+	} {
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderDict(relabelDict(tc.dict, tc.id)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := tc.line(1000) + "\n" + tc.line(1001) + "\n"
+		want[tc.name] = data
+		if err := os.WriteFile(filepath.Join(in, tc.name+".zst"), encoder.EncodeAll([]byte(data), nil), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		encoder.Close()
+	}
+
+	url, pushed := fakeGateway(t)
+	code, out := run(t, "-in", in, "-out", t.TempDir(), "-dict-dir", dictDir, "-pushgateway", url, "-retry-dicts=false")
+	if code != 1 {
+		t.Fatalf("without -retry-dicts: exit %d, want 1, output:\n%s", code, out)
+	}
+
+	outDir := t.TempDir()
+	code, out = run(t, "-in", in, "-out", outDir, "-dict-dir", dictDir, "-pushgateway", url)
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, out)
+	}
+	for _, report := range []string{
+		"people.json.zst: decoded with alternate dictionary " + filepath.Join(dictDir, "people.zdict") + " (id 10)",
+		"movies.json.zst: decoded with alternate dictionary " + filepath.Join(dictDir, "movies.zdict") + " (id 20)",
+		"2 files decoded only with an alternate dictionary",
+	} {
+		if !strings.Contains(out, report) {
+			t.Errorf("output lacks %q:\n%s", report, out)
+		}
+	}
+	if got := readTree(t, outDir); len(got) != 2 || got["people.json"] != want["people.json"] || got["movies.json"] != want["movies.json"] {
+		t.Errorf("decoded %q, want %q", got, want)
+	}
+	if got := pushed()["decompress_files_processed"]; got != 2 {
+		t.Errorf("pushed %v files processed, want 2", got)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+
+	"zstd-learning/internal/frame"
+	"zstd-learning/internal/walk"
+)
+
+// maxParallelFrameBytes bounds what the parallel frame path holds of one
+// frame, compressed or as declared by its header. Frame headers are not
+// trusted to size buffers: a file with a larger frame is streamed instead.
+const maxParallelFrameBytes = 64 << 20
+
+type frameResult struct {
+	data []byte
+	err  error
+}
+
+// decompressFramesParallel decodes the independent frames of a multi-frame
+// file concurrently and writes them to out in order. It reports false without
+// writing anything when the file has fewer than two data frames, or a frame
+// larger than maxParallelFrameBytes, so the caller can fall back to the
+// streaming decoder.
+func decompressFramesParallel(decoder *zstd.Decoder, inPath string, out io.Writer, workers int) (int64, bool, error) {
+	inFile, err := walk.Open(inPath)
+	if err != nil {
+		return 0, false, err
+	}
+	defer inFile.Close()
+
+	frames, err := frame.ScanAll(inFile)
+	if err != nil {
+		return 0, false, err
+	}
+	dataFrames := frames[:0:0]
+	for _, info := range frames {
+		if info.Skippable {
+			continue
+		}
+		if info.Length > maxParallelFrameBytes || info.ContentSize > maxParallelFrameBytes {
+			return 0, false, nil
+		}
+		dataFrames = append(dataFrames, info)
+	}
+	if len(dataFrames) < 2 {
+		return 0, false, nil
+	}
+
+	// Each frame gets its own result channel; the semaphore bounds how many
+	// decoded frames are held in memory while the writer catches up.
+	results := make([]chan frameResult, len(dataFrames))
+	for i := range results {
+		results[i] = make(chan frameResult, 1)
+	}
+	sem := make(chan struct{}, workers)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for i, info := range dataFrames {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func(info frame.Info, result chan<- frameResult) {
+				src := make([]byte, info.Length)
+				if _, err := inFile.ReadAt(src, info.Offset); err != nil {
+					result <- frameResult{err: err}
+					return
+				}
+				var dst []byte
+				if info.HasContentSize() {
+					dst = make([]byte, 0, info.ContentSize)
+				}
+				data, err := decoder.DecodeAll(src, dst)
+				if errors.Is(err, zstd.ErrFrameSizeMismatch) || (err == nil && info.HasContentSize() && int64(len(data)) != info.ContentSize) {
+					err = errCorruptSize
+				}
+				result <- frameResult{data: data, err: err}
+			}(info, results[i])
+		}
+	}()
+
+	var written int64
+	for _, result := range results {
+		decoded := <-result
+		<-sem
+		if decoded.err != nil {
+			return written, true, decoded.err
+		}
+		n, err := out.Write(decoded.data)
+		written += int64(n)
+		if err != nil {
+			return written, true, err
+		}
+	}
+	return written, true, nil
+}
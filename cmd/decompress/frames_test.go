@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+
+	"zstd-learning/internal/crypt"
+)
+
+// writeFile writes data to name under a test directory and returns its path.
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newFrameDecoder(t *testing.T, workers int) *zstd.Decoder {
+	t.Helper()
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(workers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(decoder.Close)
+	return decoder
+}
+
+func TestFramesParallelMatchesSerial(t *testing.T) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	var compressed, want []byte
+	for i := 0; i < 12; i++ {
+		var part bytes.Buffer
+		for j := 0; j < 200*(i+1); j++ {
+			fmt.Fprintf(&part, `{"frame":%d,"record":%d,"title":"The Ninth Signal"}`+"\n", i, j)
+		}
+		want = append(want, part.Bytes()...)
+		compressed = encoder.EncodeAll(part.Bytes(), compressed)
+	}
+	path := writeFile(t, "multi.zst", compressed)
+
+	var serial bytes.Buffer
+	if _, err := decodeTo(newFrameDecoder(t, 1), nil, 1, path, crypt.Keys{}, &serial); err != nil {
+		t.Fatal(err)
+	}
+	var parallel bytes.Buffer
+	written, handled, err := decompressFramesParallel(newFrameDecoder(t, 4), path, &parallel, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !handled {
+		t.Fatal("a 12-frame file was not decoded in parallel")
+	}
+	if written != int64(len(want)) {
+		t.Errorf("wrote %d bytes, want %d", written, len(want))
+	}
+	if !bytes.Equal(serial.Bytes(), want) {
+		t.Fatal("serial output differs from the input")
+	}
+	if !bytes.Equal(parallel.Bytes(), serial.Bytes()) {
+		t.Fatal("parallel output differs from serial output")
+	}
+}
+
+// rawFrame returns a frame holding payload in one raw block, with an
+// 8-byte Frame_Content_Size field declaring contentSize.
+func rawFrame(payload []byte, contentSize uint64) []byte {
+	data := binary.LittleEndian.AppendUint32(nil, 0xFD2FB528)
+	data = append(data, 0xC0, 0x00) // 8-byte content size; 1 KiB window
+	data = binary.LittleEndian.AppendUint64(data, contentSize)
+	header := uint32(1) | uint32(len(payload))<<3 // last raw block
+	data = append(data, byte(header), byte(header>>8), byte(header>>16))
+	return append(data, payload...)
+}
+
+func TestFramesParallelDistrustsContentSize(t *testing.T) {
+	payload := []byte("hello")
+	for _, size := range []uint64{1 << 60, maxParallelFrameBytes + 1} {
+		path := writeFile(t, "crafted.zst", append(rawFrame(payload, size), rawFrame(payload, size)...))
+		_, handled, err := decompressFramesParallel(newFrameDecoder(t, 2), path, io.Discard, 2)
+		if err != nil || handled {
+			t.Fatalf("content size %d: handled %v, err %v; want a fallback to streaming", size, handled, err)
+		}
+		if _, err := decodeTo(newFrameDecoder(t, 1), newFrameDecoder(t, 2), 2, path, crypt.Keys{}, io.Discard); err == nil {
+			t.Fatalf("content size %d: decoding frames that declare more than they hold succeeded", size)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"zstd-learning/internal/crypt"
+	"zstd-learning/internal/frame"
+	"zstd-learning/internal/walk"
+)
+
+type fileListing struct {
+	Path           string
+	CompressedSize int64
+	Frames         int
+	Skippable      int
+	ContentSize    int64 // -1 when at least one data frame omits it
+	DictIDs        []uint32
+	Checksums      int
+	// WindowSize is the largest window a data frame needs.
+	WindowSize uint64
+}
+
+func runList(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	inputDir := fs.String("in", "compressed", "input directory with .zst files to list")
+	suffix := fs.String("suffix", ".zst", "only list files with this suffix (empty lists every file)")
+	requireContentSize := fs.Bool("require-content-size", false, "fail when any data frame does not declare its content size")
+	decryptIdentity := fs.String("decrypt-identity", "", "age identity file for listing inputs encrypted with compress -encrypt-recipient")
+	decryptKeyfile := fs.String("decrypt-keyfile", "", "key file for listing inputs encrypted with compress -encrypt-keyfile")
+	fs.Parse(args)
+
+	keys, err := loadKeys(*decryptIdentity, *decryptKeyfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid decryption key: %v\n", err)
+		exit(1)
+	}
+
+	paths, _, err := walk.Files(*inputDir, nil, walk.Skip)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list input files: %v\n", err)
+		exit(1)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "COMPRESSED\tFRAMES\tCONTENT SIZE\tDICT IDS\tCHECKSUMS\tFILE")
+
+	var missing, failed []string
+	for _, path := range paths {
+		if *suffix != "" && !hasInputSuffix(path, *suffix) {
+			continue
+		}
+		rel, err := filepath.Rel(*inputDir, path)
+		if err != nil {
+			rel = path
+		}
+
+		listing, err := inspectFile(path, keys)
+		if err != nil {
+			failed = append(failed, rel)
+			fmt.Fprintf(writer, "-\t-\t-\t-\t-\t%s (%v)\n", rel, err)
+			continue
+		}
+		contentSize := "unknown"
+		if listing.ContentSize >= 0 {
+			contentSize = strconv.FormatInt(listing.ContentSize, 10)
+		} else {
+			missing = append(missing, rel)
+		}
+		fmt.Fprintf(writer, "%d\t%d\t%s\t%s\t%d/%d\t%s\n", listing.CompressedSize, listing.Frames, contentSize, formatDictIDs(listing.DictIDs), listing.Checksums, listing.Frames, rel)
+	}
+	writer.Flush()
+
+	if len(failed) > 0 {
+		fmt.Fprintf(os.Stderr, "%d files are not valid zstd streams\n", len(failed))
+		exit(1)
+	}
+	if *requireContentSize && len(missing) > 0 {
+		fmt.Fprintf(os.Stderr, "%d files have frames without a declared content size:\n", len(missing))
+		for _, rel := range missing {
+			fmt.Fprintf(os.Stderr, "  %s\n", rel)
+		}
+		exit(1)
+	}
+}
+
+// inspectFile scans the frames of path, decrypting it first when it is
+// encrypted. CompressedSize then counts the frames, not the encryption
+// overhead.
+func inspectFile(path string, keys crypt.Keys) (fileListing, error) {
+	file, err := openInput(path, keys)
+	if err != nil {
+		return fileListing{}, err
+	}
+	defer file.Close()
+
+	frames, err := frame.ScanAll(file)
+	if err != nil {
+		return fileListing{}, err
+	}
+
+	listing := fileListing{Path: path}
+	seenDicts := map[uint32]bool{}
+	for _, info := range frames {
+		listing.CompressedSize += info.Length
+		if info.Skippable {
+			listing.Skippable++
+			continue
+		}
+		listing.Frames++
+		listing.WindowSize = max(listing.WindowSize, info.WindowSize)
+		if info.HasChecksum {
+			listing.Checksums++
+		}
+		if !seenDicts[info.DictID] {
+			seenDicts[info.DictID] = true
+			listing.DictIDs = append(listing.DictIDs, info.DictID)
+		}
+		if listing.ContentSize >= 0 && info.HasContentSize() {
+			listing.ContentSize += info.ContentSize
+		} else {
+			listing.ContentSize = -1
+		}
+	}
+	if listing.Frames == 0 {
+		listing.ContentSize = -1
+	}
+	return listing, nil
+}
+
+func formatDictIDs(ids []uint32) string {
+	if len(ids) == 0 {
+		return "-"
+	}
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+
+	"zstd-learning/internal/crypt"
+)
+
+// encodeSized compresses data the way compress does, declaring its size in
+// the frame header, or leaving it out when size is negative.
+func encodeSized(t *testing.T, data []byte, size int64) []byte {
+	t.Helper()
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	encoder.ResetContentSize(&out, size)
+	if _, err := encoder.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestInspectFileReadsDeclaredContentSize(t *testing.T) {
+	first := []byte(strings.Repeat(`{"id":1,"name":"alpha"}`+"\n", 300))
+	// Large enough that the encoder flushes blocks before it has seen the
+	// whole input, so an undeclared size stays out of the header.
+	second := []byte(strings.Repeat(`{"id":2,"name":"beta"}`+"\n", 20000))
+
+	tests := []struct {
+		name   string
+		data   []byte
+		frames int
+		want   int64
+	}{
+		{"one frame", encodeSized(t, first, int64(len(first))), 1, int64(len(first))},
+		{"two frames", append(encodeSized(t, first, int64(len(first))), encodeSized(t, second, int64(len(second)))...), 2, int64(len(first) + len(second))},
+		{"undeclared frame", append(encodeSized(t, first, int64(len(first))), encodeSized(t, second, -1)...), 2, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listing, err := inspectFile(writeFile(t, "data.json.zst", tt.data), crypt.Keys{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if listing.Frames != tt.frames {
+				t.Errorf("got %d frames, want %d", listing.Frames, tt.frames)
+			}
+			if listing.ContentSize != tt.want {
+				t.Errorf("got content size %d, want %d", listing.ContentSize, tt.want)
+			}
+			if listing.CompressedSize != int64(len(tt.data)) {
+				t.Errorf("got compressed size %d, want %d", listing.CompressedSize, len(tt.data))
+			}
+		})
+	}
+}
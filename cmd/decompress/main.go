@@ -5,216 +5,1054 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"io/fs"
 	"os"
 	"path/filepath"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/push"
+
+	"zstd-learning/internal/bundle"
+	"zstd-learning/internal/config"
+	"zstd-learning/internal/console"
+	"zstd-learning/internal/crypt"
+	"zstd-learning/internal/decpool"
+	"zstd-learning/internal/dictfile"
+	"zstd-learning/internal/events"
+	"zstd-learning/internal/fdlimit"
+	"zstd-learning/internal/filter"
+	"zstd-learning/internal/history"
+	"zstd-learning/internal/lock"
+	"zstd-learning/internal/mirror"
+	"zstd-learning/internal/notify"
+	"zstd-learning/internal/outpath"
+	"zstd-learning/internal/pushspool"
+	"zstd-learning/internal/report"
+	"zstd-learning/internal/repro"
+	"zstd-learning/internal/stats"
+	"zstd-learning/internal/summary"
+	"zstd-learning/internal/walk"
+	"zstd-learning/pkg/progress"
 )
 
+var errCorruptSize = errors.New("corrupt: decoded size does not match the content size declared in the frame header")
+
+// runStats counts a decompress run. FilesSkipped counts the special files
+// and the outputs -resume found complete, FilesFailed the files -test found
+// corrupt; both are also counted on their own.
 type runStats struct {
-	FilesProcessed int
-	InputBytes     int64
-	OutputBytes    int64
+	stats.RunStats
+	DictRetries int
+	// Bundles counts the compress -batch-small-files bundles split back
+	// into their files, which FilesProcessed counts one by one.
+	Bundles int
+	// ResumeSkipped and ResumeRedone count, with -resume, existing outputs
+	// found complete and those decoded again as partial or unverifiable.
+	ResumeSkipped int
+	ResumeRedone  int
+	// FilesCopied and CopiedBytes count the files -copy-unmatched copied
+	// unchanged.
+	FilesCopied int
+	CopiedBytes int64
+	// SpecialSkipped counts the FIFOs, sockets and devices left out.
+	SpecialSkipped int
+	RecordFiles    int
+	Records        int64
+	// Counted maps both the compressed and the output name of each counted
+	// file to its record count, for -expected-counts.
+	Counted map[string]int64
+	// FilteredFiles, RecordsScanned and RecordsMatched count, with
+	// -record-filter, the files filtered and their records seen and kept.
+	FilteredFiles  int
+	RecordsScanned int64
+	RecordsMatched int64
+	// InvalidJSON lists the files that decoded but failed -validate json.
+	InvalidJSON []string
+	// FramesByDict counts data frames by the dictionary ID their header
+	// references (0 for none); set only with -dict-report.
+	FramesByDict map[uint32]int64
+	// Routed counts the outputs -route-by-type placed, by content type.
+	Routed map[string]int
+	Files  []report.File
+}
+
+type decompressOptions struct {
+	DictBytes    []byte
+	RawDict      bool
+	RawDictID    uint32
+	Dicts        []dictfile.Dict
+	RetryDicts   bool
+	CountRecords bool
+	ValidateJSON bool
+	Sparse       bool
+	Verbose      bool
+	Printer      console.Printer
+	FrameWorkers int
+	Suffix       string
+	Resume       bool
+	Keys         crypt.Keys
+	Shards       int
+	DictReport   bool
+	RecordFilter *recordFilter
+	Atomic       bool
+	OpenFiles    *fdlimit.Limit
+	// Route places outputs by their content type; nil without
+	// -route-by-type.
+	Route *router
+	// Progress receives an event per finished file; nil without
+	// -progress-json.
+	Progress *events.Stream
+	// Notes receives the per-file lines and Warnings the warnings printed
+	// mid-run, as summary.Outputs routes them.
+	Notes    io.Writer
+	Warnings io.Writer
+}
+
+var (
+	notifier       *notify.Run
+	progressEvents *events.Stream
+	pushSpool      *pushspool.Options
+	deterministic  *repro.Options
+	outLock        *lock.Lock
+)
+
+// exit stands in for os.Exit, which would skip the deferred lock release
+// and leave -notify-url and -progress-json without the outcome.
+func exit(code int) {
+	progressEvents.Finish(code)
+	notifier.Finish(code)
+	outLock.Release()
+	os.Exit(code)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "list" {
+		runList(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		runAudit(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "split-frames" {
+		runSplitFrames(os.Args[2:])
+		return
+	}
+
 	inputDir := flag.String("in", "compressed", "input directory with .zst files to decompress")
 	outDir := flag.String("out", "decompressed", "output directory for decompressed files")
 	useDict := flag.Bool("use-dict", false, "enable dictionary decompression")
-	dictPath := flag.String("dict", "", "path to zstd dictionary file")
+	dictPath := flag.String("dict", "", "path to zstd dictionary file (.zdict, or a .zdictpkg package from train-dict -package)")
+	rawDict := flag.Bool("raw-dict", false, "treat -dict as raw content (as written by train-dict -dict-format raw) instead of a wrapped zstd dictionary")
+	dictSHA256 := flag.String("dict-sha256", "", "fail unless the -dict file has this hex SHA-256")
+	rawDictID := flag.Uint("raw-dict-id", 0, "dictionary ID to match in frame headers with -raw-dict (0 matches frames without an ID)")
+	dictA := flag.String("dict-a", "", "load the two dictionaries of a compress -dict-a/-dict-b run: dictionary A")
+	dictB := flag.String("dict-b", "", "with -dict-a, dictionary B of a compress -dict-a/-dict-b run")
+	dictDir := flag.String("dict-dir", "", "also load every .zdict file in this directory for decoding")
+	retryDicts := flag.Bool("retry-dicts", true, "when a file fails to decode, retry it with each loaded dictionary in case its frames declare the wrong dictionary ID")
 	runID := flag.String("run-id", "", "run identifier for metrics grouping")
 	pushURL := flag.String("pushgateway", "http://localhost:9091", "Pushgateway base URL")
-	flag.Parse()
+	suffix := flag.String("suffix", ".zst", "suffix stripped from input names, matching compress -suffix (files without it get .out appended)")
+	filterExpr := flag.String("filter", "", "only process files matching an expression, e.g. 'size > 1MB && ext == .json && age < 7d' (see internal/filter)")
+	specialFiles := flag.String("special-files", "skip", "what to do with FIFOs, sockets and device nodes under -in, which are never opened: skip (and count them) or error")
+	summaryFormat := flag.String("summary-format", "text", "end-of-run summary format: text (human-readable sizes and rates) or json (raw numbers)")
+	allowEmpty := flag.Bool("allow-empty", false, "treat an input directory without files as a successful run that does nothing and pushes zeroed metrics, instead of an error")
+	quiet := flag.Bool("quiet", false, "do not print the end-of-run summary or other notes; warnings still go to stderr")
+	waitForLock := flag.Duration("wait-for-lock", 0, "when another run holds the output directory lock, wait up to this long for it instead of failing at once")
+	lockStaleAfter := flag.Duration("lock-stale-after", time.Hour, "break an output directory lock file its holder stopped refreshing this long ago (only where the OS cannot lock files; flock and LockFileEx locks die with their process)")
+	colorFlag := flag.String("color", "auto", "colorize output: auto (only on a terminal), always, never")
+	verbose := flag.Bool("verbose", false, "print a line per decompressed file")
+	frameWorkers := flag.Int("frame-workers", 1, "decode the frames of multi-frame files concurrently with this many workers (1 = serial)")
+	countRecords := flag.Bool("count-records", false, "count top-level records in JSON array and NDJSON outputs while decoding")
+	expectedCounts := flag.String("expected-counts", "", "JSON manifest of {\"path\": records}; fail the run when counted records differ (implies -count-records)")
+	recordFilterExpr := flag.String("record-filter", "", "write only the records of .json, .ndjson and .jsonl outputs (JSON arrays or NDJSON) matching field=value or field~prefix, e.g. country=Norway or genre~Sci; nested fields as a.b")
+	validate := flag.String("validate", "", "check each decoded output while writing it; \"json\" fails files that are not well-formed JSON (a document or NDJSON)")
+	sparse := flag.Bool("sparse", false, "write runs of zero bytes as filesystem holes so sparse inputs restore as sparse files")
+	perFileMetrics := flag.Bool("per-file-metrics", false, "also push a per-file ratio metric with a file label, for small curated corpora; disabled with a warning when the run has more than -per-file-metrics-limit files")
+	perFileLimit := flag.Int("per-file-metrics-limit", 500, "most files -per-file-metrics will label before it disables itself")
+	dictReport := flag.Bool("dict-report", false, "count the frames of the batch by the dictionary ID their headers reference (0 for none), print the counts and push them as decompress_frames_by_dict")
+	historyPath := flag.String("history", "", "append a one-line record of this run to this JSONL history file (export it with report history export)")
+	reportPath := flag.String("report", "", "write a JSON run report with per-file results to this path")
+	limit := flag.Int("limit", 0, "process at most this many files, in sorted order (0 = no limit)")
+	atomic := flag.Bool("atomic", false, "write each output to a hidden temporary file next to it and rename it into place once complete and synced, so an interrupted run never leaves a partial output under its final name")
+	resume := flag.Bool("resume", false, "skip outputs that already exist with the size declared in their frame headers and decode partial ones again (outputs without a declared size are always decoded again)")
+	decryptIdentity := flag.String("decrypt-identity", "", "age identity file (as written by age-keygen) for inputs encrypted with compress -encrypt-recipient")
+	decryptKeyfile := flag.String("decrypt-keyfile", "", "32-byte key file (raw or hex) for inputs encrypted with compress -encrypt-keyfile")
+	copyUnmatched := flag.Bool("copy-unmatched", false, "copy inputs without -suffix unchanged into -out, restoring the uncompressed entries written by compress -copy-unmatched, instead of decoding them")
+	routeByType := flag.Bool("route-by-type", false, "sniff each output's first bytes and place it under -out/json/, -out/csv/ or -out/other/ by content type (NDJSON goes with JSON); the report records each file's type")
+	routeConfig := flag.String("route-config", "", "with -route-by-type, JSON file mapping content types (json, ndjson, csv, other) to subdirectories of -out, overriding the defaults")
+	shards := flag.Int("shard", 1, "spread outputs over this many directories -out/shard-<k>/, k being the FNV-1a hash of the output's relative path modulo N (1 keeps the plain layout)")
+	testMode := flag.Bool("test", false, "test-decode files without writing output, reporting every failure")
+	testWorkers := flag.Int("workers", 1, "with -test, decode this many files at once, each worker with its own decoder (failures are still all collected)")
+	maxOpenFiles := flag.Int("max-open-files", 0, "with -test, most input files held open at once across -workers, to stay under the open file limit on huge trees (0 = no limit)")
+	sampleFraction := flag.Float64("sample-fraction", 1, "with -test, check only this random fraction of files (0 < f <= 1)")
+	sampleSeed := flag.Int64("sample-seed", 0, "seed for -sample-fraction selection (0 picks one from the clock and prints it)")
+	stratify := flag.Bool("stratify", false, "with -sample-fraction, sample each directory separately so every subtree is covered")
+	notifyOpts := notify.Flags(flag.CommandLine)
+	progressOpts := events.Flags(flag.CommandLine)
+	pushSpool = pushspool.Flags(flag.CommandLine)
+	deterministic = repro.Flags(flag.CommandLine)
+	if err := config.Parse(flag.CommandLine, os.Args[1:], "ZSTD_DECOMPRESS"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
 
-	if *useDict && strings.TrimSpace(*dictPath) == "" {
-		fmt.Fprintln(os.Stderr, "-dict is required when -use-dict is set")
+	colorMode, err := console.ParseMode(*colorFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+	stdout := console.NewPrinter(colorMode, os.Stdout)
+	stderr := console.NewPrinter(colorMode, os.Stderr)
+	progressEvents, err = events.Start(progressOpts, "decompress")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	defer progressEvents.Finish(0)
+	notifier, err = notify.Start(notifyOpts, "decompress")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+	defer notifier.Finish(0)
+	summaryFmt, err := summary.ParseFormat(*summaryFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+	notes, warnings := summary.Outputs(summaryFmt, *quiet)
+	specialPolicy, err := walk.ParsePolicy(*specialFiles)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
 
-	if err := os.MkdirAll(*outDir, 0o755); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to create output dir: %v\n", err)
-		os.Exit(1)
+	if *waitForLock < 0 || *lockStaleAfter < 0 {
+		fmt.Fprintln(os.Stderr, "wait-for-lock and lock-stale-after must not be negative")
+		exit(1)
+	}
+	if *useDict && strings.TrimSpace(*dictPath) == "" {
+		fmt.Fprintln(os.Stderr, "-dict is required when -use-dict is set")
+		exit(1)
+	}
+	if *rawDict && !*useDict {
+		fmt.Fprintln(os.Stderr, "-raw-dict requires -use-dict")
+		exit(1)
+	}
+	if *dictSHA256 != "" && !*useDict {
+		fmt.Fprintln(os.Stderr, "-dict-sha256 requires -use-dict")
+		exit(1)
+	}
+	if *rawDict && *dictDir != "" {
+		fmt.Fprintln(os.Stderr, "-dict-dir cannot be combined with -raw-dict")
+		exit(1)
+	}
+	abTest := *dictA != "" || *dictB != ""
+	if abTest && (*dictA == "" || *dictB == "") {
+		fmt.Fprintln(os.Stderr, "-dict-a and -dict-b must be set together")
+		exit(1)
+	}
+	if abTest && *rawDict {
+		fmt.Fprintln(os.Stderr, "-dict-a cannot be combined with -raw-dict")
+		exit(1)
 	}
 
-	paths, err := listFiles(*inputDir)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to list input files: %v\n", err)
-		os.Exit(1)
+	if strings.ContainsAny(*suffix, `/\`) {
+		fmt.Fprintln(os.Stderr, "-suffix must not contain path separators")
+		exit(1)
 	}
-	if len(paths) == 0 {
-		fmt.Fprintf(os.Stderr, "no files found in %s\n", *inputDir)
-		os.Exit(1)
+	if *frameWorkers <= 0 {
+		fmt.Fprintln(os.Stderr, "frame-workers must be positive")
+		exit(1)
+	}
+	if *perFileLimit <= 0 {
+		fmt.Fprintln(os.Stderr, "per-file-metrics-limit must be positive")
+		exit(1)
+	}
+	if *limit < 0 {
+		fmt.Fprintln(os.Stderr, "limit must not be negative")
+		exit(1)
+	}
+	if *validate != "" && *validate != "json" {
+		fmt.Fprintf(os.Stderr, "invalid -validate %q (expected json)\n", *validate)
+		exit(1)
+	}
+	var recordFilter *recordFilter
+	if *recordFilterExpr != "" {
+		var err error
+		if recordFilter, err = parseRecordFilter(*recordFilterExpr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+	}
+	if recordFilter != nil && (*testMode || *resume) {
+		fmt.Fprintln(os.Stderr, "-record-filter cannot be combined with -test, which writes no output, or -resume, which compares outputs with the declared sizes")
+		exit(1)
+	}
+	if *sampleFraction <= 0 || *sampleFraction > 1 {
+		fmt.Fprintln(os.Stderr, "sample-fraction must be in (0, 1]")
+		exit(1)
+	}
+	if *resume && (*testMode || *countRecords || *expectedCounts != "") {
+		fmt.Fprintln(os.Stderr, "-resume cannot be combined with -test, -count-records or -expected-counts, which need every file decoded")
+		exit(1)
+	}
+	if *copyUnmatched && (*testMode || *suffix == "") {
+		fmt.Fprintln(os.Stderr, "-copy-unmatched needs a non-empty -suffix to tell copies apart and cannot be combined with -test")
+		exit(1)
+	}
+	if *shards < 1 {
+		fmt.Fprintf(os.Stderr, "invalid -shard %d: must be at least 1\n", *shards)
+		exit(1)
+	}
+	if *copyUnmatched && *shards > 1 {
+		fmt.Fprintln(os.Stderr, "-copy-unmatched cannot be combined with -shard, since copies keep their place in the output tree")
+		exit(1)
+	}
+	if *testWorkers < 1 {
+		fmt.Fprintf(os.Stderr, "invalid -workers %d: must be at least 1\n", *testWorkers)
+		exit(1)
+	}
+	if *testWorkers > 1 && !*testMode {
+		fmt.Fprintln(os.Stderr, "-workers requires -test")
+		exit(1)
+	}
+	if *maxOpenFiles < 0 {
+		fmt.Fprintf(os.Stderr, "invalid -max-open-files %d: must not be negative\n", *maxOpenFiles)
+		exit(1)
+	}
+	if *atomic && *testMode {
+		fmt.Fprintln(os.Stderr, "-atomic cannot be combined with -test, which writes no output")
+		exit(1)
+	}
+	if *routeConfig != "" && !*routeByType {
+		fmt.Fprintln(os.Stderr, "-route-config requires -route-by-type")
+		exit(1)
+	}
+	if *routeByType && (*testMode || *resume || *shards > 1) {
+		fmt.Fprintln(os.Stderr, "-route-by-type cannot be combined with -test, which writes no output, -resume, which looks for outputs at their unrouted place, or -shard")
+		exit(1)
+	}
+	var route *router
+	if *routeByType {
+		var err error
+		if route, err = newRouter(*routeConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -route-config: %v\n", err)
+			exit(1)
+		}
+	}
+	if *maxOpenFiles > 0 && !*testMode {
+		fmt.Fprintln(os.Stderr, "-max-open-files requires -test")
+		exit(1)
+	}
+	if *sampleFraction < 1 && !*testMode {
+		fmt.Fprintln(os.Stderr, "-sample-fraction requires -test")
+		exit(1)
+	}
+	if err := deterministic.Check(flag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+	if *sampleFraction < 1 {
+		if err := deterministic.RequireSeed("sample-seed", *sampleSeed); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+	}
+
+	if !*testMode {
+		if err := os.MkdirAll(*outDir, 0o755); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create output dir: %v\n", err)
+			exit(1)
+		}
+		held, err := lock.Acquire(*outDir, lock.Options{Command: "decompress", Wait: *waitForLock, StaleAfter: *lockStaleAfter})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("cannot lock output directory"), err)
+			exit(1)
+		}
+		outLock = held
+		defer outLock.Release()
 	}
 
 	var dictBytes []byte
+	var dictID uint32
+	var dicts []dictfile.Dict
 	if *useDict {
-		dictBytes, err = os.ReadFile(*dictPath)
+		loaded, err := dictfile.Load(*dictPath, *rawDict, *dictSHA256)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to read dict: %v\n", err)
-			os.Exit(1)
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("invalid dictionary"), err)
+			exit(1)
+		}
+		fmt.Fprintln(notes, loaded)
+		// A .zdictpkg records whether it holds a raw dictionary.
+		*rawDict = loaded.Raw
+		dictBytes, dictID = loaded.Data, loaded.ID
+		if loaded.Raw {
+			dictID = uint32(*rawDictID)
+		}
+		if !loaded.Raw {
+			dicts = append(dicts, loaded)
+		}
+	}
+	if abTest {
+		for _, path := range []string{*dictA, *dictB} {
+			loaded, err := dictfile.Load(path, false, "")
+			if err == nil && loaded.Raw {
+				err = fmt.Errorf("%s: compress -dict-a/-dict-b only uses wrapped dictionaries", path)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("invalid dictionary"), err)
+				exit(1)
+			}
+			fmt.Fprintln(notes, loaded)
+			dicts = append(dicts, loaded)
+		}
+	}
+	if *dictDir != "" {
+		fromDir, err := loadDictDir(*dictDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("invalid dictionary"), err)
+			exit(1)
+		}
+		for _, dict := range fromDir {
+			fmt.Fprintln(notes, dict)
 		}
+		dicts = append(dicts, fromDir...)
 	}
 
-	start := time.Now()
-	stats, err := decompressFiles(paths, *inputDir, *outDir, dictBytes)
+	// The scheme is detected from each input's first bytes, so one run can
+	// mix plain, age and keyfile inputs as long as the keys are given.
+	keys, err := loadKeys(*decryptIdentity, *decryptKeyfile)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "decompression failed: %v\n", err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("invalid decryption key"), err)
+		exit(1)
+	}
+
+	var expected map[string]int64
+	if *expectedCounts != "" {
+		expected, err = readExpectedCounts(*expectedCounts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read expected counts: %v\n", err)
+			exit(1)
+		}
+		*countRecords = true
+	}
+
+	var match *filter.Expr
+	if strings.TrimSpace(*filterExpr) != "" {
+		match, err = filter.Parse(*filterExpr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
 	}
-	duration := time.Since(start)
 
 	sourceLabel := filepath.Base(*inputDir)
 	if sourceLabel == "." || sourceLabel == string(filepath.Separator) {
 		sourceLabel = "compressed"
 	}
 	if strings.TrimSpace(*runID) == "" {
-		*runID = time.Now().Format("20060102_150405")
+		*runID = deterministic.Now().Format("20060102_150405")
 	}
 
-	if err := pushMetrics(*pushURL, stats, duration, sourceLabel, *useDict, *runID); err != nil {
-		fmt.Fprintf(os.Stderr, "metrics push failed: %v\n", err)
-		os.Exit(1)
+	paths, specialSkipped, err := walk.Files(*inputDir, match, specialPolicy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list input files: %v\n", err)
+		exit(1)
 	}
+	var copies []string
+	if *copyUnmatched {
+		paths, copies, err = splitCopies(*inputDir, match, paths, *suffix)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to list input files: %v\n", err)
+			exit(1)
+		}
+	}
+	if len(paths) == 0 && len(copies) == 0 {
+		if !*allowEmpty {
+			fmt.Fprintf(os.Stderr, "no files found in %s\n", *inputDir)
+			exit(1)
+		}
+		fmt.Fprintf(notes, "no files found in %s; nothing to do\n", *inputDir)
+		if err := pushMetrics(*pushURL, runStats{}, nil, 0, sourceLabel, *useDict, *runID, 0); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("metrics push failed"), err)
+			exit(1)
+		}
+		return
+	}
+	available := len(paths)
+	if *limit > 0 && len(paths) > *limit {
+		paths = paths[:*limit]
+	}
+	limited := len(paths) < available
 
-	fmt.Printf("decompressed %d files (%d bytes -> %d bytes) into %s\n", stats.FilesProcessed, stats.InputBytes, stats.OutputBytes, *outDir)
-}
+	var copyDests []string
+	if len(copies) > 0 {
+		_, outs, _, err := outputPaths(paths, *inputDir, *outDir, *suffix, 1)
+		if err == nil {
+			copyDests, err = mirror.Plan(copies, *inputDir, *outDir, paths, outs)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("decompression failed"), err)
+			exit(1)
+		}
+	}
 
-func decompressFiles(paths []string, baseDir, outDir string, dictBytes []byte) (runStats, error) {
-	stats := runStats{}
+	opts := decompressOptions{
+		DictBytes:    dictBytes,
+		RawDict:      *rawDict,
+		RawDictID:    uint32(*rawDictID),
+		Dicts:        dicts,
+		RetryDicts:   *retryDicts,
+		CountRecords: *countRecords,
+		ValidateJSON: *validate == "json",
+		RecordFilter: recordFilter,
+		Sparse:       *sparse,
+		Verbose:      *verbose,
+		Printer:      stdout,
+		FrameWorkers: *frameWorkers,
+		OpenFiles:    fdlimit.New(*maxOpenFiles),
+		Atomic:       *atomic,
+		Route:        route,
+		Suffix:       *suffix,
+		Resume:       *resume,
+		Keys:         keys,
+		Shards:       *shards,
+		DictReport:   *dictReport,
+		Progress:     progressEvents,
+		Notes:        notes,
+		Warnings:     warnings,
+	}
 
-	options := []zstd.DOption{}
-	if len(dictBytes) > 0 {
-		options = append(options, zstd.WithDecoderDicts(dictBytes))
+	start := time.Now()
+	var stats runStats
+	var test *testResult
+	if *testMode {
+		if *sampleSeed == 0 {
+			*sampleSeed = time.Now().UnixNano()
+		}
+		sample := selectSample(paths, sampleOptions{Fraction: *sampleFraction, Seed: *sampleSeed, Stratify: *stratify})
+		progressEvents.Begin(*runID, len(sample), inputSize(sample))
+		var failures []string
+		stats, failures, err = testFiles(sample, *inputDir, opts, *testWorkers)
+		test = &testResult{Stats: stats, FilesTotal: len(paths), Failures: failures}
+	} else {
+		progressEvents.Begin(*runID, len(paths), inputSize(paths))
+		stats, err = decompressFiles(paths, *inputDir, *outDir, opts)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("decompression failed"), err)
+		exit(1)
+	}
+	stats.SpecialSkipped = specialSkipped
+	stats.FilesSkipped += specialSkipped
+	if len(copies) > 0 {
+		stats.FilesCopied, stats.CopiedBytes, err = mirror.Copy(copies, copyDests)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("copying unmatched files failed"), err)
+			exit(1)
+		}
+	}
+	duration := time.Since(start)
+
+	notifier.Record(*runID, stats.FilesProcessed, stats.InputBytes, stats.OutputBytes, report.Ratio(stats.InputBytes, stats.OutputBytes))
+
+	if *reportPath != "" {
+		if err := report.Write(*reportPath, newRunReport(stats, *inputDir, *outDir, *runID, *shards)); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("failed to write report"), err)
+			exit(1)
+		}
 	}
 
+	// Test results are printed before the push so failing paths are listed
+	// even when the Pushgateway is unreachable.
+	if test != nil {
+		printTestResult(notes, stdout, *test, *sampleFraction, *sampleSeed)
+		if limited {
+			fmt.Fprintln(warnings, stdout.Yellow(fmt.Sprintf("limit of %d files applied: sample drawn from %d of %d files", *limit, len(paths), available)))
+		}
+	}
+	fileLimit := 0
+	if *perFileMetrics {
+		fileLimit = *perFileLimit
+		if len(stats.Files) > fileLimit {
+			fmt.Fprintln(warnings, stdout.Yellow(fmt.Sprintf("warning: -per-file-metrics disabled: %d files exceed -per-file-metrics-limit %d; only aggregate metrics are pushed", len(stats.Files), fileLimit)))
+		}
+	}
+	if *historyPath != "" && test == nil {
+		err := history.Append(*historyPath, history.Record{
+			Timestamp:       deterministic.Now(),
+			Command:         "decompress",
+			Source:          sourceLabel,
+			RunID:           *runID,
+			Files:           stats.FilesProcessed,
+			InputBytes:      stats.InputBytes,
+			OutputBytes:     stats.OutputBytes,
+			Ratio:           report.Ratio(stats.InputBytes, stats.OutputBytes),
+			DurationSeconds: deterministic.Duration(duration).Seconds(),
+			DictID:          dictID,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("failed to record history"), err)
+			exit(1)
+		}
+	}
+	if err := pushMetrics(*pushURL, stats, test, duration, sourceLabel, *useDict || len(dicts) > 0, *runID, fileLimit); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("metrics push failed"), err)
+		exit(1)
+	}
+
+	failed := false
+	if test != nil {
+		failed = len(test.Failures) > 0
+	} else {
+		if !*quiet {
+			sum := summary.New("decompress", stats.FilesProcessed, stats.InputBytes, stats.OutputBytes, stats.OutputBytes, deterministic.Duration(duration))
+			sum.Ratio = report.Ratio(stats.InputBytes, stats.OutputBytes)
+			sum.Destination = *outDir
+			if summaryFmt == summary.JSON {
+				sum.WriteJSON(os.Stdout)
+			} else {
+				fmt.Printf("decompressed %s files: %s into %s\n", stdout.Bold(strconv.Itoa(stats.FilesProcessed)), sum.Details(stdout), *outDir)
+			}
+		}
+		if limited {
+			fmt.Fprintln(warnings, stdout.Yellow(fmt.Sprintf("limit of %d files applied: %d of %d files processed", *limit, len(paths), available)))
+		}
+		if *copyUnmatched {
+			fmt.Fprintf(notes, "copied %d uncompressed files (%d bytes) unchanged; %d already up to date\n", stats.FilesCopied, stats.CopiedBytes, len(copies)-stats.FilesCopied)
+		}
+		if stats.SpecialSkipped > 0 {
+			fmt.Fprintln(warnings, stdout.Yellow(fmt.Sprintf("skipped %d special files (FIFOs, sockets or devices)", stats.SpecialSkipped)))
+		}
+		if *resume {
+			fmt.Fprintf(notes, "resume: %d complete outputs skipped, %d partial or unverifiable outputs decoded again\n", stats.ResumeSkipped, stats.ResumeRedone)
+		}
+		if stats.Bundles > 0 {
+			fmt.Fprintf(notes, "split %d bundles back into their files\n", stats.Bundles)
+		}
+		if route != nil {
+			fmt.Fprintf(notes, "routed by type: %s\n", formatRouted(stats.Routed, route))
+		}
+		if stats.DictRetries > 0 {
+			fmt.Fprintln(warnings, stdout.Yellow(fmt.Sprintf("%d files decoded only with an alternate dictionary", stats.DictRetries)))
+		}
+		if len(stats.InvalidJSON) > 0 {
+			fmt.Fprintln(os.Stderr, stderr.Red(fmt.Sprintf("%d files decoded to invalid JSON (outputs kept for inspection)", len(stats.InvalidJSON))))
+			failed = true
+		}
+	}
+	if *dictReport {
+		fmt.Fprintf(notes, "frames by dictionary: %s\n", formatFrameDicts(stats.FramesByDict))
+	}
+	if recordFilter != nil {
+		fmt.Fprintf(notes, "record filter: kept %d of %d records in %d JSON files\n", stats.RecordsMatched, stats.RecordsScanned, stats.FilteredFiles)
+	}
+	if *countRecords {
+		fmt.Fprintf(notes, "counted %d records in %d JSON files (%d non-JSON files excluded)\n", stats.Records, stats.RecordFiles, stats.FilesProcessed-stats.RecordFiles)
+	}
+	if expected != nil {
+		problems := checkExpectedCounts(expected, stats.Counted)
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, stderr.Red(problem))
+		}
+		if len(problems) > 0 {
+			failed = true
+		}
+	}
+	if failed {
+		exit(1)
+	}
+}
+
+func decompressFiles(paths []string, baseDir, outDir string, opts decompressOptions) (runStats, error) {
+	stats := runStats{}
+
+	options := decoderOptions(opts)
 	decoder, err := zstd.NewReader(nil, options...)
 	if err != nil {
 		return stats, err
 	}
 	defer decoder.Close()
 
-	for _, path := range paths {
-		rel, err := filepath.Rel(baseDir, path)
+	var frameDecoder *zstd.Decoder
+	if opts.FrameWorkers > 1 {
+		frameDecoder, err = zstd.NewReader(nil, append(options, zstd.WithDecoderConcurrency(opts.FrameWorkers))...)
 		if err != nil {
 			return stats, err
 		}
+		defer frameDecoder.Close()
+	}
 
-		outRel := strings.TrimSuffix(rel, ".zst")
-		if outRel == rel {
-			outRel = rel + ".out"
+	rels, outPaths, caseOnly, err := outputPaths(paths, baseDir, outDir, opts.Suffix, opts.Shards)
+	if err != nil {
+		return stats, err
+	}
+	for _, warning := range caseOnly {
+		fmt.Fprintln(opts.Warnings, opts.Printer.Yellow("warning: "+warning))
+	}
+
+	for i, path := range paths {
+		rel, outPath := rels[i], outPaths[i]
+		// A bundle is always split again: -resume has no single output to
+		// compare it with, and its members are small.
+		idx, err := bundle.ReadIndex(path)
+		if err != nil {
+			return stats, fmt.Errorf("%s: %w", path, err)
+		}
+		if idx != nil {
+			if err := splitBundle(decoder, path, rel, outDir, idx, opts, &stats); err != nil {
+				return stats, fmt.Errorf("%s: %w", path, err)
+			}
+			if opts.DictReport {
+				if stats.FramesByDict == nil {
+					stats.FramesByDict = map[uint32]int64{}
+				}
+				if err := countFrameDicts(path, opts.Keys, stats.FramesByDict); err != nil {
+					return stats, fmt.Errorf("%s: %w", path, err)
+				}
+			}
+			continue
+		}
+		if opts.Resume {
+			action, err := checkResume(path, outPath, opts.Keys)
+			if err != nil {
+				return stats, fmt.Errorf("%s: %w", path, err)
+			}
+			if action == resumeSkip {
+				stats.ResumeSkipped++
+				stats.FilesSkipped++
+				opts.Progress.File(filepath.ToSlash(rel), 0, 0, progress.StatusSkipped)
+				if opts.Verbose {
+					fmt.Fprintf(opts.Notes, "  %-40s %s\n", rel, opts.Printer.Green("complete, skipped"))
+				}
+				continue
+			}
+			if action == resumeRedecode {
+				stats.ResumeRedone++
+			}
 		}
-		outPath := filepath.Join(outDir, outRel)
-		if err := os.MkdirAll(filepath.Dir(outPath), 0o755); err != nil {
+		tmpPath := writePath(outPath, opts.Atomic)
+		if opts.Route != nil {
+			tmpPath = opts.Route.tempPath(outDir, outPath)
+		}
+		if err := os.MkdirAll(filepath.Dir(tmpPath), 0o755); err != nil {
 			return stats, err
 		}
 
-		inFile, err := os.Open(path)
-		if err != nil {
-			return stats, err
+		checks := newOutputChecks(opts, outPath)
+		written, err := decompressFile(decoder, frameDecoder, opts.FrameWorkers, path, tmpPath, opts.Keys, opts.Sparse, checks)
+		if err != nil && opts.RetryDicts && len(opts.Dicts) > 0 && retryable(err) {
+			dict, retried, retryErr := retryWithDicts(opts.Dicts, path, opts.Keys, func() (io.WriteCloser, error) {
+				out, err := createOutput(tmpPath, opts.Sparse)
+				if err != nil {
+					return out, err
+				}
+				checks.reset()
+				return teeWriteCloser{checks.tee(out), out}, nil
+			})
+			if retryErr == nil {
+				fmt.Fprintf(opts.Warnings, "  %s: decoded with alternate dictionary %s (id %d) after: %v\n", rel, dict.Path, dict.ID, err)
+				stats.DictRetries++
+				written, err = retried, nil
+			}
+		}
+		invalid := checks.finish()
+		routed := outPath
+		if err == nil && opts.Route != nil {
+			routed, err = opts.Route.commit(tmpPath, outDir, outPath, checks.sniff.Type(), opts.Atomic)
+		} else if err == nil && opts.Atomic {
+			err = commitOutput(tmpPath, outPath)
 		}
-		outFile, err := os.Create(outPath)
 		if err != nil {
-			inFile.Close()
-			return stats, err
+			if opts.Atomic || opts.Route != nil {
+				os.Remove(tmpPath)
+			}
+			return stats, fmt.Errorf("%s: %w", path, err)
 		}
 
-		decoder.Reset(inFile)
-		written, err := io.Copy(outFile, decoder)
+		info, err := os.Stat(path)
 		if err != nil {
-			outFile.Close()
-			inFile.Close()
 			return stats, err
 		}
 
-		if err := outFile.Close(); err != nil {
-			inFile.Close()
-			return stats, err
+		if opts.DictReport {
+			if stats.FramesByDict == nil {
+				stats.FramesByDict = map[uint32]int64{}
+			}
+			if err := countFrameDicts(path, opts.Keys, stats.FramesByDict); err != nil {
+				return stats, fmt.Errorf("%s: %w", path, err)
+			}
 		}
-		if err := inFile.Close(); err != nil {
-			return stats, err
+
+		stats.Add(info.Size(), written)
+		var sharded string
+		if opts.Shards > 1 {
+			sharded, _ = filepath.Rel(outDir, outPath)
+		}
+		records := stats.addFile(rel, sharded, opts.Suffix, info.Size(), written, checks.counter)
+		if opts.Route != nil {
+			stats.recordRoute(outDir, routed, checks.sniff.Type())
+		}
+		stats.addFiltered(opts.Notes, rel, checks)
+		status := progress.StatusOK
+		if invalid != nil {
+			status = progress.StatusFailed
+		}
+		opts.Progress.File(filepath.ToSlash(rel), info.Size(), written, status)
+		if invalid != nil {
+			stats.InvalidJSON = append(stats.InvalidJSON, rel)
+			fmt.Fprintf(opts.Warnings, "  %s: %s: %v\n", rel, opts.Printer.Red("invalid JSON"), invalid)
+			continue
+		}
+
+		if opts.Verbose {
+			note := ""
+			if records != nil {
+				note = fmt.Sprintf("  %d records", *records)
+			}
+			fmt.Fprintf(opts.Notes, "  %-40s %10d -> %10d  %s%s\n", rel, info.Size(), written, opts.Printer.Green("ok"), note)
 		}
+	}
+
+	return stats, nil
+}
 
+// inputSize sums the sizes of paths, or returns -1 when one cannot be
+// read, which leaves the total out of the run-start event.
+func inputSize(paths []string) int64 {
+	var total int64
+	for _, path := range paths {
 		info, err := os.Stat(path)
 		if err != nil {
-			return stats, err
+			return -1
 		}
+		total += info.Size()
+	}
+	return total
+}
 
-		stats.FilesProcessed++
-		stats.InputBytes += info.Size()
-		stats.OutputBytes += written
+func decoderOptions(opts decompressOptions) []zstd.DOption {
+	options := []zstd.DOption{}
+	if opts.RawDict {
+		return append(options, zstd.WithDecoderDictRaw(opts.RawDictID, opts.DictBytes))
 	}
+	if len(opts.Dicts) > 0 {
+		options = append(options, zstd.WithDecoderDicts(dictData(opts.Dicts)...))
+	}
+	return options
+}
 
-	return stats, nil
+// decoderPool returns the shared pool of single-threaded decoders with the
+// same dictionaries as decoderOptions.
+func decoderPool(opts decompressOptions) (*decpool.Pool, error) {
+	if opts.RawDict {
+		return decpool.ForRaw(opts.RawDictID, opts.DictBytes)
+	}
+	return decpool.For(dictData(opts.Dicts))
 }
 
-func listFiles(dir string) ([]string, error) {
-	var paths []string
-	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+func dictData(dicts []dictfile.Dict) [][]byte {
+	data := make([][]byte, len(dicts))
+	for i, dict := range dicts {
+		data[i] = dict.Data
+	}
+	return data
+}
+
+// outputName maps a compressed relative path back to its original name. It
+// mirrors compress -suffix: the suffix is stripped when present (ignoring
+// case, so .ZST matches .zst), an empty suffix keeps names unchanged, and
+// anything else gets ".out" so the output never silently reuses the input
+// name with a different meaning. The .age or .enc compress adds after the
+// suffix when encrypting is stripped with it.
+func outputName(rel, suffix string) string {
+	rel = trimEncryptedExt(rel, suffix)
+	if suffix == "" {
+		return rel
+	}
+	if trimmed, ok := outpath.TrimSuffix(rel, suffix); ok && trimmed != "" && !strings.HasSuffix(trimmed, "/") && !strings.HasSuffix(trimmed, `\`) {
+		return trimmed
+	}
+	return rel + ".out"
+}
+
+// outputPaths maps every input to its relative name and output path before
+// anything is written, so a name that would escape outDir, or two inputs
+// such as a.json.zst and a.json.ZST that decompress to the same name, fail
+// the run up front. caseOnly describes outputs that differ only in case,
+// which are worth a warning but not an error. With shards above 1, each
+// output goes under the shard directory its name hashes to (see
+// outpath.Shard).
+func outputPaths(paths []string, baseDir, outDir, suffix string, shards int) (rels, outs, caseOnly []string, err error) {
+	rels = make([]string, len(paths))
+	outs = make([]string, len(paths))
+	collisions := outpath.NewCollisions()
+	for i, path := range paths {
+		rel, err := filepath.Rel(baseDir, path)
 		if err != nil {
-			return err
+			return nil, nil, nil, err
 		}
-		if d.IsDir() {
-			return nil
-		}
-		info, err := d.Info()
+		out, err := outpath.Join(outDir, outpath.Sharded(outputName(rel, suffix), shards))
 		if err != nil {
-			return err
+			return nil, nil, nil, err
 		}
-		if info.Size() == 0 {
-			return nil
+		if err := collisions.Add(rel, out); err != nil {
+			return nil, nil, nil, err
 		}
-		paths = append(paths, path)
-		return nil
-	})
-	if err != nil && !errors.Is(err, fs.SkipDir) {
+		rels[i], outs[i] = rel, out
+	}
+	return rels, outs, collisions.CaseOnly(), nil
+}
+
+// decompressFile decodes inPath into outPath, teeing the decoded bytes into
+// checks as they are written.
+func decompressFile(decoder, frameDecoder *zstd.Decoder, frameWorkers int, inPath, outPath string, keys crypt.Keys, sparse bool, checks *outputChecks) (int64, error) {
+	outFile, err := createOutput(outPath, sparse)
+	if err != nil {
+		return 0, err
+	}
+	defer outFile.Close()
+
+	written, err := decodeTo(decoder, frameDecoder, frameWorkers, inPath, keys, checks.tee(outFile))
+	if err != nil {
+		return written, err
+	}
+	return written, outFile.Close()
+}
+
+// createOutput creates outPath, wrapped to leave holes for zero runs when
+// sparse is set.
+func createOutput(outPath string, sparse bool) (io.WriteCloser, error) {
+	f, err := os.Create(outPath)
+	if err != nil {
 		return nil, err
 	}
-	sort.Strings(paths)
-	return paths, nil
+	if !sparse {
+		return f, nil
+	}
+	return newSparseFile(f), nil
+}
+
+// decodeTo decodes inPath into out, decrypting it first when it is
+// encrypted, and using the parallel frame path when frameDecoder is set and
+// the file has several frames.
+func decodeTo(decoder, frameDecoder *zstd.Decoder, frameWorkers int, inPath string, keys crypt.Keys, out io.Writer) (int64, error) {
+	inFile, err := openInput(inPath, keys)
+	if err != nil {
+		return 0, err
+	}
+	defer inFile.Close()
+
+	// Frames are located by offset, which only works on the raw file, so
+	// encrypted inputs are always decoded as a stream.
+	if frameDecoder != nil && inFile.Scheme == crypt.None {
+		written, handled, err := decompressFramesParallel(frameDecoder, inPath, out, frameWorkers)
+		if err != nil || handled {
+			return written, err
+		}
+	}
+
+	if err := decoder.Reset(inFile); err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(out, decoder)
+	if errors.Is(err, zstd.ErrFrameSizeMismatch) {
+		return written, errCorruptSize
+	}
+	if err != nil {
+		return written, err
+	}
+	return written, inFile.Close()
+}
+
+// statsHelp describes the gauges of the run's stats.RunStats.
+var statsHelp = map[string]string{
+	"decompress_duration_seconds": "Duration of the last decompression run in seconds.",
+	"decompress_files_processed":  "Number of files processed in the last decompression run.",
+	"decompress_files_skipped":    "Number of files skipped in the last decompression run: special files and outputs -resume found complete.",
+	"decompress_files_failed":     "Number of files that failed to decode in the last -test run.",
+	"decompress_input_bytes":      "Total input bytes decompressed in the last run.",
+	"decompress_output_bytes":     "Total output bytes produced in the last run.",
+	"decompress_ratio":            "Output/input size ratio for the last decompression run.",
 }
 
-func pushMetrics(pushURL string, stats runStats, duration time.Duration, source string, useDict bool, runID string) error {
+// pushMetrics pushes the run's metrics. Per-file series are only added when
+// fileLimit is positive and the run has at most that many files, so a large
+// run can never push one series per file.
+func pushMetrics(pushURL string, stats runStats, test *testResult, duration time.Duration, source string, useDict bool, runID string, fileLimit int) error {
 	registry := prometheus.NewRegistry()
 
-	durationGauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "decompress_duration_seconds",
-		Help: "Duration of the last decompression run in seconds.",
-	})
-	filesGauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "decompress_files_processed",
-		Help: "Number of files processed in the last decompression run.",
-	})
-	inputBytesGauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "decompress_input_bytes",
-		Help: "Total input bytes decompressed in the last run.",
-	})
-	outputBytesGauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "decompress_output_bytes",
-		Help: "Total output bytes produced in the last run.",
-	})
-	ratioGauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "decompress_ratio",
-		Help: "Output/input size ratio for the last decompression run.",
-	})
 	timestampGauge := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "decompress_last_run_timestamp_seconds",
 		Help: "Unix timestamp of the last decompression run.",
 	})
 
-	metrics := []prometheus.Collector{
-		durationGauge,
-		filesGauge,
-		inputBytesGauge,
-		outputBytesGauge,
-		ratioGauge,
+	invalidJSONGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "decompress_invalid_json",
+		Help: "Number of files that decoded but failed -validate json in the last run.",
+	})
+	specialGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "decompress_special_files_skipped",
+		Help: "Number of FIFOs, sockets and devices under -in skipped in the last run.",
+	})
+
+	stats.Duration = duration
+	metrics := append(stats.Gauges("decompress").Collectors(statsHelp),
 		timestampGauge,
+		invalidJSONGauge,
+		specialGauge,
+	)
+	if test != nil {
+		sampledGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "decompress_test_files_sampled",
+			Help: "Number of files test-decoded in the last -test run.",
+		})
+		totalGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "decompress_test_files_total",
+			Help: "Number of files the last -test sample was drawn from.",
+		})
+		failuresGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "decompress_test_failures",
+			Help: "Number of sampled files that failed to decode in the last -test run.",
+		})
+		okGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "verify_files_ok",
+			Help: "Number of files that decoded cleanly in the last -test run.",
+		})
+		corruptGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "verify_files_corrupt",
+			Help: "Number of files that failed to decode in the last -test run.",
+		})
+		sampledGauge.Set(float64(test.Stats.FilesProcessed))
+		totalGauge.Set(float64(test.FilesTotal))
+		failuresGauge.Set(float64(len(test.Failures)))
+		okGauge.Set(float64(test.Stats.FilesProcessed - len(test.Failures)))
+		corruptGauge.Set(float64(len(test.Failures)))
+		metrics = append(metrics, sampledGauge, totalGauge, failuresGauge, okGauge, corruptGauge)
+	}
+	if stats.FramesByDict != nil {
+		framesByDict := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "decompress_frames_by_dict",
+			Help: "Data frames in the last run by the dictionary ID their header references, 0 for none (-dict-report).",
+		}, []string{"dict_id"})
+		for id, n := range stats.FramesByDict {
+			framesByDict.WithLabelValues(strconv.FormatUint(uint64(id), 10)).Set(float64(n))
+		}
+		metrics = append(metrics, framesByDict)
+	}
+	if fileLimit > 0 && len(stats.Files) <= fileLimit {
+		fileRatio := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "decompress_file_ratio",
+			Help: "Decoded/compressed size ratio per file in the last run (-per-file-metrics).",
+		}, []string{"file"})
+		for _, f := range stats.Files {
+			fileRatio.WithLabelValues(f.Label()).Set(f.Ratio)
+		}
+		metrics = append(metrics, fileRatio)
 	}
 	for _, metric := range metrics {
 		if err := registry.Register(metric); err != nil {
@@ -222,21 +1060,18 @@ func pushMetrics(pushURL string, stats runStats, duration time.Duration, source
 		}
 	}
 
-	durationGauge.Set(duration.Seconds())
-	filesGauge.Set(float64(stats.FilesProcessed))
-	inputBytesGauge.Set(float64(stats.InputBytes))
-	outputBytesGauge.Set(float64(stats.OutputBytes))
-	if stats.InputBytes > 0 {
-		ratioGauge.Set(float64(stats.OutputBytes) / float64(stats.InputBytes))
-	}
 	timestampGauge.Set(float64(time.Now().Unix()))
+	invalidJSONGauge.Set(float64(len(stats.InvalidJSON)))
+	specialGauge.Set(float64(stats.SpecialSkipped))
 
 	source = strings.TrimSpace(source)
 	if source == "" {
 		source = "compressed"
 	}
 
-	pusher := push.New(pushURL, "decompress").Gatherer(registry)
-	pusher = pusher.Grouping("source", source).Grouping("use_dict", strconv.FormatBool(useDict)).Grouping("run_id", runID)
-	return pusher.Push()
+	grouping := pushspool.Grouping{"source": source, "use_dict": strconv.FormatBool(useDict), "run_id": runID}
+	if test != nil {
+		grouping["mode"] = "test"
+	}
+	return pushspool.Push(pushSpool, pushURL, "decompress", grouping, registry)
 }
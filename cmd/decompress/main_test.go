@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// runEnv makes the test binary run main instead of the tests, so a test can
+// run the command as a child process and look at its exit code.
+const runEnv = "ZSTD_LEARNING_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runEnv) == "1" {
+		main()
+		exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// run runs the command with args and returns its exit code and combined
+// output.
+func run(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runEnv+"=1")
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), string(out)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0, string(out)
+}
+
+// fakeGateway starts a Pushgateway stand-in and returns its URL and a
+// function returning the gauge values of the pushes it has received, by
+// family name and, for labeled series, also by name and sorted labels such
+// as compress_file_ratio{file=d0/a.json}.
+func fakeGateway(t *testing.T) (string, func() map[string]float64) {
+	t.Helper()
+	var mu sync.Mutex
+	gauges := map[string]float64{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		mu.Lock()
+		defer mu.Unlock()
+		for {
+			var family dto.MetricFamily
+			if err := dec.Decode(&family); err != nil {
+				return
+			}
+			for _, metric := range family.Metric {
+				value := metric.GetGauge().GetValue() + metric.GetCounter().GetValue()
+				gauges[family.GetName()] = value
+				if len(metric.Label) > 0 {
+					var labels []string
+					for _, label := range metric.Label {
+						labels = append(labels, label.GetName()+"="+label.GetValue())
+					}
+					sort.Strings(labels)
+					gauges[family.GetName()+"{"+strings.Join(labels, ",")+"}"] = value
+				}
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, func() map[string]float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return maps.Clone(gauges)
+	}
+}
+
+func TestAllowEmpty(t *testing.T) {
+	in := t.TempDir()
+	url, pushed := fakeGateway(t)
+
+	code, out := run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url)
+	if code != 1 || !strings.Contains(out, "no files found in "+in) {
+		t.Fatalf("without -allow-empty: exit %d, output:\n%s", code, out)
+	}
+	if len(pushed()) != 0 {
+		t.Fatal("metrics pushed for a run that failed on empty input")
+	}
+
+	code, out = run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url, "-allow-empty")
+	if code != 0 {
+		t.Fatalf("with -allow-empty: exit %d, output:\n%s", code, out)
+	}
+	gauges := pushed()
+	for _, name := range []string{"decompress_files_processed", "decompress_input_bytes", "decompress_output_bytes"} {
+		if value, ok := gauges[name]; !ok || value != 0 {
+			t.Errorf("%s: pushed %v (present %v), want 0", name, value, ok)
+		}
+	}
+}
+
+// writeCompressed writes each file, keyed by slash-separated path, under dir
+// as one zstd frame of its contents.
+func writeCompressed(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, encodeSized(t, []byte(data), int64(len(data))), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTree returns the regular files under dir by slash-separated path.
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		files[filepath.ToSlash(rel)] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestOutputName(t *testing.T) {
+	tests := []struct {
+		rel, suffix, want string
+	}{
+		{"report.2024.json.zst", ".zst", "report.2024.json"},
+		{"report.2024.json.ZST", ".zst", "report.2024.json"},
+		{"dir/report.json.zst", ".zst", "dir/report.json"},
+		{"report.2024.json.zstd", ".zstd", "report.2024.json"},
+		{"report.2024.json.Zstd", ".zstd", "report.2024.json"},
+		{"report.2024.json.zstd", ".zst", "report.2024.json.zstd.out"},
+		{"report.2024.json.zst", ".zstd", "report.2024.json.zst.out"},
+		{"report.json", ".zst", "report.json.out"},
+		{".zst", ".zst", ".zst.out"},
+		{"dir/.zst", ".zst", "dir/.zst.out"},
+		{"report.json", "", "report.json"},
+		{"report.json.zst", "", "report.json.zst"},
+		{"report.json.zst.age", ".zst", "report.json"},
+		{"report.json.zstd.enc", ".zstd", "report.json"},
+	}
+	for _, tt := range tests {
+		if got := outputName(filepath.FromSlash(tt.rel), tt.suffix); got != filepath.FromSlash(tt.want) {
+			t.Errorf("outputName(%q, %q) = %q, want %q", tt.rel, tt.suffix, got, tt.want)
+		}
+	}
+}
+
+func TestSuffixRoundTrip(t *testing.T) {
+	plain := map[string]string{
+		"report.2024.json": `{"id":1}`,
+		"dir/b.json":       `{"id":2}`,
+		"dir/C.csv":        "id\n3\n",
+	}
+	for _, suffix := range []string{".zst", ".zstd", ""} {
+		t.Run("suffix="+suffix, func(t *testing.T) {
+			in, out := t.TempDir(), t.TempDir()
+			// compress -suffix names the files; one comes with the suffix
+			// in upper case, as a case-insensitive filesystem may keep it.
+			compressed := map[string]string{}
+			for name, data := range plain {
+				if name == "dir/C.csv" {
+					compressed[name+strings.ToUpper(suffix)] = data
+				} else {
+					compressed[name+suffix] = data
+				}
+			}
+			writeCompressed(t, in, compressed)
+			url, _ := fakeGateway(t)
+
+			code, output := run(t, "-in", in, "-out", out, "-suffix", suffix, "-pushgateway", url)
+			if code != 0 {
+				t.Fatalf("exit %d, output:\n%s", code, output)
+			}
+			if got := readTree(t, out); !maps.Equal(got, plain) {
+				t.Errorf("decompressed\n%q\nwant\n%q", got, plain)
+			}
+		})
+	}
+}
+
+func TestLimit(t *testing.T) {
+	in := t.TempDir()
+	writeCompressed(t, in, map[string]string{"e.txt.zst": "e", "b.txt.zst": "b", "d.txt.zst": "d", "a.txt.zst": "a", "c.txt.zst": "c"})
+	url, pushed := fakeGateway(t)
+
+	out := t.TempDir()
+	code, output := run(t, "-in", in, "-out", out, "-pushgateway", url, "-limit", "2")
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, output)
+	}
+	if got, want := readTree(t, out), map[string]string{"a.txt": "a", "b.txt": "b"}; !maps.Equal(got, want) {
+		t.Errorf("-limit 2 wrote %q, want the first 2 in sorted order %q", got, want)
+	}
+	if !strings.Contains(output, "limit of 2 files applied: 2 of 5 files processed") {
+		t.Errorf("summary does not report the limit:\n%s", output)
+	}
+	if got := pushed()["decompress_files_processed"]; got != 2 {
+		t.Errorf("pushed %v files processed, want 2", got)
+	}
+}
+
+func TestPerFileMetrics(t *testing.T) {
+	in := t.TempDir()
+	writeCompressed(t, in, map[string]string{"c.txt.zst": "c", "d0/a.txt.zst": "a", "d1/e/b.txt.zst": "b"})
+
+	url, pushed := fakeGateway(t)
+	code, out := run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url, "-per-file-metrics", "-per-file-metrics-limit", "3")
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, out)
+	}
+	gauges := pushed()
+	for _, name := range []string{"decompress_file_ratio{file=c.txt.zst}", "decompress_file_ratio{file=d0/a.txt.zst}", "decompress_file_ratio{file=d1/e/b.txt.zst}"} {
+		if ratio, ok := gauges[name]; !ok || ratio <= 0 {
+			t.Errorf("%s = %v (present %v), want a ratio", name, ratio, ok)
+		}
+	}
+
+	writeCompressed(t, in, map[string]string{"d0/f.txt.zst": "f"})
+	url, pushed = fakeGateway(t)
+	code, out = run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url, "-per-file-metrics", "-per-file-metrics-limit", "3")
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, out)
+	}
+	if !strings.Contains(out, "-per-file-metrics disabled: 4 files exceed -per-file-metrics-limit 3") {
+		t.Errorf("no warning that the cap was exceeded:\n%s", out)
+	}
+	if _, ok := pushed()["decompress_file_ratio"]; ok {
+		t.Error("per-file series pushed over the cap")
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// recordFilter is a parsed -record-filter expression: field=value keeps
+// records whose field equals value, field~value those whose string field
+// starts with value. field may name a nested field as a.b.c.
+type recordFilter struct {
+	path   []string
+	value  string
+	prefix bool
+}
+
+func parseRecordFilter(expr string) (*recordFilter, error) {
+	i := strings.IndexAny(expr, "=~")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid -record-filter %q: expected field=value or field~prefix", expr)
+	}
+	f := &recordFilter{path: strings.Split(expr[:i], "."), value: expr[i+1:], prefix: expr[i] == '~'}
+	for _, name := range f.path {
+		if strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid -record-filter %q: empty field name", expr)
+		}
+	}
+	return f, nil
+}
+
+// filterable reports whether -record-filter applies to an output name.
+func filterable(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasSuffix(lower, ".json") || strings.HasSuffix(lower, ".ndjson") || strings.HasSuffix(lower, ".jsonl")
+}
+
+// match reports whether record, one complete JSON value, passes the filter.
+// Only the objects on the way to the field are decoded. A record without
+// the field, or where it is not a string for ~, does not match; numbers,
+// booleans and null compare by their JSON text for =.
+func (f *recordFilter) match(record []byte) (bool, error) {
+	raw := json.RawMessage(record)
+	for _, name := range f.path {
+		if len(raw) == 0 || raw[0] != '{' {
+			return false, nil
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return false, err
+		}
+		var ok bool
+		if raw, ok = fields[name]; !ok {
+			return false, nil
+		}
+	}
+	if len(raw) > 0 && raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return false, err
+		}
+		if f.prefix {
+			return strings.HasPrefix(s, f.value), nil
+		}
+		return s == f.value, nil
+	}
+	return !f.prefix && string(raw) == f.value, nil
+}
+
+// filterWriter passes the records of a JSON array or NDJSON stream that
+// match a recordFilter on to out, as they are written. Record boundaries
+// are found with the same byte-level scan as recordCounter, so only one
+// record is held at a time. Kept records are written compacted: an array
+// stays an array, one record per line, and any other stream becomes NDJSON.
+type filterWriter struct {
+	filter   *recordFilter
+	out      io.Writer
+	format   recordFormat
+	depth    int
+	inString bool
+	escaped  bool
+	record   bytes.Buffer
+	compact  bytes.Buffer
+	closed   bool
+	scanned  int64
+	matched  int64
+	err      error
+}
+
+func newFilterWriter(filter *recordFilter, out io.Writer) *filterWriter {
+	return &filterWriter{filter: filter, out: out}
+}
+
+// Write filters p. A malformed stream stops the filtering, but Write keeps
+// accepting bytes so the decode completes; the error is returned by finish.
+func (w *filterWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if w.err != nil {
+			break
+		}
+		w.feed(b)
+	}
+	var syntax *filterSyntaxError
+	if w.err != nil && !errors.As(w.err, &syntax) {
+		return 0, w.err
+	}
+	return len(p), nil
+}
+
+// filterSyntaxError is a problem with the decoded data rather than with
+// writing the output.
+type filterSyntaxError struct{ msg string }
+
+func (e *filterSyntaxError) Error() string { return e.msg }
+
+func (w *filterWriter) fail(msg string) {
+	w.err = &filterSyntaxError{msg}
+}
+
+func (w *filterWriter) feed(b byte) {
+	space := b == ' ' || b == '\t' || b == '\r' || b == '\n'
+	if w.format == formatUnknown {
+		switch {
+		case space:
+			return
+		case b == '[':
+			w.format = formatArray
+			w.depth = 1
+			w.write([]byte("["))
+			return
+		case b == '{':
+			w.format = formatStream
+		default:
+			w.fail("not a JSON array or NDJSON stream")
+			return
+		}
+	}
+	if w.closed {
+		if !space {
+			w.fail("data after the top-level array")
+		}
+		return
+	}
+
+	if w.inString {
+		switch {
+		case w.escaped:
+			w.escaped = false
+		case b == '\\':
+			w.escaped = true
+		case b == '"':
+			w.inString = false
+		}
+		w.record.WriteByte(b)
+		return
+	}
+
+	if w.format == formatArray && w.depth == 1 {
+		switch {
+		case b == ',':
+			w.endRecord()
+			return
+		case b == ']':
+			w.endRecord()
+			w.depth = 0
+			w.closed = true
+			if w.matched > 0 {
+				w.write([]byte("\n"))
+			}
+			w.write([]byte("]\n"))
+			return
+		case space && w.record.Len() == 0:
+			return
+		}
+	}
+	if w.format == formatStream && w.depth == 0 {
+		switch {
+		case space:
+			return
+		case b != '{' && b != '[':
+			w.fail("NDJSON record is not an object or array")
+			return
+		}
+	}
+
+	w.record.WriteByte(b)
+	switch b {
+	case '"':
+		w.inString = true
+	case '{', '[':
+		w.depth++
+	case '}', ']':
+		w.depth--
+		if w.format == formatStream && w.depth == 0 {
+			w.endRecord()
+		}
+	}
+}
+
+// endRecord evaluates the record collected so far and writes it on when it
+// matches.
+func (w *filterWriter) endRecord() {
+	record := bytes.TrimSpace(w.record.Bytes())
+	defer w.record.Reset()
+	if len(record) == 0 {
+		return
+	}
+	w.scanned++
+	ok, err := w.filter.match(record)
+	if err != nil {
+		w.fail(fmt.Sprintf("record %d: %v", w.scanned, err))
+		return
+	}
+	if !ok {
+		return
+	}
+	w.compact.Reset()
+	if err := json.Compact(&w.compact, record); err != nil {
+		w.fail(fmt.Sprintf("record %d: %v", w.scanned, err))
+		return
+	}
+	switch {
+	case w.format == formatStream:
+		w.compact.WriteByte('\n')
+	case w.matched > 0:
+		w.write([]byte(",\n"))
+	default:
+		w.write([]byte("\n"))
+	}
+	w.matched++
+	w.write(w.compact.Bytes())
+}
+
+func (w *filterWriter) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	if _, err := w.out.Write(p); err != nil {
+		w.err = err
+	}
+}
+
+// finish returns why the stream could not be filtered, or nil; a stream
+// that ends inside a record or array is truncated.
+func (w *filterWriter) finish() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.depth > 0 || w.record.Len() > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// addFiltered records the record counts of the file addFile just added and
+// prints them to notes, when -record-filter applied to it.
+func (stats *runStats) addFiltered(notes io.Writer, rel string, checks *outputChecks) {
+	scanned, matched, ok := checks.filtered()
+	if !ok {
+		return
+	}
+	stats.FilteredFiles++
+	stats.RecordsScanned += scanned
+	stats.RecordsMatched += matched
+	file := &stats.Files[len(stats.Files)-1]
+	file.RecordsScanned, file.RecordsMatched = &scanned, &matched
+	fmt.Fprintf(notes, "  %-40s kept %d of %d records\n", rel, matched, scanned)
+}
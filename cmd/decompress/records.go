@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"zstd-learning/internal/report"
+)
+
+type recordFormat int
+
+const (
+	formatUnknown recordFormat = iota
+	formatArray                // a single top-level JSON array
+	formatStream               // NDJSON or concatenated top-level values
+	formatNotJSON
+)
+
+// recordCounter counts top-level JSON records in a byte stream as it is
+// written, so records are counted in the same pass that decodes the file.
+// A stream starting with '[' counts the elements of that array; one starting
+// with '{' counts every top-level object or array, which covers NDJSON.
+// Anything else is not JSON and is left uncounted.
+type recordCounter struct {
+	format      recordFormat
+	depth       int
+	inString    bool
+	escaped     bool
+	expectValue bool
+	records     int64
+}
+
+func (c *recordCounter) Reset() {
+	*c = recordCounter{}
+}
+
+// Records returns the count and whether the stream looked like JSON.
+func (c *recordCounter) Records() (int64, bool) {
+	if c.format != formatArray && c.format != formatStream {
+		return 0, false
+	}
+	return c.records, true
+}
+
+func (c *recordCounter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		c.feed(b)
+	}
+	return len(p), nil
+}
+
+func (c *recordCounter) feed(b byte) {
+	switch c.format {
+	case formatNotJSON:
+		return
+	case formatUnknown:
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			return
+		case '[':
+			c.format = formatArray
+			c.depth = 1
+			c.expectValue = true
+			return
+		case '{':
+			c.format = formatStream
+		default:
+			c.format = formatNotJSON
+			return
+		}
+	}
+
+	if c.inString {
+		switch {
+		case c.escaped:
+			c.escaped = false
+		case b == '\\':
+			c.escaped = true
+		case b == '"':
+			c.inString = false
+		}
+		return
+	}
+
+	switch b {
+	case ' ', '\t', '\r', '\n':
+		return
+	case ',':
+		if c.format == formatArray && c.depth == 1 {
+			c.expectValue = true
+		}
+		return
+	}
+
+	if c.format == formatArray && c.depth == 1 && c.expectValue && b != ']' {
+		c.records++
+		c.expectValue = false
+	}
+	switch b {
+	case '"':
+		c.inString = true
+	case '{', '[':
+		if c.format == formatStream && c.depth == 0 {
+			c.records++
+		}
+		c.depth++
+	case '}', ']':
+		if c.depth > 0 {
+			c.depth--
+		}
+	}
+}
+
+// readExpectedCounts loads a manifest mapping file paths to record counts.
+// Keys may be the compressed path relative to -in or the output name.
+func readExpectedCounts(path string) (map[string]int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var expected map[string]int64
+	if err := json.Unmarshal(data, &expected); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return expected, nil
+}
+
+// checkExpectedCounts compares counted records with the manifest and returns
+// one message per mismatch, including manifest entries that were not counted.
+// counted holds each file under both its compressed and its output name.
+func checkExpectedCounts(expected, counted map[string]int64) []string {
+	var problems []string
+	for key, want := range expected {
+		got, ok := counted[filepath.ToSlash(key)]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s: expected %d records, file was not counted", key, want))
+		case got != want:
+			problems = append(problems, fmt.Sprintf("%s: expected %d records, got %d", key, want, got))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+type teeWriteCloser struct {
+	io.Writer
+	io.Closer
+}
+
+// addFile records one decoded file for the report and, when counter is set
+// and the output was JSON, its record count, which it returns. sharded is
+// the output's path under the output directory when -shard moved it, or
+// empty.
+func (stats *runStats) addFile(rel, sharded, suffix string, input, output int64, counter *recordCounter) *int64 {
+	file := report.File{
+		Path:        filepath.ToSlash(rel),
+		Output:      filepath.ToSlash(sharded),
+		InputBytes:  input,
+		OutputBytes: output,
+		Ratio:       report.Ratio(output, input),
+	}
+	if counter != nil {
+		if n, ok := counter.Records(); ok {
+			file.Records = &n
+			stats.RecordFiles++
+			stats.Records += n
+			if stats.Counted == nil {
+				stats.Counted = map[string]int64{}
+			}
+			stats.Counted[file.Path] = n
+			stats.Counted[filepath.ToSlash(outputName(rel, suffix))] = n
+		}
+	}
+	stats.Files = append(stats.Files, file)
+	return file.Records
+}
+
+func newRunReport(stats runStats, inputDir, outDir, runID string, shards int) report.Run {
+	if shards < 2 {
+		shards = 0
+	}
+	totals := stats.Totals()
+	totals.Records = stats.Records
+	return report.Run{
+		Tool:      "decompress",
+		CreatedAt: deterministic.Now().UTC().Format(time.RFC3339),
+		RunID:     runID,
+		InputDir:  inputDir,
+		OutputDir: outDir,
+		Shards:    shards,
+		Totals:    totals,
+		Files:     stats.Files,
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+
+	"zstd-learning/internal/crypt"
+	"zstd-learning/internal/frame"
+)
+
+// resumeAction is what -resume decided for one input.
+type resumeAction int
+
+const (
+	resumeDecode   resumeAction = iota // no output yet
+	resumeSkip                         // output is complete
+	resumeRedecode                     // output is partial or cannot be checked
+)
+
+// checkResume compares an existing output of inPath against the
+// decompressed size its frame headers declare, which compress always
+// records. When any data frame leaves the size out there is nothing to check
+// against, so the output is treated as suspect and decoded again.
+func checkResume(inPath, outPath string, keys crypt.Keys) (resumeAction, error) {
+	info, err := os.Stat(outPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return resumeDecode, nil
+	}
+	if err != nil {
+		return resumeDecode, err
+	}
+	if !info.Mode().IsRegular() {
+		return resumeRedecode, nil
+	}
+
+	expected, ok, err := declaredSize(inPath, keys)
+	if err != nil {
+		return resumeDecode, err
+	}
+	if !ok || info.Size() != expected {
+		return resumeRedecode, nil
+	}
+	return resumeSkip, nil
+}
+
+// declaredSize sums the content sizes declared by the data frames of path.
+// ok is false when a data frame does not declare its size or the file has
+// no data frames. Encrypted inputs are decrypted to reach their frame
+// headers.
+func declaredSize(path string, keys crypt.Keys) (int64, bool, error) {
+	file, err := openInput(path, keys)
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	frames, err := frame.ScanAll(file)
+	if err != nil {
+		return 0, false, err
+	}
+	var total int64
+	data := 0
+	for _, info := range frames {
+		if info.Skippable {
+			continue
+		}
+		if !info.HasContentSize() {
+			return 0, false, nil
+		}
+		total += info.ContentSize
+		data++
+	}
+	return total, data > 0, nil
+}
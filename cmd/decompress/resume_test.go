@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestResume decodes into an output directory left by an interrupted run:
+// the complete output is kept, the truncated one is decoded again, as is
+// one whose frame does not declare a size to check it against.
+func TestResume(t *testing.T) {
+	// Large enough that the encoder flushes before Close, so the unsized
+	// frame really leaves the size out.
+	data := strings.Repeat("resumable line of output\n", 20000)
+	in := t.TempDir()
+	writeCompressed(t, in, map[string]string{"complete.txt.zst": data, "partial.txt.zst": data, "missing.txt.zst": data})
+	if err := os.WriteFile(filepath.Join(in, "unsized.txt.zst"), encodeSized(t, []byte(data), -1), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir()
+	// Same size as the real output but different bytes, so a skip shows.
+	kept := strings.Repeat("x", len(data))
+	for name, contents := range map[string]string{
+		"complete.txt": kept,
+		"partial.txt":  data[:len(data)/3],
+		"unsized.txt":  kept,
+	} {
+		if err := os.WriteFile(filepath.Join(out, name), []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	url, _ := fakeGateway(t)
+	code, output := run(t, "-in", in, "-out", out, "-pushgateway", url, "-resume")
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, output)
+	}
+	want := map[string]string{"complete.txt": kept, "partial.txt": data, "unsized.txt": data, "missing.txt": data}
+	got := readTree(t, out)
+	for name, contents := range want {
+		if got[name] != contents {
+			t.Errorf("%s: %d bytes starting %.1q, want %d starting %.1q", name, len(got[name]), got[name], len(contents), contents)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("wrote %d outputs, want %d", len(got), len(want))
+	}
+	if !strings.Contains(output, "resume: 1 complete outputs skipped, 2 partial or unverifiable outputs decoded again") {
+		t.Errorf("summary does not count the resumed outputs:\n%s", output)
+	}
+}
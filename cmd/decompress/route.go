@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Content types -route-by-type tells apart.
+const (
+	typeJSON   = "json"
+	typeNDJSON = "ndjson"
+	typeCSV    = "csv"
+	typeOther  = "other"
+)
+
+// sniffBytes is how much of the start of each output -route-by-type looks
+// at; the rest is written without being kept.
+const sniffBytes = 8 << 10
+
+// csvSniffLines is how many complete lines the CSV heuristic parses.
+const csvSniffLines = 10
+
+// router places each output of -route-by-type under the subdirectory of
+// -out its sniffed content type maps to.
+type router struct {
+	Dirs map[string]string
+}
+
+// newRouter returns the default routing, NDJSON going with JSON, with the
+// -route-config file, a JSON object of type to subdirectory such as
+// {"ndjson": "ndjson", "other": "misc"}, laid over it.
+func newRouter(configPath string) (*router, error) {
+	r := &router{Dirs: map[string]string{
+		typeJSON:   "json",
+		typeNDJSON: "json",
+		typeCSV:    "csv",
+		typeOther:  "other",
+	}}
+	if configPath == "" {
+		return r, nil
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var dirs map[string]string
+	if err := json.Unmarshal(data, &dirs); err != nil {
+		return nil, fmt.Errorf("%s: %w", configPath, err)
+	}
+	for kind, dir := range dirs {
+		if _, ok := r.Dirs[kind]; !ok {
+			return nil, fmt.Errorf("%s: unknown content type %q (expected json, ndjson, csv or other)", configPath, kind)
+		}
+		if dir == "" || !filepath.IsLocal(filepath.FromSlash(dir)) {
+			return nil, fmt.Errorf("%s: subdirectory %q for %s must be a relative path inside -out", configPath, dir, kind)
+		}
+		r.Dirs[kind] = filepath.FromSlash(dir)
+	}
+	return r, nil
+}
+
+// tempPath is where the output for outPath is decoded before its type is
+// known: a hidden file directly under outDir, outside every routed
+// subdirectory.
+func (r *router) tempPath(outDir, outPath string) string {
+	return filepath.Join(outDir, "."+filepath.Base(outPath)+".route"+atomicTempSuffix)
+}
+
+// commit moves the decoded tmpPath to outPath's place under the
+// subdirectory of kind and returns where it went. With atomic it is synced
+// first, as -atomic does for unrouted outputs.
+func (r *router) commit(tmpPath, outDir, outPath, kind string, atomic bool) (string, error) {
+	rel, err := filepath.Rel(outDir, outPath)
+	if err != nil {
+		return "", err
+	}
+	routed := filepath.Join(outDir, r.Dirs[kind], rel)
+	if err := os.MkdirAll(filepath.Dir(routed), 0o755); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	if atomic {
+		return routed, commitOutput(tmpPath, routed)
+	}
+	if err := os.Rename(tmpPath, routed); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return routed, nil
+}
+
+// sniffer keeps the first sniffBytes written to it and counts the rest.
+type sniffer struct {
+	head    []byte
+	written int64
+}
+
+func (s *sniffer) Write(p []byte) (int, error) {
+	if room := sniffBytes - len(s.head); room > 0 {
+		s.head = append(s.head, p[:min(room, len(p))]...)
+	}
+	s.written += int64(len(p))
+	return len(p), nil
+}
+
+func (s *sniffer) Reset() {
+	s.head, s.written = s.head[:0], 0
+}
+
+// Type sniffs what was written.
+func (s *sniffer) Type() string {
+	return sniffType(s.head, s.written <= int64(len(s.head)))
+}
+
+// sniffType guesses the content type from head, the first bytes of an
+// output, whole when it is all of it. A top-level array is JSON; an object
+// is NDJSON when another value starts on a following line, and JSON
+// otherwise, including an object too large to end within head. Anything
+// else is CSV when its first lines parse as CSV with the same number of
+// fields, at least two, and a header without empty names, and other when
+// not.
+func sniffType(head []byte, whole bool) string {
+	data := bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) == 0 {
+		return typeOther
+	}
+	switch trimmed[0] {
+	case '[':
+		return typeJSON
+	case '{':
+		dec := json.NewDecoder(bytes.NewReader(trimmed))
+		var first json.RawMessage
+		if err := dec.Decode(&first); err != nil {
+			return typeJSON
+		}
+		rest := bytes.TrimLeft(trimmed[dec.InputOffset():], " \t\r")
+		if len(rest) > 0 && rest[0] == '\n' {
+			if next := bytes.TrimLeft(rest, " \t\r\n"); len(next) > 0 && (next[0] == '{' || next[0] == '[') {
+				return typeNDJSON
+			}
+		}
+		return typeJSON
+	}
+	if looksCSV(data, whole) {
+		return typeCSV
+	}
+	return typeOther
+}
+
+// looksCSV parses the complete lines of head, up to csvSniffLines, as
+// CSV. When head is not the whole output, its last line may be cut off
+// and is left out. When the lines parsed are not all of it, a quoted field
+// that runs past them does not count against it as long as two records
+// parsed before it.
+func looksCSV(head []byte, whole bool) bool {
+	if !whole {
+		end := bytes.LastIndexByte(head, '\n')
+		if end < 0 {
+			return false
+		}
+		head = head[:end+1]
+	}
+	if bytes.IndexByte(head, 0) >= 0 || !utf8.Valid(head) {
+		return false
+	}
+	lines := bytes.SplitAfterN(head, []byte("\n"), csvSniffLines+1)
+	cut := !whole
+	if len(lines) > csvSniffLines {
+		lines, cut = lines[:csvSniffLines], true
+	}
+	reader := csv.NewReader(bytes.NewReader(bytes.Join(lines, nil)))
+	header, err := reader.Read()
+	if err != nil || len(header) < 2 {
+		return false
+	}
+	for _, name := range header {
+		if strings.TrimSpace(name) == "" {
+			return false
+		}
+	}
+	records := 1
+	for {
+		_, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return true
+		}
+		if err != nil {
+			return cut && records >= 2 && !errors.Is(err, csv.ErrFieldCount)
+		}
+		records++
+	}
+}
+
+// recordRoute notes on the file just added where its output was routed,
+// relative to outDir, and its content type.
+func (stats *runStats) recordRoute(outDir, routed, kind string) {
+	file := &stats.Files[len(stats.Files)-1]
+	if rel, err := filepath.Rel(outDir, routed); err == nil {
+		file.Output = filepath.ToSlash(rel)
+	}
+	file.Type = kind
+	if stats.Routed == nil {
+		stats.Routed = map[string]int{}
+	}
+	stats.Routed[kind]++
+}
+
+// formatRouted renders the -route-by-type counts, e.g.
+// "csv 3 (csv/), json 12 (json/)".
+func formatRouted(routed map[string]int, r *router) string {
+	kinds := make([]string, 0, len(routed))
+	for kind := range routed {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	parts := make([]string, len(kinds))
+	for i, kind := range kinds {
+		parts[i] = fmt.Sprintf("%s %d (%s/)", kind, routed[kind], filepath.ToSlash(r.Dirs[kind]))
+	}
+	return strings.Join(parts, ", ")
+}
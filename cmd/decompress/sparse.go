@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// sparseBlock is the granularity at which zero runs become holes. It
+// matches the block size of common filesystems, so skipped runs map onto
+// whole unallocated blocks.
+const sparseBlock = 4096
+
+var zeroBlock = make([]byte, sparseBlock)
+
+// sparseFile writes to f, seeking over zero blocks instead of writing them
+// so the filesystem leaves holes. Close must be called to give the file its
+// full logical size when it ends in a hole.
+type sparseFile struct {
+	f    *os.File
+	size int64
+	hole int64
+}
+
+func newSparseFile(f *os.File) *sparseFile {
+	return &sparseFile{f: f}
+}
+
+func (s *sparseFile) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Split on block boundaries of the output offset, so holes stay
+		// block-aligned regardless of how the decoder sizes its writes.
+		n := sparseBlock - int((s.size+s.hole)%sparseBlock)
+		if n > len(p) {
+			n = len(p)
+		}
+		seg := p[:n]
+		if bytes.Equal(seg, zeroBlock[:n]) {
+			s.hole += int64(n)
+			written += n
+			p = p[n:]
+			continue
+		}
+		if err := s.skipHole(); err != nil {
+			return written, err
+		}
+		m, err := s.f.Write(seg)
+		s.size += int64(m)
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (s *sparseFile) skipHole() error {
+	if s.hole == 0 {
+		return nil
+	}
+	if _, err := s.f.Seek(s.hole, io.SeekCurrent); err != nil {
+		return err
+	}
+	s.size += s.hole
+	s.hole = 0
+	return nil
+}
+
+// Close extends the file over a trailing hole, which a seek alone would
+// leave out of the file's length, and closes it.
+func (s *sparseFile) Close() error {
+	if s.hole > 0 {
+		if err := s.f.Truncate(s.size + s.hole); err != nil {
+			s.f.Close()
+			return err
+		}
+		s.size += s.hole
+		s.hole = 0
+	}
+	return s.f.Close()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSparse writes the chunks through a sparseFile at path and closes it.
+func writeSparse(t *testing.T, path string, chunks ...[]byte) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSparseFile(f)
+	for _, chunk := range chunks {
+		if n, err := s.Write(chunk); err != nil || n != len(chunk) {
+			t.Fatalf("Write of %d bytes: %d, %v", len(chunk), n, err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSparseFileContents(t *testing.T) {
+	zeros := func(n int) []byte { return make([]byte, n) }
+	data := func(n int) []byte { return bytes.Repeat([]byte("d"), n) }
+	tests := []struct {
+		name   string
+		chunks [][]byte
+	}{
+		{"empty", nil},
+		{"data only", [][]byte{data(10000)}},
+		{"zeros only", [][]byte{zeros(3 * sparseBlock)}},
+		{"leading hole", [][]byte{zeros(2 * sparseBlock), data(100)}},
+		{"trailing hole", [][]byte{data(100), zeros(2 * sparseBlock)}},
+		{"trailing partial block of zeros", [][]byte{data(sparseBlock), zeros(100)}},
+		{"hole in the middle", [][]byte{data(sparseBlock), zeros(4 * sparseBlock), data(sparseBlock)}},
+		// Zeros that straddle a block boundary are split at it.
+		{"unaligned zeros", [][]byte{data(100), zeros(sparseBlock), data(100)}},
+		{"small writes", [][]byte{data(1000), zeros(1000), zeros(3096), zeros(5000), data(7), zeros(9000)}},
+		{"one write across blocks", [][]byte{append(append(data(5000), zeros(3*sparseBlock)...), data(10)...)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "out")
+			writeSparse(t, path, tt.chunks...)
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := bytes.Join(tt.chunks, nil); !bytes.Equal(got, want) {
+				t.Errorf("file has %d bytes that differ from the %d written", len(got), len(want))
+			}
+		})
+	}
+}
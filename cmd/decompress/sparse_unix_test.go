@@ -0,0 +1,60 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// allocated returns the bytes the filesystem holds for the file at path.
+func allocated(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestSparseFileLeavesHoles(t *testing.T) {
+	dir := t.TempDir()
+	const logical = 4 << 20
+	data := bytes.Repeat([]byte("d"), sparseBlock)
+
+	dense := filepath.Join(dir, "dense")
+	if err := os.WriteFile(dense, bytes.Repeat([]byte("d"), logical), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if allocated(t, dense) < logical/2 {
+		t.Skip("the filesystem does not allocate written blocks (compressed or deduplicated?)")
+	}
+
+	tests := []struct {
+		name   string
+		chunks [][]byte
+	}{
+		{"hole in the middle", [][]byte{data, make([]byte, logical-2*sparseBlock), data}},
+		// The file ends in a hole, which Close covers with Truncate.
+		{"trailing hole", [][]byte{data, make([]byte, logical-sparseBlock)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			writeSparse(t, path, tt.chunks...)
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != logical {
+				t.Errorf("size %d, want %d", info.Size(), logical)
+			}
+			if on := allocated(t, path); on >= logical/4 {
+				t.Errorf("%d bytes on disk for a %d-byte file that is mostly holes", on, logical)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package main
+
+import (
+	"maps"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestSpecialFiles(t *testing.T) {
+	in := t.TempDir()
+	writeCompressed(t, in, map[string]string{"a.txt.zst": "a"})
+	if err := syscall.Mkfifo(filepath.Join(in, "pipe.txt.zst"), 0o644); err != nil {
+		t.Skipf("cannot create a FIFO: %v", err)
+	}
+	url, _ := fakeGateway(t)
+
+	out := t.TempDir()
+	code, output := run(t, "-in", in, "-out", out, "-pushgateway", url)
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, output)
+	}
+	if got := readTree(t, out); !maps.Equal(got, map[string]string{"a.txt": "a"}) {
+		t.Errorf("wrote %q, want only a.txt", got)
+	}
+	if !strings.Contains(output, "skipped 1 special files") {
+		t.Errorf("the FIFO is not reported:\n%s", output)
+	}
+
+	code, output = run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url, "-special-files", "error")
+	if code != 1 || !strings.Contains(output, "pipe.txt.zst is a FIFO, not a regular file") {
+		t.Errorf("-special-files error: exit %d, output:\n%s", code, output)
+	}
+}
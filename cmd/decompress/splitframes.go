@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+
+	"zstd-learning/internal/frame"
+)
+
+// framePart is one output of split-frames: a data frame together with the
+// skippable frames around it, as bytes [Offset, Offset+Length) of the input.
+type framePart struct {
+	Offset      int64
+	Length      int64
+	Frames      int
+	Skippable   int
+	ContentSize int64 // -1 when the data frame does not declare it
+}
+
+// frameSplit is the result of walking a file: its parts and, when the walk
+// stopped at bytes that are not a whole frame, where they start and why.
+type frameSplit struct {
+	Parts         []framePart
+	Size          int64
+	TrailerOffset int64 // -1 without trailing data
+	TrailerErr    error
+}
+
+// runSplitFrames splits a file holding several concatenated outputs back
+// into one file per output.
+func runSplitFrames(args []string) {
+	fs := flag.NewFlagSet("split-frames", flag.ExitOnError)
+	inPath := fs.String("in", "", "the .zst file to split (required)")
+	outDir := fs.String("out", "", "directory for the parts (default: the directory of -in)")
+	suffix := fs.String("suffix", ".zst", "suffix stripped from the input name before numbering the parts, and appended after")
+	dryRun := fs.Bool("dry-run", false, "only list the detected frame boundaries; write nothing")
+	fs.Parse(args)
+
+	if *inPath == "" || fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: decompress split-frames -in file.zst [-out dir] [-dry-run]")
+		exit(1)
+	}
+	if *outDir == "" {
+		*outDir = filepath.Dir(*inPath)
+	}
+
+	split, err := scanFrameParts(*inPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to scan %s: %v\n", *inPath, err)
+		exit(1)
+	}
+	if len(split.Parts) == 0 {
+		if split.TrailerErr != nil {
+			fmt.Fprintf(os.Stderr, "%s holds no valid zstd frame: %v\n", *inPath, split.TrailerErr)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s is empty\n", *inPath)
+		}
+		exit(1)
+	}
+
+	base := filepath.Base(*inPath)
+	if *suffix != "" && hasInputSuffix(base, *suffix) {
+		base = base[:len(base)-len(*suffix)]
+	}
+	width := max(3, len(strconv.Itoa(len(split.Parts))))
+	partName := func(i int) string {
+		return fmt.Sprintf("%s.part%0*d%s", base, width, i+1, *suffix)
+	}
+	trailerName := base + ".trailer"
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "PART\tBYTES\tLENGTH\tFRAMES\tCONTENT SIZE\tFILE")
+	for i, part := range split.Parts {
+		contentSize := "unknown"
+		if part.ContentSize >= 0 {
+			contentSize = strconv.FormatInt(part.ContentSize, 10)
+		}
+		frames := strconv.Itoa(part.Frames)
+		if part.Skippable > 0 {
+			frames += fmt.Sprintf(" (+%d skippable)", part.Skippable)
+		}
+		fmt.Fprintf(writer, "%d\t%d-%d\t%d\t%s\t%s\t%s\n", i+1, part.Offset, part.Offset+part.Length, part.Length, frames, contentSize, partName(i))
+	}
+	if split.TrailerOffset >= 0 {
+		fmt.Fprintf(writer, "trailer\t%d-%d\t%d\t-\t-\t%s\n", split.TrailerOffset, split.Size, split.Size-split.TrailerOffset, trailerName)
+	}
+	writer.Flush()
+	if split.TrailerOffset >= 0 {
+		fmt.Fprintf(os.Stderr, "warning: %d bytes after the last valid frame are not a whole frame: %v\n", split.Size-split.TrailerOffset, split.TrailerErr)
+	}
+	if *dryRun {
+		return
+	}
+
+	if err := os.MkdirAll(*outDir, 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create output directory: %v\n", err)
+		exit(1)
+	}
+	in, err := os.Open(*inPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open %s: %v\n", *inPath, err)
+		exit(1)
+	}
+	defer in.Close()
+	for i, part := range split.Parts {
+		if err := copyRange(in, part.Offset, part.Length, filepath.Join(*outDir, partName(i))); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write part %d: %v\n", i+1, err)
+			exit(1)
+		}
+	}
+	if split.TrailerOffset >= 0 {
+		if err := copyRange(in, split.TrailerOffset, split.Size-split.TrailerOffset, filepath.Join(*outDir, trailerName)); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write trailer: %v\n", err)
+			exit(1)
+		}
+	}
+	fmt.Printf("wrote %d parts to %s\n", len(split.Parts), *outDir)
+}
+
+// scanFrameParts walks the frames of path by their headers and block
+// lengths, so magic numbers inside compressed data are never mistaken for
+// boundaries. Every data frame starts a new part; a skippable frame, such
+// as a bundle index, belongs to the data frame before it, or to the first
+// one when it leads the file. Walking stops at the first bytes that do not
+// parse as a whole frame, which become the trailer.
+func scanFrameParts(path string) (frameSplit, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return frameSplit{}, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return frameSplit{}, err
+	}
+
+	split := frameSplit{Size: stat.Size(), TrailerOffset: -1}
+	scanner := frame.NewScanner(file)
+	var leading framePart
+	for {
+		info, err := scanner.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			split.TrailerOffset, split.TrailerErr = scanner.Offset(), err
+			break
+		}
+		switch {
+		case info.Skippable && len(split.Parts) == 0:
+			if leading.Skippable == 0 {
+				leading.Offset = info.Offset
+			}
+			leading.Length += info.Length
+			leading.Skippable++
+		case info.Skippable:
+			last := &split.Parts[len(split.Parts)-1]
+			last.Length += info.Length
+			last.Skippable++
+		default:
+			part := framePart{Offset: info.Offset, Length: info.Length, Frames: 1, ContentSize: info.ContentSize}
+			if len(split.Parts) == 0 && leading.Skippable > 0 {
+				part.Offset, part.Length = leading.Offset, leading.Length+info.Length
+				part.Skippable = leading.Skippable
+			}
+			split.Parts = append(split.Parts, part)
+		}
+	}
+	if len(split.Parts) == 0 && leading.Skippable > 0 {
+		// Only skippable frames: keep them as one part rather than losing them.
+		split.Parts = append(split.Parts, framePart{Offset: leading.Offset, Length: leading.Length, Skippable: leading.Skippable, ContentSize: -1})
+	}
+	return split, nil
+}
+
+// copyRange writes length bytes of in, starting at offset, to outPath.
+func copyRange(in *os.File, offset, length int64, outPath string) error {
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, io.NewSectionReader(in, offset, length)); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
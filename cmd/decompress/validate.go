@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// jsonValidator checks that the bytes written to it are well-formed JSON:
+// one or more top-level values, so both single documents and NDJSON pass.
+// It tokenizes in a goroutine fed through a pipe, so memory use does not
+// grow with the size of the output.
+type jsonValidator struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func newJSONValidator() *jsonValidator {
+	pr, pw := io.Pipe()
+	v := &jsonValidator{pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := validateJSON(pr)
+		// Keep accepting writes after a syntax error so the decode, and
+		// with it the output file, still completes.
+		io.Copy(io.Discard, pr)
+		v.done <- err
+	}()
+	return v
+}
+
+func (v *jsonValidator) Write(p []byte) (int, error) {
+	return v.pw.Write(p)
+}
+
+// Close ends the stream and returns why it is not valid JSON, or nil.
+func (v *jsonValidator) Close() error {
+	v.pw.Close()
+	return <-v.done
+}
+
+func validateJSON(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	depth := 0
+	values := 0
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			// Token reports a clean EOF even inside an unclosed array or
+			// object, so truncation has to be caught here.
+			if depth > 0 {
+				return fmt.Errorf("at offset %d: %w", dec.InputOffset(), io.ErrUnexpectedEOF)
+			}
+			if values == 0 {
+				return errors.New("no JSON value")
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("at offset %d: %w", dec.InputOffset(), err)
+		}
+		switch tok {
+		case json.Delim('['), json.Delim('{'):
+			depth++
+			continue
+		case json.Delim(']'), json.Delim('}'):
+			depth--
+		}
+		if depth == 0 {
+			values++
+		}
+	}
+}
+
+// outputChecks are the optional consumers of a file's decoded bytes: the
+// -count-records counter, the -validate json validator, the
+// -route-by-type sniffer and the -record-filter filter, which unlike the
+// others sits between the decoder and the output.
+type outputChecks struct {
+	counter   *recordCounter
+	validator *jsonValidator
+	sniff     *sniffer
+	filter    *recordFilter
+	filtering *filterWriter
+}
+
+// newOutputChecks returns the checks for the output at outPath, which
+// decides whether -record-filter applies.
+func newOutputChecks(opts decompressOptions, outPath string) *outputChecks {
+	checks := &outputChecks{}
+	if opts.RecordFilter != nil && filterable(outPath) {
+		checks.filter = opts.RecordFilter
+	}
+	if opts.CountRecords {
+		checks.counter = &recordCounter{}
+	}
+	if opts.ValidateJSON {
+		checks.validator = newJSONValidator()
+	}
+	if opts.Route != nil {
+		checks.sniff = &sniffer{}
+	}
+	return checks
+}
+
+// tee returns a writer that copies to out, through the record filter when
+// it applies, and to every enabled check, which see the unfiltered bytes.
+func (c *outputChecks) tee(out io.Writer) io.Writer {
+	if c.filter != nil {
+		c.filtering = newFilterWriter(c.filter, out)
+		out = c.filtering
+	}
+	writers := []io.Writer{out}
+	if c.counter != nil {
+		writers = append(writers, c.counter)
+	}
+	if c.validator != nil {
+		writers = append(writers, c.validator)
+	}
+	if c.sniff != nil {
+		writers = append(writers, c.sniff)
+	}
+	if len(writers) == 1 {
+		return out
+	}
+	return io.MultiWriter(writers...)
+}
+
+// reset discards what the checks have seen, before a retried decode.
+func (c *outputChecks) reset() {
+	if c.counter != nil {
+		c.counter.Reset()
+	}
+	if c.validator != nil {
+		c.validator.Close()
+		c.validator = newJSONValidator()
+	}
+	if c.sniff != nil {
+		c.sniff.Reset()
+	}
+}
+
+// finish stops the validator and returns its verdict, or why the record
+// filter could not parse the output. It must be called once per file,
+// whether or not the decode succeeded.
+func (c *outputChecks) finish() error {
+	var err error
+	if c.validator != nil {
+		err = c.validator.Close()
+		c.validator = nil
+	}
+	if c.filtering != nil && err == nil {
+		if filterErr := c.filtering.finish(); filterErr != nil {
+			err = fmt.Errorf("-record-filter: %w", filterErr)
+		}
+	}
+	return err
+}
+
+// filtered returns the records the filter scanned and kept, and false when
+// it did not apply.
+func (c *outputChecks) filtered() (scanned, matched int64, ok bool) {
+	if c.filtering == nil {
+		return 0, 0, false
+	}
+	return c.filtering.scanned, c.filtering.matched, true
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateJSON(t *testing.T) {
+	tests := []struct {
+		name, data string
+		valid      bool
+	}{
+		{"document", `{"a":[1,2,{"b":null}]}`, true},
+		{"ndjson", "{\"a\":1}\n{\"a\":2}\n", true},
+		{"array", " [1, \"two\", 3.0] \n", true},
+		{"scalars", "1 2 \"three\"", true},
+		{"truncated object", `{"a":[1,2`, false},
+		{"trailing comma", `{"a":1,}`, false},
+		{"garbage", "\x00\x9f\x92binary", false},
+		{"text", "hello world", false},
+		{"empty", "", false},
+		{"whitespace", " \n\t", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateJSON(strings.NewReader(tt.data)); (err == nil) != tt.valid {
+				t.Errorf("validateJSON(%q) = %v, want valid %v", tt.data, err, tt.valid)
+			}
+			// The validator sees the output in whatever pieces the decoder
+			// writes, and keeps taking them after an error.
+			v := newJSONValidator()
+			for i := 0; i < len(tt.data); i += 3 {
+				if _, err := v.Write([]byte(tt.data[i:min(i+3, len(tt.data))])); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := v.Close(); (err == nil) != tt.valid {
+				t.Errorf("jsonValidator on %q: %v, want valid %v", tt.data, err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestValidateJSONFailsTheFile(t *testing.T) {
+	in := t.TempDir()
+	writeCompressed(t, in, map[string]string{
+		"good.json.zst": "{\"id\":1}\n{\"id\":2}\n",
+		"bad.json.zst":  "{\"id\":1}\n\x00\x01 not json\n",
+	})
+	url, pushed := fakeGateway(t)
+
+	out := t.TempDir()
+	code, output := run(t, "-in", in, "-out", out, "-pushgateway", url, "-validate", "json")
+	if code != 1 {
+		t.Fatalf("exit %d, want 1, output:\n%s", code, output)
+	}
+	for _, want := range []string{"bad.json.zst: invalid JSON", "1 files decoded to invalid JSON"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output lacks %q:\n%s", want, output)
+		}
+	}
+	if strings.Contains(output, "good.json.zst: invalid JSON") {
+		t.Errorf("the valid file was reported:\n%s", output)
+	}
+	if got, ok := pushed()["decompress_invalid_json"]; !ok || got != 1 {
+		t.Errorf("pushed decompress_invalid_json %v (present %v), want 1", got, ok)
+	}
+	// Outputs are kept for inspection.
+	if got := readTree(t, out); len(got) != 2 {
+		t.Errorf("wrote %q, want both outputs", got)
+	}
+
+	if code, output := run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url); code != 0 {
+		t.Errorf("without -validate: exit %d, output:\n%s", code, output)
+	}
+}
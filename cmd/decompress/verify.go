@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+
+	"zstd-learning/internal/console"
+	"zstd-learning/internal/dictfile"
+	"zstd-learning/pkg/progress"
+)
+
+// sampleOptions selects the files checked by -test.
+type sampleOptions struct {
+	Fraction float64
+	Seed     int64
+	Stratify bool
+}
+
+// testResult is the outcome of a -test run. Stats counts only the sampled
+// files; FilesTotal is the size of the corpus they were drawn from.
+type testResult struct {
+	Stats      runStats
+	FilesTotal int
+	Failures   []string
+}
+
+// selectSample returns a reproducible random subset of paths. With stratify,
+// the fraction is applied per directory and every directory contributes at
+// least one file, so small subtrees are not missed by chance. The result is
+// sorted so the decode order does not depend on the seed.
+func selectSample(paths []string, opts sampleOptions) []string {
+	if opts.Fraction >= 1 {
+		return paths
+	}
+	rng := rand.New(rand.NewSource(opts.Seed))
+
+	groups := [][]string{paths}
+	if opts.Stratify {
+		byDir := map[string][]string{}
+		var dirs []string
+		for _, path := range paths {
+			dir := filepath.Dir(path)
+			if _, ok := byDir[dir]; !ok {
+				dirs = append(dirs, dir)
+			}
+			byDir[dir] = append(byDir[dir], path)
+		}
+		sort.Strings(dirs)
+		groups = groups[:0]
+		for _, dir := range dirs {
+			groups = append(groups, byDir[dir])
+		}
+	}
+
+	var sample []string
+	for _, group := range groups {
+		n := int(math.Ceil(opts.Fraction * float64(len(group))))
+		if n < 1 {
+			n = 1
+		}
+		picked := append([]string(nil), group...)
+		rng.Shuffle(len(picked), func(i, j int) {
+			picked[i], picked[j] = picked[j], picked[i]
+		})
+		sample = append(sample, picked[:n]...)
+	}
+	sort.Strings(sample)
+	return sample
+}
+
+// testOutcome is the result of test-decoding one file.
+type testOutcome struct {
+	inputSize int64
+	written   int64
+	// retriedWith is the alternate dictionary the file only decoded with,
+	// or nil.
+	retriedWith *dictfile.Dict
+	retryErr    error
+	invalid     bool
+	counter     *recordCounter
+	// frameDicts counts the file's frames by dictionary ID, with
+	// -dict-report.
+	frameDicts map[uint32]int64
+	err        error
+}
+
+// testFiles decodes every path to io.Discard, spread over workers
+// goroutines that each own their decoders. Unlike decompressFiles it keeps
+// going after a failure so the whole sample is checked. Outcomes are
+// gathered per file and tallied in path order afterwards, so the results do
+// not depend on which worker finished first.
+func testFiles(paths []string, baseDir string, opts decompressOptions, workers int) (runStats, []string, error) {
+	stats := runStats{}
+
+	rels := make([]string, len(paths))
+	for i, path := range paths {
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return stats, nil, err
+		}
+		rels[i] = rel
+	}
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+
+	// Each worker takes a decoder from the shared pool and resets it for
+	// every file; only the multi-threaded frame decoders are its own.
+	pool, err := decoderPool(opts)
+	if err != nil {
+		return stats, nil, err
+	}
+	var frameDecoders []*zstd.Decoder
+	defer func() {
+		for _, decoder := range frameDecoders {
+			decoder.Close()
+		}
+	}()
+
+	outcomes := make([]testOutcome, len(paths))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		var frameDecoder *zstd.Decoder
+		if opts.FrameWorkers > 1 {
+			frameDecoder, err = zstd.NewReader(nil, append(decoderOptions(opts), zstd.WithDecoderConcurrency(opts.FrameWorkers))...)
+			if err != nil {
+				close(jobs)
+				wg.Wait()
+				return stats, nil, err
+			}
+			frameDecoders = append(frameDecoders, frameDecoder)
+		}
+		decoder, err := pool.Get(nil)
+		if err != nil {
+			close(jobs)
+			wg.Wait()
+			return stats, nil, err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer pool.Put(decoder)
+			for i := range jobs {
+				// The frame path opens the input a second time.
+				opts.OpenFiles.Acquire(2)
+				outcomes[i] = testFile(decoder, frameDecoder, paths[i], opts)
+				opts.OpenFiles.Release(2)
+				status := progress.StatusOK
+				if outcomes[i].err != nil || outcomes[i].invalid {
+					status = progress.StatusFailed
+				}
+				opts.Progress.File(filepath.ToSlash(rels[i]), outcomes[i].inputSize, outcomes[i].written, status)
+			}
+		}()
+	}
+	for i := range paths {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var failures []string
+	for i, outcome := range outcomes {
+		rel, path := rels[i], paths[i]
+		if outcome.retriedWith != nil {
+			fmt.Fprintf(opts.Warnings, "  %s: decoded with alternate dictionary %s (id %d) after: %v\n", rel, outcome.retriedWith.Path, outcome.retriedWith.ID, outcome.retryErr)
+			stats.DictRetries++
+		}
+		if outcome.invalid {
+			stats.InvalidJSON = append(stats.InvalidJSON, rel)
+		}
+		if opts.DictReport {
+			if stats.FramesByDict == nil {
+				stats.FramesByDict = map[uint32]int64{}
+			}
+			for id, n := range outcome.frameDicts {
+				stats.FramesByDict[id] += n
+			}
+		}
+		stats.Add(outcome.inputSize, outcome.written)
+		if outcome.err != nil {
+			stats.FilesFailed++
+			failures = append(failures, fmt.Sprintf("%s: %v", path, outcome.err))
+			if opts.Verbose {
+				fmt.Fprintf(opts.Notes, "  %-40s %s %v\n", rel, opts.Printer.Red("FAIL"), outcome.err)
+			}
+			continue
+		}
+		records := stats.addFile(rel, "", opts.Suffix, outcome.inputSize, outcome.written, outcome.counter)
+		if opts.Verbose {
+			note := ""
+			if records != nil {
+				note = fmt.Sprintf("  %d records", *records)
+			}
+			fmt.Fprintf(opts.Notes, "  %-40s %10d bytes  %s%s\n", rel, outcome.written, opts.Printer.Green("ok"), note)
+		}
+	}
+
+	return stats, failures, nil
+}
+
+// testFile decodes path to io.Discard with the calling worker's decoders,
+// retrying with the loaded dictionaries as decompressFiles does.
+func testFile(decoder, frameDecoder *zstd.Decoder, path string, opts decompressOptions) testOutcome {
+	var outcome testOutcome
+	checks := newOutputChecks(opts, "")
+	written, err := decodeTo(decoder, frameDecoder, opts.FrameWorkers, path, opts.Keys, checks.tee(io.Discard))
+	if err != nil && opts.RetryDicts && len(opts.Dicts) > 0 && retryable(err) {
+		dict, retried, retryErr := retryWithDicts(opts.Dicts, path, opts.Keys, func() (io.WriteCloser, error) {
+			checks.reset()
+			return nopWriteCloser{checks.tee(io.Discard)}, nil
+		})
+		if retryErr == nil {
+			outcome.retriedWith, outcome.retryErr = &dict, err
+			written, err = retried, nil
+		}
+	}
+	if invalid := checks.finish(); err == nil && invalid != nil {
+		outcome.invalid = true
+		err = fmt.Errorf("invalid JSON: %w", invalid)
+	}
+	if opts.DictReport && err == nil {
+		outcome.frameDicts = map[uint32]int64{}
+		err = countFrameDicts(path, opts.Keys, outcome.frameDicts)
+	}
+	if info, statErr := os.Stat(path); statErr == nil {
+		outcome.inputSize = info.Size()
+	}
+	outcome.written, outcome.counter, outcome.err = written, checks.counter, err
+	return outcome
+}
+
+// wilsonInterval is the 95% Wilson score interval for failures out of n
+// sampled files, which stays meaningful when no failures were observed.
+func wilsonInterval(failures, n int) (float64, float64) {
+	if n == 0 {
+		return 0, 1
+	}
+	const z = 1.96
+	p := float64(failures) / float64(n)
+	nf := float64(n)
+	denom := 1 + z*z/nf
+	center := (p + z*z/(2*nf)) / denom
+	margin := z * math.Sqrt(p*(1-p)/nf+z*z/(4*nf*nf)) / denom
+	return math.Max(0, center-margin), math.Min(1, center+margin)
+}
+
+func printTestResult(w io.Writer, p console.Printer, test testResult, fraction float64, seed int64) {
+	sampled := test.Stats.FilesProcessed
+	failed := len(test.Failures)
+	status := p.Green("ok")
+	if failed > 0 {
+		status = p.Red("FAILED")
+	}
+	fmt.Fprintf(w, "tested %d of %d files (%d bytes): %d failed, %s\n", sampled, test.FilesTotal, test.Stats.InputBytes, failed, status)
+	if fraction < 1 {
+		low, high := wilsonInterval(failed, sampled)
+		rate := 0.0
+		if sampled > 0 {
+			rate = float64(failed) / float64(sampled)
+		}
+		fmt.Fprintf(w, "estimated corpus failure rate %.2f%% (95%% interval %.2f%%-%.2f%%, about %d of %d files); reproduce with -sample-seed %d\n",
+			rate*100, low*100, high*100, int(math.Round(rate*float64(test.FilesTotal))), test.FilesTotal, seed)
+	}
+	for _, failure := range test.Failures {
+		fmt.Fprintln(os.Stderr, failure)
+	}
+}
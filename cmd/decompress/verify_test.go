@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestVerifyReportsOnlyTheCorruptFile test-decodes a corpus with one
+// corrupted file across several workers and checks that it is the one
+// failure reported and that every other file is counted as passing.
+func TestVerifyReportsOnlyTheCorruptFile(t *testing.T) {
+	in := t.TempDir()
+	files := map[string]string{}
+	for i := 0; i < 24; i++ {
+		files[fmt.Sprintf("d%d/f%02d.json.zst", i%3, i)] = strings.Repeat(fmt.Sprintf(`{"id":%d}`+"\n", i), 50+i)
+	}
+	writeCompressed(t, in, files)
+	corrupt := filepath.Join(in, "d1", "f07.json.zst")
+	data, err := os.ReadFile(corrupt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last byte is part of the content checksum.
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(corrupt, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, workers := range []string{"1", "4"} {
+		t.Run("workers="+workers, func(t *testing.T) {
+			url, pushed := fakeGateway(t)
+			out := t.TempDir()
+			code, output := run(t, "-in", in, "-out", out, "-pushgateway", url, "-test", "-workers", workers)
+			if code != 1 {
+				t.Fatalf("exit %d, want 1, output:\n%s", code, output)
+			}
+			if !strings.Contains(output, "tested 24 of 24 files") || !strings.Contains(output, ": 1 failed") {
+				t.Errorf("summary does not report 1 failure in 24 files:\n%s", output)
+			}
+			var failures []string
+			for _, line := range strings.Split(output, "\n") {
+				if strings.HasPrefix(line, in) {
+					failures = append(failures, line)
+				}
+			}
+			if len(failures) != 1 || !strings.HasPrefix(failures[0], corrupt+": ") {
+				t.Errorf("failures listed: %q, want only %s", failures, corrupt)
+			}
+			gauges := pushed()
+			if gauges["verify_files_ok"] != 23 || gauges["verify_files_corrupt"] != 1 {
+				t.Errorf("pushed %v ok and %v corrupt, want 23 and 1", gauges["verify_files_ok"], gauges["verify_files_corrupt"])
+			}
+			if got := readTree(t, out); len(got) != 0 {
+				t.Errorf("-test wrote %d outputs", len(got))
+			}
+		})
+	}
+}
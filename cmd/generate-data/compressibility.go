@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+
+	"zstd-learning/internal/report"
+)
+
+// compressibility is what -report-compressibility measured for the output.
+type compressibility struct {
+	InputBytes  int64
+	OutputBytes int64
+}
+
+// Ratio returns compressed/original, as the other tools report it.
+func (c compressibility) Ratio() float64 {
+	return report.Ratio(c.OutputBytes, c.InputBytes)
+}
+
+// measureCompressibility compresses the file at path in memory at the
+// default level, without a dictionary, and returns the sizes.
+func measureCompressibility(path string) (compressibility, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return compressibility{}, err
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return compressibility{}, err
+	}
+	defer encoder.Close()
+	compressed := encoder.EncodeAll(data, nil)
+	return compressibility{InputBytes: int64(len(data)), OutputBytes: int64(len(compressed))}, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"zstd-learning/internal/summary"
+)
+
+func TestReportCompressibility(t *testing.T) {
+	url, pushed := fakeGateway(t)
+	for _, tt := range []struct {
+		kind string
+		// The generators repeat keys and draw values from small lists, so
+		// the output compresses well but not to nothing.
+		low, high float64
+	}{
+		{"people", 0.05, 0.4},
+		{"movies", 0.05, 0.4},
+	} {
+		code, out := run(t, "-type", tt.kind, "-n", "500", "-seed", "7", "-out", t.TempDir(), "-pushgateway", url,
+			"-report-compressibility", "-summary-format", "json")
+		if code != 0 {
+			t.Fatalf("%s: exit %d, output:\n%s", tt.kind, code, out)
+		}
+		var sum summary.Summary
+		if err := json.Unmarshal([]byte(strings.TrimSpace(out)), &sum); err != nil {
+			t.Fatalf("%s: %v, output:\n%s", tt.kind, err, out)
+		}
+		name := "generate_compressibility_ratio{type=" + tt.kind + "}"
+		ratio, ok := pushed()[name]
+		if !ok || ratio < tt.low || ratio > tt.high {
+			t.Errorf("%s = %v (pushed %v), want %.2f to %.2f", name, ratio, ok, tt.low, tt.high)
+		}
+		if sum.Compressibility != ratio {
+			t.Errorf("%s: summary compressibility %v, pushed %v", tt.kind, sum.Compressibility, ratio)
+		}
+	}
+
+	url, pushed = fakeGateway(t)
+	if code, out := run(t, "-type", "people", "-n", "5", "-seed", "7", "-out", t.TempDir(), "-pushgateway", url, "-quiet"); code != 0 {
+		t.Fatalf("without the flag: exit %d, output:\n%s", code, out)
+	}
+	gauges := pushed()
+	if _, ok := gauges["generate_compressibility_ratio{type=people}"]; ok {
+		t.Error("generate_compressibility_ratio pushed without -report-compressibility")
+	}
+	if _, ok := gauges["generated_items_total{type=people}"]; !ok {
+		t.Errorf("generated_items_total{type=people} was not pushed, got %v", gauges)
+	}
+}
@@ -2,66 +2,28 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"math/rand"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/push"
-)
-
-type Movie struct {
-	ID        int     `json:"id"`
-	Title     string  `json:"title"`
-	Genre     string  `json:"genre"`
-	Year      int     `json:"year"`
-	Director  string  `json:"director"`
-	Rating    float64 `json:"rating"`
-	Runtime   int     `json:"runtime_minutes"`
-	CreatedAt string  `json:"created_at"`
-}
 
-type Book struct {
-	ID        int     `json:"id"`
-	Title     string  `json:"title"`
-	Author    string  `json:"author"`
-	Genre     string  `json:"genre"`
-	Year      int     `json:"year"`
-	Pages     int     `json:"pages"`
-	Rating    float64 `json:"rating"`
-	CreatedAt string  `json:"created_at"`
-}
-
-type Person struct {
-	ID        int    `json:"id"`
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
-	Email     string `json:"email"`
-	City      string `json:"city"`
-	Country   string `json:"country"`
-	Age       int    `json:"age"`
-	CreatedAt string `json:"created_at"`
-}
+	"zstd-learning/internal/config"
+	"zstd-learning/internal/console"
+	"zstd-learning/internal/outpath"
+	"zstd-learning/internal/pushspool"
+	"zstd-learning/internal/repro"
+	"zstd-learning/internal/size"
+	"zstd-learning/internal/summary"
+	"zstd-learning/internal/synth"
+)
 
 var (
-	movieTitles = []string{"Silent Horizon", "Crimson Valley", "Echoes of Tomorrow", "Northbound", "Astra Drift", "Blue Lantern", "Midnight Harbor", "Glass River"}
-	movieGenres = []string{"Drama", "Sci-Fi", "Thriller", "Comedy", "Adventure", "Mystery"}
-	directors   = []string{"Avery Quinn", "Morgan Ellis", "Riley Chen", "Harper Singh", "Jordan Blake", "Taylor Reyes"}
-
-	bookTitles = []string{"The Last Orchard", "Paper Cities", "Sparks in Winter", "The River and the Road", "Atlas of Dust", "The Ninth Signal"}
-	bookGenres = []string{"Fantasy", "Historical", "Non-Fiction", "Mystery", "Romance", "Sci-Fi"}
-	authors    = []string{"Samira Holt", "Eli Navarro", "Priya Kapoor", "Luca Moretti", "Noah Sterling", "Yuna Park"}
-
-	firstNames = []string{"Ava", "Liam", "Maya", "Ethan", "Isla", "Noah", "Zoe", "Amir", "Nora", "Leo"}
-	lastNames  = []string{"Johnson", "Khan", "Patel", "Garcia", "Nguyen", "Smith", "Rossi", "Wright"}
-	cities     = []string{"Austin", "Seattle", "Denver", "Toronto", "Dublin", "Oslo", "Berlin", "Lisbon"}
-	countries  = []string{"USA", "Canada", "Ireland", "Norway", "Germany", "Portugal"}
+	pushSpool     *pushspool.Options
+	deterministic *repro.Options
 )
 
 func main() {
@@ -69,7 +31,45 @@ func main() {
 	count := flag.Int("n", 0, "number of items to generate")
 	outDir := flag.String("out", "output", "output directory")
 	pushURL := flag.String("pushgateway", "http://localhost:9091", "Pushgateway base URL")
-	flag.Parse()
+	pushSpool = pushspool.Flags(flag.CommandLine)
+	seed := flag.Int64("seed", 0, "random seed for reproducible output (0 uses the current time)")
+	locales := flag.String("locales", "en", "comma-separated locales for people names and cities")
+	emailDomains := flag.String("email-domains", "example.com", "comma-separated email domains for people, optionally weighted as domain:weight")
+	unicodeRate := flag.Float64("unicode-rate", 0, "probability (0..1) of injecting quotes, backslashes, emoji, CJK or control characters into each string field")
+	baseTime := flag.String("base-time", "", "RFC3339 time such as 2024-01-01T00:00:00Z; record N is then created at base-time + N*time-step instead of now, so seeded output is byte for byte reproducible")
+	timeStep := flag.Duration("time-step", time.Second, "with -base-time, the time between consecutive records' created_at (whole seconds; created_at has no fraction)")
+	keyOrderFlag := flag.String("key-order", "struct", "order of the fields in each record: struct (the same fixed order every time), sorted (alphabetical) or shuffled (random per record, reproducible with -seed)")
+	timestampFormat := flag.String("timestamp-format", outpath.StampLayout, "Go time layout of the UTC timestamp in the output file name, e.g. 20060102_150405 for the older style; a name already taken gets _2, _3, ...")
+	summaryFormat := flag.String("summary-format", "text", "end-of-run summary format: text (human-readable sizes and rates) or json (raw numbers)")
+	quiet := flag.Bool("quiet", false, "do not print the end-of-run summary")
+	reportCompressibility := flag.Bool("report-compressibility", false, "after writing, compress the output in memory at the default level without a dictionary, print the ratio and push it as generate_compressibility_ratio")
+	colorFlag := flag.String("color", "auto", "colorize output: auto (only on a terminal), always, never")
+	deterministic = repro.Flags(flag.CommandLine)
+	if err := config.Parse(flag.CommandLine, os.Args[1:], "ZSTD_GENERATE_DATA"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := deterministic.Check(flag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := deterministic.RequireSeed("seed", *seed); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	colorMode, err := console.ParseMode(*colorFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	stdout := console.NewPrinter(colorMode, os.Stdout)
+	stderr := console.NewPrinter(colorMode, os.Stderr)
+	summaryFmt, err := summary.ParseFormat(*summaryFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
 	if *dataType == "" {
 		*dataType = promptString("Select type (movies, books, people): ")
@@ -85,44 +85,116 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *unicodeRate < 0 || *unicodeRate > 1 {
+		fmt.Fprintln(os.Stderr, "unicode-rate must be between 0 and 1")
+		os.Exit(1)
+	}
+	order, err := synth.ParseKeyOrder(strings.ToLower(strings.TrimSpace(*keyOrderFlag)))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var clock synth.Clock
+	if strings.TrimSpace(*baseTime) != "" {
+		clock.Base, err = time.Parse(time.RFC3339, strings.TrimSpace(*baseTime))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -base-time %q: must be an RFC3339 time such as 2024-01-01T00:00:00Z\n", *baseTime)
+			os.Exit(1)
+		}
+		if *timeStep <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid -time-step %s: must be positive\n", *timeStep)
+			os.Exit(1)
+		}
+		clock.Step = *timeStep
+	} else {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "time-step" {
+				fmt.Fprintln(os.Stderr, "-time-step requires -base-time")
+				os.Exit(1)
+			}
+		})
+	}
+
+	if err := outpath.CheckStampLayout(*timestampFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	if err := os.MkdirAll(*outDir, 0o755); err != nil {
 		fmt.Fprintf(os.Stderr, "failed to create output dir: %v\n", err)
 		os.Exit(1)
 	}
 
-	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	gen, err := synth.New(synth.Options{
+		Type:         dataTypeVal,
+		Seed:         *seed,
+		Locales:      *locales,
+		EmailDomains: *emailDomains,
+		UnicodeRate:  *unicodeRate,
+		KeyOrder:     order,
+		Clock:        clock,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid people options: %v\n", err)
+		os.Exit(1)
+	}
 	start := time.Now()
 
-	outputFile := filepath.Join(*outDir, fmt.Sprintf("%s_%s.json", dataTypeVal, time.Now().Format("20060102_150405")))
-
-	var err error
-	switch dataTypeVal {
-	case "movies":
-		err = writeJSONArray(outputFile, *count, func(i int) any {
-			return makeMovie(rng, i+1)
-		})
-	case "books":
-		err = writeJSONArray(outputFile, *count, func(i int) any {
-			return makeBook(rng, i+1)
-		})
-	case "people":
-		err = writeJSONArray(outputFile, *count, func(i int) any {
-			return makePerson(rng, i+1)
-		})
+	file, err := outpath.CreateStamped(*outDir, dataTypeVal+"_", *timestampFormat, ".json", deterministic.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("failed to create output"), err)
+		os.Exit(1)
 	}
+	outputFile := file.Name()
 
+	err = gen.Write(file, *count, "json")
+	if closeErr := file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to write output: %v\n", err)
+		fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("failed to write output"), err)
 		os.Exit(1)
 	}
 
 	duration := time.Since(start)
-	if err := pushMetrics(*pushURL, dataTypeVal, *count, duration); err != nil {
-		fmt.Fprintf(os.Stderr, "metrics push failed: %v\n", err)
+	var measured *compressibility
+	if *reportCompressibility {
+		c, err := measureCompressibility(outputFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("failed to measure compressibility"), err)
+			os.Exit(1)
+		}
+		measured = &c
+	}
+	if err := pushMetrics(*pushURL, dataTypeVal, *count, duration, measured); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("metrics push failed"), err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("generated %d %s into %s\n", *count, dataTypeVal, outputFile)
+	if !*quiet {
+		var written int64
+		if info, err := os.Stat(outputFile); err == nil {
+			written = info.Size()
+		}
+		sum := summary.New("generate-data", 1, 0, written, written, deterministic.Duration(duration))
+		sum.Destination = outputFile
+		sum.KeyOrder = order.String()
+		if measured != nil {
+			sum.Compressibility = measured.Ratio()
+		}
+		if summaryFmt == summary.JSON {
+			sum.WriteJSON(os.Stdout)
+		} else {
+			fmt.Printf("generated %s %s with %s key order into %s: %s\n", stdout.Bold(strconv.Itoa(*count)), dataTypeVal, order, stdout.Green(outputFile), sum.Details(stdout))
+			if measured != nil {
+				fmt.Printf("compressibility at the default level without a dictionary: %s -> %s, ratio %.3f\n", size.Format(measured.InputBytes), size.Format(measured.OutputBytes), measured.Ratio())
+			}
+		}
+	}
 }
 
 func promptString(message string) string {
@@ -160,86 +232,9 @@ func promptInt(message string) int {
 	}
 }
 
-func makeMovie(rng *rand.Rand, id int) Movie {
-	return Movie{
-		ID:        id,
-		Title:     pick(rng, movieTitles),
-		Genre:     pick(rng, movieGenres),
-		Year:      rng.Intn(45) + 1980,
-		Director:  pick(rng, directors),
-		Rating:    randFloat(rng, 5.5, 9.8),
-		Runtime:   rng.Intn(81) + 80,
-		CreatedAt: time.Now().Format(time.RFC3339),
-	}
-}
-
-func makeBook(rng *rand.Rand, id int) Book {
-	return Book{
-		ID:        id,
-		Title:     pick(rng, bookTitles),
-		Author:    pick(rng, authors),
-		Genre:     pick(rng, bookGenres),
-		Year:      rng.Intn(60) + 1965,
-		Pages:     rng.Intn(450) + 150,
-		Rating:    randFloat(rng, 3.5, 5.0),
-		CreatedAt: time.Now().Format(time.RFC3339),
-	}
-}
-
-func makePerson(rng *rand.Rand, id int) Person {
-	first := pick(rng, firstNames)
-	last := pick(rng, lastNames)
-	return Person{
-		ID:        id,
-		FirstName: first,
-		LastName:  last,
-		Email:     strings.ToLower(fmt.Sprintf("%s.%s@example.com", first, last)),
-		City:      pick(rng, cities),
-		Country:   pick(rng, countries),
-		Age:       rng.Intn(52) + 18,
-		CreatedAt: time.Now().Format(time.RFC3339),
-	}
-}
-
-func writeJSONArray(path string, count int, makeItem func(i int) any) error {
-	file, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	writer := bufio.NewWriter(file)
-	defer writer.Flush()
-
-	if _, err := writer.WriteString("[\n"); err != nil {
-		return err
-	}
-
-	for i := 0; i < count; i++ {
-		if i > 0 {
-			if _, err := writer.WriteString(",\n"); err != nil {
-				return err
-			}
-		}
-
-		item := makeItem(i)
-		data, err := json.Marshal(item)
-		if err != nil {
-			return err
-		}
-		if _, err := writer.Write(data); err != nil {
-			return err
-		}
-	}
-
-	if _, err := writer.WriteString("\n]\n"); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func pushMetrics(pushURL, dataType string, count int, duration time.Duration) error {
+// pushMetrics pushes the run's metrics, and generate_compressibility_ratio
+// when measured is not nil.
+func pushMetrics(pushURL, dataType string, count int, duration time.Duration, measured *compressibility) error {
 	registry := prometheus.NewRegistry()
 	counter := prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "generated_items_total",
@@ -264,18 +259,20 @@ func pushMetrics(pushURL, dataType string, count int, duration time.Duration) er
 		return err
 	}
 
+	if measured != nil {
+		ratioGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "generate_compressibility_ratio",
+			Help: "Compressed/original size of the last generated output at the default zstd level without a dictionary, by type.",
+		})
+		if err := registry.Register(ratioGauge); err != nil {
+			return err
+		}
+		ratioGauge.Set(measured.Ratio())
+	}
+
 	counter.Add(float64(count))
 	durationGauge.Set(duration.Seconds())
 	timestampGauge.Set(float64(time.Now().Unix()))
 
-	pusher := push.New(pushURL, "generate-data").Gatherer(registry).Grouping("type", dataType)
-	return pusher.Push()
-}
-
-func pick(rng *rand.Rand, items []string) string {
-	return items[rng.Intn(len(items))]
-}
-
-func randFloat(rng *rand.Rand, min, max float64) float64 {
-	return min + rng.Float64()*(max-min)
+	return pushspool.Push(pushSpool, pushURL, "generate-data", pushspool.Grouping{"type": dataType}, registry)
 }
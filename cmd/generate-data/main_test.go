@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// runEnv makes the test binary run main instead of the tests, so a test can
+// run the command as a child process and look at its exit code.
+const runEnv = "ZSTD_LEARNING_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// run runs the command with args and returns its exit code and combined
+// output.
+func run(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runEnv+"=1")
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), string(out)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0, string(out)
+}
+
+// fakeGateway starts a Pushgateway stand-in and returns its URL and a
+// function returning the values of the pushes it has received, keyed by
+// name and the grouping labels of the push URL, such as
+// generated_items_total{type=people}.
+func fakeGateway(t *testing.T) (string, func() map[string]float64) {
+	t.Helper()
+	var mu sync.Mutex
+	series := map[string]float64{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The path is /metrics/job/<job> followed by label/value pairs.
+		var labels []string
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/metrics/job/"), "/")
+		for i := 1; i+1 < len(parts); i += 2 {
+			labels = append(labels, parts[i]+"="+parts[i+1])
+		}
+		sort.Strings(labels)
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		mu.Lock()
+		defer mu.Unlock()
+		for {
+			var family dto.MetricFamily
+			if err := dec.Decode(&family); err != nil {
+				return
+			}
+			for _, metric := range family.Metric {
+				series[family.GetName()+"{"+strings.Join(labels, ",")+"}"] = metric.GetGauge().GetValue() + metric.GetCounter().GetValue()
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, func() map[string]float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return maps.Clone(series)
+	}
+}
+
+func TestBaseTimeIsReproducible(t *testing.T) {
+	url, _ := fakeGateway(t)
+	generate := func(args ...string) []byte {
+		t.Helper()
+		out := t.TempDir()
+		args = append([]string{"-type", "people", "-n", "40", "-seed", "7", "-out", out, "-pushgateway", url, "-quiet"}, args...)
+		if code, output := run(t, args...); code != 0 {
+			t.Fatalf("exit %d, output:\n%s", code, output)
+		}
+		paths, err := filepath.Glob(filepath.Join(out, "people_*.json"))
+		if err != nil || len(paths) != 1 {
+			t.Fatalf("wrote %q (%v), want one file", paths, err)
+		}
+		data, err := os.ReadFile(paths[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	first := generate("-base-time", "2024-01-01T00:00:00Z", "-time-step", "1m")
+	if second := generate("-base-time", "2024-01-01T00:00:00Z", "-time-step", "1m"); !bytes.Equal(first, second) {
+		t.Error("two runs with the same -seed and -base-time differ")
+	}
+	if !bytes.Contains(first, []byte(`"created_at":"2024-01-01T00:39:00Z"`)) {
+		t.Error("the last record is not created at base-time + 39 steps")
+	}
+
+	for _, args := range [][]string{
+		{"-base-time", "yesterday"},
+		{"-base-time", "2024-01-01T00:00:00Z", "-time-step", "0s"},
+		{"-time-step", "1m"},
+	} {
+		if code, output := run(t, append([]string{"-type", "people", "-n", "1", "-seed", "7", "-out", t.TempDir(), "-pushgateway", url}, args...)...); code != 1 {
+			t.Errorf("%q: exit %d, want 1, output:\n%s", args, code, output)
+		}
+	}
+}
+
+// TestSameSecondRuns runs twice with -deterministic, so both runs take their
+// file name from the same -base-time, and checks that the second does not
+// overwrite the first.
+func TestSameSecondRuns(t *testing.T) {
+	url, _ := fakeGateway(t)
+	out := t.TempDir()
+	for _, seed := range []string{"1", "2"} {
+		if code, output := run(t, "-type", "people", "-n", "5", "-seed", seed, "-deterministic", "-base-time", "2024-01-01T00:00:00Z", "-out", out, "-pushgateway", url, "-quiet"); code != 0 {
+			t.Fatalf("exit %d, output:\n%s", code, output)
+		}
+	}
+	first, err := os.ReadFile(filepath.Join(out, "people_20240101T000000Z.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := os.ReadFile(filepath.Join(out, "people_20240101T000000Z_2.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first, second) {
+		t.Error("the runs with seeds 1 and 2 wrote the same records")
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"zstd-learning/internal/frame"
+)
+
+type auditConfig struct {
+	Dir         string
+	Suffix      string
+	Dicts       [][]byte
+	SampleFiles int
+	MaxBytes    int64
+}
+
+// auditResult summarizes one audit cycle.
+type auditResult struct {
+	Finished     time.Time
+	Duration     time.Duration
+	FilesSampled int
+	BytesSampled int64
+	Failures     []string
+	// DictFiles counts sampled files per dictionary ID; 0 means no
+	// dictionary.
+	DictFiles map[uint32]int
+}
+
+type auditor struct {
+	cfg     auditConfig
+	decoder *zstd.Decoder
+	loaded  map[uint32]bool
+	metrics *auditMetrics
+	rng     *rand.Rand
+
+	mu   sync.Mutex // serializes audits and guards last
+	last *auditResult
+}
+
+func newAuditor(cfg auditConfig) (*auditor, error) {
+	var opts []zstd.DOption
+	loaded := map[uint32]bool{0: true}
+	if len(cfg.Dicts) > 0 {
+		opts = append(opts, zstd.WithDecoderDicts(cfg.Dicts...))
+		for _, dict := range cfg.Dicts {
+			info, err := zstd.InspectDictionary(dict)
+			if err != nil {
+				return nil, err
+			}
+			loaded[info.ID()] = true
+		}
+	}
+	decoder, err := zstd.NewReader(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &auditor{
+		cfg:     cfg,
+		decoder: decoder,
+		loaded:  loaded,
+		metrics: newAuditMetrics(),
+		rng:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+func (a *auditor) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		result := a.audit()
+		if len(result.Failures) > 0 {
+			fmt.Fprintf(os.Stderr, "audit: %d of %d files failed\n", len(result.Failures), result.FilesSampled)
+		}
+		<-ticker.C
+	}
+}
+
+// audit samples up to SampleFiles random files, stopping early once
+// MaxBytes of compressed input has been read, and test-decodes each one.
+func (a *auditor) audit() auditResult {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	start := time.Now()
+	result := auditResult{DictFiles: map[uint32]int{}}
+	candidates, err := a.listCandidates()
+	if err != nil {
+		result.Failures = append(result.Failures, err.Error())
+	}
+	a.rng.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	for _, c := range candidates {
+		if result.FilesSampled >= a.cfg.SampleFiles {
+			break
+		}
+		if result.BytesSampled+c.size > a.cfg.MaxBytes {
+			continue
+		}
+		result.FilesSampled++
+		result.BytesSampled += c.size
+		dictIDs, err := a.verifyFile(c.path)
+		for _, id := range dictIDs {
+			result.DictFiles[id]++
+		}
+		if err != nil {
+			result.Failures = append(result.Failures, fmt.Sprintf("%s: %v", c.path, err))
+		}
+	}
+
+	result.Finished = time.Now()
+	result.Duration = result.Finished.Sub(start)
+	a.last = &result
+	a.metrics.record(result, a.loaded)
+	return result
+}
+
+type candidate struct {
+	path string
+	size int64
+}
+
+func (a *auditor) listCandidates() ([]candidate, error) {
+	var candidates []candidate
+	err := filepath.WalkDir(a.cfg.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, a.cfg.Suffix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Size() > 0 {
+			candidates = append(candidates, candidate{path: path, size: info.Size()})
+		}
+		return nil
+	})
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].path < candidates[j].path })
+	return candidates, err
+}
+
+// verifyFile decodes path to io.Discard and checks the result against the
+// content sizes declared in the frame headers. It returns the distinct
+// dictionary IDs the file's frames reference.
+func (a *auditor) verifyFile(path string) ([]uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	frames, err := frame.ScanAll(f)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	seen := map[uint32]bool{}
+	declared := int64(0)
+	allDeclared := true
+	for _, info := range frames {
+		if info.Skippable {
+			continue
+		}
+		if !seen[info.DictID] {
+			seen[info.DictID] = true
+			ids = append(ids, info.DictID)
+		}
+		if info.HasContentSize() {
+			declared += info.ContentSize
+		} else {
+			allDeclared = false
+		}
+	}
+	for _, id := range ids {
+		if !a.loaded[id] {
+			return ids, fmt.Errorf("dictionary %d is not loaded", id)
+		}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return ids, err
+	}
+	if err := a.decoder.Reset(f); err != nil {
+		return ids, err
+	}
+	defer a.decoder.Reset(nil)
+	n, err := io.Copy(io.Discard, a.decoder)
+	if err != nil {
+		return ids, err
+	}
+	if allDeclared && n != declared {
+		return ids, fmt.Errorf("decoded %d bytes, frame headers declare %d", n, declared)
+	}
+	return ids, nil
+}
+
+func (a *auditor) lastResult() *auditResult {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.last
+}
+
+func (a *auditor) handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	last := a.lastResult()
+	switch {
+	case last == nil:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "no audit has completed yet")
+	case len(last.Failures) > 0:
+		w.WriteHeader(http.StatusInternalServerError)
+		writeResult(w, *last)
+	default:
+		writeResult(w, *last)
+	}
+}
+
+// handleAudit runs an audit immediately and reports its result. It waits
+// for an audit that is already in progress to finish first.
+func (a *auditor) handleAudit(w http.ResponseWriter, _ *http.Request) {
+	result := a.audit()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(result.Failures) > 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	writeResult(w, result)
+}
+
+func writeResult(w io.Writer, result auditResult) {
+	status := "ok"
+	if len(result.Failures) > 0 {
+		status = "failed"
+	}
+	fmt.Fprintf(w, "%s: sampled %d files (%d bytes) at %s\n", status, result.FilesSampled, result.BytesSampled, result.Finished.UTC().Format(time.RFC3339))
+	for _, failure := range result.Failures {
+		fmt.Fprintf(w, "  %s\n", failure)
+	}
+}
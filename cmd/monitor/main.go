@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"zstd-learning/internal/size"
+)
+
+func main() {
+	addr := flag.String("addr", ":8082", "listen address")
+	dir := flag.String("dir", "compressed", "directory of compressed files to audit")
+	suffix := flag.String("suffix", ".zst", "only audit files ending in this suffix")
+	dicts := flag.String("dict", "", "comma-separated dictionary files used to decode the archive")
+	interval := flag.Duration("interval", 5*time.Minute, "time between audits")
+	sampleFiles := flag.Int("sample", 10, "files sampled per audit")
+	maxBytesFlag := flag.String("max-bytes", "64MiB", "compressed bytes read per audit (e.g. 512KiB, 64MiB)")
+	flag.Parse()
+
+	if *sampleFiles <= 0 {
+		fmt.Fprintln(os.Stderr, "-sample must be positive")
+		os.Exit(1)
+	}
+	if *interval <= 0 {
+		fmt.Fprintln(os.Stderr, "-interval must be positive")
+		os.Exit(1)
+	}
+	maxBytes, err := size.Parse(*maxBytesFlag)
+	if err != nil || maxBytes <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid -max-bytes %q\n", *maxBytesFlag)
+		os.Exit(1)
+	}
+
+	var dictBytes [][]byte
+	for _, path := range strings.Split(*dicts, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read dict: %v\n", err)
+			os.Exit(1)
+		}
+		dictBytes = append(dictBytes, data)
+	}
+
+	aud, err := newAuditor(auditConfig{
+		Dir:         *dir,
+		Suffix:      *suffix,
+		Dicts:       dictBytes,
+		SampleFiles: *sampleFiles,
+		MaxBytes:    maxBytes,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create auditor: %v\n", err)
+		os.Exit(1)
+	}
+
+	go aud.loop(*interval)
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", aud.metrics.handler())
+	mux.HandleFunc("GET /healthz", aud.handleHealthz)
+	mux.HandleFunc("POST /audit", aud.handleAudit)
+
+	fmt.Printf("auditing %s every %s, serving on %s\n", *dir, *interval, *addr)
+	if err := http.ListenAndServe(*addr, mux); err != nil {
+		fmt.Fprintf(os.Stderr, "server failed: %v\n", err)
+		os.Exit(1)
+	}
+}
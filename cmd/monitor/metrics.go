@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type auditMetrics struct {
+	registry     *prometheus.Registry
+	lastAudit    prometheus.Gauge
+	duration     prometheus.Gauge
+	filesSampled prometheus.Gauge
+	bytesSampled prometheus.Gauge
+	failures     prometheus.Gauge
+	audits       prometheus.Counter
+	dictFiles    *prometheus.GaugeVec
+}
+
+func newAuditMetrics() *auditMetrics {
+	m := &auditMetrics{
+		registry: prometheus.NewRegistry(),
+		lastAudit: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "monitor_last_audit_timestamp_seconds",
+			Help: "Unix timestamp of the last completed audit.",
+		}),
+		duration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "monitor_audit_duration_seconds",
+			Help: "Duration of the last audit in seconds.",
+		}),
+		filesSampled: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "monitor_files_sampled",
+			Help: "Files test-decoded by the last audit.",
+		}),
+		bytesSampled: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "monitor_bytes_sampled",
+			Help: "Compressed bytes read by the last audit.",
+		}),
+		failures: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "monitor_failures",
+			Help: "Files that failed to decode in the last audit.",
+		}),
+		audits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "monitor_audits_total",
+			Help: "Audits run since startup.",
+		}),
+		dictFiles: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "monitor_dict_files",
+			Help: "Files sampled by the last audit per dictionary ID (0 = no dictionary).",
+		}, []string{"dict_id", "loaded"}),
+	}
+	m.registry.MustRegister(m.lastAudit, m.duration, m.filesSampled, m.bytesSampled, m.failures, m.audits, m.dictFiles)
+	return m
+}
+
+func (m *auditMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *auditMetrics) record(result auditResult, loaded map[uint32]bool) {
+	m.lastAudit.Set(float64(result.Finished.Unix()))
+	m.duration.Set(result.Duration.Seconds())
+	m.filesSampled.Set(float64(result.FilesSampled))
+	m.bytesSampled.Set(float64(result.BytesSampled))
+	m.failures.Set(float64(len(result.Failures)))
+	m.audits.Inc()
+
+	m.dictFiles.Reset()
+	for id := range loaded {
+		m.dictFiles.WithLabelValues(strconv.FormatUint(uint64(id), 10), "true").Set(0)
+	}
+	for id, n := range result.DictFiles {
+		m.dictFiles.WithLabelValues(strconv.FormatUint(uint64(id), 10), strconv.FormatBool(loaded[id])).Set(float64(n))
+	}
+}
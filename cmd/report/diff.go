@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"zstd-learning/internal/report"
+)
+
+// exitRegression is the exit status used when -fail-on-regression is set and
+// the aggregate ratio got worse.
+const exitRegression = 3
+
+// fileDelta compares one file present in both reports. A positive Delta is a
+// regression: the new output is larger relative to its input.
+type fileDelta struct {
+	Path     string  `json:"path"`
+	OldRatio float64 `json:"old_ratio"`
+	NewRatio float64 `json:"new_ratio"`
+	Delta    float64 `json:"delta"`
+	OldBytes int64   `json:"old_output_bytes"`
+	NewBytes int64   `json:"new_output_bytes"`
+}
+
+type runDelta struct {
+	Old          report.Totals `json:"old"`
+	New          report.Totals `json:"new"`
+	RatioDelta   float64       `json:"ratio_delta"`
+	Common       int           `json:"common_files"`
+	Added        []string      `json:"added"`
+	Removed      []string      `json:"removed"`
+	Regressions  []fileDelta   `json:"regressions"`
+	Improvements []fileDelta   `json:"improvements"`
+}
+
+func runDiff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	top := fs.Int("top", 10, "number of largest regressions and improvements to list")
+	asJSON := fs.Bool("json", false, "print the comparison as JSON")
+	failOnRegression := fs.Bool("fail-on-regression", false, fmt.Sprintf("exit with status %d when the aggregate ratio regressed", exitRegression))
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: report diff [flags] <old.json> <new.json>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *top < 0 {
+		fmt.Fprintln(os.Stderr, "-top must not be negative")
+		os.Exit(1)
+	}
+
+	oldRun, err := report.Read(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read report: %v\n", err)
+		os.Exit(1)
+	}
+	newRun, err := report.Read(fs.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read report: %v\n", err)
+		os.Exit(1)
+	}
+
+	delta := diffRuns(oldRun, newRun, *top)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(delta)
+	} else {
+		err = printDelta(os.Stdout, delta)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *failOnRegression && delta.RatioDelta > 0 {
+		os.Exit(exitRegression)
+	}
+}
+
+// diffRuns joins the two runs on relative path. Totals are recomputed from
+// the file lists rather than trusted from the reports, so a report written
+// by a tool that omits or computes them differently still compares.
+func diffRuns(oldRun, newRun report.Run, top int) runDelta {
+	oldFiles := make(map[string]report.File, len(oldRun.Files))
+	for _, f := range oldRun.Files {
+		oldFiles[f.Path] = f
+	}
+
+	delta := runDelta{
+		Old:     totals(oldRun.Files),
+		New:     totals(newRun.Files),
+		Added:   []string{},
+		Removed: []string{},
+	}
+	delta.RatioDelta = delta.New.Ratio - delta.Old.Ratio
+
+	var changed []fileDelta
+	seen := make(map[string]bool, len(newRun.Files))
+	for _, f := range newRun.Files {
+		seen[f.Path] = true
+		old, ok := oldFiles[f.Path]
+		if !ok {
+			delta.Added = append(delta.Added, f.Path)
+			continue
+		}
+		delta.Common++
+		oldRatio := report.Ratio(old.OutputBytes, old.InputBytes)
+		newRatio := report.Ratio(f.OutputBytes, f.InputBytes)
+		if newRatio == oldRatio {
+			continue
+		}
+		changed = append(changed, fileDelta{
+			Path:     f.Path,
+			OldRatio: oldRatio,
+			NewRatio: newRatio,
+			Delta:    newRatio - oldRatio,
+			OldBytes: old.OutputBytes,
+			NewBytes: f.OutputBytes,
+		})
+	}
+	for _, f := range oldRun.Files {
+		if !seen[f.Path] {
+			delta.Removed = append(delta.Removed, f.Path)
+		}
+	}
+	sort.Strings(delta.Added)
+	sort.Strings(delta.Removed)
+
+	sort.Slice(changed, func(i, j int) bool {
+		if changed[i].Delta != changed[j].Delta {
+			return changed[i].Delta > changed[j].Delta
+		}
+		return changed[i].Path < changed[j].Path
+	})
+	delta.Regressions = []fileDelta{}
+	for _, c := range changed {
+		if c.Delta <= 0 || len(delta.Regressions) >= top {
+			break
+		}
+		delta.Regressions = append(delta.Regressions, c)
+	}
+	delta.Improvements = []fileDelta{}
+	for i := len(changed) - 1; i >= 0; i-- {
+		if changed[i].Delta >= 0 || len(delta.Improvements) >= top {
+			break
+		}
+		delta.Improvements = append(delta.Improvements, changed[i])
+	}
+	return delta
+}
+
+func totals(files []report.File) report.Totals {
+	t := report.Totals{Files: len(files)}
+	for _, f := range files {
+		t.InputBytes += f.InputBytes
+		t.OutputBytes += f.OutputBytes
+	}
+	t.Ratio = report.Ratio(t.OutputBytes, t.InputBytes)
+	return t
+}
+
+func printDelta(w io.Writer, delta runDelta) error {
+	fmt.Fprintf(w, "ratio %.4f -> %.4f (%+.4f) over %d -> %d files\n", delta.Old.Ratio, delta.New.Ratio, delta.RatioDelta, delta.Old.Files, delta.New.Files)
+	fmt.Fprintf(w, "%d files in both, %d added, %d removed\n", delta.Common, len(delta.Added), len(delta.Removed))
+
+	sections := []struct {
+		title string
+		rows  []fileDelta
+	}{
+		{"regressions", delta.Regressions},
+		{"improvements", delta.Improvements},
+	}
+	for _, section := range sections {
+		if len(section.rows) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s:\n", section.title)
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "DELTA\tOLD\tNEW\tOLD BYTES\tNEW BYTES\tFILE")
+		for _, r := range section.rows {
+			fmt.Fprintf(tw, "%+.4f\t%.4f\t%.4f\t%d\t%d\t%s\n", r.Delta, r.OldRatio, r.NewRatio, r.OldBytes, r.NewBytes, r.Path)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"zstd-learning/internal/confirm"
+	"zstd-learning/internal/history"
+)
+
+// historyColumns are the columns history export can emit, in default order.
+var historyColumns = []string{"timestamp", "command", "source", "run_id", "files", "input_bytes", "output_bytes", "ratio", "duration_seconds", "level", "dict_id"}
+
+func runHistory(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: report history <export|prune> [flags]")
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "export":
+		runHistoryExport(args[1:])
+	case "prune":
+		runHistoryPrune(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown history action %q (expected export, prune)\n", args[0])
+		os.Exit(1)
+	}
+}
+
+func runHistoryExport(args []string) {
+	fs := flag.NewFlagSet("history export", flag.ExitOnError)
+	file := fs.String("file", "history.jsonl", "history file written by -history")
+	command := fs.String("command", "", "only export runs of this command (compress, decompress, train-dict)")
+	source := fs.String("source", "", "only export runs with this source label")
+	since := fs.String("since", "", "only export runs at or after this date (2006-01-02 or RFC 3339)")
+	until := fs.String("until", "", "only export runs before this date (2006-01-02 or RFC 3339)")
+	format := fs.String("format", "csv", "output format: csv or json")
+	columns := fs.String("columns", strings.Join(historyColumns, ","), "comma-separated columns to export")
+	fs.Parse(args)
+
+	if *format != "csv" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "invalid -format %q (expected csv or json)\n", *format)
+		os.Exit(1)
+	}
+	cols, err := parseHistoryColumns(*columns)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	from, err := parseHistoryTime("-since", *since)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	to, err := parseHistoryTime("-until", *until)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	records, err := history.Read(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read history: %v\n", err)
+		os.Exit(1)
+	}
+	selected := records[:0]
+	for _, rec := range records {
+		switch {
+		case *command != "" && rec.Command != *command:
+		case *source != "" && rec.Source != *source:
+		case !from.IsZero() && rec.Timestamp.Before(from):
+		case !to.IsZero() && !rec.Timestamp.Before(to):
+		default:
+			selected = append(selected, rec)
+		}
+	}
+
+	if *format == "json" {
+		err = writeHistoryJSON(os.Stdout, selected, cols)
+	} else {
+		err = writeHistoryCSV(os.Stdout, selected, cols)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "history export failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runHistoryPrune(args []string) {
+	fs := flag.NewFlagSet("history prune", flag.ExitOnError)
+	file := fs.String("file", "history.jsonl", "history file written by -history")
+	keepDays := fs.Int("keep-days", 0, "remove runs older than this many days")
+	confirmOpts := confirm.Flags(fs)
+	fs.Parse(args)
+
+	if *keepDays <= 0 {
+		fmt.Fprintln(os.Stderr, "-keep-days must be positive")
+		os.Exit(1)
+	}
+	cutoff := time.Now().UTC().AddDate(0, 0, -*keepDays)
+	records, err := history.Read(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "history prune failed: %v\n", err)
+		os.Exit(1)
+	}
+	var old []string
+	for _, rec := range records {
+		if rec.Timestamp.Before(cutoff) {
+			old = append(old, fmt.Sprintf("%s %s %s", rec.Timestamp.Format(time.RFC3339), rec.Command, rec.Source))
+		}
+	}
+	if len(old) > 0 {
+		err := confirm.Ask(confirmOpts, confirm.Plan{
+			Action: fmt.Sprintf("remove runs older than %s from %s", cutoff.Format(time.RFC3339), *file),
+			Count:  len(old),
+			Unit:   "runs",
+			Bytes:  -1,
+			Paths:  old,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "history prune failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	removed, err := history.Prune(*file, cutoff)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "history prune failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("removed %d runs older than %s from %s\n", removed, cutoff.Format(time.RFC3339), *file)
+}
+
+func parseHistoryColumns(value string) ([]string, error) {
+	var cols []string
+	for _, col := range strings.Split(value, ",") {
+		col = strings.TrimSpace(col)
+		if col == "" {
+			continue
+		}
+		if historyValue(history.Record{}, col) == nil {
+			return nil, fmt.Errorf("unknown history column %q (expected %s)", col, strings.Join(historyColumns, ", "))
+		}
+		cols = append(cols, col)
+	}
+	if len(cols) == 0 {
+		return nil, fmt.Errorf("-columns must name at least one column")
+	}
+	return cols, nil
+}
+
+// parseHistoryTime accepts a date, taken as midnight UTC, or an RFC 3339
+// timestamp. An empty value is the zero time, meaning no bound.
+func parseHistoryTime(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q: expected 2006-01-02 or RFC 3339", name, value)
+	}
+	return t, nil
+}
+
+// historyValue returns column col of rec, or nil for an unknown column.
+func historyValue(rec history.Record, col string) any {
+	switch col {
+	case "timestamp":
+		return rec.Timestamp.UTC().Format(time.RFC3339)
+	case "command":
+		return rec.Command
+	case "source":
+		return rec.Source
+	case "run_id":
+		return rec.RunID
+	case "files":
+		return rec.Files
+	case "input_bytes":
+		return rec.InputBytes
+	case "output_bytes":
+		return rec.OutputBytes
+	case "ratio":
+		return rec.Ratio
+	case "duration_seconds":
+		return rec.DurationSeconds
+	case "level":
+		return rec.Level
+	case "dict_id":
+		return rec.DictID
+	}
+	return nil
+}
+
+func writeHistoryCSV(w io.Writer, records []history.Record, cols []string) error {
+	out := csv.NewWriter(w)
+	out.Write(cols)
+	row := make([]string, len(cols))
+	for _, rec := range records {
+		for i, col := range cols {
+			switch v := historyValue(rec, col).(type) {
+			case float64:
+				row[i] = strconv.FormatFloat(v, 'f', -1, 64)
+			default:
+				row[i] = fmt.Sprint(v)
+			}
+		}
+		out.Write(row)
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// writeHistoryJSON writes one object per run with the selected columns in
+// the requested order.
+func writeHistoryJSON(w io.Writer, records []history.Record, cols []string) error {
+	var buf strings.Builder
+	buf.WriteString("[")
+	for i, rec := range records {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n  {")
+		for j, col := range cols {
+			value, err := json.Marshal(historyValue(rec, col))
+			if err != nil {
+				return err
+			}
+			if j > 0 {
+				buf.WriteString(", ")
+			}
+			fmt.Fprintf(&buf, "%q: %s", col, value)
+		}
+		buf.WriteString("}")
+	}
+	if len(records) > 0 {
+		buf.WriteString("\n")
+	}
+	buf.WriteString("]\n")
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
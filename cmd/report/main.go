@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: report diff [flags] <old.json> <new.json> | report stats-diff [flags] <before.json> <after.json> | report history <export|prune> [flags] | report metrics flush [flags]")
+		os.Exit(1)
+	}
+	switch os.Args[1] {
+	case "diff":
+		runDiff(os.Args[2:])
+	case "stats-diff":
+		runStatsDiff(os.Args[2:])
+	case "history":
+		runHistory(os.Args[2:])
+	case "metrics":
+		runMetrics(os.Args[2:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown subcommand %q (expected diff, stats-diff, history, metrics)\n", os.Args[1])
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"zstd-learning/internal/pushspool"
+)
+
+func runMetrics(args []string) {
+	if len(args) == 0 || args[0] != "flush" {
+		fmt.Fprintln(os.Stderr, "usage: report metrics flush [flags]")
+		os.Exit(1)
+	}
+	fs := flag.NewFlagSet("metrics flush", flag.ExitOnError)
+	pushURL := fs.String("pushgateway", "http://localhost:9091", "Pushgateway base URL")
+	spool := pushspool.Flags(fs)
+	fs.Parse(args[1:])
+
+	if spool.Dir == "" {
+		fmt.Fprintln(os.Stderr, "-push-spool-dir is required")
+		os.Exit(1)
+	}
+	pushed, err := pushspool.Flush(spool, *pushURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "metrics flush failed after %d pushes: %v\n", pushed, err)
+		os.Exit(1)
+	}
+	fmt.Printf("pushed %d spooled metric pushes from %s\n", pushed, spool.Dir)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"zstd-learning/internal/size"
+	"zstd-learning/internal/summary"
+)
+
+// statDelta compares one number of two run summaries. Change is the relative
+// change in percent, and is omitted when the before value is zero.
+type statDelta struct {
+	Metric     string   `json:"metric"`
+	Before     float64  `json:"before"`
+	After      float64  `json:"after"`
+	Change     *float64 `json:"change_percent,omitempty"`
+	Regression bool     `json:"regression"`
+}
+
+type statsDiff struct {
+	Before      summary.Summary `json:"before"`
+	After       summary.Summary `json:"after"`
+	Threshold   float64         `json:"threshold_percent"`
+	Deltas      []statDelta     `json:"deltas"`
+	Regressions int             `json:"regressions"`
+}
+
+func runStatsDiff(args []string) {
+	fs := flag.NewFlagSet("stats-diff", flag.ExitOnError)
+	threshold := fs.Float64("threshold", 5, "flag the ratio or duration as a regression when it grew by more than this many percent")
+	asJSON := fs.Bool("json", false, "print the comparison as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: report stats-diff [flags] <before.json> <after.json>")
+		fmt.Fprintln(fs.Output(), "Compares the -summary-format json output of two runs and exits with status 3 when a regression exceeds -threshold.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *threshold < 0 {
+		fmt.Fprintln(os.Stderr, "-threshold must not be negative")
+		os.Exit(1)
+	}
+
+	before, err := readSummary(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read summary: %v\n", err)
+		os.Exit(1)
+	}
+	after, err := readSummary(fs.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read summary: %v\n", err)
+		os.Exit(1)
+	}
+	if before.Action != after.Action {
+		fmt.Fprintf(os.Stderr, "warning: comparing a %s run with a %s run\n", before.Action, after.Action)
+	}
+
+	diff := diffSummaries(before, after, *threshold)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(diff)
+	} else {
+		err = printStatsDiff(os.Stdout, diff)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if diff.Regressions > 0 {
+		os.Exit(exitRegression)
+	}
+}
+
+// readSummary returns the last summary in path. Tools print other lines
+// before their JSON summary, so a saved stdout is accepted as is: lines that
+// are not a summary object are skipped.
+func readSummary(path string) (summary.Summary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return summary.Summary{}, err
+	}
+	defer f.Close()
+
+	var found *summary.Summary
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var s summary.Summary
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil || s.Action == "" {
+			continue
+		}
+		found = &s
+	}
+	if err := scanner.Err(); err != nil {
+		return summary.Summary{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if found == nil {
+		return summary.Summary{}, fmt.Errorf("%s: no -summary-format json line found", path)
+	}
+	return *found, nil
+}
+
+// diffSummaries compares two summaries. Only the ratio and the duration,
+// for both of which larger is worse, can be regressions; sizes and files
+// are reported for context, since whether more bytes is worse depends on
+// the tool.
+func diffSummaries(before, after summary.Summary, threshold float64) statsDiff {
+	diff := statsDiff{Before: before, After: after, Threshold: threshold}
+	add := func(metric string, b, a float64, gated bool) {
+		d := statDelta{Metric: metric, Before: b, After: a}
+		if b != 0 {
+			change := (a - b) / b * 100
+			d.Change = &change
+			d.Regression = gated && change > threshold
+		}
+		if d.Regression {
+			diff.Regressions++
+		}
+		diff.Deltas = append(diff.Deltas, d)
+	}
+	add("ratio", before.Ratio, after.Ratio, true)
+	add("duration_seconds", before.DurationSeconds, after.DurationSeconds, true)
+	add("input_bytes", float64(before.InputBytes), float64(after.InputBytes), false)
+	add("output_bytes", float64(before.OutputBytes), float64(after.OutputBytes), false)
+	add("files", float64(before.Files), float64(after.Files), false)
+	return diff
+}
+
+func printStatsDiff(w io.Writer, diff statsDiff) error {
+	fmt.Fprintf(w, "%s run: %d regressions over %.1f%%\n", diff.After.Action, diff.Regressions, diff.Threshold)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "METRIC\tBEFORE\tAFTER\tCHANGE\t")
+	for _, d := range diff.Deltas {
+		change := "n/a"
+		if d.Change != nil {
+			change = fmt.Sprintf("%+.1f%%", *d.Change)
+		}
+		note := ""
+		if d.Regression {
+			note = "REGRESSION"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", d.Metric, formatStat(d.Metric, d.Before), formatStat(d.Metric, d.After), change, note)
+	}
+	return tw.Flush()
+}
+
+func formatStat(metric string, v float64) string {
+	switch metric {
+	case "ratio":
+		return strconv.FormatFloat(v, 'f', 4, 64)
+	case "duration_seconds":
+		return strconv.FormatFloat(v, 'f', 3, 64) + "s"
+	case "input_bytes", "output_bytes":
+		return size.Format(int64(v))
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"zstd-learning/internal/summary"
+)
+
+// writeSummary saves s as a run's stdout would have it: a progress line and
+// then the -summary-format json line.
+func writeSummary(t *testing.T, s summary.Summary) string {
+	t.Helper()
+	line, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "summary.json")
+	if err := os.WriteFile(path, append([]byte("compressed 3 files\n"), append(line, '\n')...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+var baseline = summary.Summary{Action: "compress", Files: 10, InputBytes: 1000, OutputBytes: 250, Ratio: 0.25, DurationSeconds: 2}
+
+func TestDiffSummaries(t *testing.T) {
+	tests := []struct {
+		name        string
+		after       summary.Summary
+		regressions []string
+	}{
+		{"unchanged", baseline, nil},
+		{"within the threshold", summary.Summary{Action: "compress", Files: 10, InputBytes: 1000, OutputBytes: 260, Ratio: 0.26, DurationSeconds: 2.08}, nil},
+		{"ratio", summary.Summary{Action: "compress", Files: 10, InputBytes: 1000, OutputBytes: 300, Ratio: 0.30, DurationSeconds: 2}, []string{"ratio"}},
+		{"both", summary.Summary{Action: "compress", Files: 10, InputBytes: 1000, OutputBytes: 300, Ratio: 0.30, DurationSeconds: 3}, []string{"ratio", "duration_seconds"}},
+		{"improvement", summary.Summary{Action: "compress", Files: 10, InputBytes: 1000, OutputBytes: 100, Ratio: 0.10, DurationSeconds: 1}, nil},
+		// Sizes and file counts are context only, however far they move.
+		{"more bytes", summary.Summary{Action: "compress", Files: 40, InputBytes: 4000, OutputBytes: 1000, Ratio: 0.25, DurationSeconds: 2}, nil},
+	}
+	for _, tt := range tests {
+		diff := diffSummaries(baseline, tt.after, 5)
+		var got []string
+		for _, d := range diff.Deltas {
+			if d.Regression {
+				got = append(got, d.Metric)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(tt.regressions, ",") || diff.Regressions != len(tt.regressions) {
+			t.Errorf("%s: regressions %q (%d), want %q", tt.name, got, diff.Regressions, tt.regressions)
+		}
+	}
+
+	diff := diffSummaries(baseline, tests[2].after, 5)
+	if d := diff.Deltas[0]; d.Metric != "ratio" || d.Change == nil || *d.Change < 19.99 || *d.Change > 20.01 {
+		t.Errorf("ratio delta %+v, want +20%%", d)
+	}
+	// A zero before value has no percentage change and cannot regress.
+	zero := baseline
+	zero.DurationSeconds = 0
+	if d := diffSummaries(zero, baseline, 5).Deltas[1]; d.Change != nil || d.Regression {
+		t.Errorf("duration delta from zero %+v, want no change and no regression", d)
+	}
+}
+
+func TestReadSummary(t *testing.T) {
+	got, err := readSummary(writeSummary(t, baseline))
+	if err != nil || got != baseline {
+		t.Errorf("readSummary = %+v, %v; want %+v", got, err, baseline)
+	}
+	path := filepath.Join(t.TempDir(), "plain.txt")
+	if err := os.WriteFile(path, []byte("compressed 3 files\n{\"other\":1}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSummary(path); err == nil || !strings.Contains(err.Error(), "no -summary-format json line") {
+		t.Errorf("a file without a summary: got %v", err)
+	}
+}
+
+func TestStatsDiff(t *testing.T) {
+	before := writeSummary(t, baseline)
+	worse := baseline
+	worse.OutputBytes, worse.Ratio = 300, 0.30
+
+	code, output := run(t, "stats-diff", before, writeSummary(t, worse))
+	if code != exitRegression {
+		t.Fatalf("exit %d, want %d, output:\n%s", code, exitRegression, output)
+	}
+	for _, want := range []string{"compress run: 1 regressions over 5.0%", "+20.0%", "REGRESSION"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output lacks %q:\n%s", want, output)
+		}
+	}
+
+	if code, output := run(t, "stats-diff", "-threshold", "25", before, writeSummary(t, worse)); code != 0 {
+		t.Errorf("with -threshold 25: exit %d, want 0, output:\n%s", code, output)
+	}
+
+	code, output = run(t, "stats-diff", "-json", before, writeSummary(t, worse))
+	var diff statsDiff
+	if err := json.Unmarshal([]byte(output), &diff); err != nil || code != exitRegression || diff.Regressions != 1 {
+		t.Errorf("-json: exit %d, %d regressions, %v, output:\n%s", code, diff.Regressions, err, output)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	"zstd-learning/internal/decpool"
+	"zstd-learning/internal/encpool"
+	"zstd-learning/internal/size"
+	"zstd-learning/pkg/zstdhttp"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "listen address")
+	staticDir := flag.String("dir", "output", "directory served under /files/")
+	level := flag.Int("level", 0, "zstd compression level (0=default, 1..22 supported)")
+	useDict := flag.Bool("use-dict", false, "enable dictionary compression")
+	dictPath := flag.String("dict", "", "path to zstd dictionary file")
+	middleware := flag.Bool("middleware", false, "negotiate Content-Encoding (zstd, gzip) for all responses and decode compressed request bodies")
+	noGzip := flag.Bool("middleware-no-gzip", false, "do not fall back to gzip when the client does not accept zstd")
+	middlewareDict := flag.Bool("middleware-dict", false, "also use the dictionary for negotiated zstd responses (clients must hold the same dictionary)")
+	maxRequestBody := flag.String("middleware-max-request-body", "32MiB", "largest decoded size of a compressed request body the middleware accepts (0 = no limit)")
+	flag.Parse()
+
+	if *useDict && strings.TrimSpace(*dictPath) == "" {
+		fmt.Fprintln(os.Stderr, "-dict is required when -use-dict is set")
+		os.Exit(1)
+	}
+	maxRequestBytes, err := size.Parse(*maxRequestBody)
+	if err != nil || maxRequestBytes < 0 {
+		fmt.Fprintf(os.Stderr, "invalid -middleware-max-request-body %q\n", *maxRequestBody)
+		os.Exit(1)
+	}
+	if maxRequestBytes == 0 {
+		maxRequestBytes = -1
+	}
+
+	var dictBytes []byte
+	if *useDict {
+		var err error
+		dictBytes, err = os.ReadFile(*dictPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read dict: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	srv, err := newServer(*level, dictBytes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create codec: %v\n", err)
+		os.Exit(1)
+	}
+
+	mux := routes(srv, newServerMetrics(), *staticDir)
+	var handler http.Handler = mux
+	if *middleware {
+		opts := zstdhttp.Options{DisableGzip: *noGzip, MaxRequestBodySize: maxRequestBytes}
+		if *level != 0 {
+			opts.Level = zstd.EncoderLevelFromZstd(*level)
+		}
+		if len(dictBytes) > 0 {
+			opts.DecoderDicts = [][]byte{dictBytes}
+			if *middlewareDict {
+				opts.EncoderDict = dictBytes
+			}
+		}
+		handler, err = zstdhttp.Handler(mux, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create middleware: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Printf("serving on %s (middleware=%t)\n", *addr, *middleware)
+	if err := http.ListenAndServe(*addr, handler); err != nil {
+		fmt.Fprintf(os.Stderr, "server failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// routes registers the endpoints, counting the served ones in metrics.
+func routes(srv *server, metrics *serverMetrics, staticDir string) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("POST /compress", metrics.instrument("compress", http.HandlerFunc(srv.handleCompress)))
+	mux.Handle("POST /decompress", metrics.instrument("decompress", http.HandlerFunc(srv.handleDecompress)))
+	mux.Handle("GET /files/", metrics.instrument("files", http.StripPrefix("/files/", http.FileServer(http.Dir(staticDir)))))
+	mux.Handle("GET /metrics", metrics.handler())
+	mux.HandleFunc("GET /healthz", handleHealthz)
+	return mux
+}
+
+type server struct {
+	// encoders and decoders are reused across requests, which saves
+	// rebuilding the dictionary tables for every /compress and /decompress
+	// call.
+	encoders *encpool.Pool
+	decoders *decpool.Pool
+}
+
+func newServer(level int, dictBytes []byte) (*server, error) {
+	srv := &server{}
+	var encoderLevel zstd.EncoderLevel
+	if level != 0 {
+		encoderLevel = zstd.EncoderLevelFromZstd(level)
+	}
+	var dicts [][]byte
+	if len(dictBytes) > 0 {
+		dicts = [][]byte{dictBytes}
+	}
+
+	var err error
+	srv.encoders, err = encpool.For(encoderLevel, dictBytes)
+	if err != nil {
+		return nil, err
+	}
+	srv.decoders, err = decpool.For(dicts)
+	if err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
+
+func (s *server) handleCompress(w http.ResponseWriter, r *http.Request) {
+	encoder, err := s.encoders.Get(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer s.encoders.Put(encoder)
+	// The body is already zstd, so the middleware must not encode it again.
+	w.Header().Set("Content-Type", "application/zstd")
+	if _, err := io.Copy(encoder, r.Body); err != nil {
+		encoder.Close()
+		http.Error(w, err.Error(), bodyErrorStatus(err))
+		return
+	}
+	if err := encoder.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *server) handleDecompress(w http.ResponseWriter, r *http.Request) {
+	decoder, err := s.decoders.Get(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer s.decoders.Put(decoder)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := io.Copy(w, decoder); err != nil {
+		http.Error(w, err.Error(), bodyErrorStatus(err))
+	}
+}
+
+// bodyErrorStatus is the status for a failure to read a request body: 413
+// past the -middleware-max-request-body limit, 400 otherwise.
+func bodyErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
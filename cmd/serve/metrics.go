@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// serverMetrics holds the in-process counters exposed on /metrics. Unlike
+// the batch commands, serve runs long enough to be scraped, so nothing is
+// pushed to a Pushgateway.
+type serverMetrics struct {
+	registry      *prometheus.Registry
+	requests      *prometheus.CounterVec
+	requestBytes  *prometheus.CounterVec
+	responseBytes *prometheus.CounterVec
+	errors        *prometheus.CounterVec
+}
+
+func newServerMetrics() *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "serve_requests_total",
+			Help: "Requests served, by route and status code.",
+		}, []string{"route", "code"}),
+		requestBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "serve_request_bytes_total",
+			Help: "Request body bytes read, by route.",
+		}, []string{"route"}),
+		responseBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "serve_response_bytes_total",
+			Help: "Response body bytes written, by route.",
+		}, []string{"route"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "serve_errors_total",
+			Help: "Requests that ended with a 4xx or 5xx status, by route.",
+		}, []string{"route"}),
+	}
+	m.registry.MustRegister(m.requests, m.requestBytes, m.responseBytes, m.errors)
+	return m
+}
+
+func (m *serverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// instrument counts requests, body bytes and errors for route. Byte counts
+// are measured at the handler, before any middleware encoding.
+func (m *serverMetrics) instrument(route string, next http.Handler) http.Handler {
+	m.requestBytes.WithLabelValues(route)
+	m.responseBytes.WithLabelValues(route)
+	m.errors.WithLabelValues(route)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := &countingReader{r: r.Body}
+		r.Body = body
+		rec := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		m.requests.WithLabelValues(route, strconv.Itoa(rec.status)).Inc()
+		m.requestBytes.WithLabelValues(route).Add(float64(body.n))
+		m.responseBytes.WithLabelValues(route).Add(float64(rec.n))
+		if rec.status >= http.StatusBadRequest {
+			m.errors.WithLabelValues(route).Inc()
+		}
+	})
+}
+
+func handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, "ok\n")
+}
+
+type countingReader struct {
+	r io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	return c.r.Close()
+}
+
+type recordingWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	n           int64
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
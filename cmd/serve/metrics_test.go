@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// scrape fetches /metrics and returns every series as its name and sorted
+// labels, such as serve_requests_total{code=200,route=compress}, mapped to
+// its value.
+func scrape(t *testing.T, url string) map[string]float64 {
+	t.Helper()
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	dec := expfmt.NewDecoder(resp.Body, expfmt.ResponseFormat(resp.Header))
+	series := map[string]float64{}
+	for {
+		var family dto.MetricFamily
+		if err := dec.Decode(&family); err == io.EOF {
+			return series
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		for _, metric := range family.Metric {
+			var labels []string
+			for _, label := range metric.Label {
+				labels = append(labels, label.GetName()+"="+label.GetValue())
+			}
+			sort.Strings(labels)
+			series[family.GetName()+"{"+strings.Join(labels, ",")+"}"] = metric.GetCounter().GetValue()
+		}
+	}
+}
+
+func post(t *testing.T, url string, body []byte) (int, []byte) {
+	t.Helper()
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, data
+}
+
+func TestMetricsCountRequests(t *testing.T) {
+	srv, err := newServer(0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(routes(srv, newServerMetrics(), t.TempDir()))
+	defer ts.Close()
+
+	before := scrape(t, ts.URL)
+	for _, name := range []string{
+		"serve_request_bytes_total{route=compress}",
+		"serve_response_bytes_total{route=decompress}",
+		"serve_errors_total{route=files}",
+	} {
+		if v, ok := before[name]; !ok || v != 0 {
+			t.Errorf("before any request, %s = %v (present %v), want 0", name, v, ok)
+		}
+	}
+
+	plain := []byte(strings.Repeat(`{"id":1,"name":"user-1"}`+"\n", 100))
+	code, compressed := post(t, ts.URL+"/compress", plain)
+	if code != http.StatusOK {
+		t.Fatalf("/compress: status %d", code)
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	if got, err := decoder.DecodeAll(compressed, nil); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("/compress returned a body that does not decode: %v", err)
+	}
+	if code, _ := post(t, ts.URL+"/decompress", []byte("not zstd")); code != http.StatusBadRequest {
+		t.Errorf("/decompress of junk: status %d, want 400", code)
+	}
+
+	after := scrape(t, ts.URL)
+	want := map[string]float64{
+		"serve_requests_total{code=200,route=compress}":   1,
+		"serve_request_bytes_total{route=compress}":       float64(len(plain)),
+		"serve_response_bytes_total{route=compress}":      float64(len(compressed)),
+		"serve_errors_total{route=compress}":              0,
+		"serve_requests_total{code=400,route=decompress}": 1,
+		"serve_errors_total{route=decompress}":            1,
+	}
+	for name, value := range want {
+		if got, ok := after[name]; !ok || got != value {
+			t.Errorf("%s = %v (present %v), want %v", name, got, ok, value)
+		}
+	}
+	// The decoder stops at the bad magic number, and only what it read
+	// counts.
+	if got := after["serve_request_bytes_total{route=decompress}"]; got == 0 || got > float64(len("not zstd")) {
+		t.Errorf("serve_request_bytes_total{route=decompress} = %v, want 1 to %d", got, len("not zstd"))
+	}
+	if _, ok := after["serve_requests_total{code=200,route=metrics}"]; ok {
+		t.Error("scrapes of /metrics are counted")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// autoSizeOptions configures -auto-size: dictionary sizes from MinSize
+// doubling up to MaxSize are each trained and scored on the held-out
+// samples.
+type autoSizeOptions struct {
+	MinSize int
+	MaxSize int
+	Holdout float64
+	// TargetRatio, when positive, stops the search at the first (and so
+	// smallest) size whose holdout ratio is at or below it.
+	TargetRatio float64
+	// EvalSample, when positive, scores each size on at most that many
+	// holdout samples, picked at random with Seed, so large corpora stay
+	// quick to tune.
+	EvalSample int
+	Seed       int64
+	// Notes receives a line per size tried.
+	Notes io.Writer
+}
+
+// sizeTrial is one size tried by -auto-size.
+type sizeTrial struct {
+	Size      int     `json:"size"`
+	DictBytes int     `json:"dict_bytes"`
+	Ratio     float64 `json:"holdout_ratio"`
+}
+
+// autoSizeResult is the outcome of -auto-size. Dict is the dictionary of
+// the selected trial, trained on the samples outside the holdout set.
+type autoSizeResult struct {
+	Trials      []sizeTrial `json:"trials"`
+	Selected    int         `json:"selected_size"`
+	Ratio       float64     `json:"holdout_ratio"`
+	TargetRatio float64     `json:"target_ratio,omitempty"`
+	TargetMet   bool        `json:"target_met"`
+	Holdout     int         `json:"holdout_samples"`
+	// EvalSamples is how many of the holdout samples were scored.
+	EvalSamples int    `json:"eval_samples"`
+	Dict        []byte `json:"-"`
+}
+
+// autoSizes returns the sizes -auto-size tries: minSize doubling up to
+// maxSize, with maxSize itself always tried last.
+func autoSizes(minSize, maxSize int) []int {
+	var sizes []int
+	for size := minSize; size < maxSize; size *= 2 {
+		sizes = append(sizes, size)
+	}
+	return append(sizes, maxSize)
+}
+
+// splitHoldout puts every n-th sample into the holdout set, where n is the
+// closest whole step to the holdout fraction.
+func splitHoldout(samples [][]byte, fraction float64) (train, holdout [][]byte) {
+	step := int(1/fraction + 0.5)
+	if step < 2 {
+		step = 2
+	}
+	for i, sample := range samples {
+		if i%step == step-1 {
+			holdout = append(holdout, sample)
+		} else {
+			train = append(train, sample)
+		}
+	}
+	return train, holdout
+}
+
+// sampleHoldout returns n of the holdout samples picked at random with
+// seed, in their original order, or all of them when n is 0 or covers them.
+func sampleHoldout(holdout [][]byte, n int, seed int64) [][]byte {
+	if n <= 0 || n >= len(holdout) {
+		return holdout
+	}
+	picked := rand.New(rand.NewSource(seed)).Perm(len(holdout))[:n]
+	sort.Ints(picked)
+	sampled := make([][]byte, n)
+	for i, index := range picked {
+		sampled[i] = holdout[index]
+	}
+	return sampled
+}
+
+// autoSize trains a dictionary at each candidate size and keeps the best
+// holdout ratio, or, with a target, the smallest size that reaches it.
+// When no size reaches the target the best one found is selected and
+// TargetMet stays false.
+func autoSize(samples [][]byte, opts autoSizeOptions, train func(samples [][]byte, size int) ([]byte, error)) (autoSizeResult, error) {
+	trainSet, holdout := splitHoldout(samples, opts.Holdout)
+	result := autoSizeResult{TargetRatio: opts.TargetRatio, Holdout: len(holdout)}
+	if len(trainSet) < minTrainSamples || len(holdout) == 0 {
+		return result, fmt.Errorf("-auto-size needs at least %d training and 1 holdout sample, got %d and %d; raise -holdout or collect more samples", minTrainSamples, len(trainSet), len(holdout))
+	}
+	holdout = sampleHoldout(holdout, opts.EvalSample, opts.Seed)
+	result.EvalSamples = len(holdout)
+	if result.EvalSamples < result.Holdout {
+		fmt.Fprintf(opts.Notes, "  auto-size: scoring on %d of %d holdout samples (-eval-seed %d)\n", result.EvalSamples, result.Holdout, opts.Seed)
+	}
+	var holdoutBytes int64
+	for _, sample := range holdout {
+		holdoutBytes += int64(len(sample))
+	}
+
+	for _, size := range autoSizes(opts.MinSize, opts.MaxSize) {
+		trained, err := train(trainSet, size)
+		if err != nil {
+			return result, fmt.Errorf("size %d: %w", size, err)
+		}
+		compressed, err := holdoutCompressedBytes(trained, holdout)
+		if err != nil {
+			return result, fmt.Errorf("size %d: %w", size, err)
+		}
+		trial := sizeTrial{Size: size, DictBytes: len(trained), Ratio: ratioOf(compressed, holdoutBytes)}
+		result.Trials = append(result.Trials, trial)
+		fmt.Fprintf(opts.Notes, "  auto-size %7d: %6d byte dictionary, holdout ratio %.4f\n", size, trial.DictBytes, trial.Ratio)
+
+		if result.Dict == nil || trial.Ratio < result.Ratio {
+			result.Selected, result.Ratio, result.Dict = size, trial.Ratio, trained
+		}
+		if opts.TargetRatio > 0 && trial.Ratio <= opts.TargetRatio {
+			result.Selected, result.Ratio, result.Dict = size, trial.Ratio, trained
+			result.TargetMet = true
+			break
+		}
+	}
+	return result, nil
+}
+
+// holdoutCompressedBytes compresses each holdout sample on its own with
+// dictionary, as compress would compress small files, and sums the sizes.
+func holdoutCompressedBytes(dictionary []byte, holdout [][]byte) (int64, error) {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderDict(dictionary))
+	if err != nil {
+		return 0, err
+	}
+	defer encoder.Close()
+
+	var total int64
+	var dst []byte
+	for _, sample := range holdout {
+		dst = encoder.EncodeAll(sample, dst[:0])
+		total += int64(len(dst))
+	}
+	return total, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/klauspost/compress/dict"
+)
+
+// trainRecording trains real dictionaries and records the sizes asked for.
+func trainRecording(sizes *[]int) func([][]byte, int) ([]byte, error) {
+	return func(samples [][]byte, size int) ([]byte, error) {
+		*sizes = append(*sizes, size)
+		return dict.BuildZstdDict(samples, dict.Options{MaxDictSize: size, HashBytes: 6, ZstdDictID: 1})
+	}
+}
+
+func TestAutoSizeTargetRatio(t *testing.T) {
+	samples := bytes.Split(bytes.TrimSpace(generated(t, "people", "ndjson", 200)), []byte("\n"))
+	opts := autoSizeOptions{MinSize: 1024, MaxSize: 4096, Holdout: 0.1, Notes: io.Discard}
+	all := []int{1024, 2048, 4096}
+
+	// A lenient target is met by the smallest size, so the search stops
+	// there.
+	opts.TargetRatio = 0.95
+	var tried []int
+	lenient, err := autoSize(samples, opts, trainRecording(&tried))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tried, []int{1024}) || !lenient.TargetMet || lenient.Selected != 1024 || lenient.Ratio > 0.95 {
+		t.Errorf("lenient target: tried %v, selected %d with ratio %.4f (met %v); want only 1024", tried, lenient.Selected, lenient.Ratio, lenient.TargetMet)
+	}
+	if lenient.Dict == nil || len(lenient.Trials) != 1 {
+		t.Errorf("lenient target: %d trials, dictionary %d bytes", len(lenient.Trials), len(lenient.Dict))
+	}
+
+	// A target no size reaches tries them all and reports the best.
+	opts.TargetRatio = 0.001
+	tried = nil
+	missed, err := autoSize(samples, opts, trainRecording(&tried))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tried, all) || missed.TargetMet {
+		t.Errorf("unreachable target: tried %v (target met %v), want %v", tried, missed.TargetMet, all)
+	}
+	for _, trial := range missed.Trials {
+		if trial.Ratio < missed.Ratio {
+			t.Errorf("unreachable target: selected %d with ratio %.4f, but %d got %.4f", missed.Selected, missed.Ratio, trial.Size, trial.Ratio)
+		}
+	}
+}
+
+func TestAutoSizePushesTheSelection(t *testing.T) {
+	url, pushed := fakeGateway(t)
+	code, out := run(t, "-generate", "people", "-generate-count", "300", "-generate-seed", "1", "-split", "json",
+		"-auto-size", "-auto-size-min", "1024", "-dict-size", "8192", "-target-ratio", "0.95",
+		"-out", t.TempDir(), "-pushgateway", url)
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, out)
+	}
+	gauges := pushed()
+	if gauges["dict_auto_size_selected_bytes"] != 1024 || gauges["dict_auto_size_target_met"] != 1 {
+		t.Errorf("pushed selected size %v, target met %v; want 1024 and 1", gauges["dict_auto_size_selected_bytes"], gauges["dict_auto_size_target_met"])
+	}
+	if ratio := gauges["dict_auto_size_holdout_ratio"]; ratio <= 0 || ratio > 0.95 {
+		t.Errorf("pushed holdout ratio %v, want at most the 0.95 target", ratio)
+	}
+}
+
+func TestSampleHoldout(t *testing.T) {
+	var holdout [][]byte
+	for i := 0; i < 50; i++ {
+		holdout = append(holdout, []byte{byte(i)})
+	}
+	picked := sampleHoldout(holdout, 10, 7)
+	if len(picked) != 10 {
+		t.Fatalf("picked %d samples, want 10", len(picked))
+	}
+	for i := 1; i < len(picked); i++ {
+		if picked[i][0] <= picked[i-1][0] {
+			t.Fatalf("picked %v, want distinct samples in their original order", picked)
+		}
+	}
+	if again := sampleHoldout(holdout, 10, 7); !reflect.DeepEqual(again, picked) {
+		t.Errorf("seed 7 picked %v, then %v", picked, again)
+	}
+	if other := sampleHoldout(holdout, 10, 8); reflect.DeepEqual(other, picked) {
+		t.Error("seeds 7 and 8 picked the same samples")
+	}
+	// The first ten would be what a cap without sampling keeps.
+	if reflect.DeepEqual(picked, holdout[:10]) {
+		t.Error("picked the first ten samples")
+	}
+	for _, n := range []int{0, 50, 80} {
+		if got := sampleHoldout(holdout, n, 7); len(got) != len(holdout) {
+			t.Errorf("n %d: picked %d samples, want all %d", n, len(got), len(holdout))
+		}
+	}
+}
+
+// TestAutoSizeEvalSample checks that -eval-sample caps the holdout samples
+// each size is scored on, and that the run says how many it used.
+func TestAutoSizeEvalSample(t *testing.T) {
+	samples := bytes.Split(bytes.TrimSpace(generated(t, "people", "ndjson", 200)), []byte("\n"))
+	var notes bytes.Buffer
+	opts := autoSizeOptions{MinSize: 1024, MaxSize: 1024, Holdout: 0.1, EvalSample: 5, Seed: 3, Notes: &notes}
+	var tried []int
+	result, err := autoSize(samples, opts, trainRecording(&tried))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Holdout != 20 || result.EvalSamples != 5 {
+		t.Errorf("scored %d of %d holdout samples, want 5 of 20", result.EvalSamples, result.Holdout)
+	}
+	if want := "scoring on 5 of 20 holdout samples (-eval-seed 3)"; !bytes.Contains(notes.Bytes(), []byte(want)) {
+		t.Errorf("notes lack %q:\n%s", want, notes.String())
+	}
+
+	// The ratio is that of the five picked samples alone.
+	_, holdout := splitHoldout(samples, opts.Holdout)
+	picked := sampleHoldout(holdout, 5, 3)
+	compressed, err := holdoutCompressedBytes(result.Dict, picked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, sample := range picked {
+		size += int64(len(sample))
+	}
+	if want := ratioOf(compressed, size); result.Ratio != want {
+		t.Errorf("holdout ratio %.4f, want %.4f over the picked samples", result.Ratio, want)
+	}
+
+	opts.EvalSample, notes = 0, bytes.Buffer{}
+	all, err := autoSize(samples, opts, trainRecording(&tried))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all.EvalSamples != 20 || bytes.Contains(notes.Bytes(), []byte("scoring on")) {
+		t.Errorf("without -eval-sample: scored %d samples, notes:\n%s", all.EvalSamples, notes.String())
+	}
+}
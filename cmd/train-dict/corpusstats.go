@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+
+	"zstd-learning/internal/chunker"
+	"zstd-learning/internal/filter"
+	"zstd-learning/internal/size"
+	"zstd-learning/internal/walk"
+)
+
+const (
+	// The recommended -dict-size follows the zstd rule of thumb of about
+	// 100 bytes of samples per dictionary byte, within these bounds.
+	minRecommendedDict = 4 << 10
+	maxRecommendedDict = 128 << 10
+	// quickDictBytes caps the throwaway dictionary used for the redundancy
+	// estimate so the analysis stays fast.
+	quickDictBytes = 16 << 10
+	// defaultAnalyzeBytes bounds the bytes read for the redundancy estimate.
+	defaultAnalyzeBytes = "8MiB"
+)
+
+type corpusStats struct {
+	Inputs     []string        `json:"inputs"`
+	Files      int             `json:"files"`
+	TotalBytes int64           `json:"total_bytes"`
+	Sizes      sizePercentiles `json:"sizes"`
+	Extensions []extensionStat `json:"extensions"`
+	Oldest     *fileTime       `json:"oldest,omitempty"`
+	Newest     *fileTime       `json:"newest,omitempty"`
+	Redundancy redundancy      `json:"redundancy"`
+	// TrainingBytes is what train-dict would read with the given
+	// -max-samples and -max-sample-bytes; RecommendedDictSize derives
+	// from it.
+	TrainingBytes       int64 `json:"training_bytes"`
+	RecommendedDictSize int   `json:"recommended_dict_size"`
+}
+
+type sizePercentiles struct {
+	Min int64 `json:"min"`
+	P50 int64 `json:"p50"`
+	P90 int64 `json:"p90"`
+	P99 int64 `json:"p99"`
+	Max int64 `json:"max"`
+}
+
+type extensionStat struct {
+	Ext   string `json:"ext"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+type fileTime struct {
+	Path    string    `json:"path"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// redundancy estimates how much a dictionary could help. Samples alternate
+// between training a quick dictionary and evaluation; the evaluation samples
+// are compressed one by one without and with it, and once concatenated,
+// which shows the redundancy zstd finds across samples on its own.
+type redundancy struct {
+	Samples       int     `json:"samples"`
+	SampleBytes   int64   `json:"sample_bytes"`
+	PlainRatio    float64 `json:"plain_ratio,omitempty"`
+	DictRatio     float64 `json:"dict_ratio,omitempty"`
+	DictSaved     float64 `json:"dict_saved,omitempty"`
+	ConcatRatio   float64 `json:"concatenated_ratio,omitempty"`
+	CrossFileGain float64 `json:"cross_file_gain,omitempty"`
+	Skipped       string  `json:"skipped,omitempty"`
+}
+
+type corpusOptions struct {
+	Match          *filter.Expr
+	SampleBytes    int64
+	MaxSamples     int
+	MaxSampleBytes int
+	Split          string
+	SpecialFiles   walk.Policy
+}
+
+func runCorpusStats(args []string) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	var inputDirs stringList
+	fs.Var(&inputDirs, "in", "input directory to analyze (repeat for several corpora; default output)")
+	filterExpr := fs.String("filter", "", "only analyze files matching an expression (see internal/filter)")
+	sampleBytes := fs.String("sample-bytes", defaultAnalyzeBytes, "most bytes read for the redundancy estimate")
+	maxSamples := fs.Int("max-samples", 1000, "max-samples planned for training, used for the -dict-size recommendation")
+	maxSampleBytes := fs.Int("max-sample-bytes", 32*1024, "max-sample-bytes planned for training, also the sample size of the estimate")
+	split := fs.String("split", "bytes", "how to cut files into samples, as for training: "+strings.Join(chunker.Modes, ", "))
+	asJSON := fs.Bool("json", false, "print the statistics as JSON")
+	specialFiles := fs.String("special-files", "skip", "what to do with FIFOs, sockets and device nodes, which are never opened: skip or error")
+	fs.Parse(args)
+
+	if len(inputDirs) == 0 {
+		inputDirs = stringList{"output"}
+	}
+	var match *filter.Expr
+	if strings.TrimSpace(*filterExpr) != "" {
+		var err error
+		match, err = filter.Parse(*filterExpr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+	}
+	budget, err := size.Parse(*sampleBytes)
+	if err != nil || budget <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid -sample-bytes %q: must be a positive size\n", *sampleBytes)
+		exit(1)
+	}
+	if *maxSamples <= 0 || *maxSampleBytes <= 0 {
+		fmt.Fprintln(os.Stderr, "max-samples and max-sample-bytes must be positive")
+		exit(1)
+	}
+	if !slices.Contains(chunker.Modes, *split) {
+		fmt.Fprintf(os.Stderr, "invalid -split %q (expected %s)\n", *split, strings.Join(chunker.Modes, ", "))
+		exit(1)
+	}
+	specialPolicy, err := walk.ParsePolicy(*specialFiles)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+
+	analyzeAndPrint(inputDirs, corpusOptions{
+		Match:          match,
+		SampleBytes:    budget,
+		MaxSamples:     *maxSamples,
+		MaxSampleBytes: *maxSampleBytes,
+		Split:          *split,
+		SpecialFiles:   specialPolicy,
+	}, *asJSON)
+}
+
+// analyzeAndPrint runs the analysis for both train-dict stats and
+// train-dict -analyze-only and exits on failure.
+func analyzeAndPrint(dirs []string, opts corpusOptions, asJSON bool) {
+	stats, err := analyzeCorpus(dirs, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to analyze corpus: %v\n", err)
+		exit(1)
+	}
+	if asJSON {
+		data, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+		fmt.Println(string(data))
+		return
+	}
+	printCorpusStats(stats)
+}
+
+func analyzeCorpus(dirs []string, opts corpusOptions) (corpusStats, error) {
+	stats := corpusStats{Inputs: dirs}
+	var paths []string
+	for _, dir := range dirs {
+		found, _, err := walk.Files(dir, opts.Match, opts.SpecialFiles)
+		if err != nil {
+			return stats, err
+		}
+		paths = append(paths, found...)
+	}
+	if len(paths) == 0 {
+		return stats, fmt.Errorf("no files found in %s", strings.Join(dirs, ", "))
+	}
+
+	sizes := make([]int64, 0, len(paths))
+	byExt := map[string]*extensionStat{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return stats, err
+		}
+		sizes = append(sizes, info.Size())
+		stats.TotalBytes += info.Size()
+
+		ext := strings.ToLower(filepath.Ext(path))
+		if ext == "" {
+			ext = "(none)"
+		}
+		e, ok := byExt[ext]
+		if !ok {
+			e = &extensionStat{Ext: ext}
+			byExt[ext] = e
+		}
+		e.Files++
+		e.Bytes += info.Size()
+
+		if stats.Oldest == nil || info.ModTime().Before(stats.Oldest.ModTime) {
+			stats.Oldest = &fileTime{Path: path, ModTime: info.ModTime()}
+		}
+		if stats.Newest == nil || info.ModTime().After(stats.Newest.ModTime) {
+			stats.Newest = &fileTime{Path: path, ModTime: info.ModTime()}
+		}
+	}
+	stats.Files = len(paths)
+
+	slices.Sort(sizes)
+	stats.Sizes = sizePercentiles{
+		Min: sizes[0],
+		P50: percentile(sizes, 50),
+		P90: percentile(sizes, 90),
+		P99: percentile(sizes, 99),
+		Max: sizes[len(sizes)-1],
+	}
+	for _, e := range byExt {
+		stats.Extensions = append(stats.Extensions, *e)
+	}
+	sort.Slice(stats.Extensions, func(i, j int) bool {
+		if stats.Extensions[i].Bytes != stats.Extensions[j].Bytes {
+			return stats.Extensions[i].Bytes > stats.Extensions[j].Bytes
+		}
+		return stats.Extensions[i].Ext < stats.Extensions[j].Ext
+	})
+
+	stats.TrainingBytes = int64(opts.MaxSamples) * int64(opts.MaxSampleBytes)
+	if stats.TotalBytes < stats.TrainingBytes {
+		stats.TrainingBytes = stats.TotalBytes
+	}
+	stats.RecommendedDictSize = recommendDictSize(stats.TrainingBytes)
+
+	samples, err := sampleCorpus(paths, opts)
+	if err != nil {
+		return stats, err
+	}
+	stats.Redundancy = estimateRedundancy(samples, min(stats.RecommendedDictSize, quickDictBytes))
+	return stats, nil
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted values.
+func percentile(sorted []int64, p int) int64 {
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
+
+// recommendDictSize suggests a -dict-size of about 1/100 of the training
+// bytes, rounded down to a power of two.
+func recommendDictSize(trainingBytes int64) int {
+	target := maxRecommendedDict
+	if trainingBytes/100 < maxRecommendedDict {
+		target = int(trainingBytes / 100)
+	}
+	size := minRecommendedDict
+	for size*2 <= target {
+		size *= 2
+	}
+	return size
+}
+
+// sampleCorpus reads chunks spread across paths until opts.SampleBytes have
+// been collected, taking an equal share from each file.
+func sampleCorpus(paths []string, opts corpusOptions) ([][]byte, error) {
+	budget := max(int(opts.SampleBytes/int64(opts.MaxSampleBytes)), 1)
+	perFile := max(budget/len(paths), 1)
+	sampling := sampleOptions{Split: opts.Split, MaxSampleBytes: opts.MaxSampleBytes}
+
+	var samples [][]byte
+	var total int64
+	for _, path := range paths {
+		if total >= opts.SampleBytes {
+			break
+		}
+		chunks, _, err := readSamplesFromFile(context.Background(), path, sampling, perFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, chunk := range chunks {
+			if total >= opts.SampleBytes {
+				break
+			}
+			samples = append(samples, chunk)
+			total += int64(len(chunk))
+		}
+	}
+	return samples, nil
+}
+
+func estimateRedundancy(samples [][]byte, dictSize int) redundancy {
+	var train, eval [][]byte
+	for i, sample := range samples {
+		if i%2 == 0 {
+			train = append(train, sample)
+		} else {
+			eval = append(eval, sample)
+		}
+	}
+	r := redundancy{Samples: len(eval)}
+	for _, sample := range eval {
+		r.SampleBytes += int64(len(sample))
+	}
+	if len(train) < minTrainSamples || len(eval) == 0 {
+		r.Skipped = fmt.Sprintf("only %d samples; lower -max-sample-bytes or add data", len(samples))
+		return r
+	}
+
+	plain, err := zstd.NewWriter(nil)
+	if err != nil {
+		r.Skipped = err.Error()
+		return r
+	}
+	defer plain.Close()
+
+	var plainBytes, concatBytes int64
+	for _, sample := range eval {
+		plainBytes += int64(len(plain.EncodeAll(sample, nil)))
+	}
+	concatBytes = int64(len(plain.EncodeAll(bytes.Join(eval, nil), nil)))
+	r.PlainRatio = ratioOf(plainBytes, r.SampleBytes)
+	r.ConcatRatio = ratioOf(concatBytes, r.SampleBytes)
+	if plainBytes > 0 {
+		r.CrossFileGain = 1 - float64(concatBytes)/float64(plainBytes)
+	}
+
+	trained, err := dict.BuildZstdDict(train, dict.Options{MaxDictSize: dictSize, HashBytes: 6})
+	if err != nil {
+		r.Skipped = fmt.Sprintf("quick dictionary failed: %v", err)
+		return r
+	}
+	withDict, err := zstd.NewWriter(nil, zstd.WithEncoderDict(trained))
+	if err != nil {
+		r.Skipped = fmt.Sprintf("quick dictionary failed: %v", err)
+		return r
+	}
+	defer withDict.Close()
+
+	var dictBytes int64
+	for _, sample := range eval {
+		dictBytes += int64(len(withDict.EncodeAll(sample, nil)))
+	}
+	r.DictRatio = ratioOf(dictBytes, r.SampleBytes)
+	if plainBytes > 0 {
+		r.DictSaved = 1 - float64(dictBytes)/float64(plainBytes)
+	}
+	return r
+}
+
+func ratioOf(output, input int64) float64 {
+	if input <= 0 {
+		return 0
+	}
+	return float64(output) / float64(input)
+}
+
+func printCorpusStats(stats corpusStats) {
+	fmt.Printf("corpus:        %s\n", strings.Join(stats.Inputs, ", "))
+	fmt.Printf("files:         %d (%s)\n", stats.Files, size.Format(stats.TotalBytes))
+	fmt.Printf("file sizes:    min %s, p50 %s, p90 %s, p99 %s, max %s\n",
+		size.Format(stats.Sizes.Min), size.Format(stats.Sizes.P50), size.Format(stats.Sizes.P90), size.Format(stats.Sizes.P99), size.Format(stats.Sizes.Max))
+	if stats.Oldest != nil {
+		fmt.Printf("oldest:        %s  %s\n", stats.Oldest.ModTime.Format(time.RFC3339), stats.Oldest.Path)
+		fmt.Printf("newest:        %s  %s\n", stats.Newest.ModTime.Format(time.RFC3339), stats.Newest.Path)
+	}
+
+	fmt.Println()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "EXT\tFILES\tBYTES")
+	for _, e := range stats.Extensions {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", e.Ext, e.Files, size.Format(e.Bytes))
+	}
+	tw.Flush()
+
+	fmt.Println()
+	r := stats.Redundancy
+	fmt.Printf("redundancy estimate over %d samples (%s):\n", r.Samples, size.Format(r.SampleBytes))
+	if r.PlainRatio > 0 {
+		fmt.Printf("  plain, one by one:       ratio %.3f\n", r.PlainRatio)
+		fmt.Printf("  plain, concatenated:     ratio %.3f (%.1f%% smaller than one by one)\n", r.ConcatRatio, r.CrossFileGain*100)
+	}
+	if r.DictRatio > 0 {
+		fmt.Printf("  dictionary, one by one:  ratio %.3f (%.1f%% smaller than plain)\n", r.DictRatio, r.DictSaved*100)
+	}
+	if r.Skipped != "" {
+		fmt.Printf("  dictionary estimate skipped: %s\n", r.Skipped)
+	}
+
+	fmt.Println()
+	fmt.Printf("recommended -dict-size %d (%s of training data at the planned -max-samples and -max-sample-bytes)\n", stats.RecommendedDictSize, size.Format(stats.TrainingBytes))
+}
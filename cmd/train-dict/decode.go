@@ -0,0 +1,31 @@
+package main
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+
+	"zstd-learning/internal/outpath"
+)
+
+// zstdInputSuffix marks the inputs -decode-zst decompresses while sampling.
+const zstdInputSuffix = ".zst"
+
+// sampleReader returns the content of the sample file path read through r.
+// With opts.DecodeZst, a .zst file is decompressed as it is read, so a
+// dictionary can be trained from a compressed archive without writing the
+// decoded files anywhere; the returned close function releases the decoder.
+func sampleReader(path string, r io.Reader, opts sampleOptions) (io.Reader, func(), error) {
+	if !opts.DecodeZst || !outpath.HasSuffix(path, zstdInputSuffix) {
+		return r, func() {}, nil
+	}
+	options := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+	if len(opts.InputDict) > 0 {
+		options = append(options, zstd.WithDecoderDicts(opts.InputDict))
+	}
+	decoder, err := zstd.NewReader(r, options...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return decoder, decoder.Close, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+// writeCorpus splits generated people records over files in a plain, a
+// compressed and a dictionary-compressed directory, and returns the paths
+// of each and the dictionary.
+func writeCorpus(t *testing.T) (plain, compressed, withDict []string, d []byte) {
+	t.Helper()
+	lines := bytes.SplitAfter(bytes.TrimSpace(generated(t, "people", "ndjson", 200)), []byte("\n"))
+	d, err := dict.BuildZstdDict(lines[:100], dict.Options{MaxDictSize: 4096, HashBytes: 6, ZstdDictID: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	dictEncoder, err := zstd.NewWriter(nil, zstd.WithEncoderDict(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dictEncoder.Close()
+
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	for i := 0; i < 4; i++ {
+		data := bytes.Join(lines[i*50:(i+1)*50], nil)
+		name := fmt.Sprintf("part%d.ndjson", i)
+		for j, out := range [][]byte{data, encoder.EncodeAll(data, nil), dictEncoder.EncodeAll(data, nil)} {
+			path := filepath.Join(dirs[j], name)
+			if j > 0 {
+				path += ".zst"
+			}
+			if err := os.WriteFile(path, out, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			switch j {
+			case 0:
+				plain = append(plain, path)
+			case 1:
+				compressed = append(compressed, path)
+			case 2:
+				withDict = append(withDict, path)
+			}
+		}
+	}
+	return plain, compressed, withDict, d
+}
+
+func TestDecodeZstSamples(t *testing.T) {
+	plain, compressed, withDict, d := writeCorpus(t)
+	opts := sampleOptions{Split: "lines", MaxSampleBytes: 1024}
+	want, _, err := collectRoot(context.Background(), plain, opts, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != 200 {
+		t.Fatalf("%d samples from the plain files, want 200", len(want))
+	}
+
+	undecoded, _, err := collectRoot(context.Background(), compressed, opts, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(undecoded, want) {
+		t.Fatal("compressed files gave the plain samples without -decode-zst")
+	}
+
+	opts.DecodeZst = true
+	got, stats, err := collectRoot(context.Background(), compressed, opts, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) || stats.FilesProcessed != 4 {
+		t.Errorf("-decode-zst: %d samples from %d files, want the %d plain ones", len(got), stats.FilesProcessed, len(want))
+	}
+
+	if _, _, err := collectRoot(context.Background(), withDict, opts, 1000); err == nil {
+		t.Error("dictionary-compressed inputs decoded without -input-dict")
+	}
+	opts.InputDict = d
+	got, _, err = collectRoot(context.Background(), withDict, opts, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("-input-dict: %d samples, want the %d plain ones", len(got), len(want))
+	}
+}
+
+func TestTrainFromCompressed(t *testing.T) {
+	_, compressed, withDict, d := writeCorpus(t)
+	dictPath := filepath.Join(t.TempDir(), "input.zdict")
+	if err := os.WriteFile(dictPath, d, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	url, _ := fakeGateway(t)
+
+	for _, tc := range []struct {
+		name string
+		args []string
+	}{
+		{"plain frames", []string{"-in", filepath.Dir(compressed[0])}},
+		{"dictionary frames", []string{"-in", filepath.Dir(withDict[0]), "-input-dict", dictPath}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "trained.zdict")
+			args := append(tc.args, "-decode-zst", "-split", "lines", "-dict-size", "4096", "-dict-id", "5", "-out-file", out, "-pushgateway", url)
+			if code, output := run(t, args...); code != 0 {
+				t.Fatalf("exit %d, output:\n%s", code, output)
+			}
+			trained, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := zstd.InspectDictionary(trained)
+			if err != nil || info.ID() != 5 {
+				t.Fatalf("trained dictionary: %v, id %v", err, info)
+			}
+			// Trained on the decoded records, it holds their text.
+			if !strings.Contains(string(info.Content()), `"email":`) {
+				t.Error("dictionary content does not come from the decoded records")
+			}
+		})
+	}
+}
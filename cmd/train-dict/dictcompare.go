@@ -0,0 +1,261 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"zstd-learning/internal/filter"
+	"zstd-learning/internal/pushspool"
+	"zstd-learning/internal/walk"
+)
+
+// dictScore is the result of compressing the sample set with one dictionary.
+type dictScore struct {
+	Path        string
+	ID          uint32
+	DictBytes   int
+	InputBytes  int64
+	OutputBytes int64
+}
+
+func (s dictScore) ratio() float64 {
+	if s.InputBytes == 0 {
+		return 0
+	}
+	return float64(s.OutputBytes) / float64(s.InputBytes)
+}
+
+type dictComparison struct {
+	Old, New   dictScore
+	Files      int
+	Similarity float64 // Jaccard similarity of content n-grams, 0..1
+	Ngram      int
+}
+
+// ratioDelta is new minus old; negative means the new dictionary compresses
+// the samples better.
+func (c dictComparison) ratioDelta() float64 {
+	return c.New.ratio() - c.Old.ratio()
+}
+
+func runDictCompare(args []string) {
+	fs := flag.NewFlagSet("dict-compare", flag.ExitOnError)
+	samplesDir := fs.String("samples", "output", "directory of sample files compressed with both dictionaries")
+	filterExpr := fs.String("filter", "", "only use sample files matching an expression (see internal/filter)")
+	level := fs.Int("level", 0, "zstd compression level (0=default, 1..22 supported)")
+	ngram := fs.Int("ngram", 8, "substring length used for the content similarity")
+	pushURL := fs.String("pushgateway", "http://localhost:9091", "Pushgateway base URL")
+	pushSpool = pushspool.Flags(fs)
+	noPush := fs.Bool("no-push", false, "skip pushing comparison metrics")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: train-dict dict-compare [flags] <old.zdict> <new.zdict>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		exit(1)
+	}
+	if *ngram <= 0 {
+		fmt.Fprintln(os.Stderr, "ngram must be positive")
+		exit(1)
+	}
+
+	var match *filter.Expr
+	if strings.TrimSpace(*filterExpr) != "" {
+		var err error
+		match, err = filter.Parse(*filterExpr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+	}
+
+	paths, _, err := walk.Files(*samplesDir, match, walk.Skip)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list sample files: %v\n", err)
+		exit(1)
+	}
+	if len(paths) == 0 {
+		fmt.Fprintf(os.Stderr, "no files found in %s\n", *samplesDir)
+		exit(1)
+	}
+
+	cmp, err := compareDicts(fs.Arg(0), fs.Arg(1), paths, *level, *ngram)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dict-compare failed: %v\n", err)
+		exit(1)
+	}
+
+	printDictComparison(cmp)
+
+	if !*noPush {
+		if err := pushDictCompareMetrics(*pushURL, cmp); err != nil {
+			fmt.Fprintf(os.Stderr, "metrics push failed: %v\n", err)
+			exit(1)
+		}
+	}
+}
+
+func compareDicts(oldPath, newPath string, paths []string, level, ngram int) (dictComparison, error) {
+	cmp := dictComparison{Files: len(paths), Ngram: ngram}
+
+	oldRaw, err := os.ReadFile(oldPath)
+	if err != nil {
+		return cmp, err
+	}
+	newRaw, err := os.ReadFile(newPath)
+	if err != nil {
+		return cmp, err
+	}
+	oldInfo, err := zstd.InspectDictionary(oldRaw)
+	if err != nil {
+		return cmp, fmt.Errorf("%s: %w", oldPath, err)
+	}
+	newInfo, err := zstd.InspectDictionary(newRaw)
+	if err != nil {
+		return cmp, fmt.Errorf("%s: %w", newPath, err)
+	}
+
+	cmp.Old = dictScore{Path: oldPath, ID: oldInfo.ID(), DictBytes: len(oldRaw)}
+	cmp.New = dictScore{Path: newPath, ID: newInfo.ID(), DictBytes: len(newRaw)}
+	cmp.Similarity = ngramSimilarity(oldInfo.Content(), newInfo.Content(), ngram)
+
+	if err := scoreDict(&cmp.Old, oldRaw, paths, level); err != nil {
+		return cmp, err
+	}
+	if err := scoreDict(&cmp.New, newRaw, paths, level); err != nil {
+		return cmp, err
+	}
+	return cmp, nil
+}
+
+// scoreDict compresses every sample file with raw and accumulates the byte
+// counts into score.
+func scoreDict(score *dictScore, raw []byte, paths []string, level int) error {
+	options := []zstd.EOption{zstd.WithEncoderDict(raw)}
+	if level != 0 {
+		options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	encoder, err := zstd.NewWriter(nil, options...)
+	if err != nil {
+		return err
+	}
+	defer encoder.Close()
+
+	var dst []byte
+	for _, path := range paths {
+		data, err := walk.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		dst = encoder.EncodeAll(data, dst[:0])
+		score.InputBytes += int64(len(data))
+		score.OutputBytes += int64(len(dst))
+	}
+	return nil
+}
+
+// ngramSimilarity is the Jaccard index of the sets of n-byte substrings of a
+// and b: 1 when both contents share every substring, 0 when they share none.
+func ngramSimilarity(a, b []byte, n int) float64 {
+	set := func(data []byte) map[string]struct{} {
+		grams := make(map[string]struct{})
+		for i := 0; i+n <= len(data); i++ {
+			grams[string(data[i:i+n])] = struct{}{}
+		}
+		return grams
+	}
+	setA, setB := set(a), set(b)
+	if len(setA) == 0 && len(setB) == 0 {
+		return 1
+	}
+	shared := 0
+	for gram := range setA {
+		if _, ok := setB[gram]; ok {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(setA)+len(setB)-shared)
+}
+
+func printDictComparison(cmp dictComparison) {
+	fmt.Printf("compared over %d sample files\n", cmp.Files)
+	for _, s := range []struct {
+		label string
+		score dictScore
+	}{{"old", cmp.Old}, {"new", cmp.New}} {
+		fmt.Printf("  %s %-30s id %-10d %7d bytes  %d -> %d bytes, ratio %.4f\n", s.label, s.score.Path, s.score.ID, s.score.DictBytes, s.score.InputBytes, s.score.OutputBytes, s.score.ratio())
+	}
+	idNote := "different"
+	if cmp.Old.ID == cmp.New.ID {
+		idNote = "same"
+	}
+	fmt.Printf("  ratio delta     %+.4f (%+.2f%% output bytes)\n", cmp.ratioDelta(), percentChange(cmp.Old.OutputBytes, cmp.New.OutputBytes))
+	fmt.Printf("  dict ids        %s (%d -> %d)\n", idNote, cmp.Old.ID, cmp.New.ID)
+	fmt.Printf("  content overlap %.1f%% of %d-byte substrings shared\n", cmp.Similarity*100, cmp.Ngram)
+}
+
+func percentChange(old, new int64) float64 {
+	if old == 0 {
+		return 0
+	}
+	return float64(new-old) * 100 / float64(old)
+}
+
+func pushDictCompareMetrics(pushURL string, cmp dictComparison) error {
+	registry := prometheus.NewRegistry()
+
+	ratioGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dict_compare_ratio",
+		Help: "Output/input size ratio of the sample set per compared dictionary.",
+	}, []string{"dict"})
+	deltaGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dict_compare_ratio_delta",
+		Help: "New minus old ratio on the sample set; negative means the new dictionary is better.",
+	})
+	similarityGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dict_compare_content_similarity",
+		Help: "Jaccard similarity of the dictionaries' content n-grams (0..1).",
+	})
+	sameIDGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dict_compare_same_id",
+		Help: "1 when both dictionaries have the same ID, 0 otherwise.",
+	})
+	timestampGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dict_compare_last_run_timestamp_seconds",
+		Help: "Unix timestamp of the last dictionary comparison.",
+	})
+
+	metrics := []prometheus.Collector{
+		ratioGauge,
+		deltaGauge,
+		similarityGauge,
+		sameIDGauge,
+		timestampGauge,
+	}
+	for _, metric := range metrics {
+		if err := registry.Register(metric); err != nil {
+			return err
+		}
+	}
+
+	ratioGauge.WithLabelValues("old").Set(cmp.Old.ratio())
+	ratioGauge.WithLabelValues("new").Set(cmp.New.ratio())
+	deltaGauge.Set(cmp.ratioDelta())
+	similarityGauge.Set(cmp.Similarity)
+	if cmp.Old.ID == cmp.New.ID {
+		sameIDGauge.Set(1)
+	}
+	timestampGauge.Set(float64(time.Now().Unix()))
+
+	return pushspool.Push(pushSpool, pushURL, "dict-compare", pushspool.Grouping{"old_dict_id": strconv.FormatUint(uint64(cmp.Old.ID), 10), "new_dict_id": strconv.FormatUint(uint64(cmp.New.ID), 10)}, registry)
+}
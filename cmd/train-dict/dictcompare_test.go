@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNgramSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		n    int
+		want float64
+	}{
+		{"abcdef", "abcdef", 3, 1},
+		{"abcdef", "uvwxyz", 3, 0},
+		{"abcd", "bcde", 3, 1.0 / 3},
+		{"ab", "xy", 3, 1},
+		{"", "abc", 3, 0},
+	}
+	for _, tt := range tests {
+		if got := ngramSimilarity([]byte(tt.a), []byte(tt.b), tt.n); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("ngramSimilarity(%q, %q, %d) = %v, want %v", tt.a, tt.b, tt.n, got, tt.want)
+		}
+	}
+}
+
+// TestDictCompare compares a dictionary trained on people with one trained
+// on movies, over people samples: the movies one must come out worse, with
+// a different ID and little content in common.
+func TestDictCompare(t *testing.T) {
+	people := trainDict(t, "-dict-id", "1")
+	movies := trainDict(t, "-dict-id", "2", "-generate", "movies")
+
+	samples := t.TempDir()
+	var paths []string
+	for i, line := range bytes.Split(bytes.TrimSpace(generated(t, "people", "ndjson", 40)), []byte("\n")) {
+		path := filepath.Join(samples, fmt.Sprintf("p%02d.json", i))
+		if err := os.WriteFile(path, line, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	cmp, err := compareDicts(people, movies, paths, 0, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmp.Files != 40 || cmp.Old.InputBytes != cmp.New.InputBytes || cmp.Old.InputBytes == 0 {
+		t.Errorf("compared %d files, %d and %d input bytes", cmp.Files, cmp.Old.InputBytes, cmp.New.InputBytes)
+	}
+	if cmp.Old.ID != 1 || cmp.New.ID != 2 {
+		t.Errorf("dict ids %d and %d, want 1 and 2", cmp.Old.ID, cmp.New.ID)
+	}
+	if cmp.ratioDelta() <= 0.05 {
+		t.Errorf("ratio %.4f with people, %.4f with movies; want the movies dictionary clearly worse", cmp.Old.ratio(), cmp.New.ratio())
+	}
+	if cmp.Similarity > 0.2 {
+		t.Errorf("content similarity %.3f for dictionaries trained on disjoint data", cmp.Similarity)
+	}
+	self, err := compareDicts(people, people, paths, 0, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if self.ratioDelta() != 0 || self.Similarity != 1 {
+		t.Errorf("a dictionary against itself: delta %v, similarity %v", self.ratioDelta(), self.Similarity)
+	}
+
+	url, pushed := fakeGateway(t)
+	code, out := run(t, "dict-compare", "-samples", samples, "-pushgateway", url, people, movies)
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, out)
+	}
+	if !strings.Contains(out, "dict ids        different (1 -> 2)") {
+		t.Errorf("report does not show the differing IDs:\n%s", out)
+	}
+	gauges := pushed()
+	if got := gauges["dict_compare_ratio_delta"]; math.Abs(got-cmp.ratioDelta()) > 1e-9 {
+		t.Errorf("pushed ratio delta %v, want %v", got, cmp.ratioDelta())
+	}
+	if got, ok := gauges["dict_compare_same_id"]; !ok || got != 0 {
+		t.Errorf("pushed same id %v (present %v), want 0", got, ok)
+	}
+	if got := gauges["dict_compare_content_similarity"]; math.Abs(got-cmp.Similarity) > 1e-9 {
+		t.Errorf("pushed similarity %v, want %v", got, cmp.Similarity)
+	}
+}
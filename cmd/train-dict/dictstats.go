@@ -0,0 +1,224 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"zstd-learning/internal/pushspool"
+)
+
+const (
+	dictHeaderBytes  = 8  // magic number + dictionary ID
+	dictOffsetsBytes = 12 // three repeat offsets
+)
+
+type dictComposition struct {
+	ID             uint32
+	TotalBytes     int
+	HeaderBytes    int
+	TableBytes     int
+	OffsetsBytes   int
+	ContentBytes   int
+	ContentEntropy float64
+	Offsets        [3]int
+	TopSubstrings  []substringCount
+}
+
+type substringCount struct {
+	Text  string
+	Count int
+}
+
+func runDictStats(args []string) {
+	fs := flag.NewFlagSet("dict-stats", flag.ExitOnError)
+	dictPath := fs.String("dict", "", "path to the .zdict file to analyze")
+	ngram := fs.Int("ngram", 8, "substring length used for the repeated-substring histogram")
+	top := fs.Int("top", 10, "number of most common substrings to report")
+	pushURL := fs.String("pushgateway", "http://localhost:9091", "Pushgateway base URL")
+	pushSpool = pushspool.Flags(fs)
+	noPush := fs.Bool("no-push", false, "skip pushing composition metrics")
+	fs.Parse(args)
+
+	if strings.TrimSpace(*dictPath) == "" && fs.NArg() > 0 {
+		*dictPath = fs.Arg(0)
+	}
+	if strings.TrimSpace(*dictPath) == "" {
+		fmt.Fprintln(os.Stderr, "-dict is required for dict-stats")
+		exit(1)
+	}
+	if *ngram <= 0 || *top <= 0 {
+		fmt.Fprintln(os.Stderr, "ngram and top must be positive")
+		exit(1)
+	}
+
+	raw, err := os.ReadFile(*dictPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read dict: %v\n", err)
+		exit(1)
+	}
+
+	comp, err := analyzeDict(raw, *ngram, *top)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse dictionary: %v\n", err)
+		exit(1)
+	}
+
+	printDictComposition(*dictPath, comp)
+
+	if !*noPush {
+		if err := pushDictStatsMetrics(*pushURL, comp); err != nil {
+			fmt.Fprintf(os.Stderr, "metrics push failed: %v\n", err)
+			exit(1)
+		}
+	}
+}
+
+func analyzeDict(raw []byte, ngram, top int) (dictComposition, error) {
+	info, err := zstd.InspectDictionary(raw)
+	if err != nil {
+		return dictComposition{}, err
+	}
+
+	content := info.Content()
+	comp := dictComposition{
+		ID:             info.ID(),
+		TotalBytes:     len(raw),
+		HeaderBytes:    dictHeaderBytes,
+		OffsetsBytes:   dictOffsetsBytes,
+		ContentBytes:   len(content),
+		ContentEntropy: shannonEntropy(content),
+		Offsets:        info.Offsets(),
+		TopSubstrings:  topSubstrings(content, ngram, top),
+	}
+	comp.TableBytes = comp.TotalBytes - comp.HeaderBytes - comp.OffsetsBytes - comp.ContentBytes
+	if comp.TableBytes < 0 {
+		return dictComposition{}, fmt.Errorf("dictionary sections exceed file size (%d bytes)", comp.TotalBytes)
+	}
+	return comp, nil
+}
+
+func shannonEntropy(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	entropy := 0.0
+	total := float64(len(data))
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / total
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+func topSubstrings(data []byte, n, top int) []substringCount {
+	if len(data) < n {
+		return nil
+	}
+	counts := make(map[string]int)
+	for i := 0; i+n <= len(data); i++ {
+		counts[string(data[i:i+n])]++
+	}
+
+	result := make([]substringCount, 0, len(counts))
+	for text, count := range counts {
+		if count < 2 {
+			continue
+		}
+		result = append(result, substringCount{Text: text, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Text < result[j].Text
+	})
+	if len(result) > top {
+		result = result[:top]
+	}
+	return result
+}
+
+func printDictComposition(path string, comp dictComposition) {
+	percent := func(part int) float64 {
+		return float64(part) * 100 / float64(comp.TotalBytes)
+	}
+
+	fmt.Printf("dictionary %s\n", path)
+	fmt.Printf("  dict id         %d\n", comp.ID)
+	fmt.Printf("  total           %8d bytes\n", comp.TotalBytes)
+	fmt.Printf("  header          %8d bytes (%5.1f%%)\n", comp.HeaderBytes, percent(comp.HeaderBytes))
+	fmt.Printf("  entropy tables  %8d bytes (%5.1f%%)\n", comp.TableBytes, percent(comp.TableBytes))
+	fmt.Printf("  repeat offsets  %8d bytes (%5.1f%%) %v\n", comp.OffsetsBytes, percent(comp.OffsetsBytes), comp.Offsets)
+	fmt.Printf("  content         %8d bytes (%5.1f%%)\n", comp.ContentBytes, percent(comp.ContentBytes))
+	fmt.Printf("  content entropy %.3f bits/byte\n", comp.ContentEntropy)
+
+	if len(comp.TopSubstrings) == 0 {
+		fmt.Println("  no repeated substrings in content")
+		return
+	}
+	fmt.Println("  most common substrings:")
+	maxCount := comp.TopSubstrings[0].Count
+	for _, sub := range comp.TopSubstrings {
+		bar := strings.Repeat("#", max(1, sub.Count*30/maxCount))
+		fmt.Printf("    %-20s %6d %s\n", strconv.Quote(sub.Text), sub.Count, bar)
+	}
+}
+
+func pushDictStatsMetrics(pushURL string, comp dictComposition) error {
+	registry := prometheus.NewRegistry()
+
+	sectionGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dict_stats_section_bytes",
+		Help: "Size of each section of the analyzed dictionary in bytes.",
+	}, []string{"section"})
+	totalGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dict_stats_total_bytes",
+		Help: "Total size of the analyzed dictionary in bytes.",
+	})
+	entropyGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dict_stats_content_entropy_bits",
+		Help: "Shannon entropy of the dictionary content in bits per byte.",
+	})
+	timestampGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dict_stats_last_run_timestamp_seconds",
+		Help: "Unix timestamp of the last dictionary analysis.",
+	})
+
+	metrics := []prometheus.Collector{
+		sectionGauge,
+		totalGauge,
+		entropyGauge,
+		timestampGauge,
+	}
+	for _, metric := range metrics {
+		if err := registry.Register(metric); err != nil {
+			return err
+		}
+	}
+
+	sectionGauge.WithLabelValues("header").Set(float64(comp.HeaderBytes))
+	sectionGauge.WithLabelValues("tables").Set(float64(comp.TableBytes))
+	sectionGauge.WithLabelValues("offsets").Set(float64(comp.OffsetsBytes))
+	sectionGauge.WithLabelValues("content").Set(float64(comp.ContentBytes))
+	totalGauge.Set(float64(comp.TotalBytes))
+	entropyGauge.Set(comp.ContentEntropy)
+	timestampGauge.Set(float64(time.Now().Unix()))
+
+	return pushspool.Push(pushSpool, pushURL, "dict-stats", pushspool.Grouping{"dict_id": strconv.FormatUint(uint64(comp.ID), 10)}, registry)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestAnalyzeDict(t *testing.T) {
+	raw, err := os.ReadFile(trainDict(t, "-dict-id", "77"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := analyzeDict(raw, 8, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comp.ID != 77 {
+		t.Errorf("dict id %d, want 77", comp.ID)
+	}
+	if sum := comp.HeaderBytes + comp.TableBytes + comp.OffsetsBytes + comp.ContentBytes; sum != len(raw) || comp.TotalBytes != len(raw) {
+		t.Errorf("sections add up to %d, total %d, want the %d bytes of the file", sum, comp.TotalBytes, len(raw))
+	}
+	info, err := zstd.InspectDictionary(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comp.ContentBytes != len(info.Content()) || comp.TableBytes <= 0 {
+		t.Errorf("content %d bytes and tables %d, want %d and some", comp.ContentBytes, comp.TableBytes, len(info.Content()))
+	}
+	if comp.ContentEntropy <= 0 || comp.ContentEntropy > 8 {
+		t.Errorf("content entropy %.3f bits/byte, want within (0, 8]", comp.ContentEntropy)
+	}
+	if len(comp.TopSubstrings) != 5 {
+		t.Fatalf("%d top substrings, want 5", len(comp.TopSubstrings))
+	}
+	for i, sub := range comp.TopSubstrings {
+		if len(sub.Text) != 8 || sub.Count < 2 || !strings.Contains(string(info.Content()), sub.Text) {
+			t.Errorf("substring %q counted %d times", sub.Text, sub.Count)
+		}
+		if i > 0 && sub.Count > comp.TopSubstrings[i-1].Count {
+			t.Errorf("substrings not sorted by count: %v", comp.TopSubstrings)
+		}
+	}
+
+	if _, err := analyzeDict([]byte("not a dictionary"), 8, 5); err == nil {
+		t.Error("a file that is not a dictionary was analyzed")
+	}
+}
+
+func TestDictStatsCommand(t *testing.T) {
+	path := trainDict(t)
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, pushed := fakeGateway(t)
+
+	code, out := run(t, "dict-stats", "-dict", path, "-top", "3", "-pushgateway", url)
+	if code != 0 {
+		t.Fatalf("exit %d, output:\n%s", code, out)
+	}
+	for _, want := range []string{"entropy tables", "repeat offsets", "content entropy", "most common substrings"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	gauges := pushed()
+	if got := gauges["dict_stats_total_bytes"]; got != float64(len(raw)) {
+		t.Errorf("dict_stats_total_bytes pushed %v, want %d", got, len(raw))
+	}
+	if _, ok := gauges["dict_stats_section_bytes"]; !ok {
+		t.Error("section sizes were not pushed")
+	}
+
+	if code, out := run(t, "dict-stats", "-dict", path, "-top", "0", "-no-push"); code != 1 {
+		t.Errorf("-top 0: exit %d, output:\n%s", code, out)
+	}
+}
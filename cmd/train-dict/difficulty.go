@@ -0,0 +1,218 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+
+	"zstd-learning/internal/encpool"
+)
+
+// difficultyOptions configures -difficulty-weighted: Pool times
+// -max-samples candidate chunks are collected, each is scored by
+// compressing at most ProbeBytes of it on its own at the fastest level,
+// and -max-samples of them are drawn with weights ratio^Power, so chunks
+// that compress poorly without a dictionary, where one helps most, are
+// favored. Power 0 draws uniformly.
+type difficultyOptions struct {
+	Pool       int
+	ProbeBytes int
+	Power      float64
+	Seed       int64
+	// Eval trains a second dictionary on a uniform draw and compares both
+	// on held-out candidates, Holdout of the pool.
+	Eval    bool
+	Holdout float64
+}
+
+// difficultyStats records the weighting in the metadata. The ratios are
+// standalone (no dictionary) compressed/original sizes of the probed bytes.
+type difficultyStats struct {
+	Candidates     int             `json:"candidates"`
+	Selected       int             `json:"selected"`
+	ProbeBytes     int             `json:"probe_bytes"`
+	Power          float64         `json:"power"`
+	Seed           int64           `json:"seed"`
+	CandidateRatio float64         `json:"candidate_ratio"`
+	SelectedRatio  float64         `json:"selected_ratio"`
+	Eval           *difficultyEval `json:"eval,omitempty"`
+}
+
+// difficultyEval is the -difficulty-eval comparison: holdout ratios of
+// dictionaries trained on a weighted and on a uniform draw of the same
+// candidates.
+type difficultyEval struct {
+	Holdout       int     `json:"holdout_samples"`
+	WeightedRatio float64 `json:"weighted_ratio"`
+	UniformRatio  float64 `json:"uniform_ratio"`
+}
+
+// scoreDifficulty returns the standalone ratio of the first probeBytes of
+// each sample, compressed into a counting writer by pooled fastest-level
+// encoders, one goroutine per CPU, and the compressed and probed totals.
+func scoreDifficulty(samples [][]byte, probeBytes int) ([]float64, int64, int64, error) {
+	pool, err := encpool.For(zstd.SpeedFastest, nil)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	ratios := make([]float64, len(samples))
+	compressed := make([]int64, len(samples))
+	jobs := make(chan int)
+	errs := make(chan error, 1)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				probe := samples[i][:min(len(samples[i]), probeBytes)]
+				var out countingWriter
+				encoder, err := pool.Get(&out)
+				if err == nil {
+					_, err = encoder.Write(probe)
+					if closeErr := encoder.Close(); err == nil {
+						err = closeErr
+					}
+					pool.Put(encoder)
+				}
+				if err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+					continue
+				}
+				compressed[i] = out.n
+				ratios[i] = ratioOf(out.n, int64(len(probe)))
+			}
+		}()
+	}
+	for i := range samples {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return nil, 0, 0, err
+	default:
+	}
+
+	var compressedTotal, probedTotal int64
+	for i, sample := range samples {
+		compressedTotal += compressed[i]
+		probedTotal += int64(min(len(sample), probeBytes))
+	}
+	return ratios, compressedTotal, probedTotal, nil
+}
+
+// drawWeighted picks n of the indexes 0..len(weights)-1 without
+// replacement, each with probability proportional to its weight, and
+// returns them in ascending order so the samples keep their file order.
+// It uses the Efraimidis-Spirakis keys u^(1/w); a zero weight is only
+// picked once every positive one is.
+func drawWeighted(weights []float64, n int, seed int64) []int {
+	rng := rand.New(rand.NewSource(seed))
+	keys := make([]float64, len(weights))
+	order := make([]int, len(weights))
+	for i, w := range weights {
+		order[i] = i
+		if w > 0 {
+			keys[i] = math.Log(rng.Float64()) / w
+		} else {
+			keys[i] = math.Inf(-1)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool { return keys[order[a]] > keys[order[b]] })
+	picked := order[:min(n, len(order))]
+	sort.Ints(picked)
+	return picked
+}
+
+// difficultyWeights turns standalone ratios into draw weights.
+func difficultyWeights(ratios []float64, power float64) []float64 {
+	weights := make([]float64, len(ratios))
+	for i, r := range ratios {
+		weights[i] = math.Pow(r, power)
+	}
+	return weights
+}
+
+// selectByDifficulty draws n of the candidate samples weighted by
+// difficulty and returns them with the weighting's stats.
+func selectByDifficulty(candidates [][]byte, n int, opts difficultyOptions) ([][]byte, difficultyStats, error) {
+	stats := difficultyStats{Candidates: len(candidates), ProbeBytes: opts.ProbeBytes, Power: opts.Power, Seed: opts.Seed}
+	ratios, compressed, probed, err := scoreDifficulty(candidates, opts.ProbeBytes)
+	if err != nil {
+		return nil, stats, err
+	}
+	stats.CandidateRatio = ratioOf(compressed, probed)
+
+	picked := drawWeighted(difficultyWeights(ratios, opts.Power), n, opts.Seed)
+	var selectedCompressed, selectedProbed float64
+	for _, index := range picked {
+		probe := float64(min(len(candidates[index]), opts.ProbeBytes))
+		selectedCompressed += ratios[index] * probe
+		selectedProbed += probe
+	}
+	stats.Selected = len(picked)
+	if selectedProbed > 0 {
+		stats.SelectedRatio = selectedCompressed / selectedProbed
+	}
+	return pickSamples(candidates, picked), stats, nil
+}
+
+func pickSamples(samples [][]byte, picked []int) [][]byte {
+	out := make([][]byte, len(picked))
+	for i, index := range picked {
+		out[i] = samples[index]
+	}
+	return out
+}
+
+// evaluateDifficulty holds out every n-th candidate, trains one dictionary
+// on a weighted and one on a uniform draw of n of the rest, and scores both
+// on the holdout, which tells whether weighting helps on this corpus. When
+// the rest holds no more than n candidates both draws take all of them.
+func evaluateDifficulty(candidates [][]byte, n int, opts difficultyOptions, train func(samples [][]byte) ([]byte, error)) (*difficultyEval, error) {
+	rest, holdout := splitHoldout(candidates, opts.Holdout)
+	eval := &difficultyEval{Holdout: len(holdout)}
+	var holdoutBytes int64
+	for _, sample := range holdout {
+		holdoutBytes += int64(len(sample))
+	}
+	ratios, _, _, err := scoreDifficulty(rest, opts.ProbeBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, arm := range []struct {
+		power float64
+		ratio *float64
+	}{{opts.Power, &eval.WeightedRatio}, {0, &eval.UniformRatio}} {
+		picked := drawWeighted(difficultyWeights(ratios, arm.power), n, opts.Seed)
+		dictionary, err := train(pickSamples(rest, picked))
+		if err != nil {
+			return nil, err
+		}
+		compressed, err := holdoutCompressedBytes(dictionary, holdout)
+		if err != nil {
+			return nil, err
+		}
+		*arm.ratio = ratioOf(compressed, holdoutBytes)
+	}
+	return eval, nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"zstd-learning/internal/synth"
+	"zstd-learning/pkg/progress"
+)
+
+// generateConfig is what -generate trains on instead of files under -in:
+// Count records of Type from the generate-data generator, written in Format
+// and cut into samples by -split as a file would be.
+type generateConfig struct {
+	Type   string `json:"type"`
+	Count  int    `json:"count"`
+	Seed   int64  `json:"seed"`
+	Format string `json:"format"`
+}
+
+// label names the generated corpus in stats, metrics and the summary.
+func (g generateConfig) label() string {
+	return "generated-" + g.Type
+}
+
+// collectGenerated streams the generator's records through the sample
+// chunker, so -generate honors the same sampling limits as files do. The
+// records are never written to disk.
+func collectGenerated(ctx context.Context, gen *synth.Generator, cfg generateConfig, opts sampleOptions) ([][]byte, sampleStats, error) {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(gen.Write(writer, cfg.Count, cfg.Format))
+	}()
+	// Closing the reader stops the generator once the budget is reached.
+	defer reader.Close()
+	opts.Progress.Begin("", 0, -1)
+	opts.Progress.Phase("sampling")
+
+	samples, total, err := readSamples(ctx, cfg.label(), contextReader{ctx, reader}, opts, opts.MaxSamples)
+	if err != nil {
+		return nil, sampleStats{}, err
+	}
+	opts.Progress.File(cfg.label(), total, 0, progress.StatusOK)
+	stats := sampleStats{
+		Samples: len(samples),
+		Roots:   []rootStats{{Path: cfg.label(), Samples: len(samples), SampleBytes: total}},
+	}
+	stats.InputBytes = total
+
+	if len(samples) < opts.ExpectSamples {
+		return nil, stats, fmt.Errorf("-split %s cut only %d samples from %d generated %s records, fewer than -expect-samples-min %d; check that -split matches -generate-format (lines for ndjson, json for json)", opts.Split, len(samples), cfg.Count, cfg.Type, opts.ExpectSamples)
+	}
+	if len(samples) < max(opts.MinSamples, minTrainSamples) {
+		return nil, stats, fmt.Errorf("generated %d %s records gave %d samples, fewer than -min-samples %d; raise -generate-count or lower -max-sample-bytes (now %d)", cfg.Count, cfg.Type, len(samples), opts.MinSamples, opts.MaxSampleBytes)
+	}
+	return samples, stats, nil
+}
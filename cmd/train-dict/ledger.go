@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"zstd-learning/internal/confirm"
+)
+
+const (
+	latestDictName = "latest.zdict"
+	ledgerName     = "deployments.jsonl"
+)
+
+// ledgerEntry is one line of the deployment ledger. Readers ignore unknown
+// fields so newer tools can add columns without breaking older ones.
+type ledgerEntry struct {
+	Timestamp   string `json:"timestamp"`
+	Action      string `json:"action"`
+	Target      string `json:"target"`
+	Previous    string `json:"previous,omitempty"`
+	DictID      uint32 `json:"dict_id,omitempty"`
+	DictBytes   int    `json:"dict_bytes,omitempty"`
+	Samples     int    `json:"samples,omitempty"`
+	SampleBytes int64  `json:"sample_bytes,omitempty"`
+}
+
+func runDict(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: train-dict dict <history|rollback|unpack> [flags]")
+		exit(1)
+	}
+	if args[0] == "unpack" {
+		runUnpack(args[1:])
+		return
+	}
+
+	action := args[0]
+	fs := flag.NewFlagSet("dict "+action, flag.ExitOnError)
+	dir := fs.String("dir", "dict-out", "directory holding latest.zdict and the deployment ledger")
+	confirmOpts := confirm.Flags(fs)
+	fs.Parse(args[1:])
+
+	var err error
+	switch action {
+	case "history":
+		err = printLedger(*dir)
+	case "rollback":
+		var entry ledgerEntry
+		entry, err = rollbackDict(*dir, confirmOpts)
+		if err == nil {
+			fmt.Printf("rolled back %s to %s (previously %s)\n", filepath.Join(*dir, latestDictName), entry.Target, entry.Previous)
+		}
+	default:
+		err = fmt.Errorf("unknown dict action %q (expected history, rollback, unpack)", action)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dict %s failed: %v\n", action, err)
+		exit(1)
+	}
+}
+
+// publishDict points latest.zdict at dictPath and records the swap.
+func publishDict(dir, dictPath string, entry ledgerEntry) error {
+	if abs, err := filepath.Abs(dictPath); err == nil {
+		dictPath = abs
+	}
+
+	unlock, err := lockLedger(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, err := readLedger(dir)
+	if err != nil {
+		return err
+	}
+	stack := deployedStack(entries)
+	if len(stack) > 0 {
+		entry.Previous = stack[len(stack)-1]
+	}
+
+	if err := swapLatest(dir, dictPath); err != nil {
+		return err
+	}
+	entry.Action = "deploy"
+	entry.Target = dictPath
+	entry.Timestamp = deterministic.Now().UTC().Format(time.RFC3339)
+	return appendLedger(dir, entry)
+}
+
+func rollbackDict(dir string, confirmOpts *confirm.Options) (ledgerEntry, error) {
+	unlock, err := lockLedger(dir)
+	if err != nil {
+		return ledgerEntry{}, err
+	}
+	defer unlock()
+
+	entries, err := readLedger(dir)
+	if err != nil {
+		return ledgerEntry{}, err
+	}
+	stack := deployedStack(entries)
+	if len(stack) < 2 {
+		return ledgerEntry{}, errors.New("no previous deployment to roll back to")
+	}
+
+	current, previous := stack[len(stack)-1], stack[len(stack)-2]
+	if _, err := os.Stat(previous); err != nil {
+		return ledgerEntry{}, fmt.Errorf("previous dictionary is not available: %w", err)
+	}
+	err = confirm.Ask(confirmOpts, confirm.Plan{
+		Action: fmt.Sprintf("point %s back at %s, replacing", filepath.Join(dir, latestDictName), previous),
+		Count:  1,
+		Unit:   "files",
+		Bytes:  -1,
+		Paths:  []string{current},
+	})
+	if err != nil {
+		return ledgerEntry{}, err
+	}
+	if err := swapLatest(dir, previous); err != nil {
+		return ledgerEntry{}, err
+	}
+
+	entry := ledgerEntry{
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Action:    "rollback",
+		Target:    previous,
+		Previous:  current,
+	}
+	return entry, appendLedger(dir, entry)
+}
+
+// deployedStack replays the ledger: deploys push their target and rollbacks
+// pop the current one, so repeated rollbacks walk further back in history.
+func deployedStack(entries []ledgerEntry) []string {
+	var stack []string
+	for _, entry := range entries {
+		switch entry.Action {
+		case "deploy":
+			stack = append(stack, entry.Target)
+		case "rollback":
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	return stack
+}
+
+// swapLatest copies dictPath to a temporary file next to latest.zdict and
+// renames it into place, so readers never see a partially written dictionary.
+func swapLatest(dir, dictPath string) error {
+	data, err := os.ReadFile(dictPath)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".latest-*.zdict")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0o644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(dir, latestDictName)); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+func readLedger(dir string) ([]ledgerEntry, error) {
+	file, err := os.Open(filepath.Join(dir, ledgerName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []ledgerEntry
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var entry ledgerEntry
+		if err := json.Unmarshal([]byte(text), &entry); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", ledgerName, line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func appendLedger(dir string, entry ledgerEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, ledgerName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// lockLedger excludes concurrent writers with an O_EXCL lock file holding the
+// owner's PID.
+func lockLedger(dir string) (func(), error) {
+	lockPath := filepath.Join(dir, ledgerName+".lock")
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		owner, _ := os.ReadFile(lockPath)
+		return nil, fmt.Errorf("ledger is locked by %s (remove %s if that process is gone)", strings.TrimSpace(string(owner)), lockPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(file, "pid %d\n", os.Getpid())
+	file.Close()
+	return func() { os.Remove(lockPath) }, nil
+}
+
+func printLedger(dir string) error {
+	entries, err := readLedger(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Printf("no deployments recorded in %s\n", filepath.Join(dir, ledgerName))
+		return nil
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "#\tTIME\tACTION\tDICT ID\tSAMPLES\tTARGET\tPREVIOUS")
+	for i, entry := range entries {
+		dictID := "-"
+		if entry.DictID != 0 {
+			dictID = strconv.FormatUint(uint64(entry.DictID), 10)
+		}
+		samples := "-"
+		if entry.Samples != 0 {
+			samples = strconv.Itoa(entry.Samples)
+		}
+		previous := entry.Previous
+		if previous == "" {
+			previous = "-"
+		}
+		fmt.Fprintf(writer, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", i+1, entry.Timestamp, entry.Action, dictID, samples, entry.Target, previous)
+	}
+	return writer.Flush()
+}
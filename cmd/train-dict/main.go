@@ -2,14 +2,15 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"io/fs"
+	"math"
 	"os"
 	"path/filepath"
-	"sort"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -17,217 +18,1119 @@ import (
 	"github.com/klauspost/compress/dict"
 	"github.com/klauspost/compress/zstd"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/push"
+
+	"zstd-learning/internal/chunker"
+	"zstd-learning/internal/config"
+	"zstd-learning/internal/console"
+	"zstd-learning/internal/dictfile"
+	"zstd-learning/internal/events"
+	"zstd-learning/internal/filter"
+	"zstd-learning/internal/history"
+	"zstd-learning/internal/lock"
+	"zstd-learning/internal/notify"
+	"zstd-learning/internal/outpath"
+	"zstd-learning/internal/pushspool"
+	"zstd-learning/internal/repro"
+	"zstd-learning/internal/size"
+	"zstd-learning/internal/stats"
+	"zstd-learning/internal/summary"
+	"zstd-learning/internal/synth"
+	"zstd-learning/internal/walk"
+	"zstd-learning/pkg/progress"
 )
 
+// minTrainSamples is the fewest samples the trainer accepts at all;
+// -min-samples sets the higher bar a useful dictionary needs, and
+// -expect-samples-min the count a record splitter should reach on the data.
+const minTrainSamples = 2
+
+type sampleOptions struct {
+	Match          *filter.Expr
+	MaxSamples     int
+	MinSamples     int
+	ExpectSamples  int
+	MaxSampleBytes int
+	ChunkOverlap   int
+	Split          string
+	Balance        bool
+	Interleave     bool
+	SpecialFiles   walk.Policy
+	// DecodeZst decompresses .zst inputs while sampling them, with
+	// InputDict for inputs compressed with a dictionary.
+	DecodeZst bool
+	InputDict []byte
+	// Progress receives an event per file sampled; nil without
+	// -progress-json.
+	Progress *events.Stream
+}
+
+// sampleStats counts the sample collection of a training run. The
+// embedded stats count the files that yielded samples as processed, those
+// that yielded none and the special files as skipped, and the sample bytes
+// as input; OutputBytes is the dictionary.
 type sampleStats struct {
-	FilesScanned int
-	Samples      int
-	SampleBytes  int64
+	stats.RunStats
+	Samples int
+	Roots   []rootStats
+	// Truncated is set when -collect-timeout stopped collection early;
+	// FilesUnscanned counts the files it never got to read.
+	Truncated      bool
+	FilesUnscanned int
+	// SpecialSkipped counts the FIFOs, sockets and devices left out.
+	SpecialSkipped int
+}
+
+type rootStats struct {
+	Path         string `json:"path"`
+	FilesScanned int    `json:"files_scanned"`
+	Samples      int    `json:"samples"`
+	SampleBytes  int64  `json:"sample_bytes"`
+}
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+var (
+	notifier       *notify.Run
+	pushSpool      *pushspool.Options
+	deterministic  *repro.Options
+	progressEvents *events.Stream
+	outLock        *lock.Lock
+)
+
+// exit stands in for os.Exit, which would skip the deferred lock release
+// and leave -notify-url and -progress-json without the outcome.
+func exit(code int) {
+	progressEvents.Finish(code)
+	notifier.Finish(code)
+	outLock.Release()
+	os.Exit(code)
 }
 
 func main() {
-	inputDir := flag.String("in", "output", "input directory with sample data")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "dict-stats":
+			runDictStats(os.Args[2:])
+			return
+		case "stats":
+			runCorpusStats(os.Args[2:])
+			return
+		case "dict-compare":
+			runDictCompare(os.Args[2:])
+			return
+		case "dict":
+			runDict(os.Args[2:])
+			return
+		}
+	}
+
+	var inputDirs stringList
+	flag.Var(&inputDirs, "in", "input directory with sample data (repeat for several corpora; default output)")
+	generateType := flag.String("generate", "", fmt.Sprintf("train on synthetic records generated in memory instead of files under -in: %s (the generate-data generator)", strings.Join(synth.Types, ", ")))
+	generateCount := flag.Int("generate-count", 10000, "with -generate, number of records to generate")
+	generateSeed := flag.Int64("generate-seed", 0, "with -generate, random seed for the records (0 picks one from the clock; the seed used is recorded in the metadata)")
+	generateFormat := flag.String("generate-format", "json", fmt.Sprintf("with -generate, layout of the generated records: %s (pair ndjson with -split lines and json with -split json)", strings.Join(synth.Formats, " or ")))
 	outDir := flag.String("out", "dict-out", "output directory for dictionaries")
 	outFile := flag.String("out-file", "", "optional full output file path")
-	dictSize := flag.Int("dict-size", 128*1024, "dictionary size in bytes")
+	dictSize := flag.Int("dict-size", 128*1024, "dictionary size in bytes (with -auto-size, the largest size tried)")
+	dictIDFlag := flag.Uint("dict-id", 0, "dictionary ID written into the dictionary header (0 picks a random one)")
+	autoSizeFlag := flag.Bool("auto-size", false, "train dictionaries from -auto-size-min doubling up to -dict-size and keep the one with the best ratio on held-out samples")
+	autoSizeMin := flag.Int("auto-size-min", 4096, "smallest dictionary size tried by -auto-size")
+	holdout := flag.Float64("holdout", 0.1, "fraction of samples -auto-size keeps out of training to score each size")
+	evalSample := flag.Int("eval-sample", 0, "with -auto-size, score each size on at most this many holdout samples, picked at random (0 = every holdout sample)")
+	evalSeed := flag.Int64("eval-seed", 0, "seed for the -eval-sample selection (0 picks one from the clock and prints it)")
+	targetRatio := flag.Float64("target-ratio", 0, "with -auto-size, stop at the smallest size whose holdout ratio (compressed/original) is at or below this (0 = try every size)")
 	maxSamples := flag.Int("max-samples", 1000, "maximum number of samples to use")
+	expectSamples := flag.Int("expect-samples-min", 0, "with -split lines, json or csv, fail when fewer samples than this are collected, which points at a splitter that does not match the data (0 disables)")
+	minSamples := flag.Int("min-samples", 20, fmt.Sprintf("fail before training when fewer samples are collected (at least %d; fewer samples tend to give a poor dictionary)", minTrainSamples))
 	maxSampleBytes := flag.Int("max-sample-bytes", 32*1024, "maximum bytes to read per sample")
+	autoSampleSize := flag.Bool("auto-sample-size", false, "derive -max-sample-bytes so -max-samples samples total -sample-ratio times -dict-size")
+	sampleRatio := flag.Float64("sample-ratio", defaultSampleRatio, "total sample bytes per dictionary byte targeted by -auto-sample-size")
+	oversizeFactor := flag.Float64("oversize-factor", defaultOversizeFactor, "warn when -max-sample-bytes exceeds this many times -dict-size (0 = never warn)")
+	chunkOverlap := flag.Int("chunk-overlap", 0, "bytes shared between consecutive samples from the same file (must be less than -max-sample-bytes)")
 	zstdLevel := flag.Int("zstd-level", 0, "zstd compression level for training (0=default, 1=fastest, 2=default, 3=better, 4=best)")
 	pushURL := flag.String("pushgateway", "http://localhost:9091", "Pushgateway base URL")
-	flag.Parse()
+	split := flag.String("split", "bytes", "how to cut files into samples: bytes (fixed -max-sample-bytes windows), lines, json (top-level array elements) or csv (rows); records are truncated to -max-sample-bytes")
+	balance := flag.Bool("balance", false, "spread the sample budget across files by taking one chunk per file per round")
+	interleave := flag.Bool("interleave", false, "with several -in roots, alternate samples round-robin across roots instead of filling from the first root")
+	dictFormat := flag.String("dict-format", "wrapped", "dictionary file format: wrapped (zstd dictionary with magic, ID and entropy tables) or raw (content bytes only, for -raw-dict consumers)")
+	collectTimeout := flag.Duration("collect-timeout", 0, "stop reading samples after this long and train on what was gathered (0 = no limit)")
+	analyzeOnly := flag.Bool("analyze-only", false, "print corpus statistics for -in (as train-dict stats does) and exit without training")
+	writeMetadata := flag.Bool("metadata", true, "write a <dict>.json sidecar describing how the dictionary was trained")
+	writePackage := flag.Bool("package", false, "also write a single-file <dict>.zdictpkg holding the dictionary, its metadata and a sha256, which compress and decompress accept as -dict")
+	historyPath := flag.String("history", "", "append a one-line record of this run to this JSONL history file (export it with report history export)")
+	publish := flag.Bool("publish", false, "point latest.zdict in -out at the new dictionary and record the deployment ledger")
+	decodeZst := flag.Bool("decode-zst", false, "decompress .zst inputs while sampling them, to retrain a dictionary from a compressed archive without staging the decoded files on disk")
+	inputDictPath := flag.String("input-dict", "", "with -decode-zst, dictionary (.zdict or .zdictpkg) for decoding inputs that were compressed with one")
+	filterExpr := flag.String("filter", "", "only process files matching an expression, e.g. 'size > 1MB && ext == .json && age < 7d' (see internal/filter)")
+	difficultyWeighted := flag.Bool("difficulty-weighted", false, "collect -difficulty-pool times -max-samples candidate chunks, score each by compressing it alone at the fastest level, and train on -max-samples of them drawn in favor of those that compress poorly")
+	difficultyPool := flag.Int("difficulty-pool", 4, "with -difficulty-weighted, how many times -max-samples candidates to collect and choose from")
+	difficultyProbe := flag.Int("difficulty-probe-bytes", 4096, "with -difficulty-weighted, score each candidate on at most this many of its bytes, which bounds the extra CPU")
+	difficultyPower := flag.Float64("difficulty-power", 1, "with -difficulty-weighted, weighting curve: candidates are drawn with weight ratio^power, so 0 draws uniformly and 2 or more strongly favors chunks that compress poorly")
+	difficultySeed := flag.Int64("difficulty-seed", 0, "seed for the -difficulty-weighted draw (0 picks one from the clock; the seed used is recorded in the metadata)")
+	difficultyEval := flag.Bool("difficulty-eval", false, "with -difficulty-weighted, also train on a uniform draw of the same candidates and print the ratio of both dictionaries on -holdout of the candidates, to check that weighting helps on this corpus")
+	specialFiles := flag.String("special-files", "skip", "what to do with FIFOs, sockets and device nodes under -in, which are never opened: skip (and count them) or error")
+	timestampFormat := flag.String("timestamp-format", outpath.StampLayout, "Go time layout of the UTC timestamp in generated dictionary names (without -out-file), e.g. 20060102_150405 for the older style; a name already taken gets _2, _3, ...")
+	summaryFormat := flag.String("summary-format", "text", "end-of-run summary format: text (human-readable sizes and rates) or json (raw numbers)")
+	allowEmpty := flag.Bool("allow-empty", false, "treat input directories without files as a successful run that trains nothing and pushes zeroed metrics, instead of an error")
+	quiet := flag.Bool("quiet", false, "do not print the end-of-run summary or other notes; warnings still go to stderr")
+	waitForLock := flag.Duration("wait-for-lock", 0, "when another run holds the -out directory lock, wait up to this long for it instead of failing at once")
+	lockStaleAfter := flag.Duration("lock-stale-after", time.Hour, "break an -out directory lock file its holder stopped refreshing this long ago (only where the OS cannot lock files; flock and LockFileEx locks die with their process)")
+	colorFlag := flag.String("color", "auto", "colorize output: auto (only on a terminal), always, never")
+	notifyOpts := notify.Flags(flag.CommandLine)
+	progressOpts := events.Flags(flag.CommandLine)
+	pushSpool = pushspool.Flags(flag.CommandLine)
+	deterministic = repro.Flags(flag.CommandLine)
+	if err := config.Parse(flag.CommandLine, os.Args[1:], "ZSTD_TRAIN_DICT"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+
+	colorMode, err := console.ParseMode(*colorFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+	stdout := console.NewPrinter(colorMode, os.Stdout)
+	stderr := console.NewPrinter(colorMode, os.Stderr)
+	progressEvents, err = events.Start(progressOpts, "train-dict")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer progressEvents.Finish(0)
+	notifier, err = notify.Start(notifyOpts, "train-dict")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+	defer notifier.Finish(0)
+	summaryFmt, err := summary.ParseFormat(*summaryFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+	notes, warnings := summary.Outputs(summaryFmt, *quiet)
+	specialPolicy, err := walk.ParsePolicy(*specialFiles)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+	if err := outpath.CheckStampLayout(*timestampFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+
+	var generate *generateConfig
+	if *generateType != "" {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "in", "balance", "interleave", "decode-zst", "input-dict", "filter", "analyze-only":
+				fmt.Fprintf(os.Stderr, "-%s cannot be combined with -generate, which reads no files\n", f.Name)
+				exit(1)
+			}
+		})
+		if !slices.Contains(synth.Types, *generateType) {
+			fmt.Fprintf(os.Stderr, "invalid -generate %q (expected %s)\n", *generateType, strings.Join(synth.Types, ", "))
+			exit(1)
+		}
+		if !slices.Contains(synth.Formats, *generateFormat) {
+			fmt.Fprintf(os.Stderr, "invalid -generate-format %q (expected %s)\n", *generateFormat, strings.Join(synth.Formats, ", "))
+			exit(1)
+		}
+		if *generateCount <= 0 {
+			fmt.Fprintln(os.Stderr, "generate-count must be positive")
+			exit(1)
+		}
+		generate = &generateConfig{Type: *generateType, Count: *generateCount, Seed: *generateSeed, Format: *generateFormat}
+	} else {
+		flag.Visit(func(f *flag.Flag) {
+			if strings.HasPrefix(f.Name, "generate-") {
+				fmt.Fprintf(os.Stderr, "-%s requires -generate\n", f.Name)
+				exit(1)
+			}
+		})
+	}
 
+	if len(inputDirs) == 0 && generate == nil {
+		inputDirs = stringList{"output"}
+	}
+	if *waitForLock < 0 || *lockStaleAfter < 0 {
+		fmt.Fprintln(os.Stderr, "wait-for-lock and lock-stale-after must not be negative")
+		exit(1)
+	}
 	if *dictSize <= 0 {
 		fmt.Fprintln(os.Stderr, "dict-size must be positive")
-		os.Exit(1)
+		exit(1)
 	}
 	if *maxSamples <= 0 {
 		fmt.Fprintln(os.Stderr, "max-samples must be positive")
-		os.Exit(1)
+		exit(1)
+	}
+	if *minSamples < minTrainSamples {
+		fmt.Fprintf(os.Stderr, "min-samples must be at least %d\n", minTrainSamples)
+		exit(1)
+	}
+	if *autoSampleSize {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "max-sample-bytes" {
+				fmt.Fprintln(os.Stderr, "-max-sample-bytes cannot be combined with -auto-sample-size")
+				exit(1)
+			}
+		})
+		if *sampleRatio <= 0 {
+			fmt.Fprintln(os.Stderr, "sample-ratio must be positive")
+			exit(1)
+		}
+	}
+	if *oversizeFactor < 0 {
+		fmt.Fprintln(os.Stderr, "oversize-factor must not be negative")
+		exit(1)
+	}
+	var sizing *sampleSizing
+	if *autoSampleSize {
+		derived := deriveSampleSize(*dictSize, *maxSamples, *sampleRatio)
+		*maxSampleBytes = derived.MaxSampleBytes
+		sizing = &derived
+		fmt.Fprintf(notes, "auto-sample-size: %d samples of %s (%s total, %gx the %s dictionary)\n",
+			derived.MaxSamples, size.Format(int64(derived.MaxSampleBytes)), size.Format(derived.TotalBytes), derived.SampleRatio, size.Format(int64(*dictSize)))
 	}
 	if *maxSampleBytes <= 0 {
 		fmt.Fprintln(os.Stderr, "max-sample-bytes must be positive")
-		os.Exit(1)
+		exit(1)
+	}
+	if oversizedSamples(*maxSampleBytes, *dictSize, *oversizeFactor) {
+		fmt.Fprintln(os.Stderr, stderr.Yellow(fmt.Sprintf("warning: -max-sample-bytes %d is more than %gx -dict-size %d; oversized samples tend to give poor dictionaries and waste memory (try -auto-sample-size)", *maxSampleBytes, *oversizeFactor, *dictSize)))
+	}
+	if *autoSizeFlag && (*autoSizeMin <= 0 || *autoSizeMin > *dictSize) {
+		fmt.Fprintln(os.Stderr, "auto-size-min must be positive and at most dict-size")
+		exit(1)
+	}
+	if *autoSizeFlag && (*holdout <= 0 || *holdout >= 0.5) {
+		fmt.Fprintln(os.Stderr, "holdout must be greater than 0 and less than 0.5")
+		exit(1)
+	}
+	if err := deterministic.Check(flag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+	if err := deterministic.Reject(flag.CommandLine, "collect-timeout"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+	if *dictIDFlag > math.MaxUint32 {
+		fmt.Fprintf(os.Stderr, "invalid -dict-id %d: must fit in 32 bits\n", *dictIDFlag)
+		exit(1)
+	}
+	if err := deterministic.RequireSeed("dict-id", int64(*dictIDFlag)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+	if deterministic.Enabled {
+		// The dictionary builder walks Go maps, whose order changes from run
+		// to run, so only the ID and the files around the dictionary are
+		// reproducible.
+		fmt.Fprintln(os.Stderr, stderr.Yellow("warning: -deterministic: the trained dictionary content can still differ between runs; compare compress outputs against a pinned dictionary"))
+	}
+	if generate != nil {
+		if err := deterministic.RequireSeed("generate-seed", generate.Seed); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+	}
+	var difficulty *difficultyOptions
+	if *difficultyWeighted {
+		if *difficultyPool < 1 || *difficultyProbe <= 0 || *difficultyPower < 0 {
+			fmt.Fprintln(os.Stderr, "difficulty-pool must be at least 1, difficulty-probe-bytes positive and difficulty-power not negative")
+			exit(1)
+		}
+		if *difficultyEval && (*holdout <= 0 || *holdout >= 0.5) {
+			fmt.Fprintln(os.Stderr, "holdout must be greater than 0 and less than 0.5")
+			exit(1)
+		}
+		if err := deterministic.RequireSeed("difficulty-seed", *difficultySeed); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+		difficulty = &difficultyOptions{
+			Pool:       *difficultyPool,
+			ProbeBytes: *difficultyProbe,
+			Power:      *difficultyPower,
+			Seed:       *difficultySeed,
+			Eval:       *difficultyEval,
+			Holdout:    *holdout,
+		}
+	} else {
+		flag.Visit(func(f *flag.Flag) {
+			if strings.HasPrefix(f.Name, "difficulty-") {
+				fmt.Fprintf(os.Stderr, "-%s requires -difficulty-weighted\n", f.Name)
+				exit(1)
+			}
+		})
+	}
+	if *evalSample > 0 {
+		if err := deterministic.RequireSeed("eval-seed", *evalSeed); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+	}
+	if *evalSample < 0 {
+		fmt.Fprintln(os.Stderr, "eval-sample must not be negative")
+		exit(1)
+	}
+	if *evalSample > 0 && !*autoSizeFlag {
+		fmt.Fprintln(os.Stderr, "-eval-sample requires -auto-size")
+		exit(1)
+	}
+	if *targetRatio < 0 {
+		fmt.Fprintln(os.Stderr, "target-ratio must not be negative")
+		exit(1)
+	}
+	if *targetRatio > 0 && !*autoSizeFlag {
+		fmt.Fprintln(os.Stderr, "-target-ratio requires -auto-size")
+		exit(1)
+	}
+	if *dictFormat != "wrapped" && *dictFormat != "raw" {
+		fmt.Fprintf(os.Stderr, "invalid -dict-format %q (expected wrapped or raw)\n", *dictFormat)
+		exit(1)
+	}
+	if *chunkOverlap < 0 || *chunkOverlap >= *maxSampleBytes {
+		fmt.Fprintln(os.Stderr, "chunk-overlap must be at least 0 and less than max-sample-bytes")
+		exit(1)
+	}
+	if *collectTimeout < 0 {
+		fmt.Fprintln(os.Stderr, "collect-timeout must not be negative")
+		exit(1)
+	}
+	if !slices.Contains(chunker.Modes, *split) {
+		fmt.Fprintf(os.Stderr, "invalid -split %q (expected %s)\n", *split, strings.Join(chunker.Modes, ", "))
+		exit(1)
+	}
+	if *split != "bytes" && (*chunkOverlap != 0 || *balance) {
+		fmt.Fprintln(os.Stderr, "-chunk-overlap and -balance require -split bytes")
+		exit(1)
+	}
+	if *expectSamples != 0 {
+		if *split == "bytes" {
+			fmt.Fprintln(os.Stderr, "-expect-samples-min requires -split lines, json or csv")
+			exit(1)
+		}
+		if *expectSamples < 0 || *expectSamples > *maxSamples {
+			fmt.Fprintf(os.Stderr, "expect-samples-min must be between 0 and -max-samples %d\n", *maxSamples)
+			exit(1)
+		}
+	}
+
+	if *inputDictPath != "" && !*decodeZst {
+		fmt.Fprintln(os.Stderr, "-input-dict requires -decode-zst")
+		exit(1)
+	}
+	if *decodeZst && (*balance || *analyzeOnly) {
+		fmt.Fprintln(os.Stderr, "-decode-zst cannot be combined with -balance, which seeks within files, or -analyze-only")
+		exit(1)
+	}
+	var inputDict []byte
+	if *inputDictPath != "" {
+		loaded, err := dictfile.Load(*inputDictPath, false, "")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("invalid -input-dict"), err)
+			exit(1)
+		}
+		inputDict = loaded.Data
+	}
+
+	var match *filter.Expr
+	if strings.TrimSpace(*filterExpr) != "" {
+		match, err = filter.Parse(*filterExpr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+	}
+
+	if *analyzeOnly {
+		budget, _ := size.Parse(defaultAnalyzeBytes)
+		analyzeAndPrint(inputDirs, corpusOptions{
+			Match:          match,
+			SampleBytes:    budget,
+			MaxSamples:     *maxSamples,
+			MaxSampleBytes: *maxSampleBytes,
+			Split:          *split,
+			SpecialFiles:   specialPolicy,
+		}, false)
+		return
 	}
 
 	if err := os.MkdirAll(*outDir, 0o755); err != nil {
 		fmt.Fprintf(os.Stderr, "failed to create output dir: %v\n", err)
-		os.Exit(1)
+		exit(1)
 	}
-
-	outputPath := *outFile
-	if outputPath == "" {
-		outputPath = filepath.Join(*outDir, fmt.Sprintf("zstd_dict_%s.zdict", time.Now().Format("20060102_150405")))
+	held, err := lock.Acquire(*outDir, lock.Options{Command: "train-dict", Wait: *waitForLock, StaleAfter: *lockStaleAfter})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("cannot lock output directory"), err)
+		exit(1)
 	}
+	outLock = held
+	defer outLock.Release()
 
 	start := time.Now()
-	samples, stats, err := collectSamples(*inputDir, *maxSamples, *maxSampleBytes)
+	sampling := sampleOptions{
+		Match:          match,
+		MaxSamples:     *maxSamples,
+		MinSamples:     min(*minSamples, *maxSamples),
+		ExpectSamples:  *expectSamples,
+		MaxSampleBytes: *maxSampleBytes,
+		ChunkOverlap:   *chunkOverlap,
+		Split:          *split,
+		Balance:        *balance,
+		Interleave:     *interleave,
+		SpecialFiles:   specialPolicy,
+		DecodeZst:      *decodeZst,
+		InputDict:      inputDict,
+		Progress:       progressEvents,
+	}
+	collectCtx := context.Background()
+	if *collectTimeout > 0 {
+		var cancel context.CancelFunc
+		collectCtx, cancel = context.WithTimeout(collectCtx, *collectTimeout)
+		defer cancel()
+	}
+	// -difficulty-weighted collects a larger pool to draw -max-samples from.
+	collecting := sampling
+	if difficulty != nil {
+		collecting.MaxSamples = *maxSamples * difficulty.Pool
+	}
+	sourceLabel := sourceLabelOf(inputDirs)
+	var samples [][]byte
+	var stats sampleStats
+	if generate != nil {
+		if generate.Seed == 0 {
+			generate.Seed = time.Now().UnixNano()
+		}
+		var clock synth.Clock
+		if deterministic.Enabled {
+			clock = synth.Clock{Base: deterministic.Now(), Step: time.Second}
+		}
+		var gen *synth.Generator
+		gen, err = synth.New(synth.Options{
+			Type:         generate.Type,
+			Seed:         generate.Seed,
+			Locales:      "en",
+			EmailDomains: "example.com",
+			Clock:        clock,
+		})
+		if err == nil {
+			samples, stats, err = collectGenerated(collectCtx, gen, *generate, collecting)
+		}
+		sourceLabel = generate.label()
+	} else {
+		samples, stats, err = collectSamples(collectCtx, inputDirs, collecting)
+	}
+	if errors.Is(err, errNoFiles) && *allowEmpty {
+		fmt.Fprintf(notes, "%v; nothing to do\n", err)
+		if err := pushMetrics(*pushURL, sampleStats{}, 0, *dictSize, 0, sourceLabel, nil); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("metrics push failed"), err)
+			exit(1)
+		}
+		return
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to collect samples: %v\n", err)
-		os.Exit(1)
+		exit(1)
+	}
+	if stats.SpecialSkipped > 0 {
+		fmt.Fprintln(warnings, stdout.Yellow(fmt.Sprintf("skipped %d special files (FIFOs, sockets or devices)", stats.SpecialSkipped)))
+	}
+	if stats.Truncated {
+		fmt.Fprintln(warnings, stdout.Yellow(fmt.Sprintf("sample collection stopped after %s: %d files not scanned", *collectTimeout, stats.FilesUnscanned)))
+	}
+	candidates := samples
+	var weighting *difficultyStats
+	if difficulty != nil {
+		if difficulty.Seed == 0 {
+			difficulty.Seed = time.Now().UnixNano()
+		}
+		var drawn difficultyStats
+		samples, drawn, err = selectByDifficulty(candidates, *maxSamples, *difficulty)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("failed to score samples"), err)
+			exit(1)
+		}
+		weighting = &drawn
+		stats.Samples, stats.InputBytes = len(samples), 0
+		for _, sample := range samples {
+			stats.InputBytes += int64(len(sample))
+		}
+		fmt.Fprintf(notes, "difficulty-weighted: drew %d of %d candidates (-difficulty-seed %d); standalone ratio %.4f drawn vs %.4f for all candidates\n", drawn.Selected, drawn.Candidates, drawn.Seed, drawn.SelectedRatio, drawn.CandidateRatio)
 	}
 
 	options := dict.Options{
 		MaxDictSize: *dictSize,
 		HashBytes:   6,
+		ZstdDictID:  uint32(*dictIDFlag),
 	}
 	if *zstdLevel > 0 {
 		options.ZstdLevel = parseZstdLevel(*zstdLevel)
 	}
+	progressEvents.Phase("training")
+	if difficulty != nil && difficulty.Eval {
+		eval, err := evaluateDifficulty(candidates, *maxSamples, *difficulty, func(samples [][]byte) ([]byte, error) {
+			return dict.BuildZstdDict(samples, options)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("difficulty-eval failed"), err)
+			exit(1)
+		}
+		weighting.Eval = eval
+		line := fmt.Sprintf("difficulty-eval: holdout ratio %.4f weighted vs %.4f uniform on %d held-out candidates", eval.WeightedRatio, eval.UniformRatio, eval.Holdout)
+		if eval.WeightedRatio < eval.UniformRatio {
+			fmt.Fprintln(notes, line+"; weighting helps on this corpus")
+		} else {
+			fmt.Fprintln(warnings, stdout.Yellow(line+"; weighting does not help on this corpus"))
+		}
+	}
 
-	trained, err := dict.BuildZstdDict(samples, options)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to train dictionary: %v\n", err)
-		os.Exit(1)
+	var trained []byte
+	var tuned *autoSizeResult
+	if *autoSizeFlag {
+		if *evalSample > 0 && *evalSeed == 0 {
+			*evalSeed = time.Now().UnixNano()
+		}
+		result, err := autoSize(samples, autoSizeOptions{
+			MinSize:     *autoSizeMin,
+			MaxSize:     *dictSize,
+			Holdout:     *holdout,
+			TargetRatio: *targetRatio,
+			EvalSample:  *evalSample,
+			Seed:        *evalSeed,
+			Notes:       notes,
+		}, func(samples [][]byte, size int) ([]byte, error) {
+			sized := options
+			sized.MaxDictSize = size
+			return dict.BuildZstdDict(samples, sized)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("failed to train dictionary"), err)
+			exit(1)
+		}
+		switch {
+		case result.TargetMet:
+			fmt.Fprintf(notes, "auto-size selected %s: holdout ratio %s meets target %.4f\n", stdout.Bold(strconv.Itoa(result.Selected)), stdout.Ratio(result.Ratio), result.TargetRatio)
+		case result.TargetRatio > 0:
+			fmt.Fprintln(warnings, stdout.Yellow(fmt.Sprintf("auto-size: target %.4f not met; best ratio %.4f at size %d", result.TargetRatio, result.Ratio, result.Selected)))
+		default:
+			fmt.Fprintf(notes, "auto-size selected %s: best holdout ratio %s\n", stdout.Bold(strconv.Itoa(result.Selected)), stdout.Ratio(result.Ratio))
+		}
+		trained, tuned = result.Dict, &result
+	} else {
+		trained, err = dict.BuildZstdDict(samples, options)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("failed to train dictionary"), err)
+			exit(1)
+		}
 	}
 
+	progressEvents.Phase("writing")
+	// The generated name is claimed only now, so a run that fails earlier
+	// leaves no empty dictionary behind.
+	outputPath := *outFile
+	if outputPath == "" {
+		f, err := outpath.CreateStamped(*outDir, "zstd_dict_", *timestampFormat, ".zdict", deterministic.Now())
+		if err == nil {
+			outputPath = f.Name()
+			err = f.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create dictionary file: %v\n", err)
+			exit(1)
+		}
+	}
 	if err := os.MkdirAll(filepath.Dir(outputPath), 0o755); err != nil {
 		fmt.Fprintf(os.Stderr, "failed to create output dir: %v\n", err)
-		os.Exit(1)
+		exit(1)
 	}
 
-	if err := os.WriteFile(outputPath, trained, 0o644); err != nil {
+	output, err := formatDict(trained, *dictFormat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to format dictionary: %v\n", err)
+		exit(1)
+	}
+	if err := os.WriteFile(outputPath, output, 0o644); err != nil {
 		fmt.Fprintf(os.Stderr, "failed to write dictionary: %v\n", err)
-		os.Exit(1)
+		exit(1)
+	}
+
+	meta := newDictMetadata(outputPath, trained, *dictSize, inputDirs, sampling, stats)
+	meta.Format = *dictFormat
+	meta.Sampling.AutoSampleSize = sizing
+	if *collectTimeout > 0 {
+		meta.Sampling.CollectTimeout = collectTimeout.String()
+	}
+	meta.DictBytes = len(output)
+	meta.AutoSize = tuned
+	meta.Generated = generate
+	meta.Difficulty = weighting
+	if *writeMetadata {
+		if err := writeDictMetadata(outputPath, meta); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write metadata: %v\n", err)
+			exit(1)
+		}
+	}
+	if *writePackage {
+		pkgPath, err := writeDictPackage(outputPath, output, meta)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write package: %v\n", err)
+			exit(1)
+		}
+		fmt.Fprintf(notes, "packaged dictionary and metadata into %s\n", stdout.Green(pkgPath))
+	}
+
+	if *publish {
+		entry := ledgerEntry{
+			DictBytes:   len(output),
+			Samples:     stats.Samples,
+			SampleBytes: stats.InputBytes,
+		}
+		if info, err := zstd.InspectDictionary(trained); err == nil {
+			entry.DictID = info.ID()
+		}
+		if err := publishDict(*outDir, outputPath, entry); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to publish dictionary: %v\n", err)
+			exit(1)
+		}
 	}
 
 	duration := time.Since(start)
-	sourceLabel := filepath.Base(*inputDir)
-	if sourceLabel == "." || sourceLabel == string(filepath.Separator) {
-		sourceLabel = "output"
+	stats.OutputBytes = int64(len(output))
+	notifier.Record("", stats.FilesProcessed, stats.InputBytes, stats.OutputBytes, stats.Ratio())
+	if *historyPath != "" {
+		err := history.Append(*historyPath, history.Record{
+			Timestamp:       deterministic.Now(),
+			Command:         "train-dict",
+			Source:          sourceLabel,
+			Files:           stats.FilesProcessed,
+			InputBytes:      stats.InputBytes,
+			OutputBytes:     stats.OutputBytes,
+			Ratio:           stats.Ratio(),
+			DurationSeconds: deterministic.Duration(duration).Seconds(),
+			DictID:          meta.DictID,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("failed to record history"), err)
+			exit(1)
+		}
 	}
-	if err := pushMetrics(*pushURL, stats, len(trained), *dictSize, duration, sourceLabel); err != nil {
-		fmt.Fprintf(os.Stderr, "metrics push failed: %v\n", err)
-		os.Exit(1)
+	if err := pushMetrics(*pushURL, stats, len(output), *dictSize, duration, sourceLabel, tuned); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", stderr.Red("metrics push failed"), err)
+		exit(1)
 	}
 
-	fmt.Printf("trained dictionary %s (%d bytes) from %d samples\n", outputPath, len(trained), stats.Samples)
+	if !*quiet {
+		sum := summary.New("train-dict", stats.FilesProcessed, stats.InputBytes, int64(len(output)), stats.InputBytes, deterministic.Duration(duration))
+		sum.Destination = outputPath
+		if summaryFmt == summary.JSON {
+			sum.WriteJSON(os.Stdout)
+		} else if generate != nil {
+			fmt.Printf("trained dictionary %s from %s samples of %d generated %s (-generate-seed %d): %s\n", stdout.Green(outputPath), stdout.Bold(strconv.Itoa(stats.Samples)), generate.Count, generate.Type, generate.Seed, sum.Details(stdout))
+		} else {
+			fmt.Printf("trained dictionary %s from %s samples across %d files: %s\n", stdout.Green(outputPath), stdout.Bold(strconv.Itoa(stats.Samples)), stats.FilesProcessed, sum.Details(stdout))
+		}
+	}
 }
 
-func collectSamples(dir string, maxSamples, maxSampleBytes int) ([][]byte, sampleStats, error) {
-	paths, err := listFiles(dir)
+// formatDict returns the trained dictionary in the requested file format.
+// Raw output keeps only the content section, dropping the magic number, ID
+// and entropy tables, which InspectDictionary validates before stripping.
+func formatDict(trained []byte, format string) ([]byte, error) {
+	if format != "raw" {
+		return trained, nil
+	}
+	info, err := zstd.InspectDictionary(trained)
 	if err != nil {
-		return nil, sampleStats{}, err
+		return nil, err
+	}
+	return info.Content(), nil
+}
+
+// errNoFiles is returned by collectSamples when the input directories hold
+// no files.
+var errNoFiles = errors.New("no files found")
+
+// sourceLabelOf is the source metric label for the input directories.
+func sourceLabelOf(dirs []string) string {
+	labels := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		label := filepath.Base(dir)
+		if label == "." || label == string(filepath.Separator) {
+			label = "output"
+		}
+		labels = append(labels, label)
+	}
+	return strings.Join(labels, "+")
+}
+
+// collectSamples reads samples from every root. When ctx ends, collection
+// stops and the samples gathered so far are returned with stats.Truncated
+// set; the directory walk itself is not bounded.
+func collectSamples(ctx context.Context, dirs []string, opts sampleOptions) ([][]byte, sampleStats, error) {
+	rootPaths := make([][]string, len(dirs))
+	total, special := 0, 0
+	for i, dir := range dirs {
+		paths, skipped, err := walk.Files(dir, opts.Match, opts.SpecialFiles)
+		if err != nil {
+			return nil, sampleStats{}, err
+		}
+		rootPaths[i] = paths
+		total += len(paths)
+		special += skipped
+	}
+	if total == 0 {
+		return nil, sampleStats{}, fmt.Errorf("%w in %s", errNoFiles, strings.Join(dirs, ", "))
+	}
+	opts.Progress.Begin("", total, -1)
+	opts.Progress.Phase("sampling")
+
+	var samples [][]byte
+	stats := sampleStats{SpecialSkipped: special}
+	stats.FilesSkipped = special
+	if opts.Interleave && len(dirs) > 1 {
+		perRoot := make([][][]byte, len(dirs))
+		for i, paths := range rootPaths {
+			rootSamples, rootStat, err := collectRoot(ctx, paths, opts, opts.MaxSamples)
+			if err != nil {
+				return nil, stats, err
+			}
+			stats.addTruncation(rootStat)
+			perRoot[i] = rootSamples
+			stats.Roots = append(stats.Roots, rootStats{Path: dirs[i], FilesScanned: rootStat.FilesProcessed})
+		}
+		samples = interleaveSamples(perRoot, opts.MaxSamples, stats.Roots)
+	} else {
+		for i, paths := range rootPaths {
+			rootSamples, rootStat, err := collectRoot(ctx, paths, opts, opts.MaxSamples-len(samples))
+			if err != nil {
+				return nil, stats, err
+			}
+			stats.addTruncation(rootStat)
+			samples = append(samples, rootSamples...)
+			stats.Roots = append(stats.Roots, rootStats{
+				Path:         dirs[i],
+				FilesScanned: rootStat.FilesProcessed,
+				Samples:      rootStat.Samples,
+				SampleBytes:  rootStat.InputBytes,
+			})
+		}
 	}
-	if len(paths) == 0 {
-		return nil, sampleStats{}, fmt.Errorf("no files found in %s", dir)
+	for _, root := range stats.Roots {
+		stats.FilesProcessed += root.FilesScanned
+		stats.Samples += root.Samples
+		stats.InputBytes += root.SampleBytes
 	}
 
-	samples := make([][]byte, 0, min(maxSamples, len(paths)))
+	// A splitter that does not match the data, such as -split json on
+	// NDJSON, yields one sample per file rather than one per record; that
+	// is checked first so it is not reported as merely too little data.
+	// A collection timeout explains a short count on its own.
+	if len(samples) < opts.ExpectSamples && !stats.Truncated {
+		return nil, stats, fmt.Errorf("-split %s cut only %d samples from %d files, fewer than -expect-samples-min %d; check that -split matches the data format (lines for NDJSON, json for files holding one top-level JSON array, csv for CSV) and that the files under -in hold the records expected", opts.Split, len(samples), stats.FilesProcessed, opts.ExpectSamples)
+	}
+	if len(samples) < minTrainSamples && stats.Truncated {
+		return nil, stats, fmt.Errorf("not enough samples to train (got %d) before the collection timeout; %d files were not scanned", len(samples), stats.FilesUnscanned)
+	}
+	if len(samples) < minTrainSamples {
+		return nil, stats, fmt.Errorf("not enough samples to train (got %d). Increase data or lower max-sample-bytes to create more chunks", len(samples))
+	}
+	if len(samples) < opts.MinSamples {
+		hint := fmt.Sprintf("lower -max-sample-bytes (now %d) to cut more samples from each file, add more data under -in", opts.MaxSampleBytes)
+		if stats.Truncated {
+			hint = fmt.Sprintf("raise -collect-timeout (%d files were not scanned), %s", stats.FilesUnscanned, hint)
+		}
+		return nil, stats, fmt.Errorf("collected %d samples from %d files, fewer than -min-samples %d; a dictionary trained on so few samples is usually poor. To fix: %s, or lower -min-samples if this corpus is known to be small", len(samples), stats.FilesProcessed, opts.MinSamples, hint)
+	}
+
+	return samples, stats, nil
+}
+
+func collectRoot(ctx context.Context, paths []string, opts sampleOptions, budget int) ([][]byte, sampleStats, error) {
+	if budget <= 0 || len(paths) == 0 {
+		return nil, sampleStats{}, nil
+	}
+	if ctx.Err() != nil {
+		return nil, sampleStats{Truncated: true, FilesUnscanned: len(paths)}, nil
+	}
+	opts.MaxSamples = budget
+	if opts.Balance {
+		return collectBalanced(ctx, paths, opts)
+	}
+	return collectSequential(ctx, paths, opts)
+}
+
+// addTruncation carries the timeout and the skipped files of a root over;
+// the other counters are summed from stats.Roots.
+func (stats *sampleStats) addTruncation(root sampleStats) {
+	stats.Truncated = stats.Truncated || root.Truncated
+	stats.FilesUnscanned += root.FilesUnscanned
+	stats.FilesSkipped += root.FilesSkipped
+}
+
+// interleaveSamples takes one sample from each root in turn until limit is
+// reached, recording the per-root contribution in roots.
+func interleaveSamples(perRoot [][][]byte, limit int, roots []rootStats) [][]byte {
+	samples := make([][]byte, 0, limit)
+	for round := 0; len(samples) < limit; round++ {
+		added := false
+		for i, rootSamples := range perRoot {
+			if round >= len(rootSamples) || len(samples) >= limit {
+				continue
+			}
+			samples = append(samples, rootSamples[round])
+			roots[i].Samples++
+			roots[i].SampleBytes += int64(len(rootSamples[round]))
+			added = true
+		}
+		if !added {
+			break
+		}
+	}
+	return samples
+}
+
+func collectSequential(ctx context.Context, paths []string, opts sampleOptions) ([][]byte, sampleStats, error) {
+	samples := make([][]byte, 0, min(opts.MaxSamples, len(paths)))
 	stats := sampleStats{}
 
-	for _, path := range paths {
-		if len(samples) >= maxSamples {
+	for i, path := range paths {
+		if len(samples) >= opts.MaxSamples {
 			break
 		}
 
-		chunks, readBytes, err := readSamplesFromFile(path, maxSampleBytes, maxSamples-len(samples))
+		chunks, readBytes, err := readSamplesFromFile(ctx, path, opts, opts.MaxSamples-len(samples))
+		if ctx.Err() != nil {
+			// Keep what the interrupted file yielded before the deadline.
+			stats.Truncated = true
+			stats.FilesUnscanned = len(paths) - i
+			if len(chunks) > 0 {
+				stats.FilesUnscanned--
+				stats.FilesProcessed++
+				samples = append(samples, chunks...)
+				stats.Samples += len(chunks)
+				stats.InputBytes += readBytes
+			}
+			break
+		}
 		if err != nil {
 			return nil, stats, err
 		}
 		if len(chunks) == 0 {
+			stats.FilesSkipped++
+			opts.Progress.File(path, readBytes, 0, progress.StatusSkipped)
 			continue
 		}
-		stats.FilesScanned++
+		opts.Progress.File(path, readBytes, 0, progress.StatusOK)
+		stats.FilesProcessed++
 		samples = append(samples, chunks...)
 		stats.Samples += len(chunks)
-		stats.SampleBytes += readBytes
+		stats.InputBytes += readBytes
 	}
 
-	if len(samples) < 2 {
-		return nil, stats, fmt.Errorf("not enough samples to train (got %d). Increase data or lower max-sample-bytes to create more chunks", len(samples))
+	return samples, stats, nil
+}
+
+// collectBalanced takes one chunk per file per round until the sample budget
+// is spent or every file is exhausted, so large early files cannot crowd out
+// the rest of the corpus.
+func collectBalanced(ctx context.Context, paths []string, opts sampleOptions) ([][]byte, sampleStats, error) {
+	type cursor struct {
+		path        string
+		offset      int64
+		sampled     int64
+		visited     bool
+		contributed bool
+	}
+
+	cursors := make([]*cursor, len(paths))
+	for i, path := range paths {
+		cursors[i] = &cursor{path: path}
+	}
+	active := append([]*cursor(nil), cursors...)
+
+	samples := make([][]byte, 0, min(opts.MaxSamples, len(paths)))
+	stats := sampleStats{}
+
+	for len(active) > 0 && len(samples) < opts.MaxSamples {
+		next := active[:0]
+		for _, c := range active {
+			if len(samples) >= opts.MaxSamples {
+				next = append(next, c)
+				continue
+			}
+
+			chunk, offset, eof, err := readSampleAt(ctx, c.path, c.offset, opts.MaxSampleBytes, opts.ChunkOverlap)
+			if ctx.Err() != nil {
+				stats.Truncated = true
+				for _, c := range cursors {
+					if !c.visited {
+						stats.FilesUnscanned++
+					}
+				}
+				return samples, stats, nil
+			}
+			if err != nil {
+				return nil, stats, err
+			}
+			c.visited = true
+			c.offset = offset
+			if len(chunk) > 0 {
+				if !c.contributed {
+					c.contributed = true
+					stats.FilesProcessed++
+				}
+				samples = append(samples, chunk)
+				stats.Samples++
+				stats.InputBytes += int64(len(chunk))
+				c.sampled += int64(len(chunk))
+			}
+			if !eof {
+				next = append(next, c)
+			} else if c.contributed {
+				opts.Progress.File(c.path, c.sampled, 0, progress.StatusOK)
+			} else {
+				stats.FilesSkipped++
+				opts.Progress.File(c.path, 0, 0, progress.StatusSkipped)
+			}
+		}
+		active = next
 	}
 
 	return samples, stats, nil
 }
 
-func listFiles(dir string) ([]string, error) {
-	var paths []string
-	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if d.IsDir() {
-			return nil
-		}
-		info, err := d.Info()
-		if err != nil {
-			return err
-		}
-		if info.Size() == 0 {
-			return nil
-		}
-		paths = append(paths, path)
-		return nil
-	})
-	if err != nil && !errors.Is(err, fs.SkipDir) {
-		return nil, err
+// readSampleAt returns the first non-blank window of maxBytes starting at
+// offset, chunked as readSamplesFromFile does in bytes mode. When overlap is
+// set and offset is past the start of the file, the window begins overlap
+// bytes earlier so it shares them with the previous one.
+func readSampleAt(ctx context.Context, path string, offset int64, maxBytes, overlap int) ([]byte, int64, bool, error) {
+	file, err := openSample(ctx, path)
+	if err != nil {
+		return nil, offset, true, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, offset, true, err
+	}
+	start := offset - int64(overlap)
+	if start < 0 {
+		start = 0
 	}
-	sort.Strings(paths)
-	return paths, nil
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		return nil, offset, true, err
+	}
+
+	blocks := chunker.NewBlocks(bufio.NewReader(contextReader{ctx, file}), maxBytes, overlap)
+	chunk, err := blocks.Next()
+	offset = start + blocks.Offset()
+	if errors.Is(err, io.EOF) {
+		return nil, offset, true, nil
+	}
+	if err != nil {
+		return nil, offset, true, err
+	}
+	return chunk, offset, offset >= info.Size(), nil
 }
 
-func readSamplesFromFile(path string, maxBytes, maxSamples int) ([][]byte, int64, error) {
-	file, err := os.Open(path)
+// readSamplesFromFile returns up to maxSamples chunks of path, split
+// according to opts.Split, and their total size. In bytes mode path is cut
+// into fixed windows of opts.MaxSampleBytes; with a non-zero overlap, each
+// window after the first starts overlap bytes before the previous one
+// ended, so patterns that straddle a boundary appear whole in at least one
+// sample.
+func readSamplesFromFile(ctx context.Context, path string, opts sampleOptions, maxSamples int) ([][]byte, int64, error) {
+	file, err := openSample(ctx, path)
 	if err != nil {
 		return nil, 0, err
 	}
 	defer file.Close()
+	content, closeContent, err := sampleReader(path, contextReader{ctx, file}, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer closeContent()
+	return readSamples(ctx, path, content, opts, maxSamples)
+}
 
-	reader := bufio.NewReader(file)
-	buf := make([]byte, maxBytes)
+// readSamples returns up to maxSamples chunks of content, split according
+// to opts.Split, and their total size. name prefixes chunking errors.
+func readSamples(ctx context.Context, name string, content io.Reader, opts sampleOptions, maxSamples int) ([][]byte, int64, error) {
+	chunks, err := chunker.New(opts.Split, bufio.NewReader(content), opts.MaxSampleBytes, opts.ChunkOverlap)
+	if err != nil {
+		return nil, 0, err
+	}
 	var samples [][]byte
 	var total int64
-
 	for len(samples) < maxSamples {
-		n, err := io.ReadFull(reader, buf)
-		if err != nil {
-			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
-				if n == 0 {
-					break
-				}
-				data := bytesTrimSpace(buf[:n])
-				if len(data) > 0 {
-					samples = append(samples, append([]byte(nil), data...))
-					total += int64(len(data))
-				}
-				break
-			}
-			return nil, total, err
+		chunk, err := chunks.Next()
+		if errors.Is(err, io.EOF) {
+			break
 		}
-
-		data := bytesTrimSpace(buf[:n])
-		if len(data) == 0 {
-			continue
+		if ctx.Err() != nil {
+			return samples, total, ctx.Err()
+		}
+		if err != nil {
+			return nil, total, fmt.Errorf("%s: %w", name, err)
 		}
-		samples = append(samples, append([]byte(nil), data...))
-		total += int64(len(data))
+		samples = append(samples, chunk)
+		total += int64(len(chunk))
 	}
-
 	return samples, total, nil
 }
 
-func bytesTrimSpace(input []byte) []byte {
-	start := 0
-	end := len(input)
-	for start < end {
-		switch input[start] {
-		case ' ', '\n', '\r', '\t':
-			start++
-		default:
-			goto endLoop
-		}
+// openSample opens path and closes it when ctx ends, so a read blocked on
+// a slow filesystem returns instead of holding collection past its deadline.
+func openSample(ctx context.Context, path string) (*sampleFile, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-endLoop:
-	for end > start {
-		switch input[end-1] {
-		case ' ', '\n', '\r', '\t':
-			end--
-		default:
-			return input[start:end]
-		}
+	file, err := walk.Open(path)
+	if err != nil {
+		return nil, err
 	}
-	return input[start:end]
+	stop := context.AfterFunc(ctx, func() { file.Close() })
+	return &sampleFile{File: file, stop: stop}, nil
+}
+
+type sampleFile struct {
+	*os.File
+	stop func() bool
+}
+
+func (f *sampleFile) Close() error {
+	f.stop()
+	return f.File.Close()
+}
+
+// contextReader fails reads once ctx is done, so a deadline stops chunking
+// at the next read even when the file itself is still readable.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
 }
 
 func parseZstdLevel(level int) zstd.EncoderLevel {
@@ -245,7 +1148,7 @@ func parseZstdLevel(level int) zstd.EncoderLevel {
 	}
 }
 
-func pushMetrics(pushURL string, stats sampleStats, outputBytes, dictSize int, duration time.Duration, source string) error {
+func pushMetrics(pushURL string, stats sampleStats, outputBytes, dictSize int, duration time.Duration, source string, tuned *autoSizeResult) error {
 	registry := prometheus.NewRegistry()
 
 	durationGauge := prometheus.NewGauge(prometheus.GaugeOpts{
@@ -272,6 +1175,10 @@ func pushMetrics(pushURL string, stats sampleStats, outputBytes, dictSize int, d
 		Name: "dict_target_size_bytes",
 		Help: "Target dictionary size requested for training.",
 	})
+	specialGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dict_special_files_skipped",
+		Help: "Number of FIFOs, sockets and devices skipped under the inputs in the last dictionary training run.",
+	})
 	timestampGauge := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "dict_last_run_timestamp_seconds",
 		Help: "Unix timestamp of the last dictionary training run.",
@@ -284,8 +1191,29 @@ func pushMetrics(pushURL string, stats sampleStats, outputBytes, dictSize int, d
 		filesGauge,
 		outputBytesGauge,
 		dictSizeGauge,
+		specialGauge,
 		timestampGauge,
 	}
+	if tuned != nil {
+		selectedGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dict_auto_size_selected_bytes",
+			Help: "Dictionary size selected by -auto-size.",
+		})
+		ratioGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dict_auto_size_holdout_ratio",
+			Help: "Holdout compression ratio achieved by the selected -auto-size dictionary.",
+		})
+		targetMetGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dict_auto_size_target_met",
+			Help: "1 when the selected -auto-size dictionary met -target-ratio, 0 otherwise.",
+		})
+		selectedGauge.Set(float64(tuned.Selected))
+		ratioGauge.Set(tuned.Ratio)
+		if tuned.TargetMet {
+			targetMetGauge.Set(1)
+		}
+		metrics = append(metrics, selectedGauge, ratioGauge, targetMetGauge)
+	}
 	for _, metric := range metrics {
 		if err := registry.Register(metric); err != nil {
 			return err
@@ -294,10 +1222,11 @@ func pushMetrics(pushURL string, stats sampleStats, outputBytes, dictSize int, d
 
 	durationGauge.Set(duration.Seconds())
 	samplesGauge.Set(float64(stats.Samples))
-	sampleBytesGauge.Set(float64(stats.SampleBytes))
-	filesGauge.Set(float64(stats.FilesScanned))
+	sampleBytesGauge.Set(float64(stats.InputBytes))
+	filesGauge.Set(float64(stats.FilesProcessed))
 	outputBytesGauge.Set(float64(outputBytes))
 	dictSizeGauge.Set(float64(dictSize))
+	specialGauge.Set(float64(stats.SpecialSkipped))
 	timestampGauge.Set(float64(time.Now().Unix()))
 
 	source = strings.TrimSpace(source)
@@ -305,8 +1234,7 @@ func pushMetrics(pushURL string, stats sampleStats, outputBytes, dictSize int, d
 		source = "output"
 	}
 
-	pusher := push.New(pushURL, "train-dict").Gatherer(registry).Grouping("source", source).Grouping("dict_size", strconv.Itoa(dictSize))
-	return pusher.Push()
+	return pushspool.Push(pushSpool, pushURL, "train-dict", pushspool.Grouping{"source": source, "dict_size": strconv.Itoa(dictSize)}, registry)
 }
 
 func min(a, b int) int {
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"zstd-learning/internal/dictfile"
+
+	"github.com/klauspost/compress/zstd"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// runEnv makes the test binary run main instead of the tests, so a test can
+// run the command as a child process and look at its exit code.
+const runEnv = "ZSTD_LEARNING_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runEnv) == "1" {
+		main()
+		exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// run runs the command with args and returns its exit code and combined
+// output.
+func run(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runEnv+"=1")
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), string(out)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0, string(out)
+}
+
+// fakeGateway starts a Pushgateway stand-in and returns its URL and a
+// function returning the gauge values of the pushes it has received.
+func fakeGateway(t *testing.T) (string, func() map[string]float64) {
+	t.Helper()
+	var mu sync.Mutex
+	gauges := map[string]float64{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		mu.Lock()
+		defer mu.Unlock()
+		for {
+			var family dto.MetricFamily
+			if err := dec.Decode(&family); err != nil {
+				return
+			}
+			for _, metric := range family.Metric {
+				gauges[family.GetName()] = metric.GetGauge().GetValue() + metric.GetCounter().GetValue()
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, func() map[string]float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return maps.Clone(gauges)
+	}
+}
+
+func TestAllowEmpty(t *testing.T) {
+	in := t.TempDir()
+	url, pushed := fakeGateway(t)
+
+	code, out := run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url)
+	if code != 1 || !strings.Contains(out, "no files found") {
+		t.Fatalf("without -allow-empty: exit %d, output:\n%s", code, out)
+	}
+	if len(pushed()) != 0 {
+		t.Fatal("metrics pushed for a run that failed on empty input")
+	}
+
+	code, out = run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url, "-allow-empty")
+	if code != 0 {
+		t.Fatalf("with -allow-empty: exit %d, output:\n%s", code, out)
+	}
+	gauges := pushed()
+	for _, name := range []string{"dict_samples_count", "dict_sample_bytes", "dict_files_scanned", "dict_output_bytes"} {
+		if value, ok := gauges[name]; !ok || value != 0 {
+			t.Errorf("%s: pushed %v (present %v), want 0", name, value, ok)
+		}
+	}
+}
+
+func TestAutoSizeKeepsStdoutToTheSummary(t *testing.T) {
+	url, _ := fakeGateway(t)
+	args := []string{"-generate", "people", "-generate-count", "200", "-generate-seed", "3", "-split", "json",
+		"-auto-size", "-auto-size-min", "1024", "-dict-size", "2048", "-eval-sample", "10", "-eval-seed", "1",
+		"-pushgateway", url}
+
+	cmd := exec.Command(os.Args[0], append(args, "-out", t.TempDir(), "-summary-format", "json")...)
+	cmd.Env = append(os.Environ(), runEnv+"=1")
+	var stdout, stderr strings.Builder
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%v, stderr:\n%s", err, stderr.String())
+	}
+	var sum map[string]any
+	if err := json.Unmarshal([]byte(stdout.String()), &sum); err != nil {
+		t.Fatalf("stdout is not the JSON summary (%v):\n%s", err, stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "auto-size    1024:") || !strings.Contains(stderr.String(), "scoring on 10 of") {
+		t.Errorf("auto-size notes missing from stderr:\n%s", stderr.String())
+	}
+
+	code, out := run(t, append(args, "-out", t.TempDir(), "-quiet")...)
+	if code != 0 {
+		t.Fatalf("with -quiet: exit %d, output:\n%s", code, out)
+	}
+	if strings.Contains(out, "auto-size") {
+		t.Errorf("with -quiet: auto-size notes printed:\n%s", out)
+	}
+}
+
+// trainDict runs the trainer on generated people records with the extra
+// args and returns the path of the dictionary it wrote.
+func trainDict(t *testing.T, args ...string) string {
+	t.Helper()
+	url, _ := fakeGateway(t)
+	out := t.TempDir()
+	args = append([]string{"-generate", "people", "-generate-count", "300", "-generate-seed", "1", "-split", "json",
+		"-dict-size", "4096", "-out", out, "-pushgateway", url, "-quiet"}, args...)
+	if code, output := run(t, args...); code != 0 {
+		t.Fatalf("training: exit %d, output:\n%s", code, output)
+	}
+	paths, err := filepath.Glob(filepath.Join(out, "zstd_dict_*.zdict"))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("training wrote %q (%v), want one dictionary", paths, err)
+	}
+	return paths[0]
+}
+
+// TestDictFormat checks that -dict-format raw writes the content section of
+// the trained dictionary, and that each format works with the matching
+// decode option: the wrapped file as it is, the raw one with -raw-dict and
+// the ID it was trained with.
+func TestDictFormat(t *testing.T) {
+	wrapped, err := os.ReadFile(trainDict(t, "-dict-id", "77"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := zstd.InspectDictionary(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID() != 77 {
+		t.Errorf("wrapped dictionary has ID %d, want 77", info.ID())
+	}
+	if got, err := formatDict(wrapped, "wrapped"); err != nil || !bytes.Equal(got, wrapped) {
+		t.Errorf("wrapped format changed the dictionary (%v)", err)
+	}
+	if got, err := formatDict(wrapped, "raw"); err != nil || !bytes.Equal(got, info.Content()) {
+		t.Errorf("raw format is %d bytes (%v), want the %d content bytes", len(got), err, len(info.Content()))
+	}
+	if _, err := formatDict([]byte("not a dictionary"), "raw"); err == nil {
+		t.Error("raw format of a file without a dictionary header succeeded")
+	}
+
+	// Training is not byte-for-byte repeatable, so the raw file is checked
+	// on its own.
+	rawPath := trainDict(t, "-dict-id", "77", "-dict-format", "raw")
+	raw, err := os.ReadFile(rawPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint32(raw) == dictfile.Magic {
+		t.Fatal("raw dictionary starts with the dictionary magic")
+	}
+	if _, err := dictfile.Load(rawPath, false, ""); err == nil || !strings.Contains(err.Error(), "-raw-dict") {
+		t.Errorf("loading the raw dictionary without -raw-dict: got %v, want a hint to use it", err)
+	}
+	loaded, err := dictfile.Load(rawPath, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte(`{"id":12,"name":"Ada Lovelace","email":"ada@example.com","age":36}`)
+	for _, tc := range []struct {
+		name string
+		enc  zstd.EOption
+		dec  zstd.DOption
+	}{
+		{"wrapped", zstd.WithEncoderDict(wrapped), zstd.WithDecoderDicts(wrapped)},
+		{"raw", zstd.WithEncoderDictRaw(77, loaded.Data), zstd.WithDecoderDictRaw(77, loaded.Data)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			encoder, err := zstd.NewWriter(nil, tc.enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer encoder.Close()
+			frame := encoder.EncodeAll(data, nil)
+			decoder, err := zstd.NewReader(nil, tc.dec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer decoder.Close()
+			got, err := decoder.DecodeAll(frame, nil)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("round trip: %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestMinSamples(t *testing.T) {
+	url, pushed := fakeGateway(t)
+	five := filepath.Dir(writeSampleFiles(t, 1500, 1500, 1500, 1500, 1500)[0])
+	one := filepath.Dir(writeSampleFiles(t, 1500)[0])
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"below -min-samples", []string{"-in", five},
+			"collected 5 samples from 5 files, fewer than -min-samples 20; a dictionary trained on so few samples is usually poor. To fix: lower -max-sample-bytes (now 32768)"},
+		{"below the trainer's floor", []string{"-in", one, "-min-samples", "2"},
+			"not enough samples to train (got 1)"},
+		{"generated", []string{"-generate", "people", "-generate-count", "5", "-split", "json"},
+			"generated 5 people records gave 5 samples, fewer than -min-samples 20; raise -generate-count"},
+		{"-min-samples under the floor", []string{"-in", five, "-min-samples", "1"},
+			"min-samples must be at least 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, out := run(t, append(tt.args, "-out", t.TempDir(), "-pushgateway", url)...)
+			if code != 1 || !strings.Contains(out, tt.want) {
+				t.Errorf("exit %d, want 1 with %q, output:\n%s", code, tt.want, out)
+			}
+		})
+	}
+	if len(pushed()) != 0 {
+		t.Error("metrics pushed for runs that failed before training")
+	}
+}
+
+// TestExpectSamplesMin splits files that each hold one JSON array on a single
+// line: -split lines sees one sample per file, which -expect-samples-min
+// catches before the too-few-samples checks, and -split json sees the
+// records.
+func TestExpectSamplesMin(t *testing.T) {
+	url, pushed := fakeGateway(t)
+	in := t.TempDir()
+	for i := 0; i < 4; i++ {
+		var array bytes.Buffer
+		if err := json.Compact(&array, generated(t, "people", "json", 50)); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(in, fmt.Sprintf("people%d.json", i)), array.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args := []string{"-in", in, "-expect-samples-min", "150", "-dict-size", "4096", "-pushgateway", url}
+
+	code, out := run(t, append(args, "-split", "lines", "-out", t.TempDir())...)
+	want := "-split lines cut only 4 samples from 4 files, fewer than -expect-samples-min 150; check that -split matches the data format"
+	if code != 1 || !strings.Contains(out, want) {
+		t.Errorf("-split lines: exit %d, want 1 with %q, output:\n%s", code, want, out)
+	}
+	if strings.Contains(out, "-min-samples") {
+		t.Errorf("-split lines: reported as too few samples, output:\n%s", out)
+	}
+	if len(pushed()) != 0 {
+		t.Error("metrics pushed for a run that failed before training")
+	}
+
+	if code, out := run(t, append(args, "-split", "json", "-out", t.TempDir())...); code != 0 || !strings.Contains(out, "from 200 samples") {
+		t.Errorf("-split json: exit %d, want 0 with 200 samples, output:\n%s", code, out)
+	}
+	if code, out := run(t, "-in", in, "-expect-samples-min", "150", "-out", t.TempDir(), "-pushgateway", url); code != 1 || !strings.Contains(out, "-expect-samples-min requires -split") {
+		t.Errorf("without -split: exit %d, want 1, output:\n%s", code, out)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"zstd-learning/internal/dictfile"
+)
+
+// dictMetadata is written next to each dictionary as <dict>.json so a
+// dictionary can be traced back to the data and settings that produced it.
+type dictMetadata struct {
+	Dictionary   string         `json:"dictionary"`
+	DictID       uint32         `json:"dict_id"`
+	Format       string         `json:"format"`
+	DictBytes    int            `json:"dict_bytes"`
+	TargetBytes  int            `json:"target_bytes"`
+	CreatedAt    string         `json:"created_at"`
+	Inputs       []string       `json:"inputs"`
+	Sampling     samplingConfig `json:"sampling"`
+	FilesScanned int            `json:"files_scanned"`
+	Samples      int            `json:"samples"`
+	SampleBytes  int64          `json:"sample_bytes"`
+	Roots        []rootStats    `json:"roots"`
+	// Truncated is set when -collect-timeout ended sample collection
+	// before every file was read.
+	Truncated      bool `json:"collection_truncated,omitempty"`
+	FilesUnscanned int  `json:"files_unscanned,omitempty"`
+	SpecialSkipped int  `json:"special_files_skipped,omitempty"`
+	// AutoSize records the sizes tried by -auto-size and the one kept.
+	AutoSize *autoSizeResult `json:"auto_size,omitempty"`
+	// Generated is set when -generate supplied synthetic samples instead
+	// of Inputs, with the parameters that reproduce them.
+	Generated *generateConfig `json:"generated,omitempty"`
+	// Difficulty records the -difficulty-weighted draw. Roots then count
+	// the candidates rather than the samples drawn from them.
+	Difficulty *difficultyStats `json:"difficulty,omitempty"`
+}
+
+type samplingConfig struct {
+	MaxSamples     int    `json:"max_samples"`
+	MaxSampleBytes int    `json:"max_sample_bytes"`
+	Split          string `json:"split"`
+	Balance        bool   `json:"balance"`
+	Interleave     bool   `json:"interleave"`
+	Filter         string `json:"filter,omitempty"`
+	CollectTimeout string `json:"collect_timeout,omitempty"`
+	DecodeZst      bool   `json:"decode_zst,omitempty"`
+	// AutoSampleSize is set when -auto-sample-size chose MaxSampleBytes.
+	AutoSampleSize *sampleSizing `json:"auto_sample_size,omitempty"`
+}
+
+func newDictMetadata(path string, trained []byte, targetBytes int, inputs []string, opts sampleOptions, stats sampleStats) dictMetadata {
+	meta := dictMetadata{
+		Dictionary:  path,
+		DictBytes:   len(trained),
+		Format:      "wrapped",
+		TargetBytes: targetBytes,
+		CreatedAt:   deterministic.Now().UTC().Format(time.RFC3339),
+		Inputs:      append([]string{}, inputs...),
+		Sampling: samplingConfig{
+			MaxSamples:     opts.MaxSamples,
+			MaxSampleBytes: opts.MaxSampleBytes,
+			Split:          opts.Split,
+			Balance:        opts.Balance,
+			Interleave:     opts.Interleave && len(inputs) > 1,
+			DecodeZst:      opts.DecodeZst,
+		},
+		FilesScanned:   stats.FilesProcessed,
+		Samples:        stats.Samples,
+		SampleBytes:    stats.InputBytes,
+		Roots:          stats.Roots,
+		Truncated:      stats.Truncated,
+		FilesUnscanned: stats.FilesUnscanned,
+		SpecialSkipped: stats.SpecialSkipped,
+	}
+	if opts.Match != nil {
+		meta.Sampling.Filter = opts.Match.String()
+	}
+	if info, err := zstd.InspectDictionary(trained); err == nil {
+		meta.DictID = info.ID()
+	}
+	return meta
+}
+
+func writeDictMetadata(dictPath string, meta dictMetadata) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dictPath+".json", append(data, '\n'), 0o644)
+}
+
+// writeDictPackage writes dict and meta as a single .zdictpkg next to
+// dictPath and returns its path.
+func writeDictPackage(dictPath string, dict []byte, meta dictMetadata) (string, error) {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	pkgPath := strings.TrimSuffix(dictPath, ".zdict") + dictfile.PackageExt
+	return pkgPath, dictfile.WritePackage(pkgPath, dict, data)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"zstd-learning/internal/chunker"
+	"zstd-learning/internal/synth"
+)
+
+// generated returns count records of kind as generate-data writes them.
+func generated(tb testing.TB, kind, format string, count int) []byte {
+	tb.Helper()
+	gen, err := synth.New(synth.Options{
+		Type:         kind,
+		Seed:         1,
+		Locales:      "en",
+		EmailDomains: "example.com",
+		Clock:        synth.Clock{Base: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Step: time.Second},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := gen.Write(&buf, count, format); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func FuzzSplitSamples(f *testing.F) {
+	for _, kind := range synth.Types {
+		for _, format := range synth.Formats {
+			data := generated(f, kind, format, 8)
+			for mode := range chunker.Modes {
+				f.Add(data, uint8(mode), uint16(256), uint16(0))
+			}
+			f.Add(data, uint8(0), uint16(64), uint16(16))
+		}
+	}
+	f.Add([]byte(" \n\t\n"), uint8(0), uint16(1), uint16(0))
+	f.Add([]byte("a,b\n\"c\nd\",e\n"), uint8(3), uint16(3), uint16(0))
+
+	f.Fuzz(func(t *testing.T, data []byte, mode uint8, limit, overlapSeed uint16) {
+		opts := sampleOptions{
+			Split:          chunker.Modes[int(mode)%len(chunker.Modes)],
+			MaxSampleBytes: int(limit)%4096 + 1,
+		}
+		if opts.Split == "bytes" {
+			opts.ChunkOverlap = int(overlapSeed) % opts.MaxSampleBytes
+		}
+		samples, total, err := readSamples(context.Background(), "fuzz", bytes.NewReader(data), opts, len(data)+1)
+		if err != nil {
+			return
+		}
+		var sum int64
+		for _, sample := range samples {
+			if len(sample) == 0 || len(sample) > opts.MaxSampleBytes {
+				t.Fatalf("%s: sample of %d bytes with -max-sample-bytes %d", opts.Split, len(sample), opts.MaxSampleBytes)
+			}
+			sum += int64(len(sample))
+		}
+		if sum != total {
+			t.Fatalf("%s: reported %d sample bytes, samples hold %d", opts.Split, total, sum)
+		}
+		// Overlapping windows repeat up to overlap bytes each; nothing else
+		// may add bytes the input does not have.
+		allowed := int64(len(data))
+		if len(samples) > 1 {
+			allowed += int64(opts.ChunkOverlap) * int64(len(samples)-1)
+		}
+		if total > allowed {
+			t.Fatalf("%s: %d sample bytes from %d input bytes (overlap %d)", opts.Split, total, len(data), opts.ChunkOverlap)
+		}
+	})
+}
+
+// writeSampleFiles writes files of the given sizes, in sorted order, each
+// filled with lines naming it.
+func writeSampleFiles(t *testing.T, sizes ...int) []string {
+	t.Helper()
+	dir := t.TempDir()
+	var paths []string
+	for i, size := range sizes {
+		var data []byte
+		for j := 0; len(data) < size; j++ {
+			data = fmt.Appendf(data, "file %d line %d\n", i, j)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("%02d.log", i))
+		if err := os.WriteFile(path, data[:size], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func TestCollectBalanced(t *testing.T) {
+	// Two large files first, then small ones the sequential collector
+	// never reaches within the budget.
+	paths := writeSampleFiles(t, 64<<10, 32<<10, 1500, 900, 2048, 300)
+	opts := sampleOptions{Split: "bytes", MaxSampleBytes: 1024}
+
+	samples, stats, err := collectRoot(context.Background(), paths, opts, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.FilesProcessed != 1 || len(samples) != 12 {
+		t.Fatalf("sequential: %d samples from %d files, want 12 from the first file", len(samples), stats.FilesProcessed)
+	}
+
+	opts.Balance = true
+	samples, stats, err = collectRoot(context.Background(), paths, opts, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 12 || stats.Samples != 12 {
+		t.Errorf("balanced: %d samples (%d counted), want the budget of 12", len(samples), stats.Samples)
+	}
+	if stats.FilesProcessed != len(paths) {
+		t.Errorf("balanced: %d of %d files contributed", stats.FilesProcessed, len(paths))
+	}
+	for i := range paths {
+		prefix := []byte(fmt.Sprintf("file %d line", i))
+		found := false
+		for _, sample := range samples {
+			found = found || bytes.Contains(sample, prefix)
+		}
+		if !found {
+			t.Errorf("balanced: no sample from %s", filepath.Base(paths[i]))
+		}
+	}
+
+	// A budget larger than the files drains every one of them, as the
+	// sequential collector does.
+	_, balanced, err := collectRoot(context.Background(), paths, opts, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Balance = false
+	_, sequential, err := collectRoot(context.Background(), paths, opts, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balanced.InputBytes != sequential.InputBytes || balanced.Samples != sequential.Samples {
+		t.Errorf("balanced without a limit: %d samples of %d bytes, sequential %d of %d", balanced.Samples, balanced.InputBytes, sequential.Samples, sequential.InputBytes)
+	}
+}
+
+func TestChunkOverlap(t *testing.T) {
+	// No whitespace, so no window loses bytes to trimming.
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = 'a' + byte(i*7%26)
+	}
+	path := filepath.Join(t.TempDir(), "seq.txt")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		overlap, chunks int
+	}{
+		{0, 10},
+		{100, 11}, // 1000 bytes, then 900 new bytes per window
+		{500, 19},
+		{999, 9001},
+	}
+	for _, tt := range tests {
+		opts := sampleOptions{Split: "bytes", MaxSampleBytes: 1000, ChunkOverlap: tt.overlap}
+		for _, balance := range []bool{false, true} {
+			opts.Balance = balance
+			samples, _, err := collectRoot(context.Background(), []string{path}, opts, 100000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(samples) != tt.chunks {
+				t.Errorf("overlap %d, balance %v: %d chunks, want %d", tt.overlap, balance, len(samples), tt.chunks)
+				continue
+			}
+			var rebuilt []byte
+			for i, sample := range samples {
+				if i > 0 {
+					prev := samples[i-1]
+					if shared := prev[len(prev)-tt.overlap:]; !bytes.Equal(sample[:tt.overlap], shared) {
+						t.Errorf("overlap %d, balance %v: chunk %d does not start with the last %d bytes of chunk %d", tt.overlap, balance, i, tt.overlap, i-1)
+					}
+					sample = sample[tt.overlap:]
+				}
+				rebuilt = append(rebuilt, sample...)
+			}
+			if !bytes.Equal(rebuilt, data) {
+				t.Errorf("overlap %d, balance %v: chunks without their overlap do not rebuild the file", tt.overlap, balance)
+			}
+		}
+	}
+}
+
+func TestChunkOverlapMustBeLessThanTheChunk(t *testing.T) {
+	for _, overlap := range []string{"1024", "2000", "-1"} {
+		code, out := run(t, "-generate", "people", "-generate-count", "10", "-max-sample-bytes", "1024", "-chunk-overlap", overlap, "-out", t.TempDir())
+		if code != 1 || !strings.Contains(out, "chunk-overlap must be at least 0 and less than max-sample-bytes") {
+			t.Errorf("-chunk-overlap %s: exit %d, output:\n%s", overlap, code, out)
+		}
+	}
+}
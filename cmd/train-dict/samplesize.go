@@ -0,0 +1,45 @@
+package main
+
+import "math"
+
+const (
+	// defaultSampleRatio is the usual rule of thumb for dictionary training:
+	// about 100 bytes of samples for every byte of dictionary.
+	defaultSampleRatio = 100
+	// defaultOversizeFactor is how many times -dict-size a single sample may
+	// be before train-dict warns that it is oversized.
+	defaultOversizeFactor = 4
+	// minDerivedSampleBytes keeps -auto-sample-size from cutting samples too
+	// small to hold a useful match.
+	minDerivedSampleBytes = 64
+)
+
+// sampleSizing records how -auto-sample-size derived -max-sample-bytes.
+type sampleSizing struct {
+	SampleRatio    float64 `json:"sample_ratio"`
+	TotalBytes     int64   `json:"total_sample_bytes"`
+	MaxSamples     int     `json:"max_samples"`
+	MaxSampleBytes int     `json:"max_sample_bytes"`
+}
+
+// deriveSampleSize spreads sampleRatio × dictSize bytes of samples over
+// maxSamples samples.
+func deriveSampleSize(dictSize, maxSamples int, sampleRatio float64) sampleSizing {
+	total := int64(math.Ceil(float64(dictSize) * sampleRatio))
+	perSample := int(math.Ceil(float64(total) / float64(maxSamples)))
+	if perSample < minDerivedSampleBytes {
+		perSample = minDerivedSampleBytes
+	}
+	return sampleSizing{
+		SampleRatio:    sampleRatio,
+		TotalBytes:     total,
+		MaxSamples:     maxSamples,
+		MaxSampleBytes: perSample,
+	}
+}
+
+// oversizedSamples reports whether samples of maxSampleBytes are more than
+// factor times the dictionary size; a factor of 0 disables the check.
+func oversizedSamples(maxSampleBytes, dictSize int, factor float64) bool {
+	return factor > 0 && float64(maxSampleBytes) > factor*float64(dictSize)
+}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestSpecialFiles(t *testing.T) {
+	paths := writeSampleFiles(t, 1500, 1500, 1500)
+	in := filepath.Dir(paths[0])
+	if err := syscall.Mkfifo(filepath.Join(in, "pipe.log"), 0o644); err != nil {
+		t.Skipf("cannot create a FIFO: %v", err)
+	}
+	url, _ := fakeGateway(t)
+
+	// Three samples are too few to train on; the FIFO has to be skipped for
+	// the run to get as far as saying so.
+	code, output := run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url)
+	if code != 1 || !strings.Contains(output, "collected 3 samples from 3 files") {
+		t.Errorf("exit %d, output:\n%s", code, output)
+	}
+
+	code, output = run(t, "-in", in, "-out", t.TempDir(), "-pushgateway", url, "-special-files", "error")
+	if code != 1 || !strings.Contains(output, "pipe.log is a FIFO, not a regular file") {
+		t.Errorf("-special-files error: exit %d, output:\n%s", code, output)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"zstd-learning/internal/dictfile"
+)
+
+// runUnpack handles train-dict dict unpack: it verifies a .zdictpkg and
+// extracts the plain .zdict (and its metadata sidecar) for tools that do not
+// understand packages, such as the stock zstd CLI.
+func runUnpack(args []string) {
+	fs := flag.NewFlagSet("dict unpack", flag.ExitOnError)
+	pkgPath := fs.String("pkg", "", "dictionary package (.zdictpkg) to unpack")
+	outPath := fs.String("out", "", "path of the extracted dictionary (default: the package path with .zdict)")
+	writeMetadata := fs.Bool("metadata", true, "also write the embedded metadata as a <dict>.json sidecar")
+	fs.Parse(args)
+
+	if *pkgPath == "" {
+		fmt.Fprintln(os.Stderr, "-pkg is required")
+		exit(1)
+	}
+	if *outPath == "" {
+		*outPath = strings.TrimSuffix(*pkgPath, dictfile.PackageExt) + ".zdict"
+	}
+
+	data, err := os.ReadFile(*pkgPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dict unpack failed: %v\n", err)
+		exit(1)
+	}
+	dict, metadata, err := dictfile.ReadPackage(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dict unpack failed: %s: %v\n", *pkgPath, err)
+		exit(1)
+	}
+	if err := os.WriteFile(*outPath, dict, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "dict unpack failed: %v\n", err)
+		exit(1)
+	}
+	if *writeMetadata {
+		if err := os.WriteFile(*outPath+".json", metadata, 0o644); err != nil {
+			fmt.Fprintf(os.Stderr, "dict unpack failed: %v\n", err)
+			exit(1)
+		}
+	}
+	fmt.Printf("unpacked %s (%d bytes) from %s\n", *outPath, len(dict), *pkgPath)
+}
@@ -0,0 +1,156 @@
+// Package bundle reads and writes the index that compress -batch-small-files
+// appends to a bundle: one zstd stream holding several small files back to
+// back, so they share one frame and its context instead of each paying for
+// a frame of its own.
+//
+// The index is a skippable frame at the very end of the bundle, which every
+// zstd decoder ignores, so a bundle still decodes as the concatenation of its
+// members. Its content is the JSON-encoded Index followed by an 8-byte
+// trailer: the length of the JSON as a little-endian uint32 and the bytes
+// "ZBDX". The trailer sits at the end of the file, so a reader finds the
+// index from the file size alone, without walking the frames before it.
+package bundle
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"zstd-learning/internal/frame"
+)
+
+// FrameID is the skippable frame ID (the low nibble of its magic) of the
+// index frame.
+const FrameID = 0xB
+
+// Version is the index format written by WriteIndex.
+const Version = 1
+
+const (
+	trailerMagic = "ZBDX"
+	trailerSize  = 8
+	headerSize   = 8
+	// maxIndexSize bounds the JSON a reader accepts, so a corrupt trailer
+	// cannot make it allocate gigabytes.
+	maxIndexSize = 64 << 20
+)
+
+// Member is one file of a bundle. Offset and Size locate its bytes in the
+// decoded stream; Name is its base name, relative to the directory of the
+// bundle.
+type Member struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// Index lists the members of a bundle in stream order.
+type Index struct {
+	Version int      `json:"version"`
+	Members []Member `json:"members"`
+}
+
+// Size returns the decoded size of the whole bundle.
+func (idx *Index) Size() int64 {
+	var total int64
+	for _, m := range idx.Members {
+		total += m.Size
+	}
+	return total
+}
+
+// WriteIndex writes the index frame for members to w, after the compressed
+// stream.
+func WriteIndex(w io.Writer, members []Member) error {
+	body, err := json.Marshal(Index{Version: Version, Members: members})
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 0, headerSize+len(body)+trailerSize)
+	buf = binary.LittleEndian.AppendUint32(buf, frame.SkippableMagicMin+FrameID)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(body)+trailerSize))
+	buf = append(buf, body...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(body)))
+	buf = append(buf, trailerMagic...)
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadIndex returns the index of the bundle at path, or nil when path does
+// not end in an index frame and is an ordinary zstd file. An index frame
+// that is present but unreadable, or whose members do not tile the stream,
+// is an error.
+func ReadIndex(path string) (*Index, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < headerSize+trailerSize {
+		return nil, nil
+	}
+
+	var trailer [trailerSize]byte
+	if _, err := f.ReadAt(trailer[:], info.Size()-trailerSize); err != nil {
+		return nil, err
+	}
+	if string(trailer[4:]) != trailerMagic {
+		return nil, nil
+	}
+	bodySize := int64(binary.LittleEndian.Uint32(trailer[:4]))
+	start := info.Size() - trailerSize - bodySize - headerSize
+	if bodySize > maxIndexSize || start < 0 {
+		return nil, nil
+	}
+	var header [headerSize]byte
+	if _, err := f.ReadAt(header[:], start); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(header[:4]) != frame.SkippableMagicMin+FrameID ||
+		int64(binary.LittleEndian.Uint32(header[4:])) != bodySize+trailerSize {
+		return nil, nil
+	}
+
+	body := make([]byte, bodySize)
+	if _, err := f.ReadAt(body, start+headerSize); err != nil {
+		return nil, err
+	}
+	var idx Index
+	if err := json.Unmarshal(body, &idx); err != nil {
+		return nil, fmt.Errorf("bundle index: %w", err)
+	}
+	if idx.Version != Version {
+		return nil, fmt.Errorf("bundle index: unsupported version %d", idx.Version)
+	}
+	if err := idx.check(); err != nil {
+		return nil, fmt.Errorf("bundle index: %w", err)
+	}
+	return &idx, nil
+}
+
+// check rejects member names that are not plain base names, and members
+// that overlap or leave gaps.
+func (idx *Index) check() error {
+	if len(idx.Members) == 0 {
+		return errors.New("no members")
+	}
+	var offset int64
+	for _, m := range idx.Members {
+		if m.Name == "" || m.Name == "." || m.Name == ".." || strings.ContainsAny(m.Name, `/\`) {
+			return fmt.Errorf("invalid member name %q", m.Name)
+		}
+		if m.Offset != offset || m.Size < 0 {
+			return fmt.Errorf("member %s at offset %d, size %d does not follow the previous member ending at %d", m.Name, m.Offset, m.Size, offset)
+		}
+		offset += m.Size
+	}
+	return nil
+}
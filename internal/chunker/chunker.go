@@ -0,0 +1,292 @@
+// Package chunker splits sample data into chunks for dictionary training.
+//
+// Each mode reads an io.Reader and returns one chunk per call to Next until
+// io.EOF:
+//
+//	bytes  fixed windows of maxBytes, optionally overlapping
+//	lines  one chunk per non-blank line
+//	json   one chunk per element of a top-level JSON array
+//	csv    one chunk per CSV row, as the raw bytes of the row
+//
+// Chunks have surrounding ASCII whitespace trimmed and blank chunks are
+// dropped. Records longer than maxBytes are truncated to maxBytes rather
+// than rejected, since a prefix is still a useful training sample.
+package chunker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Modes lists the split modes accepted by New.
+var Modes = []string{"bytes", "lines", "json", "csv"}
+
+// Chunker yields successive chunks. Next returns io.EOF after the last
+// chunk; returned slices are not reused by later calls.
+type Chunker interface {
+	Next() ([]byte, error)
+}
+
+// New returns the chunker for mode. overlap applies only to bytes mode and
+// must be zero for the others.
+func New(mode string, r io.Reader, maxBytes, overlap int) (Chunker, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("chunker: maxBytes must be positive")
+	}
+	if overlap != 0 && mode != "bytes" {
+		return nil, fmt.Errorf("chunker: overlap is only supported in bytes mode")
+	}
+	switch mode {
+	case "bytes":
+		if overlap < 0 || overlap >= maxBytes {
+			return nil, fmt.Errorf("chunker: overlap must be at least 0 and less than maxBytes")
+		}
+		return NewBlocks(r, maxBytes, overlap), nil
+	case "lines":
+		return NewLines(r, maxBytes), nil
+	case "json":
+		return NewJSONArray(r, maxBytes), nil
+	case "csv":
+		return NewCSVRows(r, maxBytes), nil
+	}
+	return nil, fmt.Errorf("chunker: unknown mode %q (expected bytes, lines, json or csv)", mode)
+}
+
+// Blocks splits input into fixed windows of maxBytes. With a non-zero
+// overlap, each window after the first starts overlap bytes before the
+// previous one ended, so patterns that straddle a boundary appear whole in
+// at least one chunk.
+type Blocks struct {
+	r       io.Reader
+	buf     []byte
+	overlap int
+	carried int
+	offset  int64
+	done    bool
+}
+
+// NewBlocks returns a Blocks chunker. overlap must be less than maxBytes.
+func NewBlocks(r io.Reader, maxBytes, overlap int) *Blocks {
+	return &Blocks{r: r, buf: make([]byte, maxBytes), overlap: overlap}
+}
+
+// Offset returns the number of bytes consumed from the reader so far.
+func (b *Blocks) Offset() int64 {
+	return b.offset
+}
+
+func (b *Blocks) Next() ([]byte, error) {
+	for !b.done {
+		n, err := io.ReadFull(b.r, b.buf[b.carried:])
+		b.offset += int64(n)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, err
+			}
+			b.done = true
+			if n == 0 {
+				break
+			}
+		}
+		data := bytes.Clone(trimSpace(b.buf[:b.carried+n]))
+		if !b.done {
+			b.carried = copy(b.buf, b.buf[len(b.buf)-b.overlap:])
+		}
+		if len(data) > 0 {
+			return data, nil
+		}
+	}
+	return nil, io.EOF
+}
+
+// Lines yields one chunk per non-blank line. Lines end at '\n'; a trailing
+// '\r' is trimmed with the other whitespace.
+type Lines struct {
+	r        *bufio.Reader
+	maxBytes int
+}
+
+// NewLines returns a Lines chunker.
+func NewLines(r io.Reader, maxBytes int) *Lines {
+	return &Lines{r: bufio.NewReader(r), maxBytes: maxBytes}
+}
+
+func (l *Lines) Next() ([]byte, error) {
+	for {
+		line, err := l.readLine()
+		if err != nil && len(line) == 0 {
+			return nil, err
+		}
+		if data := trimSpace(line); len(data) > 0 {
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readLine returns the next line, keeping at most maxBytes of it and
+// discarding the rest. The error is io.EOF only for a final line without a
+// newline, or with an empty line at the end of input.
+func (l *Lines) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		part, err := l.r.ReadSlice('\n')
+		if room := l.maxBytes - len(line); room > 0 {
+			line = append(line, part[:min(len(part), room)]...)
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		return line, err
+	}
+}
+
+// JSONArray yields the elements of a top-level JSON array, each as its raw
+// JSON text. Input that is empty or only whitespace yields no chunks; any
+// other input that is not a single well-formed array is an error.
+type JSONArray struct {
+	dec      *json.Decoder
+	maxBytes int
+	started  bool
+	done     bool
+}
+
+// NewJSONArray returns a JSONArray chunker. Elements are decoded whole
+// before truncation, so memory use follows the largest element.
+func NewJSONArray(r io.Reader, maxBytes int) *JSONArray {
+	return &JSONArray{dec: json.NewDecoder(r), maxBytes: maxBytes}
+}
+
+func (j *JSONArray) Next() ([]byte, error) {
+	if j.done {
+		return nil, io.EOF
+	}
+	if !j.started {
+		j.started = true
+		tok, err := j.dec.Token()
+		if errors.Is(err, io.EOF) {
+			j.done = true
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, j.errorf("%w", err)
+		}
+		if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+			return nil, j.errorf("top-level value is not an array")
+		}
+	}
+	if !j.dec.More() {
+		if _, err := j.dec.Token(); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, j.errorf("%w", err)
+		}
+		if _, err := j.dec.Token(); !errors.Is(err, io.EOF) {
+			return nil, j.errorf("unexpected data after the top-level array")
+		}
+		j.done = true
+		return nil, io.EOF
+	}
+	var elem json.RawMessage
+	if err := j.dec.Decode(&elem); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, j.errorf("%w", err)
+	}
+	if len(elem) > j.maxBytes {
+		elem = elem[:j.maxBytes]
+	}
+	return elem, nil
+}
+
+func (j *JSONArray) errorf(format string, args ...any) error {
+	j.done = true
+	return fmt.Errorf("chunker: invalid JSON at offset %d: %w", j.dec.InputOffset(), fmt.Errorf(format, args...))
+}
+
+// CSVRows yields one chunk per CSV record, as the record's bytes in the
+// input rather than a re-encoding, so quoting and separators survive into
+// the samples. Rows may have differing numbers of fields.
+type CSVRows struct {
+	rec      *recorder
+	csv      *csv.Reader
+	maxBytes int
+	start    int64
+}
+
+// NewCSVRows returns a CSVRows chunker for comma-separated input.
+func NewCSVRows(r io.Reader, maxBytes int) *CSVRows {
+	rec := &recorder{r: r}
+	reader := csv.NewReader(rec)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	return &CSVRows{rec: rec, csv: reader, maxBytes: maxBytes}
+}
+
+func (c *CSVRows) Next() ([]byte, error) {
+	for {
+		if _, err := c.csv.Read(); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, io.EOF
+			}
+			return nil, fmt.Errorf("chunker: invalid CSV: %w", err)
+		}
+		end := c.csv.InputOffset()
+		row := c.rec.take(c.start, end)
+		c.start = end
+		if data := trimSpace(row); len(data) > 0 {
+			if len(data) > c.maxBytes {
+				data = data[:c.maxBytes]
+			}
+			return bytes.Clone(data), nil
+		}
+	}
+}
+
+// recorder keeps the bytes read through it from base onwards, so records
+// can be sliced out of the input by offset even though the CSV reader
+// buffers ahead.
+type recorder struct {
+	r    io.Reader
+	buf  []byte
+	base int64
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.buf = append(r.buf, p[:n]...)
+	return n, err
+}
+
+// take returns the input between offsets start and end and forgets
+// everything before end.
+func (r *recorder) take(start, end int64) []byte {
+	data := r.buf[start-r.base : end-r.base]
+	r.buf = r.buf[end-r.base:]
+	r.base = end
+	return data
+}
+
+func trimSpace(input []byte) []byte {
+	start, end := 0, len(input)
+	for start < end && isSpace(input[start]) {
+		start++
+	}
+	for end > start && isSpace(input[end-1]) {
+		end--
+	}
+	return input[start:end]
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t'
+}
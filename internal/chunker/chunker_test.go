@@ -0,0 +1,230 @@
+package chunker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"zstd-learning/internal/synth"
+)
+
+// generated returns count records of kind as generate-data writes them.
+func generated(tb testing.TB, kind, format string, count int) []byte {
+	tb.Helper()
+	gen, err := synth.New(synth.Options{
+		Type:         kind,
+		Seed:         1,
+		Locales:      "en",
+		EmailDomains: "example.com",
+		Clock:        synth.Clock{Base: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Step: time.Second},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := gen.Write(&buf, count, format); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func collect(c Chunker) ([]string, error) {
+	var chunks []string
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks, nil
+		}
+		if err != nil {
+			return chunks, err
+		}
+		chunks = append(chunks, string(chunk))
+	}
+}
+
+func TestChunkers(t *testing.T) {
+	long := strings.Repeat("x", 10000)
+	tests := []struct {
+		name     string
+		mode     string
+		input    string
+		maxBytes int
+		overlap  int
+		want     []string
+		wantErr  string
+	}{
+		{"bytes/empty", "bytes", "", 4, 0, nil, ""},
+		{"bytes/blank", "bytes", " \n\t \r\n", 4, 0, nil, ""},
+		{"bytes/exact boundary", "bytes", "abcdefgh", 4, 0, []string{"abcd", "efgh"}, ""},
+		{"bytes/short last block", "bytes", "abcdefghi", 4, 0, []string{"abcd", "efgh", "i"}, ""},
+		{"bytes/smaller than a block", "bytes", "ab", 4, 0, []string{"ab"}, ""},
+		{"bytes/trims and drops blank blocks", "bytes", "ab\n    \ncd", 4, 0, []string{"ab", "cd"}, ""},
+		{"bytes/overlap", "bytes", "abcdefgh", 4, 2, []string{"abcd", "cdef", "efgh"}, ""},
+		{"bytes/overlap short tail", "bytes", "abcdefghi", 4, 1, []string{"abcd", "defg", "ghi"}, ""},
+		{"bytes/long input", "bytes", long, 4096, 0, []string{long[:4096], long[:4096], long[:10000-8192]}, ""},
+
+		{"lines/empty", "lines", "", 5, 0, nil, ""},
+		{"lines/blank", "lines", "\n \r\n\t\n", 5, 0, nil, ""},
+		{"lines/plain", "lines", "one\ntwo\n", 5, 0, []string{"one", "two"}, ""},
+		{"lines/no final newline", "lines", "one\ntwo", 5, 0, []string{"one", "two"}, ""},
+		{"lines/crlf and blank lines", "lines", "one\r\n\n  \r\ntwo\r\n", 5, 0, []string{"one", "two"}, ""},
+		{"lines/exact boundary", "lines", "abcde\nfghij", 5, 0, []string{"abcde", "fghij"}, ""},
+		{"lines/oversized", "lines", "abcdefgh\nxy\n", 5, 0, []string{"abcde", "xy"}, ""},
+		{"lines/oversized past the read buffer", "lines", long + "\nb\n", 5, 0, []string{"xxxxx", "b"}, ""},
+
+		{"json/empty", "json", "", 8, 0, nil, ""},
+		{"json/blank", "json", " \n\t", 8, 0, nil, ""},
+		{"json/empty array", "json", " [ ] \n", 8, 0, nil, ""},
+		{"json/elements", "json", `[1, "two", {"a":3}, null, [4]]`, 8, 0, []string{"1", `"two"`, `{"a":3}`, "null", "[4]"}, ""},
+		{"json/exact boundary", "json", `["abcdef"]`, 8, 0, []string{`"abcdef"`}, ""},
+		{"json/oversized", "json", `["abcdefg", {"name":"long value"}]`, 8, 0, []string{`"abcdefg`, `{"name":`}, ""},
+		{"json/not an array", "json", `{"a":1}`, 8, 0, nil, "top-level value is not an array"},
+		{"json/scalar", "json", `42`, 8, 0, nil, "top-level value is not an array"},
+		{"json/not json", "json", `nope`, 8, 0, nil, "invalid JSON at offset"},
+		{"json/unterminated", "json", `[1,2`, 8, 0, []string{"1", "2"}, "unexpected end of JSON input"},
+		{"json/truncated element", "json", `[1,{"a":`, 8, 0, []string{"1"}, "unexpected EOF"},
+		{"json/missing comma", "json", `[1 2]`, 8, 0, []string{"1"}, "invalid JSON at offset"},
+		{"json/trailing data", "json", `[1] [2]`, 8, 0, []string{"1"}, "unexpected data after the top-level array"},
+
+		{"csv/empty", "csv", "", 8, 0, nil, ""},
+		{"csv/blank lines", "csv", "\n\n", 8, 0, nil, ""},
+		{"csv/rows", "csv", "a,b\nc,d\n", 8, 0, []string{"a,b", "c,d"}, ""},
+		{"csv/crlf and blank lines", "csv", "a,b\r\n\r\n\nc,d", 8, 0, []string{"a,b", "c,d"}, ""},
+		{"csv/differing fields", "csv", "a,b,c\nd\n", 8, 0, []string{"a,b,c", "d"}, ""},
+		{"csv/quoting kept", "csv", "\"x,y\",z\n\"multi\nline\",w\n", 64, 0, []string{`"x,y",z`, "\"multi\nline\",w"}, ""},
+		{"csv/exact boundary", "csv", "abcd,efg\nh\n", 8, 0, []string{"abcd,efg", "h"}, ""},
+		{"csv/oversized", "csv", "abcd,efgh\n\"quoted,field\",x\n", 8, 0, []string{"abcd,efg", `"quoted,`}, ""},
+		{"csv/bare quote", "csv", "a,b\nc \"d\",e\n", 8, 0, []string{"a,b"}, "invalid CSV"},
+		{"csv/extraneous quote", "csv", "\"a\"b,c\n", 8, 0, nil, "invalid CSV"},
+		{"csv/unterminated quote", "csv", "a\n\"b,c\n", 8, 0, []string{"a"}, "invalid CSV"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := New(tt.mode, strings.NewReader(tt.input), tt.maxBytes, tt.overlap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := collect(c)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr) || !strings.HasPrefix(err.Error(), "chunker: ")):
+				t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			if chunk, err := c.Next(); err != io.EOF {
+				t.Errorf("Next after the end = %q, %v; want io.EOF", chunk, err)
+			}
+		})
+	}
+}
+
+func TestChunkersPassReadErrors(t *testing.T) {
+	errRead := errors.New("disk on fire")
+	for _, mode := range Modes {
+		input := io.MultiReader(strings.NewReader(map[string]string{
+			"bytes": "abc\n",
+			"lines": "abc\n",
+			"json":  "[1,",
+			"csv":   "a,b\n",
+		}[mode]), iotest.ErrReader(errRead))
+		c, err := New(mode, input, 4, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := collect(c); !errors.Is(err, errRead) {
+			t.Errorf("%s: got %v, want the read error", mode, err)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		mode              string
+		maxBytes, overlap int
+		wantErr           string
+	}{
+		{"bytes", 4, 3, ""},
+		{"lines", 1, 0, ""},
+		{"bytes", 0, 0, "maxBytes must be positive"},
+		{"json", -1, 0, "maxBytes must be positive"},
+		{"bytes", 4, 4, "overlap must be at least 0 and less than maxBytes"},
+		{"bytes", 4, -1, "overlap must be at least 0 and less than maxBytes"},
+		{"lines", 4, 1, "overlap is only supported in bytes mode"},
+		{"csv", 4, 1, "overlap is only supported in bytes mode"},
+		{"xml", 4, 0, `unknown mode "xml"`},
+	}
+	for _, tt := range tests {
+		_, err := New(tt.mode, strings.NewReader(""), tt.maxBytes, tt.overlap)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("New(%q, %d, %d) = %v, want %q", tt.mode, tt.maxBytes, tt.overlap, err, tt.wantErr)
+		}
+	}
+}
+
+func TestBlocksOffset(t *testing.T) {
+	b := NewBlocks(strings.NewReader("abcdefghij"), 4, 1)
+	var offsets []int64
+	for {
+		if _, err := b.Next(); err != nil {
+			break
+		}
+		offsets = append(offsets, b.Offset())
+	}
+	if want := []int64{4, 7, 10}; !reflect.DeepEqual(offsets, want) {
+		t.Errorf("offsets %v, want %v", offsets, want)
+	}
+}
+
+func FuzzJSONArray(f *testing.F) {
+	for _, kind := range synth.Types {
+		data := generated(f, kind, "json", 5)
+		f.Add(data, uint16(4096))
+		f.Add(data, uint16(16))
+		f.Add(data[:len(data)/2], uint16(4096))
+	}
+	for _, seed := range []string{"", " \n", "[]", "[1,2", `[{"a":1}] x`, `{"a":1}`, `["é", null, [[]]]`} {
+		f.Add([]byte(seed), uint16(8))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, limit uint16) {
+		maxBytes := int(limit)%4096 + 1
+		chunks := NewJSONArray(bytes.NewReader(data), maxBytes)
+		var total int
+		// Every chunk consumes at least one byte of input, so more calls
+		// than that means Next is stuck.
+		for calls := 0; ; calls++ {
+			if calls > len(data)+1 {
+				t.Fatalf("no end after %d chunks of %d input bytes", calls, len(data))
+			}
+			chunk, err := chunks.Next()
+			if err != nil {
+				if _, again := chunks.Next(); again == nil {
+					t.Fatalf("Next returned a chunk after %v", err)
+				}
+				break
+			}
+			if len(chunk) == 0 || len(chunk) > maxBytes {
+				t.Fatalf("chunk of %d bytes with maxBytes %d", len(chunk), maxBytes)
+			}
+			if len(chunk) < maxBytes && !json.Valid(chunk) {
+				t.Fatalf("untruncated element %q is not valid JSON", chunk)
+			}
+			total += len(chunk)
+		}
+		if total > len(data) {
+			t.Fatalf("%d chunk bytes from %d input bytes", total, len(data))
+		}
+	})
+}
@@ -0,0 +1,310 @@
+// Package config supplies flag defaults from a config file and the
+// environment, so a run does not have to repeat the same flags every time.
+//
+// Values are resolved per flag, lowest precedence first:
+//
+//  1. the flag's built-in default
+//  2. the file named by -config
+//  3. an environment variable PREFIX_NAME, where NAME is the flag name
+//     upper-cased with '-' replaced by '_' (ZSTD_COMPRESS_DICT_SHA256)
+//  4. the flag given on the command line
+//
+// Config files are flat maps from flag names to values, written as YAML
+// (.yaml, .yml) or TOML (.toml):
+//
+//	# YAML                        # TOML
+//	level: 3                      level = 3
+//	use-dict: true                use-dict = true
+//	dict: dicts/latest.zdict      dict = "dicts/latest.zdict"
+//	in: [output, archive]         in = ["output", "archive"]
+//
+// Lists set a repeatable flag once per element; YAML block lists ("- item"
+// under the key) are accepted too. Nested maps and TOML tables are not, and
+// a key that names no flag is an error rather than being ignored.
+package config
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Parse registers -config on fs, parses args and then fills every flag not
+// given on the command line from the environment or the config file.
+// envPrefix is prepended to environment variable names, e.g. "ZSTD_COMPRESS".
+func Parse(fs *flag.FlagSet, args []string, envPrefix string) error {
+	path := fs.String("config", "", "read flag defaults from a YAML or TOML file (command-line flags and "+envPrefix+"_* environment variables take precedence)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return Apply(fs, *path, envPrefix)
+}
+
+// Apply sets each flag of an already parsed fs that was not given on the
+// command line, taking the environment over the file at path. An empty path
+// skips the file.
+func Apply(fs *flag.FlagSet, path, envPrefix string) error {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	var entries []entry
+	if path != "" {
+		var err error
+		entries, err = load(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, e := range entries {
+		if fs.Lookup(e.key) == nil {
+			return fmt.Errorf("%s:%d: unknown flag %q", path, e.line, e.key)
+		}
+		if e.key == "config" {
+			return fmt.Errorf("%s:%d: config files cannot name another config file", path, e.line)
+		}
+		if explicit[e.key] || envSet(envPrefix, e.key) {
+			continue
+		}
+		for _, value := range e.values {
+			if err := fs.Set(e.key, value); err != nil {
+				return fmt.Errorf("%s:%d: invalid value %q for %s: %v", path, e.line, value, e.key, err)
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || f.Name == "config" {
+			return
+		}
+		name := EnvName(envPrefix, f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", value, name, setErr)
+		}
+	})
+	return err
+}
+
+// EnvName returns the environment variable consulted for flag name.
+func EnvName(prefix, name string) string {
+	return prefix + "_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+func envSet(prefix, name string) bool {
+	_, ok := os.LookupEnv(EnvName(prefix, name))
+	return ok
+}
+
+type entry struct {
+	key    string
+	values []string
+	line   int
+}
+
+// load reads the flag values in a YAML or TOML config file, in file order.
+func load(path string) ([]entry, error) {
+	var parseLine func(string) (string, string, error)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		parseLine = splitYAML
+	case ".toml":
+		parseLine = splitTOML
+	default:
+		return nil, fmt.Errorf("%s: unsupported config format (expected .yaml, .yml or .toml)", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []entry
+	seen := map[string]int{}
+	open := -1 // index of a YAML key awaiting "- item" lines
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" || line == "---" {
+			continue
+		}
+		if item, ok := strings.CutPrefix(line, "- "); ok {
+			if open < 0 {
+				return nil, fmt.Errorf("%s:%d: list item outside a list", path, lineNo)
+			}
+			value, err := scalar(strings.TrimSpace(item))
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+			}
+			entries[open].values = append(entries[open].values, value)
+			continue
+		}
+		open = -1
+
+		key, raw, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		if first, ok := seen[key]; ok {
+			return nil, fmt.Errorf("%s:%d: %s already set on line %d", path, lineNo, key, first)
+		}
+		seen[key] = lineNo
+
+		e := entry{key: key, line: lineNo}
+		if raw == "" {
+			open = len(entries)
+		} else {
+			e.values, err = values(raw)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+			}
+			if e.values == nil {
+				e.values = []string{}
+			}
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.values == nil {
+			return nil, fmt.Errorf("%s:%d: %s has no value", path, e.line, e.key)
+		}
+	}
+	return entries, nil
+}
+
+func splitYAML(line string) (string, string, error) {
+	key, value, ok := strings.Cut(line, ":")
+	if !ok {
+		return "", "", fmt.Errorf("expected key: value, got %q", line)
+	}
+	key = strings.TrimSpace(key)
+	if key == "" || strings.ContainsAny(key, " \t") {
+		return "", "", fmt.Errorf("invalid key %q", key)
+	}
+	return key, strings.TrimSpace(value), nil
+}
+
+func splitTOML(line string) (string, string, error) {
+	if strings.HasPrefix(line, "[") {
+		return "", "", fmt.Errorf("tables are not supported; put flags at the top level")
+	}
+	key, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return "", "", fmt.Errorf("expected key = value, got %q", line)
+	}
+	key = strings.TrimSpace(key)
+	if unquoted, err := scalar(key); err == nil {
+		key = unquoted
+	}
+	if key == "" || strings.ContainsAny(key, " \t") {
+		return "", "", fmt.Errorf("invalid key %q", key)
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", "", fmt.Errorf("%s has no value", key)
+	}
+	return key, value, nil
+}
+
+// values parses a scalar or a one-line [a, b] list.
+func values(raw string) ([]string, error) {
+	inner, ok := strings.CutPrefix(raw, "[")
+	if !ok {
+		value, err := scalar(raw)
+		if err != nil {
+			return nil, err
+		}
+		return []string{value}, nil
+	}
+	inner, ok = strings.CutSuffix(inner, "]")
+	if !ok {
+		return nil, fmt.Errorf("unterminated list %q", raw)
+	}
+	var out []string
+	for _, item := range splitList(inner) {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		value, err := scalar(item)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, value)
+	}
+	return out, nil
+}
+
+// scalar unquotes "double" (with escapes) and 'single' (literal) strings
+// and returns anything else as written.
+func scalar(raw string) (string, error) {
+	switch {
+	case len(raw) >= 2 && raw[0] == '"' && raw[len(raw)-1] == '"':
+		value, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", raw)
+		}
+		return value, nil
+	case len(raw) >= 2 && raw[0] == '\'' && raw[len(raw)-1] == '\'':
+		return raw[1 : len(raw)-1], nil
+	case strings.HasPrefix(raw, `"`) || strings.HasPrefix(raw, "'"):
+		return "", fmt.Errorf("unterminated string %s", raw)
+	}
+	return raw, nil
+}
+
+// splitList splits on commas outside quotes.
+func splitList(s string) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// stripComment drops a '#' comment that starts the line or follows
+// whitespace outside quotes, so values such as "a#b" survive.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,107 @@
+// Package confirm guards the operations that delete or replace data:
+// compress -rm, -in-place and -prune-removed, train-dict dict rollback and
+// report history prune. Before acting, a tool describes what it is about to
+// touch, and the user confirms on a terminal. Scripts pass -yes; without
+// it, a run whose stdin is not a terminal is refused rather than left to
+// guess, so a mistyped flag in a cron job fails instead of deleting data.
+package confirm
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+
+	"zstd-learning/internal/size"
+)
+
+// shownPaths is how many of a plan's paths the summary lists.
+const shownPaths = 10
+
+// Options holds -yes.
+type Options struct {
+	Yes bool
+}
+
+// Flags registers -yes on fs.
+func Flags(fs *flag.FlagSet) *Options {
+	opts := &Options{}
+	fs.BoolVar(&opts.Yes, "yes", false, "do not ask before deleting or replacing data (-rm, -in-place, -prune-removed, rollbacks, prunes); required when stdin is not a terminal")
+	return opts
+}
+
+// Plan describes a destructive operation. Action completes "about to ...",
+// e.g. "remove the inputs after compressing them"; Count is how many Units
+// (a plural such as "files" or "runs") it touches, of which Paths lists the
+// first. Bytes is left out of the summary when negative.
+type Plan struct {
+	Action string
+	Count  int
+	Unit   string
+	Bytes  int64
+	Paths  []string
+}
+
+// ErrDeclined is returned when the user answers anything but yes.
+var ErrDeclined = errors.New("not confirmed; nothing was changed")
+
+// Prompter asks for confirmations on In and Out. Terminal says whether In
+// is interactive; Ask fills it in from os.Stdin, tests set it directly.
+type Prompter struct {
+	In       io.Reader
+	Out      io.Writer
+	Terminal bool
+}
+
+// Ask confirms plan on stdin and stderr. opts may be nil. The check asks
+// the terminal driver, so a run with stdin from /dev/null is refused rather
+// than read as a "no".
+func Ask(opts *Options, plan Plan) error {
+	if opts != nil && opts.Yes {
+		return nil
+	}
+	return Prompter{In: os.Stdin, Out: os.Stderr, Terminal: term.IsTerminal(int(os.Stdin.Fd()))}.Confirm(plan)
+}
+
+// Confirm prints the summary of plan and reads the answer. Without a
+// terminal it returns an error telling the caller to pass -yes.
+func (p Prompter) Confirm(plan Plan) error {
+	if !p.Terminal {
+		return fmt.Errorf("refusing to %s (%s) without confirmation: stdin is not a terminal; check the flags and pass -yes to run unattended", plan.Action, plan.amount())
+	}
+	fmt.Fprintf(p.Out, "about to %s: %s\n", plan.Action, plan.amount())
+	for _, path := range plan.Paths[:min(len(plan.Paths), shownPaths)] {
+		fmt.Fprintf(p.Out, "  %s\n", path)
+	}
+	if more := plan.Count - min(len(plan.Paths), shownPaths); more > 0 {
+		fmt.Fprintf(p.Out, "  ... and %d more\n", more)
+	}
+	fmt.Fprint(p.Out, "proceed? [y/N] ")
+	answer, err := bufio.NewReader(p.In).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return ErrDeclined
+}
+
+// amount renders the count and, when known, the total size.
+func (p Plan) amount() string {
+	unit := p.Unit
+	if p.Count == 1 {
+		unit = strings.TrimSuffix(unit, "s")
+	}
+	text := fmt.Sprintf("%d %s", p.Count, unit)
+	if p.Bytes >= 0 {
+		text += ", " + size.Format(p.Bytes)
+	}
+	return text
+}
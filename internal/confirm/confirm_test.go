@@ -0,0 +1,109 @@
+package confirm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+var plan = Plan{Action: "remove the inputs after compressing them", Count: 3, Unit: "files", Bytes: 2048, Paths: []string{"a.json", "b.json", "c.json"}}
+
+func TestConfirmAnswers(t *testing.T) {
+	tests := []struct {
+		answer string
+		want   error
+	}{
+		{"y\n", nil},
+		{"yes\n", nil},
+		{"  YES \r\n", nil},
+		{"Y", nil},
+		{"n\n", ErrDeclined},
+		{"no\n", ErrDeclined},
+		{"yep\n", ErrDeclined},
+		{"\n", ErrDeclined},
+		{"", ErrDeclined},
+		{"n\ny\n", ErrDeclined},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		err := Prompter{In: strings.NewReader(tt.answer), Out: &out, Terminal: true}.Confirm(plan)
+		if !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+			t.Errorf("answer %q: got %v, want %v", tt.answer, err, tt.want)
+		}
+		if !strings.HasSuffix(out.String(), "proceed? [y/N] ") {
+			t.Errorf("answer %q: no prompt in %q", tt.answer, out.String())
+		}
+	}
+}
+
+func TestConfirmReadError(t *testing.T) {
+	failing := iotest.ErrReader(errors.New("terminal hung up"))
+	err := Prompter{In: failing, Out: &bytes.Buffer{}, Terminal: true}.Confirm(plan)
+	if err == nil || errors.Is(err, ErrDeclined) {
+		t.Errorf("got %v, want the read error", err)
+	}
+}
+
+func TestConfirmSummary(t *testing.T) {
+	var paths []string
+	for i := 0; i < 12; i++ {
+		paths = append(paths, fmt.Sprintf("run-%02d", i))
+	}
+	tests := []struct {
+		plan Plan
+		want string
+	}{
+		{plan, "about to remove the inputs after compressing them: 3 files, 2.0 KiB\n  a.json\n  b.json\n  c.json\nproceed? [y/N] "},
+		{Plan{Action: "prune history", Count: 1, Unit: "runs", Bytes: -1, Paths: paths[:1]}, "about to prune history: 1 run\n  run-00\nproceed? [y/N] "},
+		{Plan{Action: "prune history", Count: 40, Unit: "runs", Bytes: -1, Paths: paths}, "about to prune history: 40 runs\n  run-00\n  run-01\n  run-02\n  run-03\n  run-04\n  run-05\n  run-06\n  run-07\n  run-08\n  run-09\n  ... and 30 more\nproceed? [y/N] "},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		Prompter{In: strings.NewReader("n\n"), Out: &out, Terminal: true}.Confirm(tt.plan)
+		if out.String() != tt.want {
+			t.Errorf("got\n%s\nwant\n%s", out.String(), tt.want)
+		}
+	}
+}
+
+func TestConfirmRefusesWithoutTerminal(t *testing.T) {
+	in := strings.NewReader("y\n")
+	var out bytes.Buffer
+	err := Prompter{In: in, Out: &out, Terminal: false}.Confirm(plan)
+	if err == nil || !strings.Contains(err.Error(), "pass -yes") || !strings.Contains(err.Error(), "3 files, 2.0 KiB") {
+		t.Fatalf("got %v, want a refusal naming -yes and the amount", err)
+	}
+	if in.Len() != len("y\n") || out.Len() != 0 {
+		t.Error("a refused confirmation read an answer or printed a prompt")
+	}
+}
+
+func TestAskWithPipedStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// A "y" that arrives on a pipe must not count as confirmation.
+	if _, err := w.WriteString("y\n"); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+
+	if err := Ask(nil, plan); err == nil || !strings.Contains(err.Error(), "stdin is not a terminal") {
+		t.Errorf("without -yes: got %v, want a refusal", err)
+	}
+	if err := Ask(&Options{}, plan); err == nil {
+		t.Error("with -yes unset: the plan went ahead")
+	}
+	if err := Ask(&Options{Yes: true}, plan); err != nil {
+		t.Errorf("with -yes: %v", err)
+	}
+}
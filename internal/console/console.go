@@ -0,0 +1,114 @@
+// Package console colors the commands' terminal output. A Printer wraps
+// text in ANSI escape codes when its -color mode asks for them, and in auto
+// mode only when the output is a terminal that has not opted out with
+// NO_COLOR or TERM=dumb.
+package console
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// Mode is a -color setting.
+type Mode string
+
+// The -color settings.
+const (
+	ModeAuto   Mode = "auto"
+	ModeAlways Mode = "always"
+	ModeNever  Mode = "never"
+)
+
+const (
+	codeReset  = "\x1b[0m"
+	codeBold   = "\x1b[1m"
+	codeRed    = "\x1b[31m"
+	codeGreen  = "\x1b[32m"
+	codeYellow = "\x1b[33m"
+)
+
+// ParseMode parses a -color value, case-insensitively. An empty value is
+// ModeAuto.
+func ParseMode(value string) (Mode, error) {
+	switch mode := Mode(strings.ToLower(strings.TrimSpace(value))); mode {
+	case ModeAuto, ModeAlways, ModeNever:
+		return mode, nil
+	case "":
+		return ModeAuto, nil
+	default:
+		return "", fmt.Errorf("unknown color mode %q (expected auto, always, never)", value)
+	}
+}
+
+// IsTerminal reports whether f is a terminal. It asks the terminal driver
+// rather than checking for a character device, so pipes, redirects and
+// devices such as /dev/null all count as not a terminal.
+func IsTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// Printer colors text for one output. The zero Printer leaves text as is.
+type Printer struct {
+	color bool
+}
+
+// NewPrinter returns a Printer for output to f in mode.
+func NewPrinter(mode Mode, f *os.File) Printer {
+	switch mode {
+	case ModeAlways:
+		return Printer{color: true}
+	case ModeNever:
+		return Printer{}
+	default:
+		return Printer{color: IsTerminal(f) && os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb"}
+	}
+}
+
+// Enabled reports whether p colors its text.
+func (p Printer) Enabled() bool {
+	return p.color
+}
+
+// Bold returns text in bold.
+func (p Printer) Bold(text string) string {
+	return p.wrap(codeBold, text)
+}
+
+// Red returns text in red.
+func (p Printer) Red(text string) string {
+	return p.wrap(codeRed, text)
+}
+
+// Green returns text in green.
+func (p Printer) Green(text string) string {
+	return p.wrap(codeGreen, text)
+}
+
+// Yellow returns text in yellow.
+func (p Printer) Yellow(text string) string {
+	return p.wrap(codeYellow, text)
+}
+
+// Ratio formats an output/input ratio, green when the output is at most half
+// the input, yellow when it still shrank and red when it grew.
+func (p Printer) Ratio(ratio float64) string {
+	text := fmt.Sprintf("%.3f", ratio)
+	switch {
+	case ratio <= 0.5:
+		return p.Green(text)
+	case ratio < 1:
+		return p.Yellow(text)
+	default:
+		return p.Red(text)
+	}
+}
+
+func (p Printer) wrap(code, text string) string {
+	if !p.color {
+		return text
+	}
+	return code + text + codeReset
+}
@@ -0,0 +1,96 @@
+package console
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Mode
+	}{
+		{"auto", ModeAuto},
+		{"", ModeAuto},
+		{"Always", ModeAlways},
+		{" NEVER ", ModeNever},
+	}
+	for _, tt := range tests {
+		if got, err := ParseMode(tt.value); err != nil || got != tt.want {
+			t.Errorf("ParseMode(%q) = %q, %v; want %q", tt.value, got, err, tt.want)
+		}
+	}
+	if _, err := ParseMode("sometimes"); err == nil {
+		t.Error(`ParseMode("sometimes") succeeded`)
+	}
+}
+
+func TestPrinterModes(t *testing.T) {
+	t.Setenv("NO_COLOR", "")
+	t.Setenv("TERM", "xterm")
+	// A regular file stands in for a redirect, which auto mode leaves plain.
+	f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+
+	tests := []struct {
+		mode  Mode
+		name  string
+		f     *os.File
+		color bool
+	}{
+		{ModeAlways, "a file", f, true},
+		{ModeAlways, "nil", nil, true},
+		{ModeNever, "a file", f, false},
+		{ModeNever, "nil", nil, false},
+		{ModeAuto, "a file", f, false},
+		{ModeAuto, "the null device", null, false},
+	}
+	for _, tt := range tests {
+		p := NewPrinter(tt.mode, tt.f)
+		if p.Enabled() != tt.color {
+			t.Errorf("%s on %v: Enabled() = %v, want %v", tt.mode, tt.name, p.Enabled(), tt.color)
+		}
+		for _, text := range []string{p.Bold("x"), p.Red("x"), p.Green("x"), p.Yellow("x"), p.Ratio(0.3), p.Ratio(0.8), p.Ratio(1.2)} {
+			if escaped := strings.Contains(text, "\x1b["); escaped != tt.color {
+				t.Errorf("%s on %v: %q has escape codes: %v, want %v", tt.mode, tt.name, text, escaped, tt.color)
+			}
+		}
+	}
+
+	if got := NewPrinter(ModeAlways, nil).Red("x"); got != "\x1b[31mx\x1b[0m" {
+		t.Errorf("Red = %q", got)
+	}
+	if got := NewPrinter(ModeNever, nil).Ratio(0.25); got != "0.250" {
+		t.Errorf("Ratio = %q", got)
+	}
+}
+
+func TestIsTerminal(t *testing.T) {
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	if IsTerminal(null) {
+		t.Error("the null device counts as a terminal")
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	if IsTerminal(r) || IsTerminal(w) {
+		t.Error("a pipe counts as a terminal")
+	}
+}
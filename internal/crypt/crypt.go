@@ -0,0 +1,422 @@
+// Package crypt encrypts compressed outputs at rest and removes that
+// encryption again on the way back, detecting the scheme from the first
+// bytes of the input.
+//
+// Two schemes are supported. age (https://age-encryption.org) encrypts to
+// public keys, so the machine that compresses never holds a secret. The
+// keyfile scheme shares one 32-byte key between both sides and writes a
+// STREAM-style AES-256-GCM format:
+//
+//	magic   "ZSTDENC\x01"                            8 bytes
+//	salt    random                                  16 bytes
+//	check   HMAC-SHA256(key, "check" || salt)[:16]  16 bytes
+//	chunks  64 KiB of plaintext each, plus a 16-byte tag
+//
+// Each file is sealed under its own key, HMAC-SHA256(key, "encrypt" || salt),
+// with a chunk counter as the nonce and the nonce's last byte marking the
+// final chunk, so reordered, dropped or truncated chunks fail to open. The
+// check value lets a wrong key be reported as such before any chunk is read,
+// instead of looking like damaged data.
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+var (
+	// ErrWrongKey reports that the input is encrypted to a different key or
+	// identity than the one given.
+	ErrWrongKey = errors.New("wrong decryption key")
+	// ErrCorrupt reports that the input was encrypted to the given key but
+	// its contents do not authenticate: they were damaged or truncated.
+	ErrCorrupt = errors.New("encrypted data is corrupt or truncated")
+	// ErrNoKey reports an encrypted input when no key for its scheme was
+	// given.
+	ErrNoKey = errors.New("input is encrypted but no key was given")
+)
+
+// Scheme identifies how a stream is encrypted.
+type Scheme int
+
+const (
+	None Scheme = iota
+	Age
+	Keyfile
+)
+
+func (s Scheme) String() string {
+	switch s {
+	case Age:
+		return "age"
+	case Keyfile:
+		return "aes-gcm"
+	}
+	return "none"
+}
+
+// Ext is the extension added after the compressed suffix for outputs in
+// this scheme.
+func (s Scheme) Ext() string {
+	switch s {
+	case Age:
+		return ".age"
+	case Keyfile:
+		return ".enc"
+	}
+	return ""
+}
+
+const (
+	// KeySize is the length of a keyfile key.
+	KeySize = 32
+
+	chunkSize = 64 << 10
+	saltSize  = 16
+	checkSize = 16
+	tagSize   = 16
+)
+
+var magic = []byte("ZSTDENC\x01")
+
+const ageMagic = "age-encryption.org/v1\n"
+
+// DetectLen is how many leading bytes Detect needs to recognize every
+// scheme.
+const DetectLen = len(armor.Header)
+
+// Detect returns the scheme a stream starting with header is encrypted
+// with, or None.
+func Detect(header []byte) Scheme {
+	switch {
+	case bytes.HasPrefix(header, []byte(ageMagic)), bytes.HasPrefix(header, []byte(armor.Header)):
+		return Age
+	case bytes.HasPrefix(header, magic):
+		return Keyfile
+	}
+	return None
+}
+
+// ReadKeyFile reads a keyfile key, stored either as 32 raw bytes or as 64
+// hex characters.
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if text := bytes.TrimSpace(data); len(text) == 2*KeySize {
+		if key, err := hex.DecodeString(string(text)); err == nil {
+			return key, nil
+		}
+	}
+	if len(data) != KeySize {
+		return nil, fmt.Errorf("key file %s must hold %d raw bytes or %d hex characters, found %d bytes", path, KeySize, 2*KeySize, len(data))
+	}
+	return data, nil
+}
+
+// ReadIdentities reads the age identities (private keys) in path, one per
+// line, as written by age-keygen.
+func ReadIdentities(path string) ([]age.Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return identities, nil
+}
+
+// Sealer encrypts output streams in one scheme.
+type Sealer struct {
+	scheme     Scheme
+	recipients []age.Recipient
+	key        []byte
+}
+
+// NewAgeSealer encrypts to the age public keys in recipients, separated by
+// commas or newlines.
+func NewAgeSealer(recipients string) (*Sealer, error) {
+	parsed, err := age.ParseRecipients(strings.NewReader(strings.ReplaceAll(recipients, ",", "\n")))
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{scheme: Age, recipients: parsed}, nil
+}
+
+// NewKeySealer encrypts with the keyfile scheme under key.
+func NewKeySealer(key []byte) (*Sealer, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", KeySize, len(key))
+	}
+	return &Sealer{scheme: Keyfile, key: key}, nil
+}
+
+// Scheme returns the scheme s writes.
+func (s *Sealer) Scheme() Scheme {
+	return s.scheme
+}
+
+// Wrap returns a writer that encrypts everything written to it into w.
+// Close must be called to finish the stream; it does not close w.
+func (s *Sealer) Wrap(w io.Writer) (io.WriteCloser, error) {
+	if s.scheme == Age {
+		return age.Encrypt(w, s.recipients...)
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	check, aead, err := deriveKeys(s.key, salt)
+	if err != nil {
+		return nil, err
+	}
+	header := append(append(append([]byte{}, magic...), salt...), check...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &streamWriter{w: w, aead: aead, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+// Keys holds what is available to decrypt inputs. Either field may be empty;
+// an input in a scheme without a key fails with ErrNoKey.
+type Keys struct {
+	Identities []age.Identity
+	Key        []byte
+}
+
+// Open detects the scheme of r and returns a reader of its plaintext.
+// Unencrypted input is passed through unchanged with scheme None. Errors
+// that mean the key does not match wrap ErrWrongKey; errors that mean the
+// data is damaged, including those returned later by the reader, wrap
+// ErrCorrupt.
+func (k Keys) Open(r io.Reader) (io.Reader, Scheme, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(DetectLen)
+	if err != nil && err != io.EOF {
+		return nil, None, err
+	}
+	scheme := Detect(header)
+	switch scheme {
+	case Age:
+		plain, err := k.openAge(br, bytes.HasPrefix(header, []byte(armor.Header)))
+		return plain, scheme, err
+	case Keyfile:
+		plain, err := k.openKeyfile(br)
+		return plain, scheme, err
+	}
+	return br, None, nil
+}
+
+func (k Keys) openAge(r io.Reader, armored bool) (io.Reader, error) {
+	if len(k.Identities) == 0 {
+		return nil, fmt.Errorf("%w (age input needs an identity)", ErrNoKey)
+	}
+	if armored {
+		r = armor.NewReader(r)
+	}
+	plain, err := age.Decrypt(r, k.Identities...)
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		return nil, fmt.Errorf("%w: %v", ErrWrongKey, err)
+	}
+	if err != nil {
+		return nil, corrupt(err)
+	}
+	return corruptReader{plain}, nil
+}
+
+func (k Keys) openKeyfile(r *bufio.Reader) (io.Reader, error) {
+	if len(k.Key) == 0 {
+		return nil, fmt.Errorf("%w (aes-gcm input needs a key file)", ErrNoKey)
+	}
+	header := make([]byte, len(magic)+saltSize+checkSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, corrupt(err)
+	}
+	salt := header[len(magic) : len(magic)+saltSize]
+	check, aead, err := deriveKeys(k.Key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(check, header[len(magic)+saltSize:]) {
+		return nil, fmt.Errorf("%w: the key check value does not match", ErrWrongKey)
+	}
+	return &streamReader{r: r, aead: aead, buf: make([]byte, chunkSize+tagSize)}, nil
+}
+
+// deriveKeys returns the check value and the cipher for the file with salt.
+func deriveKeys(key, salt []byte) ([]byte, cipher.AEAD, error) {
+	check := hmac.New(sha256.New, key)
+	check.Write([]byte("check"))
+	check.Write(salt)
+
+	fileKey := hmac.New(sha256.New, key)
+	fileKey.Write([]byte("encrypt"))
+	fileKey.Write(salt)
+	block, err := aes.NewCipher(fileKey.Sum(nil))
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return check.Sum(nil)[:checkSize], aead, nil
+}
+
+// chunkNonce is the nonce of chunk n: the counter in the first eight bytes
+// and 1 in the last byte for the final chunk.
+func chunkNonce(dst []byte, n uint64, last bool) []byte {
+	dst = dst[:12]
+	clear(dst)
+	binary.BigEndian.PutUint64(dst, n)
+	if last {
+		dst[11] = 1
+	}
+	return dst
+}
+
+type streamWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	sealed  []byte
+	nonce   [12]byte
+	counter uint64
+	closed  bool
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("write to closed encrypted stream")
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, because the
+		// final chunk, sealed by Close, must be marked as such.
+		if len(s.buf) == chunkSize {
+			if err := s.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):chunkSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (s *streamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.seal(true)
+}
+
+func (s *streamWriter) seal(last bool) error {
+	s.sealed = s.aead.Seal(s.sealed[:0], chunkNonce(s.nonce[:], s.counter, last), s.buf, nil)
+	s.counter++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(s.sealed)
+	return err
+}
+
+type streamReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	plain   []byte
+	nonce   [12]byte
+	counter uint64
+	done    bool
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+// next opens the following chunk. A chunk is the last one when it is short
+// or nothing follows it.
+func (s *streamReader) next() error {
+	n, err := io.ReadFull(s.r, s.buf)
+	last := false
+	switch {
+	case err == io.EOF:
+		return corrupt(errors.New("stream ends without a final chunk"))
+	case err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, err := s.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if n < tagSize {
+		return corrupt(errors.New("chunk shorter than its tag"))
+	}
+	plain, err := s.aead.Open(s.buf[:0], chunkNonce(s.nonce[:], s.counter, last), s.buf[:n], nil)
+	if err != nil {
+		return corrupt(fmt.Errorf("chunk %d: %v", s.counter, err))
+	}
+	s.counter++
+	s.plain = plain
+	s.done = last
+	return nil
+}
+
+// corruptReader marks read errors from a decrypting reader as corruption,
+// leaving I/O errors on the underlying file alone.
+type corruptReader struct {
+	r io.Reader
+}
+
+func (c corruptReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err != nil && err != io.EOF {
+		var pathErr *fs.PathError
+		if !errors.As(err, &pathErr) {
+			err = corrupt(err)
+		}
+	}
+	return n, err
+}
+
+func corrupt(err error) error {
+	return fmt.Errorf("%w: %v", ErrCorrupt, err)
+}
@@ -0,0 +1,199 @@
+package crypt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/klauspost/compress/zstd"
+)
+
+// sealCase is a sealer with the keys that open its output and keys that
+// hold only a different key.
+type sealCase struct {
+	sealer    *Sealer
+	keys      Keys
+	wrongKeys Keys
+}
+
+// schemes returns a sealCase for each scheme.
+func schemes(t *testing.T) []sealCase {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ageSealer, err := NewAgeSealer(identity.Recipient().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{7}, KeySize)
+	keySealer, err := NewKeySealer(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []sealCase{
+		{ageSealer, Keys{Identities: []age.Identity{identity}}, Keys{Identities: []age.Identity{other}}},
+		{keySealer, Keys{Key: key}, Keys{Key: bytes.Repeat([]byte{8}, KeySize)}},
+	}
+}
+
+func seal(t *testing.T, s *Sealer, plain []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	w, err := s.Wrap(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func open(keys Keys, data []byte) ([]byte, Scheme, error) {
+	r, scheme, err := keys.Open(bytes.NewReader(data))
+	if err != nil {
+		return nil, scheme, err
+	}
+	plain, err := io.ReadAll(r)
+	return plain, scheme, err
+}
+
+func TestRoundTrip(t *testing.T) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+
+	record := []byte(`{"id": 12, "name": "The Ninth Signal", "tags": ["scifi", "audio"]}` + "\n")
+	for _, tt := range schemes(t) {
+		// Sizes around the keyfile chunk boundaries, compressed first as
+		// compress does.
+		for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 100} {
+			data := bytes.Repeat(record, size/len(record)+1)[:size]
+			compressed := encoder.EncodeAll(data, nil)
+			sealed := seal(t, tt.sealer, compressed)
+			if got := Detect(sealed); got != tt.sealer.Scheme() {
+				t.Fatalf("%s, %d bytes: detected %s", tt.sealer.Scheme(), size, got)
+			}
+
+			opened, scheme, err := open(tt.keys, sealed)
+			if err != nil {
+				t.Fatalf("%s, %d bytes: %v", tt.sealer.Scheme(), size, err)
+			}
+			if scheme != tt.sealer.Scheme() {
+				t.Errorf("%s, %d bytes: opened as %s", tt.sealer.Scheme(), size, scheme)
+			}
+			plain, err := decoder.DecodeAll(opened, nil)
+			if err != nil {
+				t.Fatalf("%s, %d bytes: %v", tt.sealer.Scheme(), size, err)
+			}
+			if !bytes.Equal(plain, data) {
+				t.Fatalf("%s, %d bytes: round trip changed the data", tt.sealer.Scheme(), size)
+			}
+		}
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	plain := bytes.Repeat([]byte("0123456789abcdef"), chunkSize/8)
+	for _, tt := range schemes(t) {
+		scheme := tt.sealer.Scheme()
+		sealed := seal(t, tt.sealer, plain)
+
+		if _, _, err := open(tt.wrongKeys, sealed); !errors.Is(err, ErrWrongKey) {
+			t.Errorf("%s, wrong key: got %v, want ErrWrongKey", scheme, err)
+		}
+		if _, _, err := open(Keys{}, sealed); !errors.Is(err, ErrNoKey) {
+			t.Errorf("%s, no key: got %v, want ErrNoKey", scheme, err)
+		}
+
+		damaged := append([]byte(nil), sealed...)
+		damaged[len(damaged)-100] ^= 1
+		for name, data := range map[string][]byte{
+			"damaged":         damaged,
+			"truncated":       sealed[:len(sealed)-10],
+			"last chunk lost": sealed[:len(sealed)/2],
+		} {
+			_, _, err := open(tt.keys, data)
+			if !errors.Is(err, ErrCorrupt) {
+				t.Errorf("%s, %s: got %v, want ErrCorrupt", scheme, name, err)
+			}
+			if errors.Is(err, ErrWrongKey) {
+				t.Errorf("%s, %s: corruption reported as a wrong key", scheme, name)
+			}
+		}
+	}
+}
+
+func TestOpenPassesPlainInputThrough(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("x"), {0x28, 0xB5, 0x2F, 0xFD, 0, 0, 0}} {
+		got, scheme, err := open(Keys{}, data)
+		if err != nil || scheme != None || !bytes.Equal(got, data) {
+			t.Errorf("%q: got %q, %s, %v", data, got, scheme, err)
+		}
+	}
+}
+
+func TestKeySealerSaltsEachFile(t *testing.T) {
+	s, err := NewKeySealer(bytes.Repeat([]byte{1}, KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(seal(t, s, []byte("same input")), seal(t, s, []byte("same input"))) {
+		t.Error("two files sealed under the same key are identical")
+	}
+	if _, err := NewKeySealer(make([]byte, 16)); err == nil {
+		t.Error("NewKeySealer accepted a 16-byte key")
+	}
+}
+
+func TestReadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{0xAB}, KeySize)
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"raw", key, false},
+		{"hex", []byte(strings.Repeat("ab", KeySize) + "\n"), false},
+		{"short", key[:16], true},
+		{"bad hex", []byte(strings.Repeat("zz", KeySize)), true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(path, tt.data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadKeyFile(path)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: got key %x, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, key) {
+			t.Errorf("%s: got %x, %v", tt.name, got, err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Package decpool keeps reusable zstd decoders per dictionary set, the
+// decoding side of internal/encpool, so code that decodes many small
+// streams, such as one per HTTP request or per file in a worker, does not
+// build a decoder and register its dictionaries each time.
+//
+// Pooled decoders run single-threaded, which keeps them free of background
+// goroutines: many of them work in parallel on separate streams instead.
+package decpool
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Pool hands out decoders built with the same dictionaries.
+type Pool struct {
+	options []zstd.DOption
+	pool    sync.Pool
+}
+
+// key identifies a pool. The dictionaries are keyed by the SHA-256 of their
+// lengths and bytes, in order, rather than the bytes themselves: a weaker
+// hash could let two dictionary sets share a pool, and the second would get
+// decoders that only know the first.
+type key struct {
+	raw     bool
+	rawID   uint32
+	dictSum [sha256.Size]byte
+	dicts   int
+}
+
+var pools sync.Map // key -> *Pool
+
+// For returns the shared pool for decoders with dicts registered; dicts may
+// be empty. The first call for a set builds a decoder up front, so an
+// invalid dictionary fails there rather than on first use. The dictionaries
+// must not be modified afterwards.
+func For(dicts [][]byte) (*Pool, error) {
+	k := key{dictSum: sum(dicts), dicts: len(dicts)}
+	var options []zstd.DOption
+	if len(dicts) > 0 {
+		options = append(options, zstd.WithDecoderDicts(dicts...))
+	}
+	return load(k, options)
+}
+
+// ForRaw is For for a single raw content dictionary registered under id, as
+// written by train-dict -dict-format raw.
+func ForRaw(id uint32, dict []byte) (*Pool, error) {
+	k := key{raw: true, rawID: id, dictSum: sum([][]byte{dict}), dicts: 1}
+	return load(k, []zstd.DOption{zstd.WithDecoderDictRaw(id, dict)})
+}
+
+func sum(dicts [][]byte) [sha256.Size]byte {
+	var total [sha256.Size]byte
+	if len(dicts) == 0 {
+		return total
+	}
+	h := sha256.New()
+	for _, dict := range dicts {
+		h.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(dict))))
+		h.Write(dict)
+	}
+	h.Sum(total[:0])
+	return total
+}
+
+func load(k key, options []zstd.DOption) (*Pool, error) {
+	if p, ok := pools.Load(k); ok {
+		return p.(*Pool), nil
+	}
+	p := &Pool{options: append(options, zstd.WithDecoderConcurrency(1))}
+	decoder, err := p.newDecoder()
+	if err != nil {
+		return nil, err
+	}
+	p.pool.Put(decoder)
+	actual, _ := pools.LoadOrStore(k, p)
+	return actual.(*Pool), nil
+}
+
+func (p *Pool) newDecoder() (*zstd.Decoder, error) {
+	return zstd.NewReader(nil, p.options...)
+}
+
+// Get returns a decoder reading a new stream from r. r may be nil when the
+// decoder is only used for DecodeAll or is Reset by the caller. Return it
+// with Put.
+func (p *Pool) Get(r io.Reader) (*zstd.Decoder, error) {
+	decoder, ok := p.pool.Get().(*zstd.Decoder)
+	if !ok {
+		var err error
+		if decoder, err = p.newDecoder(); err != nil {
+			return nil, err
+		}
+	}
+	if err := decoder.Reset(r); err != nil {
+		p.Put(decoder)
+		return nil, err
+	}
+	return decoder, nil
+}
+
+// Put returns decoder to the pool, whether or not its stream was read to
+// the end. The decoder is reset right away, which drops the rest of the
+// stream and its reference to the reader; its dictionaries stay registered.
+func (p *Pool) Put(decoder *zstd.Decoder) {
+	decoder.Reset(nil)
+	p.pool.Put(decoder)
+}
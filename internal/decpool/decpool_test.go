@@ -0,0 +1,191 @@
+package decpool
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+// buildDicts trains a dictionary with ID 42 and returns it with a copy that
+// differs only in its ID, 43, so the two have the same length.
+var buildDicts = sync.OnceValues(func() ([2][]byte, error) {
+	var samples [][]byte
+	for i := 0; i < 200; i++ {
+		samples = append(samples, fmt.Appendf(nil, `{"id":%d,"name":"user-%d","email":"user-%d@example.com","active":%t}`, i, i%17, i, i%3 == 0))
+	}
+	first, err := dict.BuildZstdDict(samples, dict.Options{MaxDictSize: 4096, HashBytes: 6, ZstdDictID: 42})
+	if err != nil {
+		return [2][]byte{}, err
+	}
+	second := bytes.Clone(first)
+	binary.LittleEndian.PutUint32(second[4:], 43)
+	return [2][]byte{first, second}, nil
+})
+
+func dicts(t *testing.T) [2][]byte {
+	t.Helper()
+	d, err := buildDicts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+var rawDict = []byte(`{"id":0,"name":"user-0","email":"user-0@example.com","active":true}`)
+
+func encode(t *testing.T, data []byte, options ...zstd.EOption) []byte {
+	t.Helper()
+	encoder, err := zstd.NewWriter(nil, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	return encoder.EncodeAll(data, nil)
+}
+
+func TestForSharesPools(t *testing.T) {
+	d := dicts(t)
+	both, err := For([][]byte{d[0], d[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same, _ := For([][]byte{bytes.Clone(d[0]), bytes.Clone(d[1])}); same != both {
+		t.Error("equal dictionary sets got different pools")
+	}
+	first, _ := For([][]byte{d[0]})
+	second, _ := For([][]byte{d[1]})
+	if first == second {
+		t.Fatal("dictionaries of the same length that differ got the same pool")
+	}
+	if swapped, _ := For([][]byte{d[1], d[0]}); swapped == both {
+		t.Error("a reordered set got the same pool")
+	}
+	if raw, _ := ForRaw(7, d[0]); raw == first {
+		t.Error("a raw dictionary got the pool of a zstd one with the same bytes")
+	}
+
+	decoder, err := second.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Put(decoder)
+	input := []byte(`{"id":7,"name":"user-7"}`)
+	got, err := decoder.DecodeAll(encode(t, input, zstd.WithEncoderDict(d[1])), nil)
+	if err != nil || !bytes.Equal(got, input) {
+		t.Errorf("decoder from the second pool: %q, %v", got, err)
+	}
+}
+
+func TestForRejectsInvalidDictionary(t *testing.T) {
+	if _, err := For([][]byte{[]byte("not a dictionary")}); err == nil {
+		t.Error("an invalid dictionary built a pool")
+	}
+}
+
+func TestPutDropsTheStream(t *testing.T) {
+	p, err := For(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := encode(t, bytes.Repeat([]byte("left unfinished "), 100000))
+	decoder, err := p.Get(bytes.NewReader(long))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decoder.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	p.Put(decoder)
+
+	decoder, err = p.Get(bytes.NewReader(encode(t, []byte("second stream"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Put(decoder)
+	var got bytes.Buffer
+	if _, err := got.ReadFrom(decoder); err != nil || got.String() != "second stream" {
+		t.Errorf("next stream decodes to %q, %v", got.String(), err)
+	}
+}
+
+// TestConcurrentDecoding sends many files through shared pools at once, each
+// decoder going back with Put between files, and checks every file still
+// finds its dictionaries.
+func TestConcurrentDecoding(t *testing.T) {
+	d := dicts(t)
+	type codec struct {
+		name    string
+		pool    func() (*Pool, error)
+		options []zstd.EOption
+	}
+	codecs := []codec{
+		{"no dictionary", func() (*Pool, error) { return For(nil) }, nil},
+		{"dictionary 42", func() (*Pool, error) { return For([][]byte{d[0], d[1]}) }, []zstd.EOption{zstd.WithEncoderDict(d[0])}},
+		{"dictionary 43", func() (*Pool, error) { return For([][]byte{d[0], d[1]}) }, []zstd.EOption{zstd.WithEncoderDict(d[1])}},
+		{"only 43", func() (*Pool, error) { return For([][]byte{d[1]}) }, []zstd.EOption{zstd.WithEncoderDict(d[1])}},
+		{"raw", func() (*Pool, error) { return ForRaw(7, rawDict) }, []zstd.EOption{zstd.WithEncoderDictRaw(7, rawDict)}},
+	}
+
+	const files = 40
+	type file struct {
+		codec   codec
+		plain   []byte
+		encoded []byte
+	}
+	var inputs []file
+	for i := 0; i < files; i++ {
+		c := codecs[i%len(codecs)]
+		plain := bytes.Repeat(fmt.Appendf(nil, `{"id":%d,"name":"user-%d","email":"user-%d@example.com"}`, i, i%17, i), 1+i%7)
+		inputs = append(inputs, file{c, plain, encode(t, plain, c.options...)})
+	}
+
+	const workers, rounds = 16, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds*files; i++ {
+				f := inputs[(w*5+i)%files]
+				p, err := f.codec.pool()
+				if err != nil {
+					errs <- err
+					return
+				}
+				decoder, err := p.Get(bytes.NewReader(f.encoded))
+				if err != nil {
+					errs <- err
+					return
+				}
+				var got bytes.Buffer
+				if i%2 == 0 {
+					_, err = got.ReadFrom(decoder)
+				} else {
+					var out []byte
+					out, err = decoder.DecodeAll(f.encoded, nil)
+					got.Write(out)
+				}
+				p.Put(decoder)
+				if err != nil {
+					errs <- fmt.Errorf("worker %d, %s: %w", w, f.codec.name, err)
+					return
+				}
+				if !bytes.Equal(got.Bytes(), f.plain) {
+					errs <- fmt.Errorf("worker %d, %s: decoded %d bytes that differ from the %d encoded", w, f.codec.name, got.Len(), len(f.plain))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
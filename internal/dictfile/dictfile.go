@@ -0,0 +1,119 @@
+// Package dictfile loads zstd dictionaries from disk and validates them
+// before they reach an encoder or decoder, so a bad -dict fails at startup
+// with an error that names the problem.
+package dictfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// Magic starts every wrapped zstd dictionary (RFC 8878 section 5).
+	Magic uint32 = 0xEC30A437
+
+	// minWrappedBytes covers the magic number and dictionary ID.
+	minWrappedBytes = 8
+	// minRawBytes is the smallest raw content the zstd format accepts.
+	minRawBytes = 8
+)
+
+// Dict is a validated dictionary. ID is 0 for raw dictionaries. Metadata is
+// the train-dict metadata JSON when the dictionary came from a package.
+type Dict struct {
+	Path     string
+	Data     []byte
+	ID       uint32
+	Raw      bool
+	Metadata []byte
+}
+
+// Load reads path and validates it as a wrapped dictionary, or as raw content
+// when raw is set. A non-empty checksum must be the hex SHA-256 of the file.
+// A package (see WritePackage) is recognized by its magic; its own checksum
+// is verified and the format recorded in its metadata is used, so raw only
+// has to agree with it.
+func Load(path string, raw bool, checksum string) (Dict, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Dict{}, err
+	}
+	if checksum != "" {
+		sum := sha256.Sum256(data)
+		if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, strings.TrimSpace(checksum)) {
+			return Dict{}, fmt.Errorf("%s: sha256 mismatch: got %s, want %s", path, got, checksum)
+		}
+	}
+	var metadata []byte
+	if IsPackage(data) {
+		data, metadata, err = ReadPackage(data)
+		if err != nil {
+			return Dict{}, fmt.Errorf("%s: %w", path, err)
+		}
+		format, err := packageFormat(metadata)
+		if err != nil {
+			return Dict{}, fmt.Errorf("%s: %w", path, err)
+		}
+		if raw && format != "raw" {
+			return Dict{}, fmt.Errorf("%s: package holds a %s dictionary; drop -raw-dict", path, format)
+		}
+		raw = format == "raw"
+	}
+	dict, err := Parse(data, raw)
+	if err != nil {
+		return Dict{}, fmt.Errorf("%s: %w", path, err)
+	}
+	dict.Path = path
+	dict.Metadata = metadata
+	return dict, nil
+}
+
+// Parse validates data as a dictionary without reading it from disk.
+func Parse(data []byte, raw bool) (Dict, error) {
+	if len(data) == 0 {
+		return Dict{}, errors.New("dictionary is empty")
+	}
+	if raw {
+		if len(data) < minRawBytes {
+			return Dict{}, fmt.Errorf("raw dictionary is %d bytes, need at least %d", len(data), minRawBytes)
+		}
+		return Dict{Data: data, Raw: true}, nil
+	}
+
+	if len(data) < minWrappedBytes {
+		return Dict{}, fmt.Errorf("dictionary is truncated (%d bytes, header alone is %d)", len(data), minWrappedBytes)
+	}
+	if magic := binary.LittleEndian.Uint32(data); magic != Magic {
+		return Dict{}, fmt.Errorf("not a zstd dictionary (magic 0x%08X, want 0x%08X); use -raw-dict for raw content", magic, Magic)
+	}
+	info, err := zstd.InspectDictionary(data)
+	if err != nil {
+		return Dict{}, fmt.Errorf("malformed dictionary: %w", err)
+	}
+	return Dict{Data: data, ID: info.ID()}, nil
+}
+
+// String is the startup line printed for a loaded dictionary, followed by
+// the embedded metadata for packages.
+func (d Dict) String() string {
+	line := fmt.Sprintf("loaded dictionary %s: id=%d, size=%d", d.Path, d.ID, len(d.Data))
+	if d.Raw {
+		line = fmt.Sprintf("loaded dictionary %s: raw, size=%d", d.Path, len(d.Data))
+	}
+	if d.Metadata != nil {
+		var compact bytes.Buffer
+		if json.Compact(&compact, d.Metadata) == nil {
+			line += "\n  package metadata: " + compact.String()
+		}
+	}
+	return line
+}
@@ -0,0 +1,168 @@
+package dictfile
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/dict"
+)
+
+// buildDict trains a wrapped dictionary with ID 42 from small JSON records,
+// once for all tests.
+var buildDict = sync.OnceValues(func() ([]byte, error) {
+	var samples [][]byte
+	for i := 0; i < 200; i++ {
+		samples = append(samples, fmt.Appendf(nil, `{"id":%d,"name":"user-%d","email":"user-%d@example.com","active":%t}`, i, i%17, i, i%3 == 0))
+	}
+	return dict.BuildZstdDict(samples, dict.Options{MaxDictSize: 4096, HashBytes: 6, ZstdDictID: 42})
+})
+
+func trained(t *testing.T) []byte {
+	t.Helper()
+	data, err := buildDict()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), data...)
+}
+
+func writeDict(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.zdict")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParse(t *testing.T) {
+	wrapped := trained(t)
+	wrongMagic := append([]byte(nil), wrapped...)
+	binary.LittleEndian.PutUint32(wrongMagic, 0xFD2FB528)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		raw     bool
+		wantID  uint32
+		wantErr string
+	}{
+		{"wrapped", wrapped, false, 42, ""},
+		{"raw", []byte("raw dictionary content"), true, 0, ""},
+		{"wrapped read as raw", wrapped, true, 0, ""},
+		{"empty", nil, false, 0, "dictionary is empty"},
+		{"empty raw", []byte{}, true, 0, "dictionary is empty"},
+		{"truncated header", wrapped[:6], false, 0, "dictionary is truncated (6 bytes, header alone is 8)"},
+		{"truncated tables", wrapped[:40], false, 0, "malformed dictionary"},
+		{"truncated raw", []byte("short"), true, 0, "raw dictionary is 5 bytes, need at least 8"},
+		{"wrong magic", wrongMagic, false, 0, "not a zstd dictionary (magic 0xFD2FB528, want 0xEC30A437)"},
+		{"text file", []byte(`{"id": 1, "name": "not a dictionary"}`), false, 0, "not a zstd dictionary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.data, tt.raw)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Parse: got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != tt.wantID || got.Raw != tt.raw || len(got.Data) != len(tt.data) {
+				t.Errorf("Parse: got id=%d raw=%v size=%d, want id=%d raw=%v size=%d", got.ID, got.Raw, len(got.Data), tt.wantID, tt.raw, len(tt.data))
+			}
+		})
+	}
+}
+
+func TestLoadChecksum(t *testing.T) {
+	data := trained(t)
+	path := writeDict(t, data)
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+
+	got, err := Load(path, false, " "+strings.ToUpper(checksum)+"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Path != path || got.ID != 42 {
+		t.Errorf("Load: got path %s id %d, want %s id 42", got.Path, got.ID, path)
+	}
+	if want := fmt.Sprintf("loaded dictionary %s: id=42, size=%d", path, len(data)); got.String() != want {
+		t.Errorf("String: got %q, want %q", got.String(), want)
+	}
+
+	_, err = Load(path, false, strings.Repeat("0", 64))
+	if err == nil || !strings.Contains(err.Error(), "sha256 mismatch: got "+checksum) {
+		t.Fatalf("Load with a wrong checksum: got error %v", err)
+	}
+}
+
+func TestLoadNamesThePath(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"empty":       nil,
+		"truncated":   trained(t)[:4],
+		"wrong magic": []byte("PK\x03\x04 not a dictionary"),
+	} {
+		path := writeDict(t, data)
+		if _, err := Load(path, false, ""); err == nil || !strings.HasPrefix(err.Error(), path+": ") {
+			t.Errorf("%s: got error %v, want one starting with the path", name, err)
+		}
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.zdict"), false, ""); !os.IsNotExist(err) {
+		t.Errorf("missing file: got error %v, want a not-exist error", err)
+	}
+}
+
+func TestPackageRoundTrip(t *testing.T) {
+	data := trained(t)
+	path := filepath.Join(t.TempDir(), "test"+PackageExt)
+	metadata := []byte(`{"format": "wrapped", "dict_id": 42}`)
+	if err := WritePackage(path, data, metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Load(path, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != 42 || string(got.Data) != string(data) || string(got.Metadata) != string(metadata) {
+		t.Fatalf("Load: got id %d, %d bytes, metadata %s", got.ID, len(got.Data), got.Metadata)
+	}
+	if !strings.HasSuffix(got.String(), "\n  package metadata: "+`{"format":"wrapped","dict_id":42}`) {
+		t.Errorf("String: got %q", got.String())
+	}
+	if _, err := Load(path, true, ""); err == nil || !strings.Contains(err.Error(), "drop -raw-dict") {
+		t.Errorf("Load with -raw-dict: got error %v", err)
+	}
+
+	pkg, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	damaged := append([]byte(nil), pkg...)
+	damaged[len(damaged)/2] ^= 0xFF
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"damaged", damaged, "package checksum mismatch"},
+		{"truncated", pkg[:len(packageMagic)+4], "package is truncated"},
+		{"not a package", data, "not a dictionary package"},
+	}
+	for _, tt := range tests {
+		if _, _, err := ReadPackage(tt.data); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v, want one containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package dictfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// PackageExt is the extension of dictionary packages written by
+// train-dict -package.
+const PackageExt = ".zdictpkg"
+
+// A package keeps a dictionary and its metadata in one file so they cannot
+// drift apart on the way to the hosts that use them:
+//
+//	magic       "ZDICTPKG"                      8 bytes
+//	version     1                               1 byte
+//	meta length little-endian uint32            4 bytes
+//	metadata    train-dict metadata JSON
+//	dict length little-endian uint32            4 bytes
+//	dictionary  the .zdict bytes, wrapped or raw
+//	checksum    SHA-256 of everything above     32 bytes
+var packageMagic = []byte("ZDICTPKG")
+
+const packageVersion = 1
+
+// IsPackage reports whether data starts like a dictionary package.
+func IsPackage(data []byte) bool {
+	return bytes.HasPrefix(data, packageMagic)
+}
+
+// WritePackage writes dict and its metadata JSON to path as a package.
+func WritePackage(path string, dict, metadata []byte) error {
+	var buf bytes.Buffer
+	buf.Write(packageMagic)
+	buf.WriteByte(packageVersion)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(metadata)))
+	buf.Write(metadata)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(dict)))
+	buf.Write(dict)
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:])
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+// ReadPackage verifies the checksum of a package and returns the dictionary
+// and metadata it holds.
+func ReadPackage(data []byte) (dict, metadata []byte, err error) {
+	if !IsPackage(data) {
+		return nil, nil, errors.New("not a dictionary package")
+	}
+	if len(data) < len(packageMagic)+1+4+4+sha256.Size {
+		return nil, nil, fmt.Errorf("package is truncated (%d bytes)", len(data))
+	}
+	body, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if got := sha256.Sum256(body); !bytes.Equal(got[:], sum) {
+		return nil, nil, errors.New("package checksum mismatch: the file is damaged or was modified")
+	}
+	if version := body[len(packageMagic)]; version != packageVersion {
+		return nil, nil, fmt.Errorf("unsupported package version %d (want %d)", version, packageVersion)
+	}
+
+	rest := body[len(packageMagic)+1:]
+	metadata, rest, err = packageSection(rest, "metadata")
+	if err != nil {
+		return nil, nil, err
+	}
+	dict, rest, err = packageSection(rest, "dictionary")
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rest) != 0 {
+		return nil, nil, fmt.Errorf("package has %d unexpected trailing bytes", len(rest))
+	}
+	return dict, metadata, nil
+}
+
+func packageSection(data []byte, name string) ([]byte, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, fmt.Errorf("package is truncated before the %s", name)
+	}
+	n := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+	if uint64(n) > uint64(len(data)) {
+		return nil, nil, fmt.Errorf("package %s length %d exceeds the file", name, n)
+	}
+	return data[:n], data[n:], nil
+}
+
+// packageFormat returns the dictionary format ("wrapped" or "raw") recorded
+// in package metadata, defaulting to wrapped.
+func packageFormat(metadata []byte) (string, error) {
+	var meta struct {
+		Format string `json:"format"`
+	}
+	if err := json.Unmarshal(metadata, &meta); err != nil {
+		return "", fmt.Errorf("package metadata is not valid JSON: %w", err)
+	}
+	if meta.Format == "" {
+		return "wrapped", nil
+	}
+	return meta.Format, nil
+}
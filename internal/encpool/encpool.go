@@ -0,0 +1,93 @@
+// Package encpool keeps reusable zstd encoders per level and dictionary, so
+// code that compresses many small streams, such as one per HTTP request,
+// does not build an encoder (and, with a dictionary, its tables) each time.
+//
+// Pooled encoders run single-threaded: many of them work in parallel on
+// separate streams, which suits request-sized inputs better than one
+// encoder splitting a stream across goroutines.
+package encpool
+
+import (
+	"crypto/sha256"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Pool hands out encoders built with the same options.
+type Pool struct {
+	level zstd.EncoderLevel
+	dict  []byte
+	pool  sync.Pool
+}
+
+// key identifies a pool. The dictionary is keyed by its SHA-256 rather than
+// its bytes: a weaker hash could let two dictionaries share a pool, and the
+// second would get encoders built with the first.
+type key struct {
+	level   zstd.EncoderLevel
+	dictSum [sha256.Size]byte
+}
+
+var pools sync.Map // key -> *Pool
+
+// For returns the shared pool for level and dict; level 0 means
+// zstd.SpeedDefault and an empty dict none. The first call for a pair builds
+// an encoder up front, so an invalid dictionary fails there rather than on
+// first use. dict must not be modified afterwards.
+func For(level zstd.EncoderLevel, dict []byte) (*Pool, error) {
+	if level == 0 {
+		level = zstd.SpeedDefault
+	}
+	k := key{level: level}
+	if len(dict) > 0 {
+		k.dictSum = sha256.Sum256(dict)
+	}
+	if p, ok := pools.Load(k); ok {
+		return p.(*Pool), nil
+	}
+
+	p := &Pool{level: level, dict: dict}
+	encoder, err := p.newEncoder()
+	if err != nil {
+		return nil, err
+	}
+	p.pool.Put(encoder)
+	actual, _ := pools.LoadOrStore(k, p)
+	return actual.(*Pool), nil
+}
+
+func (p *Pool) newEncoder() (*zstd.Encoder, error) {
+	options := []zstd.EOption{
+		zstd.WithEncoderLevel(p.level),
+		zstd.WithEncoderConcurrency(1),
+	}
+	if len(p.dict) > 0 {
+		options = append(options, zstd.WithEncoderDict(p.dict))
+	}
+	return zstd.NewWriter(nil, options...)
+}
+
+// Get returns an encoder that starts a new stream to w. w may be nil when
+// the encoder is only used for EncodeAll. Return it with Put.
+func (p *Pool) Get(w io.Writer) (*zstd.Encoder, error) {
+	encoder, ok := p.pool.Get().(*zstd.Encoder)
+	if !ok {
+		var err error
+		if encoder, err = p.newEncoder(); err != nil {
+			return nil, err
+		}
+	}
+	encoder.Reset(w)
+	return encoder, nil
+}
+
+// Put returns encoder to the pool, whether or not its stream was closed.
+// The encoder is reset right away, which drops whatever the stream still
+// held and its reference to the writer, so nothing of one stream can reach
+// the next.
+func (p *Pool) Put(encoder *zstd.Encoder) {
+	encoder.Reset(nil)
+	p.pool.Put(encoder)
+}
@@ -0,0 +1,196 @@
+package encpool
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+// buildDicts trains a dictionary with ID 42 and returns it with a copy that
+// differs only in its ID, 43, so the two have the same length.
+var buildDicts = sync.OnceValues(func() ([2][]byte, error) {
+	var samples [][]byte
+	for i := 0; i < 200; i++ {
+		samples = append(samples, fmt.Appendf(nil, `{"id":%d,"name":"user-%d","email":"user-%d@example.com","active":%t}`, i, i%17, i, i%3 == 0))
+	}
+	first, err := dict.BuildZstdDict(samples, dict.Options{MaxDictSize: 4096, HashBytes: 6, ZstdDictID: 42})
+	if err != nil {
+		return [2][]byte{}, err
+	}
+	second := bytes.Clone(first)
+	binary.LittleEndian.PutUint32(second[4:], 43)
+	return [2][]byte{first, second}, nil
+})
+
+func dicts(t *testing.T) [2][]byte {
+	t.Helper()
+	d, err := buildDicts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func decode(t *testing.T, data []byte, dicts ...[]byte) ([]byte, error) {
+	t.Helper()
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dicts...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	return decoder.DecodeAll(data, nil)
+}
+
+func TestForSharesPools(t *testing.T) {
+	d := dicts(t)
+	a, err := For(zstd.SpeedDefault, d[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, err := For(0, bytes.Clone(d[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != same {
+		t.Error("equal dictionaries at the default level got different pools")
+	}
+	other, err := For(zstd.SpeedDefault, d[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == a {
+		t.Fatal("dictionaries of the same length that differ got the same pool")
+	}
+	if faster, _ := For(zstd.SpeedFastest, d[0]); faster == a {
+		t.Error("two levels got the same pool")
+	}
+
+	encoder, err := other.Get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Put(encoder)
+	frame := encoder.EncodeAll([]byte(`{"id":7,"name":"user-7"}`), nil)
+	header := zstd.Header{}
+	if err := header.Decode(frame); err != nil {
+		t.Fatal(err)
+	}
+	if header.DictionaryID != 43 {
+		t.Errorf("encoder from the second pool uses dictionary %d, want 43", header.DictionaryID)
+	}
+}
+
+func TestForRejectsInvalidDictionary(t *testing.T) {
+	if _, err := For(zstd.SpeedDefault, []byte("not a dictionary")); err == nil {
+		t.Error("an invalid dictionary built a pool")
+	}
+}
+
+func TestPutDropsTheStream(t *testing.T) {
+	p, err := For(zstd.SpeedFastest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var abandoned, next bytes.Buffer
+	encoder, err := p.Get(&abandoned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder.Write(bytes.Repeat([]byte("left unfinished "), 1000))
+	p.Put(encoder)
+	written := abandoned.Len()
+
+	encoder, err = p.Get(&next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder.Write([]byte("second stream"))
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p.Put(encoder)
+
+	if abandoned.Len() != written {
+		t.Error("the abandoned stream was written to after Put")
+	}
+	got, err := decode(t, next.Bytes())
+	if err != nil || string(got) != "second stream" {
+		t.Errorf("next stream decodes to %q, %v", got, err)
+	}
+}
+
+func TestConcurrentRoundTrip(t *testing.T) {
+	d := dicts(t)
+	levels := []zstd.EncoderLevel{zstd.SpeedFastest, zstd.SpeedDefault, zstd.SpeedBetterCompression}
+	dictSets := [][]byte{nil, d[0], d[1]}
+
+	const workers, rounds = 16, 100
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			decoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(d[0], d[1]), zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer decoder.Close()
+			for i := 0; i < rounds; i++ {
+				level, dictBytes := levels[(w+i)%len(levels)], dictSets[(w*7+i)%len(dictSets)]
+				p, err := For(level, dictBytes)
+				if err != nil {
+					errs <- err
+					return
+				}
+				input := fmt.Appendf(nil, `{"id":%d,"worker":%d,"name":"user-%d","email":"user-%d@example.com"}`, i, w, i%17, i)
+				input = bytes.Repeat(input, 1+i%5)
+
+				var out bytes.Buffer
+				encoder, err := p.Get(&out)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if i%10 == 9 {
+					// An abandoned stream must not reach the next user.
+					encoder.Write(input)
+					p.Put(encoder)
+					continue
+				}
+				if i%2 == 0 {
+					encoder.Write(input)
+					err = encoder.Close()
+				} else {
+					out.Write(encoder.EncodeAll(input, nil))
+				}
+				p.Put(encoder)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				got, err := decoder.DecodeAll(out.Bytes(), nil)
+				if err != nil {
+					errs <- fmt.Errorf("worker %d round %d: %w", w, i, err)
+					return
+				}
+				if !bytes.Equal(got, input) {
+					errs <- fmt.Errorf("worker %d round %d: decoded %d bytes that differ from the %d encoded", w, i, len(got), len(input))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
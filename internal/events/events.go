@@ -0,0 +1,221 @@
+// Package events writes the -progress-json stream of compress, decompress
+// and train-dict: the pkg/progress events, one JSON line each.
+//
+// A tool registers the flags with Flags, calls Start once they are parsed,
+// Begin when it knows what it will process, File for each file it finishes
+// and Finish with its exit code, like notify. A nil *Stream, returned when
+// -progress-json is off, ignores every call. Each event is marshaled first
+// and written with a single Write under a lock, so lines never interleave,
+// and a pipe reader sees whole lines as long as they are shorter than the
+// pipe buffer, which they are unless a path is very long.
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"zstd-learning/pkg/progress"
+)
+
+// Options holds the -progress-* flags.
+type Options struct {
+	JSON     bool
+	Target   string
+	Interval time.Duration
+}
+
+// Flags registers -progress-json, -progress-fd and -progress-interval on
+// fs.
+func Flags(fs *flag.FlagSet) *Options {
+	opts := &Options{}
+	fs.BoolVar(&opts.JSON, "progress-json", false, "write machine-readable progress to stderr as JSON lines: run-start, periodic progress, one event per finished file and run-end (schema in pkg/progress)")
+	fs.StringVar(&opts.Target, "progress-fd", "", "with -progress-json, write the events to this inherited file descriptor number (e.g. 3) or path, such as a named FIFO, instead of stderr")
+	fs.DurationVar(&opts.Interval, "progress-interval", time.Second, "with -progress-json, how often to write a progress event while files are being finished")
+	return opts
+}
+
+// Stream is a run's -progress-json output.
+type Stream struct {
+	command string
+	out     io.Writer
+	closer  io.Closer
+	start   time.Time
+
+	mu      sync.Mutex
+	runID   string
+	totals  progress.Event
+	changed bool
+	ended   bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Start opens the stream of a run of command. It returns nil when
+// -progress-json is off. Tools call it before notify.Start, so the events
+// go to the real stderr rather than through the pipe notify reads the
+// error message of a failed run from.
+func Start(opts *Options, command string) (*Stream, error) {
+	if opts == nil || !opts.JSON {
+		if opts != nil && opts.Target != "" {
+			return nil, errors.New("-progress-fd requires -progress-json")
+		}
+		return nil, nil
+	}
+	if opts.Interval <= 0 {
+		return nil, errors.New("progress-interval must be positive")
+	}
+	s := &Stream{command: command, out: os.Stderr, start: time.Now()}
+	if opts.Target != "" {
+		file, err := openTarget(opts.Target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -progress-fd: %w", err)
+		}
+		s.out, s.closer = file, file
+	}
+	s.stop, s.done = make(chan struct{}), make(chan struct{})
+	go s.tick(opts.Interval)
+	return s, nil
+}
+
+// openTarget opens -progress-fd: a number is a descriptor the process
+// inherited, anything else a path opened for appending. Opening a FIFO
+// waits until a reader has it open.
+func openTarget(target string) (*os.File, error) {
+	if fd, err := strconv.Atoi(target); err == nil {
+		if fd < 0 {
+			return nil, fmt.Errorf("bad file descriptor %d", fd)
+		}
+		file := os.NewFile(uintptr(fd), "progress-fd-"+target)
+		if _, err := file.Stat(); err != nil {
+			return nil, fmt.Errorf("file descriptor %d: %w", fd, err)
+		}
+		return file, nil
+	}
+	return os.OpenFile(target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+}
+
+// Begin writes the run-start event with the files and bytes the run is
+// about to process; totalBytes is left out when negative.
+func (s *Stream) Begin(runID string, totalFiles int, totalBytes int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runID = runID
+	ev := progress.Event{Type: progress.RunStart, TotalFiles: totalFiles}
+	if totalBytes > 0 {
+		ev.TotalBytes = totalBytes
+	}
+	s.write(ev)
+}
+
+// Phase writes a progress event naming the step the run moved on to.
+func (s *Stream) Phase(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.totals.Phase = name
+	s.progressLocked()
+}
+
+// File writes the event of one finished file and adds it to the totals
+// unless status is skipped. compress and decompress give path relative to
+// -in, train-dict as walked, since it may read several roots.
+func (s *Stream) File(path string, inputBytes, outputBytes int64, status string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status != progress.StatusSkipped {
+		s.totals.Files++
+		s.totals.InputBytes += inputBytes
+		s.totals.OutputBytes += outputBytes
+		s.changed = true
+	}
+	s.write(progress.Event{Type: progress.File, Path: path, InputBytes: inputBytes, OutputBytes: outputBytes, Status: status})
+}
+
+// Finish writes the run-end event for a run exiting with code and closes
+// the stream. Only the first call has an effect.
+func (s *Stream) Finish(code int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	close(s.stop)
+	s.mu.Unlock()
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ev := s.totals
+	ev.Type = progress.RunEnd
+	ev.Phase = ""
+	ev.Status = progress.StatusOK
+	if code != 0 {
+		ev.Status = progress.StatusFailed
+		ev.ExitCode = code
+	}
+	ev.Seconds = time.Since(s.start).Seconds()
+	s.write(ev)
+	if s.closer != nil {
+		s.closer.Close()
+	}
+}
+
+// tick writes a progress event every interval in which a file finished.
+func (s *Stream) tick(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if s.changed {
+				s.progressLocked()
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *Stream) progressLocked() {
+	ev := s.totals
+	ev.Type = progress.Progress
+	s.write(ev)
+	s.changed = false
+}
+
+// write stamps ev and writes it as one line; s.mu is held. A stream that
+// cannot be written to, such as a FIFO whose reader went away, is not
+// worth failing the run for, so errors are dropped.
+func (s *Stream) write(ev progress.Event) {
+	ev.V = progress.Version
+	ev.Time = time.Now().UTC()
+	ev.Command = s.command
+	ev.RunID = s.runID
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	s.out.Write(append(line, '\n'))
+}
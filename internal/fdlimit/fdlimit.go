@@ -0,0 +1,48 @@
+// Package fdlimit implements -max-open-files: it bounds how many input and
+// output files the parallel modes of compress and decompress hold open at
+// once, whatever their worker counts, so a run over a huge tree stays
+// within the process's file descriptor limit.
+package fdlimit
+
+import "sync"
+
+// Limit counts open files against a maximum. A nil *Limit does not limit.
+type Limit struct {
+	// mu serializes Acquire, so a caller taking several slots gets all of
+	// them before the next caller takes any and two callers holding part of
+	// what they need cannot wait on each other forever.
+	mu    sync.Mutex
+	slots chan struct{}
+}
+
+// New returns a Limit of max open files, or nil when max is not positive.
+func New(max int) *Limit {
+	if max <= 0 {
+		return nil
+	}
+	return &Limit{slots: make(chan struct{}, max)}
+}
+
+// Acquire waits until n more files may be opened and reserves them. A
+// caller must release what it acquired before acquiring again. n is capped
+// at the maximum, so a single caller never waits forever.
+func (l *Limit) Acquire(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for range min(n, cap(l.slots)) {
+		l.slots <- struct{}{}
+	}
+}
+
+// Release returns n files reserved by Acquire.
+func (l *Limit) Release(n int) {
+	if l == nil {
+		return
+	}
+	for range min(n, cap(l.slots)) {
+		<-l.slots
+	}
+}
@@ -0,0 +1,58 @@
+package fdlimit
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLimitBoundsHolders(t *testing.T) {
+	const maxOpen = 3
+	l := New(maxOpen)
+	var open, most atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Mix one- and two-file holders, as the readers and encoders
+			// of the compress pipeline do.
+			n := 1 + i%2
+			for range 20 {
+				l.Acquire(n)
+				now := open.Add(int64(n))
+				for {
+					m := most.Load()
+					if now <= m || most.CompareAndSwap(m, now) {
+						break
+					}
+				}
+				open.Add(-int64(n))
+				l.Release(n)
+			}
+		}()
+	}
+	wg.Wait()
+	if most.Load() > maxOpen {
+		t.Errorf("%d files held at once, limit %d", most.Load(), maxOpen)
+	}
+}
+
+func TestAcquireCapsAtTheMaximum(t *testing.T) {
+	l := New(2)
+	// Asking for more than the limit takes all of it rather than waiting
+	// forever.
+	l.Acquire(5)
+	l.Release(5)
+	l.Acquire(2)
+	l.Release(2)
+}
+
+func TestNilLimit(t *testing.T) {
+	var l *Limit
+	if New(0) != nil || New(-1) != nil {
+		t.Error("a limit of 0 or less is not nil")
+	}
+	l.Acquire(100)
+	l.Release(100)
+}
@@ -0,0 +1,406 @@
+// Package filter implements the small expression language used by -filter to
+// select files during a directory walk.
+//
+// Grammar:
+//
+//	expr    = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | "(" expr ")" | compare
+//	compare = field op value
+//	field   = "size" | "ext" | "name" | "age" | "mode"
+//	op      = "==" | "!=" | "<" | "<=" | ">" | ">=" | "~"
+//	value   = bare word or "double quoted string"
+//
+// size takes byte sizes such as 512, 64KiB or 1MB and age takes durations
+// with units s, m, h, d or w (7d, 36h, 90m); both support the ordering
+// operators. mode is the permission bits, written in octal (0644). name is
+// the base name and ext the extension including the dot (".json", compared
+// case-insensitively; a missing leading dot is added). Strings support ==,
+// != and ~, which matches a shell glob such as "report-*.json".
+package filter
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"zstd-learning/internal/size"
+)
+
+// File is the input to an expression.
+type File struct {
+	Path string
+	Info fs.FileInfo
+}
+
+// Expr is a parsed filter expression.
+type Expr struct {
+	source string
+	root   node
+	now    func() time.Time
+}
+
+// Parse compiles a filter expression.
+func Parse(source string) (*Expr, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, fmt.Errorf("filter: unexpected %q", p.peek().text)
+	}
+	return &Expr{source: source, root: root, now: time.Now}, nil
+}
+
+func (e *Expr) String() string {
+	return e.source
+}
+
+// Match evaluates the expression for one file. A nil expression matches
+// everything.
+func (e *Expr) Match(file File) bool {
+	if e == nil {
+		return true
+	}
+	return e.root.eval(&evalContext{file: file, now: e.now()})
+}
+
+type evalContext struct {
+	file File
+	now  time.Time
+}
+
+type node interface {
+	eval(ctx *evalContext) bool
+}
+
+type orNode struct{ left, right node }
+type andNode struct{ left, right node }
+type notNode struct{ inner node }
+
+func (n orNode) eval(ctx *evalContext) bool  { return n.left.eval(ctx) || n.right.eval(ctx) }
+func (n andNode) eval(ctx *evalContext) bool { return n.left.eval(ctx) && n.right.eval(ctx) }
+func (n notNode) eval(ctx *evalContext) bool { return !n.inner.eval(ctx) }
+
+type numberCompare struct {
+	field string
+	op    string
+	value int64
+}
+
+func (n numberCompare) eval(ctx *evalContext) bool {
+	var actual int64
+	switch n.field {
+	case "size":
+		actual = ctx.file.Info.Size()
+	case "age":
+		actual = int64(ctx.now.Sub(ctx.file.Info.ModTime()))
+	case "mode":
+		actual = int64(ctx.file.Info.Mode().Perm())
+	}
+	switch n.op {
+	case "==":
+		return actual == n.value
+	case "!=":
+		return actual != n.value
+	case "<":
+		return actual < n.value
+	case "<=":
+		return actual <= n.value
+	case ">":
+		return actual > n.value
+	case ">=":
+		return actual >= n.value
+	}
+	return false
+}
+
+type stringCompare struct {
+	field string
+	op    string
+	value string
+}
+
+func (n stringCompare) eval(ctx *evalContext) bool {
+	name := filepath.Base(ctx.file.Path)
+	actual := name
+	if n.field == "ext" {
+		actual = strings.ToLower(filepath.Ext(name))
+	}
+	switch n.op {
+	case "==":
+		return actual == n.value
+	case "!=":
+		return actual != n.value
+	case "~":
+		matched, _ := path.Match(n.value, actual)
+		return matched
+	}
+	return false
+}
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenString
+	tokenOp
+	tokenLParen
+	tokenRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(source string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "("})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")"})
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(source) && source[end] != '"' {
+				if source[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(source) {
+				return nil, fmt.Errorf("filter: unterminated string at offset %d", i)
+			}
+			text, err := strconv.Unquote(source[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("filter: invalid string at offset %d: %v", i, err)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: text})
+			i = end + 1
+		case strings.IndexByte("=!<>~&|", c) >= 0:
+			op := string(c)
+			if i+1 < len(source) {
+				pair := source[i : i+2]
+				switch pair {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					op = pair
+				}
+			}
+			if op == "=" || op == "&" || op == "|" {
+				return nil, fmt.Errorf("filter: unknown operator %q at offset %d", op, i)
+			}
+			tokens = append(tokens, token{kind: tokenOp, text: op})
+			i += len(op)
+		default:
+			end := i
+			for end < len(source) && strings.IndexByte(" \t\n\r()\"=!<>~&|", source[end]) < 0 {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenWord, text: source[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *parser) peek() token {
+	if p.done() {
+		return token{}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() (token, error) {
+	if p.done() {
+		return token{}, fmt.Errorf("filter: unexpected end of expression")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t, nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for !p.done() && p.peek().kind == tokenOp && p.peek().text == "||" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for !p.done() && p.peek().kind == tokenOp && p.peek().text == "&&" {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokenOp && t.text == "!":
+		p.pos++
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{inner}, nil
+	case t.kind == tokenLParen:
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		closing, err := p.next()
+		if err != nil || closing.kind != tokenRParen {
+			return nil, fmt.Errorf("filter: missing closing parenthesis")
+		}
+		return inner, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *parser) parseCompare() (node, error) {
+	fieldTok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if fieldTok.kind != tokenWord {
+		return nil, fmt.Errorf("filter: expected a field name, got %q", fieldTok.text)
+	}
+	opTok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if opTok.kind != tokenOp || opTok.text == "&&" || opTok.text == "||" || opTok.text == "!" {
+		return nil, fmt.Errorf("filter: expected a comparison after %q, got %q", fieldTok.text, opTok.text)
+	}
+	valueTok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if valueTok.kind != tokenWord && valueTok.kind != tokenString {
+		return nil, fmt.Errorf("filter: expected a value after %q %s", fieldTok.text, opTok.text)
+	}
+
+	field, op, value := strings.ToLower(fieldTok.text), opTok.text, valueTok.text
+	switch field {
+	case "size", "age", "mode":
+		if op == "~" {
+			return nil, fmt.Errorf("filter: %s does not support ~", field)
+		}
+		number, err := parseNumber(field, value)
+		if err != nil {
+			return nil, err
+		}
+		return numberCompare{field: field, op: op, value: number}, nil
+	case "name", "ext":
+		switch op {
+		case "==", "!=", "~":
+		default:
+			return nil, fmt.Errorf("filter: %s only supports ==, != and ~", field)
+		}
+		if field == "ext" {
+			value = strings.ToLower(value)
+			if value != "" && !strings.HasPrefix(value, ".") && !strings.ContainsAny(value, "*?[") {
+				value = "." + value
+			}
+		}
+		if op == "~" {
+			if _, err := path.Match(value, ""); err != nil {
+				return nil, fmt.Errorf("filter: invalid pattern %q", value)
+			}
+		}
+		return stringCompare{field: field, op: op, value: value}, nil
+	default:
+		return nil, fmt.Errorf("filter: unknown field %q (expected size, ext, name, age, mode)", fieldTok.text)
+	}
+}
+
+func parseNumber(field, value string) (int64, error) {
+	switch field {
+	case "size":
+		bytes, err := size.Parse(value)
+		if err != nil {
+			return 0, fmt.Errorf("filter: %v", err)
+		}
+		return bytes, nil
+	case "age":
+		d, err := parseAge(value)
+		if err != nil {
+			return 0, err
+		}
+		return int64(d), nil
+	default:
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil {
+			return 0, fmt.Errorf("filter: invalid octal mode %q", value)
+		}
+		return int64(mode), nil
+	}
+}
+
+var ageUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+func parseAge(value string) (time.Duration, error) {
+	split := strings.IndexFunc(value, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if split <= 0 {
+		return 0, fmt.Errorf("filter: invalid age %q (use units s, m, h, d, w)", value)
+	}
+	unit, ok := ageUnits[strings.ToLower(value[split:])]
+	if !ok {
+		return 0, fmt.Errorf("filter: invalid age unit in %q (use s, m, h, d, w)", value)
+	}
+	amount, err := strconv.ParseFloat(value[:split], 64)
+	if err != nil {
+		return 0, fmt.Errorf("filter: invalid age %q", value)
+	}
+	return time.Duration(amount * float64(unit)), nil
+}
@@ -0,0 +1,182 @@
+package filter
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fileInfo) IsDir() bool        { return false }
+func (fi fileInfo) Sys() any           { return nil }
+
+var now = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// file is a 2 MB, 0640, three-day-old file.
+func file(path string) File {
+	name := path[strings.LastIndexByte(path, '/')+1:]
+	return File{Path: path, Info: fileInfo{name: name, size: 2_000_000, mode: 0o640, modTime: now.Add(-72 * time.Hour)}}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		expr string
+		path string
+		want bool
+	}{
+		// size
+		{"size == 2000000", "a.json", true},
+		{"size != 2MB", "a.json", false},
+		{"size > 1MB", "a.json", true},
+		{"size > 2MB", "a.json", false},
+		{"size >= 2MB", "a.json", true},
+		{"size < 2MiB", "a.json", true},
+		{"size <= 1999999", "a.json", false},
+		{"size > 1.5mb", "a.json", true},
+
+		// ext
+		{"ext == .json", "dir/a.json", true},
+		{"ext == json", "dir/a.json", true},
+		{"ext == .JSON", "dir/a.json", true},
+		{"ext == .json", "dir/A.JSON", true},
+		{"ext != .json", "dir/a.csv", true},
+		{"ext == .json", "dir/a.json.zst", false},
+		{`ext == ""`, "dir/Makefile", true},
+		{"ext ~ .js*", "a.jsonl", true},
+		{"ext ~ .js*", "a.csv", false},
+
+		// name
+		{"name == a.json", "dir/sub/a.json", true},
+		{"name == sub", "dir/sub/a.json", false},
+		{"name != a.json", "b.json", true},
+		{"name ~ report-*.json", "out/report-2024.json", true},
+		{"name ~ report-?.json", "report-10.json", false},
+		{"name ~ [ab].json", "b.json", true},
+
+		// age
+		{"age > 2d", "a.json", true},
+		{"age < 7d", "a.json", true},
+		{"age < 1w", "a.json", true},
+		{"age >= 72h", "a.json", true},
+		{"age > 72h", "a.json", false},
+		{"age == 4320m", "a.json", true},
+		{"age != 259200s", "a.json", false},
+		{"age <= 2.5d", "a.json", false},
+		{"age < 3D", "a.json", false},
+
+		// mode
+		{"mode == 0640", "a.json", true},
+		{"mode == 640", "a.json", true},
+		{"mode != 0644", "a.json", true},
+		{"mode > 0600", "a.json", true},
+		{"mode < 0640", "a.json", false},
+		{"mode >= 0640", "a.json", true},
+		{"mode <= 0600", "a.json", false},
+
+		// ! and parentheses
+		{"!ext == .csv", "a.json", true},
+		{"!!ext == .csv", "a.json", false},
+		{"!(size > 1MB && ext == .json)", "a.json", false},
+		{"(ext == .csv || ext == .json) && size > 1MB", "a.json", true},
+		{"((name == a.json))", "a.json", true},
+
+		// && binds tighter than ||
+		{"ext == .csv && size > 1MB || name == a.json", "a.json", true},
+		{"name == a.json || ext == .csv && size > 1MB", "a.json", true},
+		{"ext == .csv && (size > 1MB || name == a.json)", "a.json", false},
+		{"ext == .json || ext == .csv && size > 9MB", "a.json", true},
+		{"(ext == .json || ext == .csv) && size > 9MB", "a.json", false},
+		{"size > 1MB && ext == .json && age < 7d", "a.json", true},
+
+		// quoted values
+		{`name == "my report.json"`, "out/my report.json", true},
+		{`name == "say \"hi\".json"`, `say "hi".json`, true},
+		{`name ~ "* (1).json"`, "copy (1).json", true},
+		{`name == "a&&b"`, "a&&b", true},
+		{`ext == ".json"`, "a.json", true},
+		{`size > "1MB"`, "a.json", true},
+	}
+	for _, tt := range tests {
+		expr, err := Parse(tt.expr)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.expr, err)
+			continue
+		}
+		expr.now = func() time.Time { return now }
+		if got := expr.Match(file(tt.path)); got != tt.want {
+			t.Errorf("%q on %s = %v, want %v", tt.expr, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestMatchNil(t *testing.T) {
+	var expr *Expr
+	if !expr.Match(file("a.json")) {
+		t.Error("a nil expression rejected a file")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"", "unexpected end"},
+		{"size", "unexpected end"},
+		{"size >", "unexpected end"},
+		{"color == red", `unknown field "color"`},
+		{"size = 1", `unknown operator "="`},
+		{"size > 1 & ext == .json", `unknown operator "&"`},
+		{"size > 1 | ext == .json", `unknown operator "|"`},
+		{"size > 1 ext == .json", `unexpected "ext"`},
+		{"size > 1 &&", "unexpected end"},
+		{"(size > 1", "missing closing parenthesis"},
+		{"size > 1)", `unexpected ")"`},
+		{"() ", "expected a field name"},
+		{"size && 1", "expected a comparison"},
+		{"size > (", "expected a value"},
+		{"size > lots", "invalid size"},
+		{"size ~ 1*", "size does not support ~"},
+		{"age < 7", "invalid age"},
+		{"age < 7y", "invalid age unit"},
+		{"age < d", "invalid age"},
+		{"mode == 0649", "invalid octal mode"},
+		{"name > a", "name only supports ==, != and ~"},
+		{"ext <= .json", "ext only supports ==, != and ~"},
+		{"name ~ [a", "invalid pattern"},
+		{`name == "open`, "unterminated string"},
+		{`name == "\q"`, "invalid string"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.expr)
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error containing %q", tt.expr, tt.want)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) || !strings.HasPrefix(err.Error(), "filter: ") {
+			t.Errorf("Parse(%q) = %v, want an error containing %q", tt.expr, err, tt.want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	const source = "size > 1MB && ext == .json"
+	expr, err := Parse(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expr.String() != source {
+		t.Errorf("String() = %q, want %q", expr.String(), source)
+	}
+}
@@ -0,0 +1,246 @@
+// Package frame walks the frame structure of zstd streams without decoding
+// block contents, following RFC 8878 section 3.1.
+package frame
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// Magic is the little-endian magic number that starts a zstd frame.
+	Magic uint32 = 0xFD2FB528
+	// SkippableMagicMin and SkippableMagicMax bound the magic numbers of
+	// skippable frames.
+	SkippableMagicMin uint32 = 0x184D2A50
+	SkippableMagicMax uint32 = 0x184D2A5F
+
+	maxBlockSize = 128 << 10
+)
+
+// ErrNotZstd is returned when the data at a frame boundary starts with
+// neither a zstd nor a skippable frame magic number.
+var ErrNotZstd = errors.New("not a zstd frame")
+
+// Info describes one frame. Offset and Length locate the whole frame,
+// including header, blocks and checksum, within the scanned stream.
+type Info struct {
+	Offset        int64
+	Length        int64
+	Skippable     bool
+	SkippableID   uint32
+	DictID        uint32
+	ContentSize   int64 // -1 when the header does not declare it
+	WindowSize    uint64
+	SingleSegment bool
+	HasChecksum   bool
+	HeaderLength  int
+	Blocks        int
+}
+
+// HasContentSize reports whether the frame header declares the
+// decompressed size.
+func (i Info) HasContentSize() bool {
+	return i.ContentSize >= 0
+}
+
+// Scanner reads consecutive frames from a stream.
+type Scanner struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+func NewScanner(r io.Reader) *Scanner {
+	return &Scanner{r: bufio.NewReaderSize(r, 64<<10)}
+}
+
+// Offset is the number of bytes consumed so far, i.e. the start of the next
+// frame.
+func (s *Scanner) Offset() int64 {
+	return s.offset
+}
+
+// Next returns the next frame. It returns io.EOF at a clean end of stream and
+// io.ErrUnexpectedEOF when the stream ends inside a frame.
+func (s *Scanner) Next() (Info, error) {
+	info := Info{Offset: s.offset, ContentSize: -1}
+
+	var magicBuf [4]byte
+	n, err := io.ReadFull(s.r, magicBuf[:])
+	if err != nil {
+		if errors.Is(err, io.EOF) && n == 0 {
+			return info, io.EOF
+		}
+		return info, io.ErrUnexpectedEOF
+	}
+	magic := binary.LittleEndian.Uint32(magicBuf[:])
+
+	switch {
+	case magic >= SkippableMagicMin && magic <= SkippableMagicMax:
+		var sizeBuf [4]byte
+		if _, err := io.ReadFull(s.r, sizeBuf[:]); err != nil {
+			return info, io.ErrUnexpectedEOF
+		}
+		size := int64(binary.LittleEndian.Uint32(sizeBuf[:]))
+		if err := s.discard(size); err != nil {
+			return info, err
+		}
+		info.Skippable = true
+		info.SkippableID = magic - SkippableMagicMin
+		info.HeaderLength = 8
+		info.Length = 8 + size
+	case magic == Magic:
+		headerLen, err := s.readHeader(&info)
+		if err != nil {
+			return info, err
+		}
+		blocks, blockBytes, err := s.skipBlocks()
+		if err != nil {
+			return info, err
+		}
+		info.Blocks = blocks
+		info.HeaderLength = 4 + headerLen
+		info.Length = int64(info.HeaderLength) + blockBytes
+		if info.HasChecksum {
+			if err := s.discard(4); err != nil {
+				return info, err
+			}
+			info.Length += 4
+		}
+	default:
+		return info, fmt.Errorf("%w at offset %d (magic %#08x)", ErrNotZstd, s.offset, magic)
+	}
+
+	s.offset += info.Length
+	return info, nil
+}
+
+func (s *Scanner) readHeader(info *Info) (int, error) {
+	descriptor, err := s.r.ReadByte()
+	if err != nil {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if descriptor&0x08 != 0 {
+		return 0, fmt.Errorf("frame at offset %d: reserved header bit set", info.Offset)
+	}
+
+	fcsFlag := descriptor >> 6
+	info.SingleSegment = descriptor&0x20 != 0
+	info.HasChecksum = descriptor&0x04 != 0
+	dictIDSize := [4]int{0, 1, 2, 4}[descriptor&0x03]
+	fcsSize := [4]int{0, 2, 4, 8}[fcsFlag]
+	if fcsFlag == 0 && info.SingleSegment {
+		fcsSize = 1
+	}
+	windowSize := 0
+	if !info.SingleSegment {
+		windowSize = 1
+	}
+
+	rest := make([]byte, windowSize+dictIDSize+fcsSize)
+	if _, err := io.ReadFull(s.r, rest); err != nil {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	if windowSize > 0 {
+		exponent := uint64(rest[0] >> 3)
+		mantissa := uint64(rest[0] & 0x07)
+		base := uint64(1) << (10 + exponent)
+		info.WindowSize = base + (base/8)*mantissa
+	}
+	field := rest[windowSize:]
+
+	switch dictIDSize {
+	case 1:
+		info.DictID = uint32(field[0])
+	case 2:
+		info.DictID = uint32(binary.LittleEndian.Uint16(field))
+	case 4:
+		info.DictID = binary.LittleEndian.Uint32(field)
+	}
+	field = field[dictIDSize:]
+
+	switch fcsSize {
+	case 1:
+		info.ContentSize = int64(field[0])
+	case 2:
+		info.ContentSize = int64(binary.LittleEndian.Uint16(field)) + 256
+	case 4:
+		info.ContentSize = int64(binary.LittleEndian.Uint32(field))
+	case 8:
+		info.ContentSize = int64(binary.LittleEndian.Uint64(field))
+	}
+	if info.SingleSegment && info.ContentSize >= 0 {
+		info.WindowSize = uint64(info.ContentSize)
+	}
+
+	return 1 + len(rest), nil
+}
+
+func (s *Scanner) skipBlocks() (int, int64, error) {
+	var blocks int
+	var total int64
+	for {
+		var header [3]byte
+		if _, err := io.ReadFull(s.r, header[:]); err != nil {
+			return blocks, total, io.ErrUnexpectedEOF
+		}
+		value := uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16
+		last := value&1 != 0
+		blockType := (value >> 1) & 0x03
+		blockSize := int64(value >> 3)
+
+		payload := blockSize
+		switch blockType {
+		case 1: // RLE blocks store a single byte repeated blockSize times.
+			payload = 1
+		case 3:
+			return blocks, total, fmt.Errorf("reserved block type at offset %d", s.offset+total)
+		}
+		if blockSize > maxBlockSize {
+			return blocks, total, fmt.Errorf("block size %d exceeds maximum at offset %d", blockSize, s.offset+total)
+		}
+		if err := s.discard(payload); err != nil {
+			return blocks, total, err
+		}
+		blocks++
+		total += 3 + payload
+		if last {
+			return blocks, total, nil
+		}
+	}
+}
+
+func (s *Scanner) discard(n int64) error {
+	for n > 0 {
+		step := n
+		if step > 1<<30 {
+			step = 1 << 30
+		}
+		discarded, err := s.r.Discard(int(step))
+		n -= int64(discarded)
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	return nil
+}
+
+// ScanAll returns every frame in r.
+func ScanAll(r io.Reader) ([]Info, error) {
+	scanner := NewScanner(r)
+	var frames []Info
+	for {
+		info, err := scanner.Next()
+		if errors.Is(err, io.EOF) {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+		frames = append(frames, info)
+	}
+}
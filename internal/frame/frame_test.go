@@ -0,0 +1,103 @@
+package frame
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"zstd-learning/internal/synth"
+)
+
+// compressedSeeds returns zstd streams of generate-data output: single
+// frames with and without a checksum, several frames back to back, and
+// frames around a skippable one.
+func compressedSeeds(tb testing.TB) [][]byte {
+	tb.Helper()
+	var seeds [][]byte
+	var records [][]byte
+	for _, kind := range synth.Types {
+		gen, err := synth.New(synth.Options{
+			Type:         kind,
+			Seed:         1,
+			Locales:      "en",
+			EmailDomains: "example.com",
+			Clock:        synth.Clock{Base: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Step: time.Second},
+		})
+		if err != nil {
+			tb.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := gen.Write(&buf, 20, "json"); err != nil {
+			tb.Fatal(err)
+		}
+		records = append(records, buf.Bytes())
+	}
+	plain, err := zstd.NewWriter(nil, zstd.WithEncoderCRC(false))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer plain.Close()
+	checked, err := zstd.NewWriter(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer checked.Close()
+
+	skippable := binary.LittleEndian.AppendUint32(nil, SkippableMagicMin+3)
+	skippable = binary.LittleEndian.AppendUint32(skippable, 5)
+	skippable = append(skippable, "index"...)
+	var multi []byte
+	for i, data := range records {
+		single := plain.EncodeAll(data, nil)
+		seeds = append(seeds, single, checked.EncodeAll(data, nil), single[:len(single)/2])
+		multi = checked.EncodeAll(data, multi)
+		if i == 0 {
+			multi = append(multi, skippable...)
+		}
+	}
+	seeds = append(seeds, multi, append(skippable, multi...))
+	return seeds
+}
+
+func FuzzScanner(f *testing.F) {
+	for _, seed := range compressedSeeds(f) {
+		f.Add(seed)
+	}
+	f.Add([]byte{})
+	f.Add([]byte("not zstd"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		scanner := NewScanner(bytes.NewReader(data))
+		var end int64
+		for {
+			info, err := scanner.Next()
+			if err != nil {
+				if errors.Is(err, io.EOF) && end != int64(len(data)) {
+					t.Fatalf("clean end at %d of %d bytes", end, len(data))
+				}
+				if scanner.Offset() != end {
+					t.Fatalf("failed frame moved the offset from %d to %d", end, scanner.Offset())
+				}
+				return
+			}
+			if info.Offset != end {
+				t.Fatalf("frame at %d, previous one ended at %d", info.Offset, end)
+			}
+			if info.Length < int64(info.HeaderLength) {
+				t.Fatalf("frame at %d: length %d, header %d", info.Offset, info.Length, info.HeaderLength)
+			}
+			end = info.Offset + info.Length
+			if end > int64(len(data)) {
+				t.Fatalf("frame at %d declares %d bytes, past the end of %d bytes of input", info.Offset, info.Length, len(data))
+			}
+			if scanner.Offset() != end {
+				t.Fatalf("scanner at %d after a frame ending at %d", scanner.Offset(), end)
+			}
+		}
+	})
+}
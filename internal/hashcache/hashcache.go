@@ -0,0 +1,141 @@
+// Package hashcache remembers the hashes of files between runs, so a run
+// over a large, mostly unchanged tree does not reread every file to hash it
+// again.
+//
+// The cache is a JSON file:
+//
+//	{
+//	  "version": 1,
+//	  "entries": {
+//	    "/abs/path/file.zst": {"mtime": "2026-10-15T03:04:13.123456789Z", "size": 1234, "hash": "..."}
+//	  }
+//	}
+//
+// Entries are keyed by absolute path. An entry is only used while the
+// file's modification time and size still match it; otherwise the file is
+// hashed again and the entry replaced. What the hash covers is up to the
+// caller, so one cache file should not be shared between different kinds
+// of hashes.
+package hashcache
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const version = 1
+
+type entry struct {
+	ModTime time.Time `json:"mtime"`
+	Size    int64     `json:"size"`
+	Hash    string    `json:"hash"`
+}
+
+type file struct {
+	Version int              `json:"version"`
+	Entries map[string]entry `json:"entries"`
+}
+
+// Cache is a loaded cache file. It is safe for concurrent use.
+type Cache struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]entry
+	hits    int
+	misses  int
+}
+
+// Load reads the cache at path. A missing file, or one that cannot be
+// parsed or has another version, yields an empty cache, which only costs a
+// full rehash.
+func Load(path string) (*Cache, error) {
+	c := &Cache{path: path, entries: map[string]entry{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f file
+	if json.Unmarshal(data, &f) == nil && f.Version == version && f.Entries != nil {
+		c.entries = f.Entries
+	}
+	return c, nil
+}
+
+// Hash returns the hash of the file at path, from the cache when its
+// modification time and size are unchanged, otherwise from compute, whose
+// result is then cached.
+func (c *Cache) Hash(path string, compute func() (string, error)) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	cached, ok := c.entries[key]
+	if ok && cached.Size == info.Size() && cached.ModTime.Equal(info.ModTime()) {
+		c.hits++
+		c.mu.Unlock()
+		return cached.Hash, nil
+	}
+	c.mu.Unlock()
+
+	hash, err := compute()
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.entries[key] = entry{ModTime: info.ModTime().UTC(), Size: info.Size(), Hash: hash}
+	c.misses++
+	c.mu.Unlock()
+	return hash, nil
+}
+
+// Stats returns how many hashes came from the cache and how many were
+// computed.
+func (c *Cache) Stats() (hits, misses int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// Save writes the cache back via a temporary file and rename. Entries of
+// files that no longer exist are dropped; entries of files this run did not
+// hash are otherwise kept, so runs over different trees can share a cache.
+func (c *Cache) Save() error {
+	c.mu.Lock()
+	for key := range c.entries {
+		if _, err := os.Stat(key); errors.Is(err, os.ErrNotExist) {
+			delete(c.entries, key)
+		}
+	}
+	data, err := json.Marshal(file{Version: version, Entries: c.entries})
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(c.path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
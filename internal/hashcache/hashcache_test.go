@@ -0,0 +1,136 @@
+package hashcache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// hasher returns a compute function that counts its calls and returns the
+// content of path as the hash.
+func hasher(path string, calls *int) func() (string, error) {
+	return func() (string, error) {
+		*calls++
+		data, err := os.ReadFile(path)
+		return string(data), err
+	}
+}
+
+func TestHashReusesUnchangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.json")
+	if err := os.WriteFile(path, []byte("one"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cachePath := filepath.Join(dir, "cache", "hashes.json")
+	c, err := Load(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	if hash, err := c.Hash(path, hasher(path, &calls)); err != nil || hash != "one" || calls != 1 {
+		t.Fatalf("first hash %q, %v after %d computations", hash, err, calls)
+	}
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cachePath + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	// A new run loads the saved entry and does not hash again.
+	c, err = Load(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash, err := c.Hash(path, hasher(path, &calls)); err != nil || hash != "one" || calls != 1 {
+		t.Errorf("unchanged file: hash %q, %v after %d computations, want the cached one", hash, err, calls)
+	}
+
+	// The same size with a new mtime is a change.
+	if err := os.WriteFile(path, []byte("two"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if hash, err := c.Hash(path, hasher(path, &calls)); err != nil || hash != "two" || calls != 2 {
+		t.Errorf("new mtime: hash %q, %v after %d computations, want it recomputed", hash, err, calls)
+	}
+
+	// So is a new size with the mtime put back.
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("three"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if hash, err := c.Hash(path, hasher(path, &calls)); err != nil || hash != "three" || calls != 3 {
+		t.Errorf("new size: hash %q, %v after %d computations, want it recomputed", hash, err, calls)
+	}
+	if hits, misses := c.Stats(); hits != 1 || misses != 2 {
+		t.Errorf("Stats() = %d hits, %d misses; want 1, 2", hits, misses)
+	}
+}
+
+func TestSaveDropsRemovedFiles(t *testing.T) {
+	dir := t.TempDir()
+	kept := filepath.Join(dir, "kept.json")
+	removed := filepath.Join(dir, "removed.json")
+	for _, path := range []string{kept, removed} {
+		if err := os.WriteFile(path, []byte(path), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cachePath := filepath.Join(dir, "hashes.json")
+	c, err := Load(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	for _, path := range []string{kept, removed} {
+		if _, err := c.Hash(path, hasher(path, &calls)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(removed); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	c, err = Load(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.entries) != 1 {
+		t.Errorf("%d entries after saving, want the 1 of the file still there", len(c.entries))
+	}
+}
+
+func TestLoadIgnoresUnusableCaches(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"corrupt.json":    "{not json",
+		"version.json":    `{"version":99,"entries":{"/a":{"size":1,"hash":"x"}}}`,
+		"no-entries.json": `{"version":1}`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := Load(path)
+		if err != nil || len(c.entries) != 0 {
+			t.Errorf("%s: %v with %d entries, want an empty cache", name, err, len(c.entries))
+		}
+	}
+	if c, err := Load(filepath.Join(dir, "missing.json")); err != nil || len(c.entries) != 0 {
+		t.Errorf("missing file: %v, want an empty cache", err)
+	}
+}
@@ -0,0 +1,141 @@
+// Package history keeps a local, append-only record of runs for users
+// without Prometheus. compress, decompress and train-dict append one JSON
+// line per run to the file given with -history, and cmd/report exports or
+// prunes it. Readers ignore unknown fields, so files written by newer tool
+// versions stay readable.
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Record is one run. Timestamp is when the run finished, in UTC.
+type Record struct {
+	Timestamp       time.Time `json:"timestamp"`
+	Command         string    `json:"command"`
+	Source          string    `json:"source"`
+	RunID           string    `json:"run_id,omitempty"`
+	Files           int       `json:"files"`
+	InputBytes      int64     `json:"input_bytes"`
+	OutputBytes     int64     `json:"output_bytes"`
+	Ratio           float64   `json:"ratio"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Level           int       `json:"level,omitempty"`
+	DictID          uint32    `json:"dict_id,omitempty"`
+}
+
+// Append adds rec to the history file at path, creating it if needed. The
+// line is written with a single append so concurrent runs do not interleave
+// within a record.
+func Append(path string, rec Record) error {
+	rec.Timestamp = rec.Timestamp.UTC().Truncate(time.Second)
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Read returns every record in the history file at path, in Sort order. A
+// missing file is an empty history.
+func Read(path string) ([]Record, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	Sort(records)
+	return records, nil
+}
+
+// Sort orders records by timestamp, then command, source and run ID, so
+// exports of the same history are byte-for-byte stable and diffable.
+func Sort(records []Record) {
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+		if a.Command != b.Command {
+			return a.Command < b.Command
+		}
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.RunID < b.RunID
+	})
+}
+
+// Prune rewrites the history file at path without the records older than
+// cutoff and returns how many were removed. The new file is written next to
+// the old one and renamed over it, so readers never see a partial history.
+func Prune(path string, cutoff time.Time) (int, error) {
+	records, err := Read(path)
+	if err != nil {
+		return 0, err
+	}
+	var buf bytes.Buffer
+	removed := 0
+	for _, rec := range records {
+		if rec.Timestamp.Before(cutoff) {
+			removed++
+			continue
+		}
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return 0, err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0o644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	return removed, nil
+}
@@ -0,0 +1,126 @@
+// Package lock takes an advisory lock on an output directory so two runs of
+// compress, decompress or train-dict cannot write into it at once.
+//
+// The lock is the file FileName in the directory, removed again on Release
+// so it does not stay behind among the outputs. On Unix it is held with
+// flock and on Windows with LockFileEx, so the operating system drops it
+// when the process exits for any reason, signals and crashes included; the
+// file itself then stays until the next run takes and releases the lock.
+// Elsewhere the file is created with O_EXCL; its holder refreshes the
+// modification time while running and removes it on exit or on SIGINT and
+// SIGTERM, and a file not refreshed for Options.StaleAfter is taken to be
+// left over from a crashed process and broken. In every case the file names
+// the holder, so a refused run can say who has the directory.
+package lock
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileName is the lock file created in a locked directory.
+const FileName = ".zstd-learning.lock"
+
+// pollInterval is how often Acquire retries while waiting for a lock.
+const pollInterval = 200 * time.Millisecond
+
+// Holder identifies the process holding a lock.
+type Holder struct {
+	Command string    `json:"command"`
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Since   time.Time `json:"since"`
+}
+
+func (h Holder) String() string {
+	if h.PID == 0 {
+		return "an unknown process"
+	}
+	return fmt.Sprintf("%s (pid %d on %s, since %s)", h.Command, h.PID, h.Host, h.Since.Format(time.RFC3339))
+}
+
+// Options configures Acquire.
+type Options struct {
+	// Command names the tool taking the lock, for the holder record.
+	Command string
+	// Wait is how long to keep retrying a held lock; 0 fails at once.
+	Wait time.Duration
+	// StaleAfter is the age after which an O_EXCL lock file that its
+	// holder stopped refreshing is broken. Locks held with flock or
+	// LockFileEx are released by the OS instead and never go stale.
+	StaleAfter time.Duration
+}
+
+// HeldError is returned when another process holds the lock.
+type HeldError struct {
+	Dir    string
+	Holder Holder
+	Waited time.Duration
+}
+
+func (e *HeldError) Error() string {
+	if e.Waited > 0 {
+		return fmt.Sprintf("%s is still locked by %s after waiting %s", e.Dir, e.Holder, e.Waited)
+	}
+	return fmt.Sprintf("%s is locked by %s; pass -wait-for-lock to wait for it", e.Dir, e.Holder)
+}
+
+// Lock is a held directory lock.
+type Lock struct {
+	path    string
+	release func() error
+}
+
+// Acquire locks dir, retrying until opts.Wait has passed while another
+// process holds it.
+func Acquire(dir string, opts Options) (*Lock, error) {
+	path := filepath.Join(dir, FileName)
+	holder := Holder{Command: opts.Command, PID: os.Getpid(), Since: time.Now().UTC().Truncate(time.Second)}
+	holder.Host, _ = os.Hostname()
+	record, err := json.Marshal(holder)
+	if err != nil {
+		return nil, err
+	}
+	record = append(record, '\n')
+
+	start := time.Now()
+	for {
+		release, err := tryLock(path, record, opts.StaleAfter)
+		if err != nil {
+			return nil, err
+		}
+		if release != nil {
+			return &Lock{path: path, release: release}, nil
+		}
+		if time.Since(start) >= opts.Wait {
+			return nil, &HeldError{Dir: dir, Holder: readHolder(path), Waited: opts.Wait}
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// Release drops the lock and removes its file. It is safe to call more than
+// once.
+func (l *Lock) Release() error {
+	if l == nil || l.release == nil {
+		return nil
+	}
+	release := l.release
+	l.release = nil
+	return release()
+}
+
+// readHolder returns the holder recorded in the lock file at path, or the
+// zero Holder when it cannot be read.
+func readHolder(path string) Holder {
+	var holder Holder
+	data, err := os.ReadFile(path)
+	if err == nil {
+		json.Unmarshal([]byte(strings.TrimSpace(string(data))), &holder)
+	}
+	return holder
+}
@@ -0,0 +1,70 @@
+//go:build !unix && !windows
+
+package lock
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// tryLock creates path with O_EXCL and records the holder in it. A lock
+// file its holder has not refreshed for staleAfter is removed and taken
+// over. It returns a nil release function when another process holds the
+// lock.
+func tryLock(path string, record []byte, staleAfter time.Duration) (func() error, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		info, statErr := os.Stat(path)
+		if statErr == nil && staleAfter > 0 && time.Since(info.ModTime()) > staleAfter {
+			os.Remove(path)
+			return tryLock(path, record, 0)
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(record)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	// The holder keeps the file fresh so only a lock left behind by a dead
+	// process goes stale, and removes it when interrupted.
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		interval := staleAfter / 4
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				now := time.Now()
+				os.Chtimes(path, now, now)
+			case <-signals:
+				os.Remove(path)
+				os.Exit(130)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() error {
+		signal.Stop(signals)
+		close(done)
+		return os.Remove(path)
+	}, nil
+}
@@ -0,0 +1,74 @@
+package lock
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReleaseRemovesFile(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Acquire(dir, Options{Command: "compress"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, FileName)
+	if holder := readHolder(path); holder.Command != "compress" || holder.PID != os.Getpid() {
+		t.Errorf("lock file names %+v", holder)
+	}
+	if err := l.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("lock file left after release: %v", err)
+	}
+	if err := l.Release(); err != nil {
+		t.Errorf("second release: %v", err)
+	}
+}
+
+func TestAcquireHeld(t *testing.T) {
+	dir := t.TempDir()
+	first, err := Acquire(dir, Options{Command: "compress"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Release()
+
+	_, err = Acquire(dir, Options{Command: "decompress"})
+	var held *HeldError
+	if !errors.As(err, &held) {
+		t.Fatalf("second Acquire: got %v, want a HeldError", err)
+	}
+	if held.Holder.Command != "compress" {
+		t.Errorf("HeldError names %s, want compress", held.Holder)
+	}
+}
+
+func TestAcquireWaitsForRelease(t *testing.T) {
+	dir := t.TempDir()
+	first, err := Acquire(dir, Options{Command: "compress"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(3 * pollInterval / 2)
+		first.Release()
+	}()
+
+	second, err := Acquire(dir, Options{Command: "train-dict", Wait: 10 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Release()
+	// The file the first holder removed must not be the one locked now,
+	// or a third run could lock a new file alongside.
+	if _, err := Acquire(dir, Options{Command: "decompress"}); err == nil {
+		t.Fatal("a third run took the lock the second holds")
+	}
+	if holder := readHolder(filepath.Join(dir, FileName)); holder.Command != "train-dict" {
+		t.Errorf("lock file names %s, want train-dict", holder)
+	}
+}
@@ -0,0 +1,63 @@
+//go:build unix
+
+package lock
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// tryLock takes a non-blocking flock on path and records the holder in it.
+// It returns a nil release function when another process holds the lock.
+// Releasing removes the file.
+func tryLock(path string, record []byte, _ time.Duration) (func() error, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	// The previous holder removes the file on release, so the one locked
+	// here may be gone from the directory by now; locking it would then
+	// guard nothing, and the file at path is the one to lock.
+	if !isCurrent(f, path) {
+		f.Close()
+		return tryLock(path, record, 0)
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteAt(record, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() error {
+		// Removing the file while still holding the lock keeps a process
+		// that opened it meanwhile from taking it after us; it sees the
+		// file is gone and creates a new one.
+		err := os.Remove(path)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}, nil
+}
+
+// isCurrent reports whether f is still the file at path.
+func isCurrent(f *os.File, path string) bool {
+	held, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	return err == nil && os.SameFile(held, current)
+}
@@ -0,0 +1,55 @@
+//go:build windows
+
+package lock
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockOffsetHigh places the locked byte far past the holder record, since
+// Windows byte-range locks are mandatory and would otherwise stop other
+// processes from reading who holds the lock.
+const lockOffsetHigh = 0x7fffffff
+
+// tryLock takes a non-blocking LockFileEx lock on path and records the
+// holder in it. It returns a nil release function when another process
+// holds the lock. Releasing removes the file unless another process has it
+// open, waiting for the lock.
+func tryLock(path string, record []byte, _ time.Duration) (func() error, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	handle := windows.Handle(f.Fd())
+	overlapped := &windows.Overlapped{OffsetHigh: lockOffsetHigh}
+	err = windows.LockFileEx(handle, windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, overlapped)
+	if err != nil {
+		f.Close()
+		if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteAt(record, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() error {
+		f.Truncate(0)
+		windows.UnlockFileEx(handle, 0, 1, 0, &windows.Overlapped{OffsetHigh: lockOffsetHigh})
+		err := f.Close()
+		// An open file cannot be removed on Windows, so this fails, and
+		// the file stays for the next holder, only while another process
+		// has it open.
+		os.Remove(path)
+		return err
+	}, nil
+}
@@ -0,0 +1,91 @@
+// Package mirror copies the files a tool does not transform into its output
+// tree unchanged, so that compress and decompress can produce a complete
+// mirror of their input when some files are skipped.
+package mirror
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"zstd-learning/internal/outpath"
+)
+
+// Plan maps every path to the same relative name under outDir. outs are the
+// outputs the tool itself writes for inputs; a copy that would land on one
+// of them, or on another copy, is an error, so the run can fail before
+// anything is written.
+func Plan(paths []string, baseDir, outDir string, inputs, outs []string) ([]string, error) {
+	collisions := outpath.NewCollisions()
+	for i, out := range outs {
+		if err := collisions.Add(inputs[i], out); err != nil {
+			return nil, err
+		}
+	}
+	dests := make([]string, len(paths))
+	for i, path := range paths {
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return nil, err
+		}
+		dest, err := outpath.Join(outDir, rel)
+		if err != nil {
+			return nil, err
+		}
+		if err := collisions.Add(rel, dest); err != nil {
+			return nil, err
+		}
+		dests[i] = dest
+	}
+	return dests, nil
+}
+
+// Copy copies each path to its destination unchanged, keeping the
+// modification time. Destinations that already have the source's size and
+// modification time are left alone, so repeated mirror runs only copy what
+// changed. It returns the number of files and bytes copied.
+func Copy(paths, dests []string) (int, int64, error) {
+	copied := 0
+	var copiedBytes int64
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return copied, copiedBytes, err
+		}
+		if existing, err := os.Stat(dests[i]); err == nil && existing.Size() == info.Size() && existing.ModTime().Equal(info.ModTime()) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dests[i]), 0o755); err != nil {
+			return copied, copiedBytes, err
+		}
+		n, err := copyFile(path, dests[i], info)
+		if err != nil {
+			return copied, copiedBytes, err
+		}
+		copied++
+		copiedBytes += n
+	}
+	return copied, copiedBytes, nil
+}
+
+func copyFile(src, dst string, info fs.FileInfo) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if closeErr := out.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,239 @@
+// Package notify posts a JSON summary of a finished or failed run to a
+// webhook, such as a Slack incoming webhook relay, so nightly jobs can
+// report without a wrapper script.
+//
+// A tool registers the flags with Flags, calls Start once they are parsed
+// and calls Finish with its exit code. While a run is being watched, stderr
+// is passed through a pipe that remembers its last line, which becomes the
+// error message of a failed run; that way the many error paths of a tool,
+// which print to stderr and exit, need no changes beyond exiting through
+// Finish. A notification that cannot be delivered is reported on stderr
+// and never changes the exit code.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values of -notify-on.
+const (
+	OnAlways  = "always"
+	OnFailure = "failure"
+	OnSuccess = "success"
+)
+
+// Statuses reported in Payload.Status.
+const (
+	StatusSuccess = "success"
+	StatusFailure = "failure"
+)
+
+// retryDelay is the pause before the single retry of a failed delivery.
+const retryDelay = time.Second
+
+// Options holds the notification flags.
+type Options struct {
+	URL     string
+	On      string
+	Timeout time.Duration
+}
+
+// Flags registers -notify-url, -notify-on and -notify-timeout on fs.
+func Flags(fs *flag.FlagSet) *Options {
+	opts := &Options{}
+	fs.StringVar(&opts.URL, "notify-url", "", "POST a JSON summary of the run (command, run ID, status, stats, duration, error) to this webhook URL when it ends")
+	fs.StringVar(&opts.On, "notify-on", OnAlways, "when -notify-url fires: always, failure or success")
+	fs.DurationVar(&opts.Timeout, "notify-timeout", 10*time.Second, "timeout of each -notify-url attempt; a failed delivery is retried once")
+	return opts
+}
+
+// Payload is the JSON body posted to the webhook.
+type Payload struct {
+	Command         string    `json:"command"`
+	RunID           string    `json:"run_id,omitempty"`
+	Status          string    `json:"status"`
+	Files           int       `json:"files"`
+	InputBytes      int64     `json:"input_bytes"`
+	OutputBytes     int64     `json:"output_bytes"`
+	Ratio           float64   `json:"ratio,omitempty"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Error           string    `json:"error,omitempty"`
+	FinishedAt      time.Time `json:"finished_at"`
+}
+
+// Run is a run being watched for notification. A nil *Run, returned by
+// Start when no URL is set, ignores every call.
+type Run struct {
+	opts    Options
+	command string
+	start   time.Time
+	tail    *stderrTail
+	payload Payload
+	once    sync.Once
+}
+
+// Start begins watching a run of command. It returns nil when opts has no
+// URL.
+func Start(opts *Options, command string) (*Run, error) {
+	if opts == nil || strings.TrimSpace(opts.URL) == "" {
+		return nil, nil
+	}
+	switch opts.On {
+	case OnAlways, OnFailure, OnSuccess:
+	default:
+		return nil, fmt.Errorf("invalid -notify-on %q (expected always, failure or success)", opts.On)
+	}
+	if opts.Timeout <= 0 {
+		return nil, errors.New("notify-timeout must be positive")
+	}
+	tail, err := captureStderr()
+	if err != nil {
+		return nil, err
+	}
+	return &Run{opts: *opts, command: command, start: time.Now(), tail: tail}, nil
+}
+
+// Record sets the run ID and stats reported when the run finishes.
+func (r *Run) Record(runID string, files int, inputBytes, outputBytes int64, ratio float64) {
+	if r == nil {
+		return
+	}
+	r.payload.RunID = runID
+	r.payload.Files = files
+	r.payload.InputBytes = inputBytes
+	r.payload.OutputBytes = outputBytes
+	r.payload.Ratio = ratio
+}
+
+// Finish stops watching stderr and, if -notify-on selects the outcome,
+// posts the notification for a run exiting with code. Only the first call
+// has an effect.
+func (r *Run) Finish(code int) {
+	if r == nil {
+		return
+	}
+	r.once.Do(func() {
+		lastLine := r.tail.stop()
+		payload := r.payload
+		payload.Command = r.command
+		payload.Status = StatusSuccess
+		if code != 0 {
+			payload.Status = StatusFailure
+			payload.Error = lastLine
+			if payload.Error == "" {
+				payload.Error = fmt.Sprintf("exit status %d", code)
+			}
+		}
+		payload.DurationSeconds = time.Since(r.start).Seconds()
+		payload.FinishedAt = time.Now().UTC()
+
+		if r.opts.On == OnFailure && code == 0 || r.opts.On == OnSuccess && code != 0 {
+			return
+		}
+		if err := Send(r.opts.URL, r.opts.Timeout, payload); err != nil {
+			fmt.Fprintf(os.Stderr, "notification failed: %v\n", err)
+		}
+	})
+}
+
+// Send posts payload to url as JSON, retrying once after a failure. Each
+// attempt is bounded by timeout; any 2xx response is a success.
+func Send(url string, timeout time.Duration, payload Payload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: timeout}
+	err = post(client, url, body)
+	if err == nil {
+		return nil
+	}
+	time.Sleep(retryDelay)
+	if retryErr := post(client, url, body); retryErr != nil {
+		return fmt.Errorf("%w (after retrying: %v)", err, retryErr)
+	}
+	return nil
+}
+
+func post(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// ansiEscape matches the color codes of internal/console.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// stderrTail stands in for os.Stderr, copying everything written to it to
+// the real stderr as it arrives and remembering the last non-blank line.
+type stderrTail struct {
+	orig *os.File
+	w    *os.File
+	done chan struct{}
+	last string
+}
+
+func captureStderr() (*stderrTail, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	t := &stderrTail{orig: os.Stderr, w: w, done: make(chan struct{})}
+	go func() {
+		defer close(t.done)
+		defer r.Close()
+		var line []byte
+		buf := make([]byte, 4096)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				t.orig.Write(buf[:n])
+				for _, b := range buf[:n] {
+					if b != '\n' {
+						line = append(line, b)
+						continue
+					}
+					t.keep(line)
+					line = line[:0]
+				}
+			}
+			if err != nil {
+				t.keep(line)
+				return
+			}
+		}
+	}()
+	os.Stderr = w
+	return t, nil
+}
+
+func (t *stderrTail) keep(line []byte) {
+	if text := strings.TrimSpace(ansiEscape.ReplaceAllString(string(line), "")); text != "" {
+		t.last = text
+	}
+}
+
+// stop restores os.Stderr, waits for everything written so far to be
+// copied and returns the last line.
+func (t *stderrTail) stop() string {
+	os.Stderr = t.orig
+	t.w.Close()
+	<-t.done
+	return t.last
+}
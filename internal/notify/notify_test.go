@@ -0,0 +1,179 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhook records the JSON bodies posted to it, answering with the next of
+// codes, then 200.
+type webhook struct {
+	mu     sync.Mutex
+	codes  []int
+	bodies []map[string]any
+}
+
+func (h *webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var body map[string]any
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "want a JSON POST", http.StatusBadRequest)
+		return
+	}
+	data, _ := io.ReadAll(r.Body)
+	json.Unmarshal(data, &body)
+	h.bodies = append(h.bodies, body)
+	if len(h.codes) > 0 {
+		w.WriteHeader(h.codes[0])
+		h.codes = h.codes[1:]
+	}
+}
+
+func (h *webhook) received() []map[string]any {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.bodies
+}
+
+func keys(m map[string]any) []string {
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestFinishPostsThePayload(t *testing.T) {
+	hook := &webhook{}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+
+	run, err := Start(&Options{URL: server.URL, On: OnAlways, Timeout: time.Second}, "compress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run.Record("nightly", 3, 3000, 1000, 1.0/3)
+	run.Finish(0)
+	run.Finish(1)
+
+	bodies := hook.received()
+	if len(bodies) != 1 {
+		t.Fatalf("got %d notifications, want 1", len(bodies))
+	}
+	body := bodies[0]
+	want := []string{"command", "duration_seconds", "files", "finished_at", "input_bytes", "output_bytes", "ratio", "run_id", "status"}
+	if got := keys(body); !reflect.DeepEqual(got, want) {
+		t.Errorf("payload fields %q, want %q", got, want)
+	}
+	if body["command"] != "compress" || body["run_id"] != "nightly" || body["status"] != StatusSuccess ||
+		body["files"] != 3.0 || body["input_bytes"] != 3000.0 || body["output_bytes"] != 1000.0 {
+		t.Errorf("payload %v", body)
+	}
+	if d, ok := body["duration_seconds"].(float64); !ok || d < 0 {
+		t.Errorf("duration_seconds = %v", body["duration_seconds"])
+	}
+	if s, _ := body["finished_at"].(string); s == "" {
+		t.Error("finished_at is missing")
+	} else if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+		t.Errorf("finished_at %q: %v", s, err)
+	}
+}
+
+func TestFinishReportsTheLastErrorLine(t *testing.T) {
+	hook := &webhook{}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+
+	run, err := Start(&Options{URL: server.URL, On: OnFailure, Timeout: time.Second}, "decompress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(os.Stderr, "\x1b[31mfirst problem\x1b[0m")
+	fmt.Fprintln(os.Stderr, "\x1b[31mdecompression failed\x1b[0m: a.zst: corrupt")
+	fmt.Fprintln(os.Stderr)
+	run.Finish(1)
+
+	bodies := hook.received()
+	if len(bodies) != 1 {
+		t.Fatalf("got %d notifications, want 1", len(bodies))
+	}
+	if body := bodies[0]; body["status"] != StatusFailure || body["error"] != "decompression failed: a.zst: corrupt" {
+		t.Errorf("payload %v, want the failure with the last stderr line", body)
+	}
+}
+
+func TestNotifyOn(t *testing.T) {
+	tests := []struct {
+		on   string
+		code int
+		sent bool
+	}{
+		{OnAlways, 0, true},
+		{OnAlways, 1, true},
+		{OnFailure, 0, false},
+		{OnFailure, 2, true},
+		{OnSuccess, 0, true},
+		{OnSuccess, 1, false},
+	}
+	for _, tt := range tests {
+		hook := &webhook{}
+		server := httptest.NewServer(hook)
+		run, err := Start(&Options{URL: server.URL, On: tt.on, Timeout: time.Second}, "train-dict")
+		if err != nil {
+			t.Fatal(err)
+		}
+		run.Finish(tt.code)
+		server.Close()
+		if sent := len(hook.received()) == 1; sent != tt.sent {
+			t.Errorf("-notify-on %s, exit %d: sent %v, want %v", tt.on, tt.code, sent, tt.sent)
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	if run, err := Start(&Options{On: OnAlways, Timeout: time.Second}, "compress"); run != nil || err != nil {
+		t.Errorf("without a URL: %v, %v; want nothing watched", run, err)
+	}
+	if _, err := Start(&Options{URL: "http://example.com", On: "sometimes", Timeout: time.Second}, "compress"); err == nil {
+		t.Error("invalid -notify-on accepted")
+	}
+	if _, err := Start(&Options{URL: "http://example.com", On: OnAlways}, "compress"); err == nil {
+		t.Error("zero -notify-timeout accepted")
+	}
+	var run *Run
+	run.Record("id", 1, 1, 1, 1)
+	run.Finish(1)
+}
+
+func TestSendRetriesOnce(t *testing.T) {
+	hook := &webhook{codes: []int{http.StatusBadGateway}}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+	if err := Send(server.URL, time.Second, Payload{Command: "compress"}); err != nil {
+		t.Errorf("a failure then a success: %v", err)
+	}
+	if n := len(hook.received()); n != 2 {
+		t.Errorf("%d attempts, want 2", n)
+	}
+
+	hook = &webhook{codes: []int{http.StatusBadGateway, http.StatusInternalServerError, http.StatusOK}}
+	server2 := httptest.NewServer(hook)
+	defer server2.Close()
+	if err := Send(server2.URL, time.Second, Payload{Command: "compress"}); err == nil {
+		t.Error("two failures reported as delivered")
+	}
+	if n := len(hook.received()); n != 2 {
+		t.Errorf("%d attempts, want 2", n)
+	}
+}
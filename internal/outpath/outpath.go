@@ -0,0 +1,121 @@
+// Package outpath maps input files to output paths under an output root.
+//
+// Relative names are checked on both path styles: an element of ".." between
+// either '/' or '\' separators is rejected, as are absolute names, so a
+// crafted name cannot escape the root on Unix or Windows. Drive-qualified
+// names such as "C:foo" are only rejected on Windows; elsewhere "c:notes.txt"
+// is an ordinary file name. Outputs that differ only in case are reported
+// rather than rejected: they are distinct files on Linux but overwrite each
+// other on case-insensitive filesystems (macOS and Windows defaults).
+package outpath
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Join returns rel placed under root. It fails when rel is empty, absolute,
+// contains a ".." element on either path style, or, on Windows, carries a
+// volume name.
+func Join(root, rel string) (string, error) {
+	if err := Check(rel); err != nil {
+		return "", err
+	}
+	out := filepath.Join(root, rel)
+	// Defense in depth: Clean must not have lifted the result out of root.
+	if back, err := filepath.Rel(root, out); err != nil || back == ".." || strings.HasPrefix(back, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q escapes the output directory", rel)
+	}
+	return out, nil
+}
+
+// Check reports whether rel is safe to place under an output root.
+func Check(rel string) error {
+	return check(rel, runtime.GOOS == "windows")
+}
+
+func check(rel string, windows bool) error {
+	switch {
+	case rel == "" || rel == ".":
+		return fmt.Errorf("empty relative path")
+	case strings.ContainsRune(rel, 0):
+		return fmt.Errorf("%q contains a NUL byte", rel)
+	case filepath.IsAbs(rel) || filepath.VolumeName(rel) != "" || rel[0] == '/' || rel[0] == '\\' || windows && hasDriveLetter(rel):
+		return fmt.Errorf("%q is absolute, not relative to the input directory", rel)
+	}
+	for _, elem := range strings.FieldsFunc(rel, isSeparator) {
+		if elem == ".." {
+			return fmt.Errorf("%q escapes the output directory", rel)
+		}
+	}
+	return nil
+}
+
+// TrimSuffix removes suffix from the end of name, ignoring case so that
+// "a.json.ZST" matches ".zst". ok is false when name does not end in suffix.
+func TrimSuffix(name, suffix string) (string, bool) {
+	if len(name) < len(suffix) || !strings.EqualFold(name[len(name)-len(suffix):], suffix) {
+		return name, false
+	}
+	return name[:len(name)-len(suffix)], true
+}
+
+// HasSuffix reports whether name ends in suffix, ignoring case.
+func HasSuffix(name, suffix string) bool {
+	_, ok := TrimSuffix(name, suffix)
+	return ok
+}
+
+// Collisions finds outputs that would overwrite one another. Two inputs
+// that map to the same output are an error; outputs that differ only in
+// case are recorded for CaseOnly, since they only collide on
+// case-insensitive filesystems.
+type Collisions struct {
+	seen     map[string]string
+	folded   map[string]string
+	caseOnly []string
+}
+
+// NewCollisions returns an empty collision set.
+func NewCollisions() *Collisions {
+	return &Collisions{seen: map[string]string{}, folded: map[string]string{}}
+}
+
+// Add records out, produced from input, and fails if an earlier output
+// claims the same name.
+func (c *Collisions) Add(input, out string) error {
+	out = filepath.Clean(out)
+	if earlier, ok := c.seen[out]; ok {
+		return fmt.Errorf("%s and %s map to the same output %s", earlier, input, out)
+	}
+	c.seen[out] = input
+	key := strings.ToLower(out)
+	if earlier, ok := c.folded[key]; ok {
+		c.caseOnly = append(c.caseOnly, fmt.Sprintf("%s and %s map to outputs that differ only in case and overwrite each other on a case-insensitive filesystem", earlier, input))
+		return nil
+	}
+	c.folded[key] = input
+	return nil
+}
+
+// CaseOnly describes every output added so far whose name differs from an
+// earlier one only in case.
+func (c *Collisions) CaseOnly() []string {
+	return c.caseOnly
+}
+
+func isSeparator(r rune) bool {
+	return r == '/' || r == '\\'
+}
+
+// hasDriveLetter catches "C:foo" style names, which are relative to the
+// current directory of drive C on Windows rather than to root.
+func hasDriveLetter(rel string) bool {
+	if len(rel) < 2 || rel[1] != ':' {
+		return false
+	}
+	c := rel[0] | 0x20
+	return c >= 'a' && c <= 'z'
+}
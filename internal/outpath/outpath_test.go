@@ -0,0 +1,171 @@
+package outpath
+
+import (
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		rel string
+		// unix and windows are the expected error substrings; empty means
+		// the name is accepted.
+		unix, windows string
+	}{
+		{"a.json", "", ""},
+		{"dir/a.json", "", ""},
+		{`dir\a.json`, "", ""},
+		{`dir/sub\a.json`, "", ""},
+		{"./a.json", "", ""},
+		{"a//b.json", "", ""},
+		{`a\\b.json`, "", ""},
+		{"a/./b.json", "", ""},
+		{"..a", "", ""},
+		{"a..b/c", "", ""},
+		{"a/..b/c", "", ""},
+		{"...", "", ""},
+		{"1:notes.txt", "", ""},
+		{":notes.txt", "", ""},
+
+		{"", "empty", "empty"},
+		{".", "empty", "empty"},
+		{"a\x00b", "NUL", "NUL"},
+
+		{"..", "escapes", "escapes"},
+		{"../a.json", "escapes", "escapes"},
+		{"a/../../b.json", "escapes", "escapes"},
+		{"a/b/..", "escapes", "escapes"},
+		{"a/../b.json", "escapes", "escapes"},
+		{`..\a.json`, "escapes", "escapes"},
+		{`a\..\..\b.json`, "escapes", "escapes"},
+		{`a/..\b.json`, "escapes", "escapes"},
+		{`a\../b.json`, "escapes", "escapes"},
+
+		{"/etc/passwd", "absolute", "absolute"},
+		{"//server/share/a", "absolute", "absolute"},
+		{`\Windows\a.json`, "absolute", "absolute"},
+		{`\\server\share\a`, "absolute", "absolute"},
+		{"C:foo", "", "absolute"},
+		{"c:notes.txt", "", "absolute"},
+		{`C:\a.json`, "", "absolute"},
+		{"z:/a.json", "", "absolute"},
+	}
+	for _, tt := range tests {
+		for _, style := range []struct {
+			windows bool
+			want    string
+		}{{false, tt.unix}, {true, tt.windows}} {
+			err := check(tt.rel, style.windows)
+			if style.want == "" && err != nil || style.want != "" && (err == nil || !strings.Contains(err.Error(), style.want)) {
+				t.Errorf("check(%q, windows=%v) = %v, want %q", tt.rel, style.windows, err, style.want)
+			}
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	root := filepath.FromSlash("out/tree")
+	tests := []struct {
+		rel  string
+		want string
+	}{
+		{"a.json", "out/tree/a.json"},
+		{"dir/a.json", "out/tree/dir/a.json"},
+		{"./dir//a.json", "out/tree/dir/a.json"},
+		{"dir/./a.json.zst", "out/tree/dir/a.json.zst"},
+	}
+	if runtime.GOOS != "windows" {
+		tests = append(tests,
+			struct{ rel, want string }{"c:notes.txt", "out/tree/c:notes.txt"},
+			struct{ rel, want string }{`odd\name.json`, `out/tree/odd\name.json`},
+		)
+	}
+	for _, tt := range tests {
+		got, err := Join(root, tt.rel)
+		if err != nil {
+			t.Errorf("Join(%q): %v", tt.rel, err)
+			continue
+		}
+		if want := filepath.FromSlash(tt.want); got != want {
+			t.Errorf("Join(%q) = %q, want %q", tt.rel, got, want)
+		}
+	}
+	for _, rel := range []string{"../a.json", `a\..\..\b`, "/abs", ""} {
+		if got, err := Join(root, rel); err == nil {
+			t.Errorf("Join(%q) = %q, want an error", rel, got)
+		}
+	}
+}
+
+func TestTrimSuffix(t *testing.T) {
+	tests := []struct {
+		name, suffix, want string
+		ok                 bool
+	}{
+		{"a.json.zst", ".zst", "a.json", true},
+		{"a.json.ZST", ".zst", "a.json", true},
+		{"A.JSON.Zst", ".zst", "A.JSON", true},
+		{"a.json.zstd", ".zstd", "a.json", true},
+		{"a.json.zstd", ".zst", "a.json.zstd", false},
+		{"a.json", ".zst", "a.json", false},
+		{".zst", ".zst", "", true},
+		{"zst", ".zst", "zst", false},
+		{"a.json", "", "a.json", true},
+	}
+	for _, tt := range tests {
+		got, ok := TrimSuffix(tt.name, tt.suffix)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("TrimSuffix(%q, %q) = %q, %v; want %q, %v", tt.name, tt.suffix, got, ok, tt.want, tt.ok)
+		}
+		if HasSuffix(tt.name, tt.suffix) != tt.ok {
+			t.Errorf("HasSuffix(%q, %q) = %v, want %v", tt.name, tt.suffix, !tt.ok, tt.ok)
+		}
+	}
+}
+
+func TestCollisions(t *testing.T) {
+	tests := []struct {
+		name     string
+		outs     []string
+		wantErr  string
+		caseOnly int
+	}{
+		{"distinct", []string{"out/a.json", "out/b.json", "out/dir/a.json"}, "", 0},
+		{"same output", []string{"out/a.json", "out/a.json"}, "map to the same output", 0},
+		{"same after clean", []string{"out/dir/a.json", "out/dir/./sub/../a.json"}, "map to the same output", 0},
+		{"same with backslashes", []string{`out\dir\a.json`, `out\dir\a.json`}, "map to the same output", 0},
+		{"case only", []string{"out/README", "out/readme"}, "", 1},
+		{"case only in a directory", []string{"out/Dir/a.json", "out/dir/a.json"}, "", 1},
+		{"case only with backslashes", []string{`out\Dir\A.json`, `out\dir\a.json`}, "", 1},
+		{"case only beyond ASCII", []string{"out/Ärger.json", "out/ärger.json"}, "", 1},
+		{"three spellings", []string{"out/a.json", "out/A.json", "out/A.JSON"}, "", 2},
+		{"case only then same", []string{"out/A.json", "out/a.json", "out/A.json"}, "map to the same output", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCollisions()
+			var err error
+			for i, out := range tt.outs {
+				if err = c.Add("input"+string(rune('0'+i)), filepath.FromSlash(out)); err != nil {
+					break
+				}
+			}
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("got %v, want %q", err, tt.wantErr)
+			}
+			if got := len(c.CaseOnly()); got != tt.caseOnly {
+				t.Errorf("%d case-only warnings %q, want %d", got, c.CaseOnly(), tt.caseOnly)
+			}
+		})
+	}
+
+	c := NewCollisions()
+	c.Add("README", "out/README")
+	c.Add("readme", "out/readme")
+	if want := []string{"README and readme map to outputs that differ only in case and overwrite each other on a case-insensitive filesystem"}; !reflect.DeepEqual(c.CaseOnly(), want) {
+		t.Errorf("CaseOnly() = %q, want %q", c.CaseOnly(), want)
+	}
+}
@@ -0,0 +1,35 @@
+package outpath
+
+import (
+	"hash/fnv"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Shard returns the shard in [0, n) that the relative name rel belongs to:
+// the 32-bit FNV-1a hash of rel, with every '\' turned into '/', modulo n.
+// It depends only on the name, so the same file lands in the same shard on
+// every run and platform. n below 2 always gives shard 0.
+func Shard(rel string, n int) int {
+	if n < 2 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strings.ReplaceAll(filepath.ToSlash(rel), `\`, "/")))
+	return int(h.Sum32() % uint32(n))
+}
+
+// ShardDir returns the directory name of shard k, "shard-<k>".
+func ShardDir(k int) string {
+	return "shard-" + strconv.Itoa(k)
+}
+
+// Sharded returns rel placed under the directory of its shard out of n, or
+// rel unchanged when n is below 2.
+func Sharded(rel string, n int) string {
+	if n < 2 {
+		return rel
+	}
+	return filepath.Join(ShardDir(Shard(rel, n)), rel)
+}
@@ -0,0 +1,45 @@
+package outpath
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// StampLayout is the default time layout of generated file names: UTC to
+// the second, with a Z so the zone is explicit and names from machines in
+// different time zones sort together.
+const StampLayout = "20060102T150405Z"
+
+// CheckStampLayout rejects a -timestamp-format whose names would contain a
+// path separator.
+func CheckStampLayout(layout string) error {
+	if strings.TrimSpace(layout) == "" {
+		return errors.New("timestamp format must not be empty")
+	}
+	if strings.ContainsAny(time.Now().UTC().Format(layout), `/\`) {
+		return fmt.Errorf("timestamp format %q produces path separators", layout)
+	}
+	return nil
+}
+
+// CreateStamped creates a new file in dir named prefix, then now in UTC
+// formatted with layout, then ext. It creates with O_EXCL, so two runs
+// starting in the same second never write to one file: when the name is
+// taken, "_2", "_3" and so on are added before ext until a name is free;
+// an underscore sorts after the ".", so the first name still sorts first.
+func CreateStamped(dir, prefix, layout, ext string, now time.Time) (*os.File, error) {
+	base := prefix + now.UTC().Format(layout)
+	name := base + ext
+	for n := 2; ; n++ {
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+		if !errors.Is(err, fs.ErrExist) {
+			return f, err
+		}
+		name = fmt.Sprintf("%s_%d%s", base, n, ext)
+	}
+}
@@ -0,0 +1,64 @@
+package outpath
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCheckStampLayout(t *testing.T) {
+	for _, layout := range []string{StampLayout, "20060102_150405", "2006-01-02"} {
+		if err := CheckStampLayout(layout); err != nil {
+			t.Errorf("CheckStampLayout(%q) = %v", layout, err)
+		}
+	}
+	for _, layout := range []string{"", "  ", "2006/01/02", `2006\01`} {
+		if err := CheckStampLayout(layout); err == nil {
+			t.Errorf("CheckStampLayout(%q) succeeded", layout)
+		}
+	}
+}
+
+// TestCreateStampedSameSecond creates several files at one instant, as runs
+// starting in the same second would, and checks that each gets its own name.
+func TestCreateStampedSameSecond(t *testing.T) {
+	dir := t.TempDir()
+	// Not UTC, to check the name is.
+	now := time.Date(2024, 1, 2, 5, 4, 5, 0, time.FixedZone("UTC+2", 2*60*60))
+	var names []string
+	for i := 0; i < 3; i++ {
+		f, err := CreateStamped(dir, "people_", StampLayout, ".json", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString(string(rune('a' + i))); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		names = append(names, filepath.Base(f.Name()))
+	}
+	want := []string{"people_20240102T030405Z.json", "people_20240102T030405Z_2.json", "people_20240102T030405Z_3.json"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("created %q, want %q", names, want)
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("names %q do not sort in creation order", names)
+	}
+	// No file was reopened: each holds only what its creator wrote.
+	for i, name := range want {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(rune('a'+i)) {
+			t.Errorf("%s holds %q, want %q", name, data, string(rune('a'+i)))
+		}
+	}
+
+	if _, err := CreateStamped(filepath.Join(dir, "missing"), "people_", StampLayout, ".json", now); err == nil {
+		t.Error("created a file in a missing directory")
+	}
+}
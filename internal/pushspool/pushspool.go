@@ -0,0 +1,446 @@
+// Package pushspool keeps Pushgateway pushes that failed so they are not
+// lost while the gateway is down, for instance overnight, when batch runs
+// succeed but their metrics would otherwise be dropped.
+//
+// A tool registers the flags with Flags and pushes through Push. Without
+// -push-spool-dir, Push is a plain push. With it, a push that still fails
+// after retrying is written to a timestamped file in the directory and the
+// run carries on; the next push to a reachable gateway, or report metrics
+// flush, replays the spooled pushes oldest first before its own. Spool
+// files older than -push-spool-retention are dropped with a warning, and
+// files that cannot be parsed, such as one cut short by a crash, are
+// skipped and removed.
+//
+// -pushgateway may list several gateways, for instance one per region;
+// every push goes to each of them, and -metrics-quorum decides whether one
+// success is enough. A spooled push remembers the gateway it failed for and
+// is replayed only there.
+//
+// Several teams can share one gateway: -metrics-job replaces the job name,
+// -metrics-prefix is put in front of every metric name and -metrics-label
+// adds key=value pairs to the grouping key. They are applied before a push
+// is spooled, so a replayed push keeps them.
+package pushspool
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"zstd-learning/internal/outpath"
+)
+
+// attempts is how often a push is tried before it is spooled, and
+// retryDelay the pause before the first retry, doubled for each further one.
+const (
+	attempts   = 3
+	retryDelay = time.Second
+)
+
+// settleTime is how long an unparsable spool file is left alone, in case
+// another run is still writing it.
+const settleTime = time.Minute
+
+const (
+	filePrefix = "push-"
+	fileExt    = ".json"
+)
+
+// Values of -metrics-quorum.
+const (
+	QuorumAll = "all"
+	QuorumAny = "any"
+)
+
+// Options holds the push flags. Job, when set, replaces the job name of
+// every push, Prefix is prepended to every metric name, and Labels are
+// added to every grouping key.
+type Options struct {
+	Dir       string
+	Retention time.Duration
+	Quorum    string
+	Job       string
+	Prefix    string
+	Labels    Grouping
+}
+
+// Prometheus naming rules: a metric name prefix may hold colons, label
+// names may not, and label names starting with __ are reserved.
+var (
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// Flags registers -push-spool-dir, -push-spool-retention, -metrics-quorum,
+// -metrics-job, -metrics-prefix and -metrics-label on fs.
+func Flags(fs *flag.FlagSet) *Options {
+	opts := &Options{Quorum: QuorumAll}
+	fs.StringVar(&opts.Dir, "push-spool-dir", "", "when the metrics push still fails after retrying, save it in this directory and push it before the next successful push (or with report metrics flush) instead of failing the run")
+	fs.DurationVar(&opts.Retention, "push-spool-retention", 7*24*time.Hour, "drop spooled pushes older than this, with a warning")
+	fs.Func("metrics-quorum", "with several comma-separated -pushgateway URLs, fail the push unless it reached all of them (all, the default) or at least one (any)", func(value string) error {
+		if value != QuorumAll && value != QuorumAny {
+			return fmt.Errorf("expected %s or %s", QuorumAll, QuorumAny)
+		}
+		opts.Quorum = value
+		return nil
+	})
+	fs.Func("metrics-job", "push under this job name instead of the tool's own (compress, train-dict, ...), so tenants sharing a Pushgateway do not overwrite each other", func(value string) error {
+		if strings.TrimSpace(value) == "" {
+			return errors.New("must not be empty")
+		}
+		opts.Job = value
+		return nil
+	})
+	fs.Func("metrics-prefix", "prepend this to every pushed metric name, e.g. teama_ gives teama_compress_ratio", func(value string) error {
+		if !metricNameRE.MatchString(value) {
+			return fmt.Errorf("%q is not a valid metric name prefix (letters, digits, _ and :, not starting with a digit)", value)
+		}
+		opts.Prefix = value
+		return nil
+	})
+	fs.Func("metrics-label", "add key=value to the grouping labels of every push (repeatable), e.g. team=search", func(value string) error {
+		key, val, ok := strings.Cut(value, "=")
+		switch {
+		case !ok:
+			return fmt.Errorf("%q is not key=value", value)
+		case !labelNameRE.MatchString(key) || strings.HasPrefix(key, "__"):
+			return fmt.Errorf("%q is not a valid label name (letters, digits and _, not starting with a digit or __)", key)
+		case key == "job":
+			return errors.New("the job label is set with -metrics-job")
+		case val == "":
+			return fmt.Errorf("label %s has an empty value", key)
+		}
+		if opts.Labels == nil {
+			opts.Labels = Grouping{}
+		}
+		if _, dup := opts.Labels[key]; dup {
+			return fmt.Errorf("label %s given twice", key)
+		}
+		opts.Labels[key] = val
+		return nil
+	})
+	return opts
+}
+
+// namespace applies opts.Job, opts.Labels and opts.Prefix to a push. An
+// extra label may not replace one the tool groups by.
+func namespace(opts *Options, job string, grouping Grouping, g prometheus.Gatherer) (string, Grouping, prometheus.Gatherer, error) {
+	if opts.Job != "" {
+		job = opts.Job
+	}
+	if len(opts.Labels) > 0 {
+		merged := make(Grouping, len(grouping)+len(opts.Labels))
+		for name, value := range grouping {
+			merged[name] = value
+		}
+		for name, value := range opts.Labels {
+			if _, taken := grouping[name]; taken {
+				return "", nil, nil, fmt.Errorf("-metrics-label %s: %s metrics are already grouped by %s", name, job, name)
+			}
+			merged[name] = value
+		}
+		grouping = merged
+	}
+	if opts.Prefix != "" {
+		inner := g
+		g = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			families, err := inner.Gather()
+			for _, family := range families {
+				name := opts.Prefix + family.GetName()
+				family.Name = &name
+			}
+			return families, err
+		})
+	}
+	return job, grouping, g, nil
+}
+
+// URLs splits a -pushgateway value into its comma-separated URLs.
+func URLs(value string) []string {
+	var urls []string
+	for _, url := range strings.Split(value, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// Grouping is the grouping key of a push.
+type Grouping map[string]string
+
+// entry is one spooled push. Metrics holds the gathered families in the
+// text exposition format.
+type entry struct {
+	// Gateway is the URL the push failed for; empty in files written
+	// before -pushgateway took a list, which are replayed to every gateway.
+	Gateway   string    `json:"gateway,omitempty"`
+	Job       string    `json:"job"`
+	Grouping  Grouping  `json:"grouping"`
+	CreatedAt time.Time `json:"created_at"`
+	Metrics   string    `json:"metrics"`
+}
+
+// Push pushes what g gathers to each Pushgateway listed in urls under job
+// and grouping, as renamed and extended by opts.Job, opts.Prefix and
+// opts.Labels. The push fails when it did not reach all gateways, or with
+// opts.Quorum "any" none of them; with "any", the gateways that failed are
+// only warned about on stderr. With opts.Dir set it first replays the
+// spool, then retries a failed push and, when that fails too, spools it for
+// that gateway, warns on stderr and counts it as delivered; opts may be
+// nil.
+func Push(opts *Options, urls, job string, grouping Grouping, g prometheus.Gatherer) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	targets := URLs(urls)
+	if len(targets) == 0 {
+		return errors.New("no Pushgateway URL")
+	}
+	job, grouping, g, err := namespace(opts, job, grouping, g)
+	if err != nil {
+		return err
+	}
+	if opts.Dir != "" {
+		if _, err := Flush(opts, urls); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: spooled metrics not replayed: %v\n", err)
+		}
+	}
+
+	var errs []error
+	for _, url := range targets {
+		if err := pushOne(opts, url, job, grouping, g); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", url, err))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	if len(targets) == 1 {
+		return errors.Unwrap(errs[0])
+	}
+	if opts.Quorum == QuorumAny && len(errs) < len(targets) {
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "warning: metrics push failed: %v\n", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("pushed to %d of %d gateways: %w", len(targets)-len(errs), len(targets), errors.Join(errs...))
+}
+
+// pushOne pushes to a single gateway, retrying and spooling with opts.Dir.
+func pushOne(opts *Options, url, job string, grouping Grouping, g prometheus.Gatherer) error {
+	pusher := newPusher(url, job, grouping, g)
+	if opts.Dir == "" {
+		return pusher.Push()
+	}
+	err := pusher.Push()
+	for i, delay := 1, retryDelay; err != nil && i < attempts; i, delay = i+1, delay*2 {
+		time.Sleep(delay)
+		err = pusher.Push()
+	}
+	if err == nil {
+		return nil
+	}
+	path, spoolErr := spool(opts.Dir, url, job, grouping, g)
+	if spoolErr != nil {
+		return fmt.Errorf("%w (spooling failed: %v)", err, spoolErr)
+	}
+	fmt.Fprintf(os.Stderr, "warning: metrics push failed after %d attempts, spooled to %s: %v\n", attempts, path, err)
+	return nil
+}
+
+func newPusher(url, job string, grouping Grouping, g prometheus.Gatherer) *push.Pusher {
+	pusher := push.New(url, job).Gatherer(g)
+	names := make([]string, 0, len(grouping))
+	for name := range grouping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pusher = pusher.Grouping(name, grouping[name])
+	}
+	return pusher
+}
+
+// spool writes the gathered metrics to a new file in dir and returns its
+// path.
+func spool(dir, gateway, job string, grouping Grouping, g prometheus.Gatherer) (string, error) {
+	families, err := g.Gather()
+	if err != nil {
+		return "", err
+	}
+	var text bytes.Buffer
+	enc := expfmt.NewEncoder(&text, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, family := range families {
+		if err := enc.Encode(family); err != nil {
+			return "", err
+		}
+	}
+	data, err := json.Marshal(entry{Gateway: gateway, Job: job, Grouping: grouping, CreatedAt: time.Now().UTC(), Metrics: text.String()})
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	f, err := outpath.CreateStamped(dir, filePrefix+sanitize(job)+"-", outpath.StampLayout, fileExt, time.Now())
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if syncErr := f.Sync(); syncErr != nil && err == nil {
+		err = syncErr
+	}
+	if closeErr := f.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// sanitize keeps job usable in a file name.
+func sanitize(job string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, job)
+}
+
+// Flush pushes the spooled pushes in opts.Dir to the gateways listed in
+// urls, oldest first, removing each once it is pushed, and returns how many
+// were pushed. A push spooled for a gateway not in urls is left alone. At
+// the first push to a gateway that fails, the rest for that gateway are
+// kept for next time.
+func Flush(opts *Options, urls string) (int, error) {
+	paths, err := filepath.Glob(filepath.Join(opts.Dir, filePrefix+"*"+fileExt))
+	if err != nil {
+		return 0, err
+	}
+	// Names start with the job, so order by the time they were written.
+	type spooled struct {
+		path  string
+		entry entry
+	}
+	var pending []spooled
+	for _, path := range paths {
+		e, err := readEntry(path)
+		if errors.Is(err, os.ErrNotExist) {
+			// Replayed by a concurrent run.
+			continue
+		}
+		if err != nil {
+			if info, statErr := os.Stat(path); statErr == nil && time.Since(info.ModTime()) < settleTime {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "warning: removing unreadable spooled metrics %s: %v\n", path, err)
+			os.Remove(path)
+			continue
+		}
+		if opts.Retention > 0 && time.Since(e.CreatedAt) > opts.Retention {
+			fmt.Fprintf(os.Stderr, "warning: dropping spooled %s metrics from %s, older than -push-spool-retention %s\n", e.Job, e.CreatedAt.Format(time.RFC3339), opts.Retention)
+			os.Remove(path)
+			continue
+		}
+		pending = append(pending, spooled{path, e})
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		if !pending[i].entry.CreatedAt.Equal(pending[j].entry.CreatedAt) {
+			return pending[i].entry.CreatedAt.Before(pending[j].entry.CreatedAt)
+		}
+		return pending[i].path < pending[j].path
+	})
+
+	targets := URLs(urls)
+	failed := map[string]bool{}
+	var errs []error
+	pushed := 0
+	for _, p := range pending {
+		families, err := parseMetrics(p.entry.Metrics)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: removing unreadable spooled metrics %s: %v\n", p.path, err)
+			os.Remove(p.path)
+			continue
+		}
+		gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return families, nil })
+		gateways := targets
+		if p.entry.Gateway != "" {
+			if !slices.Contains(targets, p.entry.Gateway) {
+				continue
+			}
+			gateways = []string{p.entry.Gateway}
+		}
+		done := true
+		for _, url := range gateways {
+			if failed[url] {
+				done = false
+				continue
+			}
+			if err := newPusher(url, p.entry.Job, p.entry.Grouping, gatherer).Push(); err != nil {
+				failed[url] = true
+				errs = append(errs, fmt.Errorf("%s: %s: %w", p.path, url, err))
+				done = false
+			}
+		}
+		if !done {
+			continue
+		}
+		if err := os.Remove(p.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return pushed, err
+		}
+		pushed++
+	}
+	return pushed, errors.Join(errs...)
+}
+
+func readEntry(path string) (entry, error) {
+	var e entry
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return e, err
+	}
+	if err := json.Unmarshal(data, &e); err != nil {
+		return e, err
+	}
+	if e.Job == "" || e.CreatedAt.IsZero() {
+		return e, errors.New("missing job or timestamp")
+	}
+	return e, nil
+}
+
+func parseMetrics(text string) ([]*dto.MetricFamily, error) {
+	dec := expfmt.NewDecoder(strings.NewReader(text), expfmt.NewFormat(expfmt.TypeTextPlain))
+	var families []*dto.MetricFamily
+	for {
+		family := &dto.MetricFamily{}
+		err := dec.Decode(family)
+		if errors.Is(err, io.EOF) {
+			return families, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		families = append(families, family)
+	}
+}
@@ -0,0 +1,200 @@
+package pushspool
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gateway is a fake Pushgateway that records the pushes it accepts, or
+// answers every push with 500 when down.
+type gateway struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	down   bool
+	pushes []request
+}
+
+type request struct {
+	Path string
+	Body string
+}
+
+func newGateway(t *testing.T, down bool) *gateway {
+	t.Helper()
+	g := &gateway{down: down}
+	g.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.down {
+			http.Error(w, "gateway unavailable", http.StatusInternalServerError)
+			return
+		}
+		g.pushes = append(g.pushes, request{r.URL.Path, string(body)})
+	}))
+	t.Cleanup(g.Close)
+	return g
+}
+
+func (g *gateway) setDown(down bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.down = down
+}
+
+func (g *gateway) received() []request {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]request(nil), g.pushes...)
+}
+
+func registry(t *testing.T) *prometheus.Registry {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	files := prometheus.NewGauge(prometheus.GaugeOpts{Name: "compress_files_total", Help: "Files compressed."})
+	files.Set(12)
+	reg.MustRegister(files)
+	return reg
+}
+
+func TestPushQuorum(t *testing.T) {
+	tests := []struct {
+		name    string
+		quorum  string
+		down    []bool
+		wantErr string
+	}{
+		{"all reached", QuorumAll, []bool{false, false}, ""},
+		{"all with one down", QuorumAll, []bool{false, true}, "pushed to 1 of 2 gateways"},
+		{"any with one down", QuorumAny, []bool{true, false}, ""},
+		{"any with both down", QuorumAny, []bool{true, true}, "pushed to 0 of 2 gateways"},
+		{"single gateway down", QuorumAny, []bool{true}, "500"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gateways []*gateway
+			var urls []string
+			for _, down := range tt.down {
+				g := newGateway(t, down)
+				gateways = append(gateways, g)
+				urls = append(urls, g.URL)
+			}
+			err := Push(&Options{Quorum: tt.quorum}, strings.Join(urls, ", "), "compress", Grouping{"instance": "batch-1"}, registry(t))
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Push: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Push: got error %v, want one containing %q", err, tt.wantErr)
+			}
+			for i, g := range gateways {
+				pushes := g.received()
+				if tt.down[i] {
+					if len(pushes) != 0 {
+						t.Errorf("gateway %d is down but recorded %d pushes", i, len(pushes))
+					}
+					continue
+				}
+				if len(pushes) != 1 {
+					t.Fatalf("gateway %d: got %d pushes, want 1", i, len(pushes))
+				}
+				if want := "/metrics/job/compress/instance/batch-1"; pushes[0].Path != want {
+					t.Errorf("gateway %d: pushed to %s, want %s", i, pushes[0].Path, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPushNamespace(t *testing.T) {
+	g := newGateway(t, false)
+	opts := &Options{Job: "team-a", Prefix: "teama_", Labels: Grouping{"team": "search"}}
+	if err := Push(opts, g.URL, "compress", Grouping{"instance": "batch-1"}, registry(t)); err != nil {
+		t.Fatal(err)
+	}
+	pushes := g.received()
+	if len(pushes) != 1 {
+		t.Fatalf("got %d pushes, want 1", len(pushes))
+	}
+	path := pushes[0].Path
+	if !strings.HasPrefix(path, "/metrics/job/team-a/") || !strings.Contains(path, "/instance/batch-1") || !strings.Contains(path, "/team/search") {
+		t.Errorf("pushed to %s, want job team-a grouped by instance and team", path)
+	}
+	if !strings.Contains(pushes[0].Body, "teama_compress_files_total") {
+		t.Errorf("pushed metrics lack the prefix:\n%s", pushes[0].Body)
+	}
+
+	opts.Labels = Grouping{"instance": "other"}
+	if err := Push(opts, g.URL, "compress", Grouping{"instance": "batch-1"}, registry(t)); err == nil {
+		t.Error("a -metrics-label replaced the instance grouping label")
+	}
+}
+
+func TestFlushReplaysToTheFailedGateway(t *testing.T) {
+	dir := t.TempDir()
+	up, down := newGateway(t, false), newGateway(t, true)
+	if _, err := spool(dir, down.URL, "compress", Grouping{"instance": "batch-1"}, registry(t)); err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{Dir: dir}
+	urls := up.URL + "," + down.URL
+
+	if pushed, err := Flush(opts, urls); pushed != 0 || err == nil {
+		t.Fatalf("Flush with the gateway still down: pushed %d, err %v", pushed, err)
+	}
+	if len(up.received()) != 0 {
+		t.Fatal("a push spooled for one gateway was replayed to another")
+	}
+
+	down.setDown(false)
+	if pushed, err := Flush(opts, urls); pushed != 1 || err != nil {
+		t.Fatalf("Flush: pushed %d, err %v", pushed, err)
+	}
+	if got := down.received(); len(got) != 1 || !strings.Contains(got[0].Body, "compress_files_total") {
+		t.Fatalf("gateway got %v", got)
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "*")); len(left) != 0 {
+		t.Errorf("spool files left after replay: %v", left)
+	}
+}
+
+func TestFlushDropsExpiredAndUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	g := newGateway(t, false)
+	path, err := spool(dir, g.URL, "compress", Grouping{}, registry(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := `{"job":"compress","grouping":{},"created_at":"2000-01-01T00:00:00Z","metrics":""}`
+	if err := os.WriteFile(filepath.Join(dir, "push-old.json"), []byte(old), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	broken := filepath.Join(dir, "push-broken.json")
+	if err := os.WriteFile(broken, []byte(`{"job":`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	pushed, err := Flush(&Options{Dir: dir, Retention: 24 * time.Hour}, g.URL)
+	if pushed != 1 || err != nil {
+		t.Fatalf("Flush: pushed %d, err %v", pushed, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("replayed spool file was kept")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "push-old.json")); !os.IsNotExist(err) {
+		t.Error("expired spool file was kept")
+	}
+	// Just written, so it may still be in progress.
+	if _, err := os.Stat(broken); err != nil {
+		t.Error("unreadable spool file younger than the settle time was removed")
+	}
+}
@@ -0,0 +1,130 @@
+// Package report defines the JSON run report written by cmd/compress and
+// read by cmd/report. Readers ignore unknown fields, so reports from newer
+// or older tool versions can be compared.
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Run describes one compression or decompression run. For decompress
+// reports, InputBytes are compressed and OutputBytes decoded, and Shards is
+// the -shard count when outputs were spread over shard directories.
+type Run struct {
+	Tool      string  `json:"tool"`
+	CreatedAt string  `json:"created_at"`
+	RunID     string  `json:"run_id,omitempty"`
+	InputDir  string  `json:"input_dir"`
+	OutputDir string  `json:"output_dir"`
+	Level     int     `json:"level"`
+	Dict      string  `json:"dict,omitempty"`
+	DictID    uint32  `json:"dict_id,omitempty"`
+	Shards    int     `json:"shards,omitempty"`
+	Totals    Totals  `json:"totals"`
+	Groups    []Group `json:"groups,omitempty"`
+	Files     []File  `json:"files"`
+
+	// Encoder names the library encoder Level ran, and RequestedLevel is
+	// set when compress -level-fallback compressed at a lower level.
+	Encoder        string `json:"encoder,omitempty"`
+	RequestedLevel int    `json:"requested_level,omitempty"`
+
+	// PriorityTiers is set by compress -priority, in dispatch order.
+	PriorityTiers []PriorityTier `json:"priority_tiers,omitempty"`
+}
+
+// PriorityTier is how far a compress -priority run got through one tier of
+// files: complete, partial or not started.
+type PriorityTier struct {
+	Name      string `json:"name"`
+	Files     int    `json:"files"`
+	Processed int    `json:"processed"`
+	Status    string `json:"status"`
+}
+
+// Group aggregates the files under one directory prefix of the input tree.
+type Group struct {
+	Name        string  `json:"name"`
+	Files       int     `json:"files"`
+	InputBytes  int64   `json:"input_bytes"`
+	OutputBytes int64   `json:"output_bytes"`
+	Ratio       float64 `json:"ratio"`
+}
+
+// Totals aggregates the files of a run.
+type Totals struct {
+	Files       int     `json:"files"`
+	InputBytes  int64   `json:"input_bytes"`
+	OutputBytes int64   `json:"output_bytes"`
+	Ratio       float64 `json:"ratio"`
+	Records     int64   `json:"records,omitempty"`
+}
+
+// File is the result for one input file. Path is relative to the run's
+// input directory and is the key used to join two reports.
+type File struct {
+	Path         string  `json:"path"`
+	InputBytes   int64   `json:"input_bytes"`
+	OutputBytes  int64   `json:"output_bytes"`
+	Ratio        float64 `json:"ratio"`
+	DictFallback bool    `json:"dict_fallback,omitempty"`
+	// Unstable is set by compress for a file whose size or modification
+	// time changed while it was compressed.
+	Unstable bool `json:"unstable,omitempty"`
+	// Arm is the dictionary, A or B, compress -dict-a/-dict-b assigned the
+	// file to.
+	Arm string `json:"arm,omitempty"`
+	// Output is the output's path relative to the run's output directory,
+	// set by decompress -shard, which places it under a shard directory.
+	Output string `json:"output,omitempty"`
+	// Records is the number of top-level JSON records, set by
+	// decompress -count-records for files recognized as JSON.
+	Records *int64 `json:"records,omitempty"`
+	// RecordsScanned and RecordsMatched are the records decompress
+	// -record-filter read and wrote for files it filtered.
+	RecordsScanned *int64 `json:"records_scanned,omitempty"`
+	RecordsMatched *int64 `json:"records_matched,omitempty"`
+	// Type is the content type decompress -route-by-type sniffed: json,
+	// ndjson, csv or other.
+	Type string `json:"type,omitempty"`
+}
+
+// Label returns Path as a metric label value, with every '\\' turned into
+// '/' so the same file gets the same series whatever platform wrote it.
+func (f File) Label() string {
+	return strings.ReplaceAll(filepath.ToSlash(f.Path), `\`, "/")
+}
+
+// Ratio returns output/input, or 0 for empty input.
+func Ratio(output, input int64) float64 {
+	if input <= 0 {
+		return 0
+	}
+	return float64(output) / float64(input)
+}
+
+// Write stores run as indented JSON at path.
+func Write(path string, run Run) error {
+	data, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// Read loads a run report from path.
+func Read(path string) (Run, error) {
+	var run Run
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return run, err
+	}
+	if err := json.Unmarshal(data, &run); err != nil {
+		return run, fmt.Errorf("%s: %w", path, err)
+	}
+	return run, nil
+}
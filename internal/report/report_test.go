@@ -0,0 +1,19 @@
+package report
+
+import "testing"
+
+func TestFileLabel(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"a.json", "a.json"},
+		{"d0/e/a.json", "d0/e/a.json"},
+		{`d0\e\a.json`, "d0/e/a.json"},
+		{`d0/e\a.json`, "d0/e/a.json"},
+	}
+	for _, tt := range tests {
+		if got := (File{Path: tt.path}).Label(); got != tt.want {
+			t.Errorf("Label of %q = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
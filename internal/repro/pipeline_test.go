@@ -0,0 +1,109 @@
+package repro
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/pipeline.golden")
+
+const baseTime = "2024-01-01T00:00:00Z"
+
+// TestPipelineGolden runs generate-data, train-dict, compress and decompress
+// with -deterministic and compares the hashes of everything they write with
+// testdata/pipeline.golden. The content of a trained dictionary can differ
+// between runs, as train-dict warns, so compress and decompress use
+// testdata/pinned.zdict, trained once the same way, and of train-dict only
+// the names of its outputs are checked.
+func TestPipelineGolden(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs the commands")
+	}
+	bin := t.TempDir()
+	build := exec.Command("go", "build", "-o", bin,
+		"zstd-learning/cmd/generate-data",
+		"zstd-learning/cmd/train-dict",
+		"zstd-learning/cmd/compress",
+		"zstd-learning/cmd/decompress",
+	)
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+	gateway := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer gateway.Close()
+
+	work := t.TempDir()
+	pinned, err := os.ReadFile(filepath.Join("testdata", "pinned.zdict"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(work, "pinned.zdict"), pinned, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	run := func(tool string, args ...string) {
+		t.Helper()
+		args = append(args, "-deterministic", "-base-time", baseTime, "-pushgateway", gateway.URL, "-quiet")
+		cmd := exec.Command(filepath.Join(bin, tool), args...)
+		cmd.Dir = work
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s %s: %v\n%s", tool, strings.Join(args, " "), err, out)
+		}
+	}
+	run("generate-data", "-type", "movies", "-n", "200", "-seed", "7", "-out", "data/movies")
+	run("generate-data", "-type", "people", "-n", "200", "-seed", "7", "-out", "data/people")
+	run("train-dict", "-in", "data", "-split", "json", "-dict-id", "4242", "-dict-size", "4096", "-out", "dict-out")
+	run("compress", "-in", "data", "-out", "compressed", "-report", "compress.json")
+	run("compress", "-in", "data", "-out", "compressed-dict", "-use-dict", "-dict", "pinned.zdict", "-level", "19", "-report", "compress-dict.json")
+	run("decompress", "-in", "compressed-dict", "-out", "decompressed", "-use-dict", "-dict", "pinned.zdict")
+
+	var got strings.Builder
+	err = filepath.WalkDir(work, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(work, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if strings.HasPrefix(rel, "dict-out/") {
+			fmt.Fprintf(&got, "%s\n", rel)
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		fmt.Fprintf(&got, "%s  %s\n", hex.EncodeToString(sum[:]), rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden := filepath.Join("testdata", "pipeline.golden")
+	if *update {
+		if err := os.WriteFile(golden, []byte(got.String()), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != string(want) {
+		t.Errorf("outputs differ from %s (rerun with -update after an intended change):\ngot:\n%swant:\n%s", golden, got.String(), want)
+	}
+}
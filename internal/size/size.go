@@ -0,0 +1,77 @@
+// Package size parses and formats human-readable byte sizes.
+//
+// Decimal suffixes (KB, MB, GB, TB) are powers of 1000, binary suffixes (KiB,
+// MiB, GiB, TiB) and bare letters (K, M, G, T) are powers of 1024. Matching is
+// case-insensitive and a number without suffix is a plain byte count.
+package size
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var multipliers = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1e3,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1e6,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1e9,
+	"gib": 1 << 30,
+	"t":   1 << 40,
+	"tb":  1e12,
+	"tib": 1 << 40,
+}
+
+// Parse converts values such as "512", "64KiB", "1.5GB" or "10M" to bytes.
+func Parse(value string) (int64, error) {
+	text := strings.TrimSpace(value)
+	if text == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	split := len(text)
+	for i, r := range text {
+		if (r < '0' || r > '9') && r != '.' {
+			split = i
+			break
+		}
+	}
+	number, suffix := text[:split], strings.ToLower(strings.TrimSpace(text[split:]))
+
+	multiplier, ok := multipliers[suffix]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q", value, suffix)
+	}
+	amount, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	bytes := amount * multiplier
+	if bytes > math.MaxInt64 {
+		return 0, fmt.Errorf("size %q is too large", value)
+	}
+	return int64(bytes), nil
+}
+
+// Format renders bytes with binary units, e.g. "11.8 MiB".
+func Format(bytes int64) string {
+	const unit = 1024
+	if bytes < unit && bytes > -unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	value := float64(bytes)
+	units := []string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	i := -1
+	for math.Abs(value) >= unit && i < len(units)-1 {
+		value /= unit
+		i++
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + " " + units[i]
+}
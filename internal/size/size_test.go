@@ -0,0 +1,51 @@
+package size
+
+import "testing"
+
+func TestFormat(t *testing.T) {
+	for bytes, want := range map[int64]string{
+		0:          "0 B",
+		1023:       "1023 B",
+		-512:       "-512 B",
+		1024:       "1.0 KiB",
+		1536:       "1.5 KiB",
+		12373196:   "11.8 MiB",
+		5 << 30:    "5.0 GiB",
+		3 << 40:    "3.0 TiB",
+		-(2 << 20): "-2.0 MiB",
+		1<<63 - 1:  "8.0 EiB",
+	} {
+		if got := Format(bytes); got != want {
+			t.Errorf("Format(%d) = %q, want %q", bytes, got, want)
+		}
+	}
+}
+
+func TestFormatIgnoresLocale(t *testing.T) {
+	for _, name := range []string{"LC_ALL", "LC_NUMERIC", "LANG"} {
+		t.Setenv(name, "de_DE.UTF-8")
+	}
+	if got := Format(1536); got != "1.5 KiB" {
+		t.Errorf("Format(1536) = %q under a German locale, want %q", got, "1.5 KiB")
+	}
+}
+
+func TestParse(t *testing.T) {
+	for value, want := range map[string]int64{
+		"512":    512,
+		"64KiB":  64 << 10,
+		"1.5GB":  1500000000,
+		"10M":    10 << 20,
+		" 2 kb ": 2000,
+	} {
+		got, err := Parse(value)
+		if err != nil || got != want {
+			t.Errorf("Parse(%q) = %d, %v; want %d", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "MB", "1.2.3", "5 parsecs", "99999999TiB"} {
+		if _, err := Parse(value); err == nil {
+			t.Errorf("Parse(%q) succeeded", value)
+		}
+	}
+}
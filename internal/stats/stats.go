@@ -0,0 +1,207 @@
+// Package stats holds the counters every tool keeps about a run: files
+// processed, skipped and failed, bytes in and out, how long it took, and
+// the same per group of files. compress and decompress embed RunStats in
+// their run statistics and train-dict in its sample statistics, adding the
+// counters only they keep.
+//
+// A RunStats is not safe for concurrent use. The commands' workers send
+// their results to the one goroutine that counts them; Merge is for
+// callers that keep a RunStats per worker or per run and combine them.
+package stats
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"zstd-learning/internal/report"
+)
+
+// RunStats are the counters of one run. For decompress, InputBytes are
+// compressed and OutputBytes decoded; train-dict counts the files it read
+// as processed and the sample bytes it kept as input.
+type RunStats struct {
+	FilesProcessed int
+	FilesSkipped   int
+	FilesFailed    int
+	InputBytes     int64
+	OutputBytes    int64
+	Duration       time.Duration
+	// Groups holds the same counters per group, such as compress
+	// -group-depth directories; nil when the run does not group files.
+	Groups map[string]Group
+}
+
+// Group is the counters of one group of a run.
+type Group struct {
+	Files       int   `json:"files"`
+	InputBytes  int64 `json:"input_bytes"`
+	OutputBytes int64 `json:"output_bytes"`
+}
+
+// Add counts one processed file.
+func (s *RunStats) Add(input, output int64) {
+	s.FilesProcessed++
+	s.InputBytes += input
+	s.OutputBytes += output
+}
+
+// AddGroup counts one file in group name, creating it on first use. It
+// does not count the file in the run's totals; Add does.
+func (s *RunStats) AddGroup(name string, input, output int64) {
+	if s.Groups == nil {
+		s.Groups = map[string]Group{}
+	}
+	g := s.Groups[name]
+	g.Files++
+	g.InputBytes += input
+	g.OutputBytes += output
+	s.Groups[name] = g
+}
+
+// Merge adds the counters of other to s. Durations are not summed: workers
+// run side by side, so the run took as long as the longest of them.
+func (s *RunStats) Merge(other RunStats) {
+	s.FilesProcessed += other.FilesProcessed
+	s.FilesSkipped += other.FilesSkipped
+	s.FilesFailed += other.FilesFailed
+	s.InputBytes += other.InputBytes
+	s.OutputBytes += other.OutputBytes
+	s.Duration = max(s.Duration, other.Duration)
+	for name, g := range other.Groups {
+		if s.Groups == nil {
+			s.Groups = map[string]Group{}
+		}
+		mine := s.Groups[name]
+		mine.Files += g.Files
+		mine.InputBytes += g.InputBytes
+		mine.OutputBytes += g.OutputBytes
+		s.Groups[name] = mine
+	}
+}
+
+// Ratio is OutputBytes over InputBytes, 0 without input.
+func (s RunStats) Ratio() float64 {
+	return report.Ratio(s.OutputBytes, s.InputBytes)
+}
+
+// Totals returns the counters as the totals of a run report.
+func (s RunStats) Totals() report.Totals {
+	return report.Totals{
+		Files:       s.FilesProcessed,
+		InputBytes:  s.InputBytes,
+		OutputBytes: s.OutputBytes,
+		Ratio:       s.Ratio(),
+	}
+}
+
+// GroupList returns the groups as report groups, largest output first and
+// by name among equals.
+func (s RunStats) GroupList() []report.Group {
+	groups := make([]report.Group, 0, len(s.Groups))
+	for name, g := range s.Groups {
+		groups = append(groups, report.Group{
+			Name:        name,
+			Files:       g.Files,
+			InputBytes:  g.InputBytes,
+			OutputBytes: g.OutputBytes,
+			Ratio:       report.Ratio(g.OutputBytes, g.InputBytes),
+		})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].OutputBytes != groups[j].OutputBytes {
+			return groups[i].OutputBytes > groups[j].OutputBytes
+		}
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
+
+// runStatsJSON is the JSON form of RunStats. Ratio is derived and ignored
+// when reading.
+type runStatsJSON struct {
+	FilesProcessed  int              `json:"files_processed"`
+	FilesSkipped    int              `json:"files_skipped"`
+	FilesFailed     int              `json:"files_failed"`
+	InputBytes      int64            `json:"input_bytes"`
+	OutputBytes     int64            `json:"output_bytes"`
+	Ratio           float64          `json:"ratio"`
+	DurationSeconds float64          `json:"duration_seconds"`
+	Groups          map[string]Group `json:"groups,omitempty"`
+}
+
+// MarshalJSON writes the counters with snake_case names, the duration in
+// seconds and the ratio, like the run reports.
+func (s RunStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(runStatsJSON{
+		FilesProcessed:  s.FilesProcessed,
+		FilesSkipped:    s.FilesSkipped,
+		FilesFailed:     s.FilesFailed,
+		InputBytes:      s.InputBytes,
+		OutputBytes:     s.OutputBytes,
+		Ratio:           s.Ratio(),
+		DurationSeconds: s.Duration.Seconds(),
+		Groups:          s.Groups,
+	})
+}
+
+// UnmarshalJSON reads what MarshalJSON writes.
+func (s *RunStats) UnmarshalJSON(data []byte) error {
+	var v runStatsJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*s = RunStats{
+		FilesProcessed: v.FilesProcessed,
+		FilesSkipped:   v.FilesSkipped,
+		FilesFailed:    v.FilesFailed,
+		InputBytes:     v.InputBytes,
+		OutputBytes:    v.OutputBytes,
+		Duration:       time.Duration(v.DurationSeconds * float64(time.Second)),
+		Groups:         v.Groups,
+	}
+	return nil
+}
+
+// Gauges maps metric names to gauge values.
+type Gauges map[string]float64
+
+// Gauges returns the counters as gauge values keyed by metric name, each
+// name prefix followed by _files_processed, _files_skipped, _files_failed,
+// _input_bytes, _output_bytes, _ratio and _duration_seconds.
+func (s RunStats) Gauges(prefix string) Gauges {
+	gauges := Gauges{
+		prefix + "_files_processed":  float64(s.FilesProcessed),
+		prefix + "_files_skipped":    float64(s.FilesSkipped),
+		prefix + "_files_failed":     float64(s.FilesFailed),
+		prefix + "_input_bytes":      float64(s.InputBytes),
+		prefix + "_output_bytes":     float64(s.OutputBytes),
+		prefix + "_ratio":            s.Ratio(),
+		prefix + "_duration_seconds": s.Duration.Seconds(),
+	}
+	return gauges
+}
+
+// Collectors turns the gauges into set prometheus gauges ready to
+// register, in name order. help gives each its help text; a name without
+// one is its own help.
+func (gauges Gauges) Collectors(help map[string]string) []prometheus.Collector {
+	names := make([]string, 0, len(gauges))
+	for name := range gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	collectors := make([]prometheus.Collector, 0, len(names))
+	for _, name := range names {
+		text := help[name]
+		if text == "" {
+			text = name
+		}
+		gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: name, Help: text})
+		gauge.Set(gauges[name])
+		collectors = append(collectors, gauge)
+	}
+	return collectors
+}
@@ -0,0 +1,123 @@
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMergeConcurrentWorkers(t *testing.T) {
+	const workers, files = 8, 500
+	results := make(chan RunStats)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var s RunStats
+			for i := 0; i < files; i++ {
+				s.Add(100, 10)
+				s.AddGroup(fmt.Sprintf("group-%d", i%3), 100, 10)
+			}
+			s.FilesSkipped = 1
+			s.FilesFailed = w % 2
+			s.Duration = time.Duration(w+1) * time.Second
+			results <- s
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var total RunStats
+	for s := range results {
+		total.Merge(s)
+	}
+	want := RunStats{
+		FilesProcessed: workers * files,
+		FilesSkipped:   workers,
+		FilesFailed:    workers / 2,
+		InputBytes:     workers * files * 100,
+		OutputBytes:    workers * files * 10,
+		Duration:       workers * time.Second,
+		Groups: map[string]Group{
+			"group-0": {Files: workers * 167, InputBytes: workers * 167 * 100, OutputBytes: workers * 167 * 10},
+			"group-1": {Files: workers * 167, InputBytes: workers * 167 * 100, OutputBytes: workers * 167 * 10},
+			"group-2": {Files: workers * 166, InputBytes: workers * 166 * 100, OutputBytes: workers * 166 * 10},
+		},
+	}
+	if !reflect.DeepEqual(total, want) {
+		t.Errorf("merged\n%+v\nwant\n%+v", total, want)
+	}
+}
+
+func TestMergeKeepsOtherGroupsApart(t *testing.T) {
+	var a, b RunStats
+	a.AddGroup("x", 1, 1)
+	b.AddGroup("y", 2, 2)
+	a.Merge(b)
+	b.AddGroup("y", 2, 2)
+	if a.Groups["y"].Files != 1 {
+		t.Error("Merge shares the groups map of the merged stats")
+	}
+	var empty RunStats
+	empty.Merge(RunStats{})
+	if empty.Groups != nil {
+		t.Error("merging stats without groups created a groups map")
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	for _, s := range []RunStats{
+		{},
+		{FilesProcessed: 3, FilesSkipped: 1, FilesFailed: 2, InputBytes: 3000, OutputBytes: 750, Duration: 1500 * time.Millisecond},
+		{FilesProcessed: 1, InputBytes: 10, OutputBytes: 4, Groups: map[string]Group{"logs/2024": {Files: 1, InputBytes: 10, OutputBytes: 4}}},
+	} {
+		data, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got RunStats
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, s) {
+			t.Errorf("%s read back as %+v, want %+v", data, got, s)
+		}
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	s := RunStats{FilesProcessed: 2, InputBytes: 400, OutputBytes: 100, Duration: 2 * time.Second}
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"files_processed":2,"files_skipped":0,"files_failed":0,"input_bytes":400,"output_bytes":100,"ratio":0.25,"duration_seconds":2}`
+	if string(data) != want {
+		t.Errorf("got %s\nwant %s", data, want)
+	}
+}
+
+func TestGauges(t *testing.T) {
+	s := RunStats{FilesProcessed: 4, FilesFailed: 1, InputBytes: 200, OutputBytes: 50, Duration: time.Second}
+	want := Gauges{
+		"compress_files_processed":  4,
+		"compress_files_skipped":    0,
+		"compress_files_failed":     1,
+		"compress_input_bytes":      200,
+		"compress_output_bytes":     50,
+		"compress_ratio":            0.25,
+		"compress_duration_seconds": 1,
+	}
+	if got := s.Gauges("compress"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if n := len(want.Collectors(nil)); n != len(want) {
+		t.Errorf("got %d collectors for %d gauges", n, len(want))
+	}
+}
@@ -0,0 +1,139 @@
+// Package summary renders the end-of-run summary line shared by the tools,
+// either as text for people ("11.8 MiB -> 2.2 MiB, ratio 0.190, 184.0 MiB/s,
+// 3.2s") or as JSON with the raw numbers for scripts. Numbers are formatted
+// with strconv and internal/size, never through the locale, so the output
+// is the same on every machine.
+package summary
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"zstd-learning/internal/console"
+	"zstd-learning/internal/size"
+)
+
+// Format selects how a summary is printed.
+type Format string
+
+const (
+	Text Format = "text"
+	JSON Format = "json"
+)
+
+// ParseFormat validates a -summary-format value.
+func ParseFormat(value string) (Format, error) {
+	switch Format(strings.ToLower(strings.TrimSpace(value))) {
+	case Text:
+		return Text, nil
+	case JSON:
+		return JSON, nil
+	}
+	return "", fmt.Errorf("invalid -summary-format %q (expected text or json)", value)
+}
+
+// Outputs returns where a command prints besides its summary. Notes go to
+// stdout, or to stderr with JSON so that stdout holds only the JSON
+// summary, and are dropped with quiet; warnings go to stdout, or to stderr
+// with JSON or quiet, so quiet never hides them.
+func Outputs(format Format, quiet bool) (notes, warnings io.Writer) {
+	switch {
+	case quiet:
+		return io.Discard, os.Stderr
+	case format == JSON:
+		return os.Stderr, os.Stderr
+	}
+	return os.Stdout, os.Stdout
+}
+
+// manyFiles is the file count from which the text summary also reports
+// files per second, the rate that matters for runs of many small files.
+const manyFiles = 100
+
+// Summary holds the totals of one run. Ratio is compressed/uncompressed and
+// is left out when zero; BytesPerSecond is measured on the uncompressed
+// side, the size users reason about.
+type Summary struct {
+	Action          string  `json:"action"`
+	Files           int     `json:"files"`
+	InputBytes      int64   `json:"input_bytes"`
+	OutputBytes     int64   `json:"output_bytes"`
+	Ratio           float64 `json:"ratio,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	BytesPerSecond  float64 `json:"bytes_per_second"`
+	FilesPerSecond  float64 `json:"files_per_second"`
+	Destination     string  `json:"destination,omitempty"`
+	// Level is the zstd level compress ran at, after any -level-fallback;
+	// 0, the default level, is left out.
+	Level int `json:"level,omitempty"`
+	// KeyOrder is the generate-data -key-order mode.
+	KeyOrder string `json:"key_order,omitempty"`
+	// Compressibility is the generate-data -report-compressibility ratio.
+	Compressibility float64 `json:"compressibility,omitempty"`
+}
+
+// New returns the summary of a run that read inputBytes and wrote
+// outputBytes, uncompressed of which were the uncompressed data.
+func New(action string, files int, inputBytes, outputBytes, uncompressed int64, duration time.Duration) Summary {
+	s := Summary{
+		Action:          action,
+		Files:           files,
+		InputBytes:      inputBytes,
+		OutputBytes:     outputBytes,
+		DurationSeconds: duration.Seconds(),
+	}
+	if seconds := duration.Seconds(); seconds > 0 {
+		s.BytesPerSecond = float64(uncompressed) / seconds
+		s.FilesPerSecond = float64(files) / seconds
+	}
+	return s
+}
+
+// Details renders the sizes, ratio, throughput and duration, e.g.
+// "11.8 MiB -> 2.2 MiB, ratio 0.190, 184.0 MiB/s, 3.2s". Runs without input
+// bytes show only the output size.
+func (s Summary) Details(p console.Printer) string {
+	parts := []string{size.Format(s.OutputBytes)}
+	if s.InputBytes > 0 {
+		parts[0] = size.Format(s.InputBytes) + " -> " + parts[0]
+	}
+	if s.Ratio > 0 {
+		parts = append(parts, "ratio "+p.Ratio(s.Ratio))
+	}
+	if s.BytesPerSecond > 0 {
+		parts = append(parts, size.Format(int64(s.BytesPerSecond))+"/s")
+	}
+	parts = append(parts, FormatDuration(time.Duration(s.DurationSeconds*float64(time.Second))))
+	if s.Files >= manyFiles && s.FilesPerSecond > 0 {
+		parts = append(parts, strconv.FormatFloat(s.FilesPerSecond, 'f', 0, 64)+" files/s")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// WriteJSON writes s to w as one line of JSON.
+func (s Summary) WriteJSON(w io.Writer) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// FormatDuration renders d compactly: "<1ms", "350ms", "3.2s", or "2m5s".
+func FormatDuration(d time.Duration) string {
+	switch {
+	case d < time.Millisecond:
+		return "<1ms"
+	case d < time.Second:
+		return strconv.FormatInt(d.Milliseconds(), 10) + "ms"
+	case d < time.Minute:
+		return strconv.FormatFloat(d.Seconds(), 'f', 1, 64) + "s"
+	}
+	return d.Round(time.Second).String()
+}
@@ -0,0 +1,128 @@
+package summary
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"zstd-learning/internal/console"
+)
+
+func TestParseFormat(t *testing.T) {
+	for value, want := range map[string]Format{"text": Text, " JSON ": JSON, "Json": JSON} {
+		got, err := ParseFormat(value)
+		if err != nil || got != want {
+			t.Errorf("ParseFormat(%q) = %q, %v; want %q", value, got, err, want)
+		}
+	}
+	if _, err := ParseFormat("yaml"); err == nil {
+		t.Error("ParseFormat accepted yaml")
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		0:                             "<1ms",
+		999 * time.Microsecond:        "<1ms",
+		350 * time.Millisecond:        "350ms",
+		3200 * time.Millisecond:       "3.2s",
+		59949 * time.Millisecond:      "59.9s",
+		2*time.Minute + 5*time.Second: "2m5s",
+		time.Hour + 2*time.Minute + 499*time.Millisecond: "1h2m0s",
+	} {
+		if got := FormatDuration(d); got != want {
+			t.Errorf("FormatDuration(%s) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+func TestDetails(t *testing.T) {
+	var plain console.Printer
+	tests := []struct {
+		name string
+		sum  Summary
+		want string
+	}{
+		{
+			name: "compress",
+			sum:  withRatio(New("compress", 12, 12373196, 2306867, 12373196, 3200*time.Millisecond), 0.186),
+			want: "11.8 MiB -> 2.2 MiB, ratio 0.186, 3.7 MiB/s, 3.2s",
+		},
+		{
+			name: "many files",
+			sum:  New("decompress", 400, 2048, 8192, 8192, 2*time.Second),
+			want: "2.0 KiB -> 8.0 KiB, 4.0 KiB/s, 2.0s, 200 files/s",
+		},
+		{
+			name: "no input",
+			sum:  New("generate-data", 3, 0, 900, 900, 0),
+			want: "900 B, <1ms",
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.sum.Details(plain); got != tt.want {
+			t.Errorf("%s: Details() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func withRatio(s Summary, ratio float64) Summary {
+	s.Ratio = ratio
+	return s
+}
+
+func TestWriteJSONKeepsRawNumbers(t *testing.T) {
+	sum := New("compress", 2, 3000, 1000, 3000, 1500*time.Millisecond)
+	sum.Ratio = 1.0 / 3
+	var buf bytes.Buffer
+	if err := sum.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("}\n")) || bytes.Count(buf.Bytes(), []byte("\n")) != 1 {
+		t.Fatalf("WriteJSON wrote %q, want one line", buf.String())
+	}
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"action":           "compress",
+		"files":            2.0,
+		"input_bytes":      3000.0,
+		"output_bytes":     1000.0,
+		"ratio":            1.0 / 3,
+		"duration_seconds": 1.5,
+		"bytes_per_second": 2000.0,
+		"files_per_second": 2.0 / 1.5,
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %v, want %v", key, got[key], value)
+		}
+	}
+	if _, ok := got["level"]; ok {
+		t.Error("level 0 was written")
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	tests := []struct {
+		format          Format
+		quiet           bool
+		notes, warnings io.Writer
+	}{
+		{Text, false, os.Stdout, os.Stdout},
+		{JSON, false, os.Stderr, os.Stderr},
+		{Text, true, io.Discard, os.Stderr},
+		{JSON, true, io.Discard, os.Stderr},
+	}
+	for _, tt := range tests {
+		notes, warnings := Outputs(tt.format, tt.quiet)
+		if notes != tt.notes || warnings != tt.warnings {
+			t.Errorf("Outputs(%s, quiet %v) sends notes to %v and warnings to %v", tt.format, tt.quiet, notes, warnings)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package synth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// KeyOrder is the -key-order mode: the order in which record fields are
+// written. Struct order is the same for every record, which flatters
+// dictionaries; the other modes show how much of their gain depends on it.
+type KeyOrder int
+
+const (
+	KeyOrderStruct KeyOrder = iota
+	KeyOrderSorted
+	KeyOrderShuffled
+)
+
+// ParseKeyOrder parses a -key-order value.
+func ParseKeyOrder(s string) (KeyOrder, error) {
+	switch s {
+	case "struct":
+		return KeyOrderStruct, nil
+	case "sorted":
+		return KeyOrderSorted, nil
+	case "shuffled":
+		return KeyOrderShuffled, nil
+	}
+	return 0, fmt.Errorf("unknown -key-order %q (expected struct, sorted or shuffled)", s)
+}
+
+func (o KeyOrder) String() string {
+	switch o {
+	case KeyOrderSorted:
+		return "sorted"
+	case KeyOrderShuffled:
+		return "shuffled"
+	}
+	return "struct"
+}
+
+// orderedField is one member of an orderedObject, its value already
+// marshaled.
+type orderedField struct {
+	Key   string
+	Value json.RawMessage
+}
+
+// orderedObject is a JSON object that marshals its fields in slice order.
+type orderedObject []orderedField
+
+func (o orderedObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(field.Key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(field.Value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// toOrdered marshals item, a struct, into an orderedObject with its fields
+// in struct order.
+func toOrdered(item any) (orderedObject, error) {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("%T does not marshal to a JSON object", item)
+	}
+	var fields orderedObject
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		fields = append(fields, orderedField{Key: tok.(string), Value: value})
+	}
+	return fields, nil
+}
+
+// orderKeys returns makeItem wrapped to reorder each record's fields. rng
+// drives only the shuffling, so every mode writes the same records for the
+// same seed.
+func orderKeys(order KeyOrder, rng *rand.Rand, makeItem func(i int) any) func(i int) (any, error) {
+	return func(i int) (any, error) {
+		item := makeItem(i)
+		if order == KeyOrderStruct {
+			return item, nil
+		}
+		fields, err := toOrdered(item)
+		if err != nil {
+			return nil, err
+		}
+		if order == KeyOrderSorted {
+			sort.Slice(fields, func(a, b int) bool { return fields[a].Key < fields[b].Key })
+		} else {
+			rng.Shuffle(len(fields), func(a, b int) { fields[a], fields[b] = fields[b], fields[a] })
+		}
+		return fields, nil
+	}
+}
@@ -0,0 +1,188 @@
+package synth
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+type localePool struct {
+	Name       string
+	FirstNames []string `json:"first_names"`
+	LastNames  []string `json:"last_names"`
+	Cities     []string `json:"cities"`
+	Countries  []string `json:"countries"`
+}
+
+type weightedDomain struct {
+	Domain string
+	Weight int
+}
+
+type peopleGenerator struct {
+	locales     []localePool
+	domains     []weightedDomain
+	totalWeight int
+	seenEmails  map[string]int
+}
+
+func availableLocales() ([]string, error) {
+	entries, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, strings.TrimSuffix(entry.Name(), path.Ext(entry.Name())))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func loadLocale(name string) (localePool, error) {
+	data, err := localeFiles.ReadFile(path.Join("locales", name+".json"))
+	if err != nil {
+		available, _ := availableLocales()
+		return localePool{}, fmt.Errorf("unknown locale %q (available: %s)", name, strings.Join(available, ", "))
+	}
+	pool := localePool{Name: name}
+	if err := json.Unmarshal(data, &pool); err != nil {
+		return localePool{}, fmt.Errorf("locale %s: %w", name, err)
+	}
+	if len(pool.FirstNames) == 0 || len(pool.LastNames) == 0 || len(pool.Cities) == 0 || len(pool.Countries) == 0 {
+		return localePool{}, fmt.Errorf("locale %s: every pool must be non-empty", name)
+	}
+	return pool, nil
+}
+
+// parseEmailDomains parses "example.com:3,mail.test" into domains with
+// weights; a domain without an explicit weight counts as 1.
+func parseEmailDomains(value string) ([]weightedDomain, error) {
+	var domains []weightedDomain
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		domain, weightText, hasWeight := strings.Cut(part, ":")
+		weight := 1
+		if hasWeight {
+			parsed, err := strconv.Atoi(strings.TrimSpace(weightText))
+			if err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("invalid weight in %q: must be a positive integer", part)
+			}
+			weight = parsed
+		}
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" || strings.ContainsAny(domain, "@ ") {
+			return nil, fmt.Errorf("invalid email domain %q", part)
+		}
+		domains = append(domains, weightedDomain{Domain: domain, Weight: weight})
+	}
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("at least one email domain is required")
+	}
+	return domains, nil
+}
+
+func newPeopleGenerator(locales string, emailDomains string) (*peopleGenerator, error) {
+	gen := &peopleGenerator{seenEmails: make(map[string]int)}
+	for _, name := range strings.Split(locales, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		pool, err := loadLocale(name)
+		if err != nil {
+			return nil, err
+		}
+		gen.locales = append(gen.locales, pool)
+	}
+	if len(gen.locales) == 0 {
+		return nil, fmt.Errorf("at least one locale is required")
+	}
+
+	domains, err := parseEmailDomains(emailDomains)
+	if err != nil {
+		return nil, err
+	}
+	gen.domains = domains
+	for _, domain := range domains {
+		gen.totalWeight += domain.Weight
+	}
+	return gen, nil
+}
+
+func (g *peopleGenerator) makePerson(rng *rand.Rand, id int, noise unicodeNoise, clock Clock) Person {
+	locale := g.locales[rng.Intn(len(g.locales))]
+	first := pick(rng, locale.FirstNames)
+	last := pick(rng, locale.LastNames)
+	return Person{
+		ID:        id,
+		FirstName: noise.apply(rng, first),
+		LastName:  noise.apply(rng, last),
+		Email:     g.uniqueEmail(emailLocalPart(first, last), g.pickDomain(rng)),
+		City:      noise.apply(rng, pick(rng, locale.Cities)),
+		Country:   noise.apply(rng, pick(rng, locale.Countries)),
+		Age:       rng.Intn(52) + 18,
+		CreatedAt: clock.At(id),
+	}
+}
+
+func (g *peopleGenerator) pickDomain(rng *rand.Rand) string {
+	n := rng.Intn(g.totalWeight)
+	for _, domain := range g.domains {
+		if n < domain.Weight {
+			return domain.Domain
+		}
+		n -= domain.Weight
+	}
+	return g.domains[len(g.domains)-1].Domain
+}
+
+// uniqueEmail appends a numeric disambiguator to the local part when the
+// address was already handed out in this run.
+func (g *peopleGenerator) uniqueEmail(local, domain string) string {
+	email := local + "@" + domain
+	for {
+		count := g.seenEmails[email]
+		g.seenEmails[email] = count + 1
+		if count == 0 {
+			return email
+		}
+		email = local + strconv.Itoa(count+1) + "@" + domain
+	}
+}
+
+var asciiFold = strings.NewReplacer(
+	"á", "a", "à", "a", "â", "a", "ã", "a", "ä", "a",
+	"é", "e", "è", "e", "ê", "e", "ë", "e",
+	"í", "i", "ì", "i", "î", "i", "ï", "i",
+	"ó", "o", "ò", "o", "ô", "o", "õ", "o", "ö", "o",
+	"ú", "u", "ù", "u", "û", "u", "ü", "u",
+	"ç", "c", "ñ", "n", "ß", "ss",
+)
+
+// emailLocalPart lowercases the name and folds accented letters to ASCII so
+// "João Müller" becomes "joao.muller".
+func emailLocalPart(first, last string) string {
+	fold := func(name string) string {
+		var b strings.Builder
+		for _, r := range asciiFold.Replace(strings.ToLower(name)) {
+			if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+				b.WriteRune(r)
+			}
+		}
+		return b.String()
+	}
+	return fold(first) + "." + fold(last)
+}
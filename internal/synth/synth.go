@@ -0,0 +1,211 @@
+// Package synth generates the synthetic movie, book and people records
+// written by cmd/generate-data and used by train-dict -generate, so both
+// produce the same records for the same seed.
+package synth
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Types lists the record types New accepts.
+var Types = []string{"movies", "books", "people"}
+
+// Formats lists the layouts Write accepts: json is one top-level array with
+// a record per line, ndjson one record per line.
+var Formats = []string{"json", "ndjson"}
+
+type Movie struct {
+	ID        int     `json:"id"`
+	Title     string  `json:"title"`
+	Genre     string  `json:"genre"`
+	Year      int     `json:"year"`
+	Director  string  `json:"director"`
+	Rating    float64 `json:"rating"`
+	Runtime   int     `json:"runtime_minutes"`
+	CreatedAt string  `json:"created_at"`
+}
+
+type Book struct {
+	ID        int     `json:"id"`
+	Title     string  `json:"title"`
+	Author    string  `json:"author"`
+	Genre     string  `json:"genre"`
+	Year      int     `json:"year"`
+	Pages     int     `json:"pages"`
+	Rating    float64 `json:"rating"`
+	CreatedAt string  `json:"created_at"`
+}
+
+type Person struct {
+	ID        int    `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+	City      string `json:"city"`
+	Country   string `json:"country"`
+	Age       int    `json:"age"`
+	CreatedAt string `json:"created_at"`
+}
+
+var (
+	movieTitles = []string{"Silent Horizon", "Crimson Valley", "Echoes of Tomorrow", "Northbound", "Astra Drift", "Blue Lantern", "Midnight Harbor", "Glass River"}
+	movieGenres = []string{"Drama", "Sci-Fi", "Thriller", "Comedy", "Adventure", "Mystery"}
+	directors   = []string{"Avery Quinn", "Morgan Ellis", "Riley Chen", "Harper Singh", "Jordan Blake", "Taylor Reyes"}
+
+	bookTitles = []string{"The Last Orchard", "Paper Cities", "Sparks in Winter", "The River and the Road", "Atlas of Dust", "The Ninth Signal"}
+	bookGenres = []string{"Fantasy", "Historical", "Non-Fiction", "Mystery", "Romance", "Sci-Fi"}
+	authors    = []string{"Samira Holt", "Eli Navarro", "Priya Kapoor", "Luca Moretti", "Noah Sterling", "Yuna Park"}
+)
+
+// Options configures a Generator. Locales and EmailDomains only apply to
+// people.
+type Options struct {
+	Type         string
+	Seed         int64
+	Locales      string
+	EmailDomains string
+	UnicodeRate  float64
+	KeyOrder     KeyOrder
+	Clock        Clock
+}
+
+// Generator produces the records of one type in order, reproducibly for a
+// seed apart from Clock's timestamps.
+type Generator struct {
+	next func(i int) (any, error)
+	i    int
+}
+
+// New returns a Generator for opts.
+func New(opts Options) (*Generator, error) {
+	if opts.UnicodeRate < 0 || opts.UnicodeRate > 1 {
+		return nil, fmt.Errorf("unicode rate %g must be between 0 and 1", opts.UnicodeRate)
+	}
+	rng := rand.New(rand.NewSource(opts.Seed))
+	// Shuffling draws from its own source so the records themselves are the
+	// same whatever the key order.
+	keyRng := rand.New(rand.NewSource(opts.Seed))
+	noise := unicodeNoise{rate: opts.UnicodeRate}
+	clock := opts.Clock
+
+	var makeItem func(i int) any
+	switch opts.Type {
+	case "movies":
+		makeItem = func(i int) any { return makeMovie(rng, i+1, noise, clock) }
+	case "books":
+		makeItem = func(i int) any { return makeBook(rng, i+1, noise, clock) }
+	case "people":
+		people, err := newPeopleGenerator(opts.Locales, opts.EmailDomains)
+		if err != nil {
+			return nil, err
+		}
+		makeItem = func(i int) any { return people.makePerson(rng, i+1, noise, clock) }
+	default:
+		return nil, fmt.Errorf("unknown type: %s (expected %s)", opts.Type, strings.Join(Types, ", "))
+	}
+	return &Generator{next: orderKeys(opts.KeyOrder, keyRng, makeItem)}, nil
+}
+
+// Next returns the next record, ready to be marshaled.
+func (g *Generator) Next() (any, error) {
+	item, err := g.next(g.i)
+	g.i++
+	return item, err
+}
+
+// Write writes the next count records to w in format, one of Formats.
+func (g *Generator) Write(w io.Writer, count int, format string) error {
+	var open, sep, end string
+	switch format {
+	case "json":
+		open, sep, end = "[\n", ",\n", "\n]\n"
+	case "ndjson":
+		sep, end = "\n", "\n"
+	default:
+		return fmt.Errorf("unknown format %q (expected %s)", format, strings.Join(Formats, ", "))
+	}
+
+	writer := bufio.NewWriter(w)
+	if _, err := writer.WriteString(open); err != nil {
+		return err
+	}
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			if _, err := writer.WriteString(sep); err != nil {
+				return err
+			}
+		}
+		item, err := g.Next()
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(data); err != nil {
+			return err
+		}
+	}
+	if count > 0 || format == "json" {
+		if _, err := writer.WriteString(end); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+func makeMovie(rng *rand.Rand, id int, noise unicodeNoise, clock Clock) Movie {
+	return Movie{
+		ID:        id,
+		Title:     noise.apply(rng, pick(rng, movieTitles)),
+		Genre:     noise.apply(rng, pick(rng, movieGenres)),
+		Year:      rng.Intn(45) + 1980,
+		Director:  noise.apply(rng, pick(rng, directors)),
+		Rating:    randFloat(rng, 5.5, 9.8),
+		Runtime:   rng.Intn(81) + 80,
+		CreatedAt: clock.At(id),
+	}
+}
+
+func makeBook(rng *rand.Rand, id int, noise unicodeNoise, clock Clock) Book {
+	return Book{
+		ID:        id,
+		Title:     noise.apply(rng, pick(rng, bookTitles)),
+		Author:    noise.apply(rng, pick(rng, authors)),
+		Genre:     noise.apply(rng, pick(rng, bookGenres)),
+		Year:      rng.Intn(60) + 1965,
+		Pages:     rng.Intn(450) + 150,
+		Rating:    randFloat(rng, 3.5, 5.0),
+		CreatedAt: clock.At(id),
+	}
+}
+
+// Clock produces the created_at values: the current time, or with a Base,
+// Base + id*Step, which makes them reproducible and increasing.
+type Clock struct {
+	Base time.Time
+	Step time.Duration
+}
+
+// At returns the created_at value of record id.
+func (c Clock) At(id int) string {
+	if c.Base.IsZero() {
+		return time.Now().UTC().Format(time.RFC3339)
+	}
+	return c.Base.Add(time.Duration(id) * c.Step).Format(time.RFC3339)
+}
+
+func pick(rng *rand.Rand, items []string) string {
+	return items[rng.Intn(len(items))]
+}
+
+func randFloat(rng *rand.Rand, min, max float64) float64 {
+	return min + rng.Float64()*(max-min)
+}
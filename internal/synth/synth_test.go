@@ -0,0 +1,66 @@
+package synth
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestClockAt(t *testing.T) {
+	clock := Clock{Base: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Step: 90 * time.Second}
+	for id, want := range map[int]string{0: "2024-01-01T00:00:00Z", 1: "2024-01-01T00:01:30Z", 40: "2024-01-01T01:00:00Z"} {
+		if got := clock.At(id); got != want {
+			t.Errorf("At(%d) = %s, want %s", id, got, want)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339, (Clock{}).At(3)); err != nil {
+		t.Errorf("without a base: %v", err)
+	}
+}
+
+// TestWriteIsReproducible checks that a seed and a base time fix every
+// byte of the output, created_at included, for every type.
+func TestWriteIsReproducible(t *testing.T) {
+	generate := func(kind string, base time.Time) []byte {
+		t.Helper()
+		gen, err := New(Options{Type: kind, Seed: 7, Locales: "en", EmailDomains: "example.com", Clock: Clock{Base: base, Step: time.Minute}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := gen.Write(&buf, 50, "json"); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, kind := range Types {
+		t.Run(kind, func(t *testing.T) {
+			first, second := generate(kind, base), generate(kind, base)
+			if !bytes.Equal(first, second) {
+				t.Fatal("two runs with the same seed and base time differ")
+			}
+			var records []struct {
+				CreatedAt string `json:"created_at"`
+			}
+			if err := json.Unmarshal(first, &records); err != nil {
+				t.Fatal(err)
+			}
+			var last time.Time
+			for i, record := range records {
+				at, err := time.Parse(time.RFC3339, record.CreatedAt)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i > 0 && at.Sub(last) != time.Minute {
+					t.Fatalf("record %d created %s after the one before, want one step", i, at.Sub(last))
+				}
+				last = at
+			}
+			if bytes.Equal(first, generate(kind, base.Add(time.Hour))) {
+				t.Error("another base time gave the same output")
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package synth
+
+import (
+	"math/rand"
+	"unicode/utf8"
+)
+
+// unicodePools are fragments that exercise JSON escaping: characters that
+// must be escaped, characters encoding/json escapes by choice, multi-byte
+// UTF-8 and astral-plane runes that need surrogate pairs in \u form.
+var unicodePools = [][]string{
+	{`"`, `\`, `\"`, `'`, `/`},
+	{"😀", "🎬", "📚", "🚀", "👩‍💻", "🇳🇴"},
+	{"東京", "映画", "書籍", "한국어", "中文", "日本語"},
+	{"\u0000", "\u0001", "\t", "\n", "\r", "\u001f", "\u007f"},
+	{"\u00a0", "\u2028", "<", ">", "&", "e\u0301", "\ufeff"},
+}
+
+type unicodeNoise struct {
+	rate float64
+}
+
+// apply inserts one fragment at a random rune boundary with probability
+// rate. It draws from rng only when enabled so seeded output without
+// -unicode-rate is unchanged.
+func (n unicodeNoise) apply(rng *rand.Rand, text string) string {
+	if n.rate <= 0 {
+		return text
+	}
+	if rng.Float64() >= n.rate {
+		return text
+	}
+	pool := unicodePools[rng.Intn(len(unicodePools))]
+	fragment := pool[rng.Intn(len(pool))]
+
+	runes := utf8.RuneCountInString(text)
+	at := rng.Intn(runes + 1)
+	offset := 0
+	for i := 0; i < at; i++ {
+		_, size := utf8.DecodeRuneInString(text[offset:])
+		offset += size
+	}
+	return text[:offset] + fragment + text[offset:]
+}
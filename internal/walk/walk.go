@@ -0,0 +1,180 @@
+// Package walk lists the input files of compress, decompress and
+// train-dict.
+//
+// Only regular files are ever opened. FIFOs, sockets and device nodes, or
+// symlinks to them, are classified from their mode before anything touches
+// their contents: reading a FIFO with no writer blocks forever and reading
+// a device can return endless or destructive data, so they are skipped and
+// counted, or fail the walk, according to a Policy.
+package walk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"zstd-learning/internal/filter"
+	"zstd-learning/internal/lock"
+)
+
+// Policy decides what Files does with a special file.
+type Policy string
+
+const (
+	// Skip leaves special files out and counts them.
+	Skip Policy = "skip"
+	// Error fails the walk at the first special file.
+	Error Policy = "error"
+)
+
+// ParsePolicy validates a -special-files value.
+func ParsePolicy(value string) (Policy, error) {
+	switch Policy(strings.ToLower(strings.TrimSpace(value))) {
+	case Skip:
+		return Skip, nil
+	case Error:
+		return Error, nil
+	}
+	return "", fmt.Errorf("invalid -special-files %q (expected skip or error)", value)
+}
+
+// SpecialError reports a special file where a regular file was expected.
+type SpecialError struct {
+	Path string
+	Kind string
+}
+
+func (e *SpecialError) Error() string {
+	return fmt.Sprintf("%s is a %s, not a regular file", e.Path, e.Kind)
+}
+
+// Kind names the special file type of mode, or returns "" for regular
+// files and directories.
+func Kind(mode fs.FileMode) string {
+	switch {
+	case mode&fs.ModeNamedPipe != 0:
+		return "FIFO"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	case mode&fs.ModeCharDevice != 0:
+		return "character device"
+	case mode&fs.ModeDevice != 0:
+		return "block device"
+	case mode&fs.ModeIrregular != 0:
+		return "irregular file"
+	}
+	return ""
+}
+
+// Files returns the non-empty files under dir that match, sorted, and the
+// number of special files skipped. Symlinks are resolved only to classify
+// their target, and the lock files of internal/lock are never listed.
+func Files(dir string, match *filter.Expr, policy Policy) ([]string, int, error) {
+	return files(dir, match, policy, nil)
+}
+
+// Stamp is the size and modification time of a file as the walk saw it.
+type Stamp struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// StampOf returns the Stamp of info.
+func StampOf(info fs.FileInfo) Stamp {
+	return Stamp{Size: info.Size(), ModTime: info.ModTime()}
+}
+
+// Changed reports whether info, a later stat of the same file, differs
+// from s, which means the file was written to in between.
+func (s Stamp) Changed(info fs.FileInfo) bool {
+	return info.Size() != s.Size || !info.ModTime().Equal(s.ModTime)
+}
+
+// FilesStamped is Files that also returns the Stamp of every listed file,
+// taken from the stat the walk does anyway, so a caller can tell whether a
+// file changed while it was being read without stating it twice. The
+// Stamp of a symlink is that of its target.
+func FilesStamped(dir string, match *filter.Expr, policy Policy) ([]string, map[string]Stamp, int, error) {
+	stamps := map[string]Stamp{}
+	paths, special, err := files(dir, match, policy, stamps)
+	return paths, stamps, special, err
+}
+
+// files is Files, recording the Stamp of each listed file in stamps unless
+// it is nil.
+func files(dir string, match *filter.Expr, policy Policy, stamps map[string]Stamp) ([]string, int, error) {
+	var paths []string
+	special := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() == lock.FileName {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		mode := info.Mode()
+		stamp := StampOf(info)
+		if mode&fs.ModeSymlink != 0 {
+			if target, err := os.Stat(path); err == nil {
+				mode = target.Mode()
+				stamp = StampOf(target)
+			}
+		}
+		if kind := Kind(mode); kind != "" {
+			if policy == Error {
+				return &SpecialError{Path: path, Kind: kind}
+			}
+			special++
+			return nil
+		}
+		if info.Size() == 0 {
+			return nil
+		}
+		if !match.Match(filter.File{Path: path, Info: info}) {
+			return nil
+		}
+		paths = append(paths, path)
+		if stamps != nil {
+			stamps[path] = stamp
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.SkipDir) {
+		return nil, special, err
+	}
+	sort.Strings(paths)
+	return paths, special, nil
+}
+
+// Open opens path for reading after checking that it is not a special
+// file, so a FIFO put in place of a listed file cannot block the caller.
+func Open(path string) (*os.File, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if kind := Kind(info.Mode()); kind != "" {
+		return nil, &SpecialError{Path: path, Kind: kind}
+	}
+	return os.Open(path)
+}
+
+// ReadFile is os.ReadFile with the special file check of Open.
+func ReadFile(path string) ([]byte, error) {
+	f, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
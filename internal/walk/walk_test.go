@@ -0,0 +1,68 @@
+package walk
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"zstd-learning/internal/lock"
+)
+
+func TestParsePolicy(t *testing.T) {
+	for value, want := range map[string]Policy{"skip": Skip, " Error ": Error} {
+		if got, err := ParsePolicy(value); err != nil || got != want {
+			t.Errorf("ParsePolicy(%q) = %q, %v; want %q", value, got, err, want)
+		}
+	}
+	if _, err := ParsePolicy("open"); err == nil {
+		t.Error(`ParsePolicy("open") succeeded`)
+	}
+}
+
+func TestKind(t *testing.T) {
+	tests := []struct {
+		mode fs.FileMode
+		want string
+	}{
+		{0o644, ""},
+		{fs.ModeDir, ""},
+		{fs.ModeNamedPipe, "FIFO"},
+		{fs.ModeSocket, "socket"},
+		{fs.ModeDevice | fs.ModeCharDevice, "character device"},
+		{fs.ModeDevice, "block device"},
+		{fs.ModeIrregular, "irregular file"},
+	}
+	for _, tt := range tests {
+		if got := Kind(tt.mode); got != tt.want {
+			t.Errorf("Kind(%v) = %q, want %q", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"b.json":       "b",
+		"a/c.json":     "c",
+		"a/empty.json": "",
+		lock.FileName:  "{}",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	paths, special, err := Files(dir, nil, Error)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "a", "c.json"), filepath.Join(dir, "b.json")}
+	if !reflect.DeepEqual(paths, want) || special != 0 {
+		t.Errorf("Files = %q, %d special; want %q", paths, special, want)
+	}
+}
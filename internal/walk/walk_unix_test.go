@@ -0,0 +1,54 @@
+//go:build unix
+
+package walk
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// TestFilesNeverOpensAFIFO lists a directory holding a FIFO with no writer
+// and a symlink to it. Opening either would block the test forever.
+func TestFilesNeverOpensAFIFO(t *testing.T) {
+	dir := t.TempDir()
+	fifo := filepath.Join(dir, "pipe.json")
+	if err := syscall.Mkfifo(fifo, 0o644); err != nil {
+		t.Skipf("cannot create a FIFO: %v", err)
+	}
+	if err := os.Symlink(fifo, filepath.Join(dir, "link.json")); err != nil {
+		t.Fatal(err)
+	}
+	regular := filepath.Join(dir, "data.json")
+	if err := os.WriteFile(regular, []byte(`{"a":1}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, special, err := Files(dir, nil, Skip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, []string{regular}) || special != 2 {
+		t.Errorf("Files = %q, %d special; want only %s and 2 special", paths, special, regular)
+	}
+
+	var specialErr *SpecialError
+	if _, _, err := Files(dir, nil, Error); !errors.As(err, &specialErr) || specialErr.Kind != "FIFO" {
+		t.Errorf("with the error policy: got %v, want a SpecialError for a FIFO", err)
+	}
+
+	for _, path := range []string{fifo, filepath.Join(dir, "link.json")} {
+		if f, err := Open(path); !errors.As(err, &specialErr) {
+			if f != nil {
+				f.Close()
+			}
+			t.Errorf("Open(%s) = %v, want a SpecialError", path, err)
+		}
+		if _, err := ReadFile(path); !errors.As(err, &specialErr) {
+			t.Errorf("ReadFile(%s) = %v, want a SpecialError", path, err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Package estimate predicts how well data will compress with zstd, optionally
+// with a dictionary, without writing anything, so a service can decide
+// whether compressing is worth it in-process.
+//
+// Encoders are pooled per level and dictionary (internal/encpool) and reused
+// across calls, and inputs larger than the sample size are estimated from
+// evenly spaced slices of them, which bounds the work per call.
+package estimate
+
+import (
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+
+	"zstd-learning/internal/encpool"
+)
+
+// DefaultSampleBytes is the sample size used when Options.SampleBytes or the
+// sampleBytes argument of EstimateReader is not positive.
+const DefaultSampleBytes = 1 << 20
+
+// sampleSlices is the number of evenly spaced slices a large input is
+// sampled from, so both its start and its end count.
+const sampleSlices = 8
+
+// ErrEmpty is returned for empty input, which has no meaningful ratio.
+var ErrEmpty = errors.New("estimate: empty input")
+
+// Options configures an estimate. The zero value uses the default zstd level,
+// no dictionary and DefaultSampleBytes.
+type Options struct {
+	// Level is the zstd encoder level.
+	Level zstd.EncoderLevel
+	// Dict is an optional zstd dictionary, as written by train-dict. It
+	// must not be modified while estimates with it may run.
+	Dict []byte
+	// SampleBytes caps how much of the input EstimateRatio compresses.
+	SampleBytes int
+}
+
+// EstimateRatio returns the expected output/input size ratio of compressing
+// data with opts, the same ratio compress reports. Data longer than
+// opts.SampleBytes is estimated from a sample of that size. It is safe for
+// concurrent use.
+func EstimateRatio(data []byte, opts Options) (float64, error) {
+	if len(data) == 0 {
+		return 0, ErrEmpty
+	}
+	pool, err := encpool.For(opts.Level, opts.Dict)
+	if err != nil {
+		return 0, err
+	}
+	return ratio(pool, sample(data, sampleSize(opts.SampleBytes)))
+}
+
+// EstimateReader estimates the ratio of the data read from r, reading at most
+// sampleBytes of it (DefaultSampleBytes when not positive). Since r cannot be
+// sampled out of order, the estimate covers its first sampleBytes; opts.
+// SampleBytes is ignored.
+func EstimateReader(r io.Reader, sampleBytes int, opts Options) (float64, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(sampleSize(sampleBytes))))
+	if err != nil {
+		return 0, err
+	}
+	return EstimateRatio(data, opts)
+}
+
+func sampleSize(n int) int {
+	if n <= 0 {
+		return DefaultSampleBytes
+	}
+	return n
+}
+
+// sample returns data when it fits in limit, and otherwise sampleSlices
+// evenly spaced slices of it joined together, limit bytes in all.
+func sample(data []byte, limit int) []byte {
+	if len(data) <= limit {
+		return data
+	}
+	slices := sampleSlices
+	if limit < slices {
+		slices = 1
+	}
+	width := limit / slices
+	stride := (len(data) - width) / max(slices-1, 1)
+	out := make([]byte, 0, width*slices)
+	for i := 0; i < slices; i++ {
+		start := i * stride
+		out = append(out, data[start:start+width]...)
+	}
+	return out
+}
+
+// ratio compresses data with an encoder from pool and returns the size
+// ratio.
+func ratio(pool *encpool.Pool, data []byte) (float64, error) {
+	encoder, err := pool.Get(nil)
+	if err != nil {
+		return 0, err
+	}
+	defer pool.Put(encoder)
+	compressed := encoder.EncodeAll(data, make([]byte, 0, len(data)/2))
+	return float64(len(compressed)) / float64(len(data)), nil
+}
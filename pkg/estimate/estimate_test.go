@@ -0,0 +1,194 @@
+package estimate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+func record(i int) []byte {
+	return fmt.Appendf(nil, `{"id":%d,"name":"user-%d","email":"user-%d@example.com","active":%t}`, i, i%17, i, i%3 == 0)
+}
+
+// records returns JSON lines, at least n bytes of them.
+func records(n int) []byte {
+	var data bytes.Buffer
+	for i := 0; data.Len() < n; i++ {
+		data.Write(record(i))
+		data.WriteByte('\n')
+	}
+	return data.Bytes()
+}
+
+var trainDict = sync.OnceValues(func() ([]byte, error) {
+	var samples [][]byte
+	for i := 0; i < 300; i++ {
+		samples = append(samples, record(i))
+	}
+	return dict.BuildZstdDict(samples, dict.Options{MaxDictSize: 4096, HashBytes: 6, ZstdDictID: 42})
+})
+
+func testDict(tb testing.TB) []byte {
+	tb.Helper()
+	d, err := trainDict()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return d
+}
+
+func TestEstimateRatio(t *testing.T) {
+	// A single short record does not compress on its own; a dictionary
+	// trained on records like it makes the difference.
+	one := record(1000)
+	plain, err := EstimateRatio(one, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	withDict, err := EstimateRatio(one, Options{Dict: testDict(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain < 0.9 {
+		t.Errorf("without a dictionary, ratio %.3f for one record, want at least 0.9", plain)
+	}
+	if withDict >= plain*0.7 {
+		t.Errorf("with a dictionary, ratio %.3f, want well under %.3f", withDict, plain)
+	}
+
+	// The estimate is the ratio compress would get.
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderDict(testDict(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	if want := float64(len(encoder.EncodeAll(one, nil))) / float64(len(one)); withDict != want {
+		t.Errorf("with a dictionary, ratio %.4f, want %.4f", withDict, want)
+	}
+
+	repetitive, err := EstimateRatio(records(256<<10), Options{Level: zstd.SpeedBetterCompression})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repetitive > 0.3 {
+		t.Errorf("ratio %.3f for 256 KiB of records, want at most 0.3", repetitive)
+	}
+}
+
+func TestEstimateRatioErrors(t *testing.T) {
+	if _, err := EstimateRatio(nil, Options{}); !errors.Is(err, ErrEmpty) {
+		t.Errorf("empty input: got %v, want ErrEmpty", err)
+	}
+	if _, err := EstimateRatio([]byte("data"), Options{Dict: []byte("not a dictionary")}); err == nil {
+		t.Error("an invalid dictionary was accepted")
+	}
+	if _, err := EstimateReader(strings.NewReader(""), 0, Options{}); !errors.Is(err, ErrEmpty) {
+		t.Errorf("empty reader: got %v, want ErrEmpty", err)
+	}
+}
+
+func TestEstimateReader(t *testing.T) {
+	data := records(64 << 10)
+	// The reader is cut at sampleBytes, so the estimate is that of the
+	// prefix, whatever follows it.
+	r := &countingReader{r: bytes.NewReader(append(bytes.Clone(data[:4096]), bytes.Repeat([]byte{0xff}, 1<<20)...))}
+	got, err := EstimateReader(r, 4096, Options{Dict: testDict(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := EstimateRatio(data[:4096], Options{Dict: testDict(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("ratio %.4f, want %.4f for the first 4096 bytes", got, want)
+	}
+	if r.n > 4096+512 {
+		t.Errorf("read %d bytes for a 4096-byte sample", r.n)
+	}
+}
+
+type countingReader struct {
+	r *bytes.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestSample(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	tests := []struct {
+		limit int
+		want  int
+	}{
+		{1000, 1000},
+		{2000, 1000},
+		{800, 800},
+		{803, 800},
+		{5, 5},
+	}
+	for _, tt := range tests {
+		got := sample(data, tt.limit)
+		if len(got) != tt.want {
+			t.Errorf("sample(1000 bytes, %d) has %d bytes, want %d", tt.limit, len(got), tt.want)
+		}
+	}
+	// Both ends of the input are sampled: the slices are 10 bytes wide and
+	// the last one ends within a slice width of the end.
+	got := sample(data[:250], 80)
+	if got[0] != 0 || got[len(got)-1] < 250-10 {
+		t.Errorf("sample of 250 bytes starts with %d and ends with %d", got[0], got[len(got)-1])
+	}
+}
+
+var benchSizes = []int{4 << 10, 64 << 10, 1 << 20, 16 << 20}
+
+func BenchmarkEstimateRatio(b *testing.B) {
+	d := testDict(b)
+	for _, size := range benchSizes {
+		data := records(size)[:size]
+		for _, mode := range []struct {
+			name string
+			opts Options
+		}{
+			{"plain", Options{}},
+			{"dict", Options{Dict: d}},
+		} {
+			b.Run(fmt.Sprintf("%s/%dKiB", mode.name, size>>10), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				for b.Loop() {
+					if _, err := EstimateRatio(data, mode.opts); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkEstimateReader(b *testing.B) {
+	data := records(16 << 20)
+	for _, sampleBytes := range benchSizes {
+		b.Run(fmt.Sprintf("%dKiB", sampleBytes>>10), func(b *testing.B) {
+			b.SetBytes(int64(sampleBytes))
+			for b.Loop() {
+				if _, err := EstimateReader(bytes.NewReader(data), sampleBytes, Options{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
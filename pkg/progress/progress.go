@@ -0,0 +1,78 @@
+// Package progress defines the events compress, decompress and train-dict
+// write with -progress-json, so a workflow engine driving them can follow a
+// run without parsing the human output.
+//
+// Events are JSON lines, one Event per line. A run writes one RunStart,
+// then Progress events at -progress-interval while work is done and a File
+// event per file it finishes, and ends with one RunEnd, which is also
+// written when the run fails. Fields are left out when they are zero, so a
+// consumer reads an absent field as 0 or "". Fields are only ever added
+// within a Version; a change that alters the meaning of one bumps it.
+//
+//	dec := json.NewDecoder(stream)
+//	for {
+//		var ev progress.Event
+//		if err := dec.Decode(&ev); err != nil {
+//			break
+//		}
+//		if ev.V != progress.Version { ... }
+//		switch ev.Type { ... }
+//	}
+package progress
+
+import "time"
+
+// Version is the schema version written in Event.V.
+const Version = 1
+
+// Type says which kind of event a line is.
+type Type string
+
+const (
+	// RunStart opens a run. TotalFiles and TotalBytes hold what it is
+	// about to process, when known.
+	RunStart Type = "run-start"
+	// Progress reports Files, InputBytes and OutputBytes done so far, and
+	// with train-dict the Phase being worked on.
+	Progress Type = "progress"
+	// File reports one finished file: its Path, InputBytes, OutputBytes
+	// and Status.
+	File Type = "file"
+	// RunEnd closes a run with the same totals as Progress, its Status,
+	// ExitCode and Seconds.
+	RunEnd Type = "run-end"
+)
+
+// Statuses of File and RunEnd events.
+const (
+	StatusOK = "ok"
+	// StatusUnstable marks a file compress saw change while it was being
+	// compressed.
+	StatusUnstable = "unstable"
+	// StatusSkipped marks a file left alone, such as a complete output
+	// with decompress -resume.
+	StatusSkipped = "skipped"
+	StatusFailed  = "failed"
+)
+
+// Event is one line of a -progress-json stream.
+type Event struct {
+	V       int       `json:"v"`
+	Type    Type      `json:"type"`
+	Time    time.Time `json:"t"`
+	Command string    `json:"cmd"`
+	RunID   string    `json:"run_id,omitempty"`
+
+	TotalFiles int   `json:"total_files,omitempty"`
+	TotalBytes int64 `json:"total_bytes,omitempty"`
+
+	Phase       string `json:"phase,omitempty"`
+	Files       int    `json:"files,omitempty"`
+	InputBytes  int64  `json:"in,omitempty"`
+	OutputBytes int64  `json:"out,omitempty"`
+
+	Path     string  `json:"path,omitempty"`
+	Status   string  `json:"status,omitempty"`
+	ExitCode int     `json:"exit_code,omitempty"`
+	Seconds  float64 `json:"secs,omitempty"`
+}
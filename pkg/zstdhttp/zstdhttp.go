@@ -0,0 +1,415 @@
+// Package zstdhttp provides HTTP middleware that negotiates zstd (or gzip)
+// response compression and transparently decodes compressed request bodies.
+//
+// A decoded request body is limited to Options.MaxRequestBodySize, since a
+// few kilobytes of zstd can expand to gigabytes. A handler reading past the
+// limit gets an *http.MaxBytesError, as with http.MaxBytesReader, and
+// should answer 413 Request Entity Too Large.
+package zstdhttp
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	encodingZstd     = "zstd"
+	encodingGzip     = "gzip"
+	encodingIdentity = "identity"
+)
+
+// DefaultMaxRequestBodySize is the decoded request body limit used when
+// Options.MaxRequestBodySize is 0.
+const DefaultMaxRequestBodySize = 32 << 20
+
+// Options configures the middleware. The zero value compresses with the
+// default zstd level, falls back to gzip and uses no dictionaries.
+type Options struct {
+	// Level is the zstd encoder level used for responses.
+	Level zstd.EncoderLevel
+	// EncoderDict is an optional dictionary used for zstd responses. Only set
+	// it when every client is known to hold the same dictionary.
+	EncoderDict []byte
+	// DecoderDicts are dictionaries accepted when decoding zstd request bodies.
+	DecoderDicts [][]byte
+	// DisableGzip stops the middleware from falling back to gzip.
+	DisableGzip bool
+	// SkipContentTypes lists media type prefixes that are already compressed
+	// and are passed through untouched. Nil uses DefaultSkipContentTypes.
+	SkipContentTypes []string
+	// MaxRequestBodySize caps the decoded size of a compressed request body.
+	// 0 uses DefaultMaxRequestBodySize and a negative value removes the
+	// limit. Bodies sent without Content-Encoding are not limited.
+	MaxRequestBodySize int64
+}
+
+// DefaultSkipContentTypes are media type prefixes that rarely benefit from a
+// second round of compression.
+var DefaultSkipContentTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zstd",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/x-7z-compressed",
+	"application/x-xz",
+	"application/x-bzip2",
+}
+
+// Middleware wraps handlers with content-encoding negotiation. It owns pools
+// of encoders and decoders, so a single instance should be shared.
+type Middleware struct {
+	opts     Options
+	zstdPool sync.Pool
+	gzipPool sync.Pool
+	decPool  sync.Pool
+}
+
+// New validates the options by building one encoder and one decoder up front,
+// so misconfigured dictionaries fail at startup rather than per request.
+func New(opts Options) (*Middleware, error) {
+	if opts.Level == 0 {
+		opts.Level = zstd.SpeedDefault
+	}
+	if opts.SkipContentTypes == nil {
+		opts.SkipContentTypes = DefaultSkipContentTypes
+	}
+	if opts.MaxRequestBodySize == 0 {
+		opts.MaxRequestBodySize = DefaultMaxRequestBodySize
+	}
+	m := &Middleware{opts: opts}
+
+	encoder, err := m.newEncoder()
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := m.newDecoder()
+	if err != nil {
+		encoder.Close()
+		return nil, err
+	}
+	m.zstdPool.Put(encoder)
+	m.decPool.Put(decoder)
+	return m, nil
+}
+
+// Handler wraps next with the middleware.
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release, err := m.decodeRequest(w, r)
+		if err != nil {
+			var unsupported unsupportedEncodingError
+			switch {
+			case errors.As(err, &unsupported):
+				http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			case errors.Is(err, errMalformedBody):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		defer release()
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := m.negotiate(r.Header.Get("Accept-Encoding"))
+		if encoding == encodingIdentity || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &responseWriter{ResponseWriter: w, m: m, encoding: encoding}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// Handler is a convenience wrapper for one-off use of the middleware.
+func Handler(next http.Handler, opts Options) (http.Handler, error) {
+	m, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+	return m.Handler(next), nil
+}
+
+func (m *Middleware) newEncoder() (*zstd.Encoder, error) {
+	options := []zstd.EOption{
+		zstd.WithEncoderLevel(m.opts.Level),
+		zstd.WithEncoderConcurrency(1),
+		// RFC 9659 caps the window for HTTP content coding at 8 MB.
+		zstd.WithWindowSize(8 << 20),
+	}
+	if len(m.opts.EncoderDict) > 0 {
+		options = append(options, zstd.WithEncoderDict(m.opts.EncoderDict))
+	}
+	return zstd.NewWriter(nil, options...)
+}
+
+func (m *Middleware) newDecoder() (*zstd.Decoder, error) {
+	options := []zstd.DOption{
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderMaxWindow(8 << 20),
+	}
+	if len(m.opts.DecoderDicts) > 0 {
+		options = append(options, zstd.WithDecoderDicts(m.opts.DecoderDicts...))
+	}
+	return zstd.NewReader(nil, options...)
+}
+
+func (m *Middleware) getEncoder(w io.Writer) (*zstd.Encoder, error) {
+	if encoder, ok := m.zstdPool.Get().(*zstd.Encoder); ok {
+		encoder.Reset(w)
+		return encoder, nil
+	}
+	encoder, err := m.newEncoder()
+	if err != nil {
+		return nil, err
+	}
+	encoder.Reset(w)
+	return encoder, nil
+}
+
+func (m *Middleware) getDecoder(r io.Reader) (*zstd.Decoder, error) {
+	decoder, ok := m.decPool.Get().(*zstd.Decoder)
+	if !ok {
+		var err error
+		decoder, err = m.newDecoder()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Reset reads the frame header, so it fails on a body that is not zstd.
+	if err := decoder.Reset(r); err != nil {
+		decoder.Close()
+		return nil, fmt.Errorf("%w: %v", errMalformedBody, err)
+	}
+	return decoder, nil
+}
+
+func (m *Middleware) getGzip(w io.Writer) *gzip.Writer {
+	if writer, ok := m.gzipPool.Get().(*gzip.Writer); ok {
+		writer.Reset(w)
+		return writer
+	}
+	return gzip.NewWriter(w)
+}
+
+// errMalformedBody reports a compressed request body that cannot be
+// decoded.
+var errMalformedBody = errors.New("malformed request body")
+
+type unsupportedEncodingError string
+
+func (e unsupportedEncodingError) Error() string {
+	return "unsupported Content-Encoding: " + string(e)
+}
+
+// decodeRequest replaces a compressed r.Body with its decoded, size-limited
+// form and returns a function that returns the decoder to its pool.
+func (m *Middleware) decodeRequest(w http.ResponseWriter, r *http.Request) (func(), error) {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	var decoded io.Reader
+	var release func()
+	switch encoding {
+	case "", encodingIdentity:
+		return func() {}, nil
+	case encodingZstd:
+		decoder, err := m.getDecoder(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		decoded = decoder
+		release = func() {
+			decoder.Reset(nil)
+			m.decPool.Put(decoder)
+		}
+	case encodingGzip:
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errMalformedBody, err)
+		}
+		decoded = reader
+		release = func() { reader.Close() }
+	default:
+		return nil, unsupportedEncodingError(encoding)
+	}
+
+	body := r.Body
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{decoded, body}
+	if m.opts.MaxRequestBodySize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, m.opts.MaxRequestBodySize)
+	}
+	stripRequestEncoding(r)
+	return release, nil
+}
+
+func stripRequestEncoding(r *http.Request) {
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+}
+
+// negotiate picks zstd, then gzip, then identity from an Accept-Encoding
+// header, honoring q-values and the "*" wildcard.
+func (m *Middleware) negotiate(header string) string {
+	weights := parseAcceptEncoding(header)
+	best := encodingIdentity
+	bestQ := 0.0
+	for _, candidate := range []string{encodingZstd, encodingGzip} {
+		if candidate == encodingGzip && m.opts.DisableGzip {
+			continue
+		}
+		q, ok := weights[candidate]
+		if !ok {
+			q, ok = weights["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = candidate, q
+		}
+	}
+	return best
+}
+
+func parseAcceptEncoding(header string) map[string]float64 {
+	weights := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || strings.TrimSpace(key) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err == nil {
+				q = parsed
+			}
+		}
+		weights[name] = q
+	}
+	return weights
+}
+
+func (m *Middleware) skipContentType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, prefix := range m.opts.SkipContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	m           *Middleware
+	encoding    string
+	writer      io.WriteCloser
+	release     func()
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	header := w.Header()
+	if w.shouldCompress(status, header) {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", w.encoding)
+		w.startEncoder()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.writer != nil {
+		return w.writer.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *responseWriter) Flush() {
+	if flusher, ok := w.writer.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *responseWriter) shouldCompress(status int, header http.Header) bool {
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	// A handler that already encoded its body must not be encoded twice.
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	return !w.m.skipContentType(header.Get("Content-Type"))
+}
+
+func (w *responseWriter) startEncoder() {
+	switch w.encoding {
+	case encodingZstd:
+		encoder, err := w.m.getEncoder(w.ResponseWriter)
+		if err != nil {
+			w.Header().Del("Content-Encoding")
+			return
+		}
+		w.writer = encoder
+		w.release = func() {
+			// Pooled writers must not keep the finished response alive.
+			encoder.Reset(nil)
+			w.m.zstdPool.Put(encoder)
+		}
+	case encodingGzip:
+		writer := w.m.getGzip(w.ResponseWriter)
+		w.writer = writer
+		w.release = func() {
+			writer.Reset(io.Discard)
+			w.m.gzipPool.Put(writer)
+		}
+	}
+}
+
+func (w *responseWriter) close() error {
+	if w.writer == nil {
+		return nil
+	}
+	err := w.writer.Close()
+	w.release()
+	w.writer = nil
+	return err
+}
@@ -0,0 +1,310 @@
+package zstdhttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+var body = strings.Repeat(`{"id": 1, "title": "The Ninth Signal", "genres": ["scifi", "drama"]}`+"\n", 200)
+
+// serve runs a request through the middleware in front of next.
+func serve(t *testing.T, opts Options, next http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	handler, err := Handler(next, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	return rec
+}
+
+func textHandler(contentType string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		io.WriteString(w, body)
+	})
+}
+
+// decodeBody decodes a response body in the given content coding.
+func decodeBody(t *testing.T, encoding string, data []byte) string {
+	t.Helper()
+	switch encoding {
+	case "":
+		return string(data)
+	case "zstd":
+		decoder, err := zstd.NewReader(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer decoder.Close()
+		plain, err := decoder.DecodeAll(data, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(plain)
+	case "gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(plain)
+	}
+	t.Fatalf("unexpected Content-Encoding %q", encoding)
+	return ""
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept      string
+		disableGzip bool
+		want        string
+	}{
+		{"", false, ""},
+		{"zstd", false, "zstd"},
+		{"gzip, deflate, br", false, "gzip"},
+		{"gzip, zstd", false, "zstd"},
+		{"GZIP;q=0.8, Zstd;q=0.5", false, "gzip"},
+		{"zstd;q=0, gzip", false, "gzip"},
+		{"zstd;q=0, gzip;q=0", false, ""},
+		{"*", false, "zstd"},
+		{"*;q=0.5, zstd;q=0", false, "gzip"},
+		{"identity", false, ""},
+		{"gzip", true, ""},
+		{"zstd;q=0.1, gzip", true, "zstd"},
+		{"zstd; q=bogus", false, "zstd"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept-Encoding", tt.accept)
+		}
+		rec := serve(t, Options{DisableGzip: tt.disableGzip}, textHandler("application/json"), r)
+		got := rec.Header().Get("Content-Encoding")
+		if got != tt.want {
+			t.Errorf("Accept-Encoding %q (gzip disabled %v): got %q, want %q", tt.accept, tt.disableGzip, got, tt.want)
+			continue
+		}
+		if vary := rec.Header().Values("Vary"); len(vary) != 1 || vary[0] != "Accept-Encoding" {
+			t.Errorf("Accept-Encoding %q: Vary %q", tt.accept, vary)
+		}
+		if plain := decodeBody(t, got, rec.Body.Bytes()); plain != body {
+			t.Errorf("Accept-Encoding %q: body does not round-trip", tt.accept)
+		}
+	}
+}
+
+func TestSkipsResponses(t *testing.T) {
+	preEncoded := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		io.WriteString(w, "already brotli")
+	})
+	noContent := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	tests := []struct {
+		name    string
+		opts    Options
+		handler http.Handler
+		method  string
+		want    string
+	}{
+		{"image", Options{}, textHandler("image/png"), http.MethodGet, ""},
+		{"zstd archive", Options{}, textHandler("application/zstd"), http.MethodGet, ""},
+		{"case-insensitive type", Options{}, textHandler("Video/MP4"), http.MethodGet, ""},
+		{"custom skip list", Options{SkipContentTypes: []string{"application/json"}}, textHandler("application/json"), http.MethodGet, ""},
+		{"custom list replaces default", Options{SkipContentTypes: []string{"application/json"}}, textHandler("image/png"), http.MethodGet, "zstd"},
+		{"sniffed text", Options{}, textHandler(""), http.MethodGet, "zstd"},
+		{"already encoded", Options{}, preEncoded, http.MethodGet, "br"},
+		{"no content", Options{}, noContent, http.MethodGet, ""},
+		{"head", Options{}, textHandler("text/plain"), http.MethodHead, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/", nil)
+		r.Header.Set("Accept-Encoding", "zstd")
+		rec := serve(t, tt.opts, tt.handler, r)
+		if got := rec.Header().Get("Content-Encoding"); got != tt.want {
+			t.Errorf("%s: Content-Encoding %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPooledEncodersAcrossRequests(t *testing.T) {
+	m, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, r.URL.Query().Get("n")+body)
+	})))
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n := strings.Repeat("x", i)
+			encoding := []string{"zstd", "gzip"}[i%2]
+			req, _ := http.NewRequest(http.MethodGet, server.URL+"/?n="+n, nil)
+			req.Header.Set("Accept-Encoding", encoding)
+			resp, err := http.DefaultTransport.RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			data, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != encoding {
+				t.Errorf("request %d: Content-Encoding %q, want %q", i, got, encoding)
+				return
+			}
+			if plain := decodeBody(t, encoding, data); plain != n+body {
+				t.Errorf("request %d: got another response's body", i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// echo answers with the request body it read, or the error reading it as
+// the status its type calls for.
+func echo(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "zstd", "gzip":
+		http.Error(w, "Content-Encoding left on a decoded body", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
+
+func zstdBody(t *testing.T, data, dictionary []byte) []byte {
+	t.Helper()
+	var options []zstd.EOption
+	if dictionary != nil {
+		options = append(options, zstd.WithEncoderDict(dictionary))
+	}
+	encoder, err := zstd.NewWriter(nil, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	return encoder.EncodeAll(data, nil)
+}
+
+func gzipBody(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	writer.Write(data)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeRequest(t *testing.T) {
+	plain := []byte(body)
+	large := bytes.Repeat([]byte("a"), 1<<20)
+	tests := []struct {
+		name     string
+		opts     Options
+		encoding string
+		data     []byte
+		status   int
+		want     []byte
+	}{
+		{"zstd", Options{}, "zstd", zstdBody(t, plain, nil), http.StatusOK, plain},
+		{"gzip", Options{}, "gzip", gzipBody(t, plain), http.StatusOK, plain},
+		{"identity", Options{}, "identity", plain, http.StatusOK, plain},
+		{"encoding in upper case", Options{}, " ZSTD ", zstdBody(t, plain, nil), http.StatusOK, plain},
+		{"unsupported", Options{}, "br", plain, http.StatusUnsupportedMediaType, nil},
+		{"malformed gzip", Options{}, "gzip", plain, http.StatusBadRequest, nil},
+		{"malformed zstd", Options{}, "zstd", plain, http.StatusBadRequest, nil},
+		{"truncated zstd", Options{}, "zstd", zstdBody(t, large, nil)[:40], http.StatusBadRequest, nil},
+		{"zstd at the limit", Options{MaxRequestBodySize: 1 << 20}, "zstd", zstdBody(t, large, nil), http.StatusOK, large},
+		{"zstd over the limit", Options{MaxRequestBodySize: 1<<20 - 1}, "zstd", zstdBody(t, large, nil), http.StatusRequestEntityTooLarge, nil},
+		{"gzip over the limit", Options{MaxRequestBodySize: 1 << 10}, "gzip", gzipBody(t, large), http.StatusRequestEntityTooLarge, nil},
+		{"zstd over the default limit", Options{}, "zstd", zstdBody(t, make([]byte, DefaultMaxRequestBodySize+1), nil), http.StatusRequestEntityTooLarge, nil},
+		{"no limit", Options{MaxRequestBodySize: -1}, "zstd", zstdBody(t, make([]byte, DefaultMaxRequestBodySize+1), nil), http.StatusOK, make([]byte, DefaultMaxRequestBodySize+1)},
+		{"plain body is not limited", Options{MaxRequestBodySize: 10}, "", plain, http.StatusOK, plain},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(tt.data))
+		r.Header.Set("Content-Encoding", tt.encoding)
+		rec := serve(t, tt.opts, http.HandlerFunc(echo), r)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d (%s)", tt.name, rec.Code, tt.status, strings.TrimSpace(rec.Body.String()))
+			continue
+		}
+		if tt.want != nil && !bytes.Equal(rec.Body.Bytes(), tt.want) {
+			t.Errorf("%s: handler read %d bytes, want %d", tt.name, rec.Body.Len(), len(tt.want))
+		}
+	}
+}
+
+func TestDecodeRequestWithDictionary(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 200; i++ {
+		samples = append(samples, []byte(fmt.Sprintf(`{"id": %d, "title": "Signal %d", "genres": ["scifi", "drama"]}`, i, i%7)))
+	}
+	trained, err := dict.BuildZstdDict(samples, dict.Options{MaxDictSize: 2048, HashBytes: 6, ZstdDictID: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte(body)
+
+	tests := []struct {
+		name   string
+		opts   Options
+		status int
+	}{
+		{"known dictionary", Options{DecoderDicts: [][]byte{trained}}, http.StatusOK},
+		{"unknown dictionary", Options{}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(zstdBody(t, plain, trained)))
+		r.Header.Set("Content-Encoding", "zstd")
+		rec := serve(t, tt.opts, http.HandlerFunc(echo), r)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.status)
+			continue
+		}
+		if tt.status == http.StatusOK && !bytes.Equal(rec.Body.Bytes(), plain) {
+			t.Errorf("%s: body does not round-trip", tt.name)
+		}
+	}
+}